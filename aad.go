@@ -0,0 +1,45 @@
+package dkeyczar
+
+// Associated data binds caller supplied context, like a tenant or record ID,
+// into the authentication of a ciphertext, so a ciphertext moved to another
+// record doesn't decrypt there.  It is not stored in the ciphertext: the
+// decrypting side supplies it again.  AES keys add it to the HMAC input
+// (followed by its length), ChaCha20-Poly1305 and X25519 keys to the AEAD
+// additional data after the header, and RSA keys use it as the OAEP label.
+// Empty associated data is the same as none, so ciphertexts made by Encrypt
+// decrypt with DecryptWithAAD and no associated data, and the other way round.
+
+// An AADEncrypter encrypts with associated data.  The Encrypters and Crypters made from
+// AES, ChaCha20-Poly1305, X25519 and RSA key sets are AADEncrypters.
+type AADEncrypter interface {
+	// EncryptWithAAD returns the encrypted string of the plaintext, authenticating aad along with it
+	EncryptWithAAD(plaintext []byte, aad []byte) (string, error)
+}
+
+// An AADCrypter encrypts and decrypts with associated data.  The Crypters made from
+// AES, ChaCha20-Poly1305, X25519 and RSA key sets are AADCrypters.
+type AADCrypter interface {
+	AADEncrypter
+	// DecryptWithAAD returns the plaintext of a ciphertext made with the same aad.
+	// A different aad fails the same way as a modified ciphertext.
+	DecryptWithAAD(ciphertext string, aad []byte) ([]byte, error)
+}
+
+// EncryptWithAAD encrypts plaintext with the primary key, authenticating aad along with it
+func (kc *keyEncrypter) EncryptWithAAD(plaintext []byte, aad []byte) (string, error) {
+	start := kc.startTimer()
+	key, err := kc.kz.primaryKey()
+	if err != nil {
+		kc.observe(OP_ENCRYPT, start, kc.kz, nil, err)
+		return "", err
+	}
+	s, err := kc.encryptWithKey(key, plaintext, aad)
+	kc.observe(OP_ENCRYPT, start, kc.kz, key, err)
+	return s, err
+}
+
+// DecryptWithAAD decrypts a ciphertext made by EncryptWithAAD with the same aad
+func (kc *keyCrypter) DecryptWithAAD(ciphertext string, aad []byte) ([]byte, error) {
+	plaintext, _, err := kc.decrypt(ciphertext, aad)
+	return plaintext, err
+}
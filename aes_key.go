@@ -6,16 +6,17 @@ There are two main types in use: fooKey and fooKeyJSON
 The fooKeyJSON match the on-disk representation of stored keys.  The fooKey
 store just the key material.  There are routines for converting back and forth
 between these two types.
-There are types for AES+HMAC, HMAC, RSA and RSA Public, DSA and DSA Public.
+There are types for AES+HMAC, HMAC, RSA and RSA Public, DSA and DSA Public, EC and EC Public,
+Ed25519 and Ed25519 Public, X25519 and X25519 Public, ChaCha20-Poly1305.
 */
 import (
 	"crypto/aes"
 	"crypto/cipher"
-	"crypto/rand"
 	"crypto/sha1"
 	"encoding/binary"
 	"encoding/json"
 	"io"
+	"sync"
 )
 
 type aesKeyJSON struct {
@@ -29,9 +30,15 @@ type aesKey struct {
 	key  []byte
 	hmac *hmacKey
 	id   []byte
+	randSource
+
+	// the expanded key, built on first use.  A cipher.Block is safe for concurrent use.
+	once     sync.Once
+	block    cipher.Block
+	blockErr error
 }
 
-func generateAESKey(size uint) (*aesKey, error) {
+func generateAESKey(size uint, rng io.Reader) (*aesKey, error) {
 	ak := new(aesKey)
 	if size == 0 {
 		size = T_AES.defaultSize()
@@ -40,8 +47,15 @@ func generateAESKey(size uint) (*aesKey, error) {
 		return nil, ErrInvalidKeySize
 	}
 	ak.key = make([]byte, size/8)
-	io.ReadFull(rand.Reader, ak.key)
-	ak.hmac, _ = generateHMACKey()
+	if _, err := io.ReadFull(rng, ak.key); err != nil {
+		return nil, err
+	}
+	hk, err := generateHMACKey(rng)
+	if err != nil {
+		wipeBytes(ak.key)
+		return nil, err
+	}
+	ak.hmac = hk
 	return ak, nil
 }
 
@@ -54,18 +68,32 @@ func (ak *aesKey) packedKeys() []byte {
 // this is used for session encryption
 // unpack the b array and return a new aes+hmac struct
 func newAESFromPackedKeys(b []byte) (*aesKey, error) {
-	keys := lenPrefixUnpack(b)
+	keys, err := lenPrefixUnpack(b)
+	if err != nil {
+		return nil, err
+	}
 	if len(keys) != 2 || !T_AES.isAcceptableSize(uint(len(keys[0]))*8) || !T_HMAC_SHA1.isAcceptableSize(uint(len(keys[1]))*8) {
 		return nil, ErrInvalidKeySize
 	}
 	ak := new(aesKey)
 	ak.hmac = &hmacKey{key: keys[1]}
-	// FIXME: make+copy? I think we're safe if lPU gives us 'fresh' data
 	ak.key = keys[0]
 	ak.hmac.key = keys[1]
 	return ak, nil
 }
 
+func (ak *aesKey) blockCipher() (cipher.Block, error) {
+	ak.once.Do(func() { ak.block, ak.blockErr = aes.NewCipher(ak.key) })
+	return ak.block, ak.blockErr
+}
+
+// both the aes and hmac keys, so the derived keys depend on all of the key
+func (ak *aesKey) secret() []byte {
+	s := make([]byte, 0, len(ak.key)+len(ak.hmac.key))
+	s = append(s, ak.key...)
+	return append(s, ak.hmac.key...)
+}
+
 func (ak *aesKey) KeyID() []byte {
 	if len(ak.id) != 0 {
 		return ak.id
@@ -93,13 +121,12 @@ func newAESKeyFromJSON(s []byte) (*aesKey, error) {
 	if err != nil {
 		return nil, ErrBase64Decoding
 	}
-	if !T_HMAC_SHA1.isAcceptableSize(aesjson.HMACKey.Size) {
+	// the sizes were checked, so a key of its size is long enough
+	if uint(len(ak.key))*8 != aesjson.Size {
 		return nil, ErrInvalidKeySize
 	}
-	ak.hmac = &hmacKey{}
-	ak.hmac.key, err = decodeWeb64String(aesjson.HMACKey.HMACKeyString)
-	if err != nil {
-		return nil, ErrBase64Decoding
+	if ak.hmac, err = newHMACKeyFromParsedJSON(&aesjson.HMACKey); err != nil {
+		return nil, err
 	}
 	return ak, nil
 }
@@ -122,38 +149,77 @@ func (ak *aesKey) ToKeyJSON() []byte {
 }
 
 func (ak *aesKey) Encrypt(data []byte) ([]byte, error) {
-	data = pkcs5pad(data, aes.BlockSize)
-	iv := make([]byte, aes.BlockSize)
-	io.ReadFull(rand.Reader, iv)
-	aesCipher, err := aes.NewCipher(ak.key)
+	return ak.appendEncrypt(nil, data)
+}
+
+func (ak *aesKey) encryptWithAAD(data []byte, aad []byte) ([]byte, error) {
+	return ak.appendEncryptWithAAD(nil, data, aad)
+}
+
+// the HMAC input: the header, iv and ciphertext, then any associated data and its length
+func aesMACInput(msg []byte, aad []byte) []byte {
+	if len(aad) == 0 {
+		return msg
+	}
+	in := make([]byte, 0, len(msg)+len(aad)+8)
+	in = append(append(in, msg...), aad...)
+	var l [8]byte
+	binary.BigEndian.PutUint64(l[:], uint64(len(aad)))
+	return append(in, l[:]...)
+}
+
+// encrypt data and append the ciphertext to dst.  The padded plaintext is
+// encrypted in place in the output, so no other buffers are needed.
+func (ak *aesKey) appendEncrypt(dst []byte, data []byte) ([]byte, error) {
+	return ak.appendEncryptWithAAD(dst, data, nil)
+}
+
+func (ak *aesKey) appendEncryptWithAAD(dst []byte, data []byte, aad []byte) ([]byte, error) {
+	aesCipher, err := ak.blockCipher()
 	if err != nil {
 		return nil, err
 	}
+	pad := aes.BlockSize - len(data)%aes.BlockSize
+	n := kzHeaderLength + aes.BlockSize + len(data) + pad + hmacSigLength
+	if cap(dst)-len(dst) < n {
+		ndst := make([]byte, len(dst), len(dst)+n)
+		copy(ndst, dst)
+		dst = ndst
+	}
+	msg := dst[len(dst) : len(dst)+n-hmacSigLength]
+	msg[0] = kzVersion
+	copy(msg[1:kzHeaderLength], ak.KeyID())
+	iv := msg[kzHeaderLength : kzHeaderLength+aes.BlockSize]
+	if _, err := io.ReadFull(ak.random(), iv); err != nil {
+		return nil, err
+	}
+	cipherBytes := msg[kzHeaderLength+aes.BlockSize:]
+	copy(cipherBytes, data)
+	for i := len(data); i < len(cipherBytes); i++ {
+		cipherBytes[i] = uint8(pad)
+	}
 	// aes only ever created with CBC as a mode
 	crypter := cipher.NewCBCEncrypter(aesCipher, iv)
-	cipherBytes := make([]byte, len(data))
-	crypter.CryptBlocks(cipherBytes, data)
-	h := makeHeader(ak)
-	msg := make([]byte, 0, kzHeaderLength+aes.BlockSize+len(cipherBytes)+hmacSigLength)
-	msg = append(msg, h...)
-	msg = append(msg, iv...)
-	msg = append(msg, cipherBytes...)
+	crypter.CryptBlocks(cipherBytes, cipherBytes)
 	// we sign the header, iv, and ciphertext
-	sig, err := ak.hmac.Sign(msg)
+	sig, err := ak.hmac.Sign(aesMACInput(msg, aad))
 	if err != nil {
 		return nil, err
 	}
-	msg = append(msg, sig...)
-	return msg, nil
+	return append(dst[:len(dst)+len(msg)], sig...), nil
+}
+
+func (ak *aesKey) iv(ciphertext []byte) []byte {
+	return ciphertext[kzHeaderLength : kzHeaderLength+aes.BlockSize]
 }
 
 func (ak *aesKey) EncryptWriter(sink io.Writer) (io.WriteCloser, error) {
 	signerCloser := ak.hmac.SignWriter(sink)
 	iv := make([]byte, aes.BlockSize)
-	if _, err := io.ReadFull(rand.Reader, iv); err != nil {
+	if _, err := io.ReadFull(ak.random(), iv); err != nil {
 		return nil, err
 	}
-	aesCipher, err := aes.NewCipher(ak.key)
+	aesCipher, err := ak.blockCipher()
 	if err != nil {
 		return nil, err
 	}
@@ -177,31 +243,49 @@ The data array should contain the following fields:
 |header|iv|ciphertext|signature|
 with lengths
 |kzHeaderLength|aes.BlockSize|<unknown>|hmacSigLength|
-The expressions could probably be simplified.
+
+authenticate checks the signature over header, iv and ciphertext, and only then
+hands out the iv and ciphertext.  Decrypt gets at them through it alone, so
+nothing is CBC decrypted or unpadded before the HMAC has been checked.
 */
-func (ak *aesKey) Decrypt(data []byte) ([]byte, error) {
+func (ak *aesKey) authenticate(data []byte, aad []byte) (iv []byte, blocks []byte, err error) {
 	if len(data) < kzHeaderLength+aes.BlockSize+hmacSigLength {
-		return nil, ErrShortCiphertext
+		return nil, nil, ErrShortCiphertext
 	}
 	msg := data[:len(data)-hmacSigLength]
 	sig := data[len(data)-hmacSigLength:]
-	// before doing anything else, first check the signature
-	if ok, err := ak.hmac.Verify(msg, sig); !ok || err != nil {
+	if ok, err := ak.hmac.Verify(aesMACInput(msg, aad), sig); !ok || err != nil {
 		if err == nil {
 			err = ErrInvalidSignature
 		}
+		return nil, nil, err
+	}
+	// only a ciphertext that passed the HMAC check gets its length and padding
+	// looked at, so a forged one can't be used as a padding oracle
+	blocks = msg[kzHeaderLength+aes.BlockSize:]
+	if len(blocks) == 0 || len(blocks)%aes.BlockSize != 0 {
+		return nil, nil, ErrBadCiphertextFormat
+	}
+	return msg[kzHeaderLength : kzHeaderLength+aes.BlockSize], blocks, nil
+}
+
+func (ak *aesKey) Decrypt(data []byte) ([]byte, error) {
+	return ak.decryptWithAAD(data, nil)
+}
+
+func (ak *aesKey) decryptWithAAD(data []byte, aad []byte) ([]byte, error) {
+	iv, blocks, err := ak.authenticate(data, aad)
+	if err != nil {
 		return nil, err
 	}
-	iv := data[kzHeaderLength : kzHeaderLength+aes.BlockSize]
-	aesCipher, err := aes.NewCipher(ak.key)
+	aesCipher, err := ak.blockCipher()
 	if err != nil {
 		return nil, err
 	}
 	crypter := cipher.NewCBCDecrypter(aesCipher, iv)
-	plainBytes := make([]byte, len(data)-kzHeaderLength-hmacSigLength-aes.BlockSize)
-	crypter.CryptBlocks(plainBytes, data[kzHeaderLength+aes.BlockSize:len(data)-hmacSigLength])
-	plainBytes = pkcs5unpad(plainBytes)
-	return plainBytes, nil
+	plainBytes := make([]byte, len(blocks))
+	crypter.CryptBlocks(plainBytes, blocks)
+	return pkcs5unpad(plainBytes, aes.BlockSize)
 }
 
 func (ak *aesKey) DecryptReader(source io.Reader) (io.ReadCloser, error) {
@@ -215,7 +299,7 @@ func (ak *aesKey) DecryptReader(source io.Reader) (io.ReadCloser, error) {
 		return nil, ErrShortCiphertext
 	}
 	iv := headeriv[kzHeaderLength:]
-	aesCipher, err := aes.NewCipher(ak.key)
+	aesCipher, err := ak.blockCipher()
 	if err != nil {
 		return nil, err
 	}
@@ -0,0 +1,233 @@
+package dkeyczar
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"sync"
+)
+
+// AES-SIV keys (RFC 5297) encrypt deterministically: equal plaintexts and
+// associated data give equal ciphertexts.  The key is split in two halves,
+// the first for S2V (CMAC) and the second for CTR mode.  The data array looks like:
+// |header|siv|ciphertext|
+// The header is authenticated as the first associated data component.
+type aesSIVKeyJSON struct {
+	AESSIVKeyString string `json:"aesSivKeyString"`
+	Size            uint   `json:"size"`
+}
+
+type aesSIVKey struct {
+	key []byte
+	id  []byte
+
+	// the expanded keys, built on first use
+	once     sync.Once
+	mac      cipher.Block
+	ctr      cipher.Block
+	blockErr error
+}
+
+const sivLength = aes.BlockSize
+
+func generateAESSIVKey(size uint, rng io.Reader) (*aesSIVKey, error) {
+	sk := new(aesSIVKey)
+	if size == 0 {
+		size = T_AES_SIV.defaultSize()
+	}
+	if !T_AES_SIV.isAcceptableSize(size) {
+		return nil, ErrInvalidKeySize
+	}
+	sk.key = make([]byte, size/8)
+	if _, err := io.ReadFull(rng, sk.key); err != nil {
+		return nil, err
+	}
+	return sk, nil
+}
+
+func (sk *aesSIVKey) blockCiphers() (mac cipher.Block, ctr cipher.Block, err error) {
+	sk.once.Do(func() {
+		half := len(sk.key) / 2
+		sk.mac, sk.blockErr = aes.NewCipher(sk.key[:half])
+		if sk.blockErr == nil {
+			sk.ctr, sk.blockErr = aes.NewCipher(sk.key[half:])
+		}
+	})
+	return sk.mac, sk.ctr, sk.blockErr
+}
+
+func (sk *aesSIVKey) secret() []byte {
+	return append([]byte(nil), sk.key...)
+}
+
+func (sk *aesSIVKey) KeyID() []byte {
+	if len(sk.id) != 0 {
+		return sk.id
+	}
+	h := sha1.New()
+	binary.Write(h, binary.BigEndian, uint32(len(sk.key)))
+	h.Write(sk.key)
+	sk.id = h.Sum(nil)[:4]
+	return sk.id
+}
+
+func newAESSIVKeyFromJSON(s []byte) (*aesSIVKey, error) {
+	sk := new(aesSIVKey)
+	sjson := new(aesSIVKeyJSON)
+	var err error
+	err = json.Unmarshal(s, &sjson)
+	if err != nil {
+		return nil, err
+	}
+	if !T_AES_SIV.isAcceptableSize(sjson.Size) {
+		return nil, ErrInvalidKeySize
+	}
+	sk.key, err = decodeWeb64String(sjson.AESSIVKeyString)
+	if err != nil {
+		return nil, ErrBase64Decoding
+	}
+	if uint(len(sk.key))*8 != sjson.Size {
+		return nil, ErrInvalidKeySize
+	}
+	return sk, nil
+}
+
+func newAESSIVJSONFromKey(key *aesSIVKey) *aesSIVKeyJSON {
+	sjson := new(aesSIVKeyJSON)
+	sjson.AESSIVKeyString = encodeWeb64String(key.key)
+	sjson.Size = uint(len(key.key)) * 8
+	return sjson
+}
+
+func (sk *aesSIVKey) ToKeyJSON() []byte {
+	j := newAESSIVJSONFromKey(sk)
+	s, _ := json.Marshal(j)
+	return s
+}
+
+// multiply by x in GF(2^128), as used by CMAC and S2V
+func sivDouble(b []byte) {
+	carry := b[0] >> 7
+	for i := 0; i < len(b)-1; i++ {
+		b[i] = b[i]<<1 | b[i+1]>>7
+	}
+	b[len(b)-1] = b[len(b)-1]<<1 ^ 0x87*carry
+}
+
+func xorBytes(dst, src []byte) {
+	for i := range src {
+		dst[i] ^= src[i]
+	}
+}
+
+// AES-CMAC (RFC 4493) of msg
+func cmac(block cipher.Block, msg []byte) []byte {
+	subkey := make([]byte, aes.BlockSize)
+	block.Encrypt(subkey, subkey)
+	sivDouble(subkey)
+	last := make([]byte, aes.BlockSize)
+	if len(msg) > 0 && len(msg)%aes.BlockSize == 0 {
+		copy(last, msg[len(msg)-aes.BlockSize:])
+		msg = msg[:len(msg)-aes.BlockSize]
+	} else {
+		// incomplete last block: pad it and use the second subkey
+		n := len(msg) - len(msg)%aes.BlockSize
+		copy(last, msg[n:])
+		last[len(msg)-n] = 0x80
+		msg = msg[:n]
+		sivDouble(subkey)
+	}
+	xorBytes(last, subkey)
+	mac := make([]byte, aes.BlockSize)
+	for len(msg) > 0 {
+		xorBytes(mac, msg[:aes.BlockSize])
+		block.Encrypt(mac, mac)
+		msg = msg[aes.BlockSize:]
+	}
+	xorBytes(mac, last)
+	block.Encrypt(mac, mac)
+	return mac
+}
+
+// S2V from RFC 5297 over the associated data components and the plaintext
+func s2v(block cipher.Block, ad [][]byte, plaintext []byte) []byte {
+	d := cmac(block, make([]byte, aes.BlockSize))
+	for _, a := range ad {
+		sivDouble(d)
+		xorBytes(d, cmac(block, a))
+	}
+	var t []byte
+	if len(plaintext) >= aes.BlockSize {
+		t = make([]byte, len(plaintext))
+		copy(t, plaintext)
+		xorBytes(t[len(t)-aes.BlockSize:], d)
+	} else {
+		sivDouble(d)
+		t = make([]byte, aes.BlockSize)
+		copy(t, plaintext)
+		t[len(plaintext)] = 0x80
+		xorBytes(t, d)
+	}
+	return cmac(block, t)
+}
+
+// the CTR mode counter is the SIV with two bits cleared, so implementations can use 32 and 64 bit additions
+func sivCTR(block cipher.Block, siv []byte) cipher.Stream {
+	q := make([]byte, aes.BlockSize)
+	copy(q, siv)
+	q[8] &= 0x7f
+	q[12] &= 0x7f
+	return cipher.NewCTR(block, q)
+}
+
+// encrypt the plaintext with the associated data and append siv|ciphertext to dst
+func (sk *aesSIVKey) seal(dst []byte, plaintext []byte, ad ...[]byte) ([]byte, error) {
+	mac, ctr, err := sk.blockCiphers()
+	if err != nil {
+		return nil, err
+	}
+	siv := s2v(mac, ad, plaintext)
+	dst = append(dst, siv...)
+	n := len(dst)
+	dst = append(dst, plaintext...)
+	sivCTR(ctr, siv).XORKeyStream(dst[n:], dst[n:])
+	return dst, nil
+}
+
+// decrypt siv|ciphertext and check it against the associated data
+func (sk *aesSIVKey) open(data []byte, ad ...[]byte) ([]byte, error) {
+	if len(data) < sivLength {
+		return nil, ErrShortCiphertext
+	}
+	mac, ctr, err := sk.blockCiphers()
+	if err != nil {
+		return nil, err
+	}
+	siv := data[:sivLength]
+	plaintext := make([]byte, len(data)-sivLength)
+	sivCTR(ctr, siv).XORKeyStream(plaintext, data[sivLength:])
+	if subtle.ConstantTimeCompare(s2v(mac, ad, plaintext), siv) != 1 {
+		wipeBytes(plaintext)
+		return nil, ErrInvalidSignature
+	}
+	return plaintext, nil
+}
+
+// Encrypt with associated data.  The header is authenticated along with it.
+func (sk *aesSIVKey) EncryptDeterministically(data []byte, associatedData []byte) ([]byte, error) {
+	h := makeHeader(sk)
+	out := make([]byte, kzHeaderLength, kzHeaderLength+sivLength+len(data))
+	copy(out, h)
+	return sk.seal(out, data, h, associatedData)
+}
+
+func (sk *aesSIVKey) DecryptDeterministically(data []byte, associatedData []byte) ([]byte, error) {
+	if len(data) < kzHeaderLength+sivLength {
+		return nil, ErrShortCiphertext
+	}
+	return sk.open(data[kzHeaderLength:], data[:kzHeaderLength], associatedData)
+}
@@ -0,0 +1,492 @@
+package dkeyczar
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"io"
+	"strings"
+
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/hkdf"
+	"golang.org/x/crypto/ssh"
+)
+
+// Files in the age format (https://age-encryption.org/v1), so key sets can be
+// used with the age tool.  X25519 key sets are age native X25519 recipients
+// and identities; RSA key sets are ssh-rsa recipients, and their private keys
+// (see ExportPrivateKeyPEM) are ssh identities.  Only the binary format is
+// supported, not the ASCII armor.  As with keyczar ciphertexts, files are
+// encrypted to the primary key of the set.
+
+const (
+	ageIntro       = "age-encryption.org/v1\n"
+	ageFileKeyLen  = 16
+	ageChunkSize   = 64 * 1024
+	ageNonceLen    = 16
+	ageColumns     = 64
+	ageX25519Info  = "age-encryption.org/v1/X25519"
+	ageSSHRSALabel = "age-encryption.org/v1/ssh-rsa"
+)
+
+var ageB64 = base64.RawStdEncoding.Strict()
+
+type ageStanza struct {
+	typ  string
+	args []string
+	body []byte
+}
+
+func (s *ageStanza) marshal(w *bytes.Buffer) {
+	w.WriteString("-> " + s.typ)
+	for _, a := range s.args {
+		w.WriteString(" " + a)
+	}
+	w.WriteString("\n")
+	// the body is wrapped at 64 columns, and its last line is always short
+	b := ageB64.EncodeToString(s.body)
+	for len(b) >= ageColumns {
+		w.WriteString(b[:ageColumns] + "\n")
+		b = b[ageColumns:]
+	}
+	w.WriteString(b + "\n")
+}
+
+func ageHKDF(secret, salt []byte, info string) []byte {
+	key := make([]byte, 32)
+	io.ReadFull(hkdf.New(sha256.New, secret, salt, []byte(info)), key)
+	return key
+}
+
+func ageHeaderMAC(fileKey, header []byte) []byte {
+	mac := hmac.New(sha256.New, ageHKDF(fileKey, nil, "header"))
+	mac.Write(header)
+	return mac.Sum(nil)
+}
+
+// the first four bytes of the SHA-256 of the key's ssh encoding, which names an ssh-rsa recipient
+func ageSSHTag(pub *rsa.PublicKey) (string, error) {
+	sk, err := ssh.NewPublicKey(pub)
+	if err != nil {
+		return "", err
+	}
+	h := sha256.Sum256(sk.Marshal())
+	return ageB64.EncodeToString(h[:4]), nil
+}
+
+// the age recipient public key of k, either the X25519 point or the RSA key
+func ageRecipientKey(k keydata) interface{} {
+	switch k := k.(type) {
+	case *x25519Key:
+		return k.publicKey.key
+	case *x25519PublicKey:
+		return k.key
+	case *rsaKey:
+		return &k.publicKey.key
+	case *rsaPublicKey:
+		return &k.key
+	}
+	return nil
+}
+
+func ageWrap(k keydata, rng io.Reader, fileKey []byte) (*ageStanza, error) {
+	switch pub := ageRecipientKey(k).(type) {
+	case []byte:
+		ephemeral := make([]byte, curve25519.ScalarSize)
+		if _, err := io.ReadFull(rng, ephemeral); err != nil {
+			return nil, err
+		}
+		share, err := curve25519.X25519(ephemeral, curve25519.Basepoint)
+		if err != nil {
+			return nil, err
+		}
+		shared, err := curve25519.X25519(ephemeral, pub)
+		if err != nil {
+			return nil, err
+		}
+		aead, _ := chacha20poly1305.New(ageHKDF(shared, append(append([]byte(nil), share...), pub...), ageX25519Info))
+		body := aead.Seal(nil, make([]byte, aead.NonceSize()), fileKey, nil)
+		return &ageStanza{"X25519", []string{ageB64.EncodeToString(share)}, body}, nil
+	case *rsa.PublicKey:
+		tag, err := ageSSHTag(pub)
+		if err != nil {
+			return nil, err
+		}
+		body, err := rsa.EncryptOAEP(sha256.New(), rng, pub, fileKey, []byte(ageSSHRSALabel))
+		if err != nil {
+			return nil, err
+		}
+		return &ageStanza{"ssh-rsa", []string{tag}, body}, nil
+	}
+	return nil, ErrUnsupportedType
+}
+
+// return the file key from the stanza if it was made for k, or nil
+func ageUnwrap(k keydata, s *ageStanza) []byte {
+	switch k := k.(type) {
+	case *x25519Key:
+		if s.typ != "X25519" || len(s.args) != 1 || len(s.body) != ageFileKeyLen+chacha20poly1305.Overhead {
+			return nil
+		}
+		share, err := ageB64.DecodeString(s.args[0])
+		if err != nil || len(share) != curve25519.PointSize {
+			return nil
+		}
+		shared, err := curve25519.X25519(k.key, share)
+		if err != nil {
+			return nil
+		}
+		aead, _ := chacha20poly1305.New(ageHKDF(shared, append(append([]byte(nil), share...), k.publicKey.key...), ageX25519Info))
+		fileKey, err := aead.Open(nil, make([]byte, aead.NonceSize()), s.body, nil)
+		if err != nil {
+			return nil
+		}
+		return fileKey
+	case *rsaKey:
+		if s.typ != "ssh-rsa" || len(s.args) != 1 {
+			return nil
+		}
+		if tag, err := ageSSHTag(&k.publicKey.key); err != nil || tag != s.args[0] {
+			return nil
+		}
+		fileKey, err := rsa.DecryptOAEP(sha256.New(), k.random(), &k.key, s.body, []byte(ageSSHRSALabel))
+		if err != nil || len(fileKey) != ageFileKeyLen {
+			return nil
+		}
+		return fileKey
+	}
+	return nil
+}
+
+// the payload nonce for chunk counter, with the final chunk flagged
+func ageChunkNonce(counter uint64, last bool) []byte {
+	nonce := make([]byte, chacha20poly1305.NonceSize)
+	for i := 10; i >= 0; i-- {
+		nonce[i] = byte(counter)
+		counter >>= 8
+	}
+	if last {
+		nonce[11] = 1
+	}
+	return nonce
+}
+
+type ageWriter struct {
+	sink    io.Writer
+	aead    cipher.AEAD
+	buf     []byte
+	counter uint64
+	closed  bool
+}
+
+func (w *ageWriter) flush(last bool) error {
+	out := w.aead.Seal(nil, ageChunkNonce(w.counter, last), w.buf, nil)
+	w.counter++
+	w.buf = w.buf[:0]
+	_, err := w.sink.Write(out)
+	return err
+}
+
+func (w *ageWriter) Write(p []byte) (int, error) {
+	if w.closed {
+		return 0, io.ErrClosedPipe
+	}
+	n := 0
+	for len(p) > 0 {
+		// a full chunk is only written once more data arrives, since the last chunk is flagged
+		if len(w.buf) == ageChunkSize {
+			if err := w.flush(false); err != nil {
+				return n, err
+			}
+		}
+		c := copy(w.buf[len(w.buf):ageChunkSize], p)
+		w.buf = w.buf[:len(w.buf)+c]
+		p = p[c:]
+		n += c
+	}
+	return n, nil
+}
+
+func (w *ageWriter) Close() error {
+	if w.closed {
+		return nil
+	}
+	w.closed = true
+	err := w.flush(true)
+	wipeBytes(w.buf[:cap(w.buf)])
+	return err
+}
+
+// EncryptAge returns a writer that encrypts everything written to it into an age file written to sink,
+// for the primary key of the encrypter.  The encrypter must have been created by NewEncrypter or NewCrypter
+// from an X25519 or RSA key set.  The file is only complete once the writer is closed.
+func EncryptAge(encrypter Encrypter, sink io.Writer) (io.WriteCloser, error) {
+	kz := jweKeyCzar(encrypter)
+	if kz == nil {
+		return nil, ErrUnsupportedType
+	}
+	key, err := kz.primaryKey()
+	if err != nil {
+		return nil, err
+	}
+	rng := kz.random()
+	fileKey := make([]byte, ageFileKeyLen)
+	if _, err := io.ReadFull(rng, fileKey); err != nil {
+		return nil, err
+	}
+	defer wipeBytes(fileKey)
+	s, err := ageWrap(key, rng, fileKey)
+	if err != nil {
+		return nil, err
+	}
+	var hdr bytes.Buffer
+	hdr.WriteString(ageIntro)
+	s.marshal(&hdr)
+	hdr.WriteString("---")
+	hdr.WriteString(" " + ageB64.EncodeToString(ageHeaderMAC(fileKey, hdr.Bytes())) + "\n")
+
+	nonce := make([]byte, ageNonceLen)
+	if _, err := io.ReadFull(rng, nonce); err != nil {
+		return nil, err
+	}
+	hdr.Write(nonce)
+	if _, err := sink.Write(hdr.Bytes()); err != nil {
+		return nil, err
+	}
+	aead, _ := chacha20poly1305.New(ageHKDF(fileKey, nonce, "payload"))
+	return &ageWriter{sink: sink, aead: aead, buf: make([]byte, 0, ageChunkSize)}, nil
+}
+
+// AgeRecipient returns the age recipient for the primary key of the encrypter, which the age tool
+// accepts with -r: an "age1..." string for an X25519 key set, or an ssh-rsa public key line for an RSA key set.
+func AgeRecipient(encrypter Encrypter) (string, error) {
+	kz := jweKeyCzar(encrypter)
+	if kz == nil {
+		return "", ErrUnsupportedType
+	}
+	key, err := kz.primaryKey()
+	if err != nil {
+		return "", err
+	}
+	switch pub := ageRecipientKey(key).(type) {
+	case []byte:
+		return bech32Encode("age", pub), nil
+	case *rsa.PublicKey:
+		sk, err := ssh.NewPublicKey(pub)
+		if err != nil {
+			return "", err
+		}
+		return strings.TrimSuffix(string(ssh.MarshalAuthorizedKey(sk)), "\n"), nil
+	}
+	return "", ErrUnsupportedType
+}
+
+// ExportAgeIdentity returns the given key version from the X25519 private key set in r as an
+// "AGE-SECRET-KEY-1..." age identity.  As with ExportPrivateKeyPEM, which gives age ssh identities
+// for RSA key sets, only versions marked exportable are exported.
+func ExportAgeIdentity(r KeyReader, version int) (string, error) {
+	kz, err := newKeyCzar(r)
+	if err != nil {
+		return "", err
+	}
+	k, err := exportPrivateKey(kz, version)
+	if err != nil {
+		return "", err
+	}
+	xk, ok := k.(*x25519Key)
+	if !ok {
+		return "", ErrUnsupportedType
+	}
+	return strings.ToUpper(bech32Encode("age-secret-key-", xk.key)), nil
+}
+
+// read one header line, without its newline
+func ageReadLine(r *bufio.Reader, hdr *bytes.Buffer) (string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return "", ErrMalformedAge
+	}
+	hdr.WriteString(line)
+	return line[:len(line)-1], nil
+}
+
+func ageParseHeader(r *bufio.Reader) (stanzas []*ageStanza, hdr []byte, mac []byte, err error) {
+	var buf bytes.Buffer
+	if line, err := ageReadLine(r, &buf); err != nil || line+"\n" != ageIntro {
+		return nil, nil, nil, ErrMalformedAge
+	}
+	for {
+		line, err := ageReadLine(r, &buf)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		if strings.HasPrefix(line, "--- ") {
+			mac, err := ageB64.DecodeString(line[4:])
+			if err != nil || len(mac) != sha256.Size {
+				return nil, nil, nil, ErrMalformedAge
+			}
+			// the MAC covers the header up to and including the "---"
+			return stanzas, buf.Bytes()[:buf.Len()-len(line)-1+len("---")], mac, nil
+		}
+		f := strings.Split(line, " ")
+		if len(f) < 2 || f[0] != "->" || f[1] == "" {
+			return nil, nil, nil, ErrMalformedAge
+		}
+		s := &ageStanza{typ: f[1], args: f[2:]}
+		for {
+			line, err := ageReadLine(r, &buf)
+			if err != nil {
+				return nil, nil, nil, err
+			}
+			b, err := ageB64.DecodeString(line)
+			if err != nil || len(line) > ageColumns {
+				return nil, nil, nil, ErrMalformedAge
+			}
+			s.body = append(s.body, b...)
+			if len(line) < ageColumns {
+				break
+			}
+		}
+		stanzas = append(stanzas, s)
+	}
+}
+
+type ageReader struct {
+	src     *bufio.Reader
+	aead    cipher.AEAD
+	buf     []byte
+	out     []byte
+	counter uint64
+	done    bool
+}
+
+func (r *ageReader) Read(p []byte) (int, error) {
+	for len(r.out) == 0 {
+		if r.done {
+			return 0, io.EOF
+		}
+		n, err := io.ReadFull(r.src, r.buf)
+		if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+			return 0, err
+		}
+		last := n < len(r.buf)
+		if !last {
+			if _, err := r.src.Peek(1); err == io.EOF {
+				last = true
+			}
+		}
+		if last && n == chacha20poly1305.Overhead && r.counter > 0 {
+			// only an empty file has an empty final chunk
+			return 0, ErrInvalidSignature
+		}
+		out, err := r.aead.Open(r.buf[:0], ageChunkNonce(r.counter, last), r.buf[:n], nil)
+		if err != nil {
+			return 0, ErrInvalidSignature
+		}
+		r.counter++
+		r.out = out
+		r.done = last
+	}
+	n := copy(p, r.out)
+	r.out = r.out[n:]
+	return n, nil
+}
+
+// DecryptAge returns a reader for the plaintext of the age file read from src, which must have a
+// recipient stanza for one of the keys of the crypter's X25519 or RSA key set.  The header is authenticated
+// before DecryptAge returns; the payload is authenticated a chunk at a time as it is read, and a
+// modified or truncated file fails with ErrInvalidSignature.
+func DecryptAge(crypter Crypter, src io.Reader) (io.Reader, error) {
+	kc, ok := crypter.(*keyCrypter)
+	if !ok {
+		return nil, ErrUnsupportedType
+	}
+	br := bufio.NewReader(src)
+	stanzas, hdr, mac, err := ageParseHeader(br)
+	if err != nil {
+		return nil, err
+	}
+	var fileKey []byte
+	for _, s := range stanzas {
+		for _, k := range kc.kz.allKeys() {
+			if fileKey = ageUnwrap(k, s); fileKey != nil {
+				break
+			}
+		}
+		if fileKey != nil {
+			break
+		}
+	}
+	if fileKey == nil {
+		return nil, ErrKeyNotFound
+	}
+	defer wipeBytes(fileKey)
+	if !hmac.Equal(ageHeaderMAC(fileKey, hdr), mac) {
+		return nil, ErrInvalidSignature
+	}
+	nonce := make([]byte, ageNonceLen)
+	if _, err := io.ReadFull(br, nonce); err != nil {
+		return nil, ErrMalformedAge
+	}
+	aead, _ := chacha20poly1305.New(ageHKDF(fileKey, nonce, "payload"))
+	return &ageReader{src: br, aead: aead, buf: make([]byte, ageChunkSize+chacha20poly1305.Overhead)}, nil
+}
+
+const bech32Charset = "qpzry9x8gf2tvdw0s3jn54khce6mua7l"
+
+func bech32Polymod(values []byte) uint32 {
+	gen := [5]uint32{0x3b6a57b2, 0x26508e6d, 0x1ea119fa, 0x3d4233dd, 0x2a1462b3}
+	chk := uint32(1)
+	for _, v := range values {
+		top := chk >> 25
+		chk = (chk&0x1ffffff)<<5 ^ uint32(v)
+		for i := 0; i < 5; i++ {
+			if (top>>uint(i))&1 == 1 {
+				chk ^= gen[i]
+			}
+		}
+	}
+	return chk
+}
+
+// BIP 173 bech32 encoding of data with the lower case human readable part hrp, as used by age
+func bech32Encode(hrp string, data []byte) string {
+	// regroup the 8-bit bytes into 5-bit values, zero padding the last
+	var values []byte
+	acc, bits := 0, 0
+	for _, b := range data {
+		acc = acc<<8 | int(b)
+		bits += 8
+		for bits >= 5 {
+			bits -= 5
+			values = append(values, byte(acc>>uint(bits))&31)
+		}
+		acc &= 1<<uint(bits) - 1
+	}
+	if bits > 0 {
+		values = append(values, byte(acc<<uint(5-bits))&31)
+	}
+	var expanded []byte
+	for i := 0; i < len(hrp); i++ {
+		expanded = append(expanded, hrp[i]>>5)
+	}
+	expanded = append(expanded, 0)
+	for i := 0; i < len(hrp); i++ {
+		expanded = append(expanded, hrp[i]&31)
+	}
+	expanded = append(append(expanded, values...), 0, 0, 0, 0, 0, 0)
+	mod := bech32Polymod(expanded) ^ 1
+	for i := 0; i < 6; i++ {
+		values = append(values, byte(mod>>uint(5*(5-i)))&31)
+	}
+	s := hrp + "1"
+	for _, v := range values {
+		s += string(bech32Charset[v])
+	}
+	return s
+}
@@ -0,0 +1,192 @@
+package dkeyczar
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"strconv"
+)
+
+// key files are small; this keeps a hostile archive from filling memory
+const maxArchiveFileSize = 1 << 20
+
+// the files of a key set directory found in an archive, keyed by their path
+type archiveFiles map[string][]byte
+
+// pick out the one key set in the archive, which may sit in a subdirectory
+func (files archiveFiles) keySet() (KeyReader, error) {
+	dir := ""
+	found := false
+	for name := range files {
+		if path.Base(name) == "meta" {
+			if found {
+				return nil, ErrMalformedArchive
+			}
+			dir, found = path.Dir(name), true
+		}
+	}
+	if !found {
+		return nil, ErrMalformedArchive
+	}
+	r := &memReader{meta: string(files[path.Join(dir, "meta")]), keys: make(map[int]string)}
+	for name, b := range files {
+		if path.Dir(name) != dir {
+			continue
+		}
+		if v, err := strconv.Atoi(path.Base(name)); err == nil {
+			r.keys[v] = string(b)
+		}
+	}
+	return r, nil
+}
+
+// add a file read from an archive, if it could belong to a key set
+func (files archiveFiles) add(name string, size int64, open func() (io.ReadCloser, error)) error {
+	name = path.Clean(name)
+	base := path.Base(name)
+	if base != "meta" {
+		if _, err := strconv.Atoi(base); err != nil {
+			return nil
+		}
+	}
+	if size > maxArchiveFileSize {
+		return ErrMalformedArchive
+	}
+	rd, err := open()
+	if err != nil {
+		return err
+	}
+	defer rd.Close()
+	b, err := ioutil.ReadAll(io.LimitReader(rd, maxArchiveFileSize))
+	if err != nil {
+		return err
+	}
+	files[name] = b
+	return nil
+}
+
+// NewZipReader returns a KeyReader for the key set stored in a zip archive, as the files of a key set
+// directory at the top level or in one subdirectory.  The key files are read into memory.
+func NewZipReader(r io.ReaderAt, size int64) (KeyReader, error) {
+	zr, err := zip.NewReader(r, size)
+	if err != nil {
+		return nil, err
+	}
+	files := make(archiveFiles)
+	for _, f := range zr.File {
+		if f.FileInfo().IsDir() {
+			continue
+		}
+		f := f
+		open := func() (io.ReadCloser, error) { return f.Open() }
+		if err := files.add(f.Name, int64(f.UncompressedSize64), open); err != nil {
+			return nil, err
+		}
+	}
+	return files.keySet()
+}
+
+// NewZipFileReader returns a KeyReader for the key set stored in the zip archive at path
+func NewZipFileReader(path string) (KeyReader, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return NewZipReader(bytes.NewReader(b), int64(len(b)))
+}
+
+// NewTarReader returns a KeyReader for the key set stored in a tar archive, laid out as for NewZipReader.
+// Compressed archives must be decompressed first, e.g. with gzip.NewReader.
+func NewTarReader(r io.Reader) (KeyReader, error) {
+	tr := tar.NewReader(r)
+	files := make(archiveFiles)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+		open := func() (io.ReadCloser, error) { return ioutil.NopCloser(tr), nil }
+		if err := files.add(hdr.Name, hdr.Size, open); err != nil {
+			return nil, err
+		}
+	}
+	return files.keySet()
+}
+
+// NewTarFileReader returns a KeyReader for the key set stored in the tar archive at path
+func NewTarFileReader(path string) (KeyReader, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return NewTarReader(f)
+}
+
+// the key set files in the order they are written: meta, then the versions
+func archiveEntries(reader KeyReader) ([]string, map[string]string, error) {
+	r, err := readKeySet(reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	names := []string{"meta"}
+	contents := map[string]string{"meta": r.meta}
+	for _, v := range r.versions() {
+		name := strconv.Itoa(v)
+		names = append(names, name)
+		contents[name] = r.keys[v]
+	}
+	return names, contents, nil
+}
+
+// WriteZip reads the whole key set from reader and writes it to w as a zip archive for NewZipReader.
+// Keys are copied as they are read, so encrypted keys stay encrypted.
+func WriteZip(w io.Writer, reader KeyReader) error {
+	names, contents, err := archiveEntries(reader)
+	if err != nil {
+		return err
+	}
+	zw := zip.NewWriter(w)
+	for _, name := range names {
+		hdr := &zip.FileHeader{Name: name, Method: zip.Deflate}
+		hdr.SetMode(0600)
+		fw, err := zw.CreateHeader(hdr)
+		if err != nil {
+			return err
+		}
+		if _, err := io.WriteString(fw, contents[name]); err != nil {
+			return err
+		}
+	}
+	return zw.Close()
+}
+
+// WriteTar reads the whole key set from reader and writes it to w as a tar archive for NewTarReader.
+// Keys are copied as they are read, so encrypted keys stay encrypted.
+func WriteTar(w io.Writer, reader KeyReader) error {
+	names, contents, err := archiveEntries(reader)
+	if err != nil {
+		return err
+	}
+	tw := tar.NewWriter(w)
+	for _, name := range names {
+		hdr := &tar.Header{Name: name, Mode: 0600, Size: int64(len(contents[name])), Typeflag: tar.TypeReg}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if _, err := io.WriteString(tw, contents[name]); err != nil {
+			return err
+		}
+	}
+	return tw.Close()
+}
@@ -0,0 +1,139 @@
+package dkeyczar
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// AuditEventType is the kind of key access reported to an AuditHook
+type AuditEventType int
+
+const (
+	AUDIT_KEY_LOAD        AuditEventType = iota // a key version was loaded, when a key set is read or reloaded
+	AUDIT_DECRYPT_FAILURE                       // a ciphertext didn't decrypt
+	AUDIT_VERIFY_FAILURE                        // a signature didn't verify
+)
+
+func (t AuditEventType) String() string {
+	switch t {
+	case AUDIT_KEY_LOAD:
+		return "key-load"
+	case AUDIT_DECRYPT_FAILURE:
+		return "decrypt-failure"
+	case AUDIT_VERIFY_FAILURE:
+		return "verify-failure"
+	}
+	return "unknown"
+}
+
+// AuditEvent describes one key access
+type AuditEvent struct {
+	Type    AuditEventType
+	Source  string // where the key set was read from, e.g. "file:/path/to/keys"
+	Version int    // the key version, or -1 if no key in the set has KeyHash
+	KeyHash []byte // the hash of the key, from the ciphertext or signature header for failures; nil if there was no header
+	Err     error  // why a decrypt or verify failed; ErrInvalidSignature for a bad signature
+}
+
+// An AuditHook receives key loads, decrypt failures and signature verification
+// failures of every key set in the program, e.g. to forward them to a SIEM.
+// Audit is called from the goroutine doing the work, so it should be quick,
+// and safe for concurrent use.
+type AuditHook interface {
+	Audit(event AuditEvent)
+}
+
+var auditHook struct {
+	sync.RWMutex
+	hook AuditHook
+}
+
+// SetAuditHook sets the hook receiving the audit events of all key sets, nil for none.
+// Key sets are loaded when the Crypter, Signer, etc. is made, so set it first.
+func SetAuditHook(hook AuditHook) {
+	auditHook.Lock()
+	auditHook.hook = hook
+	auditHook.Unlock()
+}
+
+func currentAuditHook() AuditHook {
+	auditHook.RLock()
+	defer auditHook.RUnlock()
+	return auditHook.hook
+}
+
+// A KeyReader can implement fmt.Stringer to name its source in audit events;
+// otherwise the type of the reader is used.
+func readerSource(r KeyReader) string {
+	if s, ok := r.(fmt.Stringer); ok {
+		return s.String()
+	}
+	return fmt.Sprintf("%T", r)
+}
+
+func (r *fileReader) String() string {
+	return "file:" + r.location
+}
+
+func (r *envReader) String() string {
+	return "env:" + r.prefix
+}
+
+func (r *encryptedReader) String() string {
+	return "encrypted:" + readerSource(r.reader)
+}
+
+func (r *contextReader) String() string {
+	return readerSource(r.reader)
+}
+
+// report each of the keys just loaded into kz
+func (kz *keyCzar) auditLoad() {
+	hook := currentAuditHook()
+	if hook == nil {
+		return
+	}
+	var versions []int
+	for v := range kz.keys {
+		versions = append(versions, v)
+	}
+	sort.Ints(versions)
+	for _, v := range versions {
+		kz.auditLoadVersion(v, kz.keys[v])
+	}
+}
+
+// report the key of a version just loaded into kz, e.g. on first use
+func (kz *keyCzar) auditLoadVersion(version int, k keydata) {
+	hook := currentAuditHook()
+	if hook == nil {
+		return
+	}
+	hook.Audit(AuditEvent{
+		Type:    AUDIT_KEY_LOAD,
+		Source:  kz.source,
+		Version: version,
+		KeyHash: append([]byte(nil), k.KeyID()...),
+	})
+}
+
+// report a failed decrypt or verify of text, naming the key from its header if it has one
+func (kz *keyCzar) auditFailure(t AuditEventType, ec encodingController, text string, err error) {
+	hook := currentAuditHook()
+	if hook == nil {
+		return
+	}
+	ev := AuditEvent{Type: t, Source: kz.source, Version: -1, Err: err}
+	if h, herr := decodeHeaderPrefix(ec, text); herr == nil && len(h) >= kzHeaderLength {
+		ev.KeyHash = append([]byte(nil), h[1:kzHeaderLength]...)
+		kz.mu.RLock()
+		for v, k := range kz.keys {
+			if string(k.KeyID()) == string(ev.KeyHash) && (ev.Version == -1 || v < ev.Version) {
+				ev.Version = v
+			}
+		}
+		kz.mu.RUnlock()
+	}
+	hook.Audit(ev)
+}
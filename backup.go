@@ -0,0 +1,195 @@
+package dkeyczar
+
+import (
+	"archive/tar"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"path"
+	"strconv"
+)
+
+// Key set backups: the key set files in a tar archive, with a manifest listing
+// the versions and the SHA-256 of every file, the whole archive encrypted with
+// a passphrase.  The encryption authenticates the archive, so a backup that
+// restores is the one that was written, and the manifest checks the key set
+// in it is complete.  Keys are copied as they are read, so encrypted keys stay
+// encrypted.  The backup is the PBE JSON, with scrypt and AES-256, of the tar
+// archive of:
+// |manifest.json|meta|1|2|...
+
+const backupManifestName = "manifest.json"
+
+// the largest manifest read from a backup
+const maxBackupManifestSize = 1 << 20
+
+// A BackupManifest describes the key set in a backup
+type BackupManifest struct {
+	Name       string          `json:"name"`
+	Type       KeyType         `json:"type"`
+	Purpose    KeyPurpose      `json:"purpose"`
+	Encrypted  bool            `json:"encrypted"`  // the keys are encrypted, and need the key set's crypter once restored
+	Created    int64           `json:"created"`    // when the backup was made, in milliseconds since 1/1/1970 GMT
+	MetaSHA256 string          `json:"metaSHA256"` // the hex SHA-256 of the metadata file
+	Versions   []BackupVersion `json:"versions"`
+}
+
+// A BackupVersion describes a key version in a backup
+type BackupVersion struct {
+	VersionNumber int       `json:"versionNumber"`
+	Status        KeyStatus `json:"status"`
+	Created       int64     `json:"created,omitempty"` // when the version was added, in milliseconds since 1/1/1970 GMT, or 0 if unknown
+	SHA256        string    `json:"sha256"`            // the hex SHA-256 of the key file
+}
+
+func backupHash(s string) string {
+	h := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(h[:])
+}
+
+// BackupKeyset reads the whole key set from reader and writes it to w as a backup encrypted with passphrase,
+// for RestoreKeyset.
+func BackupKeyset(reader KeyReader, w io.Writer, passphrase []byte) error {
+	names, contents, err := archiveEntries(reader)
+	if err != nil {
+		return err
+	}
+	var km KeyMeta
+	if err := json.Unmarshal([]byte(contents["meta"]), &km); err != nil {
+		return err
+	}
+	manifest := BackupManifest{
+		Name:       km.Name,
+		Type:       km.Type,
+		Purpose:    km.Purpose,
+		Encrypted:  km.Encrypted,
+		Created:    currentMillis(),
+		MetaSHA256: backupHash(contents["meta"]),
+	}
+	for _, kv := range km.Versions {
+		manifest.Versions = append(manifest.Versions, BackupVersion{
+			VersionNumber: kv.VersionNumber,
+			Status:        kv.Status,
+			Created:       kv.Created,
+			SHA256:        backupHash(contents[strconv.Itoa(kv.VersionNumber)]),
+		})
+	}
+	m, err := json.Marshal(manifest)
+	if err != nil {
+		return err
+	}
+	names = append([]string{backupManifestName}, names...)
+	contents[backupManifestName] = string(m)
+
+	var archive bytes.Buffer
+	tw := tar.NewWriter(&archive)
+	for _, name := range names {
+		hdr := &tar.Header{Name: name, Mode: 0600, Size: int64(len(contents[name])), Typeflag: tar.TypeReg}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if _, err := io.WriteString(tw, contents[name]); err != nil {
+			return err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	pbe := newPBECrypter(passphrase, PBE_SCRYPT, nil)
+	defer pbe.Wipe()
+	backup, err := pbe.Encrypt(archive.Bytes())
+	wipeBytes(archive.Bytes())
+	if err != nil {
+		return err
+	}
+	_, err = io.WriteString(w, backup)
+	return err
+}
+
+// RestoreKeyset decrypts a backup made by BackupKeyset with passphrase, and returns the key set in it,
+// after checking it against the manifest, and the manifest.  Write the key set with a KeyWriter to restore it.
+// A backup that doesn't match its manifest returns ErrBackupMismatch.
+func RestoreKeyset(r io.Reader, passphrase []byte) (KeyReader, *BackupManifest, error) {
+	backup, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, nil, err
+	}
+	pbe := newPBECrypter(passphrase, PBE_PBKDF2_SHA1, nil)
+	defer pbe.Wipe()
+	archive, err := pbe.Decrypt(string(backup))
+	if err != nil {
+		return nil, nil, err
+	}
+	defer wipeBytes(archive)
+
+	var manifest *BackupManifest
+	files := make(archiveFiles)
+	tr := tar.NewReader(bytes.NewReader(archive))
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+		if path.Clean(hdr.Name) == backupManifestName {
+			if manifest != nil || hdr.Size > maxBackupManifestSize {
+				return nil, nil, ErrBackupMismatch
+			}
+			manifest = new(BackupManifest)
+			if err := json.NewDecoder(io.LimitReader(tr, maxBackupManifestSize)).Decode(manifest); err != nil {
+				return nil, nil, ErrBackupMismatch
+			}
+			continue
+		}
+		open := func() (io.ReadCloser, error) { return ioutil.NopCloser(tr), nil }
+		if err := files.add(hdr.Name, hdr.Size, open); err != nil {
+			return nil, nil, err
+		}
+	}
+	if manifest == nil {
+		return nil, nil, ErrBackupMismatch
+	}
+	keySet, err := files.keySet()
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := manifest.check(keySet); err != nil {
+		return nil, nil, err
+	}
+	return keySet, manifest, nil
+}
+
+// check the key set matches the manifest, file for file
+func (manifest *BackupManifest) check(reader KeyReader) error {
+	meta, err := reader.GetMetadata()
+	if err != nil || backupHash(meta) != manifest.MetaSHA256 {
+		return ErrBackupMismatch
+	}
+	var km KeyMeta
+	if err := json.Unmarshal([]byte(meta), &km); err != nil {
+		return ErrBackupMismatch
+	}
+	if km.Name != manifest.Name || km.Type != manifest.Type || km.Purpose != manifest.Purpose ||
+		km.Encrypted != manifest.Encrypted || len(km.Versions) != len(manifest.Versions) {
+		return ErrBackupMismatch
+	}
+	for i, bv := range manifest.Versions {
+		kv := km.Versions[i]
+		if kv.VersionNumber != bv.VersionNumber || kv.Status != bv.Status || kv.Created != bv.Created {
+			return ErrBackupMismatch
+		}
+		key, err := reader.GetKey(bv.VersionNumber)
+		if err != nil || backupHash(key) != bv.SHA256 {
+			return ErrBackupMismatch
+		}
+	}
+	return nil
+}
@@ -0,0 +1,208 @@
+package dkeyczar
+
+import (
+	"runtime"
+	"strconv"
+	"sync"
+	"sync/atomic"
+)
+
+// BatchEncrypter is implemented by the Encrypters and Crypters made from key sets
+type BatchEncrypter interface {
+	// EncryptAll encrypts each plaintext with the primary key, looked up once for the batch
+	EncryptAll(plaintexts [][]byte) ([]string, error)
+}
+
+// BatchDecrypter is implemented by the Crypters made from key sets
+type BatchDecrypter interface {
+	// DecryptAll decrypts each ciphertext with whichever key made it
+	DecryptAll(ciphertexts []string) ([][]byte, error)
+}
+
+// BatchSigner is implemented by the Signers made from key sets
+type BatchSigner interface {
+	// SignAll signs each message with the primary key, looked up once for the batch
+	SignAll(messages [][]byte) ([]string, error)
+}
+
+// BatchVerifier is implemented by the Signers and Verifiers made from key sets
+type BatchVerifier interface {
+	// VerifyAll checks signatures[i] on messages[i].  A signature that doesn't
+	// verify is false, not an error; malformed ones are errors.
+	VerifyAll(messages [][]byte, signatures []string) ([]bool, error)
+}
+
+// BatchError is returned by the batch methods for the first item, in batch order, that failed
+type BatchError struct {
+	Index int   // the index of the item in the batch
+	Err   error // why it failed
+}
+
+func (e *BatchError) Error() string {
+	return "keyczar: batch item " + strconv.Itoa(e.Index) + ": " + e.Err.Error()
+}
+
+func (e *BatchError) Unwrap() error { return e.Err }
+
+type BatchController interface {
+	// Set how many goroutines a batch is spread across; 0 or 1 runs it on the calling goroutine,
+	// a negative number uses one per CPU
+	SetBatchWorkers(n int)
+	// Return how many goroutines a batch is spread across
+	BatchWorkers() int
+}
+
+type batchController struct {
+	workers int
+}
+
+// BatchWorkers returns how many goroutines the keyczar object spreads a batch across
+func (bc batchController) BatchWorkers() int {
+	return bc.workers
+}
+
+// SetBatchWorkers sets how many goroutines the keyczar object spreads a batch across
+func (bc *batchController) SetBatchWorkers(n int) {
+	bc.workers = n
+}
+
+// call f for each index below n, on up to bc.workers goroutines.  Items are
+// handed out in order and none are started after one fails, so every item
+// before the failing one has run, and the error returned is that of the first
+// failure in batch order.
+func (bc batchController) run(n int, f func(i int) error) error {
+	workers := bc.workers
+	if workers < 0 {
+		workers = runtime.GOMAXPROCS(0)
+	}
+	if workers > n {
+		workers = n
+	}
+	if workers <= 1 {
+		for i := 0; i < n; i++ {
+			if err := f(i); err != nil {
+				return &BatchError{i, err}
+			}
+		}
+		return nil
+	}
+
+	var (
+		next   int64 = -1
+		failed int32
+		mu     sync.Mutex
+		first  *BatchError
+		wg     sync.WaitGroup
+	)
+	wg.Add(workers)
+	for w := 0; w < workers; w++ {
+		go func() {
+			defer wg.Done()
+			for atomic.LoadInt32(&failed) == 0 {
+				i := int(atomic.AddInt64(&next, 1))
+				if i >= n {
+					return
+				}
+				if err := f(i); err != nil {
+					atomic.StoreInt32(&failed, 1)
+					mu.Lock()
+					if first == nil || i < first.Index {
+						first = &BatchError{i, err}
+					}
+					mu.Unlock()
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	if first != nil {
+		return first
+	}
+	return nil
+}
+
+// EncryptAll encrypts each plaintext like Encrypt
+func (kc *keyEncrypter) EncryptAll(plaintexts [][]byte) ([]string, error) {
+	key, err := kc.kz.primaryKey()
+	if err != nil {
+		kc.observe(OP_ENCRYPT, kc.startTimer(), kc.kz, nil, err)
+		return nil, err
+	}
+	out := make([]string, len(plaintexts))
+	err = kc.run(len(plaintexts), func(i int) error {
+		start := kc.startTimer()
+		s, err := kc.encryptWithKey(key, plaintexts[i], nil)
+		kc.observe(OP_ENCRYPT, start, kc.kz, key, err)
+		out[i] = s
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// DecryptAll decrypts each ciphertext like Decrypt
+func (kc *keyCrypter) DecryptAll(ciphertexts []string) ([][]byte, error) {
+	out := make([][]byte, len(ciphertexts))
+	err := kc.run(len(ciphertexts), func(i int) error {
+		plaintext, _, err := kc.decrypt(ciphertexts[i], nil)
+		out[i] = plaintext
+		return err
+	})
+	if err != nil {
+		for _, p := range out {
+			wipeBytes(p)
+		}
+		return nil, err
+	}
+	return out, nil
+}
+
+// SignAll signs each message like Sign
+func (ks *keySigner) SignAll(messages [][]byte) ([]string, error) {
+	key, err := ks.kz.primaryKey()
+	if err != nil {
+		ks.observe(OP_SIGN, ks.startTimer(), ks.kz, nil, err)
+		return nil, err
+	}
+	out := make([]string, len(messages))
+	err = ks.run(len(messages), func(i int) error {
+		start := ks.startTimer()
+		s, err := ks.sign(key, messages[i])
+		ks.observe(OP_SIGN, start, ks.kz, key, err)
+		out[i] = s
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// VerifyAll checks each signature like Verify
+func (ks *keySigner) VerifyAll(messages [][]byte, signatures []string) ([]bool, error) {
+	if len(messages) != len(signatures) {
+		return nil, ErrBatchLength
+	}
+	out := make([]bool, len(messages))
+	err := ks.run(len(messages), func(i int) error {
+		k, err := ks.verify(messages[i], signatures[i])
+		out[i] = k != nil
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// WithBatchWorkers spreads the batches of a Crypter, Encrypter, Signer or Verifier across n goroutines,
+// or one per CPU if n is negative
+func WithBatchWorkers(n int) Option {
+	return func(x interface{}) {
+		if bc, ok := x.(BatchController); ok {
+			bc.SetBatchWorkers(n)
+		}
+	}
+}
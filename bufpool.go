@@ -0,0 +1,127 @@
+package dkeyczar
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"sync"
+)
+
+// buffers larger than this aren't kept, so one huge message doesn't pin its memory
+const maxPooledBuffer = 64 * 1024
+
+// A pool of scratch buffers for assembling and encoding ciphertexts.
+// Buffers are zeroed before going back into the pool.  A nil *bufferPool
+// allocates fresh buffers and drops them, so callers can turn pooling off.
+type bufferPool struct {
+	pool sync.Pool
+}
+
+var defaultBufferPool bufferPool
+
+// return an empty buffer with at least n bytes of capacity
+func (bp *bufferPool) get(n int) []byte {
+	if bp != nil {
+		if b, ok := bp.pool.Get().(*[]byte); ok && cap(*b) >= n {
+			return (*b)[:0]
+		}
+	}
+	return make([]byte, 0, n)
+}
+
+// zero b and keep it for reuse
+func (bp *bufferPool) put(b []byte) {
+	if bp == nil || cap(b) > maxPooledBuffer {
+		return
+	}
+	b = b[:cap(b)]
+	wipeBytes(b)
+	b = b[:0]
+	bp.pool.Put(&b)
+}
+
+type BufferPoolController interface {
+	// Set whether scratch buffers are shared through a pool
+	SetBufferPooling(enabled bool)
+	// Return whether scratch buffers are shared through a pool
+	BufferPooling() bool
+}
+
+// pooling is on by default, hence the negative flag
+type bufferPoolController struct {
+	noPooling bool
+}
+
+// BufferPooling returns whether the keyczar object reuses its scratch buffers
+func (bc bufferPoolController) BufferPooling() bool {
+	return !bc.noPooling
+}
+
+// SetBufferPooling sets whether the keyczar object reuses its scratch buffers.
+// Pooled buffers are zeroed when released, but callers that don't want key
+// adjacent data passing through shared memory at all can turn it off.
+func (bc *bufferPoolController) SetBufferPooling(enabled bool) {
+	bc.noPooling = !enabled
+}
+
+// return the pool to use, nil if pooling is off
+func (bc bufferPoolController) buffers() *bufferPool {
+	if bc.noPooling {
+		return nil
+	}
+	return &defaultBufferPool
+}
+
+// encode 'data' like encode, using a pooled buffer for the encoded bytes
+func (ec encodingController) encodePooled(data []byte, bp *bufferPool) string {
+	var b []byte
+	switch ec.encoding {
+	case BASE64W:
+		b = bp.get(base64.RawURLEncoding.EncodedLen(len(data)))
+		b = b[:base64.RawURLEncoding.EncodedLen(len(data))]
+		base64.RawURLEncoding.Encode(b, data)
+	case HEX:
+		b = bp.get(hex.EncodedLen(len(data)))
+		b = b[:hex.EncodedLen(len(data))]
+		hex.Encode(b, data)
+	default:
+		return ec.encode(data)
+	}
+	s := string(b)
+	bp.put(b)
+	return s
+}
+
+// decode 'data' like decode, into a pooled buffer which the caller should put back
+func (ec encodingController) decodePooled(data string, bp *bufferPool) ([]byte, error) {
+	var b []byte
+	var err error
+	var n int
+	switch ec.encoding {
+	case BASE64W:
+		// accept padded input, as decodeWeb64String does
+		for len(data) > 0 && data[len(data)-1] == '=' {
+			data = data[:len(data)-1]
+		}
+		b = bp.get(base64.RawURLEncoding.DecodedLen(len(data)))
+		n, err = base64.RawURLEncoding.Decode(b[:base64.RawURLEncoding.DecodedLen(len(data))], []byte(data))
+	case HEX:
+		b = bp.get(hex.DecodedLen(len(data)))
+		n, err = hex.Decode(b[:hex.DecodedLen(len(data))], []byte(data))
+	default:
+		return ec.decode(data)
+	}
+	if err != nil {
+		bp.put(b)
+		return nil, err
+	}
+	return b[:n], nil
+}
+
+// WithBufferPooling turns the reuse of scratch buffers by a Crypter or Encrypter on or off.  It is on by default.
+func WithBufferPooling(enabled bool) Option {
+	return func(x interface{}) {
+		if bc, ok := x.(BufferPoolController); ok {
+			bc.SetBufferPooling(enabled)
+		}
+	}
+}
@@ -0,0 +1,153 @@
+package dkeyczar
+
+import (
+	"crypto/cipher"
+	"crypto/sha1"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"sync"
+
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+// ChaCha20-Poly1305 keys are an AEAD alternative to AES+HMAC that is fast
+// without hardware AES support.  The data array looks like:
+// |header|nonce|ciphertext+tag|
+// The header is authenticated as additional data.
+type chachaKeyJSON struct {
+	ChaChaKeyString string `json:"chachaKeyString"`
+	Size            uint   `json:"size"`
+}
+
+type chachaKey struct {
+	key []byte
+	id  []byte
+	randSource
+
+	// the aead, built on first use.  It is safe for concurrent use.
+	once    sync.Once
+	aead    cipher.AEAD
+	aeadErr error
+}
+
+func (ck *chachaKey) getAEAD() (cipher.AEAD, error) {
+	ck.once.Do(func() { ck.aead, ck.aeadErr = chacha20poly1305.New(ck.key) })
+	return ck.aead, ck.aeadErr
+}
+
+func generateChaChaKey(size uint, rng io.Reader) (*chachaKey, error) {
+	ck := new(chachaKey)
+	if size == 0 {
+		size = T_CHACHA20_POLY1305.defaultSize()
+	}
+	if !T_CHACHA20_POLY1305.isAcceptableSize(size) {
+		return nil, ErrInvalidKeySize
+	}
+	ck.key = make([]byte, size/8)
+	if _, err := io.ReadFull(rng, ck.key); err != nil {
+		return nil, err
+	}
+	return ck, nil
+}
+
+func (ck *chachaKey) secret() []byte {
+	return append([]byte(nil), ck.key...)
+}
+
+func (ck *chachaKey) KeyID() []byte {
+	if len(ck.id) != 0 {
+		return ck.id
+	}
+	h := sha1.New()
+	binary.Write(h, binary.BigEndian, uint32(len(ck.key)))
+	h.Write(ck.key)
+	ck.id = h.Sum(nil)[:4]
+	return ck.id
+}
+
+func newChaChaKeyFromJSON(s []byte) (*chachaKey, error) {
+	ck := new(chachaKey)
+	cjson := new(chachaKeyJSON)
+	var err error
+	err = json.Unmarshal(s, &cjson)
+	if err != nil {
+		return nil, err
+	}
+	if !T_CHACHA20_POLY1305.isAcceptableSize(cjson.Size) {
+		return nil, ErrInvalidKeySize
+	}
+	ck.key, err = decodeWeb64String(cjson.ChaChaKeyString)
+	if err != nil {
+		return nil, ErrBase64Decoding
+	}
+	if uint(len(ck.key))*8 != cjson.Size {
+		return nil, ErrInvalidKeySize
+	}
+	return ck, nil
+}
+
+func newChaChaJSONFromKey(key *chachaKey) *chachaKeyJSON {
+	cjson := new(chachaKeyJSON)
+	cjson.ChaChaKeyString = encodeWeb64String(key.key)
+	cjson.Size = uint(len(key.key)) * 8
+	return cjson
+}
+
+func (ck *chachaKey) ToKeyJSON() []byte {
+	j := newChaChaJSONFromKey(ck)
+	s, _ := json.Marshal(j)
+	return s
+}
+
+func (ck *chachaKey) Encrypt(data []byte) ([]byte, error) {
+	return ck.encryptWithAAD(data, nil)
+}
+
+// the header is always authenticated, followed by any associated data
+func chachaAD(h []byte, aad []byte) []byte {
+	if len(aad) == 0 {
+		return h
+	}
+	return append(append([]byte(nil), h...), aad...)
+}
+
+func (ck *chachaKey) encryptWithAAD(data []byte, aad []byte) ([]byte, error) {
+	aead, err := ck.getAEAD()
+	if err != nil {
+		return nil, err
+	}
+	h := makeHeader(ck)
+	out := make([]byte, kzHeaderLength+aead.NonceSize(), kzHeaderLength+aead.NonceSize()+len(data)+aead.Overhead())
+	copy(out, h)
+	nonce := out[kzHeaderLength:]
+	if _, err := io.ReadFull(ck.random(), nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(out, nonce, data, chachaAD(h, aad)), nil
+}
+
+func (ck *chachaKey) iv(ciphertext []byte) []byte {
+	return ciphertext[kzHeaderLength : kzHeaderLength+chacha20poly1305.NonceSize]
+}
+
+func (ck *chachaKey) Decrypt(data []byte) ([]byte, error) {
+	return ck.decryptWithAAD(data, nil)
+}
+
+func (ck *chachaKey) decryptWithAAD(data []byte, aad []byte) ([]byte, error) {
+	if len(data) < kzHeaderLength+chacha20poly1305.NonceSize+chacha20poly1305.Overhead {
+		return nil, ErrShortCiphertext
+	}
+	aead, err := ck.getAEAD()
+	if err != nil {
+		return nil, err
+	}
+	h := data[:kzHeaderLength]
+	nonce := data[kzHeaderLength : kzHeaderLength+aead.NonceSize()]
+	plaintext, err := aead.Open(nil, nonce, data[kzHeaderLength+aead.NonceSize():], chachaAD(h, aad))
+	if err != nil {
+		return nil, ErrInvalidSignature
+	}
+	return plaintext, nil
+}
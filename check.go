@@ -0,0 +1,165 @@
+package dkeyczar
+
+import (
+	"encoding/json"
+	"strconv"
+)
+
+type IssueSeverity int
+
+const (
+	ISSUE_WARNING IssueSeverity = iota // The key set works, but should be looked at
+	ISSUE_ERROR                        // The key set, or some of its keys, can't be used
+)
+
+func (s IssueSeverity) String() string {
+	if s == ISSUE_ERROR {
+		return "error"
+	}
+	return "warning"
+}
+
+// An Issue is a problem found by ValidateKeyset
+type Issue struct {
+	Severity IssueSeverity
+	Version  int   // the key version concerned, or 0 for the whole key set
+	Err      error // what is wrong, usually one of the Err* values
+}
+
+func (i Issue) String() string {
+	s := i.Severity.String() + ": "
+	if i.Version != 0 {
+		s += "version " + strconv.Itoa(i.Version) + ": "
+	}
+	return s + i.Err.Error()
+}
+
+// the smallest key sizes we don't warn about
+var minKeySizes = map[KeyType]uint{
+	T_AES:      128,
+	T_RSA_PRIV: 2048,
+	T_RSA_PUB:  2048,
+}
+
+// return the size in bits of a key, or 0 if we don't know it
+func keySize(k keydata) uint {
+	switch k := k.(type) {
+	case *aesKey:
+		return uint(len(k.key)) * 8
+	case *rsaKey:
+		return uint(k.key.N.BitLen())
+	case *rsaPublicKey:
+		return uint(k.key.N.BitLen())
+	case *hmacKey:
+		return uint(len(k.key)) * 8
+	case *dsaKey:
+		return uint(k.key.P.BitLen())
+	case *dsaPublicKey:
+		return uint(k.key.P.BitLen())
+	case *ecdsaKey:
+		return uint(k.key.Curve.Params().BitSize)
+	case *ecdsaPublicKey:
+		return uint(k.key.Curve.Params().BitSize)
+	case *chachaKey:
+		return uint(len(k.key)) * 8
+	case *aesSIVKey:
+		return uint(len(k.key)) * 8
+	case *ed25519Key, *ed25519PublicKey, *x25519Key, *x25519PublicKey:
+		return 256
+	case *cryptoSignerKey:
+		return keySize(k.verifyKey)
+	}
+	return 0
+}
+
+// ValidateKeyset reads the whole key set from reader and reports everything
+// that looks wrong with it: metadata that doesn't make sense, a missing
+// primary key, a reader that doesn't decrypt the keys of an encrypted key set
+// or decrypts those of a plaintext one, key versions that can't be read or don't
+// match the metadata, keys below the recommended size, password-protected keys with weak
+// parameters, keys marked exportable and a primary key outside its lifetime.
+// It returns nil if no issues were found.
+func ValidateKeyset(reader KeyReader) []Issue {
+	var issues []Issue
+	add := func(severity IssueSeverity, version int, err error) {
+		issues = append(issues, Issue{severity, version, err})
+	}
+
+	s, err := reader.GetMetadata()
+	if err != nil {
+		add(ISSUE_ERROR, 0, err)
+		return issues
+	}
+	var km KeyMeta
+	if err := json.Unmarshal([]byte(s), &km); err != nil {
+		// nothing else can be checked without the metadata
+		add(ISSUE_ERROR, 0, err)
+		return issues
+	}
+	if err := km.validate(); err != nil {
+		add(ISSUE_ERROR, 0, err)
+	}
+	if decrypts := decryptsKeys(reader); km.Encrypted && !decrypts {
+		add(ISSUE_ERROR, 0, &KeysetEncryptionError{Name: km.Name, Encrypted: true})
+	} else if !km.Encrypted && decrypts {
+		add(ISSUE_WARNING, 0, &KeysetEncryptionError{Name: km.Name})
+	}
+
+	primaries := 0
+	for _, v := range km.Versions {
+		if v.Status == S_PRIMARY {
+			primaries++
+			if err := v.usableAt(currentMillis()); err != nil {
+				add(ISSUE_ERROR, v.VersionNumber, err)
+			}
+		}
+	}
+	if primaries == 0 {
+		add(ISSUE_ERROR, 0, ErrNoPrimaryKey)
+	}
+
+	keyFromJSON := keyFromJSONFunc(km.Type)
+	for _, v := range km.Versions {
+		if v.Exportable {
+			add(ISSUE_WARNING, v.VersionNumber, ErrExportableKey)
+		}
+		s, err := reader.GetKey(v.VersionNumber)
+		if err != nil {
+			add(ISSUE_ERROR, v.VersionNumber, &KeyNotFoundError{Version: v.VersionNumber, Err: err})
+			continue
+		}
+		if keyFromJSON == nil {
+			continue
+		}
+		// a key of another type, or a mangled one, fails to parse
+		k, err := keyFromJSON([]byte(s))
+		if err != nil {
+			add(ISSUE_ERROR, v.VersionNumber, err)
+			continue
+		}
+		if min, ok := minKeySizes[km.Type]; ok && keySize(k) < min {
+			add(ISSUE_WARNING, v.VersionNumber, ErrWeakKey)
+		}
+		if weakPBEKey(reader, v.VersionNumber) {
+			add(ISSUE_WARNING, v.VersionNumber, ErrWeakPBE)
+		}
+	}
+	return issues
+}
+
+// report whether reader decrypts a password-based key protected with weak parameters
+func weakPBEKey(reader KeyReader, version int) bool {
+	er, ok := reader.(*encryptedReader)
+	if !ok {
+		return false
+	}
+	if _, ok := er.crypter.(*pbeCrypter); !ok {
+		return false
+	}
+	s, err := er.reader.GetKey(version)
+	if err != nil {
+		return false
+	}
+	p, err := GetPBEParams(s)
+	return err == nil && p.Weak()
+}
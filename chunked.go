@@ -0,0 +1,380 @@
+package dkeyczar
+
+import (
+	"crypto/aes"
+	"crypto/rand"
+	"encoding/binary"
+	"io"
+	"os"
+	"sync"
+)
+
+// Chunked files: encryption at rest for large files that must be read at any
+// offset, e.g. backup archives.  Like an envelope, the file has a fresh
+// AES+HMAC data key, encrypted with the key set, and the data split in chunks
+// each encrypted on its own with the data key, with their own IV and HMAC.
+// The file looks like:
+// |magic|version|chunk size|wrapped key length|wrapped key|chunk|chunk|...
+// The sizes are big-endian uint32s, and the wrapped key is the key set's output
+// as is.  Every chunk but the last holds chunk size bytes of plaintext; the
+// last one holds the rest, and is there even if it is empty.  A chunk
+// authenticates its index and whether it is the last as associated data, so
+// chunks can't be reordered or dropped, nor the file truncated after one.
+
+const chunkedMagic = "DKZC"
+
+const chunkedVersion = uint8(1)
+
+// ChunkSize is the plaintext size of the chunks of the files written by NewChunkedWriter
+const ChunkSize = 64 << 10
+
+// the largest chunk size a reader accepts
+const maxChunkSize = 16 << 20
+
+// the fixed part of the header
+const chunkedHeaderLength = len(chunkedMagic) + 1 + 4 + 4
+
+// the length of an encrypted chunk of n plaintext bytes
+func chunkSealedLength(n int) int {
+	return kzHeaderLength + aes.BlockSize + (n/aes.BlockSize+1)*aes.BlockSize + hmacSigLength
+}
+
+// the associated data of chunk i
+func chunkAAD(i int64, last bool) []byte {
+	aad := make([]byte, 9)
+	binary.BigEndian.PutUint64(aad, uint64(i))
+	if last {
+		aad[8] = 1
+	}
+	return aad
+}
+
+type chunkedWriter struct {
+	dek    *aesKey
+	sink   io.Writer
+	buf    []byte
+	index  int64
+	closed bool
+}
+
+// NewChunkedWriter returns a writer that encrypts everything written to it in chunks,
+// writing them to sink; see NewChunkedReader to read them back.  The data key is
+// encrypted with encrypter, and written to sink first.  Close writes the last chunk;
+// it doesn't close sink.
+func NewChunkedWriter(encrypter Encrypter, sink io.Writer) (io.WriteCloser, error) {
+	dek, err := generateAESKey(0, rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	packed := dek.packedKeys()
+	wrapped, err := encrypter.Encrypt(packed)
+	wipeBytes(packed)
+	if err != nil {
+		wipeKeydata(dek)
+		return nil, err
+	}
+	header := make([]byte, chunkedHeaderLength, chunkedHeaderLength+len(wrapped))
+	copy(header, chunkedMagic)
+	header[len(chunkedMagic)] = chunkedVersion
+	binary.BigEndian.PutUint32(header[len(chunkedMagic)+1:], ChunkSize)
+	binary.BigEndian.PutUint32(header[len(chunkedMagic)+5:], uint32(len(wrapped)))
+	header = append(header, wrapped...)
+	if _, err := sink.Write(header); err != nil {
+		wipeKeydata(dek)
+		return nil, err
+	}
+	return &chunkedWriter{dek: dek, sink: sink, buf: make([]byte, 0, ChunkSize)}, nil
+}
+
+func (w *chunkedWriter) writeChunk(plaintext []byte, last bool) error {
+	chunk, err := w.dek.encryptWithAAD(plaintext, chunkAAD(w.index, last))
+	if err != nil {
+		return err
+	}
+	w.index++
+	_, err = w.sink.Write(chunk)
+	return err
+}
+
+func (w *chunkedWriter) Write(data []byte) (int, error) {
+	if w.closed {
+		return 0, io.ErrClosedPipe
+	}
+	n := 0
+	for len(data) > 0 {
+		// a full chunk is held back until more data shows it isn't the last
+		if len(w.buf) == ChunkSize {
+			if err := w.writeChunk(w.buf, false); err != nil {
+				return n, err
+			}
+			w.buf = w.buf[:0]
+		}
+		c := copy(w.buf[len(w.buf):ChunkSize], data)
+		w.buf = w.buf[:len(w.buf)+c]
+		data = data[c:]
+		n += c
+	}
+	return n, nil
+}
+
+func (w *chunkedWriter) Close() error {
+	if w.closed {
+		return nil
+	}
+	w.closed = true
+	err := w.writeChunk(w.buf, true)
+	wipeBytes(w.buf[:cap(w.buf)])
+	wipeKeydata(w.dek)
+	return err
+}
+
+// A ChunkedReader decrypts a file written by NewChunkedWriter, at any offset.
+// Only the chunks read are decrypted, and each is authenticated before any of it is returned.
+// ReadAt is safe for concurrent use; Read and Seek share an offset, like those of an os.File.
+type ChunkedReader struct {
+	dek         *aesKey
+	src         io.ReaderAt
+	closer      io.Closer
+	dataStart   int64
+	chunkSize   int64
+	sealedChunk int64
+	lastSealed  int64 // the encrypted length of the last chunk
+	chunks      int64
+	size        int64
+
+	mu     sync.Mutex
+	offset int64
+	cached int64 // the index of the chunk in plain, or -1
+	plain  []byte
+}
+
+// NewChunkedReader returns a reader of the size bytes of src written by NewChunkedWriter.
+// The data key is decrypted with crypter, which must have the same encoding and
+// compression as the Encrypter used to write it.
+func NewChunkedReader(crypter Crypter, src io.ReaderAt, size int64) (*ChunkedReader, error) {
+	header := make([]byte, chunkedHeaderLength)
+	if n, _ := src.ReadAt(header, 0); n < len(header) {
+		return nil, ErrMalformedChunked
+	}
+	if string(header[:len(chunkedMagic)]) != chunkedMagic {
+		return nil, ErrMalformedChunked
+	}
+	if v := header[len(chunkedMagic)]; v != chunkedVersion {
+		return nil, &UnsupportedVersionError{Version: v}
+	}
+	chunkSize := int64(binary.BigEndian.Uint32(header[len(chunkedMagic)+1:]))
+	wrappedLength := int64(binary.BigEndian.Uint32(header[len(chunkedMagic)+5:]))
+	if chunkSize == 0 || chunkSize > maxChunkSize || chunkSize%aes.BlockSize != 0 ||
+		wrappedLength > size-int64(chunkedHeaderLength) {
+		return nil, ErrMalformedChunked
+	}
+	wrapped := make([]byte, wrappedLength)
+	if n, _ := src.ReadAt(wrapped, int64(chunkedHeaderLength)); n < len(wrapped) {
+		return nil, ErrMalformedChunked
+	}
+	packed, err := crypter.Decrypt(string(wrapped))
+	if err != nil {
+		return nil, err
+	}
+	dek, err := newAESFromPackedKeys(packed)
+	wipeBytes(packed)
+	if err != nil {
+		return nil, err
+	}
+	cr := &ChunkedReader{
+		dek:         dek,
+		src:         src,
+		dataStart:   int64(chunkedHeaderLength) + wrappedLength,
+		chunkSize:   chunkSize,
+		sealedChunk: int64(chunkSealedLength(int(chunkSize))),
+		cached:      -1,
+	}
+	body := size - cr.dataStart
+	cr.chunks = (body + cr.sealedChunk - 1) / cr.sealedChunk
+	cr.lastSealed = body - (cr.chunks-1)*cr.sealedChunk
+	if cr.chunks == 0 || cr.lastSealed < int64(chunkSealedLength(0)) {
+		wipeKeydata(dek)
+		return nil, ErrMalformedChunked
+	}
+	// the last chunk gives the size, and shows the file wasn't truncated
+	last, err := cr.chunk(cr.chunks - 1)
+	if err != nil {
+		wipeKeydata(dek)
+		return nil, err
+	}
+	cr.size = (cr.chunks-1)*chunkSize + int64(len(last))
+	return cr, nil
+}
+
+// OpenChunkedFile opens the file at path, written by NewChunkedWriter, for reading with a ChunkedReader.
+// Closing the reader closes the file.
+func OpenChunkedFile(crypter Crypter, path string) (*ChunkedReader, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	cr, err := NewChunkedReader(crypter, f, fi.Size())
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	cr.closer = f
+	return cr, nil
+}
+
+// return the plaintext of chunk i, which the caller must not modify
+func (cr *ChunkedReader) chunk(i int64) ([]byte, error) {
+	cr.mu.Lock()
+	defer cr.mu.Unlock()
+	if cr.cached == i {
+		return cr.plain, nil
+	}
+	n := cr.sealedChunk
+	if i == cr.chunks-1 {
+		n = cr.lastSealed
+	}
+	sealed := make([]byte, n)
+	if m, err := cr.src.ReadAt(sealed, cr.dataStart+i*cr.sealedChunk); m < len(sealed) {
+		return nil, err
+	}
+	plain, err := cr.dek.decryptWithAAD(sealed, chunkAAD(i, i == cr.chunks-1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(plain)) > cr.chunkSize || (i < cr.chunks-1 && int64(len(plain)) != cr.chunkSize) {
+		return nil, ErrMalformedChunked
+	}
+	// a chunk handed out is never changed, so it can be copied from after the lock is released
+	cr.cached, cr.plain = i, plain
+	return plain, nil
+}
+
+// Size returns the size of the plaintext
+func (cr *ChunkedReader) Size() int64 {
+	return cr.size
+}
+
+// ReadAt reads len(p) bytes of plaintext starting at off, like io.ReaderAt
+func (cr *ChunkedReader) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, ErrInvalidLength
+	}
+	n := 0
+	for n < len(p) {
+		if off >= cr.size {
+			return n, io.EOF
+		}
+		i := off / cr.chunkSize
+		plain, err := cr.chunk(i)
+		if err != nil {
+			return n, err
+		}
+		c := copy(p[n:], plain[off-i*cr.chunkSize:])
+		n += c
+		off += int64(c)
+	}
+	return n, nil
+}
+
+// Read reads plaintext from the current offset, like io.Reader
+func (cr *ChunkedReader) Read(p []byte) (int, error) {
+	cr.mu.Lock()
+	off := cr.offset
+	cr.mu.Unlock()
+	n, err := cr.ReadAt(p, off)
+	cr.mu.Lock()
+	cr.offset = off + int64(n)
+	cr.mu.Unlock()
+	if n > 0 && err == io.EOF {
+		err = nil
+	}
+	return n, err
+}
+
+// Seek sets the offset of the next Read, like io.Seeker
+func (cr *ChunkedReader) Seek(offset int64, whence int) (int64, error) {
+	cr.mu.Lock()
+	defer cr.mu.Unlock()
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += cr.offset
+	case io.SeekEnd:
+		offset += cr.size
+	default:
+		return 0, ErrInvalidLength
+	}
+	if offset < 0 {
+		return 0, ErrInvalidLength
+	}
+	cr.offset = offset
+	return offset, nil
+}
+
+// Close wipes the data key, and closes the file of a reader made by OpenChunkedFile
+func (cr *ChunkedReader) Close() error {
+	cr.mu.Lock()
+	wipeKeydata(cr.dek)
+	wipeBytes(cr.plain)
+	cr.cached, cr.plain = -1, nil
+	cr.mu.Unlock()
+	if cr.closer != nil {
+		return cr.closer.Close()
+	}
+	return nil
+}
+
+// EncryptFile encrypts the file src into a chunked file dst, which NewChunkedReader,
+// OpenChunkedFile and DecryptFile read.  dst is created readable by its owner only.
+func EncryptFile(encrypter Encrypter, src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	w, err := NewChunkedWriter(encrypter, out)
+	if err == nil {
+		_, err = io.Copy(w, in)
+		if cerr := w.Close(); err == nil {
+			err = cerr
+		}
+	}
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(dst)
+	}
+	return err
+}
+
+// DecryptFile decrypts the chunked file src, written by EncryptFile or NewChunkedWriter, into dst.
+// dst is created readable by its owner only.
+func DecryptFile(crypter Crypter, src, dst string) error {
+	cr, err := OpenChunkedFile(crypter, src)
+	if err != nil {
+		return err
+	}
+	defer cr.Close()
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, cr)
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(dst)
+	}
+	return err
+}
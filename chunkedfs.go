@@ -0,0 +1,71 @@
+package dkeyczar
+
+import (
+	"bytes"
+	"io"
+	"io/fs"
+	"io/ioutil"
+)
+
+// NewChunkedFS returns a view of fsys whose files, written by EncryptFile or NewChunkedWriter,
+// are decrypted with crypter when opened, e.g. to serve an encrypted asset bundle with http.FS.
+// The files opened can Seek and ReadAt, and their Stat reports the size of the plaintext.
+// Directories are passed through as they are, so the sizes of their entries are those of the encrypted files.
+// Files of an fsys that can't ReadAt are read into memory when opened.
+func NewChunkedFS(crypter Crypter, fsys fs.FS) fs.FS {
+	return &chunkedFS{crypter: crypter, fsys: fsys}
+}
+
+type chunkedFS struct {
+	crypter Crypter
+	fsys    fs.FS
+}
+
+func (cfs *chunkedFS) Open(name string) (fs.File, error) {
+	f, err := cfs.fsys.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	if info.IsDir() {
+		return f, nil
+	}
+	src, ok := f.(io.ReaderAt)
+	if !ok {
+		b, err := ioutil.ReadAll(f)
+		if err != nil {
+			f.Close()
+			return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+		}
+		src = bytes.NewReader(b)
+	}
+	cr, err := NewChunkedReader(cfs.crypter, src, info.Size())
+	if err != nil {
+		f.Close()
+		return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+	}
+	cr.closer = f
+	return &chunkedFile{cr, info}, nil
+}
+
+// a file of a chunkedFS, which reads and seeks through its ChunkedReader
+type chunkedFile struct {
+	*ChunkedReader
+	info fs.FileInfo
+}
+
+func (f *chunkedFile) Stat() (fs.FileInfo, error) {
+	return chunkedFileInfo{f.info, f.Size()}, nil
+}
+
+// the info of the encrypted file, with the size of the plaintext
+type chunkedFileInfo struct {
+	fs.FileInfo
+	size int64
+}
+
+func (fi chunkedFileInfo) Size() int64 { return fi.size }
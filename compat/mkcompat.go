@@ -159,7 +159,11 @@ func writeKeyczartTest(dir string) {
 
 	km.Load(r)
 
-	json := km.ToJSONs(nil)
+	json, err := km.ToJSONs(nil)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
 
 	fmt.Println(`
 
@@ -0,0 +1,121 @@
+package dkeyczar
+
+import (
+	"context"
+)
+
+// ContextKeyReader is a KeyReader that can honor the cancellation and deadline of a context,
+// such as a reader fetching keys from a remote service.
+type ContextKeyReader interface {
+	KeyReader
+	// GetMetadataContext returns the meta information for this key, giving up when ctx is done
+	GetMetadataContext(ctx context.Context) (string, error)
+	// GetKeyContext returns the key material for a particular version of this key, giving up when ctx is done
+	GetKeyContext(ctx context.Context, version int) (string, error)
+}
+
+type readResult struct {
+	s   string
+	err error
+}
+
+// run f, returning early with the context error if ctx is done first.
+// A plain KeyReader can't be interrupted, so f is left to finish in the background.
+func readWithContext(ctx context.Context, f func() (string, error)) (string, error) {
+	if err := ctx.Err(); err != nil {
+		return "", err
+	}
+	ch := make(chan readResult, 1)
+	go func() {
+		s, err := f()
+		ch <- readResult{s, err}
+	}()
+	select {
+	case res := <-ch:
+		return res.s, res.err
+	case <-ctx.Done():
+		return "", ctx.Err()
+	}
+}
+
+// return the meta information from r, using its context aware method if it has one
+func getMetadataContext(ctx context.Context, r KeyReader) (string, error) {
+	if cr, ok := r.(ContextKeyReader); ok {
+		return cr.GetMetadataContext(ctx)
+	}
+	return readWithContext(ctx, r.GetMetadata)
+}
+
+// return a key version from r, using its context aware method if it has one
+func getKeyContext(ctx context.Context, r KeyReader, version int) (string, error) {
+	if cr, ok := r.(ContextKeyReader); ok {
+		return cr.GetKeyContext(ctx, version)
+	}
+	return readWithContext(ctx, func() (string, error) { return r.GetKey(version) })
+}
+
+// a KeyReader bound to a context, so the existing constructors can use it
+type contextReader struct {
+	ctx    context.Context
+	reader KeyReader
+}
+
+func (r *contextReader) GetMetadata() (string, error) {
+	return getMetadataContext(r.ctx, r.reader)
+}
+
+func (r *contextReader) GetKey(version int) (string, error) {
+	return getKeyContext(r.ctx, r.reader, version)
+}
+
+func (r *contextReader) DecryptsKeys() bool {
+	return decryptsKeys(r.reader)
+}
+
+// pass the context on to the wrapped reader
+func (r *encryptedReader) GetMetadataContext(ctx context.Context) (string, error) {
+	return getMetadataContext(ctx, r.reader)
+}
+
+// a Crypter that can honor the context when decrypting, such as one calling a remote service
+type contextDecrypter interface {
+	decryptContext(ctx context.Context, ciphertext string) ([]byte, error)
+}
+
+// pass the context on to the wrapped reader and decrypt the key
+func (r *encryptedReader) GetKeyContext(ctx context.Context, version int) (string, error) {
+	s, err := getKeyContext(ctx, r.reader, version)
+	if err != nil {
+		return "", err
+	}
+	var b []byte
+	if cd, ok := r.crypter.(contextDecrypter); ok {
+		b, err = cd.decryptContext(ctx, s)
+	} else {
+		b, err = r.crypter.Decrypt(s)
+	}
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+// NewCrypterWithContext is like NewCrypter, but gives up reading the keys when ctx is done
+func NewCrypterWithContext(ctx context.Context, r KeyReader, opts ...Option) (Crypter, error) {
+	return NewCrypter(&contextReader{ctx, r}, opts...)
+}
+
+// NewEncrypterWithContext is like NewEncrypter, but gives up reading the keys when ctx is done
+func NewEncrypterWithContext(ctx context.Context, r KeyReader, opts ...Option) (Encrypter, error) {
+	return NewEncrypter(&contextReader{ctx, r}, opts...)
+}
+
+// NewSignerWithContext is like NewSigner, but gives up reading the keys when ctx is done
+func NewSignerWithContext(ctx context.Context, r KeyReader, opts ...Option) (Signer, error) {
+	return NewSigner(&contextReader{ctx, r}, opts...)
+}
+
+// NewVerifierWithContext is like NewVerifier, but gives up reading the keys when ctx is done
+func NewVerifierWithContext(ctx context.Context, r KeyReader, opts ...Option) (Verifier, error) {
+	return NewVerifier(&contextReader{ctx, r}, opts...)
+}
@@ -15,6 +15,7 @@ import (
 	"compress/gzip"
 	"compress/zlib"
 	"encoding/base64"
+	"encoding/hex"
 	"io"
 )
 
@@ -23,6 +24,7 @@ type Encoding int
 const (
 	BASE64W     Encoding = iota // Encode the output with web-safe base64 [default]
 	NO_ENCODING                 // Do not encode the output
+	HEX                         // Encode the output with lowercase hex
 )
 
 type Compression int
@@ -68,6 +70,8 @@ func (ec encodingController) encode(data []byte) string {
 		return string(data)
 	case BASE64W:
 		return encodeWeb64String(data)
+	case HEX:
+		return hex.EncodeToString(data)
 	}
 	panic("not reached")
 }
@@ -78,6 +82,8 @@ func (ec encodingController) encodeWriter(data io.Writer) io.WriteCloser {
 		return newNopWriteCloser(data)
 	case BASE64W:
 		return base64.NewEncoder(base64.RawURLEncoding, data)
+	case HEX:
+		return newNopWriteCloser(hex.NewEncoder(data))
 	}
 	panic("not reached")
 }
@@ -89,6 +95,8 @@ func (ec encodingController) decode(data string) ([]byte, error) {
 		return []byte(data), nil
 	case BASE64W:
 		return decodeWeb64String(data)
+	case HEX:
+		return hex.DecodeString(data)
 	}
 	panic("not reached")
 }
@@ -99,6 +107,8 @@ func (ec encodingController) decodeReader(data io.Reader) io.Reader {
 		return data
 	case BASE64W:
 		return base64.NewDecoder(base64.RawURLEncoding, data)
+	case HEX:
+		return hex.NewDecoder(data)
 	}
 	panic("not reached")
 }
@@ -163,8 +173,11 @@ func (cc compressionController) decompress(data []byte) ([]byte, error) {
 			return nil, err
 		}
 		var br bytes.Buffer
-		io.Copy(&br, r)
+		_, err = io.Copy(&br, r)
 		r.Close()
+		if err != nil {
+			return nil, err
+		}
 		return (&br).Bytes(), nil
 	case ZLIB:
 		b := bytes.NewBuffer(data)
@@ -173,8 +186,11 @@ func (cc compressionController) decompress(data []byte) ([]byte, error) {
 			return nil, err
 		}
 		var br bytes.Buffer
-		io.Copy(&br, r)
+		_, err = io.Copy(&br, r)
 		r.Close()
+		if err != nil {
+			return nil, err
+		}
 		return (&br).Bytes(), nil
 	}
 	panic("not reached")
@@ -199,3 +215,32 @@ func (cc compressionController) decompressReader(data io.ReadCloser) (io.ReadClo
 	}
 	panic("unknown compressor")
 }
+
+// An Option configures a Crypter, Encrypter, Signer, Verifier or KeyManager when it is created.
+// It is a shorthand for calling the corresponding setter afterwards.
+type Option func(interface{})
+
+// WithCompression sets the compression used by a Crypter or Encrypter
+// The ciphertext doesn't record the compression, so the decrypting side must use the same one.
+func WithCompression(compression Compression) Option {
+	return func(x interface{}) {
+		if cc, ok := x.(CompressionController); ok {
+			cc.SetCompression(compression)
+		}
+	}
+}
+
+// WithEncoding sets the output encoding of a Crypter, Encrypter, Signer or Verifier
+func WithEncoding(encoding Encoding) Option {
+	return func(x interface{}) {
+		if ec, ok := x.(EncodingController); ok {
+			ec.SetEncoding(encoding)
+		}
+	}
+}
+
+func applyOptions(x interface{}, opts []Option) {
+	for _, opt := range opts {
+		opt(x)
+	}
+}
@@ -0,0 +1,112 @@
+package dkeyczar
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"time"
+)
+
+// Encrypted cookies: a value encrypted with a symmetric key set and
+// authenticated along with the cookie name, so a cookie can't be read or
+// changed by the client, nor moved to another cookie.  The plaintext is the
+// expiry time, 8 bytes of seconds since 1/1/1970 GMT, 0 for none, followed by
+// the value.  The sealed value is the ciphertext in unpadded web-safe base64,
+// which needs no quoting in a cookie.
+//
+// Cookies sealed with an older key version open until the version is revoked.
+// With a maxAge, every cookie sealed before a rotation has expired once maxAge
+// has passed, and the old version can be revoked then.
+
+const cookieAAD = "dkeyczar cookie "
+
+// MaxCookieSize is the largest name and sealed value SealCookie makes, together:
+// the 4096 bytes browsers keep for a cookie, less room for its attributes.
+const MaxCookieSize = 3800
+
+// the length of the expiry in a cookie plaintext
+const cookieExpiryLength = 8
+
+// return key if it can seal cookies, or nil
+func cookieKey(key keydata) aadEncryptKey {
+	if _, ok := key.(secretKey); !ok {
+		// a public key would let anyone seal cookies
+		return nil
+	}
+	k, _ := key.(aadEncryptKey)
+	return k
+}
+
+// SealCookie returns value encrypted with the primary key as the value of the cookie name,
+// expiring after maxAge, or never if maxAge isn't positive.
+// The encrypter must have been created by NewEncrypter or NewCrypter from an AES or CHACHA20_POLY1305 key set.
+// Values whose cookie would be larger than MaxCookieSize return ErrCookieTooLarge.
+func SealCookie(encrypter Encrypter, name string, value []byte, maxAge time.Duration) (string, error) {
+	kz := jweKeyCzar(encrypter)
+	if kz == nil {
+		return "", ErrUnsupportedType
+	}
+	key, err := kz.primaryKey()
+	if err != nil {
+		return "", err
+	}
+	k := cookieKey(key)
+	if k == nil {
+		return "", ErrUnsupportedType
+	}
+	plaintext := make([]byte, cookieExpiryLength, cookieExpiryLength+len(value))
+	if maxAge > 0 {
+		binary.BigEndian.PutUint64(plaintext, uint64(time.Now().Add(maxAge).Unix()))
+	}
+	plaintext = append(plaintext, value...)
+	ciphertext, err := k.encryptWithAAD(plaintext, []byte(cookieAAD+name))
+	wipeBytes(plaintext)
+	if err != nil {
+		return "", err
+	}
+	sealed := base64.RawURLEncoding.EncodeToString(ciphertext)
+	if len(name)+len(sealed) > MaxCookieSize {
+		return "", ErrCookieTooLarge
+	}
+	return sealed, nil
+}
+
+// OpenCookie returns the value of the cookie name sealed by SealCookie.
+// Cookies that have expired return ErrCookieExpired; sealed values of another cookie,
+// or that were modified, fail like any other ciphertext.
+func OpenCookie(crypter Crypter, name string, sealed string) ([]byte, error) {
+	kc, ok := crypter.(*keyCrypter)
+	if !ok {
+		return nil, ErrUnsupportedType
+	}
+	if len(name)+len(sealed) > MaxCookieSize {
+		return nil, ErrCookieTooLarge
+	}
+	b, err := base64.RawURLEncoding.DecodeString(sealed)
+	if err != nil {
+		return nil, ErrBase64Decoding
+	}
+	b, kl, err := splitHeaderBytes(kc.encodingController, kc.kz, b, ErrShortCiphertext)
+	if err != nil {
+		return nil, err
+	}
+	for _, key := range kl {
+		dk, ok := key.(aadDecryptKey)
+		if !ok || cookieKey(key) == nil {
+			return nil, ErrUnsupportedType
+		}
+		var plaintext []byte
+		plaintext, err = dk.decryptWithAAD(b, []byte(cookieAAD+name))
+		if err != nil {
+			continue
+		}
+		if len(plaintext) < cookieExpiryLength {
+			return nil, ErrShortCiphertext
+		}
+		expiry := int64(binary.BigEndian.Uint64(plaintext))
+		if expiry != 0 && time.Now().Unix() >= expiry {
+			return nil, ErrCookieExpired
+		}
+		return plaintext[cookieExpiryLength:], nil
+	}
+	return nil, &DecryptError{err}
+}
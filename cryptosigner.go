@@ -0,0 +1,236 @@
+package dkeyczar
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"encoding/json"
+	"hash"
+)
+
+// a public key of the key set whose private half is behind a crypto.Signer,
+// e.g. a PKCS#11 token.  It signs exactly like the matching private key type.
+type cryptoSignerKey struct {
+	verifyKey
+	signer crypto.Signer
+	randSource
+}
+
+func (k *cryptoSignerKey) Sign(msg []byte) ([]byte, error) {
+	if _, ok := k.verifyKey.(*ed25519PublicKey); ok {
+		return k.signer.Sign(k.random(), msg, crypto.Hash(0))
+	}
+	h := k.newHash()
+	if h == nil {
+		return nil, ErrUnsupportedType
+	}
+	h.Write(msg)
+	return k.SignDigest(h.Sum(nil))
+}
+
+// the hash the signatures are made over, or nil if they are made over the whole message
+func (k *cryptoSignerKey) newHash() hash.Hash {
+	if dk, ok := k.verifyKey.(digestVerifyKey); ok {
+		return dk.newHash()
+	}
+	return nil
+}
+
+func (k *cryptoSignerKey) SignDigest(digest []byte) ([]byte, error) {
+	switch pk := k.verifyKey.(type) {
+	case *rsaPublicKey:
+		if pk.scheme == SIG_PSS {
+			return k.signer.Sign(k.random(), digest, pssOptions)
+		}
+		return k.signer.Sign(k.random(), digest, crypto.SHA1)
+	case *ecdsaPublicKey:
+		return k.signer.Sign(k.random(), digest, crypto.SHA1)
+	}
+	return nil, ErrCannotStream
+}
+
+func (k *cryptoSignerKey) VerifyDigest(digest []byte, signature []byte) (bool, error) {
+	if dk, ok := k.verifyKey.(digestVerifyKey); ok {
+		return dk.VerifyDigest(digest, signature)
+	}
+	return false, ErrCannotStream
+}
+
+// return the public key of k as the standard library type, or nil
+func stdPublicKey(k keydata) crypto.PublicKey {
+	switch k := k.(type) {
+	case *rsaPublicKey:
+		return &k.key
+	case *ecdsaPublicKey:
+		return &k.key
+	case *ed25519PublicKey:
+		return k.key
+	}
+	return nil
+}
+
+// replace the keys of kz that have a signer by cryptoSignerKeys
+func attachSigners(kz *keyCzar, signers map[int]crypto.Signer) error {
+	for version, signer := range signers {
+		k, ok := kz.keys[version]
+		if !ok {
+			return ErrNoSuchKeyVersion
+		}
+		pub, ok := stdPublicKey(k).(interface{ Equal(crypto.PublicKey) bool })
+		if !ok {
+			return ErrUnsupportedType
+		}
+		if !pub.Equal(signer.Public()) {
+			return ErrSignerMismatch
+		}
+		sk := &cryptoSignerKey{verifyKey: k.(verifyKey), signer: signer}
+		kz.keys[version] = sk
+		for _, hash := range keyIDs(k) {
+			id := kz.idkeys[hash]
+			for i := range id {
+				if id[i] == k {
+					id[i] = sk
+				}
+			}
+		}
+	}
+	if _, ok := kz.keys[kz.primary].(*cryptoSignerKey); !ok {
+		// the primary key can't sign without its private half
+		return ErrNoPrimaryKey
+	}
+	return nil
+}
+
+// NewExternalSigner returns a Signer whose private key operations are done by signers,
+// such as the crypto.Signer of a PKCS#11 token or HSM, so the private keys never leave it.
+// r is a public RSA, EC or Ed25519 key set (e.g. created with KeyManager.ImportKey from the
+// token's public keys) and signers maps its versions to the matching private keys.
+// The primary version must have a signer; versions without one can only verify.
+func NewExternalSigner(r KeyReader, signers map[int]crypto.Signer, opts ...Option) (Signer, error) {
+	k := new(keySigner)
+	k.currentTime = currentMillis
+	var err error
+	k.kz, err = newKeyCzar(r)
+	if err != nil {
+		return nil, err
+	}
+	switch k.kz.keymeta.Type {
+	case T_RSA_PUB, T_EC_PUB, T_ED25519_PUB:
+	default:
+		return nil, ErrUnsupportedType
+	}
+	if !k.kz.isAcceptablePurpose(P_VERIFY) {
+		return nil, ErrUnacceptablePurpose
+	}
+	err = k.kz.loadPrimaryKey()
+	if err != nil {
+		return nil, err
+	}
+	err = attachSigners(k.kz, signers)
+	if err != nil {
+		return nil, err
+	}
+	// a reloaded key set needs the signers too
+	load := k.kz.load
+	k.kz.load = func() (*keyCzar, error) {
+		nkz, err := load()
+		if err != nil {
+			return nil, err
+		}
+		return nkz, attachSigners(nkz, signers)
+	}
+	applyOptions(k, opts)
+	return k, nil
+}
+
+// an RSA public key whose private half is behind a crypto.Decrypter
+type cryptoDecrypterKey struct {
+	*rsaPublicKey
+	decrypter crypto.Decrypter
+}
+
+func (k *cryptoDecrypterKey) Decrypt(msg []byte) ([]byte, error) {
+	if len(msg) < kzHeaderLength {
+		return nil, ErrShortCiphertext
+	}
+	return k.decrypter.Decrypt(k.random(), msg[kzHeaderLength:], &rsa.OAEPOptions{Hash: crypto.SHA1})
+}
+
+// a reader whose keys can't be expressed as JSON, such as keys inside a TPM or smartcard
+type opaqueKeyReader interface {
+	KeyReader
+	opaqueKey(version int) (keydata, error)
+}
+
+// a fake reader for an opaque key
+type importedOpaqueKeyReader struct {
+	km  KeyMeta // our fake meta info
+	key keydata // the key we're importing
+}
+
+func newImportedOpaqueKeyReader(name string, ktype KeyType, purpose KeyPurpose, key keydata) KeyReader {
+	r := new(importedOpaqueKeyReader)
+	kv := KeyVersion{VersionNumber: 0, Status: S_PRIMARY}
+	r.km = KeyMeta{name, ktype, purpose, false, []KeyVersion{kv}}
+	r.key = key
+	return r
+}
+
+func (r *importedOpaqueKeyReader) GetMetadata() (string, error) {
+	b, err := json.Marshal(r.km)
+	return string(b), err
+}
+
+// the key material can't be read
+func (r *importedOpaqueKeyReader) GetKey(version int) (string, error) {
+	if version != 0 {
+		return "", ErrNoSuchKeyVersion
+	}
+	return "", ErrOpaqueKey
+}
+
+func (r *importedOpaqueKeyReader) opaqueKey(version int) (keydata, error) {
+	if version != 0 {
+		return nil, ErrNoSuchKeyVersion
+	}
+	return r.key, nil
+}
+
+// ImportSigner returns a KeyReader for an opaque RSA, ECDSA or Ed25519 private key, such as one
+// in a TPM, smartcard or cloud KMS, that can only be used through its crypto.Signer.
+// The only purpose allowed is P_SIGN_AND_VERIFY.  The reader works with NewSigner and NewVerifier,
+// but the key can't be added to a key set with KeyManager.ImportKey.
+func ImportSigner(s crypto.Signer, purpose KeyPurpose) (KeyReader, error) {
+	if purpose != P_SIGN_AND_VERIFY {
+		return nil, ErrUnacceptablePurpose
+	}
+	var vk verifyKey
+	var ktype KeyType
+	switch pub := s.Public().(type) {
+	case *rsa.PublicKey:
+		vk, ktype = &rsaPublicKey{key: *pub}, T_RSA_PRIV
+	case *ecdsa.PublicKey:
+		if !T_EC_PRIV.isAcceptableSize(uint(pub.Curve.Params().BitSize)) {
+			return nil, ErrInvalidKeySize
+		}
+		vk, ktype = &ecdsaPublicKey{key: *pub}, T_EC_PRIV
+	case ed25519.PublicKey:
+		vk, ktype = &ed25519PublicKey{key: pub}, T_ED25519_PRIV
+	default:
+		return nil, ErrUnsupportedType
+	}
+	return newImportedOpaqueKeyReader("Imported Signer", ktype, purpose, &cryptoSignerKey{verifyKey: vk, signer: s}), nil
+}
+
+// ImportDecrypter returns a KeyReader for an opaque RSA private key that can only be used
+// through its crypto.Decrypter, for use with NewCrypter.  Like ImportSigner, the key can't be
+// added to a key set.
+func ImportDecrypter(d crypto.Decrypter) (KeyReader, error) {
+	pub, ok := d.Public().(*rsa.PublicKey)
+	if !ok {
+		return nil, ErrUnsupportedType
+	}
+	k := &cryptoDecrypterKey{&rsaPublicKey{key: *pub}, d}
+	return newImportedOpaqueKeyReader("Imported Decrypter", T_RSA_PRIV, P_DECRYPT_AND_ENCRYPT, k), nil
+}
@@ -0,0 +1,78 @@
+package dkeyczar
+
+import (
+	"crypto/sha256"
+	"io"
+
+	"golang.org/x/crypto/hkdf"
+)
+
+// the most HKDF-SHA256 can produce
+const maxDerivedKeyLength = 255 * sha256.Size
+
+// A DerivedKey is a subkey made by DeriveKey
+type DerivedKey struct {
+	Key     []byte // the derived key material
+	Version int    // the key set version it was derived from
+	KeyHash []byte // the key hash of that version, as found in ciphertext headers
+	Info    []byte // the info string it was derived for
+}
+
+// Wipe zeroes the derived key material
+func (dk *DerivedKey) Wipe() {
+	wipeBytes(dk.Key)
+}
+
+// DeriveKey derives a subkey of length bytes for info from the primary key of
+// the symmetric key set in reader, using HKDF-SHA256.  Every component should
+// use its own info string: each then gets an independent key, and none of them
+// sees the key of the key set itself.
+// The result records the version and info used, so the same subkey can be
+// derived again with DeriveKeyVersion after the primary key changes.
+func DeriveKey(reader KeyReader, info []byte, length int) (*DerivedKey, error) {
+	return deriveKey(reader, -1, info, length)
+}
+
+// DeriveKeyVersion is like DeriveKey, but derives from the given key version instead of the primary key
+func DeriveKeyVersion(reader KeyReader, version int, info []byte, length int) (*DerivedKey, error) {
+	return deriveKey(reader, version, info, length)
+}
+
+// derive from version, or from the primary key if version is -1
+func deriveKey(reader KeyReader, version int, info []byte, length int) (*DerivedKey, error) {
+	if length <= 0 || length > maxDerivedKeyLength {
+		return nil, ErrInvalidLength
+	}
+	kz, err := newKeyCzar(reader)
+	if err != nil {
+		return nil, err
+	}
+	defer kz.wipe()
+	if version == -1 {
+		if err := kz.loadPrimaryKey(); err != nil {
+			return nil, err
+		}
+		version = kz.primary
+	}
+	k, ok := kz.keys[version]
+	if !ok {
+		return nil, ErrNoSuchKeyVersion
+	}
+	sk, ok := k.(secretKey)
+	if !ok {
+		return nil, ErrNotDerivable
+	}
+
+	secret := sk.secret()
+	defer wipeBytes(secret)
+	dk := &DerivedKey{
+		Key:     make([]byte, length),
+		Version: version,
+		KeyHash: append([]byte(nil), k.KeyID()...),
+		Info:    append([]byte(nil), info...),
+	}
+	if _, err := io.ReadFull(hkdf.New(sha256.New, secret, nil, info), dk.Key); err != nil {
+		return nil, err
+	}
+	return dk, nil
+}
@@ -0,0 +1,83 @@
+package dkeyczar
+
+import (
+	"io"
+	"io/ioutil"
+	"strings"
+)
+
+// signatures are small; anything bigger isn't a signature file
+const maxSignatureFileSize = 1 << 16
+
+// WriteDetachedSignature signs everything read from message with signer and
+// writes a detached signature file to w.  The file holds the web-safe base64
+// signature, key hash header included, as the Java keyczar tool writes it,
+// whatever the encoding of signer.  A StreamSigner signs the message as it is read.
+func WriteDetachedSignature(signer Signer, message io.Reader, w io.Writer) error {
+	var s string
+	err := ErrCannotStream
+	if ss, ok := signer.(StreamSigner); ok {
+		s, err = ss.SignReader(message)
+	}
+	if err == ErrCannotStream {
+		// the key signs the whole message
+		var msg []byte
+		msg, err = ioutil.ReadAll(message)
+		if err != nil {
+			return err
+		}
+		s, err = signer.Sign(msg)
+	}
+	if err != nil {
+		return err
+	}
+	sig, err := encodingController{signer.Encoding()}.decode(s)
+	if err != nil {
+		return err
+	}
+	_, err = io.WriteString(w, encodeWeb64String(sig))
+	return err
+}
+
+// ReadDetachedSignature reads a detached signature file and returns the
+// signature it holds, encoded with encoding.  Surrounding whitespace, like a
+// trailing newline added by an editor, is ignored.
+func ReadDetachedSignature(r io.Reader, encoding Encoding) (string, error) {
+	b, err := ioutil.ReadAll(io.LimitReader(r, maxSignatureFileSize+1))
+	if err != nil {
+		return "", err
+	}
+	if len(b) > maxSignatureFileSize {
+		return "", ErrBadCiphertextFormat
+	}
+	sig, err := decodeWeb64String(strings.TrimSpace(string(b)))
+	if err != nil {
+		return "", ErrBase64Decoding
+	}
+	return encodingController{encoding}.encode(sig), nil
+}
+
+// VerifyDetachedSignature checks everything read from message against the
+// detached signature file read from sig.  The key that made the signature is
+// found from the key hash in its header, so any version of the key set can
+// verify it.  A StreamVerifier checks the message as it is read.
+func VerifyDetachedSignature(verifier Verifier, message io.Reader, sig io.Reader) (bool, error) {
+	s, err := ReadDetachedSignature(sig, verifier.Encoding())
+	if err != nil {
+		return false, err
+	}
+	valid := false
+	err = ErrCannotStream
+	if sv, ok := verifier.(StreamVerifier); ok {
+		valid, err = sv.VerifyReader(message, s)
+	}
+	if err == ErrCannotStream {
+		var msg []byte
+		msg, err = ioutil.ReadAll(message)
+		if err != nil {
+			return false, err
+		}
+		valid, err = verifier.Verify(msg, s)
+	}
+	return valid, err
+}
@@ -0,0 +1,83 @@
+package dkeyczar
+
+// A DeterministicCrypter encrypts equal plaintexts with equal associated data to
+// equal ciphertexts, so ciphertexts can be compared or used as lookup keys.
+// That also shows which messages are equal, so only use it where that's wanted.
+// Deterministic key sets (AES_SIV) only work with a DeterministicCrypter, and
+// randomized ones only with a Crypter, so the two can't be mixed up.
+type DeterministicCrypter interface {
+	EncodingController
+	// EncryptDeterministically returns the encrypted string of the plaintext, authenticating the associated data too
+	EncryptDeterministically(plaintext []byte, associatedData []byte) (string, error)
+	// DecryptDeterministically returns the plaintext bytes of an encrypted string, which must have been encrypted with the same associated data
+	DecryptDeterministically(ciphertext string, associatedData []byte) ([]byte, error)
+}
+
+type keyDeterministicCrypter struct {
+	kz *keyCzar
+	encodingController
+}
+
+// NewDeterministicCrypter returns a DeterministicCrypter using the AES_SIV keys provided by the reader
+func NewDeterministicCrypter(r KeyReader, opts ...Option) (DeterministicCrypter, error) {
+	k := new(keyDeterministicCrypter)
+	var err error
+	k.kz, err = newKeyCzar(r)
+	if err != nil {
+		return nil, err
+	}
+	if !k.kz.isAcceptablePurpose(P_DECRYPT_AND_ENCRYPT) {
+		return nil, ErrUnacceptablePurpose
+	}
+	if !k.kz.keymeta.Type.isDeterministic() {
+		return nil, ErrNotDeterministicKey
+	}
+	err = k.kz.loadPrimaryKey()
+	if err != nil {
+		return nil, err
+	}
+	applyOptions(k, opts)
+	return k, nil
+}
+
+func (kc *keyDeterministicCrypter) EncryptDeterministically(plaintext []byte, associatedData []byte) (string, error) {
+	key, err := kc.kz.primaryKey()
+	if err != nil {
+		return "", err
+	}
+	ciphertext, err := key.(deterministicKey).EncryptDeterministically(plaintext, associatedData)
+	if err != nil {
+		return "", err
+	}
+	return kc.encode(ciphertext), nil
+}
+
+func (kc *keyDeterministicCrypter) DecryptDeterministically(ciphertext string, associatedData []byte) ([]byte, error) {
+	b, kl, err := splitHeader(kc.encodingController, kc.kz, ciphertext, ErrShortCiphertext)
+	if err != nil {
+		return nil, err
+	}
+	for _, k := range kl {
+		var plaintext []byte
+		plaintext, err = k.(deterministicKey).DecryptDeterministically(b, associatedData)
+		if err == nil {
+			return plaintext, nil
+		}
+	}
+	return nil, &DecryptError{err}
+}
+
+// SetReloadPolicy sets when the crypter re-reads its key set
+func (kc *keyDeterministicCrypter) SetReloadPolicy(policy ReloadPolicy) {
+	kc.kz.setReloadPolicy(policy)
+}
+
+// ReloadPolicy returns the current reload policy of the crypter
+func (kc *keyDeterministicCrypter) ReloadPolicy() ReloadPolicy {
+	return kc.kz.reloadPolicy()
+}
+
+// Wipe zeroes the keys of the crypter
+func (kc *keyDeterministicCrypter) Wipe() {
+	kc.kz.wipe()
+}
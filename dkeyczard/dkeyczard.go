@@ -0,0 +1,95 @@
+// Command dkeyczard serves key sets over HTTP with the remote package, so
+// applications can encrypt, decrypt, sign and verify with keys that never
+// leave the host it runs on.
+//
+//	dkeyczard --listen=:8443 --tls-cert=cert.pem --tls-key=key.pem \
+//		--crypt=/keys/crypt --sign=/keys/sign --clients=/keys/clients
+//
+// With --clients, every request must be signed by a key of that key set with
+// an httpsig.Transport; the others are refused.
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+
+	"github.com/dgryski/dkeyczar"
+	"github.com/dgryski/dkeyczar/httpsig"
+	"github.com/dgryski/dkeyczar/remote"
+	"github.com/jessevdk/go-flags"
+)
+
+var opts struct {
+	Listen   string `long:"listen" default:":8443" description:"The address to listen on."`
+	Crypt    string `long:"crypt" description:"The location of the key set to encrypt and decrypt with."`
+	Sign     string `long:"sign" description:"The location of the key set to sign and verify with."`
+	Crypter  string `short:"c" long:"crypter" description:"The location of the crypter key set to crypt the key sets."`
+	Password string `long:"password" description:"The password of PBE encrypted key sets."`
+	Clients  string `long:"clients" description:"The location of the key set verifying the signatures of the clients' requests."`
+	TLSCert  string `long:"tls-cert" description:"The PEM certificate to serve TLS with."`
+	TLSKey   string `long:"tls-key" description:"The PEM private key of the certificate."`
+}
+
+func fail(msg string, err error) {
+	fmt.Fprintln(os.Stderr, msg, err)
+	os.Exit(1)
+}
+
+func loadReader(location string) dkeyczar.KeyReader {
+	lr := dkeyczar.NewFileReader(location)
+	switch {
+	case opts.Crypter != "":
+		crypter, err := dkeyczar.NewCrypter(dkeyczar.NewFileReader(opts.Crypter))
+		if err != nil {
+			fail("failed to load crypter:", err)
+		}
+		lr = dkeyczar.NewEncryptedReader(lr, crypter)
+	case opts.Password != "":
+		lr = dkeyczar.NewPBEReader(lr, []byte(opts.Password))
+	}
+	return lr
+}
+
+func main() {
+	if _, err := flags.Parse(&opts); err != nil {
+		os.Exit(1)
+	}
+	if opts.Crypt == "" && opts.Sign == "" {
+		fmt.Fprintln(os.Stderr, "must provide a key set with --crypt or --sign")
+		os.Exit(1)
+	}
+
+	var crypter dkeyczar.Crypter
+	var signer dkeyczar.Signer
+	var err error
+	if opts.Crypt != "" {
+		if crypter, err = dkeyczar.NewCrypter(loadReader(opts.Crypt)); err != nil {
+			fail("failed to load crypt key set:", err)
+		}
+	}
+	if opts.Sign != "" {
+		if signer, err = dkeyczar.NewSigner(loadReader(opts.Sign)); err != nil {
+			fail("failed to load sign key set:", err)
+		}
+	}
+
+	var handler http.Handler = remote.NewServer(crypter, signer)
+	if opts.Clients != "" {
+		verifier, err := dkeyczar.NewVerifier(dkeyczar.NewFileReader(opts.Clients))
+		if err != nil {
+			fail("failed to load clients key set:", err)
+		}
+		handler = &httpsig.Handler{Verifier: verifier, Next: handler}
+	} else {
+		fmt.Fprintln(os.Stderr, "warning: no --clients, serving unauthenticated requests")
+	}
+
+	if opts.TLSCert != "" {
+		err = http.ListenAndServeTLS(opts.Listen, opts.TLSCert, opts.TLSKey, handler)
+	} else {
+		fmt.Fprintln(os.Stderr, "warning: no --tls-cert, serving plain HTTP")
+		err = http.ListenAndServe(opts.Listen, handler)
+	}
+	fail("server failed:", err)
+}
@@ -0,0 +1,77 @@
+/*
+Package dkeyczartest helps test code using dkeyczar.  It has fixed key sets,
+the same on every run so tests can keep their ciphertexts and signatures as
+golden files, helpers making fresh key sets, and fakes of Crypter and Signer
+for tests that check how code uses them rather than the cryptography.
+
+The fixed key sets are public: never use them outside of tests.
+*/
+package dkeyczartest
+
+import (
+	"github.com/dgryski/dkeyczar"
+)
+
+// the fixed key sets, as written by dkeyczar.ExportJSON
+const (
+	aesKeySet        = `{"meta":{"name":"dkeyczartest aes","type":"AES","purpose":"DECRYPT_AND_ENCRYPT","encrypted":false,"versions":[{"versionNumber":1,"status":"PRIMARY","exportable":false,"created":1792154938101}]},"keys":{"1":{"aesKeyString":"UlbIz0mV-myRcunyoKAYAQ","size":128,"hmacKey":{"hmacKeyString":"WSn6beFBYorzU6Pi8z3QxJrONQGG2_XH_zSKzYZ4EkM","size":256},"mode":"CBC"}}}`
+	hmacKeySet       = `{"meta":{"name":"dkeyczartest hmac","type":"HMAC_SHA1","purpose":"SIGN_AND_VERIFY","encrypted":false,"versions":[{"versionNumber":1,"status":"PRIMARY","exportable":false,"created":1792154938101}]},"keys":{"1":{"hmacKeyString":"aM37Dxpl5yxKRMpxxXazURZWXzJ_b3R3wvCWlvUxBIQ","size":256}}}`
+	ed25519KeySet    = `{"meta":{"name":"dkeyczartest ed25519","type":"ED25519_PRIV","purpose":"SIGN_AND_VERIFY","encrypted":false,"versions":[{"versionNumber":1,"status":"PRIMARY","exportable":false,"created":1792154938103}]},"keys":{"1":{"publicKey":{"publicBytes":"U6trw3HGnSBKN5Kmxm5ldURKbw4RaiHIsUyU3VDtClo","size":256},"privateKey":"ShJn99EoUP2xOrdkMflTLVcFOmAivk4Anf9Uv4Raprk","size":256}}}`
+	ed25519PubKeySet = `{"meta":{"name":"dkeyczartest ed25519","type":"ED25519_PUB","purpose":"VERIFY","encrypted":false,"versions":[{"versionNumber":1,"status":"PRIMARY","exportable":false,"created":1792154938103}]},"keys":{"1":{"publicBytes":"U6trw3HGnSBKN5Kmxm5ldURKbw4RaiHIsUyU3VDtClo","size":256}}}`
+)
+
+func fixed(keySet string) dkeyczar.KeyReader {
+	r, err := dkeyczar.NewJSONReader([]byte(keySet))
+	if err != nil {
+		panic("dkeyczartest: bad fixed key set: " + err.Error())
+	}
+	return r
+}
+
+// AESKeySet returns a reader for a fixed AES key set with one primary version
+func AESKeySet() dkeyczar.KeyReader { return fixed(aesKeySet) }
+
+// HMACKeySet returns a reader for a fixed HMAC_SHA1 key set with one primary version
+func HMACKeySet() dkeyczar.KeyReader { return fixed(hmacKeySet) }
+
+// Ed25519KeySet returns a reader for a fixed Ed25519 private key set with one primary version
+func Ed25519KeySet() dkeyczar.KeyReader { return fixed(ed25519KeySet) }
+
+// Ed25519PublicKeySet returns a reader for the public keys of Ed25519KeySet
+func Ed25519PublicKeySet() dkeyczar.KeyReader { return fixed(ed25519PubKeySet) }
+
+// a KeyReader for the output of KeyManager.ToJSONs
+type jsonsReader []string
+
+func (r jsonsReader) GetMetadata() (string, error) {
+	return r[0], nil
+}
+
+func (r jsonsReader) GetKey(version int) (string, error) {
+	if version <= 0 || version >= len(r) {
+		return "", dkeyczar.ErrNoSuchKeyVersion
+	}
+	return r[version], nil
+}
+
+// Reader returns a KeyReader for the key set of km, as it is now
+func Reader(km dkeyczar.KeyManager) dkeyczar.KeyReader {
+	jsons, err := km.ToJSONs(nil)
+	if err != nil {
+		panic("dkeyczartest: can't write the key set: " + err.Error())
+	}
+	return jsonsReader(jsons)
+}
+
+// NewKeySet returns a reader for a fresh key set of keyType for purpose, with one primary version
+// of the default size.  Key generation failing panics, as tests can't go on without the key set.
+func NewKeySet(purpose dkeyczar.KeyPurpose, keyType dkeyczar.KeyType) dkeyczar.KeyReader {
+	km := dkeyczar.NewKeyManager()
+	if err := km.Create("dkeyczartest", purpose, keyType); err != nil {
+		panic("dkeyczartest: " + err.Error())
+	}
+	if err := km.AddKey(0, dkeyczar.S_PRIMARY); err != nil {
+		panic("dkeyczartest: " + err.Error())
+	}
+	return Reader(km)
+}
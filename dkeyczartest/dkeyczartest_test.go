@@ -0,0 +1,174 @@
+package dkeyczartest
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dgryski/dkeyczar"
+)
+
+func TestFixedKeySets(t *testing.T) {
+	crypter, err := dkeyczar.NewCrypter(AESKeySet())
+	if err != nil {
+		t.Fatal("failed to load the fixed AES key set:", err)
+	}
+	ct, err := crypter.Encrypt([]byte("hello"))
+	if err != nil {
+		t.Fatal("failed to encrypt:", err)
+	}
+	if pt, err := crypter.Decrypt(ct); err != nil || string(pt) != "hello" {
+		t.Error("roundtrip failed:", pt, err)
+	}
+
+	for _, signer := range []func() dkeyczar.KeyReader{HMACKeySet, Ed25519KeySet} {
+		s, err := dkeyczar.NewSigner(signer())
+		if err != nil {
+			t.Fatal("failed to load a fixed signing key set:", err)
+		}
+		sig, err := s.Sign([]byte("hello"))
+		if err != nil {
+			t.Fatal("failed to sign:", err)
+		}
+		if ok, err := s.Verify([]byte("hello"), sig); !ok || err != nil {
+			t.Error("failed to verify:", err)
+		}
+	}
+
+	// Ed25519 is deterministic, so signatures of the fixed key set can be kept as golden values
+	s, _ := dkeyczar.NewSigner(Ed25519KeySet())
+	sig, _ := s.Sign([]byte("hello"))
+	v, err := dkeyczar.NewVerifier(Ed25519PublicKeySet())
+	if err != nil {
+		t.Fatal("failed to load the fixed public key set:", err)
+	}
+	if ok, err := v.Verify([]byte("hello"), sig); !ok || err != nil {
+		t.Error("public key set doesn't verify the private one's signature:", err)
+	}
+	if again, _ := s.Sign([]byte("hello")); again != sig {
+		t.Error("signatures of the fixed key set differ between calls")
+	}
+
+	fresh, err := dkeyczar.NewCrypter(NewKeySet(dkeyczar.P_DECRYPT_AND_ENCRYPT, dkeyczar.T_AES))
+	if err != nil {
+		t.Fatal("failed to load a fresh key set:", err)
+	}
+	if _, err := fresh.Decrypt(ct); err == nil {
+		t.Error("fresh key set decrypted the fixed one's ciphertext")
+	}
+}
+
+func TestFakeCrypter(t *testing.T) {
+	var c Crypter
+	for _, enc := range []dkeyczar.Encoding{dkeyczar.BASE64W, dkeyczar.HEX, dkeyczar.NO_ENCODING} {
+		c.SetEncoding(enc)
+		ct, err := c.Encrypt([]byte("hello"))
+		if err != nil {
+			t.Fatal("failed to encrypt:", err)
+		}
+		if pt, err := c.Decrypt(ct); err != nil || string(pt) != "hello" {
+			t.Error("roundtrip failed:", enc, pt, err)
+		}
+	}
+	if _, err := c.Decrypt("hello"); err != dkeyczar.ErrInvalidSignature {
+		t.Error("decrypted something other than a fake ciphertext:", err)
+	}
+	if n := c.Calls("Encrypt"); n != 3 {
+		t.Error("counted", n, "calls to Encrypt")
+	}
+
+	boom := errors.New("boom")
+	c.SetErr(boom)
+	if _, err := c.Encrypt([]byte("hello")); err != boom {
+		t.Error("SetErr didn't fail Encrypt:", err)
+	}
+	c.SetErr(nil)
+	c.Wipe()
+	if !c.Wiped() {
+		t.Error("Wipe wasn't recorded")
+	}
+}
+
+func TestFakeSigner(t *testing.T) {
+	var s Signer
+	msg := []byte("hello")
+
+	sig, _ := s.Sign(msg)
+	if rsig, _ := s.SignReader(bytes.NewReader(msg)); rsig != sig {
+		t.Error("SignReader and Sign differ")
+	}
+	if ok, _ := s.Verify(msg, sig); !ok {
+		t.Error("failed to verify")
+	}
+	if ok, _ := s.VerifyReader(strings.NewReader("goodbye"), sig); ok {
+		t.Error("verified the signature of another message")
+	}
+	if ok, _ := s.UnversionedVerify(msg, sig); ok {
+		t.Error("verified a signature of another kind")
+	}
+
+	attached, _ := s.AttachedSign(msg, []byte("nonce"))
+	if m, err := s.AttachedVerify(attached, []byte("nonce")); err != nil || !bytes.Equal(m, msg) {
+		t.Error("failed to verify an attached signature:", m, err)
+	}
+	if _, err := s.AttachedVerify(attached, []byte("other")); err != dkeyczar.ErrInvalidSignature {
+		t.Error("verified an attached signature with another nonce:", err)
+	}
+
+	future := time.Now().Add(time.Hour).UnixNano() / int64(time.Millisecond)
+	past := time.Now().Add(-time.Hour).UnixNano() / int64(time.Millisecond)
+	tsig, _ := s.TimeoutSign(msg, future)
+	if ok, _ := s.TimeoutVerify(msg, tsig); !ok {
+		t.Error("failed to verify a timeout signature")
+	}
+	tsig, _ = s.TimeoutSign(msg, past)
+	if ok, _ := s.TimeoutVerify(msg, tsig); ok {
+		t.Error("verified an expired timeout signature")
+	}
+
+	if n := s.Calls("Verify"); n != 1 {
+		t.Error("counted", n, "calls to Verify")
+	}
+}
+
+func TestGenerateTestKeyset(t *testing.T) {
+	a := GenerateTestKeyset(t, dkeyczar.T_AES, dkeyczar.P_DECRYPT_AND_ENCRYPT, WithSeed(42), WithVersions(2))
+	b := GenerateTestKeyset(t, dkeyczar.T_AES, dkeyczar.P_DECRYPT_AND_ENCRYPT, WithSeed(42), WithVersions(2))
+	c := GenerateTestKeyset(t, dkeyczar.T_AES, dkeyczar.P_DECRYPT_AND_ENCRYPT, WithSeed(43), WithVersions(2))
+	for v := 1; v <= 2; v++ {
+		ka, _ := a.GetKey(v)
+		kb, _ := b.GetKey(v)
+		kc, _ := c.GetKey(v)
+		if ka != kb {
+			t.Error("keys generated from the same seed differ, version", v)
+		}
+		if ka == kc {
+			t.Error("keys generated from different seeds are the same, version", v)
+		}
+	}
+	if _, err := a.GetKey(3); err == nil {
+		t.Error("key set has a third version")
+	}
+
+	crypter, err := dkeyczar.NewCrypter(a)
+	if err != nil {
+		t.Fatal("failed to load the generated key set:", err)
+	}
+	ct, _ := crypter.Encrypt([]byte("hello"))
+	other, _ := dkeyczar.NewCrypter(b)
+	if pt, err := other.Decrypt(ct); err != nil || string(pt) != "hello" {
+		t.Error("key set generated from the same seed can't decrypt:", pt, err)
+	}
+
+	dir := GenerateTestKeysetDir(t, dkeyczar.T_ED25519_PRIV, dkeyczar.P_SIGN_AND_VERIFY)
+	signer, err := dkeyczar.NewSigner(dkeyczar.NewFileReader(dir))
+	if err != nil {
+		t.Fatal("failed to load the key set written to", dir, err)
+	}
+	sig, _ := signer.Sign([]byte("hello"))
+	if ok, err := signer.Verify([]byte("hello"), sig); !ok || err != nil {
+		t.Error("failed to verify:", err)
+	}
+}
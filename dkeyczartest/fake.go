@@ -0,0 +1,299 @@
+package dkeyczartest
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dgryski/dkeyczar"
+)
+
+// The fakes don't encrypt or sign anything: a fake ciphertext is the
+// plaintext behind a marker, and a fake signature is a SHA-256 of the
+// message, so their output is readable in test failures and the same on
+// every run.  Anyone can forge them, so they only stand in for the real
+// ones in tests.  Both are safe for concurrent use.
+
+// the marker ahead of a fake ciphertext
+const fakeMarker = "dkeyczartest:"
+
+// the state common to the fakes
+type fake struct {
+	mu          sync.Mutex
+	err         error
+	encoding    dkeyczar.Encoding
+	compression dkeyczar.Compression
+	wiped       bool
+	calls       map[string]int
+}
+
+// SetErr makes every later operation fail with err, or succeed again with nil
+func (f *fake) SetErr(err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.err = err
+}
+
+// Calls returns how many times the operation op, e.g. "Encrypt" or "Verify", was called
+func (f *fake) Calls(op string) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.calls[op]
+}
+
+// Wiped reports whether Wipe was called
+func (f *fake) Wiped() bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.wiped
+}
+
+// count a call to op, and return the error set with SetErr
+func (f *fake) call(op string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.calls == nil {
+		f.calls = make(map[string]int)
+	}
+	f.calls[op]++
+	return f.err
+}
+
+// SetEncoding sets the encoding of the ciphertexts and signatures
+func (f *fake) SetEncoding(encoding dkeyczar.Encoding) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.encoding = encoding
+}
+
+// Encoding returns the encoding of the ciphertexts and signatures
+func (f *fake) Encoding() dkeyczar.Encoding {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.encoding
+}
+
+// SetCompression records the compression, which the fake doesn't apply
+func (f *fake) SetCompression(compression dkeyczar.Compression) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.compression = compression
+}
+
+// Compression returns the compression set with SetCompression
+func (f *fake) Compression() dkeyczar.Compression {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.compression
+}
+
+// Wipe records the call, for Wiped
+func (f *fake) Wipe() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.wiped = true
+}
+
+func (f *fake) encode(b []byte) string {
+	switch f.Encoding() {
+	case dkeyczar.NO_ENCODING:
+		return string(b)
+	case dkeyczar.HEX:
+		return hex.EncodeToString(b)
+	}
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func (f *fake) decode(s string) ([]byte, error) {
+	var b []byte
+	var err error
+	switch f.Encoding() {
+	case dkeyczar.NO_ENCODING:
+		return []byte(s), nil
+	case dkeyczar.HEX:
+		b, err = hex.DecodeString(s)
+	default:
+		b, err = base64.RawURLEncoding.DecodeString(strings.TrimRight(s, "="))
+	}
+	if err != nil {
+		return nil, dkeyczar.ErrBase64Decoding
+	}
+	return b, nil
+}
+
+// A Crypter is a fake dkeyczar.Crypter.  The zero value is ready to use.
+type Crypter struct {
+	fake
+}
+
+var _ dkeyczar.Crypter = (*Crypter)(nil)
+
+// Encrypt returns the fake ciphertext of plaintext
+func (c *Crypter) Encrypt(plaintext []byte) (string, error) {
+	if err := c.call("Encrypt"); err != nil {
+		return "", err
+	}
+	return c.encode(append([]byte(fakeMarker), plaintext...)), nil
+}
+
+// Decrypt returns the plaintext of a fake ciphertext, or dkeyczar.ErrInvalidSignature for anything else
+func (c *Crypter) Decrypt(ciphertext string) ([]byte, error) {
+	if err := c.call("Decrypt"); err != nil {
+		return nil, err
+	}
+	b, err := c.decode(ciphertext)
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.HasPrefix(b, []byte(fakeMarker)) {
+		return nil, dkeyczar.ErrInvalidSignature
+	}
+	return b[len(fakeMarker):], nil
+}
+
+// A Signer is a fake dkeyczar.Signer, which is also a fake dkeyczar.Verifier.
+// It can sign and verify streams too, like the ones made from key sets.  The zero value is ready to use.
+type Signer struct {
+	fake
+}
+
+var (
+	_ dkeyczar.Signer         = (*Signer)(nil)
+	_ dkeyczar.StreamSigner   = (*Signer)(nil)
+	_ dkeyczar.StreamVerifier = (*Signer)(nil)
+)
+
+// the fake signature of the parts, for the signing operation kind
+func fakeSignature(kind string, parts ...[]byte) []byte {
+	h := sha256.New()
+	io.WriteString(h, fakeMarker+kind)
+	for _, p := range parts {
+		var l [4]byte
+		binary.BigEndian.PutUint32(l[:], uint32(len(p)))
+		h.Write(l[:])
+		h.Write(p)
+	}
+	return h.Sum(nil)
+}
+
+// sign the parts as the signing operation kind, counting a call to op
+func (s *Signer) sign(op, kind string, parts ...[]byte) (string, error) {
+	if err := s.call(op); err != nil {
+		return "", err
+	}
+	return s.encode(fakeSignature(kind, parts...)), nil
+}
+
+// verify a signature of the parts made by the signing operation kind, counting a call to op
+func (s *Signer) verify(op, kind string, signature string, parts ...[]byte) (bool, error) {
+	if err := s.call(op); err != nil {
+		return false, err
+	}
+	sig, err := s.decode(signature)
+	if err != nil {
+		return false, err
+	}
+	return subtle.ConstantTimeCompare(sig, fakeSignature(kind, parts...)) == 1, nil
+}
+
+// Sign returns the fake signature of message
+func (s *Signer) Sign(message []byte) (string, error) {
+	return s.sign("Sign", "Sign", message)
+}
+
+// SignReader returns the fake signature of everything read from r, the same as Sign's
+func (s *Signer) SignReader(r io.Reader) (string, error) {
+	message, err := ioutil.ReadAll(r)
+	if err != nil {
+		return "", err
+	}
+	return s.sign("SignReader", "Sign", message)
+}
+
+// AttachedSign returns message with its fake signature with nonce attached
+func (s *Signer) AttachedSign(message []byte, nonce []byte) (string, error) {
+	if err := s.call("AttachedSign"); err != nil {
+		return "", err
+	}
+	return s.encode(append(append([]byte{}, message...), fakeSignature("AttachedSign", message, nonce)...)), nil
+}
+
+// TimeoutSign returns the fake signature of message, valid until expiration, in milliseconds since 1/1/1970 GMT
+func (s *Signer) TimeoutSign(message []byte, expiration int64) (string, error) {
+	if err := s.call("TimeoutSign"); err != nil {
+		return "", err
+	}
+	var exp [8]byte
+	binary.BigEndian.PutUint64(exp[:], uint64(expiration))
+	return s.encode(append(exp[:], fakeSignature("TimeoutSign", exp[:], message)...)), nil
+}
+
+// UnversionedSign returns the fake signature of message
+func (s *Signer) UnversionedSign(message []byte) (string, error) {
+	return s.sign("UnversionedSign", "UnversionedSign", message)
+}
+
+// Verify checks a fake signature made by Sign or SignReader
+func (s *Signer) Verify(message []byte, signature string) (bool, error) {
+	return s.verify("Verify", "Sign", signature, message)
+}
+
+// VerifyReader checks a fake signature made by Sign or SignReader of everything read from r
+func (s *Signer) VerifyReader(r io.Reader, signature string) (bool, error) {
+	message, err := ioutil.ReadAll(r)
+	if err != nil {
+		return false, err
+	}
+	return s.verify("VerifyReader", "Sign", signature, message)
+}
+
+// AttachedVerify checks a message signed by AttachedSign with nonce, and returns the message,
+// or dkeyczar.ErrInvalidSignature
+func (s *Signer) AttachedVerify(signedMessage string, nonce []byte) ([]byte, error) {
+	if err := s.call("AttachedVerify"); err != nil {
+		return nil, err
+	}
+	b, err := s.decode(signedMessage)
+	if err != nil {
+		return nil, err
+	}
+	if len(b) < sha256.Size {
+		return nil, dkeyczar.ErrShortSignature
+	}
+	message, sig := b[:len(b)-sha256.Size], b[len(b)-sha256.Size:]
+	if subtle.ConstantTimeCompare(sig, fakeSignature("AttachedSign", message, nonce)) != 1 {
+		return nil, dkeyczar.ErrInvalidSignature
+	}
+	return message, nil
+}
+
+// TimeoutVerify checks a fake signature made by TimeoutSign, and that it hasn't expired
+func (s *Signer) TimeoutVerify(message []byte, signature string) (bool, error) {
+	if err := s.call("TimeoutVerify"); err != nil {
+		return false, err
+	}
+	b, err := s.decode(signature)
+	if err != nil {
+		return false, err
+	}
+	if len(b) != 8+sha256.Size {
+		return false, dkeyczar.ErrShortSignature
+	}
+	if int64(binary.BigEndian.Uint64(b)) < time.Now().UnixNano()/int64(time.Millisecond) {
+		return false, nil
+	}
+	return subtle.ConstantTimeCompare(b[8:], fakeSignature("TimeoutSign", b[:8], message)) == 1, nil
+}
+
+// UnversionedVerify checks a fake signature made by UnversionedSign
+func (s *Signer) UnversionedVerify(message []byte, signature string) (bool, error) {
+	return s.verify("UnversionedVerify", "UnversionedSign", signature, message)
+}
@@ -0,0 +1,108 @@
+package dkeyczartest
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/sha256"
+	"encoding/binary"
+	"io"
+	"testing"
+
+	"github.com/dgryski/dkeyczar"
+)
+
+// A KeysetOption configures GenerateTestKeyset
+type KeysetOption func(*keysetOptions)
+
+type keysetOptions struct {
+	seed     *int64
+	versions int
+	size     uint
+}
+
+// WithSeed makes the keys generated from seed, so every run of the test gets the same keys.
+// Symmetric, Ed25519 and X25519 keys are fully determined by the seed; Go's RSA, DSA and ECDSA
+// code mixes in randomness of its own, so those keys still differ between runs.
+// The creation times of the versions are those of the run.
+func WithSeed(seed int64) KeysetOption {
+	return func(o *keysetOptions) { o.seed = &seed }
+}
+
+// WithVersions makes the key set n versions, the last one primary and the others active
+func WithVersions(n int) KeysetOption {
+	return func(o *keysetOptions) { o.versions = n }
+}
+
+// WithKeySize sets the size in bits of the keys, 0 for the key type's default
+func WithKeySize(size uint) KeysetOption {
+	return func(o *keysetOptions) { o.size = size }
+}
+
+// an endless stream determined by seed, AES-256-CTR keyed with its hash
+func seededReader(seed int64) io.Reader {
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:], uint64(seed))
+	key := sha256.Sum256(append([]byte("dkeyczartest seed "), b[:]...))
+	block, _ := aes.NewCipher(key[:]) // can't fail for a 32 byte key
+	return cipher.StreamReader{S: cipher.NewCTR(block, make([]byte, aes.BlockSize)), R: zeroReader{}}
+}
+
+type zeroReader struct{}
+
+func (zeroReader) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = 0
+	}
+	return len(p), nil
+}
+
+// generate the key set, as returned by KeyManager.ToJSONs
+func generate(t testing.TB, keyType dkeyczar.KeyType, purpose dkeyczar.KeyPurpose, opts []KeysetOption) []string {
+	t.Helper()
+	o := keysetOptions{versions: 1}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	var kmOpts []dkeyczar.Option
+	if o.seed != nil {
+		kmOpts = append(kmOpts, dkeyczar.WithRand(seededReader(*o.seed)))
+	}
+	km := dkeyczar.NewKeyManager(kmOpts...)
+	if err := km.Create("dkeyczartest "+t.Name(), purpose, keyType); err != nil {
+		t.Fatalf("dkeyczartest: can't create a %s key set for %s: %v", keyType, purpose, err)
+	}
+	for i := 1; i <= o.versions; i++ {
+		status := dkeyczar.S_ACTIVE
+		if i == o.versions {
+			status = dkeyczar.S_PRIMARY
+		}
+		if err := km.AddKey(o.size, status); err != nil {
+			t.Fatalf("dkeyczartest: can't add a %s key: %v", keyType, err)
+		}
+	}
+	jsons, err := km.ToJSONs(nil)
+	if err != nil {
+		t.Fatalf("dkeyczartest: can't write the key set: %v", err)
+	}
+	return jsons
+}
+
+// GenerateTestKeyset returns a throwaway key set of keyType for purpose, held in memory, so tests
+// don't need key material checked into the repository.  It has one primary version of the default
+// size unless opts say otherwise.  A key set that can't be generated fails the test.
+func GenerateTestKeyset(t testing.TB, keyType dkeyczar.KeyType, purpose dkeyczar.KeyPurpose, opts ...KeysetOption) dkeyczar.KeyReader {
+	t.Helper()
+	return jsonsReader(generate(t, keyType, purpose, opts))
+}
+
+// GenerateTestKeysetDir is GenerateTestKeyset writing the key set to a directory under t.TempDir,
+// for code that loads key sets from files, e.g. with dkeyczar.NewFileReader.  It returns the directory,
+// which is removed when the test ends.
+func GenerateTestKeysetDir(t testing.TB, keyType dkeyczar.KeyType, purpose dkeyczar.KeyPurpose, opts ...KeysetOption) string {
+	t.Helper()
+	dir := t.TempDir()
+	if err := dkeyczar.NewFileWriter(dir).WriteKeyset(generate(t, keyType, purpose, opts)); err != nil {
+		t.Fatalf("dkeyczartest: can't write the key set: %v", err)
+	}
+	return dir
+}
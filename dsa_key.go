@@ -1,11 +1,12 @@
 package dkeyczar
 import (
 	"crypto/dsa"
-	"crypto/rand"
 	"crypto/sha1"
 	"encoding/asn1"
 	"encoding/binary"
 	"encoding/json"
+	"hash"
+	"io"
 	"math/big"
 )
 type dsaPublicKeyJSON struct {
@@ -30,9 +31,10 @@ type dsaKeyJSON struct {
 type dsaKey struct {
 	key       dsa.PrivateKey
 	publicKey dsaPublicKey
+	randSource
 }
 
-func generateDSAKey(size uint) (*dsaKey, error) {
+func generateDSAKey(size uint, rng io.Reader) (*dsaKey, error) {
 	dsakey := new(dsaKey)
 	if size == 0 {
 		size = T_DSA_PRIV.defaultSize()
@@ -47,11 +49,11 @@ func generateDSAKey(size uint) (*dsaKey, error) {
 	default:
 		panic("unknown dsa key size")
 	}
-	err := dsa.GenerateParameters(&dsakey.key.PublicKey.Parameters, rand.Reader, psz)
+	err := dsa.GenerateParameters(&dsakey.key.PublicKey.Parameters, rng, psz)
 	if err != nil {
 		return nil, err
 	}
-	err = dsa.GenerateKey(&dsakey.key, rand.Reader)
+	err = dsa.GenerateKey(&dsakey.key, rng)
 	if err != nil {
 		return nil, err
 	}
@@ -193,10 +195,23 @@ type dsaSignature struct {
 	S *big.Int
 }
 
+// the hash the signatures are made over
+func (dk *dsaPublicKey) newHash() hash.Hash {
+	return sha1.New()
+}
+
+func (dk *dsaKey) newHash() hash.Hash {
+	return sha1.New()
+}
+
 func (dk *dsaKey) Sign(msg []byte) ([]byte, error) {
-	h := sha1.New()
+	h := dk.newHash()
 	h.Write(msg)
-	r, s, err := dsa.Sign(rand.Reader, &dk.key, h.Sum(nil))
+	return dk.SignDigest(h.Sum(nil))
+}
+
+func (dk *dsaKey) SignDigest(digest []byte) ([]byte, error) {
+	r, s, err := dsa.Sign(dk.random(), &dk.key, digest)
 	if err != nil {
 		return nil, err
 	}
@@ -212,14 +227,22 @@ func (dk *dsaKey) Verify(msg []byte, signature []byte) (bool, error) {
 	return dk.publicKey.Verify(msg, signature)
 }
 
+func (dk *dsaKey) VerifyDigest(digest []byte, signature []byte) (bool, error) {
+	return dk.publicKey.VerifyDigest(digest, signature)
+}
+
 func (dk *dsaPublicKey) Verify(msg []byte, signature []byte) (bool, error) {
-	h := sha1.New()
+	h := dk.newHash()
 	h.Write(msg)
+	return dk.VerifyDigest(h.Sum(nil), signature)
+}
+
+func (dk *dsaPublicKey) VerifyDigest(digest []byte, signature []byte) (bool, error) {
 	var rs dsaSignature
 	_, err := asn1.Unmarshal(signature, &rs)
 	if err != nil {
 		return false, err
 	}
-	return dsa.Verify(&dk.key, h.Sum(nil), rs.R, rs.S), nil
+	return dsa.Verify(&dk.key, digest, rs.R, rs.S), nil
 }
 
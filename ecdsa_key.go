@@ -0,0 +1,218 @@
+package dkeyczar
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/sha1"
+	"crypto/x509"
+	"encoding/json"
+	"hash"
+	"io"
+)
+
+// EC keys are stored the same way Java keyczar stores them: the public key
+// as a DER-encoded SubjectPublicKeyInfo and the private key as PKCS#8.
+type ecdsaPublicKeyJSON struct {
+	NamedCurve  string `json:"namedCurve"`
+	PublicBytes string `json:"publicBytes"`
+	Size        uint   `json:"size"`
+}
+
+type ecdsaPublicKey struct {
+	key ecdsa.PublicKey
+	id  []byte
+}
+
+type ecdsaKeyJSON struct {
+	PublicKey  ecdsaPublicKeyJSON `json:"publicKey"`
+	PrivateKey string             `json:"privateKey"`
+	Size       uint               `json:"size"`
+}
+
+type ecdsaKey struct {
+	key       ecdsa.PrivateKey
+	publicKey ecdsaPublicKey
+	randSource
+}
+
+var ecdsaCurves = []struct {
+	name  string
+	size  uint
+	curve elliptic.Curve
+}{
+	{"SECP256R1", 256, elliptic.P256()},
+	{"SECP384R1", 384, elliptic.P384()},
+	{"SECP521R1", 521, elliptic.P521()},
+}
+
+func ecdsaCurveForSize(size uint) elliptic.Curve {
+	for _, c := range ecdsaCurves {
+		if c.size == size {
+			return c.curve
+		}
+	}
+	return nil
+}
+
+func ecdsaCurveName(curve elliptic.Curve) string {
+	for _, c := range ecdsaCurves {
+		if c.curve == curve {
+			return c.name
+		}
+	}
+	return ""
+}
+
+func generateECDSAKey(size uint, rng io.Reader) (*ecdsaKey, error) {
+	eckey := new(ecdsaKey)
+	if size == 0 {
+		size = T_EC_PRIV.defaultSize()
+	}
+	if !T_EC_PRIV.isAcceptableSize(size) {
+		return nil, ErrInvalidKeySize
+	}
+	priv, err := ecdsa.GenerateKey(ecdsaCurveForSize(size), rng)
+	if err != nil {
+		return nil, err
+	}
+	eckey.key = *priv
+	eckey.publicKey.key = priv.PublicKey
+	return eckey, nil
+}
+
+func newECDSAPublicKeyFromJSON(s []byte) (*ecdsaPublicKey, error) {
+	eckey := new(ecdsaPublicKey)
+	ecjson := new(ecdsaPublicKeyJSON)
+	var err error
+	err = json.Unmarshal(s, &ecjson)
+	if err != nil {
+		return nil, err
+	}
+	if !T_EC_PUB.isAcceptableSize(ecjson.Size) {
+		return nil, ErrInvalidKeySize
+	}
+	b, err := decodeWeb64String(ecjson.PublicBytes)
+	if err != nil {
+		return nil, ErrBase64Decoding
+	}
+	pub, err := x509.ParsePKIXPublicKey(b)
+	if err != nil {
+		return nil, err
+	}
+	ecpub, ok := pub.(*ecdsa.PublicKey)
+	if !ok || ecpub.Curve.Params().BitSize != int(ecjson.Size) {
+		return nil, ErrUnsupportedType
+	}
+	eckey.key = *ecpub
+	return eckey, nil
+}
+
+func newECDSAPublicJSONFromKey(key *ecdsa.PublicKey) *ecdsaPublicKeyJSON {
+	ecjson := new(ecdsaPublicKeyJSON)
+	b, _ := x509.MarshalPKIXPublicKey(key)
+	ecjson.NamedCurve = ecdsaCurveName(key.Curve)
+	ecjson.PublicBytes = encodeWeb64String(b)
+	ecjson.Size = uint(key.Curve.Params().BitSize)
+	return ecjson
+}
+
+func (ek *ecdsaPublicKey) ToKeyJSON() []byte {
+	j := newECDSAPublicJSONFromKey(&ek.key)
+	s, _ := json.Marshal(j)
+	return s
+}
+
+func newECDSAKeyFromJSON(s []byte) (*ecdsaKey, error) {
+	eckey := new(ecdsaKey)
+	ecjson := new(ecdsaKeyJSON)
+	var err error
+	err = json.Unmarshal(s, &ecjson)
+	if err != nil {
+		return nil, err
+	}
+	if !T_EC_PRIV.isAcceptableSize(ecjson.Size) || !T_EC_PUB.isAcceptableSize(ecjson.PublicKey.Size) {
+		return nil, ErrInvalidKeySize
+	}
+	b, err := decodeWeb64String(ecjson.PrivateKey)
+	if err != nil {
+		return nil, ErrBase64Decoding
+	}
+	priv, err := x509.ParsePKCS8PrivateKey(b)
+	if err != nil {
+		return nil, err
+	}
+	ecpriv, ok := priv.(*ecdsa.PrivateKey)
+	if !ok || ecpriv.Curve.Params().BitSize != int(ecjson.Size) {
+		return nil, ErrUnsupportedType
+	}
+	eckey.key = *ecpriv
+	eckey.publicKey.key = ecpriv.PublicKey
+	return eckey, nil
+}
+
+func newECDSAJSONFromKey(key *ecdsa.PrivateKey) *ecdsaKeyJSON {
+	ecjson := new(ecdsaKeyJSON)
+	b, _ := x509.MarshalPKCS8PrivateKey(key)
+	ecjson.PrivateKey = encodeWeb64String(b)
+	ecjson.PublicKey = *newECDSAPublicJSONFromKey(&key.PublicKey)
+	ecjson.Size = uint(key.Curve.Params().BitSize)
+	return ecjson
+}
+
+func (ek *ecdsaKey) ToKeyJSON() []byte {
+	j := newECDSAJSONFromKey(&ek.key)
+	s, _ := json.Marshal(j)
+	return s
+}
+
+func (ek *ecdsaPublicKey) KeyID() []byte {
+	if len(ek.id) != 0 {
+		return ek.id
+	}
+	b, _ := x509.MarshalPKIXPublicKey(&ek.key)
+	h := sha1.New()
+	h.Write(b)
+	ek.id = h.Sum(nil)[:4]
+	return ek.id
+}
+
+func (ek *ecdsaKey) KeyID() []byte {
+	return ek.publicKey.KeyID()
+}
+
+// the hash the signatures are made over
+func (ek *ecdsaPublicKey) newHash() hash.Hash {
+	return sha1.New()
+}
+
+func (ek *ecdsaKey) newHash() hash.Hash {
+	return sha1.New()
+}
+
+func (ek *ecdsaKey) Sign(msg []byte) ([]byte, error) {
+	h := ek.newHash()
+	h.Write(msg)
+	return ek.SignDigest(h.Sum(nil))
+}
+
+func (ek *ecdsaKey) SignDigest(digest []byte) ([]byte, error) {
+	return ecdsa.SignASN1(ek.random(), &ek.key, digest)
+}
+
+func (ek *ecdsaKey) Verify(msg []byte, signature []byte) (bool, error) {
+	return ek.publicKey.Verify(msg, signature)
+}
+
+func (ek *ecdsaKey) VerifyDigest(digest []byte, signature []byte) (bool, error) {
+	return ek.publicKey.VerifyDigest(digest, signature)
+}
+
+func (ek *ecdsaPublicKey) Verify(msg []byte, signature []byte) (bool, error) {
+	h := ek.newHash()
+	h.Write(msg)
+	return ek.VerifyDigest(h.Sum(nil), signature)
+}
+
+func (ek *ecdsaPublicKey) VerifyDigest(digest []byte, signature []byte) (bool, error) {
+	return ecdsa.VerifyASN1(&ek.key, digest, signature), nil
+}
@@ -0,0 +1,140 @@
+package dkeyczar
+
+import (
+	"crypto/ed25519"
+	"crypto/sha1"
+	"encoding/json"
+	"io"
+)
+
+// Ed25519 keys have no Java keyczar counterpart.  The public key is stored
+// as its raw 32 bytes and the private key as the 32-byte RFC 8032 seed.
+type ed25519PublicKeyJSON struct {
+	PublicBytes string `json:"publicBytes"`
+	Size        uint   `json:"size"`
+}
+
+type ed25519PublicKey struct {
+	key ed25519.PublicKey
+	id  []byte
+}
+
+type ed25519KeyJSON struct {
+	PublicKey  ed25519PublicKeyJSON `json:"publicKey"`
+	PrivateKey string               `json:"privateKey"`
+	Size       uint                 `json:"size"`
+}
+
+type ed25519Key struct {
+	key       ed25519.PrivateKey
+	publicKey ed25519PublicKey
+}
+
+func generateEd25519Key(rng io.Reader) (*ed25519Key, error) {
+	edkey := new(ed25519Key)
+	pub, priv, err := ed25519.GenerateKey(rng)
+	if err != nil {
+		return nil, err
+	}
+	edkey.key = priv
+	edkey.publicKey.key = pub
+	return edkey, nil
+}
+
+func newEd25519PublicKeyFromJSON(s []byte) (*ed25519PublicKey, error) {
+	edkey := new(ed25519PublicKey)
+	edjson := new(ed25519PublicKeyJSON)
+	var err error
+	err = json.Unmarshal(s, &edjson)
+	if err != nil {
+		return nil, err
+	}
+	if !T_ED25519_PUB.isAcceptableSize(edjson.Size) {
+		return nil, ErrInvalidKeySize
+	}
+	b, err := decodeWeb64String(edjson.PublicBytes)
+	if err != nil {
+		return nil, ErrBase64Decoding
+	}
+	if len(b) != ed25519.PublicKeySize {
+		return nil, ErrInvalidKeySize
+	}
+	edkey.key = ed25519.PublicKey(b)
+	return edkey, nil
+}
+
+func newEd25519PublicJSONFromKey(key ed25519.PublicKey) *ed25519PublicKeyJSON {
+	edjson := new(ed25519PublicKeyJSON)
+	edjson.PublicBytes = encodeWeb64String(key)
+	edjson.Size = uint(len(key)) * 8
+	return edjson
+}
+
+func (ek *ed25519PublicKey) ToKeyJSON() []byte {
+	j := newEd25519PublicJSONFromKey(ek.key)
+	s, _ := json.Marshal(j)
+	return s
+}
+
+func newEd25519KeyFromJSON(s []byte) (*ed25519Key, error) {
+	edkey := new(ed25519Key)
+	edjson := new(ed25519KeyJSON)
+	var err error
+	err = json.Unmarshal(s, &edjson)
+	if err != nil {
+		return nil, err
+	}
+	if !T_ED25519_PRIV.isAcceptableSize(edjson.Size) || !T_ED25519_PUB.isAcceptableSize(edjson.PublicKey.Size) {
+		return nil, ErrInvalidKeySize
+	}
+	seed, err := decodeWeb64String(edjson.PrivateKey)
+	if err != nil {
+		return nil, ErrBase64Decoding
+	}
+	if len(seed) != ed25519.SeedSize {
+		return nil, ErrInvalidKeySize
+	}
+	edkey.key = ed25519.NewKeyFromSeed(seed)
+	edkey.publicKey.key = edkey.key.Public().(ed25519.PublicKey)
+	return edkey, nil
+}
+
+func newEd25519JSONFromKey(key ed25519.PrivateKey) *ed25519KeyJSON {
+	edjson := new(ed25519KeyJSON)
+	edjson.PrivateKey = encodeWeb64String(key.Seed())
+	edjson.PublicKey = *newEd25519PublicJSONFromKey(key.Public().(ed25519.PublicKey))
+	edjson.Size = ed25519.SeedSize * 8
+	return edjson
+}
+
+func (ek *ed25519Key) ToKeyJSON() []byte {
+	j := newEd25519JSONFromKey(ek.key)
+	s, _ := json.Marshal(j)
+	return s
+}
+
+func (ek *ed25519PublicKey) KeyID() []byte {
+	if len(ek.id) != 0 {
+		return ek.id
+	}
+	h := sha1.New()
+	h.Write(ek.key)
+	ek.id = h.Sum(nil)[:4]
+	return ek.id
+}
+
+func (ek *ed25519Key) KeyID() []byte {
+	return ek.publicKey.KeyID()
+}
+
+func (ek *ed25519Key) Sign(msg []byte) ([]byte, error) {
+	return ed25519.Sign(ek.key, msg), nil
+}
+
+func (ek *ed25519Key) Verify(msg []byte, signature []byte) (bool, error) {
+	return ek.publicKey.Verify(msg, signature)
+}
+
+func (ek *ed25519PublicKey) Verify(msg []byte, signature []byte) (bool, error) {
+	return ed25519.Verify(ek.key, msg, signature), nil
+}
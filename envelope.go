@@ -0,0 +1,69 @@
+package dkeyczar
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+)
+
+// envelopes start with this version byte, so the format can change later
+const envelopeVersion = uint8(1)
+
+// EnvelopeEncrypt encrypts plaintext with a fresh AES+HMAC data key, encrypts
+// the data key with kek, and returns both as a single blob encoded with kek's
+// encoding.  The blob looks like:
+// |version|wrapped key length|wrapped key|ciphertext|
+// The length is a big-endian uint32, and the wrapped key is kek's output as is.
+// kek isn't modified, so it can be shared between goroutines.
+func EnvelopeEncrypt(kek Encrypter, plaintext []byte) (string, error) {
+	dek, err := generateAESKey(0, rand.Reader)
+	if err != nil {
+		return "", err
+	}
+	defer wipeKeydata(dek)
+	packed := dek.packedKeys()
+	wrapped, err := kek.Encrypt(packed)
+	wipeBytes(packed)
+	if err != nil {
+		return "", err
+	}
+	ciphertext, err := dek.Encrypt(plaintext)
+	if err != nil {
+		return "", err
+	}
+	blob := make([]byte, 5, 5+len(wrapped)+len(ciphertext))
+	blob[0] = envelopeVersion
+	binary.BigEndian.PutUint32(blob[1:5], uint32(len(wrapped)))
+	blob = append(blob, wrapped...)
+	blob = append(blob, ciphertext...)
+	return encodingController{kek.Encoding()}.encode(blob), nil
+}
+
+// EnvelopeDecrypt decrypts a blob made by EnvelopeEncrypt, unwrapping the data key with kek.
+// kek must have the same encoding and compression as the Encrypter used to make the blob.
+func EnvelopeDecrypt(kek Crypter, envelope string) ([]byte, error) {
+	b, err := encodingController{kek.Encoding()}.decode(envelope)
+	if err != nil {
+		return nil, ErrBase64Decoding
+	}
+	if len(b) < 5 {
+		return nil, ErrShortCiphertext
+	}
+	if b[0] != envelopeVersion {
+		return nil, &UnsupportedVersionError{Version: b[0]}
+	}
+	n := binary.BigEndian.Uint32(b[1:5])
+	if uint64(n) > uint64(len(b)-5) {
+		return nil, ErrShortCiphertext
+	}
+	wrapped, ciphertext := b[5:5+n], b[5+n:]
+	packed, err := kek.Decrypt(string(wrapped))
+	if err != nil {
+		return nil, err
+	}
+	dek, err := newAESFromPackedKeys(packed)
+	if err != nil {
+		return nil, err
+	}
+	defer wipeKeydata(dek)
+	return dek.Decrypt(ciphertext)
+}
@@ -0,0 +1,56 @@
+package dkeyczar
+
+import (
+	"os"
+	"strconv"
+	"strings"
+)
+
+type envReader struct {
+	prefix string // the environment variables are named prefix_META, prefix_1, ...
+}
+
+// NewEnvReader returns a KeyReader that reads a key set from the environment:
+// the metadata from prefix_META and each key version from prefix_1, prefix_2, ...
+// The values are base64 encoded, web-safe or standard, with or without padding.
+// The variables are read when the keys are loaded, not when the reader is made.
+func NewEnvReader(prefix string) KeyReader {
+	return &envReader{prefix: prefix}
+}
+
+// look up and decode one of our variables
+func (r *envReader) get(name string, errMissing error) (string, error) {
+	v, ok := os.LookupEnv(r.prefix + "_" + name)
+	if !ok {
+		return "", errMissing
+	}
+	v = strings.NewReplacer("+", "-", "/", "_", "=", "").Replace(strings.TrimSpace(v))
+	b, err := decodeWeb64String(v)
+	if err != nil {
+		return "", ErrBase64Decoding
+	}
+	return string(b), nil
+}
+
+func (r *envReader) GetMetadata() (string, error) {
+	return r.get("META", ErrKeyNotFound)
+}
+
+func (r *envReader) GetKey(version int) (string, error) {
+	return r.get(strconv.Itoa(version), ErrNoSuchKeyVersion)
+}
+
+// ExportEnv reads the whole key set from reader and returns it as environment
+// variable assignments ("prefix_META=...") for NewEnvReader.
+// Keys are copied as they are read, so encrypted keys stay encrypted.
+func ExportEnv(prefix string, reader KeyReader) ([]string, error) {
+	r, err := readKeySet(reader)
+	if err != nil {
+		return nil, err
+	}
+	env := []string{prefix + "_META=" + encodeWeb64String([]byte(r.meta))}
+	for _, v := range r.versions() {
+		env = append(env, prefix+"_"+strconv.Itoa(v)+"="+encodeWeb64String([]byte(r.keys[v])))
+	}
+	return env, nil
+}
@@ -1,5 +1,9 @@
 package dkeyczar
-import "errors"
+import (
+	"encoding/hex"
+	"errors"
+	"strconv"
+)
 var (
 	ErrBadVersion          = errors.New("keyczar: bad version number in header")
 	ErrBase64Decoding      = errors.New("keyczar: error during base64 decode")
@@ -13,4 +17,121 @@ var (
 	ErrInvalidKeySize      = errors.New("keyczar: bad key size")
 	ErrNoSuchKeyVersion    = errors.New("keyczar: no such key version")
 	ErrCannotStream        = errors.New("keyczar: key type cannot stream")
+	ErrNoPEMFound          = errors.New("keyczar: no PEM data found")
+	ErrPEMDecryption       = errors.New("keyczar: unable to decrypt PEM data (wrong passphrase?)")
+	ErrPKCS12Decryption    = errors.New("keyczar: unable to decrypt PKCS#12 data (wrong password?)")
+	ErrMalformedJWT        = errors.New("keyczar: malformed JWT")
+	ErrMalformedJWE        = errors.New("keyczar: malformed JWE")
+	ErrJWTExpired          = errors.New("keyczar: JWT has expired")
+	ErrJWTNotYetValid      = errors.New("keyczar: JWT is not yet valid")
+	ErrMalformedPASETO     = errors.New("keyczar: malformed PASETO token")
+	ErrPASETOExpired       = errors.New("keyczar: PASETO token has expired")
+	ErrPASETONotYetValid   = errors.New("keyczar: PASETO token is not yet valid")
+	ErrMalformedAge        = errors.New("keyczar: malformed age file")
+	ErrCookieExpired       = errors.New("keyczar: cookie has expired")
+	ErrCookieTooLarge      = errors.New("keyczar: cookie is too large")
+	ErrMalformedChunked    = errors.New("keyczar: malformed chunked file")
+	ErrBackupMismatch      = errors.New("keyczar: backup doesn't match its manifest")
+	ErrInvalidShares       = errors.New("keyczar: invalid or too few secret shares")
+	ErrIVReused            = errors.New("keyczar: IV reused (broken random source?)")
+	ErrNoKeySets           = errors.New("keyczar: no key sets given")
+	ErrBadCiphertextFormat = errors.New("keyczar: malformed ciphertext")
+	ErrWrongKey            = errors.New("keyczar: ciphertext does not decrypt with the matching keys")
+	ErrMultiplePrimaryKeys = errors.New("keyczar: more than one primary key found")
+	ErrInvalidKeyVersion   = errors.New("keyczar: invalid key version number")
+	ErrDuplicateKeyVersion = errors.New("keyczar: duplicate key version number")
+	ErrInvalidKeyStatus    = errors.New("keyczar: invalid key status")
+	ErrKeyNotInactive      = errors.New("keyczar: only inactive keys can be revoked")
+	ErrWeakKey             = errors.New("keyczar: key is smaller than recommended")
+	ErrExportableKey       = errors.New("keyczar: key is marked exportable")
+	ErrWeakPBE             = errors.New("keyczar: password-based key is protected with weak parameters")
+	ErrDeterministicKey    = errors.New("keyczar: deterministic keys need a DeterministicCrypter")
+	ErrNotDeterministicKey = errors.New("keyczar: key set is not deterministic")
+	ErrSignerMismatch      = errors.New("keyczar: signer doesn't match the public key of the key set")
+	ErrOpaqueKey           = errors.New("keyczar: key material of an opaque key can't be read")
+	ErrNotDerivable        = errors.New("keyczar: keys can only be derived from symmetric keys")
+	ErrInvalidLength       = errors.New("keyczar: invalid derived key length")
+	ErrMalformedJSONKeySet = errors.New("keyczar: malformed JSON key set")
+	ErrMalformedArchive    = errors.New("keyczar: archive doesn't hold exactly one key set")
+	ErrInactiveKey         = errors.New("keyczar: key version is inactive")
+	ErrBatchLength         = errors.New("keyczar: batch has a different number of messages and signatures")
+	ErrNoNonceStore        = errors.New("keyczar: no nonce store to check replay-protected signatures against")
+	ErrStaleSignature      = errors.New("keyczar: signature timestamp outside the replay window")
+	ErrReplayedSignature   = errors.New("keyczar: signature nonce seen before")
+	ErrUnknownSigScheme    = errors.New("keyczar: unknown RSA signature scheme")
+	ErrBadNonceSize        = errors.New("keyczar: replay nonce is not ReplayNonceSize bytes")
+	ErrKeyExpired          = errors.New("keyczar: key version has expired")
+	ErrKeyNotYetValid      = errors.New("keyczar: key version is not valid yet")
+	ErrInvalidKeyLifetime  = errors.New("keyczar: key version expires before it becomes valid")
+	ErrKeyNotExportable    = errors.New("keyczar: key version is not marked exportable")
+	ErrExportNotConfirmed  = errors.New("keyczar: marking a key exportable needs ConfirmExportable")
+	ErrKeysetEncrypted     = errors.New("keyczar: key set is encrypted, but its reader doesn't decrypt the keys")
+	ErrKeysetNotEncrypted  = errors.New("keyczar: key set isn't encrypted, but its reader decrypts the keys")
 )
+// KeyNotFoundError is returned when a key hash isn't in the key set, or a key version can't be read.
+// errors.Is(err, ErrKeyNotFound) is true for it.
+type KeyNotFoundError struct {
+	KeyHash []byte // the key hash from the header, if any
+	Version int    // the key version being read, if any
+	Err     error  // the KeyReader error, if any
+}
+func (e *KeyNotFoundError) Error() string {
+	s := ErrKeyNotFound.Error()
+	if e.KeyHash != nil {
+		s += " (hash " + hex.EncodeToString(e.KeyHash) + ")"
+	}
+	if e.Version != 0 {
+		s += " (version " + strconv.Itoa(e.Version) + ")"
+	}
+	if e.Err != nil {
+		s += ": " + e.Err.Error()
+	}
+	return s
+}
+func (e *KeyNotFoundError) Is(target error) bool { return target == ErrKeyNotFound }
+func (e *KeyNotFoundError) Unwrap() error        { return e.Err }
+// UnsupportedVersionError is returned for a ciphertext or signature whose format version can't be read.
+// errors.Is(err, ErrBadVersion) is true for it.
+type UnsupportedVersionError struct {
+	Version uint8 // the version byte from the header
+}
+func (e *UnsupportedVersionError) Error() string {
+	return ErrBadVersion.Error() + " (" + strconv.Itoa(int(e.Version)) + ")"
+}
+func (e *UnsupportedVersionError) Is(target error) bool { return target == ErrBadVersion }
+// DecryptError is returned when keys matching the key hash were found, but none could decrypt the ciphertext.
+// errors.Is(err, ErrWrongKey) and errors.Is(err, ErrInvalidSignature), the error returned before, are true
+// for it, and Err is the error of the last key tried.
+type DecryptError struct {
+	Err error
+}
+func (e *DecryptError) Error() string {
+	return ErrWrongKey.Error() + ": " + e.Err.Error()
+}
+func (e *DecryptError) Is(target error) bool { return target == ErrWrongKey || target == ErrInvalidSignature }
+func (e *DecryptError) Unwrap() error        { return e.Err }
+// KeysetEncryptionError is returned when the metadata of a key set and the reader it is read through
+// disagree on whether the keys are encrypted: an encrypted key set read without NewEncryptedReader or
+// NewPBEReader, or a plaintext one read through them.  errors.Is(err, ErrKeysetEncrypted) is true for the
+// first, and errors.Is(err, ErrKeysetNotEncrypted) for the second.
+type KeysetEncryptionError struct {
+	Name      string // the name of the key set
+	Encrypted bool   // what the metadata says
+	Err       error  // the error reading the keys, if any
+}
+func (e *KeysetEncryptionError) Error() string {
+	var s string
+	if e.Encrypted {
+		s = ErrKeysetEncrypted.Error() + " (" + strconv.Quote(e.Name) + "): wrap it with NewEncryptedReader or NewPBEReader"
+	} else {
+		s = ErrKeysetNotEncrypted.Error() + " (" + strconv.Quote(e.Name) + ")"
+	}
+	if e.Err != nil {
+		s += ": " + e.Err.Error()
+	}
+	return s
+}
+func (e *KeysetEncryptionError) Is(target error) bool {
+	return e.Encrypted && target == ErrKeysetEncrypted || !e.Encrypted && target == ErrKeysetNotEncrypted
+}
+func (e *KeysetEncryptionError) Unwrap() error { return e.Err }
@@ -0,0 +1,154 @@
+package dkeyczar
+
+import (
+	"crypto/dsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/pem"
+)
+
+// PrimaryKeyVersion can be passed to the Export functions to select the primary key of a key set.
+const PrimaryKeyVersion = -1
+
+// return the requested version (or the primary) from the key set
+func exportKey(kz *keyCzar, version int) (keydata, error) {
+	if version == PrimaryKeyVersion {
+		if err := kz.loadPrimaryKey(); err != nil {
+			return nil, err
+		}
+		version = kz.primary
+	}
+	k, ok := kz.keys[version]
+	if !ok {
+		return nil, ErrNoSuchKeyVersion
+	}
+	return k, nil
+}
+
+// return the requested version (or the primary) from the key set, if it is marked exportable
+func exportPrivateKey(kz *keyCzar, version int) (keydata, error) {
+	k, err := exportKey(kz, version)
+	if err != nil {
+		return nil, err
+	}
+	if version == PrimaryKeyVersion {
+		version = kz.primary
+	}
+	for _, kv := range kz.keymeta.Versions {
+		if kv.VersionNumber == version && kv.Exportable {
+			return k, nil
+		}
+	}
+	return nil, ErrKeyNotExportable
+}
+
+// crypto/x509 can't marshal DSA keys, so we build the ASN.1 ourselves
+func marshalDSAPublicKey(key *dsa.PublicKey) ([]byte, error) {
+	algo, err := dsaAlgorithmIdentifier(&key.Parameters)
+	if err != nil {
+		return nil, err
+	}
+	y, err := asn1.Marshal(key.Y)
+	if err != nil {
+		return nil, err
+	}
+	return asn1.Marshal(struct {
+		Algo      pkix.AlgorithmIdentifier
+		PublicKey asn1.BitString
+	}{algo, asn1.BitString{Bytes: y, BitLength: len(y) * 8}})
+}
+
+func marshalDSAPKCS8PrivateKey(key *dsa.PrivateKey) ([]byte, error) {
+	algo, err := dsaAlgorithmIdentifier(&key.Parameters)
+	if err != nil {
+		return nil, err
+	}
+	x, err := asn1.Marshal(key.X)
+	if err != nil {
+		return nil, err
+	}
+	return asn1.Marshal(dsaPKCS8PrivateKey{0, algo, x})
+}
+
+func dsaAlgorithmIdentifier(params *dsa.Parameters) (pkix.AlgorithmIdentifier, error) {
+	b, err := asn1.Marshal(dsaAlgorithmParameters{params.P, params.Q, params.G})
+	if err != nil {
+		return pkix.AlgorithmIdentifier{}, err
+	}
+	return pkix.AlgorithmIdentifier{Algorithm: oidPublicKeyDSA, Parameters: asn1.RawValue{FullBytes: b}}, nil
+}
+
+// ExportPublicKeyPEM returns the public half of the given key version from the RSA, DSA, EC or Ed25519 key set in r,
+// encoded as a PEM "PUBLIC KEY" (SubjectPublicKeyInfo) block.  Both private and public key sets are accepted.
+func ExportPublicKeyPEM(r KeyReader, version int) ([]byte, error) {
+	kz, err := newKeyCzar(r)
+	if err != nil {
+		return nil, err
+	}
+	k, err := exportKey(kz, version)
+	if err != nil {
+		return nil, err
+	}
+	der, err := marshalPublicKey(k)
+	if err != nil {
+		return nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), nil
+}
+
+// return the public half of k as a DER SubjectPublicKeyInfo
+func marshalPublicKey(k keydata) ([]byte, error) {
+	switch k := k.(type) {
+	case *rsaKey:
+		return x509.MarshalPKIXPublicKey(&k.publicKey.key)
+	case *rsaPublicKey:
+		return x509.MarshalPKIXPublicKey(&k.key)
+	case *dsaKey:
+		return marshalDSAPublicKey(&k.publicKey.key)
+	case *dsaPublicKey:
+		return marshalDSAPublicKey(&k.key)
+	case *ecdsaKey:
+		return x509.MarshalPKIXPublicKey(&k.publicKey.key)
+	case *ecdsaPublicKey:
+		return x509.MarshalPKIXPublicKey(&k.key)
+	case *ed25519Key:
+		return x509.MarshalPKIXPublicKey(k.publicKey.key)
+	case *ed25519PublicKey:
+		return x509.MarshalPKIXPublicKey(k.key)
+	case *cryptoSignerKey:
+		return marshalPublicKey(k.verifyKey)
+	}
+	return nil, ErrUnsupportedType
+}
+
+// ExportPrivateKeyPEM returns the given key version from the RSA, DSA, EC or Ed25519 private key set in r,
+// encoded as a PEM "PRIVATE KEY" (PKCS#8) block.  The result is unencrypted, so handle it with care.
+// Only versions marked exportable, see ExportableController, are exported; others fail with ErrKeyNotExportable.
+func ExportPrivateKeyPEM(r KeyReader, version int) ([]byte, error) {
+	kz, err := newKeyCzar(r)
+	if err != nil {
+		return nil, err
+	}
+	k, err := exportPrivateKey(kz, version)
+	if err != nil {
+		return nil, err
+	}
+	var der []byte
+	switch k := k.(type) {
+	case *rsaKey:
+		der, err = x509.MarshalPKCS8PrivateKey(&k.key)
+	case *dsaKey:
+		der, err = marshalDSAPKCS8PrivateKey(&k.key)
+	case *ecdsaKey:
+		der, err = x509.MarshalPKCS8PrivateKey(&k.key)
+	case *ed25519Key:
+		der, err = x509.MarshalPKCS8PrivateKey(k.key)
+	default:
+		return nil, ErrUnsupportedType
+	}
+	if err != nil {
+		return nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), nil
+}
@@ -0,0 +1,73 @@
+package dkeyczar
+
+import (
+	"crypto/sha256"
+)
+
+// A KeyIdentifier reports what identifies the keys of its key set, e.g. to log
+// or pin the key set a peer uses.  The Encrypters, Crypters, Signers and
+// Verifiers made from key sets are KeyIdentifiers.
+type KeyIdentifier interface {
+	// KeyHash returns the key hash of a key version, as found in message headers,
+	// or nil if the key set has no such version.  PrimaryKeyVersion selects the primary key.
+	KeyHash(version int) []byte
+	// Fingerprint returns the web-safe base64 SHA-256 of the public key of a key version,
+	// encoded as a SubjectPublicKeyInfo, so it matches the fingerprint of the key exported
+	// by ExportPublicKeyPEM.  It is the same for the private and public halves of a key.
+	// Symmetric and X25519 keys fail with ErrUnsupportedType.
+	Fingerprint(version int) (string, error)
+}
+
+// return the key of a version, or the primary key, or nil
+func (kz *keyCzar) versionKey(version int) keydata {
+	if kz.loadVersion(version) != nil {
+		return nil
+	}
+	kz.mu.RLock()
+	defer kz.mu.RUnlock()
+	if version == PrimaryKeyVersion {
+		version = kz.primary
+	}
+	return kz.keys[version]
+}
+
+func (kz *keyCzar) keyHash(version int) []byte {
+	k := kz.versionKey(version)
+	if k == nil {
+		return nil
+	}
+	return append([]byte(nil), k.KeyID()...)
+}
+
+func (kz *keyCzar) fingerprint(version int) (string, error) {
+	k := kz.versionKey(version)
+	if k == nil {
+		return "", ErrNoSuchKeyVersion
+	}
+	der, err := marshalPublicKey(k)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(der)
+	return encodeWeb64String(sum[:]), nil
+}
+
+// KeyHash returns the key hash of a key version of the encrypter or crypter
+func (kc *keyEncrypter) KeyHash(version int) []byte {
+	return kc.kz.keyHash(version)
+}
+
+// Fingerprint returns the fingerprint of the public key of a key version of the encrypter
+func (kc *keyEncrypter) Fingerprint(version int) (string, error) {
+	return kc.kz.fingerprint(version)
+}
+
+// KeyHash returns the key hash of a key version of the signer or verifier
+func (ks *keySigner) KeyHash(version int) []byte {
+	return ks.kz.keyHash(version)
+}
+
+// Fingerprint returns the fingerprint of the public key of a key version of the signer or verifier
+func (ks *keySigner) Fingerprint(version int) (string, error) {
+	return ks.kz.fingerprint(version)
+}
@@ -0,0 +1,104 @@
+//go:build fuzz
+// +build fuzz
+
+package dkeyczar
+
+import (
+	"bytes"
+	"io/ioutil"
+	"sync"
+)
+
+// Entry points for go-fuzz, and for native fuzz tests wrapping them.  Build with -tags fuzz.
+// They return 1 when the input parsed, so the fuzzer favours it, and 0 otherwise;
+// a panic is a bug.
+
+var fuzzKeys struct {
+	sync.Once
+	crypters  []Crypter
+	streamers []CryptStreamer
+}
+
+// make the key sets fuzzed ciphertexts are decrypted with
+func loadFuzzKeys() {
+	fuzzKeys.Do(func() {
+		for _, kt := range []struct {
+			ktype KeyType
+			size  uint
+		}{{T_AES, 0}, {T_RSA_PRIV, 1024}} {
+			km := NewKeyManager()
+			km.Create("fuzz", P_DECRYPT_AND_ENCRYPT, kt.ktype)
+			if err := km.AddKey(kt.size, S_PRIMARY); err != nil {
+				panic(err)
+			}
+			js, err := km.ToJSONs(nil)
+			if err != nil {
+				panic(err)
+			}
+			r := &memReader{meta: js[0], keys: map[int]string{1: js[1]}}
+			c, err := NewCrypter(r, WithEncoding(NO_ENCODING))
+			if err != nil {
+				panic(err)
+			}
+			cs, _ := NewCryptStreamer(r, WithEncoding(NO_ENCODING)) // nil for key types that can't stream
+			fuzzKeys.crypters = append(fuzzKeys.crypters, c)
+			fuzzKeys.streamers = append(fuzzKeys.streamers, cs)
+		}
+	})
+}
+
+// FuzzDecrypt decrypts data as an unencoded ciphertext of an AES and an RSA key set,
+// whole and streamed, and as the session keys of a session.
+func FuzzDecrypt(data []byte) int {
+	loadFuzzKeys()
+	ok := 0
+	for i, c := range fuzzKeys.crypters {
+		if _, err := c.Decrypt(string(data)); err == nil {
+			ok = 1
+		}
+		if cs := fuzzKeys.streamers[i]; cs != nil {
+			if r, _, err := cs.DecryptReader(bytes.NewReader(data), 0); err == nil {
+				if _, err := ioutil.ReadAll(r); err == nil && r.Close() == nil {
+					ok = 1
+				}
+			}
+		}
+		if _, err := NewSessionDecrypter(c, string(data)); err == nil {
+			ok = 1
+		}
+	}
+	return ok
+}
+
+// FuzzReadKeyset reads data as a key set bundled by ExportJSON, and loads it
+// into each kind of key set user.
+func FuzzReadKeyset(data []byte) int {
+	r, err := NewJSONReader(data)
+	if err != nil {
+		return 0
+	}
+	ok := 0
+	if _, err := LoadKeysetInfo(r); err == nil {
+		ok = 1
+	}
+	if c, err := NewCrypter(r); err == nil {
+		ok = 1
+		if ct, err := c.Encrypt(data); err == nil {
+			c.Decrypt(ct)
+		}
+	}
+	if s, err := NewSigner(r); err == nil {
+		ok = 1
+		if sig, err := s.Sign(data); err == nil {
+			s.Verify(data, sig)
+		}
+	}
+	if v, err := NewVerifier(r); err == nil {
+		ok = 1
+		v.Verify(data, "")
+	}
+	if _, err := NewEncrypter(r); err == nil {
+		ok = 1
+	}
+	return ok
+}
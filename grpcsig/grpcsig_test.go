@@ -0,0 +1,156 @@
+package grpcsig
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"testing"
+
+	"github.com/dgryski/dkeyczar"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+// a key set held by a KeyManager
+type jsonsReader []string
+
+func (r jsonsReader) GetMetadata() (string, error) {
+	return r[0], nil
+}
+
+func (r jsonsReader) GetKey(version int) (string, error) {
+	return r[version], nil
+}
+
+// the key set of km as KeyManager.ToJSONs returns it, for keys that can't fail to encrypt
+func mustJSONs(km dkeyczar.KeyManager, encrypter dkeyczar.Encrypter) []string {
+	jsons, err := km.ToJSONs(encrypter)
+	if err != nil {
+		panic(err)
+	}
+	return jsons
+}
+
+func dial(t *testing.T, lis *bufconn.Listener, opts ...grpc.DialOption) healthpb.HealthClient {
+	opts = append(opts,
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) { return lis.DialContext(ctx) }))
+	cc, err := grpc.NewClient("passthrough:///bufnet", opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { cc.Close() })
+	return healthpb.NewHealthClient(cc)
+}
+
+func TestSignedCalls(t *testing.T) {
+	km := dkeyczar.NewKeyManager()
+	km.Create("grpcsig", dkeyczar.P_SIGN_AND_VERIFY, dkeyczar.T_ED25519_PRIV)
+	km.AddKey(0, dkeyczar.S_PRIMARY)
+	oldSigner, _ := dkeyczar.NewSigner(jsonsReader(mustJSONs(km, nil)))
+	km.AddKey(0, dkeyczar.S_PRIMARY)
+	signer, _ := dkeyczar.NewSigner(jsonsReader(mustJSONs(km, nil)))
+	verifier, err := dkeyczar.NewVerifier(jsonsReader(mustJSONs(km.PubKeys(), nil)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	observed := make(chan int, 10)
+	srv := &Server{Verifier: verifier, Observe: func(method string, info dkeyczar.KeyInfo) { observed <- info.Version }}
+	lis := bufconn.Listen(1 << 20)
+	gs := grpc.NewServer(grpc.UnaryInterceptor(srv.Unary()), grpc.StreamInterceptor(srv.Stream()))
+	healthpb.RegisterHealthServer(gs, health.NewServer())
+	go gs.Serve(lis)
+	defer gs.Stop()
+
+	ctx := context.Background()
+	for _, tc := range []struct {
+		signer  dkeyczar.Signer
+		version int
+	}{{signer, 2}, {oldSigner, 1}} {
+		c := &Client{Signer: tc.signer}
+		client := dial(t, lis, grpc.WithUnaryInterceptor(c.Unary()), grpc.WithStreamInterceptor(c.Stream()))
+		var header metadata.MD
+		resp, err := client.Check(ctx, &healthpb.HealthCheckRequest{}, grpc.Header(&header))
+		if err != nil {
+			t.Fatal("signed unary call failed: " + err.Error())
+		}
+		if resp.Status != healthpb.HealthCheckResponse_SERVING {
+			t.Errorf("unexpected response: %v", resp)
+		}
+		if v := header.Get(MetadataKeyVersion); len(v) != 1 || v[0] != strconv.Itoa(tc.version) {
+			t.Errorf("key version header mismatch: got %v, expected %d", v, tc.version)
+		}
+		if v := <-observed; v != tc.version {
+			t.Errorf("observed key version %d, expected %d", v, tc.version)
+		}
+
+		sctx, cancel := context.WithCancel(ctx)
+		stream, err := client.Watch(sctx, &healthpb.HealthCheckRequest{})
+		if err == nil {
+			_, err = stream.Recv()
+		}
+		cancel()
+		if err != nil {
+			t.Fatal("signed stream failed: " + err.Error())
+		}
+		<-observed
+	}
+
+	// unsigned calls, and calls signed by someone else, are turned away
+	_, err = dial(t, lis).Check(ctx, &healthpb.HealthCheckRequest{})
+	if status.Code(err) != codes.Unauthenticated {
+		t.Errorf("expected Unauthenticated for an unsigned call, got %v", err)
+	}
+	other := dkeyczar.NewKeyManager()
+	other.Create("other", dkeyczar.P_SIGN_AND_VERIFY, dkeyczar.T_ED25519_PRIV)
+	other.AddKey(0, dkeyczar.S_PRIMARY)
+	otherSigner, _ := dkeyczar.NewSigner(jsonsReader(mustJSONs(other, nil)))
+	c := &Client{Signer: otherSigner}
+	client := dial(t, lis, grpc.WithUnaryInterceptor(c.Unary()), grpc.WithStreamInterceptor(c.Stream()))
+	if _, err := client.Check(ctx, &healthpb.HealthCheckRequest{}); status.Code(err) != codes.Unauthenticated {
+		t.Errorf("expected Unauthenticated for a call signed with another key, got %v", err)
+	}
+	stream, err := client.Watch(ctx, &healthpb.HealthCheckRequest{})
+	if err == nil {
+		_, err = stream.Recv()
+	}
+	if status.Code(err) != codes.Unauthenticated {
+		t.Errorf("expected Unauthenticated for a stream signed with another key, got %v", err)
+	}
+}
+
+func TestRequestBound(t *testing.T) {
+	km := dkeyczar.NewKeyManager()
+	km.Create("grpcsig", dkeyczar.P_SIGN_AND_VERIFY, dkeyczar.T_ED25519_PRIV)
+	km.AddKey(0, dkeyczar.S_PRIMARY)
+	signer, _ := dkeyczar.NewSigner(jsonsReader(mustJSONs(km, nil)))
+	c := &Client{Signer: signer}
+	s := &Server{Verifier: signer}
+
+	req := &healthpb.HealthCheckRequest{Service: "a"}
+	ctx, err := c.sign(context.Background(), kindUnary, "/pkg.Svc/M", req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	md, _ := metadata.FromOutgoingContext(ctx)
+	ctx = metadata.NewIncomingContext(context.Background(), md)
+	if _, info, err := s.verify(ctx, kindUnary, "/pkg.Svc/M", req); err != nil || info.Version != 1 {
+		t.Fatalf("failed to verify call: %v %v", info, err)
+	}
+	if _, _, err := s.verify(ctx, kindUnary, "/pkg.Svc/M", &healthpb.HealthCheckRequest{Service: "b"}); err != ErrInvalidSignature {
+		t.Errorf("expected ErrInvalidSignature for another request, got %v", err)
+	}
+	if _, _, err := s.verify(ctx, kindUnary, "/pkg.Svc/N", req); err != ErrInvalidSignature {
+		t.Errorf("expected ErrInvalidSignature for another method, got %v", err)
+	}
+	if _, _, err := s.verify(ctx, kindUnary, "/pkg.Svc/M", "not a message"); err != ErrNotProto {
+		t.Errorf("expected ErrNotProto for a non-protobuf request, got %v", err)
+	}
+}
@@ -9,9 +9,48 @@ Decryption, Signing and Verification use the same minimal API.
 Encrypted data and signatures are encoded with web-safe base64.
 */
 package dkeyczar
-import "io"
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"io"
+)
 const kzVersion = uint8(0)
 const kzHeaderLength = 5
+
+// FORMAT_VERSION is the version byte starting every ciphertext and signature made by this package
+const FORMAT_VERSION = int(kzVersion)
+
+// an output format, selected by the version byte starting the header
+type headerFormat struct {
+	headerLength int // the version byte and the key hash
+}
+
+// the formats we can read.  A new format, e.g. for AEAD keys, gets an entry of its own
+// and is told apart by its version byte, so the readers of the existing ones stay as they are.
+var headerFormats = map[uint8]headerFormat{
+	kzVersion: {headerLength: kzHeaderLength},
+}
+
+// check we can read the format with version byte v
+func checkVersion(v uint8) error {
+	if _, ok := headerFormats[v]; !ok {
+		return &UnsupportedVersionError{Version: v}
+	}
+	return nil
+}
+
+// FormatVersion returns the format version of a ciphertext or signature encoded with encoding.
+// Only the header is decoded, and the version isn't checked, so newer formats can be told apart.
+func FormatVersion(data string, encoding Encoding) (int, error) {
+	h, err := decodeHeaderPrefix(encodingController{encoding}, data)
+	if err != nil {
+		return 0, ErrBase64Decoding
+	}
+	if len(h) == 0 {
+		return 0, ErrShortCiphertext
+	}
+	return int(h[0]), nil
+}
 type kHeader struct {
 	version uint8
 	keyid   [4]uint8
@@ -30,8 +69,8 @@ func splitHeaderBytes(ec encodingController, lookup lookupKeyIDer, cryptotext []
 	if len(b) < kzHeaderLength {
 		return nil, nil, errTooShort
 	}
-	if b[0] != kzVersion {
-		return nil, nil, ErrBadVersion
+	if err := checkVersion(b[0]); err != nil {
+		return nil, nil, err
 	}
 	k, err := lookup.getKeyForID(b[1:5])
 	if err != nil {
@@ -40,21 +79,51 @@ func splitHeaderBytes(ec encodingController, lookup lookupKeyIDer, cryptotext []
 	return b, k, nil
 }
 
-func splitHeader(ec encodingController, lookup lookupKeyIDer, cryptotext string, errTooShort error) ([]byte, []keydata, error) {
-	b, err := ec.decode(cryptotext)
+// decode just enough of the encoded cryptotext to get the header
+func decodeHeaderPrefix(ec encodingController, cryptotext string) ([]byte, error) {
+	switch ec.encoding {
+	case BASE64W:
+		// 8 characters are 6 whole bytes
+		if len(cryptotext) >= 8 && cryptotext[7] != '=' {
+			return base64.RawURLEncoding.DecodeString(cryptotext[:8])
+		}
+	case HEX:
+		if len(cryptotext) >= 2*kzHeaderLength {
+			return hex.DecodeString(cryptotext[:2*kzHeaderLength])
+		}
+	case NO_ENCODING:
+		if len(cryptotext) >= kzHeaderLength {
+			return []byte(cryptotext[:kzHeaderLength]), nil
+		}
+	}
+	return ec.decode(cryptotext)
+}
+
+// return the keys matching the header of the encoded cryptotext.
+// Only the header is decoded, so a cryptotext for an unknown key fails without decoding the rest.
+func lookupHeader(ec encodingController, lookup lookupKeyIDer, cryptotext string, errTooShort error) ([]keydata, error) {
+	h, err := decodeHeaderPrefix(ec, cryptotext)
 	if err != nil {
-		return nil, nil, ErrBase64Decoding
+		return nil, ErrBase64Decoding
 	}
-	if len(b) < kzHeaderLength {
-		return nil, nil, errTooShort
+	if len(h) < kzHeaderLength {
+		return nil, errTooShort
 	}
-	if b[0] != kzVersion {
-		return nil, nil, ErrBadVersion
+	if err := checkVersion(h[0]); err != nil {
+		return nil, err
 	}
-	k, err := lookup.getKeyForID(b[1:5])
+	return lookup.getKeyForID(h[1:kzHeaderLength])
+}
+
+func splitHeader(ec encodingController, lookup lookupKeyIDer, cryptotext string, errTooShort error) ([]byte, []keydata, error) {
+	k, err := lookupHeader(ec, lookup, cryptotext, errTooShort)
 	if err != nil {
 		return nil, nil, err
 	}
+	b, err := ec.decode(cryptotext)
+	if err != nil {
+		return nil, nil, ErrBase64Decoding
+	}
 	return b, k, nil
 }
 
@@ -75,8 +144,8 @@ func decodeHeader(lookup lookupKeyIDer, header []byte) ([]keydata, error) {
 	if len(header) != kzHeaderLength {
 		return nil, ErrShortCiphertext
 	}
-	if header[0] != kzVersion {
-		return nil, ErrBadVersion
+	if err := checkVersion(header[0]); err != nil {
+		return nil, err
 	}
 	k, err := lookup.getKeyForID(header[1:5])
 	if err != nil {
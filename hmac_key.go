@@ -3,12 +3,12 @@ package dkeyczar
 import (
 	"bytes"
 	"crypto/hmac"
-	"crypto/rand"
 	"crypto/sha1"
 	"crypto/subtle"
 	"encoding/json"
 	"hash"
 	"io"
+	"sync"
 )
 
 // we only support one hmac size for the moment
@@ -22,23 +22,42 @@ type hmacKeyJSON struct {
 type hmacKey struct {
 	key []byte
 	id  []byte
+
+	// hmac states ready for reuse; Reset is much cheaper than hmac.New
+	pool sync.Pool
+}
+
+// return a fresh hmac for the key
+func (hm *hmacKey) getHash() hash.Hash {
+	if h, ok := hm.pool.Get().(hash.Hash); ok {
+		h.Reset()
+		return h
+	}
+	return hmac.New(sha1.New, hm.key)
 }
 
-func generateHMACKey() (*hmacKey, error) {
+func generateHMACKey(rng io.Reader) (*hmacKey, error) {
 	hk := new(hmacKey)
 	hk.key = make([]byte, T_HMAC_SHA1.defaultSize()/8)
-	io.ReadFull(rand.Reader, hk.key)
+	if _, err := io.ReadFull(rng, hk.key); err != nil {
+		return nil, err
+	}
 	return hk, nil
 }
 
 func newHMACKeyFromJSON(s []byte) (*hmacKey, error) {
-	hmackey := new(hmacKey)
 	hmacjson := new(hmacKeyJSON)
-	var err error
-	err = json.Unmarshal(s, &hmacjson)
+	err := json.Unmarshal(s, &hmacjson)
 	if err != nil {
 		return nil, err
 	}
+	return newHMACKeyFromParsedJSON(hmacjson)
+}
+
+// the key of hmacjson, which must be as long as its size says, and that size an acceptable one
+func newHMACKeyFromParsedJSON(hmacjson *hmacKeyJSON) (*hmacKey, error) {
+	hmackey := new(hmacKey)
+	var err error
 	if !T_HMAC_SHA1.isAcceptableSize(hmacjson.Size) {
 		return nil, ErrInvalidKeySize
 	}
@@ -46,6 +65,9 @@ func newHMACKeyFromJSON(s []byte) (*hmacKey, error) {
 	if err != nil {
 		return nil, ErrBase64Decoding
 	}
+	if uint(len(hmackey.key))*8 != hmacjson.Size {
+		return nil, ErrInvalidKeySize
+	}
 	return hmackey, nil
 }
 
@@ -62,6 +84,10 @@ func (hm *hmacKey) ToKeyJSON() []byte {
 	return s
 }
 
+func (hm *hmacKey) secret() []byte {
+	return append([]byte(nil), hm.key...)
+}
+
 func (hm *hmacKey) KeyID() []byte {
 	if len(hm.id) != 0 {
 		return hm.id
@@ -73,16 +99,30 @@ func (hm *hmacKey) KeyID() []byte {
 }
 
 func (hm *hmacKey) Sign(msg []byte) ([]byte, error) {
-	sha1hmac := hmac.New(sha1.New, hm.key)
+	sha1hmac := hm.getHash()
 	sha1hmac.Write(msg)
 	sig := sha1hmac.Sum(nil)
+	hm.pool.Put(sha1hmac)
 	return sig, nil
 }
 
+// for an hmac the digest is the signature
+func (hm *hmacKey) newHash() hash.Hash {
+	return hm.getHash()
+}
+
+func (hm *hmacKey) SignDigest(digest []byte) ([]byte, error) {
+	return digest, nil
+}
+
+func (hm *hmacKey) VerifyDigest(digest []byte, signature []byte) (bool, error) {
+	return hmac.Equal(digest, signature), nil
+}
+
 func (hm *hmacKey) SignWriter(sink io.Writer) io.WriteCloser {
 	return &hmacSignWriter{
 		sink: sink,
-		hmac: hmac.New(sha1.New, hm.key),
+		hmac: hm.getHash(),
 	}
 }
 
@@ -117,16 +157,17 @@ func (h *hmacSignWriter) Close() error {
 }
 
 func (hm *hmacKey) Verify(msg []byte, signature []byte) (bool, error) {
-	sha1hmac := hmac.New(sha1.New, hm.key)
+	sha1hmac := hm.getHash()
 	sha1hmac.Write(msg)
 	sig := sha1hmac.Sum(nil)
+	hm.pool.Put(sha1hmac)
 	return subtle.ConstantTimeCompare(sig, signature) == 1, nil
 }
 
 func (hm *hmacKey) VerifyReader(source io.Reader) io.ReadCloser {
 	return &hmacVerifyReader{
 		source: source,
-		hmac:   hmac.New(sha1.New, hm.key),
+		hmac:   hm.getHash(),
 		buf:    bytes.NewBuffer(nil),
 		err:    nil,
 	}
@@ -162,6 +203,11 @@ func (h *hmacVerifyReader) Read(data []byte) (int, error) {
 		copy(data, realData)
 		h.hmac.Write(realData)
 	}
+	// check the signature as soon as the last of the data is handed out, so the
+	// reader consuming it gets ErrInvalidSignature rather than io.EOF for a forgery
+	if h.err == io.EOF && h.buf.Len() <= h.hmac.Size() && !hmac.Equal(h.hmac.Sum(nil), h.buf.Bytes()) {
+		h.err = ErrInvalidSignature
+	}
 	return dataSize, h.err
 }
 
@@ -0,0 +1,322 @@
+/*
+Package httpsig authenticates HTTP requests between services with dkeyczar
+signatures.  A Transport signs the requests a client sends, and a Handler
+verifies them before passing them on; the Handler can sign its responses as
+well, and the Transport verify them.  Signatures carry the key hash, so a key
+set can be rotated without coordinating the services: they only need the
+public keys of each other's versions.
+
+A signed request carries three headers:
+
+	X-Keyczar-Timestamp: 1700000000
+	X-Keyczar-Content-SHA256: <base64 SHA-256 of the body>
+	X-Keyczar-Signature: <dkeyczar signature>
+
+and the signature is over the canonical form of the request, the lines
+
+	dkeyczar-http-request-v1
+	<method>
+	<host>
+	<escaped path and query>
+	<timestamp>
+	<content digest>
+
+joined by newlines.  A signed response carries the same headers, signed over
+
+	dkeyczar-http-response-v1
+	<status code>
+	<signature of the request>
+	<timestamp>
+	<content digest>
+
+so a response can't be replayed for another request.  Timestamps are seconds
+since 1/1/1970 GMT, and must be within the window of the verifier's clock.
+
+The headers and the signature are checked before the body is read, so an
+unsigned request costs the verifier no more than its headers, and the body is
+read only up to a limit, DefaultMaxBodySize unless set otherwise.
+
+Signatures don't carry a nonce, so a signed request captured by someone else
+can be sent again, unchanged, until its timestamp leaves the window.  Send
+requests over TLS, keep the window short, and make requests that mustn't be
+repeated carry their own unique identifier for the handler to check.
+*/
+package httpsig
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/dgryski/dkeyczar"
+)
+
+// The headers of a signed request or response
+const (
+	HeaderTimestamp = "X-Keyczar-Timestamp"
+	HeaderDigest    = "X-Keyczar-Content-SHA256"
+	HeaderSignature = "X-Keyczar-Signature"
+)
+
+// DefaultWindow is how far the timestamp of a request or response may be from the verifier's clock,
+// unless set otherwise
+const DefaultWindow = 5 * time.Minute
+
+// DefaultMaxBodySize is the largest body of a request or response that is verified, unless set otherwise
+const DefaultMaxBodySize = 10 << 20
+
+var (
+	ErrUnsigned         = errors.New("httpsig: message is not signed")
+	ErrInvalidSignature = errors.New("httpsig: invalid signature")
+	ErrStale            = errors.New("httpsig: timestamp outside the window")
+	ErrDigestMismatch   = errors.New("httpsig: body doesn't match its digest")
+	ErrTooLarge         = errors.New("httpsig: body too large")
+)
+
+// read all of body, up to max bytes unless max is 0, returning it and its digest
+func readBody(body io.ReadCloser, max int64) ([]byte, string, error) {
+	var b []byte
+	if body != nil {
+		var r io.Reader = body
+		if max > 0 {
+			r = io.LimitReader(body, max+1)
+		}
+		var err error
+		b, err = ioutil.ReadAll(r)
+		body.Close()
+		if err != nil {
+			return nil, "", err
+		}
+		if max > 0 && int64(len(b)) > max {
+			return nil, "", ErrTooLarge
+		}
+	}
+	return b, digestOf(b), nil
+}
+
+func digestOf(b []byte) string {
+	d := sha256.Sum256(b)
+	return base64.StdEncoding.EncodeToString(d[:])
+}
+
+// CanonicalRequest returns the bytes signed for a request with the given timestamp and content digest
+func CanonicalRequest(req *http.Request, timestamp, digest string) []byte {
+	host := req.Host
+	if host == "" {
+		host = req.URL.Host
+	}
+	return []byte(strings.Join([]string{"dkeyczar-http-request-v1", req.Method, host, req.URL.RequestURI(), timestamp, digest}, "\n"))
+}
+
+// CanonicalResponse returns the bytes signed for a response to a request with the given signature
+func CanonicalResponse(status int, requestSignature, timestamp, digest string) []byte {
+	return []byte(strings.Join([]string{"dkeyczar-http-response-v1", strconv.Itoa(status), requestSignature, timestamp, digest}, "\n"))
+}
+
+// SignRequest signs req with signer, setting its signature headers.  The body is read and replaced.
+func SignRequest(signer dkeyczar.Signer, req *http.Request) error {
+	body, digest, err := readBody(req.Body, 0)
+	if err != nil {
+		return err
+	}
+	setBody(req, body)
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	sig, err := signer.Sign(CanonicalRequest(req, timestamp, digest))
+	if err != nil {
+		return err
+	}
+	req.Header.Set(HeaderTimestamp, timestamp)
+	req.Header.Set(HeaderDigest, digest)
+	req.Header.Set(HeaderSignature, sig)
+	return nil
+}
+
+func setBody(req *http.Request, body []byte) {
+	req.ContentLength = int64(len(body))
+	if len(body) == 0 {
+		// http.NoBody, so a client doesn't send an empty body chunked
+		req.Body = http.NoBody
+		req.GetBody = func() (io.ReadCloser, error) { return http.NoBody, nil }
+		return
+	}
+	req.Body = ioutil.NopCloser(bytes.NewReader(body))
+	req.GetBody = func() (io.ReadCloser, error) {
+		return ioutil.NopCloser(bytes.NewReader(body)), nil
+	}
+}
+
+// check the signature headers of a message are there and its timestamp is within window of now
+func checkHeaders(h http.Header, now time.Time, window time.Duration) (timestamp, digest, sig string, err error) {
+	timestamp, digest, sig = h.Get(HeaderTimestamp), h.Get(HeaderDigest), h.Get(HeaderSignature)
+	if timestamp == "" || digest == "" || sig == "" {
+		return "", "", "", ErrUnsigned
+	}
+	t, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return "", "", "", ErrInvalidSignature
+	}
+	if window == 0 {
+		window = DefaultWindow
+	}
+	if d := now.Sub(time.Unix(t, 0)); d > window || d < -window {
+		return "", "", "", ErrStale
+	}
+	return timestamp, digest, sig, nil
+}
+
+// read the body of a message whose signature verified, checking it against its signed digest
+func readSignedBody(body io.ReadCloser, digest string, max int64) ([]byte, error) {
+	if max == 0 {
+		max = DefaultMaxBodySize
+	}
+	b, d, err := readBody(body, max)
+	if err != nil {
+		return nil, err
+	}
+	if d != digest {
+		return nil, ErrDigestMismatch
+	}
+	return b, nil
+}
+
+func verify(verifier dkeyczar.Verifier, msg []byte, sig string) error {
+	ok, err := verifier.Verify(msg, sig)
+	if err != nil || !ok {
+		return ErrInvalidSignature
+	}
+	return nil
+}
+
+// VerifyRequest checks the signature of req against verifier, with a timestamp window of window, 0 for DefaultWindow.
+// Once the signature verifies, the body is read and replaced; a body over DefaultMaxBodySize fails with ErrTooLarge.
+func VerifyRequest(verifier dkeyczar.Verifier, req *http.Request, window time.Duration) error {
+	return verifyRequest(verifier, req, window, 0)
+}
+
+func verifyRequest(verifier dkeyczar.Verifier, req *http.Request, window time.Duration, maxBodySize int64) error {
+	timestamp, digest, sig, err := checkHeaders(req.Header, time.Now(), window)
+	if err != nil {
+		return err
+	}
+	if err := verify(verifier, CanonicalRequest(req, timestamp, digest), sig); err != nil {
+		return err
+	}
+	body, err := readSignedBody(req.Body, digest, maxBodySize)
+	if err != nil {
+		return err
+	}
+	setBody(req, body)
+	return nil
+}
+
+// A Handler verifies the signature of every request before passing it to Next.  Requests that
+// aren't signed, or don't verify, get a 401 Unauthorized response, and those whose body is over
+// MaxBodySize a 413 Request Entity Too Large.  If Signer is set, the responses are signed too.
+type Handler struct {
+	Verifier    dkeyczar.Verifier
+	Signer      dkeyczar.Signer // nil to leave the responses unsigned
+	Window      time.Duration   // how far request timestamps may be from the clock, 0 for DefaultWindow
+	MaxBodySize int64           // the largest request body read, 0 for DefaultMaxBodySize
+	Next        http.Handler
+}
+
+// a response held back until it can be signed
+type bufferedResponse struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (b *bufferedResponse) Header() http.Header { return b.header }
+
+func (b *bufferedResponse) Write(p []byte) (int, error) {
+	if b.status == 0 {
+		b.status = http.StatusOK
+	}
+	return b.body.Write(p)
+}
+
+func (b *bufferedResponse) WriteHeader(status int) {
+	if b.status == 0 {
+		b.status = status
+	}
+}
+
+func (h *Handler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if err := verifyRequest(h.Verifier, req, h.Window, h.MaxBodySize); err != nil {
+		status := http.StatusUnauthorized
+		if err == ErrTooLarge {
+			status = http.StatusRequestEntityTooLarge
+		}
+		http.Error(w, err.Error(), status)
+		return
+	}
+	if h.Signer == nil {
+		h.Next.ServeHTTP(w, req)
+		return
+	}
+	b := &bufferedResponse{header: w.Header()}
+	h.Next.ServeHTTP(b, req)
+	if b.status == 0 {
+		b.status = http.StatusOK
+	}
+	digest := digestOf(b.body.Bytes())
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	sig, err := h.Signer.Sign(CanonicalResponse(b.status, req.Header.Get(HeaderSignature), timestamp, digest))
+	if err != nil {
+		http.Error(w, "response signing failed", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set(HeaderTimestamp, timestamp)
+	w.Header().Set(HeaderDigest, digest)
+	w.Header().Set(HeaderSignature, sig)
+	w.WriteHeader(b.status)
+	w.Write(b.body.Bytes())
+}
+
+// A Transport is an http.RoundTripper that signs each request with Signer.  If Verifier is set,
+// it also checks the signatures of the responses, failing the request if one doesn't verify.
+type Transport struct {
+	Signer      dkeyczar.Signer
+	Verifier    dkeyczar.Verifier // nil to accept unsigned responses
+	Window      time.Duration     // how far response timestamps may be from the clock, 0 for DefaultWindow
+	MaxBodySize int64             // the largest response body read when verifying, 0 for DefaultMaxBodySize
+	Base        http.RoundTripper // the transport doing the work, nil for http.DefaultTransport
+}
+
+func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	// a RoundTripper must not modify the caller's request
+	req = req.Clone(req.Context())
+	if err := SignRequest(t.Signer, req); err != nil {
+		return nil, err
+	}
+	base := t.Base
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	resp, err := base.RoundTrip(req)
+	if err != nil || t.Verifier == nil {
+		return resp, err
+	}
+	timestamp, digest, sig, err := checkHeaders(resp.Header, time.Now(), t.Window)
+	if err == nil {
+		err = verify(t.Verifier, CanonicalResponse(resp.StatusCode, req.Header.Get(HeaderSignature), timestamp, digest), sig)
+	}
+	var body []byte
+	if err == nil {
+		body, err = readSignedBody(resp.Body, digest, t.MaxBodySize)
+	}
+	if err != nil {
+		resp.Body.Close()
+		return nil, err
+	}
+	resp.Body = ioutil.NopCloser(bytes.NewReader(body))
+	return resp, nil
+}
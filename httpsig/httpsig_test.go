@@ -0,0 +1,200 @@
+package httpsig
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dgryski/dkeyczar"
+)
+
+// a key set held by a KeyManager
+type jsonsReader []string
+
+func (r jsonsReader) GetMetadata() (string, error) {
+	return r[0], nil
+}
+
+func (r jsonsReader) GetKey(version int) (string, error) {
+	return r[version], nil
+}
+
+// the key set of km as KeyManager.ToJSONs returns it, for keys that can't fail to encrypt
+func mustJSONs(km dkeyczar.KeyManager, encrypter dkeyczar.Encrypter) []string {
+	jsons, err := km.ToJSONs(encrypter)
+	if err != nil {
+		panic(err)
+	}
+	return jsons
+}
+
+func newKeys(t *testing.T) (dkeyczar.Signer, dkeyczar.Verifier) {
+	km := dkeyczar.NewKeyManager()
+	km.Create("httpsig", dkeyczar.P_SIGN_AND_VERIFY, dkeyczar.T_ED25519_PRIV)
+	km.AddKey(0, dkeyczar.S_PRIMARY)
+	signer, err := dkeyczar.NewSigner(jsonsReader(mustJSONs(km, nil)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	verifier, err := dkeyczar.NewVerifier(jsonsReader(mustJSONs(km.PubKeys(), nil)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signer, verifier
+}
+
+func TestSignedRoundTrip(t *testing.T) {
+	clientSigner, clientVerifier := newKeys(t)
+	serverSigner, serverVerifier := newKeys(t)
+
+	server := httptest.NewServer(&Handler{
+		Verifier: clientVerifier,
+		Signer:   serverSigner,
+		Next: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			body, _ := ioutil.ReadAll(r.Body)
+			w.WriteHeader(http.StatusCreated)
+			w.Write([]byte("got " + r.URL.Query().Get("q") + " " + string(body)))
+		}),
+	})
+	defer server.Close()
+
+	client := &http.Client{Transport: &Transport{Signer: clientSigner, Verifier: serverVerifier}}
+	resp, err := client.Post(server.URL+"/items?q=a%20b", "text/plain", strings.NewReader("payload"))
+	if err != nil {
+		t.Fatal("signed request failed: " + err.Error())
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated || string(body) != "got a b payload" {
+		t.Errorf("unexpected response: %d %q", resp.StatusCode, body)
+	}
+	resp, err = client.Get(server.URL + "/items")
+	if err != nil || resp.StatusCode != http.StatusCreated {
+		t.Errorf("signed GET failed: %v", err)
+	}
+
+	// unsigned requests, and requests signed by someone else, are turned away
+	resp, err = http.Get(server.URL + "/items")
+	if err != nil || resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("expected 401 for an unsigned request, got %v %v", resp, err)
+	}
+	otherSigner, _ := newKeys(t)
+	other := &http.Client{Transport: &Transport{Signer: otherSigner}}
+	resp, err = other.Get(server.URL + "/items")
+	if err != nil || resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("expected 401 for a request signed with another key, got %v %v", resp, err)
+	}
+
+	// responses signed by someone else are rejected
+	client = &http.Client{Transport: &Transport{Signer: clientSigner, Verifier: clientVerifier}}
+	if _, err := client.Get(server.URL + "/items"); err == nil {
+		t.Error("response signed with another key was accepted")
+	}
+}
+
+func TestVerifyRequest(t *testing.T) {
+	signer, verifier := newKeys(t)
+	req := httptest.NewRequest("PUT", "http://example.com/a/b?c=d", strings.NewReader("body"))
+	if err := SignRequest(signer, req); err != nil {
+		t.Fatal("failed to sign request: " + err.Error())
+	}
+	if err := VerifyRequest(verifier, req, 0); err != nil {
+		t.Fatal("failed to verify request: " + err.Error())
+	}
+	// the body is still there for the handler
+	if b, _ := ioutil.ReadAll(req.Body); string(b) != "body" {
+		t.Errorf("request body lost: %q", b)
+	}
+
+	req.Body = ioutil.NopCloser(strings.NewReader("body"))
+	req.URL.RawQuery = "c=e"
+	if err := VerifyRequest(verifier, req, 0); err != ErrInvalidSignature {
+		t.Errorf("expected ErrInvalidSignature for a modified query, got %v", err)
+	}
+	req.URL.RawQuery = "c=d"
+	req.Body = ioutil.NopCloser(strings.NewReader("other"))
+	if err := VerifyRequest(verifier, req, 0); err != ErrDigestMismatch {
+		t.Errorf("expected ErrDigestMismatch for a modified body, got %v", err)
+	}
+	req.Body = ioutil.NopCloser(strings.NewReader("body"))
+	req.Header.Set(HeaderTimestamp, strconv.FormatInt(time.Now().Add(-time.Hour).Unix(), 10))
+	if err := VerifyRequest(verifier, req, 0); err != ErrStale {
+		t.Errorf("expected ErrStale for an old request, got %v", err)
+	}
+	req.Header.Del(HeaderSignature)
+	if err := VerifyRequest(verifier, req, 0); err != ErrUnsigned {
+		t.Errorf("expected ErrUnsigned for an unsigned request, got %v", err)
+	}
+}
+
+// a body that records whether it was read
+type watchedBody struct {
+	*strings.Reader
+	read bool
+}
+
+func (b *watchedBody) Read(p []byte) (int, error) {
+	b.read = true
+	return b.Reader.Read(p)
+}
+
+func (b *watchedBody) Close() error { return nil }
+
+func TestBodyLimits(t *testing.T) {
+	signer, verifier := newKeys(t)
+
+	// the body of a request that doesn't verify isn't read
+	body := &watchedBody{Reader: strings.NewReader("body")}
+	req := httptest.NewRequest("POST", "http://example.com/", body)
+	if err := VerifyRequest(verifier, req, 0); err != ErrUnsigned || body.read {
+		t.Errorf("unsigned request: got %v, body read %v", err, body.read)
+	}
+	req = httptest.NewRequest("POST", "http://example.com/", strings.NewReader("body"))
+	SignRequest(signer, req)
+	body = &watchedBody{Reader: strings.NewReader("body")}
+	req.Body = body
+	req.Header.Set(HeaderSignature, req.Header.Get(HeaderSignature)[:10])
+	if err := VerifyRequest(verifier, req, 0); err != ErrInvalidSignature || body.read {
+		t.Errorf("badly signed request: got %v, body read %v", err, body.read)
+	}
+
+	handler := &Handler{
+		Verifier:    verifier,
+		MaxBodySize: 8,
+		Next: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(strings.Repeat("x", 16)))
+		}),
+	}
+	for _, tt := range []struct {
+		body   string
+		status int
+	}{
+		{"12345678", http.StatusOK},
+		{"123456789", http.StatusRequestEntityTooLarge},
+	} {
+		req := httptest.NewRequest("POST", "http://example.com/", strings.NewReader(tt.body))
+		SignRequest(signer, req)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		if w.Code != tt.status {
+			t.Errorf("body of %d bytes: got status %d, want %d", len(tt.body), w.Code, tt.status)
+		}
+	}
+
+	serverSigner, serverVerifier := newKeys(t)
+	handler.Signer = serverSigner
+	server := httptest.NewServer(handler)
+	defer server.Close()
+	client := &http.Client{Transport: &Transport{Signer: signer, Verifier: serverVerifier, MaxBodySize: 8}}
+	if _, err := client.Get(server.URL); err == nil || !strings.Contains(err.Error(), ErrTooLarge.Error()) {
+		t.Errorf("response over MaxBodySize: got %v", err)
+	}
+	client.Transport.(*Transport).MaxBodySize = 0
+	if resp, err := client.Get(server.URL); err != nil || resp.StatusCode != http.StatusOK {
+		t.Errorf("response under DefaultMaxBodySize: got %v", err)
+	}
+}
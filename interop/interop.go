@@ -0,0 +1,439 @@
+/*
+Package interop generates and checks a corpus of key sets, ciphertexts and
+signatures in the layout of the keyczar interoperability test data, as written
+and read by the Java, Python and C# keyczar interop tools:
+
+	<dir>/<case>/meta, 1, 2, ...   the key set
+	<dir>/<case>/1.out, 2.out      the input encrypted or signed by key version 1 and 2
+	<dir>/<case>/128.out, ...      the input encrypted or signed by the key of that size, for the -size cases
+	<dir>/<case>/2.unversioned     an unversioned signature
+	<dir>/<case>/2.attached        an attached signature with no nonce
+	<dir>/<case>/2.timeout         a timeout signature expiring at TimeoutExpiration
+	<dir>/<case>/2.session.material and 2.session.ciphertext
+	<dir>/<case>/2.signedsession.material and 2.signedsession.ciphertext, signed by the dsa case
+
+A corpus generated here can be checked by the other implementations, and theirs with Check,
+so key rotations done from Go can be trusted by them, and the other way round.
+*/
+package interop
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/dgryski/dkeyczar"
+)
+
+// Input is the plaintext every output of the corpus encrypts or signs
+const Input = "This is some test data"
+
+// TimeoutExpiration is when the timeout signatures expire: Fri, 21 Dec 2012 11:11:00 GMT, in milliseconds
+const TimeoutExpiration = int64(1356088260000)
+
+// Check verifies timeout signatures as of five minutes before TimeoutExpiration,
+// when those of the other implementations haven't expired either
+const timeoutCheckTime = TimeoutExpiration - 5*60*1000
+
+// a key set of the corpus
+type corpusCase struct {
+	name    string
+	purpose dkeyczar.KeyPurpose
+	ktype   dkeyczar.KeyType
+	size    uint   // the size of the keys of versions 1 and 2, 0 for the default
+	sizes   []uint // for the -size cases, one key version of each size instead
+}
+
+// the cases generated, in order: dsa signs the signed sessions of rsa
+var cases = []corpusCase{
+	{name: "aes", purpose: dkeyczar.P_DECRYPT_AND_ENCRYPT, ktype: dkeyczar.T_AES},
+	{name: "aes-size", purpose: dkeyczar.P_DECRYPT_AND_ENCRYPT, ktype: dkeyczar.T_AES, sizes: []uint{128, 192, 256}},
+	{name: "hmac", purpose: dkeyczar.P_SIGN_AND_VERIFY, ktype: dkeyczar.T_HMAC_SHA1},
+	{name: "dsa", purpose: dkeyczar.P_SIGN_AND_VERIFY, ktype: dkeyczar.T_DSA_PRIV},
+	{name: "rsa", purpose: dkeyczar.P_DECRYPT_AND_ENCRYPT, ktype: dkeyczar.T_RSA_PRIV, size: 2048},
+	{name: "rsa-sign", purpose: dkeyczar.P_SIGN_AND_VERIFY, ktype: dkeyczar.T_RSA_PRIV, size: 2048},
+	{name: "rsa-size", purpose: dkeyczar.P_DECRYPT_AND_ENCRYPT, ktype: dkeyczar.T_RSA_PRIV, sizes: []uint{1024, 2048, 4096}},
+}
+
+// Cases returns the names of the cases Generate writes
+func Cases() []string {
+	var names []string
+	for _, c := range cases {
+		names = append(names, c.name)
+	}
+	return names
+}
+
+// Generate writes the named cases of the corpus into dir, all of them if names is empty.
+// Existing key sets and outputs of those cases are overwritten.
+func Generate(dir string, names ...string) error {
+	for _, name := range names {
+		if !selected(name, Cases()) {
+			return fmt.Errorf("%s: no such case", name)
+		}
+	}
+	for _, c := range cases {
+		if !selected(c.name, names) {
+			continue
+		}
+		if err := c.generate(dir); err != nil {
+			return fmt.Errorf("%s: %s", c.name, err)
+		}
+	}
+	return nil
+}
+
+func selected(name string, names []string) bool {
+	if len(names) == 0 {
+		return true
+	}
+	for _, n := range names {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
+
+func (c corpusCase) generate(dir string) error {
+	path := filepath.Join(dir, c.name)
+	if err := os.MkdirAll(path, 0700); err != nil {
+		return err
+	}
+	km := dkeyczar.NewKeyManager()
+	if err := km.Create(c.name, c.purpose, c.ktype); err != nil {
+		return err
+	}
+	if c.sizes != nil {
+		for _, size := range c.sizes {
+			if err := c.addVersion(km, path, size, strconv.Itoa(int(size))+".out"); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	for v := 1; v <= 2; v++ {
+		if err := c.addVersion(km, path, c.size, strconv.Itoa(v)+".out"); err != nil {
+			return err
+		}
+	}
+	r := dkeyczar.NewFileReader(path)
+	switch {
+	case c.purpose == dkeyczar.P_SIGN_AND_VERIFY:
+		return writeSignatures(r, path)
+	case c.ktype == dkeyczar.T_RSA_PRIV:
+		// session keys are encrypted with public keys
+		return writeSessions(r, path, filepath.Join(dir, "dsa"))
+	}
+	return nil
+}
+
+// add a primary key of size to the key set, save it, and write the input encrypted or signed by it to out
+func (c corpusCase) addVersion(km dkeyczar.KeyManager, path string, size uint, out string) error {
+	if err := km.AddKey(size, dkeyczar.S_PRIMARY); err != nil {
+		return err
+	}
+	if err := save(path, km); err != nil {
+		return err
+	}
+	r := dkeyczar.NewFileReader(path)
+	var s string
+	if c.purpose == dkeyczar.P_SIGN_AND_VERIFY {
+		signer, err := dkeyczar.NewSigner(r)
+		if err != nil {
+			return err
+		}
+		if s, err = signer.Sign([]byte(Input)); err != nil {
+			return err
+		}
+	} else {
+		crypter, err := dkeyczar.NewCrypter(r)
+		if err != nil {
+			return err
+		}
+		if s, err = crypter.Encrypt([]byte(Input)); err != nil {
+			return err
+		}
+	}
+	return write(path, out, s)
+}
+
+func writeSignatures(r dkeyczar.KeyReader, path string) error {
+	signer, err := dkeyczar.NewSigner(r)
+	if err != nil {
+		return err
+	}
+	outputs := []struct {
+		file string
+		sign func() (string, error)
+	}{
+		{"2.unversioned", func() (string, error) { return signer.UnversionedSign([]byte(Input)) }},
+		{"2.attached", func() (string, error) { return signer.AttachedSign([]byte(Input), nil) }},
+		{"2.timeout", func() (string, error) { return signer.TimeoutSign([]byte(Input), TimeoutExpiration) }},
+	}
+	for _, o := range outputs {
+		s, err := o.sign()
+		if err != nil {
+			return fmt.Errorf("%s: %s", o.file, err)
+		}
+		if err := write(path, o.file, s); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// write the session outputs, and the signed session ones if the key set at signerPath exists
+func writeSessions(r dkeyczar.KeyReader, path string, signerPath string) error {
+	encrypter, err := dkeyczar.NewEncrypter(r)
+	if err != nil {
+		return err
+	}
+	se, material, err := dkeyczar.NewSessionEncrypter(encrypter)
+	if err != nil {
+		return err
+	}
+	ciphertext, err := se.Encrypt([]byte(Input))
+	if err != nil {
+		return err
+	}
+	if err := writeMaterial(path, "2.session", material, ciphertext); err != nil {
+		return err
+	}
+	if _, err := os.Stat(filepath.Join(signerPath, "meta")); err != nil {
+		return nil
+	}
+	signer, err := dkeyczar.NewSigner(dkeyczar.NewFileReader(signerPath))
+	if err != nil {
+		return err
+	}
+	sse, material, err := dkeyczar.NewSignedSessionEncrypter(encrypter, signer)
+	if err != nil {
+		return err
+	}
+	ciphertext, err = sse.Encrypt([]byte(Input))
+	if err != nil {
+		return err
+	}
+	return writeMaterial(path, "2.signedsession", material, ciphertext)
+}
+
+func writeMaterial(path, name, material, ciphertext string) error {
+	if err := write(path, name+".material", material); err != nil {
+		return err
+	}
+	return write(path, name+".ciphertext", ciphertext)
+}
+
+// save the key set of km into path, as keyczart does
+func save(path string, km dkeyczar.KeyManager) error {
+	s, err := km.ToJSONs(nil)
+	if err != nil {
+		return err
+	}
+	if err := write(path, "meta", s[0]); err != nil {
+		return err
+	}
+	for i := 1; i < len(s); i++ {
+		if err := write(path, strconv.Itoa(i), s[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func write(path, name, s string) error {
+	return ioutil.WriteFile(filepath.Join(path, name), []byte(s), 0600)
+}
+
+// Result is the outcome of checking one output of the corpus
+type Result struct {
+	Case string // the case, e.g. "aes"
+	File string // the output checked, e.g. "2.out"
+	Err  error  // nil if the output decrypted or verified to Input
+}
+
+func (r Result) String() string {
+	if r.Err != nil {
+		return "FAIL " + r.Case + "/" + r.File + ": " + r.Err.Error()
+	}
+	return "ok " + r.Case + "/" + r.File
+}
+
+// Failed returns the results that failed
+func Failed(results []Result) []Result {
+	var failed []Result
+	for _, r := range results {
+		if r.Err != nil {
+			failed = append(failed, r)
+		}
+	}
+	return failed
+}
+
+// Check decrypts or verifies every output of the named cases in dir, all of the cases found if names is empty.
+// The outputs are found by their names, so corpora with only some of them, as
+// written by older implementations, can be checked too.
+func Check(dir string, names ...string) ([]Result, error) {
+	if len(names) == 0 {
+		entries, err := ioutil.ReadDir(dir)
+		if err != nil {
+			return nil, err
+		}
+		for _, e := range entries {
+			if _, err := os.Stat(filepath.Join(dir, e.Name(), "meta")); e.IsDir() && err == nil {
+				names = append(names, e.Name())
+			}
+		}
+	}
+	var results []Result
+	for _, name := range names {
+		rs, err := checkCase(dir, name)
+		if err != nil {
+			return results, fmt.Errorf("%s: %s", name, err)
+		}
+		results = append(results, rs...)
+	}
+	return results, nil
+}
+
+func checkCase(dir, name string) ([]Result, error) {
+	path := filepath.Join(dir, name)
+	r := dkeyczar.NewFileReader(path)
+	meta, err := dkeyczar.GetKeyMeta(r)
+	if err != nil {
+		return nil, err
+	}
+	entries, err := ioutil.ReadDir(path)
+	if err != nil {
+		return nil, err
+	}
+	var files []string
+	for _, e := range entries {
+		files = append(files, e.Name())
+	}
+	sort.Strings(files)
+
+	var check func(file, s string) error
+	switch meta.Purpose {
+	case dkeyczar.P_DECRYPT_AND_ENCRYPT:
+		crypter, err := dkeyczar.NewCrypter(r)
+		if err != nil {
+			return nil, err
+		}
+		check = func(file, s string) error { return checkCrypt(crypter, path, filepath.Join(dir, "dsa"), file, s) }
+	case dkeyczar.P_SIGN_AND_VERIFY, dkeyczar.P_VERIFY:
+		verifier, err := dkeyczar.NewVerifierTimeProvider(r, func() int64 { return timeoutCheckTime })
+		if err != nil {
+			return nil, err
+		}
+		check = func(file, s string) error { return checkSign(verifier, file, s) }
+	default:
+		return nil, dkeyczar.ErrUnacceptablePurpose
+	}
+
+	var results []Result
+	for _, file := range files {
+		if file == "meta" || strings.HasSuffix(file, ".ciphertext") {
+			continue
+		}
+		if _, err := strconv.Atoi(file); err == nil {
+			continue // a key
+		}
+		b, err := ioutil.ReadFile(filepath.Join(path, file))
+		if err == nil {
+			err = check(file, strings.TrimSpace(string(b)))
+		}
+		if err != errUnknownOutput {
+			results = append(results, Result{Case: name, File: file, Err: err})
+		}
+	}
+	return results, nil
+}
+
+var errUnknownOutput = errors.New("interop: unknown output")
+
+var errMismatch = errors.New("interop: output doesn't match the input")
+
+func checkCrypt(crypter dkeyczar.Crypter, path, signerPath, file, s string) error {
+	var p []byte
+	var err error
+	switch {
+	case strings.HasSuffix(file, ".out"):
+		p, err = crypter.Decrypt(s)
+	case strings.HasSuffix(file, ".signedsession.material"):
+		p, err = decryptSession(path, file, func() (decrypter, error) {
+			verifier, err := dkeyczar.NewVerifier(dkeyczar.NewFileReader(signerPath))
+			if err != nil {
+				return nil, err
+			}
+			return dkeyczar.NewSignedSessionDecrypter(crypter, verifier, s)
+		})
+	case strings.HasSuffix(file, ".session.material"):
+		p, err = decryptSession(path, file, func() (decrypter, error) {
+			return dkeyczar.NewSessionDecrypter(crypter, s)
+		})
+	default:
+		return errUnknownOutput
+	}
+	if err != nil {
+		return err
+	}
+	if string(p) != Input {
+		return errMismatch
+	}
+	return nil
+}
+
+type decrypter interface {
+	Decrypt(ciphertext string) ([]byte, error)
+}
+
+// decrypt the ciphertext file going with the session material file
+func decryptSession(path, material string, session func() (decrypter, error)) ([]byte, error) {
+	c, err := ioutil.ReadFile(filepath.Join(path, strings.TrimSuffix(material, ".material")+".ciphertext"))
+	if err != nil {
+		return nil, err
+	}
+	d, err := session()
+	if err != nil {
+		return nil, err
+	}
+	return d.Decrypt(strings.TrimSpace(string(c)))
+}
+
+func checkSign(verifier dkeyczar.Verifier, file, s string) error {
+	var ok bool
+	var err error
+	switch {
+	case strings.HasSuffix(file, ".out"):
+		ok, err = verifier.Verify([]byte(Input), s)
+	case strings.HasSuffix(file, ".unversioned"):
+		ok, err = verifier.UnversionedVerify([]byte(Input), s)
+	case strings.HasSuffix(file, ".timeout"):
+		ok, err = verifier.TimeoutVerify([]byte(Input), s)
+	case strings.HasSuffix(file, ".attached"):
+		// 2.attached has no nonce, 2.secret.attached has the nonce "secret"
+		var nonce []byte
+		if parts := strings.Split(file, "."); len(parts) == 3 {
+			nonce = []byte(parts[1])
+		}
+		var msg []byte
+		msg, err = verifier.AttachedVerify(s, nonce)
+		ok = string(msg) == Input
+	default:
+		return errUnknownOutput
+	}
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return dkeyczar.ErrInvalidSignature
+	}
+	return nil
+}
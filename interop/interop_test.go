@@ -0,0 +1,52 @@
+package interop
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestGenerateCheck(t *testing.T) {
+	dir, err := ioutil.TempDir("", "interop")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	if err := Generate(dir, "aes", "hmac", "dsa", "rsa"); err != nil {
+		t.Fatal(err)
+	}
+	results, err := Check(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checked := make(map[string]bool)
+	for _, r := range results {
+		if r.Err != nil {
+			t.Error(r)
+		}
+		checked[r.Case+"/"+r.File] = true
+	}
+	for _, f := range []string{"aes/1.out", "aes/2.out", "hmac/2.attached", "hmac/2.timeout", "dsa/2.unversioned", "rsa/2.session.material", "rsa/2.signedsession.material"} {
+		if !checked[f] {
+			t.Errorf("%s wasn't checked", f)
+		}
+	}
+
+	// a corrupted output fails, and the rest still pass
+	if err := ioutil.WriteFile(filepath.Join(dir, "aes", "1.out"), []byte("AAAA"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	results, err = Check(dir, "aes")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if failed := Failed(results); len(failed) != 1 || failed[0].File != "1.out" {
+		t.Errorf("corrupted output: got failures %v", failed)
+	}
+
+	if err := Generate(dir, "nosuchcase"); err == nil {
+		t.Error("generated an unknown case")
+	}
+}
@@ -313,6 +313,43 @@ func TestAESInteropDecryptSizes(t *testing.T) {
 	testInteropDecryptSizes(t, "aes", []string{"128", "192", "256"})
 }
 
+// the 256-bit keys of the other implementations work for encryption too, and
+// stay usable when a strict KeyManager adds keys to their key sets
+func TestAESInteropEncrypt256(t *testing.T) {
+	for _, lang := range INTEROP_LANGS {
+		path := testPath(lang, "aes") + "-size"
+		km := NewKeyManager(WithStrictKeyPolicy())
+		if err := km.Load(NewFileReader(path)); err != nil {
+			t.Error("failed to load key set " + path + ": " + err.Error())
+			continue
+		}
+		if err := km.AddKey(0, S_ACTIVE); err != nil {
+			t.Error("failed to add key to " + path + ": " + err.Error())
+			continue
+		}
+		kz, err := NewCrypter(keyManagerReader(mustJSONs(km, nil)))
+		if err != nil {
+			t.Error("failed to create crypter for " + path + ": " + err.Error())
+			continue
+		}
+		kc := kz.(*keyCrypter)
+		for v, k := range kc.kz.keys {
+			if keySize(k) != 256 {
+				continue
+			}
+			c, err := kc.EncryptWithVersion(v, []byte(INTEROP_INPUT))
+			if err != nil {
+				t.Error("failed encrypt for " + path + ": " + err.Error())
+				continue
+			}
+			p, err := kz.Decrypt(c)
+			if err != nil || string(p) != INTEROP_INPUT {
+				t.Error("round trip failed for " + path)
+			}
+		}
+	}
+}
+
 func TestRSAInteropDecrypt(t *testing.T) {
 	testInteropDecrypt(t, "rsa")
 }
@@ -0,0 +1,101 @@
+package dkeyczar
+
+import (
+	"container/list"
+	"sync"
+)
+
+// IV reuse detection is a safety net for testing and staging: an Encrypter
+// remembers the IVs (or nonces) of its recent encryptions with each key and
+// notices when one comes round again.  With a working random source that
+// never happens, so a reuse means a broken RNG or a deterministic seed left
+// in place, which would be catastrophic for CBC and ChaCha20-Poly1305 in
+// production.  Encrypt, EncryptWithVersion and the batch encryptions are
+// checked; streams are not.
+
+// An IVReuseHandler is told about a reused IV: the version of the key that reused it, and the IV itself
+type IVReuseHandler func(version int, iv []byte)
+
+type IVReuseController interface {
+	// Remember the IVs of the last size encryptions with each key, 0 to stop.  A reused IV is passed to handler,
+	// or, if handler is nil, fails the encryption with ErrIVReused so the ciphertext is never seen.
+	SetIVReuseDetection(size int, handler IVReuseHandler)
+}
+
+// the recent IVs of one key, most recent first
+type ivHistory struct {
+	order *list.List
+	seen  map[string]*list.Element
+}
+
+type ivTracker struct {
+	mu      sync.Mutex
+	size    int
+	handler IVReuseHandler
+	keys    map[string]*ivHistory // key id -> IVs
+}
+
+// record iv for the key with the given id, and return whether it was seen before
+func (t *ivTracker) add(id []byte, iv []byte) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	h, ok := t.keys[string(id)]
+	if !ok {
+		h = &ivHistory{order: list.New(), seen: make(map[string]*list.Element)}
+		t.keys[string(id)] = h
+	}
+	if e, ok := h.seen[string(iv)]; ok {
+		h.order.MoveToFront(e)
+		return true
+	}
+	h.seen[string(iv)] = h.order.PushFront(string(iv))
+	if h.order.Len() > t.size {
+		delete(h.seen, h.order.Remove(h.order.Back()).(string))
+	}
+	return false
+}
+
+type ivReuseController struct {
+	tracker *ivTracker
+}
+
+// SetIVReuseDetection makes the keyczar object remember the IVs of its last size encryptions with each key,
+// calling handler (or failing with ErrIVReused if it is nil) on a reuse.  A size of 0 turns detection off.
+// Set it before sharing the object between goroutines.
+func (ic *ivReuseController) SetIVReuseDetection(size int, handler IVReuseHandler) {
+	if size <= 0 {
+		ic.tracker = nil
+		return
+	}
+	ic.tracker = &ivTracker{size: size, handler: handler, keys: make(map[string]*ivHistory)}
+}
+
+// check the IV of a ciphertext just made with key k of kz
+func (ic ivReuseController) checkIV(kz *keyCzar, k keydata, ciphertext []byte) error {
+	if ic.tracker == nil {
+		return nil
+	}
+	ik, ok := k.(ivKey)
+	if !ok {
+		return nil
+	}
+	iv := ik.iv(ciphertext)
+	if !ic.tracker.add(k.KeyID(), iv) {
+		return nil
+	}
+	if ic.tracker.handler == nil {
+		return ErrIVReused
+	}
+	ic.tracker.handler(kz.keyInfo(k).Version, append([]byte(nil), iv...))
+	return nil
+}
+
+// WithIVReuseDetection makes a Crypter or Encrypter remember the IVs of its last size encryptions with each key,
+// calling handler on a reuse, or failing the encryption with ErrIVReused if handler is nil
+func WithIVReuseDetection(size int, handler IVReuseHandler) Option {
+	return func(x interface{}) {
+		if ic, ok := x.(IVReuseController); ok {
+			ic.SetIVReuseDetection(size, handler)
+		}
+	}
+}
@@ -0,0 +1,175 @@
+package dkeyczar
+
+import (
+	"bytes"
+	"encoding/json"
+	"sort"
+)
+
+// a whole key set in one JSON document:
+// {"meta": {...}, "keys": {"1": {...}, "2": {...}}}
+// Keys are embedded as JSON when they are JSON, and as strings otherwise, e.g. when encrypted.
+type jsonKeySet struct {
+	Meta json.RawMessage         `json:"meta"`
+	Keys map[int]json.RawMessage `json:"keys"`
+}
+
+// a key set held in memory
+type memReader struct {
+	meta string         // the meta json
+	keys map[int]string // the key json, or ciphertext, for each version
+}
+
+// NewJSONReader returns a KeyReader for a key set bundled into a single JSON document by ExportJSON.
+// A bundle of an encrypted key set is read with NewEncryptedReader or NewPBEReader around it, as usual.
+func NewJSONReader(data []byte) (KeyReader, error) {
+	var ks jsonKeySet
+	if err := json.Unmarshal(data, &ks); err != nil {
+		return nil, err
+	}
+	if len(ks.Meta) == 0 || ks.Meta[0] != '{' {
+		return nil, ErrMalformedJSONKeySet
+	}
+	r := &memReader{meta: string(ks.Meta), keys: make(map[int]string)}
+	for v, raw := range ks.Keys {
+		var s string
+		if raw[0] == '"' {
+			if err := json.Unmarshal(raw, &s); err != nil {
+				return nil, err
+			}
+		} else {
+			s = string(raw)
+		}
+		r.keys[v] = s
+	}
+	return r, nil
+}
+
+func (r *memReader) GetMetadata() (string, error) {
+	return r.meta, nil
+}
+
+func (r *memReader) GetKey(version int) (string, error) {
+	s, ok := r.keys[version]
+	if !ok {
+		return "", ErrNoSuchKeyVersion
+	}
+	return s, nil
+}
+
+// ExportJSON reads the whole key set from reader and bundles it into a single JSON document for NewJSONReader.
+// Keys are copied as they are read, so wrap reader with NewEncryptedReader only to export the keys decrypted;
+// the metadata of the export then says they aren't encrypted.
+func ExportJSON(reader KeyReader) ([]byte, error) {
+	r, err := readKeySet(reader)
+	if err != nil {
+		return nil, err
+	}
+	ks := jsonKeySet{Meta: compactJSON(r.meta), Keys: make(map[int]json.RawMessage)}
+	for v, s := range r.keys {
+		if raw := compactJSON(s); raw != nil {
+			ks.Keys[v] = raw
+		} else {
+			ks.Keys[v], _ = json.Marshal(s)
+		}
+	}
+	return json.Marshal(ks)
+}
+
+// SealKeyset loads the key set from reader, checking that it parses, and returns
+// it as an opaque bundle encrypted by encrypter, to hand to other processes.
+// The keys are bundled decrypted, so wrap reader with NewEncryptedReader to seal
+// an encrypted key set.  Opaque keys, e.g. in an HSM, can't be sealed.
+func SealKeyset(reader KeyReader, encrypter Encrypter) ([]byte, error) {
+	if _, ok := reader.(opaqueKeyReader); ok {
+		return nil, ErrOpaqueKey
+	}
+	kz, err := newKeyCzar(reader)
+	if err != nil {
+		return nil, err
+	}
+	defer kz.wipe()
+	meta := kz.keymeta
+	meta.Encrypted = false
+	mb, err := json.Marshal(meta)
+	if err != nil {
+		return nil, err
+	}
+	ks := jsonKeySet{Meta: mb, Keys: make(map[int]json.RawMessage)}
+	for v, k := range kz.keys {
+		ks.Keys[v] = k.ToKeyJSON()
+	}
+	b, err := json.Marshal(ks)
+	if err != nil {
+		return nil, err
+	}
+	defer wipeBytes(b)
+	for _, k := range ks.Keys {
+		wipeBytes(k)
+	}
+	s, err := encrypter.Encrypt(b)
+	if err != nil {
+		return nil, err
+	}
+	return []byte(s), nil
+}
+
+// OpenKeyset returns a KeyReader for a bundle made by SealKeyset, decrypted by crypter.
+// crypter must use the same encoding as the encrypter that sealed it.
+func OpenKeyset(bundle []byte, crypter Crypter) (KeyReader, error) {
+	b, err := crypter.Decrypt(string(bundle))
+	if err != nil {
+		return nil, err
+	}
+	defer wipeBytes(b)
+	return NewJSONReader(b)
+}
+
+// the key versions held, in order
+func (r *memReader) versions() []int {
+	var versions []int
+	for v := range r.keys {
+		versions = append(versions, v)
+	}
+	sort.Ints(versions)
+	return versions
+}
+
+// read the metadata and every key version listed in it into memory
+func readKeySet(reader KeyReader) (*memReader, error) {
+	meta, err := reader.GetMetadata()
+	if err != nil {
+		return nil, err
+	}
+	var km KeyMeta
+	if err := json.Unmarshal([]byte(meta), &km); err != nil {
+		return nil, err
+	}
+	if km.Encrypted && decryptsKeys(reader) {
+		// the copies are decrypted
+		km.Encrypted = false
+		b, err := json.Marshal(km)
+		if err != nil {
+			return nil, err
+		}
+		meta = string(b)
+	}
+	r := &memReader{meta: meta, keys: make(map[int]string)}
+	for _, kv := range km.Versions {
+		s, err := reader.GetKey(kv.VersionNumber)
+		if err != nil {
+			return nil, &KeyNotFoundError{Version: kv.VersionNumber, Err: err}
+		}
+		r.keys[kv.VersionNumber] = s
+	}
+	return r, nil
+}
+
+// return s compacted if it is a JSON object, or nil
+func compactJSON(s string) json.RawMessage {
+	var buf bytes.Buffer
+	if err := json.Compact(&buf, []byte(s)); err != nil || buf.Len() == 0 || buf.Bytes()[0] != '{' {
+		return nil
+	}
+	return buf.Bytes()
+}
@@ -0,0 +1,216 @@
+package dkeyczar
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"strings"
+)
+
+// JSON Web Encryption (RFC 7516) compact serialization with the keys of an
+// RSA key set.  The content encryption key is wrapped with RSA-OAEP, the same
+// OAEP with SHA-1 that keyczar uses, and the content encrypted with
+// A128CBC-HS256 or A256GCM.  As with JWTs, the "kid" header is the web-safe
+// base64 encoding of the keyczar key hash.
+
+// The JWE content encryption algorithms supported by EncryptJWE
+const (
+	JWE_A128CBC_HS256 = "A128CBC-HS256"
+	JWE_A256GCM       = "A256GCM"
+)
+
+type jweHeader struct {
+	Alg string `json:"alg"`
+	Enc string `json:"enc"`
+	Kid string `json:"kid,omitempty"`
+}
+
+// return the key set of an Encrypter or Crypter made by NewEncrypter or NewCrypter
+func jweKeyCzar(x interface{}) *keyCzar {
+	switch x := x.(type) {
+	case *keyEncrypter:
+		return x.kz
+	case *keyCrypter:
+		return x.kz
+	}
+	return nil
+}
+
+// return the content encryption key size of enc, or 0 if it isn't supported
+func jweKeySize(enc string) int {
+	switch enc {
+	case JWE_A128CBC_HS256, JWE_A256GCM:
+		return 32
+	}
+	return 0
+}
+
+// the A128CBC-HS256 authentication tag: the first half of an HMAC-SHA256 over
+// the additional data, IV, ciphertext and the bit length of the additional data
+func jweCBCTag(macKey, aad, iv, ciphertext []byte) []byte {
+	mac := hmac.New(sha256.New, macKey)
+	mac.Write(aad)
+	mac.Write(iv)
+	mac.Write(ciphertext)
+	var al [8]byte
+	binary.BigEndian.PutUint64(al[:], uint64(len(aad))*8)
+	mac.Write(al[:])
+	return mac.Sum(nil)[:16]
+}
+
+// EncryptJWE returns the plaintext encrypted as a compact serialized JWE for the encrypter's primary key,
+// with the content encryption algorithm enc, JWE_A128CBC_HS256 or JWE_A256GCM.
+// The encrypter must have been created by NewEncrypter or NewCrypter from an RSA key set.
+func EncryptJWE(encrypter Encrypter, plaintext []byte, enc string) (string, error) {
+	kz := jweKeyCzar(encrypter)
+	if kz == nil || jweKeySize(enc) == 0 {
+		return "", ErrUnsupportedType
+	}
+	key, err := kz.primaryKey()
+	if err != nil {
+		return "", err
+	}
+	var pub *rsa.PublicKey
+	switch k := key.(type) {
+	case *rsaKey:
+		pub = &k.publicKey.key
+	case *rsaPublicKey:
+		pub = &k.key
+	default:
+		return "", ErrUnsupportedType
+	}
+	h, err := json.Marshal(jweHeader{"RSA-OAEP", enc, encodeWeb64String(key.KeyID())})
+	if err != nil {
+		return "", err
+	}
+	aad := []byte(encodeWeb64String(h))
+
+	rng := kz.random()
+	cek := make([]byte, jweKeySize(enc))
+	if _, err := io.ReadFull(rng, cek); err != nil {
+		return "", err
+	}
+	defer wipeBytes(cek)
+	encryptedKey, err := rsa.EncryptOAEP(sha1.New(), rng, pub, cek, nil)
+	if err != nil {
+		return "", err
+	}
+
+	var iv, ciphertext, tag []byte
+	switch enc {
+	case JWE_A128CBC_HS256:
+		iv = make([]byte, aes.BlockSize)
+		if _, err := io.ReadFull(rng, iv); err != nil {
+			return "", err
+		}
+		block, _ := aes.NewCipher(cek[16:])
+		ciphertext = pkcs5pad(append([]byte(nil), plaintext...), aes.BlockSize)
+		cipher.NewCBCEncrypter(block, iv).CryptBlocks(ciphertext, ciphertext)
+		tag = jweCBCTag(cek[:16], aad, iv, ciphertext)
+	case JWE_A256GCM:
+		block, _ := aes.NewCipher(cek)
+		gcm, _ := cipher.NewGCM(block)
+		iv = make([]byte, gcm.NonceSize())
+		if _, err := io.ReadFull(rng, iv); err != nil {
+			return "", err
+		}
+		sealed := gcm.Seal(nil, iv, plaintext, aad)
+		ciphertext, tag = sealed[:len(plaintext)], sealed[len(plaintext):]
+	}
+	return string(aad) + "." + encodeWeb64String(encryptedKey) + "." + encodeWeb64String(iv) + "." +
+		encodeWeb64String(ciphertext) + "." + encodeWeb64String(tag), nil
+}
+
+// DecryptJWE returns the plaintext of a compact serialized JWE made with RSA-OAEP and A128CBC-HS256 or A256GCM.
+// The crypter must have been created by NewCrypter from an RSA key set; the key is selected with the "kid"
+// header if present.  A JWE that doesn't decrypt fails with ErrInvalidSignature, whichever part was wrong.
+func DecryptJWE(crypter Crypter, token string) ([]byte, error) {
+	kc, ok := crypter.(*keyCrypter)
+	if !ok {
+		return nil, ErrUnsupportedType
+	}
+	parts := strings.Split(token, ".")
+	if len(parts) != 5 {
+		return nil, ErrMalformedJWE
+	}
+	var fields [5][]byte
+	for i, p := range parts {
+		b, err := decodeWeb64String(p)
+		if err != nil {
+			return nil, ErrBase64Decoding
+		}
+		fields[i] = b
+	}
+	var h jweHeader
+	if err := json.Unmarshal(fields[0], &h); err != nil {
+		return nil, ErrMalformedJWE
+	}
+	size := jweKeySize(h.Enc)
+	if h.Alg != "RSA-OAEP" || size == 0 {
+		return nil, ErrUnsupportedType
+	}
+	encryptedKey, iv, ciphertext, tag := fields[1], fields[2], fields[3], fields[4]
+	aad := []byte(parts[0])
+
+	var kl []keydata
+	if h.Kid != "" {
+		id, err := decodeWeb64String(h.Kid)
+		if err != nil || len(id) != 4 {
+			return nil, ErrKeyNotFound
+		}
+		if kl, err = kc.kz.getKeyForID(id); err != nil {
+			return nil, err
+		}
+	} else {
+		kl = kc.kz.allKeys()
+	}
+	for _, k := range kl {
+		rk, ok := k.(*rsaKey)
+		if !ok {
+			continue
+		}
+		cek, err := rsa.DecryptOAEP(sha1.New(), rk.random(), &rk.key, encryptedKey, nil)
+		if err != nil || len(cek) != size {
+			// go on with a random key, so a bad key fails the same way as a bad tag (RFC 7516 section 11.5)
+			cek = make([]byte, size)
+			if _, err := io.ReadFull(kc.kz.random(), cek); err != nil {
+				return nil, err
+			}
+		}
+		plaintext, err := jweDecryptContent(h.Enc, cek, aad, iv, ciphertext, tag)
+		wipeBytes(cek)
+		if err == nil {
+			return plaintext, nil
+		}
+	}
+	return nil, ErrInvalidSignature
+}
+
+func jweDecryptContent(enc string, cek, aad, iv, ciphertext, tag []byte) ([]byte, error) {
+	switch enc {
+	case JWE_A128CBC_HS256:
+		if len(iv) != aes.BlockSize || len(ciphertext) == 0 || len(ciphertext)%aes.BlockSize != 0 ||
+			subtle.ConstantTimeCompare(jweCBCTag(cek[:16], aad, iv, ciphertext), tag) != 1 {
+			return nil, ErrInvalidSignature
+		}
+		block, _ := aes.NewCipher(cek[16:])
+		plaintext := make([]byte, len(ciphertext))
+		cipher.NewCBCDecrypter(block, iv).CryptBlocks(plaintext, ciphertext)
+		return pkcs5unpad(plaintext, aes.BlockSize)
+	case JWE_A256GCM:
+		block, _ := aes.NewCipher(cek)
+		gcm, _ := cipher.NewGCM(block)
+		if len(iv) != gcm.NonceSize() {
+			return nil, ErrInvalidSignature
+		}
+		return gcm.Open(nil, iv, append(append([]byte(nil), ciphertext...), tag...), aad)
+	}
+	return nil, ErrUnsupportedType
+}
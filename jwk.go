@@ -0,0 +1,368 @@
+package dkeyczar
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/json"
+	"math/big"
+)
+
+// JSON Web Keys (RFC 7517).  Imported keys are wrapped in a fake KeyReader,
+// the same way as the PEM importers; exported keys carry the keyczar key hash
+// as their "kid".
+
+type jwkJSON struct {
+	Kty string `json:"kty"`
+	Use string `json:"use,omitempty"`
+	Kid string `json:"kid,omitempty"`
+	Alg string `json:"alg,omitempty"`
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+	Y   string `json:"y,omitempty"`
+	N   string `json:"n,omitempty"`
+	E   string `json:"e,omitempty"`
+	D   string `json:"d,omitempty"`
+	P   string `json:"p,omitempty"`
+	Q   string `json:"q,omitempty"`
+	DP  string `json:"dp,omitempty"`
+	DQ  string `json:"dq,omitempty"`
+	QI  string `json:"qi,omitempty"`
+}
+
+type jwksJSON struct {
+	Keys []jwkJSON `json:"keys"`
+}
+
+var jwkCurves = map[string]elliptic.Curve{
+	"P-256": elliptic.P256(),
+	"P-384": elliptic.P384(),
+	"P-521": elliptic.P521(),
+}
+
+// a fake reader for a key set built from imported keys
+type importedKeySetReader struct {
+	km   KeyMeta        // our fake meta info
+	keys map[int]string // the key json for each version
+}
+
+func (r *importedKeySetReader) GetMetadata() (string, error) {
+	b, err := json.Marshal(r.km)
+	return string(b), err
+}
+
+func (r *importedKeySetReader) GetKey(version int) (string, error) {
+	s, ok := r.keys[version]
+	if !ok {
+		return "", ErrNoSuchKeyVersion
+	}
+	return s, nil
+}
+
+func decodeJWKInt(s string) (*big.Int, error) {
+	if s == "" {
+		return nil, ErrUnsupportedType
+	}
+	b, err := decodeWeb64String(s)
+	if err != nil {
+		return nil, ErrBase64Decoding
+	}
+	return new(big.Int).SetBytes(b), nil
+}
+
+// encode i big-endian, left padded with zeros to size bytes
+func encodeJWKInt(i *big.Int, size int) string {
+	b := i.Bytes()
+	if len(b) < size {
+		b = append(make([]byte, size-len(b)), b...)
+	}
+	if len(b) == 0 {
+		b = []byte{0}
+	}
+	return encodeWeb64String(b)
+}
+
+// convert a JWK into its keyczar key type, purpose and key json
+func newKeyJSONFromJWK(j *jwkJSON) (KeyType, KeyPurpose, []byte, error) {
+	private := j.D != ""
+	switch j.Kty {
+	case "RSA":
+		n, err := decodeJWKInt(j.N)
+		if err != nil {
+			return 0, 0, nil, err
+		}
+		e, err := decodeJWKInt(j.E)
+		if err != nil {
+			return 0, 0, nil, err
+		}
+		pub := rsa.PublicKey{N: n, E: int(e.Int64())}
+		// keyczar's PSS signatures use SHA-256, so they line up with PS256
+		scheme := SIG_PKCS1
+		if j.Alg == "PS256" {
+			scheme = SIG_PSS
+		}
+		if !private {
+			purpose := P_VERIFY
+			if j.Use == "enc" {
+				purpose = P_ENCRYPT
+			}
+			b, err := json.Marshal(newRSAPublicJSONFromKey(&pub, scheme))
+			return T_RSA_PUB, purpose, b, err
+		}
+		priv := &rsa.PrivateKey{PublicKey: pub}
+		if priv.D, err = decodeJWKInt(j.D); err != nil {
+			return 0, 0, nil, err
+		}
+		p, err := decodeJWKInt(j.P)
+		if err != nil {
+			return 0, 0, nil, err
+		}
+		q, err := decodeJWKInt(j.Q)
+		if err != nil {
+			return 0, 0, nil, err
+		}
+		priv.Primes = []*big.Int{p, q}
+		if err := priv.Validate(); err != nil {
+			return 0, 0, nil, err
+		}
+		priv.Precompute()
+		purpose := P_SIGN_AND_VERIFY
+		if j.Use == "enc" {
+			purpose = P_DECRYPT_AND_ENCRYPT
+		}
+		b, err := json.Marshal(newRSAJSONFromKey(priv, scheme))
+		return T_RSA_PRIV, purpose, b, err
+	case "EC":
+		curve, ok := jwkCurves[j.Crv]
+		if !ok {
+			return 0, 0, nil, ErrUnsupportedType
+		}
+		x, err := decodeJWKInt(j.X)
+		if err != nil {
+			return 0, 0, nil, err
+		}
+		y, err := decodeJWKInt(j.Y)
+		if err != nil {
+			return 0, 0, nil, err
+		}
+		if !curve.IsOnCurve(x, y) {
+			return 0, 0, nil, ErrUnsupportedType
+		}
+		pub := ecdsa.PublicKey{Curve: curve, X: x, Y: y}
+		if !private {
+			b, err := json.Marshal(newECDSAPublicJSONFromKey(&pub))
+			return T_EC_PUB, P_VERIFY, b, err
+		}
+		priv := &ecdsa.PrivateKey{PublicKey: pub}
+		if priv.D, err = decodeJWKInt(j.D); err != nil {
+			return 0, 0, nil, err
+		}
+		b, err := json.Marshal(newECDSAJSONFromKey(priv))
+		return T_EC_PRIV, P_SIGN_AND_VERIFY, b, err
+	case "OKP":
+		if j.Crv != "Ed25519" {
+			return 0, 0, nil, ErrUnsupportedType
+		}
+		x, err := decodeWeb64String(j.X)
+		if err != nil {
+			return 0, 0, nil, ErrBase64Decoding
+		}
+		if len(x) != ed25519.PublicKeySize {
+			return 0, 0, nil, ErrInvalidKeySize
+		}
+		if !private {
+			b, err := json.Marshal(newEd25519PublicJSONFromKey(ed25519.PublicKey(x)))
+			return T_ED25519_PUB, P_VERIFY, b, err
+		}
+		seed, err := decodeWeb64String(j.D)
+		if err != nil {
+			return 0, 0, nil, ErrBase64Decoding
+		}
+		if len(seed) != ed25519.SeedSize {
+			return 0, 0, nil, ErrInvalidKeySize
+		}
+		priv := ed25519.NewKeyFromSeed(seed)
+		if !priv.Public().(ed25519.PublicKey).Equal(ed25519.PublicKey(x)) {
+			return 0, 0, nil, ErrUnsupportedType
+		}
+		b, err := json.Marshal(newEd25519JSONFromKey(priv))
+		return T_ED25519_PRIV, P_SIGN_AND_VERIFY, b, err
+	}
+	return 0, 0, nil, ErrUnsupportedType
+}
+
+// ImportJWK returns a KeyReader for the RSA, EC or Ed25519 key in the JSON Web Key document.
+// Private keys can be used for signing (or decryption for RSA keys with "use":"enc"),
+// public keys for verification (or encryption).
+func ImportJWK(data []byte) (KeyReader, error) {
+	j := new(jwkJSON)
+	if err := json.Unmarshal(data, j); err != nil {
+		return nil, err
+	}
+	kt, kp, b, err := newKeyJSONFromJWK(j)
+	if err != nil {
+		return nil, err
+	}
+	r := new(importedKeySetReader)
+	kv := KeyVersion{VersionNumber: 0, Status: S_PRIMARY}
+	r.km = KeyMeta{"Imported JWK", kt, kp, false, []KeyVersion{kv}}
+	r.keys = map[int]string{0: string(b)}
+	return r, nil
+}
+
+// ImportJWKS returns a KeyReader for the keys in the JSON Web Key Set document.
+// All keys must be of the same type and purpose.  The first key becomes the primary
+// key (version 1) and the remaining keys are active, so any of them can verify.
+func ImportJWKS(data []byte) (KeyReader, error) {
+	set := new(jwksJSON)
+	if err := json.Unmarshal(data, set); err != nil {
+		return nil, err
+	}
+	if len(set.Keys) == 0 {
+		return nil, ErrKeyNotFound
+	}
+	r := new(importedKeySetReader)
+	r.km.Name = "Imported JWKS"
+	r.keys = make(map[int]string)
+	for i := range set.Keys {
+		kt, kp, b, err := newKeyJSONFromJWK(&set.Keys[i])
+		if err != nil {
+			return nil, err
+		}
+		status := S_ACTIVE
+		if i == 0 {
+			r.km.Type, r.km.Purpose = kt, kp
+			status = S_PRIMARY
+		} else if kt != r.km.Type || kp != r.km.Purpose {
+			return nil, ErrUnsupportedType
+		}
+		r.km.Versions = append(r.km.Versions, KeyVersion{VersionNumber: i + 1, Status: status})
+		r.keys[i+1] = string(b)
+	}
+	return r, nil
+}
+
+// build the JWK for the key, including the private part if private is set
+func newJWKFromKey(k keydata, purpose KeyPurpose, private bool) (*jwkJSON, error) {
+	j := new(jwkJSON)
+	j.Kid = encodeWeb64String(k.KeyID())
+	j.Use = "sig"
+	if purpose == P_ENCRYPT || purpose == P_DECRYPT_AND_ENCRYPT {
+		j.Use = "enc"
+	}
+	switch k := k.(type) {
+	case *rsaKey:
+		setRSAJWK(j, &k.publicKey.key, k.publicKey.scheme)
+		if private {
+			k.key.Precompute()
+			j.D = encodeJWKInt(k.key.D, 0)
+			j.P = encodeJWKInt(k.key.Primes[0], 0)
+			j.Q = encodeJWKInt(k.key.Primes[1], 0)
+			j.DP = encodeJWKInt(k.key.Precomputed.Dp, 0)
+			j.DQ = encodeJWKInt(k.key.Precomputed.Dq, 0)
+			j.QI = encodeJWKInt(k.key.Precomputed.Qinv, 0)
+		}
+	case *rsaPublicKey:
+		setRSAJWK(j, &k.key, k.scheme)
+	case *ecdsaKey:
+		setECJWK(j, &k.publicKey.key)
+		if private {
+			j.D = encodeJWKInt(k.key.D, (k.key.Curve.Params().BitSize+7)/8)
+		}
+	case *ecdsaPublicKey:
+		setECJWK(j, &k.key)
+	case *ed25519Key:
+		j.Kty, j.Crv = "OKP", "Ed25519"
+		j.X = encodeWeb64String(k.publicKey.key)
+		if private {
+			j.D = encodeWeb64String(k.key.Seed())
+		}
+	case *ed25519PublicKey:
+		j.Kty, j.Crv = "OKP", "Ed25519"
+		j.X = encodeWeb64String(k.key)
+	default:
+		return nil, ErrUnsupportedType
+	}
+	if private && j.D == "" {
+		return nil, ErrUnsupportedType
+	}
+	return j, nil
+}
+
+func setRSAJWK(j *jwkJSON, key *rsa.PublicKey, scheme RSASignatureScheme) {
+	j.Kty = "RSA"
+	if scheme == SIG_PSS && j.Use == "sig" {
+		j.Alg = "PS256"
+	}
+	j.N = encodeJWKInt(key.N, 0)
+	j.E = encodeJWKInt(big.NewInt(int64(key.E)), 0)
+}
+
+func setECJWK(j *jwkJSON, key *ecdsa.PublicKey) {
+	size := (key.Curve.Params().BitSize + 7) / 8
+	j.Kty = "EC"
+	j.Crv = key.Curve.Params().Name
+	j.X = encodeJWKInt(key.X, size)
+	j.Y = encodeJWKInt(key.Y, size)
+}
+
+func exportJWK(r KeyReader, version int, private bool) ([]byte, error) {
+	kz, err := newKeyCzar(r)
+	if err != nil {
+		return nil, err
+	}
+	var k keydata
+	if private {
+		k, err = exportPrivateKey(kz, version)
+	} else {
+		k, err = exportKey(kz, version)
+	}
+	if err != nil {
+		return nil, err
+	}
+	j, err := newJWKFromKey(k, kz.keymeta.Purpose, private)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(j)
+}
+
+// ExportPublicJWK returns the public half of the given key version from the RSA, EC or Ed25519 key set in r as a JSON Web Key.
+// The "kid" is the web-safe base64 encoding of the keyczar key hash.
+func ExportPublicJWK(r KeyReader, version int) ([]byte, error) {
+	return exportJWK(r, version, false)
+}
+
+// ExportPrivateJWK returns the given key version from the RSA, EC or Ed25519 private key set in r as a JSON Web Key.
+// The result is unencrypted, so handle it with care.  Like ExportPrivateKeyPEM, only versions marked exportable are exported.
+func ExportPrivateJWK(r KeyReader, version int) ([]byte, error) {
+	return exportJWK(r, version, true)
+}
+
+// ExportJWKS returns the public halves of all the non-inactive keys in the RSA, EC or Ed25519 key set in r
+// as a JSON Web Key Set, primary key first, suitable for publishing at a jwks_uri.
+func ExportJWKS(r KeyReader) ([]byte, error) {
+	kz, err := newKeyCzar(r)
+	if err != nil {
+		return nil, err
+	}
+	set := jwksJSON{Keys: []jwkJSON{}}
+	var rest []jwkJSON
+	for _, kv := range kz.keymeta.Versions {
+		if kv.Status == S_INACTIVE {
+			continue
+		}
+		j, err := newJWKFromKey(kz.keys[kv.VersionNumber], kz.keymeta.Purpose, false)
+		if err != nil {
+			return nil, err
+		}
+		if kv.Status == S_PRIMARY {
+			set.Keys = append(set.Keys, *j)
+		} else {
+			rest = append(rest, *j)
+		}
+	}
+	set.Keys = append(set.Keys, rest...)
+	return json.Marshal(set)
+}
@@ -0,0 +1,238 @@
+package dkeyczar
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/json"
+	"math/big"
+	"strings"
+)
+
+// JSON Web Tokens (RFC 7519) signed with the primary key of a keyczar key set.
+// The JWS algorithm follows the key type:
+//   HMAC_SHA1 -> HS256, RSA -> RS256 (PS256 with PSS padding),
+//   EC -> ES256/ES384/ES512, Ed25519 -> EdDSA
+// and the "kid" header is the web-safe base64 encoding of the keyczar key hash,
+// so verifiers can pick the right key version after a rotation.
+
+type jwtHeader struct {
+	Alg string `json:"alg"`
+	Typ string `json:"typ,omitempty"`
+	Kid string `json:"kid,omitempty"`
+}
+
+// return the JWS algorithm name for the key, or "" if it has none
+func jwtAlgorithm(k keydata) string {
+	switch k := k.(type) {
+	case *hmacKey:
+		return "HS256"
+	case *rsaKey:
+		return jwtAlgorithm(&k.publicKey)
+	case *rsaPublicKey:
+		if k.scheme == SIG_PSS {
+			return "PS256"
+		}
+		return "RS256"
+	case *ecdsaKey:
+		return jwtAlgorithm(&k.publicKey)
+	case *ecdsaPublicKey:
+		switch k.key.Curve.Params().BitSize {
+		case 256:
+			return "ES256"
+		case 384:
+			return "ES384"
+		case 521:
+			return "ES512"
+		}
+	case *ed25519Key, *ed25519PublicKey:
+		return "EdDSA"
+	}
+	return ""
+}
+
+func jwtHash(bitSize int) crypto.Hash {
+	switch {
+	case bitSize > 384:
+		return crypto.SHA512
+	case bitSize > 256:
+		return crypto.SHA384
+	}
+	return crypto.SHA256
+}
+
+func jwtDigest(h crypto.Hash, input []byte) []byte {
+	switch h {
+	case crypto.SHA384:
+		d := sha512.Sum384(input)
+		return d[:]
+	case crypto.SHA512:
+		d := sha512.Sum512(input)
+		return d[:]
+	}
+	d := sha256.Sum256(input)
+	return d[:]
+}
+
+func jwtSign(k keydata, input []byte) ([]byte, error) {
+	switch k := k.(type) {
+	case *hmacKey:
+		mac := hmac.New(sha256.New, k.key)
+		mac.Write(input)
+		return mac.Sum(nil), nil
+	case *rsaKey:
+		digest := jwtDigest(crypto.SHA256, input)
+		if k.publicKey.scheme == SIG_PSS {
+			return rsa.SignPSS(k.random(), &k.key, crypto.SHA256, digest, pssOptions)
+		}
+		return rsa.SignPKCS1v15(k.random(), &k.key, crypto.SHA256, digest)
+	case *ecdsaKey:
+		bitSize := k.key.Curve.Params().BitSize
+		r, s, err := ecdsa.Sign(k.random(), &k.key, jwtDigest(jwtHash(bitSize), input))
+		if err != nil {
+			return nil, err
+		}
+		// JWS uses the fixed size r||s encoding rather than ASN.1
+		size := (bitSize + 7) / 8
+		sig := make([]byte, 2*size)
+		r.FillBytes(sig[:size])
+		s.FillBytes(sig[size:])
+		return sig, nil
+	case *ed25519Key:
+		return ed25519.Sign(k.key, input), nil
+	}
+	return nil, ErrUnsupportedType
+}
+
+func jwtVerify(k keydata, input []byte, sig []byte) bool {
+	switch k := k.(type) {
+	case *hmacKey:
+		mac := hmac.New(sha256.New, k.key)
+		mac.Write(input)
+		return hmac.Equal(mac.Sum(nil), sig)
+	case *rsaKey:
+		return jwtVerify(&k.publicKey, input, sig)
+	case *rsaPublicKey:
+		digest := jwtDigest(crypto.SHA256, input)
+		if k.scheme == SIG_PSS {
+			return rsa.VerifyPSS(&k.key, crypto.SHA256, digest, sig, pssOptions) == nil
+		}
+		return rsa.VerifyPKCS1v15(&k.key, crypto.SHA256, digest, sig) == nil
+	case *ecdsaKey:
+		return jwtVerify(&k.publicKey, input, sig)
+	case *ecdsaPublicKey:
+		bitSize := k.key.Curve.Params().BitSize
+		size := (bitSize + 7) / 8
+		if len(sig) != 2*size {
+			return false
+		}
+		r := new(big.Int).SetBytes(sig[:size])
+		s := new(big.Int).SetBytes(sig[size:])
+		return ecdsa.Verify(&k.key, jwtDigest(jwtHash(bitSize), input), r, s)
+	case *ed25519Key:
+		return jwtVerify(&k.publicKey, input, sig)
+	case *ed25519PublicKey:
+		return ed25519.Verify(k.key, input, sig)
+	}
+	return false
+}
+
+// SignJWT returns a compact serialized JWT for the claims, signed with the signer's primary key.
+// The signer must have been created by NewSigner from an HMAC, RSA, EC or Ed25519 key set.
+func SignJWT(signer Signer, claims map[string]interface{}) (string, error) {
+	ks, ok := signer.(*keySigner)
+	if !ok {
+		return "", ErrUnsupportedType
+	}
+	key, err := ks.kz.primaryKey()
+	if err != nil {
+		return "", err
+	}
+	alg := jwtAlgorithm(key)
+	if alg == "" {
+		return "", ErrUnsupportedType
+	}
+	h, err := json.Marshal(jwtHeader{alg, "JWT", encodeWeb64String(key.KeyID())})
+	if err != nil {
+		return "", err
+	}
+	c, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	input := encodeWeb64String(h) + "." + encodeWeb64String(c)
+	sig, err := jwtSign(key, []byte(input))
+	if err != nil {
+		return "", err
+	}
+	return input + "." + encodeWeb64String(sig), nil
+}
+
+// VerifyJWT checks the signature of a compact serialized JWT against the verifier's key set and returns its claims.
+// The key is selected with the "kid" header if present.  Tokens whose "exp" has passed or whose "nbf" is in the future are rejected.
+func VerifyJWT(verifier Verifier, token string) (map[string]interface{}, error) {
+	ks, ok := verifier.(*keySigner)
+	if !ok {
+		return nil, ErrUnsupportedType
+	}
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 || parts[2] == "" {
+		return nil, ErrMalformedJWT
+	}
+	b, err := decodeWeb64String(parts[0])
+	if err != nil {
+		return nil, ErrBase64Decoding
+	}
+	var h jwtHeader
+	if err := json.Unmarshal(b, &h); err != nil {
+		return nil, ErrMalformedJWT
+	}
+	sig, err := decodeWeb64String(parts[2])
+	if err != nil {
+		return nil, ErrBase64Decoding
+	}
+	var kl []keydata
+	if h.Kid != "" {
+		id, err := decodeWeb64String(h.Kid)
+		if err != nil || len(id) != 4 {
+			return nil, ErrKeyNotFound
+		}
+		if kl, err = ks.kz.getKeyForID(id); err != nil {
+			return nil, err
+		}
+	} else {
+		kl = ks.kz.allKeys()
+	}
+	input := []byte(parts[0] + "." + parts[1])
+	valid := false
+	for _, k := range kl {
+		// the algorithm must match the key, never the other way around
+		if jwtAlgorithm(k) == h.Alg && jwtVerify(k, input, sig) {
+			valid = true
+			break
+		}
+	}
+	if !valid {
+		return nil, ErrInvalidSignature
+	}
+	b, err = decodeWeb64String(parts[1])
+	if err != nil {
+		return nil, ErrBase64Decoding
+	}
+	claims := make(map[string]interface{})
+	if err := json.Unmarshal(b, &claims); err != nil {
+		return nil, ErrMalformedJWT
+	}
+	now := ks.currentTime() / 1000
+	if exp, ok := claims["exp"].(float64); ok && now >= int64(exp) {
+		return nil, ErrJWTExpired
+	}
+	if nbf, ok := claims["nbf"].(float64); ok && now < int64(nbf) {
+		return nil, ErrJWTNotYetValid
+	}
+	return claims, nil
+}
@@ -1,11 +1,49 @@
 package dkeyczar
 
 import (
+	"archive/tar"
+	"archive/zip"
 	"bytes"
+	"context"
+	"crypto"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/hmac"
 	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
 	"io"
+	"io/fs"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
+	"testing/fstest"
+	"testing/iotest"
 	"time"
+
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/pbkdf2"
+	"golang.org/x/crypto/ssh"
 )
 
 const INPUT = "This is some test data"
@@ -154,6 +192,9 @@ func testSignVerify(t *testing.T, keytype string, f KeyReader) {
 	if msg == nil || !bytes.Equal(msg, []byte(INPUT)) {
 		t.Error(keytype + " attachedverify failed")
 	}
+	if _, err := kv.AttachedVerify(s, []byte{7, 6, 5, 4, 3, 2, 1, 0}); err != ErrInvalidSignature {
+		t.Error(keytype + " attachedverify accepted the wrong nonce")
+	}
 	s, err = kz.AttachedSign([]byte(INPUT), nil)
 	if err != nil {
 		t.Fatal("failed to attachedsign (no nonce) for keytype " + keytype + ": " + err.Error())
@@ -318,7 +359,7 @@ func TestRSACertImport(t *testing.T) {
 
 */
 func TestGeneratedAESEncryptDecrypt(t *testing.T) {
-	k, _ := generateAESKey(0)
+	k, _ := generateAESKey(0, rand.Reader)
 	r := newImportedAESKeyReader(k)
 	testEncryptDecrypt(t, "aes generated", r)
 	testEncryptDecryptReader(t, "aes generated", r)
@@ -336,215 +377,4564 @@ func TestGeneratedRSA(t *testing.T) {
 }
 
 */
-func TestGeneratedDSA(t *testing.T) {
-	k, _ := generateDSAKey(0)
-	r := newImportedDSAPrivateKeyReader(&k.key)
-	testSignVerify(t, "dsa generated", r)
+func TestGeneratedHMAC(t *testing.T) {
+	km := NewKeyManager()
+	km.Create("hmac", P_SIGN_AND_VERIFY, T_HMAC_SHA1)
+	km.AddKey(0, S_PRIMARY)
+	testSignVerify(t, "hmac generated", keyManagerReader(mustJSONs(km, nil)))
 }
 
-func TestEncryptedReader(t *testing.T) {
-	f := NewFileReader(TESTDATA + "aes")
-	cr, err := NewCrypter(f)
+func TestHMACSigner(t *testing.T) {
+	r := GenerateHMACKeySet("webhooks")
+	signer, err := NewHMACSigner(r)
 	if err != nil {
-		t.Fatal("failed to create crypter for keytype aes")
+		t.Fatal("NewHMACSigner failed:", err)
+	}
+	mac, err := signer.MAC(strings.NewReader(INPUT))
+	if err != nil {
+		t.Fatal("MAC failed:", err)
+	}
+	// a streamed mac is a plain keyczar signature
+	if sig, _ := signer.Sign([]byte(INPUT)); sig != mac {
+		t.Errorf("MAC %q differs from Sign %q", mac, sig)
+	}
+	if ok, err := signer.VerifyMAC(strings.NewReader(INPUT), mac); !ok || err != nil {
+		t.Errorf("VerifyMAC failed: %v %v", ok, err)
+	}
+	if ok, _ := signer.VerifyMAC(strings.NewReader(INPUT+"!"), mac); ok {
+		t.Error("VerifyMAC accepted a modified message")
+	}
+	if _, err := signer.VerifyMAC(strings.NewReader(INPUT), "AAAA"); err != ErrShortSignature {
+		t.Errorf("VerifyMAC of a short signature: got %v, want ErrShortSignature", err)
+	}
+
+	// the generated key set can be saved and loaded like any other
+	km := NewKeyManager()
+	if err := km.Load(r); err != nil {
+		t.Fatal("failed to load generated key set:", err)
+	}
+	verifier, _ := NewVerifier(keyManagerReader(mustJSONs(km, nil)))
+	if ok, _ := verifier.Verify([]byte(INPUT), mac); !ok {
+		t.Error("saved key set doesn't verify the mac")
+	}
+
+	km = NewKeyManager()
+	km.Create("not hmac", P_SIGN_AND_VERIFY, T_ED25519_PRIV)
+	km.AddKey(0, S_PRIMARY)
+	if _, err := NewHMACSigner(keyManagerReader(mustJSONs(km, nil))); err != ErrUnsupportedType {
+		t.Errorf("NewHMACSigner of ed25519 keys: got %v, want ErrUnsupportedType", err)
 	}
-	er := NewEncryptedReader(NewFileReader(TESTDATA+"aes-crypted"), cr)
-	testDecrypt(t, "aes-crypted", er)
 }
 
-func TestPBEReader(t *testing.T) {
-	f := NewFileReader(TESTDATA + "pbe_json")
-	er := NewPBEReader(f, []byte("cartman"))
-	testEncryptDecrypt(t, "pbe_json", er)
-	testEncryptDecryptReader(t, "pbe_json", er)
+func TestSignReader(t *testing.T) {
+	tests := []struct {
+		ktype  KeyType
+		scheme RSASignatureScheme
+	}{
+		{T_HMAC_SHA1, 0},
+		{T_DSA_PRIV, 0},
+		{T_RSA_PRIV, SIG_PKCS1},
+		{T_RSA_PRIV, SIG_PSS},
+		{T_EC_PRIV, 0},
+	}
+	for _, tt := range tests {
+		km := NewKeyManager()
+		km.Create("stream", P_SIGN_AND_VERIFY, tt.ktype)
+		km.SetSignatureScheme(tt.scheme)
+		km.AddKey(0, S_PRIMARY)
+		r := keyManagerReader(mustJSONs(km, nil))
+		s, _ := NewSigner(r)
+		signer := s.(*keySigner)
+		sig, err := signer.SignReader(strings.NewReader(INPUT))
+		if err != nil {
+			t.Errorf("%s: SignReader failed: %v", tt.ktype, err)
+			continue
+		}
+		// streamed and whole message signatures are interchangeable
+		if ok, _ := signer.Verify([]byte(INPUT), sig); !ok {
+			t.Errorf("%s: Verify rejected a SignReader signature", tt.ktype)
+		}
+		whole, _ := signer.Sign([]byte(INPUT))
+		if ok, err := signer.VerifyReader(strings.NewReader(INPUT), whole); !ok || err != nil {
+			t.Errorf("%s: VerifyReader rejected a Sign signature: %v", tt.ktype, err)
+		}
+		if ok, _ := signer.VerifyReader(strings.NewReader(INPUT+"!"), sig); ok {
+			t.Errorf("%s: VerifyReader accepted a modified message", tt.ktype)
+		}
+	}
+
+	km := NewKeyManager()
+	km.Create("stream", P_SIGN_AND_VERIFY, T_ED25519_PRIV)
+	km.AddKey(0, S_PRIMARY)
+	s, _ := NewSigner(keyManagerReader(mustJSONs(km, nil)))
+	signer := s.(*keySigner)
+	if _, err := signer.SignReader(strings.NewReader(INPUT)); err != ErrCannotStream {
+		t.Errorf("ed25519 SignReader: got %v, want ErrCannotStream", err)
+	}
+	sig, _ := signer.Sign([]byte(INPUT))
+	if _, err := signer.VerifyReader(strings.NewReader(INPUT), sig); err != ErrCannotStream {
+		t.Errorf("ed25519 VerifyReader: got %v, want ErrCannotStream", err)
+	}
 }
 
-func TestSessionEncryptDecrypt(t *testing.T) {
-	f := NewFileReader(TESTDATA + "rsa")
-	kz, err := NewCrypter(f)
-	if err != nil {
-		t.Fatal("failed to create crypter with rsa: " + err.Error())
+func TestDetachedSignature(t *testing.T) {
+	for _, ktype := range []KeyType{T_RSA_PRIV, T_ED25519_PRIV} {
+		km := NewKeyManager()
+		km.Create("detached", P_SIGN_AND_VERIFY, ktype)
+		km.AddKey(0, S_PRIMARY)
+		signer, _ := NewSigner(keyManagerReader(mustJSONs(km, nil)), WithEncoding(HEX))
+		var sigfile bytes.Buffer
+		if err := WriteDetachedSignature(signer, strings.NewReader(INPUT), &sigfile); err != nil {
+			t.Fatalf("%s: WriteDetachedSignature failed: %v", ktype, err)
+		}
+		// the file is web-safe base64 whatever the signer's encoding
+		sig, err := decodeWeb64String(sigfile.String())
+		if err != nil || sig[0] != kzVersion {
+			t.Errorf("%s: bad signature file %q", ktype, sigfile.String())
+		}
+
+		// rotate, so the verifier has to pick the old version from the header
+		km.AddKey(0, S_PRIMARY)
+		verifier, _ := NewVerifier(keyManagerReader(mustJSONs(km.PubKeys(), nil)))
+		withNewline := strings.NewReader(sigfile.String() + "\n")
+		if ok, err := VerifyDetachedSignature(verifier, strings.NewReader(INPUT), withNewline); !ok || err != nil {
+			t.Errorf("%s: VerifyDetachedSignature failed: %v %v", ktype, ok, err)
+		}
+		if ok, _ := VerifyDetachedSignature(verifier, strings.NewReader(INPUT+"!"), strings.NewReader(sigfile.String())); ok {
+			t.Errorf("%s: VerifyDetachedSignature accepted a modified message", ktype)
+		}
+		s, _ := ReadDetachedSignature(strings.NewReader(sigfile.String()), HEX)
+		if ok, _ := signer.Verify([]byte(INPUT), s); !ok {
+			t.Errorf("%s: ReadDetachedSignature didn't re-encode the signature", ktype)
+		}
 	}
-	sess1, keys, err := NewSessionEncrypter(kz)
-	if err != nil {
-		t.Fatal("failed to create session encrypter: " + err.Error())
+	if _, err := ReadDetachedSignature(strings.NewReader("not base64!"), BASE64W); err != ErrBase64Decoding {
+		t.Errorf("ReadDetachedSignature of garbage: got %v, want ErrBase64Decoding", err)
 	}
-	c, err := sess1.Encrypt([]byte(INPUT))
+}
+
+func TestTimeoutSign(t *testing.T) {
+	km := NewKeyManager()
+	km.Create("timeout", P_SIGN_AND_VERIFY, T_HMAC_SHA1)
+	km.AddKey(0, S_PRIMARY)
+	r := keyManagerReader(mustJSONs(km, nil))
+	signer, _ := NewSigner(r)
+	expiration := time.Now().Add(time.Minute)
+	s, err := signer.TimeoutSign([]byte(INPUT), ExpirationMillis(expiration))
 	if err != nil {
-		t.Fatal("failed to session encrypt: " + err.Error())
+		t.Fatal("failed to timeoutsign: " + err.Error())
 	}
-	sess2, err := NewSessionDecrypter(kz, keys)
+	// a Signer must be able to check its own timeout signatures
+	if ok, err := signer.TimeoutVerify([]byte(INPUT), s); !ok || err != nil {
+		t.Error("signer failed to timeoutverify")
+	}
+	late, _ := NewVerifierTimeProvider(r, func() int64 { return ExpirationMillis(expiration.Add(time.Second)) })
+	if ok, _ := late.TimeoutVerify([]byte(INPUT), s); ok {
+		t.Error("timeoutverify accepted an expired signature")
+	}
+	if ok, _ := late.Verify([]byte(INPUT), s); ok {
+		t.Error("plain verify accepted a timeout signature")
+	}
+}
+
+func TestReplaySign(t *testing.T) {
+	km := NewKeyManager()
+	km.Create("replay", P_SIGN_AND_VERIFY, T_HMAC_SHA1)
+	km.AddKey(0, S_PRIMARY)
+	r := keyManagerReader(mustJSONs(km, nil))
+	signer, _ := NewSigner(r)
+	s, err := signer.(ReplaySigner).ReplaySign([]byte(INPUT))
 	if err != nil {
-		t.Fatal("failed to create session decrypter: " + err.Error())
+		t.Fatal("failed to replaysign: " + err.Error())
 	}
-	p, err := sess2.Decrypt(c)
+	if _, err := signer.(ReplayVerifier).ReplayVerify([]byte(INPUT), s); err != ErrNoNonceStore {
+		t.Errorf("replayverify without a nonce store: got %v", err)
+	}
+	verifier, _ := NewVerifier(r, WithNonceStore(NewMemoryNonceStore()))
+	rv := verifier.(ReplayVerifier)
+	if ok, err := rv.ReplayVerify([]byte("other"), s); ok || err != nil {
+		t.Errorf("replayverify of the wrong message: got %v, %v", ok, err)
+	}
+	if ok, err := rv.ReplayVerify([]byte(INPUT), s); !ok || err != nil {
+		t.Errorf("replayverify failed: %v", err)
+	}
+	if ok, err := rv.ReplayVerify([]byte(INPUT), s); ok || err != ErrReplayedSignature {
+		t.Errorf("replayed signature: got %v, %v", ok, err)
+	}
+	if ok, _ := verifier.Verify([]byte(INPUT), s); ok {
+		t.Error("plain verify accepted a replay-protected signature")
+	}
+	s, _ = signer.(ReplaySigner).ReplaySign([]byte(INPUT))
+	late, _ := NewVerifierTimeProvider(r, func() int64 { return ExpirationMillis(time.Now().Add(time.Minute)) },
+		WithNonceStore(NewMemoryNonceStore()), WithReplayWindow(30*time.Second))
+	if ok, err := late.(ReplayVerifier).ReplayVerify([]byte(INPUT), s); ok || err != ErrStaleSignature {
+		t.Errorf("stale signature: got %v, %v", ok, err)
+	}
+
+	// the caller may bring its own nonce and timestamp
+	rs := signer.(ReplaySigner)
+	nonce := []byte("request-00000001")
+	now := ExpirationMillis(time.Now())
+	s, err = rs.ReplaySignWith([]byte(INPUT), nonce, now)
 	if err != nil {
-		t.Fatal("failed to session decrypt: " + err.Error())
+		t.Fatal("failed to replaysign with a nonce: " + err.Error())
 	}
-	if string(p) != INPUT {
-		t.Error("session decrypt(encrypt(p)) != p")
+	if again, _ := rs.ReplaySignWith([]byte(INPUT), nonce, now); again != s {
+		t.Error("hmac signatures with the same nonce and timestamp differ")
+	}
+	if ok, err := rv.ReplayVerify([]byte(INPUT), s); !ok || err != nil {
+		t.Errorf("replayverify with the caller's nonce failed: %v", err)
+	}
+	other, _ := rs.ReplaySignWith([]byte("other"), nonce, now)
+	if ok, err := rv.ReplayVerify([]byte("other"), other); ok || err != ErrReplayedSignature {
+		t.Errorf("reused nonce: got %v, %v", ok, err)
+	}
+	old, _ := rs.ReplaySignWith([]byte(INPUT), []byte("request-00000002"), now-time.Hour.Milliseconds())
+	if ok, err := rv.ReplayVerify([]byte(INPUT), old); ok || err != ErrStaleSignature {
+		t.Errorf("signature with an old timestamp: got %v, %v", ok, err)
+	}
+	if _, err := rs.ReplaySignWith([]byte(INPUT), []byte("short"), now); err != ErrBadNonceSize {
+		t.Errorf("short nonce: got %v", err)
 	}
 }
 
-func TestSessionEncryptDecryptStream(t *testing.T) {
-	f := NewFileReader(TESTDATA + "rsa")
-	kz, err := NewCrypter(f)
+func TestUnversionedSign(t *testing.T) {
+	km := NewKeyManager()
+	km.Create("unversioned", P_SIGN_AND_VERIFY, T_HMAC_SHA1)
+	km.AddKey(0, S_PRIMARY)
+	signer, _ := NewSigner(keyManagerReader(mustJSONs(km, nil)))
+	s, err := signer.UnversionedSign([]byte(INPUT))
 	if err != nil {
-		t.Fatal("failed to create crypter with rsa: " + err.Error())
+		t.Fatal("failed to unversionedsign: " + err.Error())
 	}
-	kz.SetCompression(ZLIB)
-	for size := 1024 * 1024; size < 1024*1024+5; size += 1 {
-		source := make([]byte, size)
-		io.ReadFull(rand.Reader, source)
-		for iE, enc := range []Encoding{NO_ENCODING, BASE64W} {
-			for iC, compr := range []Compression{NO_COMPRESSION, ZLIB, GZIP} {
-				buf := bytes.NewBuffer(nil)
-				encoder, err := NewSessionEncryptWriter(kz, buf, enc, compr)
-				if err != nil {
-					t.Fatal("failed to create session encrypter: " + err.Error())
-				}
-				dumper := bytes.NewBuffer(source)
-				if _, err := dumper.WriteTo(encoder); err != nil {
-					t.Fatal("failed to encrypt with session", err)
-				}
-				if err := encoder.Close(); err != nil {
-					t.Fatal("Failed to close encoder", err)
-				}
-				plainReader, err := NewSessionDecryptReader(kz, buf, enc, compr)
-				if err != nil {
-					t.Fatal("failed to create session decrypter: " + err.Error())
-				}
-				out := bytes.NewBuffer(nil)
-				if _, err := out.ReadFrom(plainReader); err != nil && err != io.EOF {
-					t.Fatalf("[Test %d/%d] Error reading session ciphered data: %s", iE, iC, err)
-				}
-				if err := plainReader.Close(); err != nil {
-					t.Fatal("Could not close reader", err)
-				}
-				if !bytes.Equal(out.Bytes(), source) {
-					t.Error("session decrypt(encrypt(p)) != p")
-				}
-			}
-		}
+	// the signature is a plain HMAC-SHA1 with no keyczar framing
+	k := signer.(*keySigner).kz.getPrimaryKey().(*hmacKey)
+	mac := hmac.New(sha1.New, k.key)
+	mac.Write([]byte(INPUT))
+	if b, _ := decodeWeb64String(s); !hmac.Equal(b, mac.Sum(nil)) {
+		t.Error("unversioned signature is not a raw hmac")
+	}
+	// after a rotation the old key must still be tried
+	km.AddKey(0, S_PRIMARY)
+	verifier, _ := NewVerifier(keyManagerReader(mustJSONs(km, nil)))
+	if ok, _ := verifier.UnversionedVerify([]byte(INPUT), s); !ok {
+		t.Error("unversionedverify failed with a non-primary key")
+	}
+	if ok, _ := verifier.UnversionedVerify([]byte(INPUT+"x"), s); ok {
+		t.Error("unversionedverify accepted a modified message")
 	}
 }
 
-func TestEncryptDecryptCompressed(t *testing.T) {
-	f := NewFileReader(TESTDATA + "aes")
-	longinput := INPUT + INPUT + INPUT + INPUT + INPUT
-	longinput = longinput + INPUT + INPUT + INPUT + INPUT + INPUT
-	longinput = longinput + INPUT + INPUT + INPUT + INPUT + INPUT
-	longinput = longinput + INPUT + INPUT + INPUT + INPUT + INPUT
-	longinput = longinput + INPUT + INPUT + INPUT + INPUT + INPUT
-	longinput = longinput + INPUT + INPUT + INPUT + INPUT + INPUT
-	kz, err := NewCrypter(f)
+// a reader that always returns the current state of a key manager
+type liveKeyManagerReader struct {
+	km KeyManager
+}
+
+func (r liveKeyManagerReader) GetMetadata() (string, error) {
+	jsons, err := r.km.ToJSONs(nil)
 	if err != nil {
-		t.Fatal("failed to create crypter for aes: " + err.Error())
+		return "", err
 	}
-	c, err := kz.Encrypt([]byte(longinput))
+	return keyManagerReader(jsons).GetMetadata()
+}
+
+func (r liveKeyManagerReader) GetKey(version int) (string, error) {
+	jsons, err := r.km.ToJSONs(nil)
 	if err != nil {
-		t.Fatal("failed to encrypt: " + err.Error())
+		return "", err
 	}
-	uncompressedLen := len(c)
-	p, err := kz.Decrypt(c)
-	if err != nil {
-		t.Fatal("failed to decrypt: " + err.Error())
+	return keyManagerReader(jsons).GetKey(version)
+}
+
+func TestReloadOnUnknownKey(t *testing.T) {
+	km := NewKeyManager()
+	km.Create("reload", P_SIGN_AND_VERIFY, T_HMAC_SHA1)
+	km.AddKey(0, S_PRIMARY)
+	verifier, _ := NewVerifier(liveKeyManagerReader{km})
+	if verifier.(ReloadController).ReloadPolicy() != NO_RELOAD {
+		t.Error("reloading should be off by default")
 	}
-	if string(p) != longinput {
-		t.Error("aes decrypt(encrypt(p)) != p")
+	staticVerifier, _ := NewVerifier(liveKeyManagerReader{km})
+	verifier.(ReloadController).SetReloadPolicy(RELOAD_ON_UNKNOWN_KEY)
+	// rotate the key on the producer side
+	km.AddKey(0, S_PRIMARY)
+	signer, _ := NewSigner(keyManagerReader(mustJSONs(km, nil)))
+	s, _ := signer.Sign([]byte(INPUT))
+	if _, err := staticVerifier.Verify([]byte(INPUT), s); !errors.Is(err, ErrKeyNotFound) {
+		t.Error("verifier without reloading found the new key")
 	}
-	for _, compression := range []struct {
-		kc    Compression
-		ctype string
-	}{{GZIP, "gzip"}, {ZLIB, "zlib"}} {
-		kz.SetCompression(compression.kc)
-		c, err = kz.Encrypt([]byte(longinput))
-		if err != nil {
-			t.Fatalf("failed to encrypt with compression %s: %s", compression.ctype, err)
-		}
-		compressedLen := len(c)
-		p, err = kz.Decrypt(c)
-		if err != nil {
-			t.Fatalf("failed to decrypt with compression %s: %s", compression.ctype, err)
-		}
-		if string(p) != longinput {
-			t.Error(compression.ctype + " raw decrypt(encrypt(p)) != p")
+	if ok, err := verifier.Verify([]byte(INPUT), s); !ok || err != nil {
+		t.Error("verifier failed to reload the new key")
+	}
+	other := NewKeyManager()
+	other.Create("other", P_SIGN_AND_VERIFY, T_HMAC_SHA1)
+	other.AddKey(0, S_PRIMARY)
+	otherSigner, _ := NewSigner(keyManagerReader(mustJSONs(other, nil)))
+	s, _ = otherSigner.Sign([]byte(INPUT))
+	if _, err := verifier.Verify([]byte(INPUT), s); !errors.Is(err, ErrKeyNotFound) {
+		t.Error("reloading verifier found a key from an unknown key set")
+	}
+}
+
+func TestMultiVerifier(t *testing.T) {
+	oldKeys := NewKeyManager()
+	oldKeys.Create("old", P_SIGN_AND_VERIFY, T_HMAC_SHA1)
+	oldKeys.AddKey(0, S_PRIMARY)
+	newKeys := NewKeyManager()
+	newKeys.Create("new", P_SIGN_AND_VERIFY, T_EC_PRIV)
+	newKeys.AddKey(0, S_PRIMARY)
+	oldSigner, _ := NewSigner(keyManagerReader(mustJSONs(oldKeys, nil)))
+	newSigner, _ := NewSigner(keyManagerReader(mustJSONs(newKeys, nil)))
+	verifier, err := NewMultiVerifier(keyManagerReader(mustJSONs(newKeys.PubKeys(), nil)), keyManagerReader(mustJSONs(oldKeys, nil)))
+	if err != nil {
+		t.Fatal("failed to create multi verifier: " + err.Error())
+	}
+	for _, signer := range []Signer{oldSigner, newSigner} {
+		s, _ := signer.Sign([]byte(INPUT))
+		if ok, err := verifier.Verify([]byte(INPUT), s); !ok || err != nil {
+			t.Error("multi verifier failed to verify")
 		}
-		if compressedLen >= uncompressedLen {
-			t.Error(compression.ctype + " failed to compress")
+		s, _ = signer.UnversionedSign([]byte(INPUT))
+		if ok, _ := verifier.UnversionedVerify([]byte(INPUT), s); !ok {
+			t.Error("multi verifier failed to unversionedverify")
 		}
 	}
+	other := NewKeyManager()
+	other.Create("other", P_SIGN_AND_VERIFY, T_HMAC_SHA1)
+	other.AddKey(0, S_PRIMARY)
+	otherSigner, _ := NewSigner(keyManagerReader(mustJSONs(other, nil)))
+	s, _ := otherSigner.Sign([]byte(INPUT))
+	if _, err := verifier.Verify([]byte(INPUT), s); !errors.Is(err, ErrKeyNotFound) {
+		t.Error("multi verifier found a key from an unknown key set")
+	}
+	if _, err := NewMultiVerifier(); err != ErrNoKeySets {
+		t.Error("multi verifier accepted no key sets")
+	}
 }
 
-func TestSignVerifyBase64(t *testing.T) {
-	f := NewFileReader(TESTDATA + "dsa")
-	kz, err := NewSigner(f)
+func TestMultiCrypter(t *testing.T) {
+	oldKeys := NewKeyManager()
+	oldKeys.Create("old", P_DECRYPT_AND_ENCRYPT, T_AES)
+	oldKeys.AddKey(0, S_PRIMARY)
+	newKeys := NewKeyManager()
+	newKeys.Create("new", P_DECRYPT_AND_ENCRYPT, T_AES)
+	newKeys.AddKey(0, S_PRIMARY)
+	oldCrypter, _ := NewCrypter(keyManagerReader(mustJSONs(oldKeys, nil)))
+	c, _ := oldCrypter.Encrypt([]byte(INPUT))
+	crypter, err := NewMultiCrypter(keyManagerReader(mustJSONs(newKeys, nil)), keyManagerReader(mustJSONs(oldKeys, nil)))
 	if err != nil {
-		t.Fatal("failed to create signer: " + err.Error())
+		t.Fatal("failed to create multi crypter: " + err.Error())
 	}
-	s, err := kz.Sign([]byte(INPUT))
-	if err != nil {
-		t.Fatal("failed to sign: " + err.Error())
+	if p, err := crypter.Decrypt(c); err != nil || string(p) != INPUT {
+		t.Error("multi crypter failed to decrypt old ciphertext")
 	}
-	if s[0] != 'A' { // first byte will 0, so first byte of base64 will be 'A'
-		t.Error("bad version byte for base64 signature")
+	// new ciphertexts use the first key set only
+	c, _ = crypter.Encrypt([]byte(INPUT))
+	if _, err := oldCrypter.Decrypt(c); !errors.Is(err, ErrKeyNotFound) {
+		t.Error("multi crypter encrypted with the wrong key set")
 	}
-	kz.SetEncoding(NO_ENCODING)
-	s, err = kz.Sign([]byte(INPUT))
-	if err != nil {
-		t.Fatal("failed to sign with no encoding: " + err.Error())
+	if p, err := crypter.Decrypt(c); err != nil || string(p) != INPUT {
+		t.Error("multi crypter failed to decrypt its own ciphertext")
 	}
-	if s[0] != 0 {
-		t.Error("bad version byte for raw signature")
+	signKeys := NewKeyManager()
+	signKeys.Create("sign", P_SIGN_AND_VERIFY, T_HMAC_SHA1)
+	signKeys.AddKey(0, S_PRIMARY)
+	if _, err := NewMultiCrypter(keyManagerReader(mustJSONs(newKeys, nil)), keyManagerReader(mustJSONs(signKeys, nil))); err != ErrUnacceptablePurpose {
+		t.Error("multi crypter accepted a signing key set")
 	}
-	kv, err := NewVerifier(f)
-	if err != nil {
-		t.Fatal("failed to create verifier")
+}
+
+// a reader that never answers, like a remote key store that has hung
+type blockingReader struct {
+	done chan struct{}
+}
+
+func (r blockingReader) GetMetadata() (string, error) {
+	<-r.done
+	return "", io.EOF
+}
+
+func (r blockingReader) GetKey(version int) (string, error) {
+	<-r.done
+	return "", io.EOF
+}
+
+func TestNewWithContext(t *testing.T) {
+	r := blockingReader{make(chan struct{})}
+	defer close(r.done)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := NewCrypterWithContext(ctx, r); err != context.DeadlineExceeded {
+		t.Error("crypter didn't give up on a hung reader")
 	}
-	kv.SetEncoding(NO_ENCODING)
-	b, err := kv.Verify([]byte(INPUT), s)
+	if _, err := NewVerifierWithContext(ctx, NewEncryptedReader(r, NewPBECrypter([]byte("pass")))); err != context.DeadlineExceeded {
+		t.Error("verifier didn't give up on a hung encrypted reader")
+	}
+	km := NewKeyManager()
+	km.Create("context", P_SIGN_AND_VERIFY, T_HMAC_SHA1)
+	km.AddKey(0, S_PRIMARY)
+	signer, err := NewSignerWithContext(context.Background(), keyManagerReader(mustJSONs(km, nil)))
 	if err != nil {
-		t.Fatal("failed to verify with no encoding: " + err.Error())
+		t.Fatal("failed to create signer with context: " + err.Error())
 	}
-	if !b {
-		t.Error("dsa raw encoding verify failed")
+	s, _ := signer.Sign([]byte(INPUT))
+	if ok, _ := signer.Verify([]byte(INPUT), s); !ok {
+		t.Error("signer created with context failed to verify")
 	}
 }
 
-var pkcs5padtests = []struct {
-	s   []byte
-	pad int
-	r   []byte
-}{
-	{[]byte{0, 0, 0, 0, 0, 0, 0, 0}, 8, []byte{0, 0, 0, 0, 0, 0, 0, 0, 8, 8, 8, 8, 8, 8, 8, 8}},
-	{[]byte{0, 0, 0, 0, 0, 0, 0}, 8, []byte{0, 0, 0, 0, 0, 0, 0, 1}},
-	{[]byte{0, 0, 0, 0, 0, 0}, 8, []byte{0, 0, 0, 0, 0, 0, 2, 2}},
-	{[]byte{0, 0, 0, 0, 0}, 8, []byte{0, 0, 0, 0, 0, 3, 3, 3}},
-	{[]byte{0, 0, 0, 0}, 8, []byte{0, 0, 0, 0, 4, 4, 4, 4}},
+func TestGeneratedDSA(t *testing.T) {
+	k, _ := generateDSAKey(0, rand.Reader)
+	r := newImportedDSAPrivateKeyReader(&k.key)
+	testSignVerify(t, "dsa generated", r)
 }
 
-func TestPKCS5Pad(t *testing.T) {
-	for _, pkcs := range pkcs5padtests {
-		unpad := make([]byte, len(pkcs.s))
-		copy(unpad, pkcs.s)
-		r := pkcs5pad(pkcs.s, pkcs.pad)
-		if bytes.Compare(pkcs.r, r) != 0 {
-			t.Error("pkcs5pad: got: ", r, "expected: ", pkcs.r)
+// a KeyReader over the output of KeyManager.ToJSONs
+type keyManagerReader []string
+
+func (r keyManagerReader) GetMetadata() (string, error) {
+	return r[0], nil
+}
+
+func (r keyManagerReader) GetKey(version int) (string, error) {
+	if version < 1 || version >= len(r) {
+		return "", ErrNoSuchKeyVersion
+	}
+	return r[version], nil
+}
+
+// the key set of km as KeyManager.ToJSONs returns it, for keys that can't fail to encrypt
+func mustJSONs(km KeyManager, encrypter Encrypter) []string {
+	jsons, err := km.ToJSONs(encrypter)
+	if err != nil {
+		panic(err)
+	}
+	return jsons
+}
+
+func TestGeneratedRSAPSS(t *testing.T) {
+	km := NewKeyManager()
+	km.Create("pss", P_SIGN_AND_VERIFY, T_RSA_PRIV)
+	km.SetSignatureScheme(SIG_PSS)
+	if err := km.AddKey(1024, S_PRIMARY); err != nil {
+		t.Fatal("failed to generate rsa key: " + err.Error())
+	}
+	r := keyManagerReader(mustJSONs(km, nil))
+	if !strings.Contains(r[1], `"signatureScheme":"PSS"`) || strings.Contains(r[1], `"padding"`) {
+		t.Error("pss signature scheme not recorded in its own field of the key json: " + r[1])
+	}
+	testSignVerify(t, "rsa pss generated", r)
+	testVerifyPublic(t, "rsa pss generated", r, keyManagerReader(mustJSONs(km.PubKeys(), nil)))
+
+	// the encryption padding other implementations write doesn't change the signature scheme
+	pub := mustJSONs(km.PubKeys(), nil)
+	java := keyManagerReader{pub[0], strings.Replace(pub[1], `"signatureScheme":"PSS"`, `"padding":"OAEP"`, 1)}
+	if _, err := newRSAPublicKeyFromJSON([]byte(java[1])); err != nil {
+		t.Error("failed to load a key with an encryption padding: " + err.Error())
+	}
+	if v, err := NewVerifier(java); err == nil {
+		s, _ := NewSigner(r)
+		sig, _ := s.Sign([]byte(INPUT))
+		if ok, _ := v.Verify([]byte(INPUT), sig); ok {
+			t.Error("key without the pss signature scheme verified a pss signature")
 		}
-		u := pkcs5unpad(r)
-		if bytes.Compare(unpad, u) != 0 {
-			t.Error("pkcs5unpad: got: ", u, "expected: ", unpad)
+	}
+	unknown := strings.Replace(pub[1], `"signatureScheme":"PSS"`, `"signatureScheme":"OAEP"`, 1)
+	if _, err := newRSAPublicKeyFromJSON([]byte(unknown)); err == nil {
+		t.Error("loaded a key with an unknown signature scheme")
+	}
+}
+
+// sign with the private keyset and verify with the public one
+func testVerifyPublic(t *testing.T, keytype string, priv KeyReader, pub KeyReader) {
+	ks, err := NewSigner(priv)
+	if err != nil {
+		t.Fatal("failed to create signer for keytype " + keytype + ": " + err.Error())
+	}
+	s, err := ks.Sign([]byte(INPUT))
+	if err != nil {
+		t.Fatal("failed to sign for keytype " + keytype + ": " + err.Error())
+	}
+	kv, err := NewVerifier(pub)
+	if err != nil {
+		t.Fatal("failed to create public verifier for keytype " + keytype + ": " + err.Error())
+	}
+	if b, _ := kv.Verify([]byte(INPUT), s); !b {
+		t.Error(keytype + " public verify failed")
+	}
+	if b, _ := kv.Verify([]byte(INPUT+"x"), s); b {
+		t.Error(keytype + " public verify accepted a modified message")
+	}
+}
+
+func TestGeneratedECDSA(t *testing.T) {
+	for _, size := range []uint{256, 384} {
+		km := NewKeyManager()
+		km.Create("ec", P_SIGN_AND_VERIFY, T_EC_PRIV)
+		if err := km.AddKey(size, S_PRIMARY); err != nil {
+			t.Fatal("failed to generate ec key: " + err.Error())
 		}
+		r := keyManagerReader(mustJSONs(km, nil))
+		testSignVerify(t, "ec generated", r)
+		testVerifyPublic(t, "ec generated", r, keyManagerReader(mustJSONs(km.PubKeys(), nil)))
 	}
 }
 
-func TestLenPrefixPack(t *testing.T) {
-	b := lenPrefixPack([]byte{4, 5, 6, 2, 1}, []byte{1, 4, 2, 8, 5, 7}, []byte{1, 2, 3, 4, 5, 6, 7, 8, 9}, []byte{1})
-	arrays := lenPrefixUnpack(b)
-	// FIXME: make this test more complete
-	if len(arrays[3]) != 1 || arrays[3][0] != 1 {
-		t.Error("unpack error")
+func TestECDSAPEMImport(t *testing.T) {
+	priv, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	der, _ := x509.MarshalPKCS8PrivateKey(priv)
+	privfile := writeTempPEM(t, "PRIVATE KEY", der)
+	r, err := ImportECDSAKeyFromPEMForSigning(privfile)
+	if err != nil {
+		t.Fatal("failed to import ec private key: " + err.Error())
 	}
+	der, _ = x509.MarshalPKIXPublicKey(&priv.PublicKey)
+	pubfile := writeTempPEM(t, "PUBLIC KEY", der)
+	pr, err := ImportECDSAPublicKeyFromPEMForVerify(pubfile)
+	if err != nil {
+		t.Fatal("failed to import ec public key: " + err.Error())
+	}
+	testSignVerify(t, "ec pem import", r)
+	testVerifyPublic(t, "ec pem import", r, pr)
 }
 
-// FIXME: DecodeWeb64String / EncodeWeb64String
+func TestDSAPEMImport(t *testing.T) {
+	k, _ := generateDSAKey(0, rand.Reader)
+	priv := &k.key
+	der, _ := asn1.Marshal(dsaOpenSSLPrivateKey{0, priv.P, priv.Q, priv.G, priv.Y, priv.X})
+	r, err := ImportDSAKeyFromPEMForSigning(writeTempPEM(t, "DSA PRIVATE KEY", der))
+	if err != nil {
+		t.Fatal("failed to import openssl dsa private key: " + err.Error())
+	}
+	params, _ := asn1.Marshal(dsaAlgorithmParameters{priv.P, priv.Q, priv.G})
+	algo := pkix.AlgorithmIdentifier{Algorithm: oidPublicKeyDSA, Parameters: asn1.RawValue{FullBytes: params}}
+	x, _ := asn1.Marshal(priv.X)
+	der, _ = asn1.Marshal(dsaPKCS8PrivateKey{0, algo, x})
+	r8, err := ImportDSAKeyFromPEMForSigning(writeTempPEM(t, "PRIVATE KEY", der))
+	if err != nil {
+		t.Fatal("failed to import pkcs8 dsa private key: " + err.Error())
+	}
+	y, _ := asn1.Marshal(priv.Y)
+	der, _ = asn1.Marshal(struct {
+		Algo      pkix.AlgorithmIdentifier
+		PublicKey asn1.BitString
+	}{algo, asn1.BitString{Bytes: y, BitLength: len(y) * 8}})
+	pr, err := ImportDSAPublicKeyFromPEMForVerify(writeTempPEM(t, "PUBLIC KEY", der))
+	if err != nil {
+		t.Fatal("failed to import dsa public key: " + err.Error())
+	}
+	testSignVerify(t, "dsa pem import", r)
+	testVerifyPublic(t, "dsa pem import", r, pr)
+	testVerifyPublic(t, "dsa pkcs8 pem import", r8, pr)
+}
+
+func TestPKCS8PEMImport(t *testing.T) {
+	rsapriv, _ := generateRSAKey(1024, rand.Reader)
+	ecpriv, _ := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	_, edpriv, _ := ed25519.GenerateKey(rand.Reader)
+	for _, k := range []interface{}{&rsapriv.key, ecpriv, edpriv} {
+		der, _ := x509.MarshalPKCS8PrivateKey(k)
+		location := writeTempPEM(t, "PRIVATE KEY", der)
+		r, err := ImportPKCS8KeyFromPEMForSigning(location)
+		if err != nil {
+			t.Fatalf("failed to import pkcs8 %T: %s", k, err)
+		}
+		testSignVerify(t, "pkcs8 pem import", r)
+		if _, ok := k.(*rsa.PrivateKey); ok {
+			if _, err := ImportRSAKeyFromPEMForCrypt(location); err != nil {
+				t.Error("failed to import pkcs8 rsa key: " + err.Error())
+			}
+		}
+	}
+}
+
+// wrap a PKCS#8 private key with PBES2 (PBKDF2-SHA256, AES-256-CBC)
+func encryptPKCS8(t *testing.T, der []byte, passphrase []byte) []byte {
+	salt := make([]byte, 16)
+	iv := make([]byte, aes.BlockSize)
+	io.ReadFull(rand.Reader, salt)
+	io.ReadFull(rand.Reader, iv)
+	prf := pkix.AlgorithmIdentifier{Algorithm: oidHMACWithSHA256, Parameters: asn1.NullRawValue}
+	kdfParams, _ := asn1.Marshal(pbkdf2Params{Salt: salt, IterationCount: 2048, PRF: prf})
+	ivParams, _ := asn1.Marshal(iv)
+	params, _ := asn1.Marshal(pbes2Params{
+		pkix.AlgorithmIdentifier{Algorithm: oidPBKDF2, Parameters: asn1.RawValue{FullBytes: kdfParams}},
+		pkix.AlgorithmIdentifier{Algorithm: oidAES256CBC, Parameters: asn1.RawValue{FullBytes: ivParams}},
+	})
+	block, _ := aes.NewCipher(pbkdf2.Key(passphrase, salt, 2048, 32, sha256.New))
+	pad := aes.BlockSize - len(der)%aes.BlockSize
+	data := append(append([]byte{}, der...), bytes.Repeat([]byte{byte(pad)}, pad)...)
+	cipher.NewCBCEncrypter(block, iv).CryptBlocks(data, data)
+	out, err := asn1.Marshal(encryptedPrivateKeyInfo{pkix.AlgorithmIdentifier{Algorithm: oidPBES2, Parameters: asn1.RawValue{FullBytes: params}}, data})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return out
+}
+
+func TestRSAEncryptedPEMImport(t *testing.T) {
+	k, _ := generateRSAKey(1024, rand.Reader)
+	passphrase := []byte("correct horse battery staple")
+	der, _ := x509.MarshalPKCS8PrivateKey(&k.key)
+	pkcs8file := writeTempPEM(t, "ENCRYPTED PRIVATE KEY", encryptPKCS8(t, der, passphrase))
+	r, err := ImportRSAKeyFromEncryptedPEM(pkcs8file, passphrase, P_DECRYPT_AND_ENCRYPT)
+	if err != nil {
+		t.Fatal("failed to import encrypted pkcs8 rsa key: " + err.Error())
+	}
+	testEncryptDecrypt(t, "rsa encrypted pkcs8 import", r)
+	if _, err := ImportRSAKeyFromEncryptedPEM(pkcs8file, []byte("wrong"), P_DECRYPT_AND_ENCRYPT); err == nil {
+		t.Error("imported encrypted pkcs8 key with the wrong passphrase")
+	}
+	block, _ := x509.EncryptPEMBlock(rand.Reader, "RSA PRIVATE KEY", x509.MarshalPKCS1PrivateKey(&k.key), passphrase, x509.PEMCipherAES256)
+	tradfile := filepath.Join(t.TempDir(), "key.pem")
+	ioutil.WriteFile(tradfile, pem.EncodeToMemory(block), 0600)
+	r, err = ImportRSAKeyFromEncryptedPEM(tradfile, passphrase, P_SIGN_AND_VERIFY)
+	if err != nil {
+		t.Fatal("failed to import encrypted pem rsa key: " + err.Error())
+	}
+	testSignVerify(t, "rsa encrypted pem import", r)
+	if _, err := ImportRSAKeyFromEncryptedPEM(tradfile, []byte("wrong"), P_SIGN_AND_VERIFY); err == nil {
+		t.Error("imported encrypted pem key with the wrong passphrase")
+	}
+}
+
+func TestOpenSSHKeyImport(t *testing.T) {
+	rsapriv, _ := rsa.GenerateKey(rand.Reader, 2048)
+	ecpriv, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	_, edpriv, _ := ed25519.GenerateKey(rand.Reader)
+	passphrase := []byte("correct horse battery staple")
+	for _, tt := range []struct {
+		name string
+		priv crypto.Signer
+	}{
+		{"rsa", rsapriv},
+		{"ec", ecpriv},
+		{"ed25519", edpriv},
+	} {
+		sshpub, _ := ssh.NewPublicKey(tt.priv.Public())
+		pr, _ := ImportSSHPublicKeyForVerify(string(ssh.MarshalAuthorizedKey(sshpub)))
+
+		block, _ := ssh.MarshalPrivateKey(tt.priv, "")
+		r, err := ImportPrivateKeyFromPEMBytes(pem.EncodeToMemory(block), nil, P_SIGN_AND_VERIFY)
+		if err != nil {
+			t.Fatalf("failed to import openssh %s key: %s", tt.name, err)
+		}
+		testVerifyPublic(t, "openssh "+tt.name+" import", r, pr)
+
+		block, _ = ssh.MarshalPrivateKeyWithPassphrase(tt.priv, "", passphrase)
+		encrypted := pem.EncodeToMemory(block)
+		r, err = ImportPrivateKeyFromPEMBytes(encrypted, passphrase, P_SIGN_AND_VERIFY)
+		if err != nil {
+			t.Fatalf("failed to import encrypted openssh %s key: %s", tt.name, err)
+		}
+		testVerifyPublic(t, "encrypted openssh "+tt.name+" import", r, pr)
+		if _, err := ImportPrivateKeyFromPEMBytes(encrypted, []byte("wrong"), P_SIGN_AND_VERIFY); err != ErrPEMDecryption {
+			t.Errorf("encrypted openssh %s key with the wrong passphrase: got %v, want ErrPEMDecryption", tt.name, err)
+		}
+		if _, err := ImportPrivateKeyFromPEMBytes(encrypted, nil, P_SIGN_AND_VERIFY); err != ErrPEMDecryption {
+			t.Errorf("encrypted openssh %s key without a passphrase: got %v, want ErrPEMDecryption", tt.name, err)
+		}
+	}
+	block, _ := ssh.MarshalPrivateKey(rsapriv, "")
+	if _, err := ImportRSAKeyFromPEMBytesForSigning(pem.EncodeToMemory(block)); err != nil {
+		t.Error("failed to import openssh rsa key for signing: " + err.Error())
+	}
+}
+
+// an RSA-1024 key and its self-signed certificate, exported by openssl pkcs12 -legacy with the password "password"
+const testPFX = `
+MIIGCQIBAzCCBc8GCSqGSIb3DQEHAaCCBcAEggW8MIIFuDCCArcGCSqGSIb3DQEHBqCCAqgwggKk
+AgEAMIICnQYJKoZIhvcNAQcBMBwGCiqGSIb3DQEMAQYwDgQI5ShoNbjGQ+QCAggAgIICcFabP/Li
+qoMjaCBixk/o9hSH5Syc0b5HtneTpkLMWLJO3KsAOFJJNBUlBQCfRVeEhKcEOxZIZoNQK+ih+v/Q
+4/T9lNB2SDrnDA5I0SUwBEduK2A4yl+IHrTKquLtywgxqTrpVss+cYWEP+sR6Z0Wg83X8y3qiFtR
+zMMFVMds9QYmBAd/Wzb80Ho9AJfy8VG601D42IhEFDUov8wbeSSNtYWE4dQ/RFaG/N7nD40fRDf5
+epkOAc6H0EbeFVN5ESFgCd1NAJzx4ggQR1r1zULdWzy6lPmnN5txd2R6l6vSf5TRuRrYqROPNt5l
+HAGLCDHsbGO7bEYPitM/ASMzev91JmDIoBY3fl9dq3f17vCDNT7XzXmHKZMHq35Dm3A30C2LH3hq
++N5WgHxjROBXAEepDncqeuMicFWhj+MENZPu3NH0xCOySQwTZRmqjLUhq1E0zv/symD9OHZdaNwt
+rB67m0RqXBQzjIBkXTRH61THJtb3aCxnPSbNeHnMi1H2jSjKWJO8xxT+ZEcRA57bVrDbyiuo55nM
+JowNiVY6b2JsKo1NUL4GymQXYxhc3t5chfw9pxGAqZbu38Awx+w9n7Ia6ELg3HByNjLeS7GmmT1O
+Dxe4MBYrcbj4EmQBRv15Zlt67f+Qs9FIVAcWNBMZHD8+zarvhZ/tQdGM1RIU35j8TB+dMkZk4zl6
+bLK73ragCFsLDfqQn7tEwOnRuRjc2/OXedOtIVmKmOvBtf5sH3E2Z7QpNv+s5woPlFXon42GggYh
+Ke93xQGM3D0tsx6Pe/7+E4qUFUiEO1VE0PehGFl7mrRID9lkQ5v68IYnr8cyaNsyGTCCAvkGCSqG
+SIb3DQEHAaCCAuoEggLmMIIC4jCCAt4GCyqGSIb3DQEMCgECoIICpjCCAqIwHAYKKoZIhvcNAQwB
+AzAOBAhgL2cco4udNwICCAAEggKAZk5VSYbDEUsZB4K15ToosaSJX5MmCndQjZmIR9a2SVAonHUZ
+gWSLdJ5UiicHX9DYnGiZ0AJQ+SQKGeBP2MbrEb4Y+hY/EZ+co3u+W1ivi5BAZMbKDPJ/z8IabVzU
+U4zSKn0ltgDS5Qi+0suNaBidbs5ZlQ+TWrJAnRYMeIzfuo0jyTf7wybxlsAgFR2Zxr9KNmPL9Tyf
+/8AyoRFbqZAsRcuLdaaGrO2rHvf/Oc12QW3sOavLhskPsF1F49Z2uJpjzcFVkPONFjzI+QWOj21L
+KQVOlzeDiwLyyg4z9yCkkibHPiK6DRF3O/QVfmUIg4rym/AzLvm7d1qFbZaL63sb3LCfv5/FSPXZ
+xpWOhQgit5X769kTI8uENEvDbBYZ/BYExXqJfkTGb6Nu8V1GnJZfvjMIMek4Y1IER+Y6EREWVmf4
+JrO7A/4kLzTdrmVmSLZWh0V+1cUCzmbTsTf6oOyZiXgtaGOuQvucUVGm/rBQlIRfjMyMOh0LKYmX
+C/Svi6zL1M7sUlXatCKHakyq/qaMtszXVAi29mJR1qVN2jdilTtaqhHAE4dsfMJLqRhvPX+YomgS
+HBVaRN7zQ3Yp/Z3sBcZyxtdJY+uRmASgfw8J3vo9OjSEwL6esqmY/e5b6+H25PDS0mpweFz77SRF
+ruxGavJ7qGEAf/PjDEJDhKQ5DadwbVTXjLT9yTizWR693esjlHLRGOUJLFzsAxPzWe0ORFXxz1pJ
+ndph3PUtwRWI/uD0JvLSraC6ZWsFIknOGJO4CaKfo0+fd5S8gU5S8wECOai49/UuZs2xZSq3hnqo
+9MnwHSGwMbBgjbCEEX6K1IKmoCgz1Ukb+vDt60A4qECsUjElMCMGCSqGSIb3DQEJFTEWBBR9xqM/
+MKZ1rBW8XhbI4fVTjjtHbTAxMCEwCQYFKw4DAhoFAAQUhQxlzHdWwwv5vPJLwjoBHgXtLS0ECO3z
+84M/LGxJAgIIAA==
+`
+
+func TestPKCS12Import(t *testing.T) {
+	pfx, _ := base64.StdEncoding.DecodeString(strings.Replace(testPFX, "\n", "", -1))
+	password := []byte("password")
+	r, err := ImportFromPKCS12Bytes(pfx, password, P_SIGN_AND_VERIFY)
+	if err != nil {
+		t.Fatal("failed to import pkcs12 key for signing: " + err.Error())
+	}
+	pr, err := ImportFromPKCS12Bytes(pfx, password, P_VERIFY)
+	if err != nil {
+		t.Fatal("failed to import pkcs12 certificate for verification: " + err.Error())
+	}
+	testVerifyPublic(t, "pkcs12 import", r, pr)
+
+	r, err = ImportFromPKCS12Bytes(pfx, password, P_DECRYPT_AND_ENCRYPT)
+	if err != nil {
+		t.Fatal("failed to import pkcs12 key for decryption: " + err.Error())
+	}
+	pr, err = ImportFromPKCS12Bytes(pfx, password, P_ENCRYPT)
+	if err != nil {
+		t.Fatal("failed to import pkcs12 certificate for encryption: " + err.Error())
+	}
+	encrypter, _ := NewEncrypter(pr)
+	crypter, _ := NewCrypter(r)
+	c, _ := encrypter.Encrypt([]byte(INPUT))
+	if p, err := crypter.Decrypt(c); err != nil || string(p) != INPUT {
+		t.Errorf("pkcs12 key failed to decrypt for its certificate: %q, %v", p, err)
+	}
+
+	if _, err := ImportFromPKCS12Bytes(pfx, []byte("wrong"), P_SIGN_AND_VERIFY); err != ErrPKCS12Decryption {
+		t.Errorf("expected ErrPKCS12Decryption with the wrong password, got %v", err)
+	}
+	if _, err := ImportFromPKCS12Bytes(pfx, password, P_TEST); err != ErrUnacceptablePurpose {
+		t.Errorf("expected ErrUnacceptablePurpose, got %v", err)
+	}
+}
+
+func TestPEMBytesImport(t *testing.T) {
+	k, _ := generateRSAKey(1024, rand.Reader)
+	der := x509.MarshalPKCS1PrivateKey(&k.key)
+	r, err := ImportRSAKeyFromPEMBytesForCrypt(pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: der}))
+	if err != nil {
+		t.Fatal("failed to import rsa private key bytes: " + err.Error())
+	}
+	testEncryptDecrypt(t, "rsa pem bytes import", r)
+	der, _ = x509.MarshalPKIXPublicKey(&k.key.PublicKey)
+	if _, err := ImportRSAPublicKeyFromPEMBytesForEncryption(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})); err != nil {
+		t.Error("failed to import rsa public key bytes: " + err.Error())
+	}
+	priv, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	der, _ = x509.MarshalECPrivateKey(priv)
+	r, err = ImportECDSAKeyFromPEMBytesForSigning(pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}))
+	if err != nil {
+		t.Fatal("failed to import ec private key bytes: " + err.Error())
+	}
+	der, _ = x509.MarshalPKIXPublicKey(&priv.PublicKey)
+	pr, err := ImportECDSAPublicKeyFromPEMBytesForVerify(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}))
+	if err != nil {
+		t.Fatal("failed to import ec public key bytes: " + err.Error())
+	}
+	testVerifyPublic(t, "ec pem bytes import", r, pr)
+	if _, err := ImportRSAPublicKeyFromPEMBytesForVerify([]byte("not a pem file")); err != ErrNoPEMFound {
+		t.Error("expected ErrNoPEMFound for garbage input, got", err)
+	}
+}
+
+func TestImportPEMBundle(t *testing.T) {
+	caKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	leafKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	newCert := func(serial int64, pub interface{}, parent *x509.Certificate, signer *ecdsa.PrivateKey, ca bool) *x509.Certificate {
+		tmpl := &x509.Certificate{
+			SerialNumber:          big.NewInt(serial),
+			Subject:               pkix.Name{CommonName: "cert " + strconv.FormatInt(serial, 10)},
+			NotBefore:             time.Now().Add(-time.Hour),
+			NotAfter:              time.Now().Add(time.Hour),
+			IsCA:                  ca,
+			BasicConstraintsValid: true,
+			KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		}
+		if parent == nil {
+			parent = tmpl
+		}
+		der, err := x509.CreateCertificate(rand.Reader, tmpl, parent, pub, signer)
+		if err != nil {
+			t.Fatal("failed to create certificate: " + err.Error())
+		}
+		cert, _ := x509.ParseCertificate(der)
+		return cert
+	}
+	root := newCert(1, &caKey.PublicKey, nil, caKey, true)
+	intermediate := newCert(2, &caKey.PublicKey, root, caKey, true)
+	leaf := newCert(3, &leafKey.PublicKey, intermediate, caKey, false)
+
+	// a typical server bundle: the certificate, its private key, then the rest of the chain
+	var bundle bytes.Buffer
+	der, _ := x509.MarshalECPrivateKey(leafKey)
+	pem.Encode(&bundle, &pem.Block{Type: "CERTIFICATE", Bytes: leaf.Raw})
+	pem.Encode(&bundle, &pem.Block{Type: "EC PARAMETERS", Bytes: []byte{0x06, 0x08, 0x2a, 0x86, 0x48, 0xce, 0x3d, 0x03, 0x01, 0x07}})
+	pem.Encode(&bundle, &pem.Block{Type: "EC PRIVATE KEY", Bytes: der})
+	pem.Encode(&bundle, &pem.Block{Type: "CERTIFICATE", Bytes: intermediate.Raw})
+
+	r, err := ImportECDSAKeyFromPEMBytesForSigning(bundle.Bytes())
+	if err != nil {
+		t.Fatal("failed to import key from bundle: " + err.Error())
+	}
+	roots := x509.NewCertPool()
+	roots.AddCert(root)
+	pr, err := ImportCertificateChainBytesForVerify(bundle.Bytes(), roots)
+	if err != nil {
+		t.Fatal("failed to import certificate chain: " + err.Error())
+	}
+	testVerifyPublic(t, "certificate chain", r, pr)
+	if _, err := ImportCertificateChainBytesForVerify(bundle.Bytes(), nil); err != nil {
+		t.Error("failed to import unverified certificate: " + err.Error())
+	}
+
+	other := x509.NewCertPool()
+	other.AddCert(newCert(4, &leafKey.PublicKey, nil, leafKey, true))
+	if _, err := ImportCertificateChainBytesForVerify(bundle.Bytes(), other); err == nil {
+		t.Error("imported a certificate that doesn't chain to the roots")
+	}
+	var leafOnly bytes.Buffer
+	pem.Encode(&leafOnly, &pem.Block{Type: "CERTIFICATE", Bytes: leaf.Raw})
+	if _, err := ImportCertificateChainBytesForVerify(leafOnly.Bytes(), roots); err == nil {
+		t.Error("verified a certificate without its intermediate")
+	}
+	if _, err := ImportCertificateChainBytesForVerify(der, roots); err != ErrNoPEMFound {
+		t.Errorf("expected ErrNoPEMFound without certificates, got %v", err)
+	}
+	if _, err := ImportECDSAPublicKeyFromPEMBytesForVerify(bundle.Bytes()); err != ErrNoPEMFound {
+		t.Errorf("expected ErrNoPEMFound for a bundle without a public key block, got %v", err)
+	}
+}
+
+func TestExportPEM(t *testing.T) {
+	for _, kt := range []KeyType{T_RSA_PRIV, T_DSA_PRIV, T_EC_PRIV, T_ED25519_PRIV} {
+		km := NewKeyManager()
+		km.Create("export", P_SIGN_AND_VERIFY, kt)
+		km.AddKey(0, S_PRIMARY)
+		km.AddKey(0, S_ACTIVE)
+		if _, err := ExportPrivateKeyPEM(keyManagerReader(mustJSONs(km, nil)), PrimaryKeyVersion); err != ErrKeyNotExportable {
+			t.Errorf("expected ErrKeyNotExportable exporting unmarked %s key, got %v", kt, err)
+		}
+		ec := km.(ExportableController)
+		if err := ec.MarkExportable(1, "yes"); err != ErrExportNotConfirmed {
+			t.Errorf("expected ErrExportNotConfirmed, got %v", err)
+		}
+		if err := ec.MarkExportable(1, ConfirmExportable); err != nil {
+			t.Fatal("MarkExportable failed: " + err.Error())
+		}
+		r := keyManagerReader(mustJSONs(km, nil))
+		if _, err := ExportPrivateKeyPEM(r, 2); err != ErrKeyNotExportable {
+			t.Errorf("expected ErrKeyNotExportable exporting unmarked %s version, got %v", kt, err)
+		}
+		privpem, err := ExportPrivateKeyPEM(r, PrimaryKeyVersion)
+		if err != nil {
+			t.Fatalf("failed to export %s private key: %s", kt, err)
+		}
+		ir, err := ImportPKCS8KeyFromPEMBytesForSigning(privpem)
+		if err != nil {
+			t.Fatalf("failed to import exported %s private key: %s", kt, err)
+		}
+		// the exported primary key must verify signatures made by the key set
+		signer, _ := NewSigner(ir)
+		sig, _ := signer.Sign([]byte(INPUT))
+		verifier, _ := NewVerifier(r)
+		if ok, err := verifier.Verify([]byte(INPUT), sig); !ok || err != nil {
+			t.Errorf("%s key set failed to verify signature from exported key", kt)
+		}
+		pubpem, err := ExportPublicKeyPEM(keyManagerReader(mustJSONs(km.PubKeys(), nil)), 2)
+		if err != nil {
+			t.Fatalf("failed to export %s public key: %s", kt, err)
+		}
+		block, _ := pem.Decode(pubpem)
+		if _, err := x509.ParsePKIXPublicKey(block.Bytes); err != nil {
+			t.Errorf("failed to parse exported %s public key: %s", kt, err)
+		}
+		if _, err := ExportPrivateKeyPEM(r, 3); err != ErrNoSuchKeyVersion {
+			t.Errorf("expected ErrNoSuchKeyVersion exporting missing %s version, got %v", kt, err)
+		}
+	}
+}
+
+func TestTinkKeyset(t *testing.T) {
+	for _, tt := range []struct {
+		kt      KeyType
+		purpose KeyPurpose
+		size    uint
+		scheme  RSASignatureScheme
+	}{
+		{T_AES, P_DECRYPT_AND_ENCRYPT, 256, SIG_PKCS1},
+		{T_HMAC_SHA1, P_SIGN_AND_VERIFY, 0, SIG_PKCS1},
+		{T_RSA_PRIV, P_SIGN_AND_VERIFY, 1024, SIG_PKCS1},
+		{T_RSA_PRIV, P_SIGN_AND_VERIFY, 1024, SIG_PSS},
+		{T_EC_PRIV, P_SIGN_AND_VERIFY, 384, SIG_PKCS1},
+	} {
+		name := tt.kt.String() + " " + tt.scheme.String()
+		km := NewKeyManager()
+		km.Create("tink", tt.purpose, tt.kt)
+		km.SetSignatureScheme(tt.scheme)
+		km.AddKey(tt.size, S_PRIMARY)
+		km.AddKey(tt.size, S_PRIMARY)
+		km.Demote(1)
+		km.Demote(1)
+		r := keyManagerReader(mustJSONs(km, nil))
+		data, err := ExportTinkKeyset(r)
+		if err != nil {
+			t.Fatalf("%s: ExportTinkKeyset failed: %s", name, err)
+		}
+		var ks tinkKeysetJSON
+		json.Unmarshal(data, &ks)
+		info, _ := LoadKeysetInfo(r)
+		if len(ks.Key) != 2 || ks.Key[0].Status != "DISABLED" || ks.Key[1].Status != "ENABLED" ||
+			ks.PrimaryKeyID != ks.Key[1].KeyID || ks.Key[1].OutputPrefixType != "LEGACY" ||
+			ks.Key[1].KeyID != binary.BigEndian.Uint32(info.Keys[1].KeyHash) {
+			t.Errorf("%s: unexpected tink keyset %s", name, data)
+		}
+		ir, err := ImportTinkKeyset(data)
+		if err != nil {
+			t.Fatalf("%s: ImportTinkKeyset failed: %s", name, err)
+		}
+		if d, err := DiffKeysets(r, ir); err != nil || !d.Empty() {
+			t.Errorf("%s: round trip changed the key set: %+v, %v", name, d, err)
+		}
+		if tt.purpose == P_DECRYPT_AND_ENCRYPT {
+			testEncryptDecrypt(t, name+" tink import", ir)
+		} else {
+			testSignVerify(t, name+" tink import", ir)
+		}
+	}
+
+	km := NewKeyManager()
+	km.Create("tink", P_SIGN_AND_VERIFY, T_EC_PRIV)
+	km.AddKey(0, S_PRIMARY)
+	pub := keyManagerReader(mustJSONs(km.PubKeys(), nil))
+	data, err := ExportTinkKeyset(pub)
+	if err != nil {
+		t.Fatal("ExportTinkKeyset of public keys failed: " + err.Error())
+	}
+	ir, err := ImportTinkKeyset(data)
+	if err != nil {
+		t.Fatal("ImportTinkKeyset of public keys failed: " + err.Error())
+	}
+	testVerifyPublic(t, "tink public import", keyManagerReader(mustJSONs(km, nil)), ir)
+
+	km = NewKeyManager()
+	km.Create("tink", P_SIGN_AND_VERIFY, T_DSA_PRIV)
+	km.AddKey(0, S_PRIMARY)
+	if _, err := ExportTinkKeyset(keyManagerReader(mustJSONs(km, nil))); err != ErrUnsupportedType {
+		t.Errorf("ExportTinkKeyset of DSA keys: got %v, want ErrUnsupportedType", err)
+	}
+	gcm := []byte(`{"primaryKeyId":1,"key":[{"keyData":{"typeUrl":"type.googleapis.com/google.crypto.tink.AesGcmKey","value":"GhCS/1+ejWpx68NfGt6ziYHd","keyMaterialType":"SYMMETRIC"},"status":"ENABLED","keyId":1,"outputPrefixType":"TINK"}]}`)
+	if _, err := ImportTinkKeyset(gcm); err != ErrUnsupportedType {
+		t.Errorf("ImportTinkKeyset of AES-GCM keys: got %v, want ErrUnsupportedType", err)
+	}
+}
+
+func TestFingerprint(t *testing.T) {
+	km := NewKeyManager()
+	km.Create("fingerprint", P_SIGN_AND_VERIFY, T_EC_PRIV)
+	km.AddKey(0, S_ACTIVE)
+	km.AddKey(0, S_PRIMARY)
+	signer, _ := NewSigner(keyManagerReader(mustJSONs(km, nil)))
+	verifier, _ := NewVerifier(keyManagerReader(mustJSONs(km.PubKeys(), nil)))
+	sig, _ := signer.Sign([]byte(INPUT))
+	_, info, _ := verifier.(InfoVerifier).VerifyWithInfo([]byte(INPUT), sig)
+	if h := verifier.(KeyIdentifier).KeyHash(PrimaryKeyVersion); !bytes.Equal(h, info.KeyHash) {
+		t.Errorf("primary key hash %x, signature made with %x", h, info.KeyHash)
+	}
+	if h := signer.(KeyIdentifier).KeyHash(1); h == nil || bytes.Equal(h, info.KeyHash) {
+		t.Errorf("wrong key hash for version 1: %x", h)
+	}
+	if h := signer.(KeyIdentifier).KeyHash(3); h != nil {
+		t.Errorf("key hash for a missing version: %x", h)
+	}
+	pubpem, _ := ExportPublicKeyPEM(keyManagerReader(mustJSONs(km, nil)), 2)
+	block, _ := pem.Decode(pubpem)
+	sum := sha256.Sum256(block.Bytes)
+	for _, ki := range []KeyIdentifier{signer.(KeyIdentifier), verifier.(KeyIdentifier)} {
+		if fp, err := ki.Fingerprint(2); err != nil || fp != encodeWeb64String(sum[:]) {
+			t.Errorf("fingerprint: got %q, %v", fp, err)
+		}
+	}
+	if _, err := verifier.(KeyIdentifier).Fingerprint(3); err != ErrNoSuchKeyVersion {
+		t.Errorf("fingerprint of a missing version: got %v", err)
+	}
+
+	km = NewKeyManager()
+	km.Create("fingerprint", P_DECRYPT_AND_ENCRYPT, T_AES)
+	km.AddKey(0, S_PRIMARY)
+	crypter, _ := NewCrypter(keyManagerReader(mustJSONs(km, nil)))
+	if _, err := crypter.(KeyIdentifier).Fingerprint(PrimaryKeyVersion); err != ErrUnsupportedType {
+		t.Errorf("fingerprint of a symmetric key: got %v", err)
+	}
+}
+
+func TestJWK(t *testing.T) {
+	for _, kt := range []KeyType{T_RSA_PRIV, T_EC_PRIV, T_ED25519_PRIV} {
+		km := NewKeyManager()
+		km.Create("jwk", P_SIGN_AND_VERIFY, kt)
+		km.AddKey(0, S_ACTIVE)
+		km.AddKey(0, S_PRIMARY)
+		if _, err := ExportPrivateJWK(keyManagerReader(mustJSONs(km, nil)), 2); err != ErrKeyNotExportable {
+			t.Errorf("expected ErrKeyNotExportable exporting unmarked %s key, got %v", kt, err)
+		}
+		km.(ExportableController).MarkExportable(2, ConfirmExportable)
+		r := keyManagerReader(mustJSONs(km, nil))
+		privjwk, err := ExportPrivateJWK(r, 2)
+		if err != nil {
+			t.Fatalf("failed to export %s private jwk: %s", kt, err)
+		}
+		ir, err := ImportJWK(privjwk)
+		if err != nil {
+			t.Fatalf("failed to import %s private jwk: %s", kt, err)
+		}
+		testSignVerify(t, kt.String()+" jwk", ir)
+		testVerifyPublic(t, kt.String()+" jwk", ir, r)
+		pubjwks, err := ExportJWKS(r)
+		if err != nil {
+			t.Fatalf("failed to export %s jwks: %s", kt, err)
+		}
+		pr, err := ImportJWKS(pubjwks)
+		if err != nil {
+			t.Fatalf("failed to import %s jwks: %s", kt, err)
+		}
+		// version 2 was the primary, so it should be first in the set
+		testVerifyPublic(t, kt.String()+" jwks", r, pr)
+		pubjwk, _ := ExportPublicJWK(pr, PrimaryKeyVersion)
+		if !strings.Contains(string(pubjwk), `"use":"sig"`) || strings.Contains(string(pubjwk), `"d"`) {
+			t.Errorf("unexpected %s public jwk: %s", kt, pubjwk)
+		}
+	}
+	// RFC 7517 appendix A.1 example EC public key
+	ec := `{"kty":"EC","crv":"P-256","x":"MKBCTNIcKUSDii11ySs3526iDZ8AiTo7Tu6KPAqv7D4","y":"4Etl6SRW2YiLUrN5vfvVHuhp7x8PxltmWWlbbM4IFyM","use":"sig","kid":"1"}`
+	if _, err := ImportJWK([]byte(ec)); err != nil {
+		t.Error("failed to import rfc 7517 ec key: " + err.Error())
+	}
+	if _, err := ImportJWK([]byte(`{"kty":"oct","k":"AyM1SysPpbyDfgZld3umj1qzKObwVMkoqQ-EstJQLr_T-1qS0gZH75aKtMN3Yj0iPS4hcgUuTwjAzZr1Z9CAow"}`)); err != ErrUnsupportedType {
+		t.Error("expected ErrUnsupportedType for oct jwk, got", err)
+	}
+}
+
+func TestJWE(t *testing.T) {
+	km := NewKeyManager()
+	km.Create("jwe", P_DECRYPT_AND_ENCRYPT, T_RSA_PRIV)
+	km.AddKey(1024, S_PRIMARY)
+	old, _ := NewEncrypter(keyManagerReader(mustJSONs(km.PubKeys(), nil)))
+	km.AddKey(1024, S_PRIMARY)
+	crypter, _ := NewCrypter(keyManagerReader(mustJSONs(km, nil)))
+	for _, enc := range []string{JWE_A128CBC_HS256, JWE_A256GCM} {
+		for _, e := range []Encrypter{old, crypter} {
+			token, err := EncryptJWE(e, []byte(INPUT), enc)
+			if err != nil {
+				t.Fatalf("%s: EncryptJWE failed: %s", enc, err)
+			}
+			if p, err := DecryptJWE(crypter, token); err != nil || string(p) != INPUT {
+				t.Errorf("%s: DecryptJWE got %q, %v", enc, p, err)
+			}
+			parts := strings.Split(token, ".")
+			for i := 1; i < 5; i++ {
+				b, _ := decodeWeb64String(parts[i])
+				b[len(b)/2] ^= 1
+				tampered := append([]string(nil), parts...)
+				tampered[i] = encodeWeb64String(b)
+				if _, err := DecryptJWE(crypter, strings.Join(tampered, ".")); err != ErrInvalidSignature {
+					t.Errorf("%s: tampered part %d: got %v, want ErrInvalidSignature", enc, i, err)
+				}
+			}
+		}
+	}
+	if _, err := EncryptJWE(crypter, []byte(INPUT), "A192GCM"); err != ErrUnsupportedType {
+		t.Errorf("EncryptJWE with an unsupported algorithm: got %v", err)
+	}
+	if _, err := DecryptJWE(crypter, "a.b.c"); err != ErrMalformedJWE {
+		t.Errorf("DecryptJWE of a JWS: got %v, want ErrMalformedJWE", err)
+	}
+
+	km = NewKeyManager()
+	km.Create("jwe", P_DECRYPT_AND_ENCRYPT, T_AES)
+	km.AddKey(0, S_PRIMARY)
+	aesCrypter, _ := NewCrypter(keyManagerReader(mustJSONs(km, nil)))
+	if _, err := EncryptJWE(aesCrypter, []byte(INPUT), JWE_A256GCM); err != ErrUnsupportedType {
+		t.Errorf("EncryptJWE with an AES key: got %v, want ErrUnsupportedType", err)
+	}
+}
+
+func TestJWT(t *testing.T) {
+	for _, kt := range []KeyType{T_HMAC_SHA1, T_RSA_PRIV, T_EC_PRIV, T_ED25519_PRIV} {
+		km := NewKeyManager()
+		km.Create("jwt", P_SIGN_AND_VERIFY, kt)
+		km.AddKey(0, S_PRIMARY)
+		r := keyManagerReader(mustJSONs(km, nil))
+		signer, _ := NewSigner(r)
+		exp := time.Now().Add(time.Hour).Unix()
+		token, err := SignJWT(signer, map[string]interface{}{"sub": "alice", "exp": exp})
+		if err != nil {
+			t.Fatalf("failed to sign %s jwt: %s", kt, err)
+		}
+		// key rotation: the old primary stays valid through the kid header
+		km.AddKey(0, S_PRIMARY)
+		verifier, _ := NewVerifier(keyManagerReader(mustJSONs(km, nil)))
+		claims, err := VerifyJWT(verifier, token)
+		if err != nil {
+			t.Fatalf("failed to verify %s jwt: %s", kt, err)
+		}
+		if claims["sub"] != "alice" {
+			t.Errorf("%s jwt claims mismatch: %v", kt, claims)
+		}
+		// only the last character of the signature can hold unused bits
+		forged := []byte(token)
+		if forged[len(forged)-2] == 'A' {
+			forged[len(forged)-2] = 'B'
+		} else {
+			forged[len(forged)-2] = 'A'
+		}
+		if _, err := VerifyJWT(verifier, string(forged)); err == nil {
+			t.Errorf("%s jwt verified with a modified signature", kt)
+		}
+		late, _ := NewVerifierTimeProvider(r, func() int64 { return (exp + 1) * 1000 })
+		if _, err := VerifyJWT(late, token); err != ErrJWTExpired {
+			t.Errorf("expected ErrJWTExpired for %s jwt, got %v", kt, err)
+		}
+	}
+}
+
+func TestPASETO(t *testing.T) {
+	exp := time.Now().Add(time.Hour).UTC().Format(time.RFC3339)
+	for _, version := range []string{PASETO_V2, PASETO_V4} {
+		km := NewKeyManager()
+		km.Create("paseto", P_DECRYPT_AND_ENCRYPT, T_CHACHA20_POLY1305)
+		km.AddKey(0, S_PRIMARY)
+		crypter, _ := NewCrypter(keyManagerReader(mustJSONs(km, nil)))
+		token, err := EncryptPASETO(crypter, version, map[string]interface{}{"sub": "alice", "exp": exp})
+		if err != nil {
+			t.Fatalf("failed to encrypt %s paseto: %s", version, err)
+		}
+		if !strings.HasPrefix(token, version+".local.") {
+			t.Errorf("unexpected %s local paseto header: %s", version, token)
+		}
+		// key rotation: the old primary stays valid through the footer kid
+		km.AddKey(0, S_PRIMARY)
+		crypter, _ = NewCrypter(keyManagerReader(mustJSONs(km, nil)))
+		claims, err := DecryptPASETO(crypter, token)
+		if err != nil {
+			t.Fatalf("failed to decrypt %s paseto: %s", version, err)
+		}
+		if claims["sub"] != "alice" {
+			t.Errorf("%s local paseto claims mismatch: %v", version, claims)
+		}
+		parts := strings.Split(token, ".")
+		payload, _ := decodeWeb64String(parts[2])
+		payload[len(payload)-1] ^= 1
+		parts[2] = encodeWeb64String(payload)
+		if _, err := DecryptPASETO(crypter, strings.Join(parts, ".")); err != ErrInvalidSignature {
+			t.Errorf("expected ErrInvalidSignature for a modified %s local paseto, got %v", version, err)
+		}
+		expired, _ := EncryptPASETO(crypter, version, map[string]interface{}{"exp": "2020-01-01T00:00:00Z"})
+		if _, err := DecryptPASETO(crypter, expired); err != ErrPASETOExpired {
+			t.Errorf("expected ErrPASETOExpired for %s local paseto, got %v", version, err)
+		}
+
+		km = NewKeyManager()
+		km.Create("paseto", P_SIGN_AND_VERIFY, T_ED25519_PRIV)
+		km.AddKey(0, S_PRIMARY)
+		r := keyManagerReader(mustJSONs(km, nil))
+		signer, _ := NewSigner(r)
+		token, err = SignPASETO(signer, version, map[string]interface{}{"sub": "alice", "exp": exp})
+		if err != nil {
+			t.Fatalf("failed to sign %s paseto: %s", version, err)
+		}
+		km.AddKey(0, S_PRIMARY)
+		verifier, _ := NewVerifier(keyManagerReader(mustJSONs(km.PubKeys(), nil)))
+		if claims, err = VerifyPASETO(verifier, token); err != nil {
+			t.Fatalf("failed to verify %s paseto: %s", version, err)
+		}
+		if claims["sub"] != "alice" {
+			t.Errorf("%s public paseto claims mismatch: %v", version, claims)
+		}
+		if _, err := VerifyPASETO(verifier, strings.Replace(token, "public", "local", 1)); err != ErrUnsupportedType {
+			t.Errorf("expected ErrUnsupportedType for a %s public paseto relabeled as local, got %v", version, err)
+		}
+		late, _ := NewVerifierTimeProvider(r, func() int64 { return time.Now().Add(2*time.Hour).UnixNano() / 1e6 })
+		if _, err := VerifyPASETO(late, token); err != ErrPASETOExpired {
+			t.Errorf("expected ErrPASETOExpired for %s public paseto, got %v", version, err)
+		}
+	}
+
+	// test vector 4-S-1 of the PASETO specification
+	seed, _ := hex.DecodeString("b4cbfb43df4ce210727d953e4a713307fa19bb7d9f85041438d9e11b942a3774")
+	der, _ := x509.MarshalPKCS8PrivateKey(ed25519.NewKeyFromSeed(seed))
+	r, err := ImportEd25519KeyFromPEMForSigning(writeTempPEM(t, "PRIVATE KEY", der))
+	if err != nil {
+		t.Fatal("failed to import ed25519 private key: " + err.Error())
+	}
+	token := "v4.public.eyJkYXRhIjoidGhpcyBpcyBhIHNpZ25lZCBtZXNzYWdlIiwiZXhwIjoiMjAyMi0wMS0wMVQwMDowMDowMCswMDowMCJ9bg_XBBzds8lTZShVlwwKSgeKpLT3yukTw6JUz3W4h_ExsQV-P0V54zemZDcAxFaSeef1QlXEFtkqxT1ciiQEDA"
+	early, _ := NewVerifierTimeProvider(r, func() int64 { return time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC).UnixNano() / 1e6 })
+	claims, err := VerifyPASETO(early, token)
+	if err != nil {
+		t.Fatal("failed to verify paseto test vector: " + err.Error())
+	}
+	if claims["data"] != "this is a signed message" {
+		t.Errorf("paseto test vector claims mismatch: %v", claims)
+	}
+}
+
+func TestAge(t *testing.T) {
+	for _, kt := range []KeyType{T_X25519_PRIV, T_RSA_PRIV} {
+		km := NewKeyManager()
+		km.Create("age", P_DECRYPT_AND_ENCRYPT, kt)
+		km.AddKey(0, S_PRIMARY)
+		crypter, _ := NewCrypter(keyManagerReader(mustJSONs(km, nil)))
+		recipient, err := AgeRecipient(crypter)
+		if err != nil {
+			t.Fatalf("failed to get %s age recipient: %s", kt, err)
+		}
+		if !strings.HasPrefix(recipient, "age1") && !strings.HasPrefix(recipient, "ssh-rsa ") {
+			t.Errorf("unexpected %s age recipient: %s", kt, recipient)
+		}
+		// empty, exactly one chunk and several chunks
+		for _, size := range []int{0, 64 * 1024, 150000} {
+			plaintext := make([]byte, size)
+			io.ReadFull(rand.Reader, plaintext)
+			var file bytes.Buffer
+			w, err := EncryptAge(crypter, &file)
+			if err != nil {
+				t.Fatalf("failed to start %s age encryption: %s", kt, err)
+			}
+			w.Write(plaintext)
+			if err := w.Close(); err != nil {
+				t.Fatalf("failed to finish %s age encryption: %s", kt, err)
+			}
+			if !bytes.HasPrefix(file.Bytes(), []byte("age-encryption.org/v1\n")) {
+				t.Errorf("%s age file has no age header", kt)
+			}
+			r, err := DecryptAge(crypter, bytes.NewReader(file.Bytes()))
+			if err != nil {
+				t.Fatalf("failed to decrypt %s age file: %s", kt, err)
+			}
+			out, err := ioutil.ReadAll(r)
+			if err != nil || !bytes.Equal(out, plaintext) {
+				t.Errorf("%s age round trip of %d bytes failed: %v", kt, size, err)
+			}
+			if size == 0 {
+				continue
+			}
+			truncated := file.Bytes()[:file.Len()-1000]
+			if r, err = DecryptAge(crypter, bytes.NewReader(truncated)); err == nil {
+				_, err = ioutil.ReadAll(r)
+			}
+			if err != ErrInvalidSignature {
+				t.Errorf("expected ErrInvalidSignature for a truncated %s age file, got %v", kt, err)
+			}
+		}
+		other := NewKeyManager()
+		other.Create("age", P_DECRYPT_AND_ENCRYPT, kt)
+		other.AddKey(0, S_PRIMARY)
+		var file bytes.Buffer
+		w, _ := EncryptAge(crypter, &file)
+		w.Close()
+		otherCrypter, _ := NewCrypter(keyManagerReader(mustJSONs(other, nil)))
+		if _, err := DecryptAge(otherCrypter, &file); err != ErrKeyNotFound {
+			t.Errorf("expected ErrKeyNotFound decrypting %s age file with another key set, got %v", kt, err)
+		}
+	}
+
+	km := NewKeyManager()
+	km.Create("age", P_DECRYPT_AND_ENCRYPT, T_X25519_PRIV)
+	km.AddKey(0, S_PRIMARY)
+	if _, err := ExportAgeIdentity(keyManagerReader(mustJSONs(km, nil)), PrimaryKeyVersion); err != ErrKeyNotExportable {
+		t.Errorf("expected ErrKeyNotExportable for an unmarked age identity, got %v", err)
+	}
+	km.(ExportableController).MarkExportable(1, ConfirmExportable)
+	identity, err := ExportAgeIdentity(keyManagerReader(mustJSONs(km, nil)), PrimaryKeyVersion)
+	if err != nil || !strings.HasPrefix(identity, "AGE-SECRET-KEY-1") {
+		t.Errorf("failed to export age identity: %q %v", identity, err)
+	}
+
+	// the identity and recipient of the age test key with scalar 0x42 repeated, and a BIP 173 vector
+	scalar := bytes.Repeat([]byte{0x42}, 32)
+	point, _ := curve25519.X25519(scalar, curve25519.Basepoint)
+	if s := strings.ToUpper(bech32Encode("age-secret-key-", scalar)); s != "AGE-SECRET-KEY-1GFPYYSJZGFPYYSJZGFPYYSJZGFPYYSJZGFPYYSJZGFPYYSJZGFPQ4EGAEX" {
+		t.Errorf("age identity mismatch: %s", s)
+	}
+	if s := bech32Encode("age", point); s != "age1zvkyg2lqzraa2lnjvqej32nkuu0ues2s82hzrye869xeexvn73equnujwj" {
+		t.Errorf("age recipient mismatch: %s", s)
+	}
+	if s := bech32Encode("a", nil); s != "a12uel5l" {
+		t.Errorf("bech32 mismatch: %s", s)
+	}
+}
+
+func TestGeneratedEd25519(t *testing.T) {
+	km := NewKeyManager()
+	km.Create("ed25519", P_SIGN_AND_VERIFY, T_ED25519_PRIV)
+	if err := km.AddKey(0, S_PRIMARY); err != nil {
+		t.Fatal("failed to generate ed25519 key: " + err.Error())
+	}
+	r := keyManagerReader(mustJSONs(km, nil))
+	testSignVerify(t, "ed25519 generated", r)
+	testVerifyPublic(t, "ed25519 generated", r, keyManagerReader(mustJSONs(km.PubKeys(), nil)))
+}
+
+func TestEd25519PEMImport(t *testing.T) {
+	pub, priv, _ := ed25519.GenerateKey(rand.Reader)
+	der, _ := x509.MarshalPKCS8PrivateKey(priv)
+	r, err := ImportEd25519KeyFromPEMForSigning(writeTempPEM(t, "PRIVATE KEY", der))
+	if err != nil {
+		t.Fatal("failed to import ed25519 private key: " + err.Error())
+	}
+	der, _ = x509.MarshalPKIXPublicKey(pub)
+	pr, err := ImportEd25519PublicKeyFromPEMForVerify(writeTempPEM(t, "PUBLIC KEY", der))
+	if err != nil {
+		t.Fatal("failed to import ed25519 public key: " + err.Error())
+	}
+	testSignVerify(t, "ed25519 pem import", r)
+	testVerifyPublic(t, "ed25519 pem import", r, pr)
+	block, _ := ssh.MarshalPrivateKey(priv, "")
+	sr, err := ImportEd25519KeyFromPEMForSigning(writeTempPEM(t, block.Type, block.Bytes))
+	if err != nil {
+		t.Fatal("failed to import openssh ed25519 private key: " + err.Error())
+	}
+	testVerifyPublic(t, "ed25519 openssh import", sr, pr)
+}
+
+func TestSSHPublicKeyImport(t *testing.T) {
+	_, edpriv, _ := ed25519.GenerateKey(rand.Reader)
+	der, _ := x509.MarshalPKCS8PrivateKey(edpriv)
+	edr, _ := ImportPKCS8KeyFromPEMBytesForSigning(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}))
+	rsapriv, _ := rsa.GenerateKey(rand.Reader, 2048)
+	rsar, _ := ImportRSAKeyFromPEMBytesForSigning(pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(rsapriv)}))
+	for _, tt := range []struct {
+		name string
+		pub  interface{}
+		r    KeyReader
+	}{
+		{"ssh-ed25519", edpriv.Public(), edr},
+		{"ssh-rsa", &rsapriv.PublicKey, rsar},
+	} {
+		sshpub, _ := ssh.NewPublicKey(tt.pub)
+		line := `from="10.0.0.0/8" ` + strings.TrimSpace(string(ssh.MarshalAuthorizedKey(sshpub))) + " dev@example.com"
+		pr, err := ImportSSHPublicKeyForVerify(line)
+		if err != nil {
+			t.Fatalf("failed to import %s key: %s", tt.name, err)
+		}
+		testVerifyPublic(t, tt.name+" authorized_keys import", tt.r, pr)
+	}
+	if _, err := ImportSSHPublicKeyForVerify("ssh-ed25519 not-base64"); err == nil {
+		t.Error("imported a malformed authorized_keys line")
+	}
+}
+
+func TestGeneratedX25519(t *testing.T) {
+	km := NewKeyManager()
+	km.Create("x25519", P_DECRYPT_AND_ENCRYPT, T_X25519_PRIV)
+	if err := km.AddKey(0, S_PRIMARY); err != nil {
+		t.Fatal("failed to generate x25519 key: " + err.Error())
+	}
+	r := keyManagerReader(mustJSONs(km, nil))
+	testEncryptDecrypt(t, "x25519 generated", r)
+	pub := keyManagerReader(mustJSONs(km.PubKeys(), nil))
+	kz, err := NewEncrypter(pub)
+	if err != nil {
+		t.Fatal("failed to create x25519 public encrypter: " + err.Error())
+	}
+	c, err := kz.Encrypt([]byte(INPUT))
+	if err != nil {
+		t.Fatal("failed to encrypt with x25519 public key: " + err.Error())
+	}
+	kc, _ := NewCrypter(r)
+	if p, err := kc.Decrypt(c); err != nil || string(p) != INPUT {
+		t.Error("x25519 public encrypt / private decrypt failed")
+	}
+	b, _ := decodeWeb64String(c)
+	b[len(b)-1] ^= 1
+	if _, err := kc.Decrypt(encodeWeb64String(b)); err == nil {
+		t.Error("x25519 decrypted a tampered ciphertext")
+	}
+	sess, keys, err := NewSessionEncrypter(kz)
+	if err != nil {
+		t.Fatal("failed to create x25519 session encrypter: " + err.Error())
+	}
+	c, _ = sess.Encrypt([]byte(INPUT))
+	sessd, err := NewSessionDecrypter(kc, keys)
+	if err != nil {
+		t.Fatal("failed to create x25519 session decrypter: " + err.Error())
+	}
+	if p, err := sessd.Decrypt(c); err != nil || string(p) != INPUT {
+		t.Error("x25519 session decrypt(encrypt(p)) != p")
+	}
+}
+
+func TestGeneratedChaCha20Poly1305(t *testing.T) {
+	km := NewKeyManager()
+	km.Create("chacha", P_DECRYPT_AND_ENCRYPT, T_CHACHA20_POLY1305)
+	km.AddKey(0, S_ACTIVE)
+	if err := km.AddKey(0, S_PRIMARY); err != nil {
+		t.Fatal("failed to generate chacha20poly1305 key: " + err.Error())
+	}
+	r := keyManagerReader(mustJSONs(km, nil))
+	testEncryptDecrypt(t, "chacha20poly1305 generated", r)
+	kz, _ := NewCrypter(r)
+	c, _ := kz.Encrypt([]byte(INPUT))
+	b, _ := decodeWeb64String(c)
+	b[len(b)-1] ^= 1
+	if _, err := kz.Decrypt(encodeWeb64String(b)); err == nil {
+		t.Error("chacha20poly1305 decrypted a tampered ciphertext")
+	}
+	if _, err := NewCryptStreamer(r); err != ErrCannotStream {
+		t.Error("chacha20poly1305 keys should not support streaming")
+	}
+}
+
+func TestAESSIVVector(t *testing.T) {
+	// RFC 5297, appendix A.1
+	key, _ := hex.DecodeString("fffefdfcfbfaf9f8f7f6f5f4f3f2f1f0f0f1f2f3f4f5f6f7f8f9fafbfcfdfeff")
+	ad, _ := hex.DecodeString("101112131415161718191a1b1c1d1e1f2021222324252627")
+	plaintext, _ := hex.DecodeString("112233445566778899aabbccddee")
+	expected := "85632d07c6e8f37f950acd320a2ecc9340c02b9690c4dc04daef7f6afe5c"
+	sk := &aesSIVKey{key: key}
+	c, err := sk.seal(nil, plaintext, ad)
+	if err != nil || hex.EncodeToString(c) != expected {
+		t.Errorf("aes-siv: got %x, expected %s (%v)", c, expected, err)
+	}
+	if p, err := sk.open(c, ad); err != nil || !bytes.Equal(p, plaintext) {
+		t.Errorf("aes-siv: failed to open the test vector: %v", err)
+	}
+}
+
+func TestGeneratedAESSIV(t *testing.T) {
+	km := NewKeyManager()
+	km.Create("siv", P_DECRYPT_AND_ENCRYPT, T_AES_SIV)
+	km.AddKey(0, S_ACTIVE)
+	if err := km.AddKey(0, S_PRIMARY); err != nil {
+		t.Fatal("failed to generate aes-siv key: " + err.Error())
+	}
+	r := keyManagerReader(mustJSONs(km, nil))
+	if _, err := NewCrypter(r); err != ErrDeterministicKey {
+		t.Errorf("randomized crypter created from a deterministic key set: %v", err)
+	}
+	dc, err := NewDeterministicCrypter(r)
+	if err != nil {
+		t.Fatal("failed to create deterministic crypter: " + err.Error())
+	}
+	c1, _ := dc.EncryptDeterministically([]byte(INPUT), []byte("users.email"))
+	c2, _ := dc.EncryptDeterministically([]byte(INPUT), []byte("users.email"))
+	if c1 != c2 {
+		t.Error("aes-siv encryption is not deterministic")
+	}
+	if c3, _ := dc.EncryptDeterministically([]byte(INPUT), []byte("users.name")); c3 == c1 {
+		t.Error("associated data doesn't change the ciphertext")
+	}
+	if p, err := dc.DecryptDeterministically(c1, []byte("users.email")); err != nil || string(p) != INPUT {
+		t.Errorf("aes-siv decrypt(encrypt(p)) != p: %v", err)
+	}
+	if _, err := dc.DecryptDeterministically(c1, []byte("users.name")); !errors.Is(err, ErrWrongKey) {
+		t.Errorf("decrypted with the wrong associated data: %v", err)
+	}
+
+	km = NewKeyManager()
+	km.Create("aes", P_DECRYPT_AND_ENCRYPT, T_AES)
+	km.AddKey(0, S_PRIMARY)
+	if _, err := NewDeterministicCrypter(keyManagerReader(mustJSONs(km, nil))); err != ErrNotDeterministicKey {
+		t.Errorf("deterministic crypter created from an aes key set: %v", err)
+	}
+}
+
+// write a PEM block to a temporary file and return its name
+func writeTempPEM(t *testing.T, blockType string, der []byte) string {
+	name := filepath.Join(t.TempDir(), "key.pem")
+	b := pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der})
+	if err := ioutil.WriteFile(name, b, 0600); err != nil {
+		t.Fatal("failed to write pem file: " + err.Error())
+	}
+	return name
+}
+
+func TestEncryptedReader(t *testing.T) {
+	f := NewFileReader(TESTDATA + "aes")
+	cr, err := NewCrypter(f)
+	if err != nil {
+		t.Fatal("failed to create crypter for keytype aes")
+	}
+	er := NewEncryptedReader(NewFileReader(TESTDATA+"aes-crypted"), cr)
+	testDecrypt(t, "aes-crypted", er)
+}
+
+func TestPBEReader(t *testing.T) {
+	f := NewFileReader(TESTDATA + "pbe_json")
+	er := NewPBEReader(f, []byte("cartman"))
+	testEncryptDecrypt(t, "pbe_json", er)
+	testEncryptDecryptReader(t, "pbe_json", er)
+}
+
+func TestKeysetEncryptionMismatch(t *testing.T) {
+	kek := NewKeyManager()
+	kek.Create("kek", P_DECRYPT_AND_ENCRYPT, T_AES)
+	kek.AddKey(0, S_PRIMARY)
+	crypter, _ := NewCrypter(keyManagerReader(mustJSONs(kek, nil)))
+
+	km := NewKeyManager()
+	km.Create("mismatch", P_DECRYPT_AND_ENCRYPT, T_AES)
+	km.AddKey(0, S_PRIMARY)
+	encrypted := keyManagerReader(mustJSONs(km, crypter))
+	plain := keyManagerReader(mustJSONs(km, nil))
+
+	_, err := NewCrypter(encrypted)
+	var kerr *KeysetEncryptionError
+	if !errors.As(err, &kerr) || !kerr.Encrypted || kerr.Name != "mismatch" || !errors.Is(err, ErrKeysetEncrypted) {
+		t.Errorf("encrypted key set loaded without decrypting: %v", err)
+	}
+	if _, err := NewCrypter(NewEncryptedReader(plain, crypter)); !errors.Is(err, ErrKeysetNotEncrypted) {
+		t.Errorf("plaintext key set loaded through a decrypting reader: %v", err)
+	}
+	if _, err := NewCrypter(NewEncryptedReader(encrypted, crypter)); err != nil {
+		t.Error("failed to load the encrypted key set: " + err.Error())
+	}
+	if _, err := NewCrypterWithContext(context.Background(), NewEncryptedReader(encrypted, crypter)); err != nil {
+		t.Error("failed to load the encrypted key set through a context reader: " + err.Error())
+	}
+
+	// exporting decrypts the keys, and the metadata says so
+	b, err := ExportJSON(NewEncryptedReader(encrypted, crypter))
+	if err != nil {
+		t.Fatal("ExportJSON failed: " + err.Error())
+	}
+	exported, _ := NewJSONReader(b)
+	if _, err := NewCrypter(exported); err != nil {
+		t.Error("failed to load the decrypted export: " + err.Error())
+	}
+
+	// reloading and writing a key set without an encrypter writes it plaintext
+	km2 := NewKeyManager()
+	if err := km2.Load(NewEncryptedReader(encrypted, crypter)); err != nil {
+		t.Fatal("failed to load the encrypted key set: " + err.Error())
+	}
+	if _, err := NewCrypter(keyManagerReader(mustJSONs(km2, nil))); err != nil {
+		t.Error("failed to load the key set written without an encrypter: " + err.Error())
+	}
+
+	issues := ValidateKeyset(encrypted)
+	if len(issues) == 0 || !errors.Is(issues[0].Err, ErrKeysetEncrypted) || issues[0].Severity != ISSUE_ERROR {
+		t.Errorf("ValidateKeyset didn't report the encrypted key set: %v", issues)
+	}
+	issues = ValidateKeyset(NewEncryptedReader(plain, crypter))
+	if len(issues) == 0 || !errors.Is(issues[0].Err, ErrKeysetNotEncrypted) || issues[0].Severity != ISSUE_WARNING {
+		t.Errorf("ValidateKeyset didn't warn about the decrypting reader: %v", issues)
+	}
+}
+
+func TestPBEMalformed(t *testing.T) {
+	pbe := NewPBECrypter([]byte("cartman"))
+	c, _ := pbe.Encrypt([]byte(INPUT))
+	var pbejson pbeKeyJSON
+	json.Unmarshal([]byte(c), &pbejson)
+	pbejson.Iv = encodeWeb64String([]byte{1, 2, 3})
+	badIV, _ := json.Marshal(pbejson)
+	// bad input must be an error, never a panic in the cbc code
+	for _, bad := range []string{"", "not json", string(badIV), strings.Replace(c, `"key":"`, `"key":"AAAA`, 1)} {
+		if _, err := pbe.Decrypt(bad); err != ErrBadCiphertextFormat {
+			t.Errorf("pbe decrypt of %q: got %v, want ErrBadCiphertextFormat", bad, err)
+		}
+	}
+	// there is no key set to reload
+	if _, ok := pbe.(ReloadController); ok {
+		t.Error("the PBE crypter claims to reload")
+	}
+}
+
+func TestPBEKDFs(t *testing.T) {
+	password := []byte("cartman")
+	reader := NewPBECrypter(password)
+	for _, kdf := range []PBEKDF{PBE_PBKDF2_SHA1, PBE_PBKDF2_SHA256, PBE_SCRYPT, PBE_ARGON2ID} {
+		pbe := NewPBECrypterWithKDF(password, kdf)
+		c, err := pbe.Encrypt([]byte(INPUT))
+		if err != nil {
+			t.Fatalf("kdf %d: encrypt failed: %v", kdf, err)
+		}
+		// the parameters travel with the key, so the default crypter can read it
+		p, err := reader.Decrypt(c)
+		if err != nil || strings.TrimRight(string(p), " ") != INPUT {
+			t.Errorf("kdf %d: decrypt failed: %q %v", kdf, p, err)
+		}
+		if p, err := NewPBECrypter([]byte("kenny")).Decrypt(c); err == nil && strings.TrimRight(string(p), " ") == INPUT {
+			t.Errorf("kdf %d: decrypted with the wrong password", kdf)
+		}
+	}
+
+	c, _ := NewPBECrypterWithKDF(password, PBE_SCRYPT).Encrypt([]byte(INPUT))
+	var pbejson pbeKeyJSON
+	json.Unmarshal([]byte(c), &pbejson)
+	if pbejson.Cipher != "AES256" || pbejson.KDF != "SCRYPT" {
+		t.Errorf("scrypt key: got cipher %q kdf %q", pbejson.Cipher, pbejson.KDF)
+	}
+
+	tests := []struct {
+		name   string
+		modify func(*pbeKeyJSON)
+		err    error
+	}{
+		{"unknown cipher", func(p *pbeKeyJSON) { p.Cipher = "DES" }, ErrUnsupportedType},
+		{"unknown kdf", func(p *pbeKeyJSON) { p.KDF = "BCRYPT" }, ErrUnsupportedType},
+		{"scrypt N not a power of two", func(p *pbeKeyJSON) { p.IterationCount = 1000 }, ErrBadCiphertextFormat},
+		{"scrypt N too large", func(p *pbeKeyJSON) { p.IterationCount = 1 << 30 }, ErrBadCiphertextFormat},
+		{"scrypt r missing", func(p *pbeKeyJSON) { p.Memory = 0 }, ErrBadCiphertextFormat},
+		{"argon2 memory too large", func(p *pbeKeyJSON) { p.KDF, p.IterationCount, p.Memory = "ARGON2ID", 1, 1<<30 }, ErrBadCiphertextFormat},
+		{"argon2 no threads", func(p *pbeKeyJSON) { p.KDF, p.IterationCount, p.Parallelism = "ARGON2ID", 1, 0 }, ErrBadCiphertextFormat},
+		{"pbkdf2 unknown hmac", func(p *pbeKeyJSON) { p.KDF, p.HMAC = "", "HMAC_MD5" }, ErrUnsupportedType},
+	}
+	for _, tt := range tests {
+		bad := pbejson
+		tt.modify(&bad)
+		b, _ := json.Marshal(bad)
+		if _, err := reader.Decrypt(string(b)); err != tt.err {
+			t.Errorf("%s: got %v, want %v", tt.name, err, tt.err)
+		}
+	}
+}
+
+func TestPBEMinIterations(t *testing.T) {
+	password := []byte("cartman")
+	var pbejson pbeKeyJSON
+	pbejson.Cipher = "AES128"
+	pbejson.HMAC = "HMAC_SHA1"
+	pbejson.IterationCount = 1000
+	salt, iv := make([]byte, 16), make([]byte, 16)
+	pbejson.Salt = encodeWeb64String(salt)
+	pbejson.Iv = encodeWeb64String(iv)
+	derive, _ := pbejson.keyDerivation(0)
+	key, _ := derive(password, salt)
+	block, _ := aes.NewCipher(key)
+	ciphertext := make([]byte, 16)
+	cipher.NewCBCEncrypter(block, iv).CryptBlocks(ciphertext, []byte("0123456789abcdef"))
+	pbejson.Key = encodeWeb64String(ciphertext)
+	b, _ := json.Marshal(pbejson)
+	weak := string(b)
+
+	if _, err := NewPBECrypter(password).Decrypt(weak); err != ErrWeakPBE {
+		t.Errorf("weak key with the default floor: got %v, want ErrWeakPBE", err)
+	}
+	pbe := NewPBECrypter(password, WithPBEMinIterations(0))
+	if pbe.(PBEController).MinIterations() != 0 {
+		t.Errorf("MinIterations: got %d, want 0", pbe.(PBEController).MinIterations())
+	}
+	if p, err := pbe.Decrypt(weak); err != nil || string(p) != "0123456789abcdef" {
+		t.Errorf("weak key with the floor off: got %q %v", p, err)
+	}
+	// only PBKDF2 has an iteration floor
+	c, _ := NewPBECrypterWithKDF(password, PBE_ARGON2ID).Encrypt([]byte(INPUT))
+	if _, err := NewPBECrypter(password, WithPBEMinIterations(10000)).Decrypt(c); err != nil {
+		t.Errorf("argon2id key with a raised floor: %v", err)
+	}
+
+	p, err := GetPBEParams(weak)
+	if err != nil || p.KDF != "PBKDF2" || p.HMAC != "HMAC_SHA1" || p.Iterations != 1000 || !p.Weak() {
+		t.Errorf("GetPBEParams: got %+v %v weak=%v", p, err, p.Weak())
+	}
+	if p, _ := GetPBEParams(c); p.KDF != "ARGON2ID" || p.Weak() {
+		t.Errorf("GetPBEParams of argon2id key: got %+v weak=%v", p, p.Weak())
+	}
+	if _, err := GetPBEParams("not json"); err != ErrBadCiphertextFormat {
+		t.Errorf("GetPBEParams of garbage: got %v, want ErrBadCiphertextFormat", err)
+	}
+
+	km := NewKeyManager()
+	km.Create("pbe", P_DECRYPT_AND_ENCRYPT, T_AES)
+	km.AddKey(0, S_PRIMARY)
+	keys := mustJSONs(km, NewPBEEncrypter(password))
+	issues := ValidateKeyset(NewPBEReader(keyManagerReader(keys), password))
+	if len(issues) != 1 || issues[0].Err != ErrWeakPBE || issues[0].Severity != ISSUE_WARNING {
+		t.Errorf("ValidateKeyset of a default pbe key set: got %v", issues)
+	}
+	keys = mustJSONs(km, NewPBECrypterWithKDF(password, PBE_SCRYPT))
+	if issues := ValidateKeyset(NewPBEReader(keyManagerReader(keys), password)); len(issues) != 0 {
+		t.Errorf("ValidateKeyset of a scrypt key set: got %v", issues)
+	}
+}
+
+func TestDeriveKey(t *testing.T) {
+	km := NewKeyManager()
+	km.Create("derive", P_DECRYPT_AND_ENCRYPT, T_AES)
+	km.AddKey(0, S_PRIMARY)
+	r := keyManagerReader(mustJSONs(km, nil))
+
+	a, err := DeriveKey(r, []byte("component a"), 32)
+	if err != nil {
+		t.Fatal("DeriveKey failed:", err)
+	}
+	if len(a.Key) != 32 || a.Version != 1 || string(a.Info) != "component a" {
+		t.Errorf("DeriveKey: got %+v", a)
+	}
+	again, _ := DeriveKey(r, []byte("component a"), 32)
+	if !bytes.Equal(a.Key, again.Key) {
+		t.Error("DeriveKey isn't reproducible")
+	}
+	b, _ := DeriveKey(r, []byte("component b"), 32)
+	if bytes.Equal(a.Key, b.Key) {
+		t.Error("different info strings gave the same key")
+	}
+
+	// after a rotation the old subkey can still be derived from its recorded version
+	km.AddKey(0, S_PRIMARY)
+	r = keyManagerReader(mustJSONs(km, nil))
+	rotated, _ := DeriveKey(r, a.Info, 32)
+	if rotated.Version != 2 || bytes.Equal(rotated.Key, a.Key) {
+		t.Errorf("DeriveKey after rotation: got version %d", rotated.Version)
+	}
+	old, err := DeriveKeyVersion(r, a.Version, a.Info, 32)
+	if err != nil || !bytes.Equal(old.Key, a.Key) || !bytes.Equal(old.KeyHash, a.KeyHash) {
+		t.Errorf("DeriveKeyVersion: got %v %v", old, err)
+	}
+	if _, err := DeriveKeyVersion(r, 5, a.Info, 32); err != ErrNoSuchKeyVersion {
+		t.Errorf("DeriveKeyVersion of a missing version: got %v, want ErrNoSuchKeyVersion", err)
+	}
+	for _, length := range []int{0, -1, 255*32 + 1} {
+		if _, err := DeriveKey(r, a.Info, length); err != ErrInvalidLength {
+			t.Errorf("DeriveKey of length %d: got %v, want ErrInvalidLength", length, err)
+		}
+	}
+
+	km = NewKeyManager()
+	km.Create("derive", P_SIGN_AND_VERIFY, T_ED25519_PRIV)
+	km.AddKey(0, S_PRIMARY)
+	if _, err := DeriveKey(keyManagerReader(mustJSONs(km, nil)), a.Info, 32); err != ErrNotDerivable {
+		t.Errorf("DeriveKey from ed25519: got %v, want ErrNotDerivable", err)
+	}
+	a.Wipe()
+	if !bytes.Equal(a.Key, make([]byte, 32)) {
+		t.Error("Wipe didn't zero the key")
+	}
+}
+
+func TestJSONReader(t *testing.T) {
+	km := NewKeyManager()
+	km.Create("bundle", P_DECRYPT_AND_ENCRYPT, T_AES)
+	km.AddKey(0, S_ACTIVE)
+	km.AddKey(0, S_PRIMARY)
+	plain := keyManagerReader(mustJSONs(km, nil))
+	crypter, _ := NewCrypter(plain)
+	c, _ := crypter.Encrypt([]byte(INPUT))
+
+	kek, _ := NewCrypter(plain)
+	pbe := NewPBECrypter([]byte("cartman"))
+	tests := []struct {
+		name   string
+		reader KeyReader                 // the key set to bundle
+		wrap   func(KeyReader) KeyReader // how to read the bundle back
+	}{
+		{"plain", plain, func(r KeyReader) KeyReader { return r }},
+		{"encrypted", keyManagerReader(mustJSONs(km, kek)), func(r KeyReader) KeyReader { return NewEncryptedReader(r, kek) }},
+		{"pbe", keyManagerReader(mustJSONs(km, pbe)), func(r KeyReader) KeyReader { return NewPBEReader(r, []byte("cartman")) }},
+	}
+	for _, tt := range tests {
+		b, err := ExportJSON(tt.reader)
+		if err != nil {
+			t.Fatalf("%s: ExportJSON failed: %v", tt.name, err)
+		}
+		r, err := NewJSONReader(b)
+		if err != nil {
+			t.Fatalf("%s: NewJSONReader failed: %v", tt.name, err)
+		}
+		d, err := NewCrypter(tt.wrap(r))
+		if err != nil {
+			t.Fatalf("%s: failed to load bundled key set: %v", tt.name, err)
+		}
+		if p, err := d.Decrypt(c); err != nil || string(p) != INPUT {
+			t.Errorf("%s: bundled key set failed to decrypt: %v", tt.name, err)
+		}
+		// a bundle of the bundle is the same bundle
+		if again, _ := ExportJSON(r); !bytes.Equal(again, b) {
+			t.Errorf("%s: re-exported bundle differs", tt.name)
+		}
+	}
+
+	for _, bad := range []string{"", "[]", `{"keys": {}}`, `{"meta": "x", "keys": {}}`, `{"meta": {}, "keys": {"one": {}}}`} {
+		if _, err := NewJSONReader([]byte(bad)); err == nil {
+			t.Errorf("NewJSONReader(%q) succeeded", bad)
+		}
+	}
+	r, _ := NewJSONReader([]byte(`{"meta": {}, "keys": {}}`))
+	if _, err := r.GetKey(1); err != ErrNoSuchKeyVersion {
+		t.Errorf("GetKey of a missing version: got %v, want ErrNoSuchKeyVersion", err)
+	}
+}
+
+func TestBatch(t *testing.T) {
+	km := NewKeyManager()
+	km.Create("batch", P_DECRYPT_AND_ENCRYPT, T_AES)
+	km.AddKey(0, S_PRIMARY)
+	plaintexts := make([][]byte, 50)
+	for i := range plaintexts {
+		plaintexts[i] = []byte(INPUT + strings.Repeat("x", i))
+	}
+	for _, workers := range []int{0, 4, -1} {
+		crypter, _ := NewCrypter(keyManagerReader(mustJSONs(km, nil)), WithBatchWorkers(workers))
+		cts, err := crypter.(BatchEncrypter).EncryptAll(plaintexts)
+		if err != nil || len(cts) != len(plaintexts) {
+			t.Fatalf("EncryptAll with %d workers: got %d, %v", workers, len(cts), err)
+		}
+		pts, err := crypter.(BatchDecrypter).DecryptAll(cts)
+		if err != nil {
+			t.Fatalf("DecryptAll with %d workers: %v", workers, err)
+		}
+		for i := range pts {
+			if !bytes.Equal(pts[i], plaintexts[i]) {
+				t.Errorf("item %d with %d workers: got %q", i, workers, pts[i])
+			}
+		}
+		cts[30], cts[40] = "bogus", "bogus"
+		_, err = crypter.(BatchDecrypter).DecryptAll(cts)
+		if be, ok := err.(*BatchError); !ok || be.Index != 30 {
+			t.Errorf("DecryptAll with %d workers: got %v, want a BatchError for item 30", workers, err)
+		}
+	}
+
+	km = NewKeyManager()
+	km.Create("batch", P_SIGN_AND_VERIFY, T_HMAC_SHA1)
+	km.AddKey(0, S_PRIMARY)
+	signer, _ := NewSigner(keyManagerReader(mustJSONs(km, nil)), WithBatchWorkers(3))
+	sigs, err := signer.(BatchSigner).SignAll(plaintexts)
+	if err != nil {
+		t.Fatal("SignAll failed: " + err.Error())
+	}
+	sigs[7] = sigs[8]
+	valid, err := signer.(BatchVerifier).VerifyAll(plaintexts, sigs)
+	if err != nil {
+		t.Fatal("VerifyAll failed: " + err.Error())
+	}
+	for i, v := range valid {
+		if v != (i != 7) {
+			t.Errorf("signature %d: got %v", i, v)
+		}
+	}
+	if _, err := signer.(BatchVerifier).VerifyAll(plaintexts, sigs[1:]); err != ErrBatchLength {
+		t.Errorf("mismatched batch: got %v", err)
+	}
+}
+
+func TestReencrypt(t *testing.T) {
+	km := NewKeyManager()
+	km.Create("rekey", P_DECRYPT_AND_ENCRYPT, T_AES)
+	km.AddKey(0, S_PRIMARY)
+	old, _ := NewCrypter(keyManagerReader(mustJSONs(km, nil)))
+	c1, _ := old.Encrypt([]byte(INPUT))
+	c2, _ := old.Encrypt([]byte("second"))
+
+	km.AddKey(0, S_PRIMARY)
+	crypter, _ := NewCrypter(keyManagerReader(mustJSONs(km, nil)))
+	c, err := Reencrypt(crypter, c1)
+	if err != nil {
+		t.Fatal("Reencrypt failed: " + err.Error())
+	}
+	var out bytes.Buffer
+	n, err := ReencryptLines(crypter, &out, strings.NewReader(c1+"\n\n"+c2+"\r\n"+c1))
+	if err != nil || n != 3 {
+		t.Fatalf("ReencryptLines: got %d, %v", n, err)
+	}
+	lines := strings.Split(out.String(), "\n")
+	if len(lines) != 4 || lines[1] != "" || !strings.HasSuffix(lines[2], "\r") {
+		t.Fatalf("ReencryptLines changed the lines: %q", out.String())
+	}
+
+	// the old key can go now
+	km.Demote(1)
+	km.Revoke(1)
+	current, _ := NewCrypter(keyManagerReader(mustJSONs(km, nil)))
+	for i, want := range []string{INPUT, "", "second", INPUT} {
+		if want == "" {
+			continue
+		}
+		if p, err := current.Decrypt(strings.TrimSuffix(lines[i], "\r")); err != nil || string(p) != want {
+			t.Errorf("line %d: got %q, %v", i+1, p, err)
+		}
+	}
+	if p, err := current.Decrypt(c); err != nil || string(p) != INPUT {
+		t.Errorf("re-encrypted ciphertext: got %q, %v", p, err)
+	}
+
+	_, err = ReencryptLines(crypter, ioutil.Discard, strings.NewReader(c1+"\nbogus\n"))
+	if re, ok := err.(*ReencryptError); !ok || re.Line != 2 {
+		t.Errorf("bad line: got %v, want a ReencryptError for line 2", err)
+	}
+}
+
+func TestSealKeyset(t *testing.T) {
+	kek := NewKeyManager()
+	kek.Create("kek", P_DECRYPT_AND_ENCRYPT, T_AES)
+	kek.AddKey(0, S_PRIMARY)
+	crypter, _ := NewCrypter(keyManagerReader(mustJSONs(kek, nil)))
+
+	km := NewKeyManager()
+	km.Create("sealed", P_SIGN_AND_VERIFY, T_HMAC_SHA1)
+	km.AddKey(0, S_ACTIVE)
+	km.AddKey(0, S_PRIMARY)
+	signer, _ := NewSigner(keyManagerReader(mustJSONs(km, nil)))
+	sig, _ := signer.Sign([]byte(INPUT))
+
+	// an encrypted key set is sealed decrypted
+	enc := NewEncryptedReader(keyManagerReader(mustJSONs(km, crypter)), crypter)
+	bundle, err := SealKeyset(enc, crypter)
+	if err != nil {
+		t.Fatal("SealKeyset failed: " + err.Error())
+	}
+	if bytes.Contains(bundle, []byte("hmacKeyString")) {
+		t.Error("the bundle isn't encrypted")
+	}
+	r, err := OpenKeyset(bundle, crypter)
+	if err != nil {
+		t.Fatal("OpenKeyset failed: " + err.Error())
+	}
+	verifier, err := NewVerifier(r)
+	if err != nil {
+		t.Fatal("failed to load the opened key set: " + err.Error())
+	}
+	if ok, err := verifier.Verify([]byte(INPUT), sig); !ok || err != nil {
+		t.Errorf("the opened key set didn't verify: %v", err)
+	}
+
+	kek2 := NewKeyManager()
+	kek2.Create("kek", P_DECRYPT_AND_ENCRYPT, T_AES)
+	kek2.AddKey(0, S_PRIMARY)
+	other, _ := NewCrypter(keyManagerReader(mustJSONs(kek2, nil)))
+	if _, err := OpenKeyset(bundle, other); err == nil {
+		t.Error("opened a bundle with the wrong crypter")
+	}
+	if _, err := SealKeyset(keyManagerReader(mustJSONs(km, crypter)), crypter); err == nil {
+		t.Error("sealed a key set whose keys don't parse")
+	}
+}
+
+func TestArchiveReaders(t *testing.T) {
+	km := NewKeyManager()
+	km.Create("archive", P_DECRYPT_AND_ENCRYPT, T_AES)
+	km.AddKey(0, S_ACTIVE)
+	km.AddKey(0, S_PRIMARY)
+	keys := keyManagerReader(mustJSONs(km, nil))
+	crypter, _ := NewCrypter(keys)
+	c, _ := crypter.Encrypt([]byte(INPUT))
+
+	check := func(name string, r KeyReader, err error) {
+		if err != nil {
+			t.Errorf("%s: failed to read archive: %v", name, err)
+			return
+		}
+		d, err := NewCrypter(r)
+		if err != nil {
+			t.Errorf("%s: failed to load key set: %v", name, err)
+			return
+		}
+		if p, err := d.Decrypt(c); err != nil || string(p) != INPUT {
+			t.Errorf("%s: failed to decrypt: %v", name, err)
+		}
+	}
+
+	var zbuf, tbuf bytes.Buffer
+	if err := WriteZip(&zbuf, keys); err != nil {
+		t.Fatal("WriteZip failed:", err)
+	}
+	r, err := NewZipReader(bytes.NewReader(zbuf.Bytes()), int64(zbuf.Len()))
+	check("zip", r, err)
+	if err := WriteTar(&tbuf, keys); err != nil {
+		t.Fatal("WriteTar failed:", err)
+	}
+	r, err = NewTarReader(bytes.NewReader(tbuf.Bytes()))
+	check("tar", r, err)
+
+	// a key set in a subdirectory, next to other files
+	zbuf.Reset()
+	zw := zip.NewWriter(&zbuf)
+	files := mustJSONs(km, nil)
+	w, _ := zw.Create("README")
+	io.WriteString(w, "backup")
+	for i, s := range files {
+		name := "./keys/" + strconv.Itoa(i)
+		if i == 0 {
+			name = "./keys/meta"
+		}
+		w, _ := zw.Create(name)
+		io.WriteString(w, s)
+	}
+	zw.Close()
+	r, err = NewZipReader(bytes.NewReader(zbuf.Bytes()), int64(zbuf.Len()))
+	check("zip subdirectory", r, err)
+
+	// two key sets are ambiguous
+	zbuf.Reset()
+	zw = zip.NewWriter(&zbuf)
+	zw.Create("a/meta")
+	zw.Create("b/meta")
+	zw.Close()
+	if _, err := NewZipReader(bytes.NewReader(zbuf.Bytes()), int64(zbuf.Len())); err != ErrMalformedArchive {
+		t.Errorf("two key sets: got %v, want ErrMalformedArchive", err)
+	}
+	tbuf.Reset()
+	tar.NewWriter(&tbuf).Close()
+	if _, err := NewTarReader(&tbuf); err != ErrMalformedArchive {
+		t.Errorf("empty tar: got %v, want ErrMalformedArchive", err)
+	}
+}
+
+func TestEnvReader(t *testing.T) {
+	km := NewKeyManager()
+	km.Create("env", P_DECRYPT_AND_ENCRYPT, T_AES)
+	km.AddKey(0, S_ACTIVE)
+	km.AddKey(0, S_PRIMARY)
+	keys := keyManagerReader(mustJSONs(km, nil))
+	crypter, _ := NewCrypter(keys)
+	c, _ := crypter.Encrypt([]byte(INPUT))
+
+	env, err := ExportEnv("TEST_DKEYCZAR", keys)
+	if err != nil || len(env) != 3 || !strings.HasPrefix(env[0], "TEST_DKEYCZAR_META=") || !strings.HasPrefix(env[2], "TEST_DKEYCZAR_2=") {
+		t.Fatalf("ExportEnv: got %v %v", env, err)
+	}
+	for i, kv := range env {
+		name, value := kv[:strings.Index(kv, "=")], kv[strings.Index(kv, "=")+1:]
+		if i == 1 {
+			// as written by base64(1): standard alphabet, padded, with a newline
+			b, _ := decodeWeb64String(value)
+			value = base64.StdEncoding.EncodeToString(b) + "\n"
+		}
+		t.Setenv(name, value)
+	}
+	d, err := NewCrypter(NewEnvReader("TEST_DKEYCZAR"))
+	if err != nil {
+		t.Fatal("failed to load key set from the environment:", err)
+	}
+	if p, err := d.Decrypt(c); err != nil || string(p) != INPUT {
+		t.Errorf("failed to decrypt: %v", err)
+	}
+
+	r := NewEnvReader("TEST_DKEYCZAR_MISSING")
+	if _, err := r.GetMetadata(); err != ErrKeyNotFound {
+		t.Errorf("missing meta: got %v, want ErrKeyNotFound", err)
+	}
+	t.Setenv("TEST_DKEYCZAR_1", "not base64!")
+	if _, err := NewEnvReader("TEST_DKEYCZAR").GetKey(1); err != ErrBase64Decoding {
+		t.Errorf("bad key: got %v, want ErrBase64Decoding", err)
+	}
+	if _, err := NewEnvReader("TEST_DKEYCZAR").GetKey(3); err != ErrNoSuchKeyVersion {
+		t.Errorf("missing key: got %v, want ErrNoSuchKeyVersion", err)
+	}
+}
+
+func TestEncryptWithVersion(t *testing.T) {
+	km := NewKeyManager()
+	km.Create("pinned", P_DECRYPT_AND_ENCRYPT, T_AES)
+	km.AddKey(0, S_PRIMARY)
+	old, _ := NewCrypter(keyManagerReader(mustJSONs(km, nil)))
+	oldc, _ := old.Encrypt([]byte(INPUT))
+	km.AddKey(0, S_PRIMARY)
+
+	crypter, _ := NewCrypter(keyManagerReader(mustJSONs(km, nil)))
+	vc := crypter.(VersionedEncrypter)
+	if v := vc.PrimaryVersion(); v != 2 {
+		t.Errorf("PrimaryVersion: got %d, want 2", v)
+	}
+	c, err := vc.EncryptWithVersion(1, []byte(INPUT))
+	if err != nil {
+		t.Fatal("EncryptWithVersion failed:", err)
+	}
+	b, _ := decodeWeb64String(c)
+	ob, _ := decodeWeb64String(oldc)
+	if !bytes.Equal(b[:kzHeaderLength], ob[:kzHeaderLength]) {
+		t.Error("EncryptWithVersion(1) didn't use version 1")
+	}
+	if p, err := old.Decrypt(c); err != nil || string(p) != INPUT {
+		t.Errorf("version 1 ciphertext doesn't decrypt with version 1: %v", err)
+	}
+	if _, err := vc.EncryptWithVersion(3, []byte(INPUT)); err != ErrNoSuchKeyVersion {
+		t.Errorf("EncryptWithVersion(3): got %v, want ErrNoSuchKeyVersion", err)
+	}
+
+	km.Demote(1)
+	encrypter, _ := NewEncrypter(keyManagerReader(mustJSONs(km, nil)))
+	if _, err := encrypter.(VersionedEncrypter).EncryptWithVersion(1, []byte(INPUT)); err != ErrInactiveKey {
+		t.Errorf("EncryptWithVersion of an inactive key: got %v, want ErrInactiveKey", err)
+	}
+}
+
+func TestDecryptVerifyWithInfo(t *testing.T) {
+	km := NewKeyManager()
+	km.Create("info", P_DECRYPT_AND_ENCRYPT, T_AES)
+	km.AddKey(0, S_PRIMARY)
+	km.AddKey(0, S_PRIMARY)
+	crypter, _ := NewCrypter(keyManagerReader(mustJSONs(km, nil)))
+	for _, v := range []int{1, 2} {
+		c, _ := crypter.(VersionedEncrypter).EncryptWithVersion(v, []byte(INPUT))
+		p, info, err := crypter.(InfoDecrypter).DecryptWithInfo(c)
+		b, _ := decodeWeb64String(c)
+		if err != nil || string(p) != INPUT || info.Version != v || !bytes.Equal(info.KeyHash, b[1:kzHeaderLength]) {
+			t.Errorf("DecryptWithInfo of a version %d ciphertext: got %+v %v", v, info, err)
+		}
+	}
+	if _, info, err := crypter.(InfoDecrypter).DecryptWithInfo("AAAAAAAAAAAAAAAA"); err == nil || info.KeyHash != nil {
+		t.Errorf("DecryptWithInfo of garbage: got %+v %v", info, err)
+	}
+
+	km = NewKeyManager()
+	km.Create("info", P_SIGN_AND_VERIFY, T_HMAC_SHA1)
+	km.AddKey(0, S_PRIMARY)
+	old, _ := NewSigner(keyManagerReader(mustJSONs(km, nil)))
+	sig, _ := old.Sign([]byte(INPUT))
+	km.AddKey(0, S_PRIMARY)
+	signer, _ := NewSigner(keyManagerReader(mustJSONs(km, nil)))
+	if ok, info, err := signer.(InfoVerifier).VerifyWithInfo([]byte(INPUT), sig); !ok || err != nil || info.Version != 1 {
+		t.Errorf("VerifyWithInfo of a version 1 signature: got %v %+v %v", ok, info, err)
+	}
+	if ok, info, _ := signer.(InfoVerifier).VerifyWithInfo([]byte(INPUT+"!"), sig); ok || info.Version != 0 {
+		t.Errorf("VerifyWithInfo of a bad signature: got %v %+v", ok, info)
+	}
+}
+
+type metricsRecord struct {
+	op      Operation
+	version int
+	err     error
+}
+
+type recordingSink struct {
+	records []metricsRecord
+}
+
+func (s *recordingSink) Observe(op Operation, version int, elapsed time.Duration, err error) {
+	s.records = append(s.records, metricsRecord{op, version, err})
+}
+
+func TestAAD(t *testing.T) {
+	for _, kt := range []KeyType{T_AES, T_CHACHA20_POLY1305, T_X25519_PRIV, T_RSA_PRIV} {
+		km := NewKeyManager()
+		km.Create("aad", P_DECRYPT_AND_ENCRYPT, kt)
+		km.AddKey(0, S_PRIMARY)
+		crypter, _ := NewCrypter(keyManagerReader(mustJSONs(km, nil)))
+		ac := crypter.(AADCrypter)
+		c, err := ac.EncryptWithAAD([]byte(INPUT), []byte("tenant-1/record-7"))
+		if err != nil {
+			t.Fatalf("failed to encrypt %s with aad: %s", kt, err)
+		}
+		p, err := ac.DecryptWithAAD(c, []byte("tenant-1/record-7"))
+		if err != nil || string(p) != INPUT {
+			t.Errorf("%s aad round trip failed: %q %v", kt, p, err)
+		}
+		for _, aad := range []string{"tenant-1/record-8", ""} {
+			if _, err := ac.DecryptWithAAD(c, []byte(aad)); err == nil {
+				t.Errorf("%s ciphertext decrypted with aad %q", kt, aad)
+			}
+		}
+		if _, err := crypter.Decrypt(c); err == nil {
+			t.Errorf("%s ciphertext with aad decrypted without it", kt)
+		}
+		// empty associated data is the same as none
+		c, _ = crypter.Encrypt([]byte(INPUT))
+		if p, err := ac.DecryptWithAAD(c, nil); err != nil || string(p) != INPUT {
+			t.Errorf("%s ciphertext without aad failed to decrypt with empty aad: %v", kt, err)
+		}
+	}
+
+	km := NewKeyManager()
+	km.Create("aad", P_DECRYPT_AND_ENCRYPT, T_AES)
+	km.AddKey(0, S_PRIMARY)
+	crypter, _ := NewCrypter(keyManagerReader(mustJSONs(km, nil)), WithCompression(GZIP), WithPadding(PadToPowerOfTwo))
+	ac := crypter.(AADCrypter)
+	c, _ := ac.EncryptWithAAD([]byte(INPUT), []byte("record"))
+	if p, err := ac.DecryptWithAAD(c, []byte("record")); err != nil || string(p) != INPUT {
+		t.Errorf("aad round trip with compression and padding failed: %q %v", p, err)
+	}
+}
+
+func TestWrapKey(t *testing.T) {
+	secret := make([]byte, 32)
+	io.ReadFull(rand.Reader, secret)
+	for _, kt := range []KeyType{T_AES, T_RSA_PRIV} {
+		km := NewKeyManager()
+		km.Create("kek", P_DECRYPT_AND_ENCRYPT, kt)
+		km.AddKey(0, S_PRIMARY)
+		r := keyManagerReader(mustJSONs(km, nil))
+		crypter, _ := NewCrypter(r)
+		wrapped, err := crypter.(KeyWrapper).WrapKey(secret)
+		if err != nil {
+			t.Fatalf("failed to wrap key with %s: %s", kt, err)
+		}
+		// compression doesn't apply to wrapped keys
+		unwrapper, _ := NewCrypter(r, WithCompression(GZIP))
+		got, err := unwrapper.(KeyUnwrapper).UnwrapKey(wrapped)
+		if err != nil || !bytes.Equal(got, secret) {
+			t.Errorf("%s key unwrap failed: %v", kt, err)
+		}
+		if _, err := crypter.Decrypt(wrapped); err == nil {
+			t.Errorf("%s wrapped key decrypted as a message", kt)
+		}
+		c, _ := crypter.Encrypt(secret)
+		if _, err := crypter.(KeyUnwrapper).UnwrapKey(c); err == nil {
+			t.Errorf("%s message unwrapped as a key", kt)
+		}
+	}
+}
+
+func TestSessionTicketKeys(t *testing.T) {
+	km := NewKeyManager()
+	km.Create("tickets", P_DECRYPT_AND_ENCRYPT, T_AES)
+	km.AddKey(0, S_PRIMARY)
+	before, err := SessionTicketKeys(keyManagerReader(mustJSONs(km, nil)))
+	if err != nil || len(before) != 1 {
+		t.Fatalf("failed to derive session ticket keys: %d %v", len(before), err)
+	}
+	km.AddKey(0, S_ACTIVE)
+	km.AddKey(0, S_PRIMARY)
+	r := keyManagerReader(mustJSONs(km, nil))
+	keys, err := SessionTicketKeys(r)
+	if err != nil || len(keys) != 3 {
+		t.Fatalf("failed to derive rotated session ticket keys: %d %v", len(keys), err)
+	}
+	// primary first, then the others from the newest
+	for i, version := range []int{3, 2, 1} {
+		dk, _ := DeriveKeyVersion(r, version, []byte(sessionTicketInfo), 32)
+		if !bytes.Equal(keys[i][:], dk.Key) {
+			t.Errorf("session ticket key %d isn't derived from version %d", i, version)
+		}
+	}
+	if keys[2] != before[0] {
+		t.Error("session ticket key of the old primary changed")
+	}
+	raw, err := RawSessionTicketKeys(r, 48)
+	if err != nil || len(raw) != 3 || len(raw[0]) != 48 {
+		t.Errorf("failed to derive 48 byte session ticket keys: %v", err)
+	}
+	if err := SetSessionTicketKeys(new(tls.Config), r); err != nil {
+		t.Error("SetSessionTicketKeys failed: " + err.Error())
+	}
+
+	km = NewKeyManager()
+	km.Create("tickets", P_SIGN_AND_VERIFY, T_ED25519_PRIV)
+	km.AddKey(0, S_PRIMARY)
+	if _, err := SessionTicketKeys(keyManagerReader(mustJSONs(km, nil))); err != ErrNotDerivable {
+		t.Errorf("expected ErrNotDerivable for an asymmetric key set, got %v", err)
+	}
+}
+
+func TestPadding(t *testing.T) {
+	km := NewKeyManager()
+	km.Create("padding", P_DECRYPT_AND_ENCRYPT, T_AES)
+	km.AddKey(0, S_PRIMARY)
+	r := keyManagerReader(mustJSONs(km, nil))
+	for _, compression := range []Compression{NO_COMPRESSION, GZIP} {
+		crypter, _ := NewCrypter(r, WithPadding(PadToPowerOfTwo), WithCompression(compression))
+		lengths := make(map[int]bool)
+		for _, s := range []string{"", "a", INPUT} {
+			c, err := crypter.Encrypt([]byte(s))
+			if err != nil {
+				t.Fatal("failed to encrypt padded plaintext: " + err.Error())
+			}
+			lengths[len(c)] = true
+			p, err := crypter.Decrypt(c)
+			if err != nil || string(p) != s {
+				t.Errorf("padded round trip of %q failed: %q %v", s, p, err)
+			}
+		}
+		if compression == NO_COMPRESSION && len(lengths) != 2 {
+			t.Errorf("expected 2 ciphertext lengths for 3 plaintexts, got %d", len(lengths))
+		}
+	}
+
+	// a crypter without padding sees the padding
+	crypter, _ := NewCrypter(r, WithPadding(PadToMultiple(100)))
+	c, _ := crypter.Encrypt([]byte(INPUT))
+	unpadded, _ := NewCrypter(r)
+	if p, _ := unpadded.Decrypt(c); len(p) != 100 {
+		t.Errorf("expected 100 padded bytes, got %d", len(p))
+	}
+	plain, _ := unpadded.Encrypt([]byte(INPUT))
+	if _, err := crypter.Decrypt(plain); err != ErrBadCiphertextFormat {
+		t.Errorf("expected ErrBadCiphertextFormat for an unpadded plaintext, got %v", err)
+	}
+
+	buckets := PadToBuckets(64, 256)
+	for _, tc := range []struct {
+		scheme  PaddingScheme
+		n, want int
+	}{
+		{PadToPowerOfTwo, 1, 16},
+		{PadToPowerOfTwo, 17, 32},
+		{PadToMultiple(10), 11, 20},
+		{buckets, 10, 64},
+		{buckets, 65, 256},
+		{buckets, 300, 512},
+	} {
+		if got := tc.scheme(tc.n); got != tc.want {
+			t.Errorf("padding %d bytes gave %d, expected %d", tc.n, got, tc.want)
+		}
+	}
+}
+
+func TestIVReuseDetection(t *testing.T) {
+	for _, kt := range []KeyType{T_AES, T_CHACHA20_POLY1305, T_X25519_PRIV} {
+		km := NewKeyManager()
+		km.Create("ivreuse", P_DECRYPT_AND_ENCRYPT, kt)
+		km.AddKey(0, S_PRIMARY)
+		r := keyManagerReader(mustJSONs(km, nil))
+		crypter, _ := NewCrypter(r, WithIVReuseDetection(16, nil))
+		for i := 0; i < 100; i++ {
+			if _, err := crypter.Encrypt([]byte(INPUT)); err != nil {
+				t.Fatalf("%s encryption %d failed with a working random source: %s", kt, i, err)
+			}
+		}
+
+		// a stuck random source repeats every IV
+		crypter, _ = NewCrypter(r, WithRand(bytes.NewReader(make([]byte, 1<<16))), WithIVReuseDetection(16, nil))
+		if _, err := crypter.Encrypt([]byte(INPUT)); err != nil {
+			t.Fatalf("first %s encryption failed: %s", kt, err)
+		}
+		if _, err := crypter.Encrypt([]byte(INPUT)); err != ErrIVReused {
+			t.Errorf("expected ErrIVReused for %s, got %v", kt, err)
+		}
+	}
+
+	km := NewKeyManager()
+	km.Create("ivreuse", P_DECRYPT_AND_ENCRYPT, T_AES)
+	km.AddKey(0, S_PRIMARY)
+	r := keyManagerReader(mustJSONs(km, nil))
+	a, b := bytes.Repeat([]byte{1}, aes.BlockSize), bytes.Repeat([]byte{2}, aes.BlockSize)
+	for _, size := range []int{1, 2} {
+		var reused [][]byte
+		handler := func(version int, iv []byte) {
+			if version != 1 {
+				t.Errorf("reuse reported for version %d", version)
+			}
+			reused = append(reused, iv)
+		}
+		rng := bytes.NewReader(bytes.Join([][]byte{a, b, a}, nil))
+		crypter, _ := NewCrypter(r, WithRand(rng), WithIVReuseDetection(size, handler))
+		for i := 0; i < 3; i++ {
+			// with a handler the reuse is only reported
+			if _, err := crypter.Encrypt([]byte(INPUT)); err != nil {
+				t.Fatalf("encryption %d failed: %s", i, err)
+			}
+		}
+		// the history is bounded, so only the larger one still remembers the first IV
+		if size == 1 && len(reused) != 0 {
+			t.Errorf("reuse reported outside the history: %x", reused)
+		}
+		if size == 2 && (len(reused) != 1 || !bytes.Equal(reused[0], a)) {
+			t.Errorf("expected reuse of %x to be reported, got %x", a, reused)
+		}
+	}
+}
+
+func TestMetricsSink(t *testing.T) {
+	km := NewKeyManager()
+	km.Create("metrics", P_DECRYPT_AND_ENCRYPT, T_AES)
+	km.AddKey(0, S_PRIMARY)
+	km.AddKey(0, S_PRIMARY)
+	sink := new(recordingSink)
+	crypter, _ := NewCrypter(keyManagerReader(mustJSONs(km, nil)), WithMetrics(sink))
+	c, _ := crypter.Encrypt([]byte(INPUT))
+	crypter.(VersionedEncrypter).EncryptWithVersion(1, []byte(INPUT))
+	crypter.Decrypt(c)
+	crypter.Decrypt("AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA")
+
+	km = NewKeyManager()
+	km.Create("metrics", P_SIGN_AND_VERIFY, T_HMAC_SHA1)
+	km.AddKey(0, S_PRIMARY)
+	signer, _ := NewSigner(keyManagerReader(mustJSONs(km, nil)))
+	signer.(MetricsController).SetMetricsSink(sink)
+	sig, _ := signer.Sign([]byte(INPUT))
+	signer.Verify([]byte(INPUT), sig)
+	signer.Verify([]byte(INPUT+"!"), sig)
+
+	want := []metricsRecord{
+		{OP_ENCRYPT, 2, nil},
+		{OP_ENCRYPT, 1, nil},
+		{OP_DECRYPT, 2, nil},
+		{OP_DECRYPT, -1, nil},
+		{OP_SIGN, 1, nil},
+		{OP_VERIFY, 1, nil},
+		{OP_VERIFY, -1, ErrInvalidSignature},
+	}
+	if len(sink.records) != len(want) {
+		t.Fatalf("got %d reports, want %d: %v", len(sink.records), len(want), sink.records)
+	}
+	for i, w := range want {
+		got := sink.records[i]
+		if got.op != w.op || got.version != w.version {
+			t.Errorf("report %d: got %v version %d, want %v version %d", i, got.op, got.version, w.op, w.version)
+		}
+		// only the failures carry an error; the failed decrypt reports its own
+		switch {
+		case w.err != nil && got.err != w.err, w.version == -1 && got.err == nil, w.version != -1 && got.err != nil:
+			t.Errorf("report %d: got error %v", i, got.err)
+		}
+	}
+}
+
+type recordingHook struct {
+	mu     sync.Mutex
+	events []AuditEvent
+}
+
+func (h *recordingHook) Audit(ev AuditEvent) {
+	h.mu.Lock()
+	h.events = append(h.events, ev)
+	h.mu.Unlock()
+}
+
+func TestAuditHook(t *testing.T) {
+	hook := new(recordingHook)
+	SetAuditHook(hook)
+	defer SetAuditHook(nil)
+
+	km := NewKeyManager()
+	km.Create("audit", P_DECRYPT_AND_ENCRYPT, T_AES)
+	km.AddKey(0, S_PRIMARY)
+	km.AddKey(0, S_PRIMARY)
+	crypter, _ := NewCrypter(keyManagerReader(mustJSONs(km, nil)))
+	c, _ := crypter.Encrypt([]byte(INPUT))
+	b, _ := decodeWeb64String(c)
+	b[len(b)-1] ^= 1
+	crypter.Decrypt(encodeWeb64String(b))
+
+	km = NewKeyManager()
+	km.Create("audit", P_SIGN_AND_VERIFY, T_HMAC_SHA1)
+	km.AddKey(0, S_PRIMARY)
+	signer, _ := NewSigner(keyManagerReader(mustJSONs(km, nil)))
+	sig, _ := signer.Sign([]byte(INPUT))
+	signer.Verify([]byte(INPUT), sig)
+	signer.Verify([]byte(INPUT+"!"), sig)
+
+	want := []struct {
+		typ     AuditEventType
+		version int
+	}{
+		// version 1 of the crypter isn't needed, so it isn't read
+		{AUDIT_KEY_LOAD, 2},
+		{AUDIT_DECRYPT_FAILURE, 2},
+		{AUDIT_KEY_LOAD, 1},
+		{AUDIT_VERIFY_FAILURE, 1},
+	}
+	if len(hook.events) != len(want) {
+		t.Fatalf("got %d events, want %d: %v", len(hook.events), len(want), hook.events)
+	}
+	for i, w := range want {
+		ev := hook.events[i]
+		if ev.Type != w.typ || ev.Version != w.version || len(ev.KeyHash) != 4 || ev.Source != "dkeyczar.keyManagerReader" {
+			t.Errorf("event %d: got %v, want %v version %d", i, ev, w.typ, w.version)
+		}
+	}
+	if hook.events[1].Err == nil || hook.events[3].Err != ErrInvalidSignature {
+		t.Errorf("failures reported errors %v and %v", hook.events[1].Err, hook.events[3].Err)
+	}
+
+	// the source names the directory of a file reader
+	if s := readerSource(NewEncryptedReader(NewFileReader("/keys"), crypter)); s != "encrypted:file:/keys/" {
+		t.Errorf("source of an encrypted file reader: got %q", s)
+	}
+}
+
+// a KeyReader counting the reads of each key version
+type countingReader struct {
+	KeyReader
+	mu    sync.Mutex
+	reads map[int]int
+	fails map[int]int // how many more reads of a version fail
+}
+
+func (r *countingReader) GetKey(version int) (string, error) {
+	r.mu.Lock()
+	r.reads[version]++
+	fail := r.fails[version] > 0
+	if fail {
+		r.fails[version]--
+	}
+	r.mu.Unlock()
+	if fail {
+		return "", errors.New("temporarily unavailable")
+	}
+	return r.KeyReader.GetKey(version)
+}
+
+func TestLazyKeyLoading(t *testing.T) {
+	km := NewKeyManager()
+	km.Create("lazy", P_DECRYPT_AND_ENCRYPT, T_AES)
+	km.AddKey(0, S_ACTIVE)
+	km.AddKey(0, S_ACTIVE)
+	km.AddKey(0, S_PRIMARY)
+	jsons := mustJSONs(km, nil)
+	eager, _ := NewCrypter(keyManagerReader(jsons), WithPreloadedKeys())
+	old, _ := eager.(VersionedEncrypter).EncryptWithVersion(1, []byte(INPUT))
+
+	r := &countingReader{KeyReader: keyManagerReader(jsons), reads: make(map[int]int)}
+	crypter, err := NewCrypter(r)
+	if err != nil {
+		t.Fatal("failed to load the key set: " + err.Error())
+	}
+	if r.reads[1] != 0 || r.reads[2] != 0 || r.reads[3] != 1 {
+		t.Errorf("read %v when loading, want only the primary key", r.reads)
+	}
+	c, _ := crypter.Encrypt([]byte(INPUT))
+	if p, err := crypter.Decrypt(c); err != nil || string(p) != INPUT {
+		t.Errorf("failed to decrypt with the primary key: %v", err)
+	}
+	if r.reads[1] != 0 || r.reads[2] != 0 {
+		t.Errorf("read %v to use the primary key", r.reads)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if p, err := crypter.Decrypt(old); err != nil || string(p) != INPUT {
+				t.Errorf("failed to decrypt with an old key: %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+	if r.reads[1] != 1 || r.reads[2] != 1 || r.reads[3] != 1 {
+		t.Errorf("read %v, want each version once", r.reads)
+	}
+
+	// a version that can't be read fails when it is needed, or when the keys are preloaded
+	missing := append([]string(nil), jsons...)
+	missing[1] = ""
+	crypter, err = NewCrypter(keyManagerReader(missing))
+	if err != nil {
+		t.Fatal("failed to load a key set with an unreadable old version: " + err.Error())
+	}
+	if _, err := crypter.Decrypt(old); !errors.Is(err, ErrKeyNotFound) {
+		t.Errorf("decrypted with an unreadable key: %v", err)
+	}
+	if _, err := NewCrypter(keyManagerReader(missing), WithPreloadedKeys()); err == nil {
+		t.Error("preloaded a key set with an unreadable version")
+	}
+
+	// a failed read is tried again when the version is next needed, once minReloadInterval has passed
+	r = &countingReader{KeyReader: keyManagerReader(jsons), reads: make(map[int]int), fails: map[int]int{1: 1}}
+	crypter, _ = NewCrypter(r)
+	for i := 0; i < 3; i++ {
+		if _, err := crypter.Decrypt(old); !errors.Is(err, ErrKeyNotFound) {
+			t.Errorf("decrypted with a key that failed to read: %v", err)
+		}
+	}
+	if r.reads[1] != 1 {
+		t.Errorf("read version 1 %d times within minReloadInterval, want 1", r.reads[1])
+	}
+	crypter.(*keyCrypter).kz.lazy.versions[1].failed = time.Now().Add(-minReloadInterval)
+	if p, err := crypter.Decrypt(old); err != nil || string(p) != INPUT {
+		t.Errorf("failed to decrypt once the key could be read: %v", err)
+	}
+	if r.reads[1] != 2 {
+		t.Errorf("read version 1 %d times, want 2", r.reads[1])
+	}
+	r = &countingReader{KeyReader: keyManagerReader(jsons), reads: make(map[int]int), fails: map[int]int{2: 1}}
+	crypter, _ = NewCrypter(r)
+	if err := crypter.(KeyLoadController).PreloadKeys(); err == nil {
+		t.Error("preloaded a version that failed to read")
+	}
+	crypter.(*keyCrypter).kz.lazy.versions[2].failed = time.Time{}
+	if err := crypter.(KeyLoadController).PreloadKeys(); err != nil {
+		t.Errorf("failed to preload once every version could be read: %v", err)
+	}
+
+	// once every version is read, unknown key hashes read nothing
+	b, _ := decodeWeb64String(old)
+	for i := 0; i < 10; i++ {
+		b[1]++
+		crypter.Decrypt(encodeWeb64String(b))
+	}
+	if r.reads[1] != 1 || r.reads[2] != 2 || r.reads[3] != 1 {
+		t.Errorf("read %v for unknown key hashes", r.reads)
+	}
+}
+
+func TestLegacyKeyHashes(t *testing.T) {
+	km := NewKeyManager()
+	km.Create("legacy", P_SIGN_AND_VERIFY, T_RSA_PRIV)
+	km.AddKey(1024, S_PRIMARY)
+	signer, _ := NewSigner(keyManagerReader(mustJSONs(km, nil)))
+	sig, _ := signer.Sign([]byte(INPUT))
+	b, _ := decodeWeb64String(sig)
+	// old Java keyczar kept the sign byte of the modulus in the hash
+	legacy := signer.(*keySigner).kz.getPrimaryKey().(legacyKeyIDer).legacyKeyID()
+	if bytes.Equal(legacy, b[1:5]) {
+		t.Fatal("legacy key hash is the same as the key hash")
+	}
+	copy(b[1:5], legacy)
+	if ok, err := signer.Verify([]byte(INPUT), encodeWeb64String(b)); !ok || err != nil {
+		t.Errorf("signature with the legacy key hash didn't verify: %v", err)
+	}
+
+	km = NewKeyManager()
+	km.Create("tryall", P_SIGN_AND_VERIFY, T_HMAC_SHA1)
+	km.AddKey(0, S_ACTIVE)
+	km.AddKey(0, S_PRIMARY)
+	signer, _ = NewSigner(keyManagerReader(mustJSONs(km, nil)))
+	sig, _ = signer.Sign([]byte(INPUT))
+	b, _ = decodeWeb64String(sig)
+	b[1] ^= 0xff
+	sig = encodeWeb64String(b)
+	if _, err := signer.Verify([]byte(INPUT), sig); !errors.Is(err, ErrKeyNotFound) {
+		t.Errorf("signature with an unknown key hash: got %v", err)
+	}
+	verifier, _ := NewVerifier(keyManagerReader(mustJSONs(km, nil)), WithTryAllKeys())
+	if ok, err := verifier.Verify([]byte(INPUT), sig); !ok || err != nil {
+		t.Errorf("trying all keys didn't verify the signature: %v", err)
+	}
+	if ok, _ := verifier.Verify([]byte(INPUT+"!"), sig); ok {
+		t.Error("trying all keys verified a bad signature")
+	}
+}
+
+func TestCppKeyHashes(t *testing.T) {
+	km := NewKeyManager()
+	km.Create("cpp", P_SIGN_AND_VERIFY, T_RSA_PRIV)
+	km.AddKey(1024, S_PRIMARY)
+	signer, _ := NewSigner(keyManagerReader(mustJSONs(km, nil)))
+	sig, _ := signer.Sign([]byte(INPUT))
+	b, _ := decodeWeb64String(sig)
+	copy(b[1:5], signer.(*keySigner).kz.getPrimaryKey().(cppKeyIDer).cppKeyID())
+	sig = encodeWeb64String(b)
+	if _, err := signer.Verify([]byte(INPUT), sig); !errors.Is(err, ErrKeyNotFound) {
+		t.Errorf("C++ key hash accepted by default: %v", err)
+	}
+	verifier, _ := NewVerifier(keyManagerReader(mustJSONs(km, nil)), WithKeyHashCompat(KEYHASH_CPP))
+	if ok, err := verifier.Verify([]byte(INPUT), sig); !ok || err != nil {
+		t.Errorf("signature with the C++ key hash didn't verify: %v", err)
+	}
+}
+
+func TestRawPrimitives(t *testing.T) {
+	km := NewKeyManager()
+	km.Create("raw", P_SIGN_AND_VERIFY, T_RSA_PRIV)
+	km.AddKey(1024, S_PRIMARY)
+	r := keyManagerReader(mustJSONs(km, nil))
+	sig, err := SignRawPKCS1(r, crypto.SHA256, []byte(INPUT))
+	if err != nil {
+		t.Fatal("failed to sign: " + err.Error())
+	}
+	pub := &km.(*keyManager).kz.getPrimaryKey().(*rsaKey).key.PublicKey
+	digest := sha256.Sum256([]byte(INPUT))
+	if err := rsa.VerifyPKCS1v15(pub, crypto.SHA256, digest[:], sig); err != nil {
+		t.Error("raw signature isn't plain PKCS#1 v1.5: " + err.Error())
+	}
+	if ok, err := VerifyRawPKCS1(keyManagerReader(mustJSONs(km.PubKeys(), nil)), crypto.SHA256, []byte(INPUT), sig); !ok || err != nil {
+		t.Errorf("raw signature didn't verify with the public keys: %v", err)
+	}
+	if ok, _ := VerifyRawPKCS1(r, crypto.SHA256, []byte(INPUT+"!"), sig); ok {
+		t.Error("raw signature verified the wrong message")
+	}
+
+	km = NewKeyManager()
+	km.Create("raw", P_SIGN_AND_VERIFY, T_HMAC_SHA1)
+	km.AddKey(0, S_PRIMARY)
+	r = keyManagerReader(mustJSONs(km, nil))
+	mac, err := HMACRaw(r, []byte(INPUT))
+	if err != nil {
+		t.Fatal("failed to hmac: " + err.Error())
+	}
+	h := hmac.New(sha1.New, km.(*keyManager).kz.getPrimaryKey().(*hmacKey).key)
+	h.Write([]byte(INPUT))
+	if !hmac.Equal(mac, h.Sum(nil)) {
+		t.Error("raw hmac isn't plain HMAC-SHA1")
+	}
+	if _, err := SignRawPKCS1(r, crypto.SHA256, []byte(INPUT)); err != ErrUnsupportedType {
+		t.Errorf("raw RSA signature with an HMAC key: %v", err)
+	}
+}
+
+func TestTypedErrors(t *testing.T) {
+	km := NewKeyManager()
+	km.Create("errors", P_DECRYPT_AND_ENCRYPT, T_AES)
+	km.AddKey(0, S_PRIMARY)
+	crypter, _ := NewCrypter(keyManagerReader(mustJSONs(km, nil)))
+	c, _ := crypter.Encrypt([]byte(INPUT))
+	b, _ := decodeWeb64String(c)
+	// flip a bit in the key hash
+	b[1] ^= 1
+	_, err := crypter.Decrypt(encodeWeb64String(b))
+	var notFound *KeyNotFoundError
+	if !errors.Is(err, ErrKeyNotFound) || !errors.As(err, &notFound) || !bytes.Equal(notFound.KeyHash, b[1:5]) {
+		t.Errorf("unknown key hash: got %v", err)
+	}
+	// corrupt the ciphertext behind a good key hash
+	b[1] ^= 1
+	b[len(b)-1] ^= 1
+	_, err = crypter.Decrypt(encodeWeb64String(b))
+	if !errors.Is(err, ErrWrongKey) || !errors.Is(err, ErrInvalidSignature) {
+		t.Errorf("corrupt ciphertext: got %v", err)
+	}
+	// whatever the key's own error, as callers used to compare with ErrInvalidSignature
+	b[len(b)-1] ^= 1
+	_, err = crypter.Decrypt(encodeWeb64String(b[:kzHeaderLength+1]))
+	if !errors.Is(err, ErrInvalidSignature) {
+		t.Errorf("truncated ciphertext: got %v", err)
+	}
+	r := keyManagerReader(mustJSONs(km, nil)[:1])
+	_, err = NewCrypter(r)
+	if !errors.As(err, &notFound) || notFound.Version != 1 {
+		t.Errorf("missing key version: got %v", err)
+	}
+	// a format from the future
+	if v, err := FormatVersion(c, BASE64W); v != FORMAT_VERSION || err != nil {
+		t.Errorf("format version: got %d %v", v, err)
+	}
+	b, _ = decodeWeb64String(c)
+	b[0] = 1
+	future := encodeWeb64String(b)
+	if v, _ := FormatVersion(future, BASE64W); v != 1 {
+		t.Errorf("future format version: got %d", v)
+	}
+	_, err = crypter.Decrypt(future)
+	var badVersion *UnsupportedVersionError
+	if !errors.Is(err, ErrBadVersion) || !errors.As(err, &badVersion) || badVersion.Version != 1 {
+		t.Errorf("unknown format version: got %v", err)
+	}
+}
+
+func TestMetadataValidation(t *testing.T) {
+	km := NewKeyManager()
+	km.Create("valid", P_SIGN_AND_VERIFY, T_HMAC_SHA1)
+	km.AddKey(0, S_PRIMARY)
+	km.AddKey(0, S_ACTIVE)
+	keys := mustJSONs(km, nil)
+	for _, tt := range []struct {
+		meta string
+		err  error
+	}{
+		{`{"name":"","type":"HMAC_SHA1","purpose":"DECRYPT_AND_ENCRYPT","encrypted":false,"versions":[{"versionNumber":1,"status":"PRIMARY","exportable":false}]}`, ErrUnacceptablePurpose},
+		{`{"name":"","type":"HMAC_SHA1","purpose":"SIGN","encrypted":false,"versions":[{"versionNumber":1,"status":"PRIMARY","exportable":false}]}`, ErrUnacceptablePurpose},
+		{`{"name":"","type":"HMAC_SHA256","purpose":"SIGN_AND_VERIFY","encrypted":false,"versions":[{"versionNumber":1,"status":"PRIMARY","exportable":false}]}`, ErrUnsupportedType},
+		{`{"name":"","type":"HMAC_SHA1","purpose":"SIGN_AND_VERIFY","encrypted":false,"versions":[{"versionNumber":1,"status":"REVOKED","exportable":false}]}`, ErrInvalidKeyStatus},
+		{`{"name":"","type":"HMAC_SHA1","purpose":"SIGN_AND_VERIFY","encrypted":false,"versions":[{"versionNumber":1,"status":"PRIMARY","exportable":false},{"versionNumber":2,"status":"PRIMARY","exportable":false}]}`, ErrMultiplePrimaryKeys},
+		{`{"name":"","type":"HMAC_SHA1","purpose":"SIGN_AND_VERIFY","encrypted":false,"versions":[{"versionNumber":1,"status":"PRIMARY","exportable":false},{"versionNumber":1,"status":"ACTIVE","exportable":false}]}`, ErrDuplicateKeyVersion},
+		{`{"name":"","type":"HMAC_SHA1","purpose":"SIGN_AND_VERIFY","encrypted":false,"versions":[{"versionNumber":-1,"status":"PRIMARY","exportable":false}]}`, ErrInvalidKeyVersion},
+	} {
+		r := keyManagerReader(append([]string{tt.meta}, keys[1:]...))
+		if _, err := NewVerifier(r); err != tt.err {
+			t.Errorf("metadata %s: got %v, want %v", tt.meta, err, tt.err)
+		}
+	}
+	// a key set without a primary can still verify, but not sign
+	meta := `{"name":"","type":"HMAC_SHA1","purpose":"SIGN_AND_VERIFY","encrypted":false,"versions":[{"versionNumber":1,"status":"ACTIVE","exportable":false}]}`
+	r := keyManagerReader(append([]string{meta}, keys[1:]...))
+	if _, err := NewVerifier(r); err != nil {
+		t.Error("failed to load a key set without a primary key: " + err.Error())
+	}
+	if _, err := NewSigner(r); err != ErrNoPrimaryKey {
+		t.Errorf("signer without a primary key: got %v", err)
+	}
+}
+
+func TestWipe(t *testing.T) {
+	km := NewKeyManager()
+	km.Create("wipe", P_DECRYPT_AND_ENCRYPT, T_AES)
+	km.AddKey(0, S_PRIMARY)
+	crypter, _ := NewCrypter(keyManagerReader(mustJSONs(km, nil)))
+	c, _ := crypter.Encrypt([]byte(INPUT))
+	ak := crypter.(*keyCrypter).kz.getPrimaryKey().(*aesKey)
+	crypter.(Wiper).Wipe()
+	if !bytes.Equal(ak.key, make([]byte, len(ak.key))) || !bytes.Equal(ak.hmac.key, make([]byte, len(ak.hmac.key))) {
+		t.Error("wipe left aes key material behind")
+	}
+	if _, err := crypter.Encrypt([]byte(INPUT)); err != ErrNoPrimaryKey {
+		t.Errorf("encrypt after wipe: got %v", err)
+	}
+	if _, err := crypter.Decrypt(c); !errors.Is(err, ErrKeyNotFound) {
+		t.Errorf("decrypt after wipe: got %v", err)
+	}
+
+	rsaKeys := NewKeyManager()
+	rsaKeys.Create("wipe", P_SIGN_AND_VERIFY, T_RSA_PRIV)
+	rsaKeys.AddKey(1024, S_PRIMARY)
+	signer, _ := NewSigner(keyManagerReader(mustJSONs(rsaKeys, nil)))
+	rk := signer.(*keySigner).kz.getPrimaryKey().(*rsaKey)
+	signer.(Wiper).Wipe()
+	for _, x := range append([]*big.Int{rk.key.D, rk.key.Precomputed.Dp, rk.key.Precomputed.Dq}, rk.key.Primes...) {
+		if x.Sign() != 0 {
+			t.Error("wipe left rsa key material behind")
+		}
+	}
+	if _, err := signer.Sign([]byte(INPUT)); err != ErrNoPrimaryKey {
+		t.Errorf("sign after wipe: got %v", err)
+	}
+
+	password := []byte("cartman")
+	pbe := NewPBECrypter(password)
+	pbe.(Wiper).Wipe()
+	if string(password) != "cartman" {
+		t.Error("pbe wipe clobbered the caller's password")
+	}
+}
+
+func TestWithCompression(t *testing.T) {
+	km := NewKeyManager()
+	km.Create("compress", P_DECRYPT_AND_ENCRYPT, T_AES)
+	km.AddKey(0, S_PRIMARY)
+	r := keyManagerReader(mustJSONs(km, nil))
+	plain, _ := NewCrypter(r)
+	input := bytes.Repeat([]byte(`{"field":"value"},`), 100)
+	for _, compression := range []Compression{GZIP, ZLIB} {
+		crypter, err := NewCrypter(r, WithCompression(compression))
+		if err != nil {
+			t.Fatal("failed to create crypter: " + err.Error())
+		}
+		if crypter.Compression() != compression {
+			t.Error("WithCompression didn't set the compression")
+		}
+		c, _ := crypter.Encrypt(input)
+		uc, _ := plain.Encrypt(input)
+		if len(c) >= len(uc) {
+			t.Errorf("compression %d didn't shrink the ciphertext", compression)
+		}
+		if p, err := crypter.Decrypt(c); err != nil || !bytes.Equal(p, input) {
+			t.Errorf("compression %d round trip failed: %v", compression, err)
+		}
+		// an uncompressed ciphertext is an error, not garbage
+		if _, err := crypter.Decrypt(uc); err == nil {
+			t.Errorf("compression %d accepted an uncompressed ciphertext", compression)
+		}
+	}
+}
+
+func TestWithEncoding(t *testing.T) {
+	km := NewKeyManager()
+	km.Create("encoding", P_SIGN_AND_VERIFY, T_HMAC_SHA1)
+	km.AddKey(0, S_PRIMARY)
+	r := keyManagerReader(mustJSONs(km, nil))
+	raw, _ := NewSigner(r, WithEncoding(NO_ENCODING))
+	rawSig, _ := raw.Sign([]byte(INPUT))
+	for _, encoding := range []Encoding{BASE64W, NO_ENCODING, HEX} {
+		signer, err := NewSigner(r, WithEncoding(encoding))
+		if err != nil {
+			t.Fatal("failed to create signer: " + err.Error())
+		}
+		s, _ := signer.Sign([]byte(INPUT))
+		if encoding == HEX && s != hex.EncodeToString([]byte(rawSig)) {
+			t.Error("hex signature isn't the hex of the raw signature")
+		}
+		verifier, _ := NewVerifier(r, WithEncoding(encoding))
+		if ok, err := verifier.Verify([]byte(INPUT), s); !ok || err != nil {
+			t.Errorf("encoding %d failed to verify", encoding)
+		}
+	}
+	crypt := NewKeyManager()
+	crypt.Create("encoding", P_DECRYPT_AND_ENCRYPT, T_AES)
+	crypt.AddKey(0, S_PRIMARY)
+	crypter, _ := NewCryptStreamer(keyManagerReader(mustJSONs(crypt, nil)), WithEncoding(HEX))
+	var buf bytes.Buffer
+	w, _ := crypter.EncryptWriter(&buf)
+	w.Write([]byte(INPUT))
+	w.Close()
+	if _, err := hex.DecodeString(buf.String()); err != nil {
+		t.Error("streamed output isn't hex: " + err.Error())
+	}
+	if p, err := crypter.Decrypt(buf.String()); err != nil || string(p) != INPUT {
+		t.Errorf("hex stream round trip failed: %v", err)
+	}
+}
+
+// a random source that only returns b
+type constReader byte
+
+func (r constReader) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = byte(r)
+	}
+	return len(p), nil
+}
+
+func TestRandSource(t *testing.T) {
+	var jsons [][]string
+	for i := 0; i < 2; i++ {
+		km := NewKeyManager(WithRand(constReader(7)))
+		km.Create("", P_DECRYPT_AND_ENCRYPT, T_AES)
+		km.AddKey(0, S_PRIMARY)
+		jsons = append(jsons, mustJSONs(km, nil))
+	}
+	if jsons[0][1] != jsons[1][1] {
+		t.Error("keys generated from the same random source differ")
+	}
+
+	crypter, _ := NewCrypter(keyManagerReader(jsons[0]), WithRand(constReader(1)))
+	c1, _ := crypter.Encrypt([]byte(INPUT))
+	c2, _ := crypter.Encrypt([]byte(INPUT))
+	if c1 != c2 {
+		t.Error("ciphertexts made from the same random source differ")
+	}
+	if p, err := crypter.Decrypt(c1); err != nil || string(p) != INPUT {
+		t.Errorf("decrypt failed: %v", err)
+	}
+
+	crypter.(RandController).SetRand(iotest.ErrReader(io.ErrUnexpectedEOF))
+	if _, err := crypter.Encrypt([]byte(INPUT)); err == nil {
+		t.Error("encrypted without randomness")
+	}
+	crypter.(RandController).SetRand(nil)
+	if c3, err := crypter.Encrypt([]byte(INPUT)); err != nil || c3 == c1 {
+		t.Errorf("nil didn't restore crypto/rand: %v", err)
+	}
+
+	km := NewKeyManager()
+	km.Create("", P_SIGN_AND_VERIFY, T_DSA_PRIV)
+	km.AddKey(0, S_PRIMARY)
+	signer, _ := NewSigner(keyManagerReader(mustJSONs(km, nil)), WithRand(iotest.ErrReader(io.ErrUnexpectedEOF)))
+	if _, err := signer.Sign([]byte(INPUT)); err == nil {
+		t.Error("dsa signed without randomness")
+	}
+
+	// a random source that fails, or runs short, fails the key generation instead of leaving zeros
+	for _, kt := range []KeyType{T_AES, T_HMAC_SHA1, T_CHACHA20_POLY1305} {
+		for _, rng := range []io.Reader{iotest.ErrReader(io.ErrUnexpectedEOF), bytes.NewReader(make([]byte, 20))} {
+			km := NewKeyManager(WithRand(rng))
+			km.Create("", P_DECRYPT_AND_ENCRYPT, kt)
+			if err := km.AddKey(0, S_PRIMARY); err == nil {
+				t.Errorf("%s key generated without enough randomness", kt)
+			}
+		}
+	}
+}
+
+func TestRSAKeySizes(t *testing.T) {
+	km := NewKeyManager(WithRSAKeySize(3072), WithMinRSAKeySize(3072))
+	km.Create("rsa", P_SIGN_AND_VERIFY, T_RSA_PRIV)
+	if err := km.AddKey(2048, S_PRIMARY); err != ErrWeakKey {
+		t.Errorf("added a key below the minimum size: %v", err)
+	}
+	if err := km.AddKey(0, S_PRIMARY); err != nil {
+		t.Fatal("failed to add key: " + err.Error())
+	}
+	signer, err := NewSigner(keyManagerReader(mustJSONs(km, nil)))
+	if err != nil {
+		t.Fatal("failed to load 3072-bit key set: " + err.Error())
+	}
+	if n := keySize(signer.(*keySigner).kz.getPrimaryKey()); n != 3072 {
+		t.Errorf("generated a %d-bit key, want 3072", n)
+	}
+	s, _ := signer.Sign([]byte(INPUT))
+	if ok, _ := signer.Verify([]byte(INPUT), s); !ok {
+		t.Error("3072-bit key failed to verify its signature")
+	}
+
+	small := NewKeyManager()
+	small.Create("rsa", P_SIGN_AND_VERIFY, T_RSA_PRIV)
+	small.AddKey(2048, S_PRIMARY)
+	if err := km.ImportKey(keyManagerReader(mustJSONs(small, nil)), S_ACTIVE); err != ErrWeakKey {
+		t.Errorf("imported a key below the minimum size: %v", err)
+	}
+}
+
+func TestAESKeySizes(t *testing.T) {
+	km := NewKeyManager(WithStrictKeyPolicy())
+	km.Create("aes", P_DECRYPT_AND_ENCRYPT, T_AES)
+	if err := km.AddKey(128, S_PRIMARY); err != ErrWeakKey {
+		t.Errorf("strict policy added a 128-bit key: %v", err)
+	}
+	km.AddKey(0, S_PRIMARY)
+	km.AddKey(192, S_ACTIVE)
+	crypter, err := NewCrypter(keyManagerReader(mustJSONs(km, nil)), WithPreloadedKeys())
+	if err != nil {
+		t.Fatal("failed to load key set: " + err.Error())
+	}
+	for v, want := range map[int]uint{1: 256, 2: 192} {
+		if n := keySize(crypter.(*keyCrypter).kz.keys[v]); n != want {
+			t.Errorf("version %d is %d bits, want %d", v, n, want)
+		}
+		c, _ := crypter.(VersionedEncrypter).EncryptWithVersion(v, []byte(INPUT))
+		if p, err := crypter.Decrypt(c); err != nil || string(p) != INPUT {
+			t.Errorf("%d-bit key failed to round trip: %v", want, err)
+		}
+	}
+
+	small := NewKeyManager()
+	small.Create("aes", P_DECRYPT_AND_ENCRYPT, T_AES)
+	small.AddKey(0, S_PRIMARY)
+	if err := km.ImportKey(keyManagerReader(mustJSONs(small, nil)), S_ACTIVE); err != ErrWeakKey {
+		t.Errorf("strict policy imported a 128-bit key: %v", err)
+	}
+}
+
+func TestGetKeyMeta(t *testing.T) {
+	km := NewKeyManager()
+	km.Create("meta", P_SIGN_AND_VERIFY, T_HMAC_SHA1)
+	km.AddKey(0, S_PRIMARY)
+	km.AddKey(0, S_INACTIVE)
+	meta, err := GetKeyMeta(keyManagerReader(mustJSONs(km, nil)))
+	if err != nil {
+		t.Fatal("failed to read meta: " + err.Error())
+	}
+	if meta.Name != "meta" || meta.Type != T_HMAC_SHA1 || meta.Purpose != P_SIGN_AND_VERIFY || len(meta.Versions) != 2 {
+		t.Fatalf("bad meta: %+v", meta)
+	}
+	if v := meta.Versions[1]; v.VersionNumber != 2 || v.Status != S_INACTIVE {
+		t.Errorf("bad version: %+v", v)
+	}
+
+	if kt, err := ParseKeyType(T_RSA_PUB.String()); kt != T_RSA_PUB || err != nil {
+		t.Errorf("ParseKeyType: got %v, %v", kt, err)
+	}
+	if kp, err := ParseKeyPurpose(P_ENCRYPT.String()); kp != P_ENCRYPT || err != nil {
+		t.Errorf("ParseKeyPurpose: got %v, %v", kp, err)
+	}
+	if ks, err := ParseKeyStatus(S_INACTIVE.String()); ks != S_INACTIVE || err != nil {
+		t.Errorf("ParseKeyStatus: got %v, %v", ks, err)
+	}
+	if _, err := ParseKeyType("ROT13"); err != ErrUnsupportedType {
+		t.Errorf("parsed an unknown key type: %v", err)
+	}
+	if s := KeyType(-1).String(); s != "(unknown KeyType)" {
+		t.Errorf("unknown key type prints as %q", s)
+	}
+}
+
+func TestLoadKeysetInfo(t *testing.T) {
+	kmc := NewKeyManager()
+	kmc.Create("wrapper", P_DECRYPT_AND_ENCRYPT, T_AES)
+	kmc.AddKey(0, S_PRIMARY)
+	wrapper, _ := NewCrypter(keyManagerReader(mustJSONs(kmc, nil)))
+
+	km := NewKeyManager()
+	km.Create("inventory", P_DECRYPT_AND_ENCRYPT, T_AES)
+	km.AddKey(256, S_PRIMARY)
+	km.AddKey(128, S_ACTIVE)
+	plain, _ := NewCrypter(keyManagerReader(mustJSONs(km, nil)), WithPreloadedKeys())
+	raw := keyManagerReader(mustJSONs(km, wrapper))
+
+	ks, err := LoadKeysetInfo(NewEncryptedReader(raw, wrapper))
+	if err != nil {
+		t.Fatal("failed to load key set info: " + err.Error())
+	}
+	if ks.Name != "inventory" || ks.Type != T_AES || ks.Purpose != P_DECRYPT_AND_ENCRYPT || !ks.Encrypted || ks.Primary != 1 || len(ks.Keys) != 2 {
+		t.Fatalf("bad key set info: %+v", ks)
+	}
+	for i, want := range []KeyInfo{{Version: 1, Status: S_PRIMARY, Size: 256}, {Version: 2, Status: S_ACTIVE, Size: 128}} {
+		got := ks.Keys[i]
+		hash := plain.(*keyCrypter).kz.keys[want.Version].KeyID()
+		if got.Version != want.Version || got.Status != want.Status || got.Size != want.Size || !bytes.Equal(got.KeyHash, hash) {
+			t.Errorf("key %d: got %+v, want %+v", i, got, want)
+		}
+	}
+
+	// without the wrapping key only the metadata is known
+	ks, err = LoadKeysetInfo(raw)
+	if err != nil {
+		t.Fatal("failed to load encrypted key set info: " + err.Error())
+	}
+	if len(ks.Keys) != 2 || ks.Keys[0].KeyHash != nil || ks.Keys[0].Size != 0 || ks.Keys[1].Status != S_ACTIVE {
+		t.Errorf("bad encrypted key set info: %+v", ks)
+	}
+}
+
+func TestDiffKeysets(t *testing.T) {
+	km := NewKeyManager()
+	km.Create("diff", P_DECRYPT_AND_ENCRYPT, T_AES)
+	km.AddKey(0, S_PRIMARY)
+	km.AddKey(0, S_ACTIVE)
+	km.AddKey(0, S_ACTIVE)
+	a := keyManagerReader(mustJSONs(km, nil))
+	if d, err := DiffKeysets(a, a); err != nil || !d.Empty() {
+		t.Fatalf("diff of a key set with itself: %+v, %v", d, err)
+	}
+	km.Promote(2)
+	km.Demote(3)
+	km.Demote(1)
+	km.Demote(1)
+	km.Revoke(1)
+	km.AddKey(0, S_ACTIVE)
+	d, err := DiffKeysets(a, keyManagerReader(mustJSONs(km, nil)))
+	if err != nil {
+		t.Fatal("DiffKeysets failed: " + err.Error())
+	}
+	if len(d.Added) != 1 || d.Added[0].Version != 4 || d.Added[0].Status != S_ACTIVE {
+		t.Errorf("added: %+v", d.Added)
+	}
+	if len(d.Removed) != 1 || d.Removed[0].Version != 1 {
+		t.Errorf("removed: %+v", d.Removed)
+	}
+	if len(d.Changed) != 2 || d.Changed[0].To.Status != S_PRIMARY || d.Changed[1].From.Status != S_ACTIVE || d.Changed[1].To.Status != S_INACTIVE {
+		t.Errorf("changed: %+v", d.Changed)
+	}
+}
+
+func TestKeyLifetime(t *testing.T) {
+	km := NewKeyManager()
+	km.Create("lifetime", P_DECRYPT_AND_ENCRYPT, T_AES)
+	km.AddKey(0, S_PRIMARY)
+	crypter, _ := NewCrypter(keyManagerReader(mustJSONs(km, nil)))
+	ciphertext, err := crypter.Encrypt([]byte(INPUT))
+	if err != nil {
+		t.Fatal("Encrypt failed: " + err.Error())
+	}
+
+	lc := km.(KeyLifetimeController)
+	if err := lc.SetKeyLifetime(2, time.Time{}, time.Time{}); err != ErrNoSuchKeyVersion {
+		t.Errorf("lifetime of a missing version: got %v, want ErrNoSuchKeyVersion", err)
+	}
+	now := time.Now()
+	if err := lc.SetKeyLifetime(1, now, now.Add(-time.Hour)); err != ErrInvalidKeyLifetime {
+		t.Errorf("lifetime ending before it starts: got %v, want ErrInvalidKeyLifetime", err)
+	}
+
+	for _, tt := range []struct {
+		notBefore, notAfter time.Time
+		err                 error
+	}{
+		{time.Time{}, now.Add(-time.Hour), ErrKeyExpired},
+		{now.Add(time.Hour), time.Time{}, ErrKeyNotYetValid},
+		{now.Add(-time.Hour), now.Add(time.Hour), nil},
+	} {
+		if err := lc.SetKeyLifetime(1, tt.notBefore, tt.notAfter); err != nil {
+			t.Fatal("SetKeyLifetime failed: " + err.Error())
+		}
+		crypter, err := NewCrypter(keyManagerReader(mustJSONs(km, nil)))
+		if err != nil {
+			t.Fatal("failed to load crypter: " + err.Error())
+		}
+		if _, err := crypter.Encrypt([]byte(INPUT)); err != tt.err {
+			t.Errorf("lifetime %v to %v: Encrypt got %v, want %v", tt.notBefore, tt.notAfter, err, tt.err)
+		}
+		if p, err := crypter.Decrypt(ciphertext); err != nil || string(p) != INPUT {
+			t.Errorf("lifetime %v to %v: Decrypt got %q, %v", tt.notBefore, tt.notAfter, p, err)
+		}
+	}
+
+	km = NewKeyManager()
+	km.Create("lifetime", P_SIGN_AND_VERIFY, T_HMAC_SHA1)
+	km.AddKey(0, S_PRIMARY)
+	signer, _ := NewSigner(keyManagerReader(mustJSONs(km, nil)))
+	signature, _ := signer.Sign([]byte(INPUT))
+	km.(KeyLifetimeController).SetKeyLifetime(1, time.Time{}, now.Add(-time.Hour))
+	r := keyManagerReader(mustJSONs(km, nil))
+	signer, err = NewSigner(r)
+	if err != nil {
+		t.Fatal("failed to load signer: " + err.Error())
+	}
+	if _, err := signer.Sign([]byte(INPUT)); err != ErrKeyExpired {
+		t.Errorf("Sign with an expired primary: got %v, want ErrKeyExpired", err)
+	}
+	if ok, err := signer.Verify([]byte(INPUT), signature); !ok || err != nil {
+		t.Errorf("Verify with an expired key: got %v, %v", ok, err)
+	}
+	if issues := ValidateKeyset(r); len(issues) == 0 {
+		t.Error("ValidateKeyset found no issue with an expired primary")
+	}
+}
+
+func TestPlanRotation(t *testing.T) {
+	now := time.Unix(1600000000, 0)
+	day := 24 * time.Hour
+	created := func(age time.Duration) int64 { return ExpirationMillis(now.Add(-age)) }
+	policy := RotationPolicy{MaxAge: 90 * day, Overlap: 7 * day}
+	for _, tt := range []struct {
+		versions []KeyVersion
+		policy   RotationPolicy
+		want     string
+	}{
+		{[]KeyVersion{{VersionNumber: 1, Status: S_ACTIVE, Created: created(day)}}, policy, "promote --version=1"},
+		{[]KeyVersion{{VersionNumber: 1, Status: S_PRIMARY, Created: created(10 * day)}}, policy, ""},
+		{[]KeyVersion{{VersionNumber: 1, Status: S_PRIMARY, Created: created(85 * day)}}, policy, "addkey --status=active"},
+		{[]KeyVersion{{VersionNumber: 1, Status: S_PRIMARY}}, policy, "addkey --status=active"},
+		{[]KeyVersion{{VersionNumber: 1, Status: S_PRIMARY, Created: created(91 * day)}, {VersionNumber: 2, Status: S_ACTIVE, Created: created(3 * day)}}, policy, ""},
+		{[]KeyVersion{{VersionNumber: 1, Status: S_PRIMARY, Created: created(91 * day)}, {VersionNumber: 2, Status: S_ACTIVE, Created: created(8 * day)}}, policy, "promote --version=2"},
+		{[]KeyVersion{{VersionNumber: 1, Status: S_ACTIVE, Created: created(200 * day), StatusChanged: created(6 * day)}, {VersionNumber: 2, Status: S_PRIMARY, Created: created(14 * day), StatusChanged: created(6 * day)}}, policy, ""},
+		{[]KeyVersion{{VersionNumber: 1, Status: S_ACTIVE, Created: created(98 * day), StatusChanged: created(8 * day)}, {VersionNumber: 2, Status: S_PRIMARY, Created: created(15 * day), StatusChanged: created(8 * day)}}, policy, "demote --version=1"},
+		{[]KeyVersion{{VersionNumber: 1, Status: S_ACTIVE}, {VersionNumber: 2, Status: S_PRIMARY, Created: created(8 * day)}}, policy, ""},
+		{[]KeyVersion{{VersionNumber: 1, Status: S_PRIMARY, Created: created(91 * day)}}, RotationPolicy{MaxAge: 90 * day}, "addkey --status=primary"},
+		{[]KeyVersion{{VersionNumber: 1, Status: S_PRIMARY}}, RotationPolicy{}, ""},
+		{[]KeyVersion{{VersionNumber: 1, Status: S_INACTIVE, Created: created(400 * day), StatusChanged: created(201 * day)}, {VersionNumber: 2, Status: S_PRIMARY, Created: created(8 * day)}}, RotationPolicy{MaxAge: 90 * day, RevokeAfter: 200 * day}, "revoke --version=1"},
+		// revoking counts from the demotion, not from when the key was added
+		{[]KeyVersion{{VersionNumber: 1, Status: S_INACTIVE, Created: created(400 * day), StatusChanged: created(10 * day)}, {VersionNumber: 2, Status: S_PRIMARY, Created: created(8 * day)}}, RotationPolicy{MaxAge: 90 * day, RevokeAfter: 200 * day}, ""},
+		// nor are keys of unknown age revoked, as in key sets from other implementations
+		{[]KeyVersion{{VersionNumber: 1, Status: S_INACTIVE}, {VersionNumber: 2, Status: S_PRIMARY, Created: created(8 * day)}}, RotationPolicy{MaxAge: 90 * day, RevokeAfter: 200 * day}, ""},
+		{[]KeyVersion{{VersionNumber: 1, Status: S_INACTIVE, Created: created(400 * day)}, {VersionNumber: 2, Status: S_PRIMARY}}, RotationPolicy{RevokeAfter: 200 * day}, ""},
+	} {
+		meta, _ := json.Marshal(KeyMeta{"plan", T_AES, P_DECRYPT_AND_ENCRYPT, false, tt.versions})
+		plan, err := PlanRotation(keyManagerReader([]string{string(meta)}), tt.policy, now)
+		if err != nil {
+			t.Fatal("PlanRotation failed: " + err.Error())
+		}
+		var ops []string
+		for _, op := range plan {
+			ops = append(ops, op.String())
+		}
+		if got := strings.Join(ops, ", "); got != tt.want {
+			t.Errorf("plan for %+v: got %q, want %q", tt.versions, got, tt.want)
+		}
+	}
+
+	km := NewKeyManager()
+	km.Create("plan", P_DECRYPT_AND_ENCRYPT, T_AES)
+	plan, _ := PlanRotation(keyManagerReader(mustJSONs(km, nil)), policy, time.Now())
+	if err := plan.Apply(km); err != nil {
+		t.Fatal("Apply failed: " + err.Error())
+	}
+	if plan, _ := PlanRotation(keyManagerReader(mustJSONs(km, nil)), policy, time.Now()); len(plan) != 0 {
+		t.Errorf("new primary key still due for rotation: %v", plan)
+	}
+
+	// demoting and revoking count from the status change KeyManager records
+	km.AddKey(0, S_PRIMARY)
+	km.Demote(1)
+	meta, _ := GetKeyMeta(keyManagerReader(mustJSONs(km, nil)))
+	if kv := meta.Versions[0]; kv.Status != S_INACTIVE || kv.StatusChanged == 0 || kv.StatusChanged < kv.Created {
+		t.Errorf("demotion wasn't recorded: %+v", kv)
+	}
+	revoke := RotationPolicy{RevokeAfter: 30 * day}
+	if plan, _ := PlanRotation(keyManagerReader(mustJSONs(km, nil)), revoke, time.Now().Add(29*day)); len(plan) != 0 {
+		t.Errorf("key revoked too soon after its demotion: %v", plan)
+	}
+	if plan, _ := PlanRotation(keyManagerReader(mustJSONs(km, nil)), revoke, time.Now().Add(31*day)); len(plan) != 1 || plan[0].String() != "revoke --version=1" {
+		t.Errorf("key not revoked after its demotion: %v", plan)
+	}
+
+	// a primary added by hand, as with addkey --status=primary, starts the overlap of the old one
+	km = NewKeyManager()
+	km.Create("plan", P_DECRYPT_AND_ENCRYPT, T_AES)
+	km.AddKey(0, S_PRIMARY)
+	old := km.(*keyManager).version(1)
+	old.Created = ExpirationMillis(time.Now().Add(-2 * day))
+	old.StatusChanged = old.Created
+	km.AddKey(0, S_PRIMARY)
+	short := RotationPolicy{MaxAge: day, Overlap: 12 * time.Hour}
+	if plan, _ := PlanRotation(keyManagerReader(mustJSONs(km, nil)), short, time.Now()); len(plan) != 0 {
+		t.Errorf("old primary demoted straight after a new one was added: %v", plan)
+	}
+	plan, _ = PlanRotation(keyManagerReader(mustJSONs(km, nil)), short, time.Now().Add(13*time.Hour))
+	if n := len(plan); n == 0 || plan[n-1].String() != "demote --version=1" {
+		t.Errorf("old primary not demoted after the overlap: %v", plan)
+	}
+}
+
+type recordingWriter struct {
+	writes [][]string
+	err    error
+}
+
+func (w *recordingWriter) WriteKeyset(jsons []string) error {
+	if w.err != nil {
+		return w.err
+	}
+	w.writes = append(w.writes, jsons)
+	return nil
+}
+
+func TestRotator(t *testing.T) {
+	km := NewKeyManager()
+	km.Create("rotator", P_DECRYPT_AND_ENCRYPT, T_AES)
+	km.AddKey(0, S_PRIMARY)
+	w := new(recordingWriter)
+	day := 24 * time.Hour
+	r := NewRotator(km, w, nil, RotationPolicy{MaxAge: 90 * day, Overlap: 7 * day, RevokeAfter: 200 * day})
+	now := time.Now()
+	r.now = func() time.Time { return now }
+	approve := true
+	var notified []string
+	r.Approve = func(plan RotationPlan) bool { return approve }
+	r.Notify = func(plan RotationPlan, err error) {
+		for _, op := range plan {
+			notified = append(notified, op.String())
+		}
+		if err != nil {
+			notified = append(notified, err.Error())
+		}
+	}
+
+	if plan, err := r.Rotate(); len(plan) != 0 || err != nil || len(w.writes) != 0 {
+		t.Fatalf("fresh key set rotated: %v, %v", plan, err)
+	}
+	now = now.Add(84 * day)
+	approve = false
+	if plan, err := r.Rotate(); plan != nil || err != nil || len(w.writes) != 0 {
+		t.Fatalf("unapproved plan applied: %v, %v", plan, err)
+	}
+	approve = true
+	w.err = errors.New("disk full")
+	if _, err := r.Rotate(); err != w.err {
+		t.Fatalf("failed write: got %v", err)
+	}
+	w.err = nil
+	if plan, err := r.Rotate(); len(plan) != 0 || err != nil || len(w.writes) != 1 {
+		t.Fatalf("retrying the write: %v, %v", plan, err)
+	}
+	now = now.Add(7 * day)
+	if _, err := r.Rotate(); err != nil || len(w.writes) != 2 {
+		t.Fatalf("promoting the next key: %v", err)
+	}
+	meta, _ := GetKeyMeta(keyManagerReader(w.writes[1]))
+	if len(meta.Versions) != 2 || meta.Versions[1].Status != S_PRIMARY {
+		t.Errorf("written key set wasn't rotated: %+v", meta.Versions)
+	}
+	want := "addkey --status=active,disk full,promote --version=2"
+	if got := strings.Join(notified, ","); got != want {
+		t.Errorf("notified %q, want %q", got, want)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := r.Run(ctx); err != context.Canceled {
+		t.Errorf("Run: got %v", err)
+	}
+}
+
+func TestFileWriter(t *testing.T) {
+	km := NewKeyManager()
+	km.Create("writer", P_DECRYPT_AND_ENCRYPT, T_AES)
+	km.AddKey(0, S_ACTIVE)
+	km.AddKey(0, S_PRIMARY)
+	km.AddKey(0, S_INACTIVE)
+	dir := filepath.Join(t.TempDir(), "keys")
+	w := NewFileWriter(dir)
+	if err := w.WriteKeyset(mustJSONs(km, nil)); err != nil {
+		t.Fatal("WriteKeyset failed: " + err.Error())
+	}
+	crypter, err := NewCrypter(NewFileReader(dir))
+	if err != nil {
+		t.Fatal("failed to read the written key set: " + err.Error())
+	}
+	c, _ := crypter.Encrypt([]byte(INPUT))
+	km.Demote(1)
+	km.Revoke(1)
+	km.Revoke(3)
+	if err := w.WriteKeyset(mustJSONs(km, nil)); err != nil {
+		t.Fatal("WriteKeyset failed: " + err.Error())
+	}
+	files, _ := ioutil.ReadDir(dir)
+	var names []string
+	for _, fi := range files {
+		names = append(names, fi.Name())
+	}
+	if got := strings.Join(names, " "); got != "2 meta" {
+		t.Errorf("files left: %s", got)
+	}
+	crypter, _ = NewCrypter(NewFileReader(dir))
+	if p, err := crypter.Decrypt(c); err != nil || string(p) != INPUT {
+		t.Errorf("decrypt with the rewritten key set: %q, %v", p, err)
+	}
+
+	// a key that fails to encrypt is an error, not a revoked version whose file is deleted
+	kekm := NewKeyManager()
+	kekm.Create("kek", P_DECRYPT_AND_ENCRYPT, T_AES)
+	kekm.AddKey(0, S_PRIMARY)
+	kekm.(KeyLifetimeController).SetKeyLifetime(1, time.Time{}, time.Now().Add(-time.Hour))
+	kek, _ := NewCrypter(keyManagerReader(mustJSONs(kekm, nil)))
+	if jsons, err := km.ToJSONs(kek); err == nil {
+		t.Errorf("ToJSONs with an expired encrypting key: got %q", jsons)
+	}
+	jsons := mustJSONs(km, nil)
+	jsons[2] = ""
+	if err := w.WriteKeyset(jsons); err != ErrMalformedJSONKeySet {
+		t.Errorf("WriteKeyset of a listed version without a key: got %v", err)
+	}
+	if _, err := NewCrypter(NewFileReader(dir)); err != nil {
+		t.Errorf("failed write damaged the key set: %v", err)
+	}
+}
+
+func TestKeyManagerImportRevoke(t *testing.T) {
+	km := NewKeyManager()
+	km.Create("import", P_SIGN_AND_VERIFY, T_EC_PRIV)
+	km.AddKey(0, S_PRIMARY)
+	priv, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	der, _ := x509.MarshalECPrivateKey(priv)
+	r, err := ImportPrivateKeyFromPEMBytes(pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), nil, P_SIGN_AND_VERIFY)
+	if err != nil {
+		t.Fatal("failed to import pem: " + err.Error())
+	}
+	if err := km.ImportKey(r, S_PRIMARY); err != nil {
+		t.Fatal("failed to import key: " + err.Error())
+	}
+	imported, _ := NewSigner(r)
+	s, _ := imported.Sign([]byte(INPUT))
+	verifier, _ := NewVerifier(keyManagerReader(mustJSONs(km, nil)))
+	if ok, _ := verifier.Verify([]byte(INPUT), s); !ok {
+		t.Error("key set failed to verify with the imported key")
+	}
+	ed, _ := ImportJWK([]byte(`{"kty":"OKP","crv":"Ed25519","x":"11qYAYKxCrfVS_7TyWQHOg7hcvPapiMlrwIaaPcHURo","d":"nWGxne_9WmC6hEr0kuwsxERJxWl7MmkZcDusAxyuf2A"}`))
+	if err := km.ImportKey(ed, S_ACTIVE); err != ErrUnsupportedType {
+		t.Errorf("imported a key of the wrong type: %v", err)
+	}
+
+	if err := km.Revoke(1); err != ErrKeyNotInactive {
+		t.Errorf("revoked an active key: %v", err)
+	}
+	km.Demote(1)
+	if err := km.Revoke(1); err != nil {
+		t.Fatal("failed to revoke key: " + err.Error())
+	}
+	if err := km.Revoke(1); err != ErrNoSuchKeyVersion {
+		t.Errorf("revoked a key twice: %v", err)
+	}
+	js := mustJSONs(km, nil)
+	if len(js) != 3 || js[1] != "" {
+		t.Fatal("revoked version wasn't left as a gap")
+	}
+	signer, err := NewSigner(keyManagerReader(js))
+	if err != nil {
+		t.Fatal("failed to load key set with a revoked version: " + err.Error())
+	}
+	if ok, _ := signer.Verify([]byte(INPUT), s); !ok {
+		t.Error("key set lost the imported key after the revoke")
+	}
+}
+
+func TestValidateKeyset(t *testing.T) {
+	km := NewKeyManager()
+	km.Create("check", P_DECRYPT_AND_ENCRYPT, T_AES)
+	km.AddKey(0, S_PRIMARY)
+	if issues := ValidateKeyset(keyManagerReader(mustJSONs(km, nil))); issues != nil {
+		t.Errorf("issues found in a good key set: %v", issues)
+	}
+
+	km = NewKeyManager()
+	km.Create("check", P_SIGN_AND_VERIFY, T_RSA_PRIV)
+	km.AddKey(1024, S_ACTIVE)
+	km.AddKey(0, S_ACTIVE)
+	js := mustJSONs(km, nil)
+	js[2] = `{"aesKeyString":"x"}`
+	issues := ValidateKeyset(keyManagerReader(js))
+	if len(issues) != 3 {
+		t.Fatalf("expected 3 issues, got %v", issues)
+	}
+	if issues[0].Err != ErrNoPrimaryKey || issues[0].Severity != ISSUE_ERROR {
+		t.Errorf("missing primary not reported: %v", issues[0])
+	}
+	if issues[1].Err != ErrWeakKey || issues[1].Version != 1 || issues[1].Severity != ISSUE_WARNING {
+		t.Errorf("weak key not reported: %v", issues[1])
+	}
+	if issues[2].Version != 2 || issues[2].Severity != ISSUE_ERROR {
+		t.Errorf("mismatched key not reported: %v", issues[2])
+	}
+
+	issues = ValidateKeyset(keyManagerReader(js[:2]))
+	if len(issues) != 3 || !errors.Is(issues[2].Err, ErrKeyNotFound) {
+		t.Errorf("unreadable key not reported: %v", issues)
+	}
+}
+
+func TestAESConcurrentUse(t *testing.T) {
+	km := NewKeyManager()
+	km.Create("concurrent", P_DECRYPT_AND_ENCRYPT, T_AES)
+	km.AddKey(0, S_PRIMARY)
+	crypter, _ := NewCrypter(keyManagerReader(mustJSONs(km, nil)))
+	errs := make(chan error, 8)
+	for i := 0; i < 8; i++ {
+		go func() {
+			for j := 0; j < 50; j++ {
+				c, err := crypter.Encrypt([]byte(INPUT))
+				if err == nil {
+					_, err = crypter.Decrypt(c)
+				}
+				if err != nil {
+					errs <- err
+					return
+				}
+			}
+			errs <- nil
+		}()
+	}
+	for i := 0; i < 8; i++ {
+		if err := <-errs; err != nil {
+			t.Error("concurrent encrypt/decrypt failed: " + err.Error())
+		}
+	}
+}
+
+// run with -race: reloads swap the key tables under callers in other goroutines
+func TestConcurrentReload(t *testing.T) {
+	akm := NewKeyManager()
+	akm.Create("concurrent", P_DECRYPT_AND_ENCRYPT, T_AES)
+	akm.AddKey(0, S_PRIMARY)
+	crypter, _ := NewCrypter(liveKeyManagerReader{akm})
+	crypter.(ReloadController).SetReloadPolicy(RELOAD_ON_UNKNOWN_KEY)
+	hkm := NewKeyManager()
+	hkm.Create("concurrent", P_SIGN_AND_VERIFY, T_HMAC_SHA1)
+	hkm.AddKey(0, S_PRIMARY)
+	verifier, _ := NewVerifier(liveKeyManagerReader{hkm})
+	verifier.(ReloadController).SetReloadPolicy(RELOAD_ON_UNKNOWN_KEY)
+
+	// rotate both key sets before any goroutine starts, as KeyManagers aren't safe for concurrent use
+	akm.AddKey(0, S_PRIMARY)
+	newCrypter, _ := NewCrypter(keyManagerReader(mustJSONs(akm, nil)))
+	ciphertext, _ := newCrypter.Encrypt([]byte(INPUT))
+	hkm.AddKey(0, S_PRIMARY)
+	signer, _ := NewSigner(keyManagerReader(mustJSONs(hkm, nil)))
+	signature, _ := signer.Sign([]byte(INPUT))
+
+	errs := make(chan error, 8)
+	for i := 0; i < 8; i++ {
+		go func() {
+			for j := 0; j < 50; j++ {
+				crypter.(KeyLookupController).SetTryAllKeys(j%2 == 0)
+				c, err := crypter.Encrypt([]byte(INPUT))
+				if err == nil {
+					_, err = crypter.Decrypt(c)
+				}
+				if err == nil {
+					_, _, err = crypter.(InfoDecrypter).DecryptWithInfo(ciphertext)
+				}
+				if err == nil {
+					var ok bool
+					ok, _, err = verifier.(InfoVerifier).VerifyWithInfo([]byte(INPUT), signature)
+					if !ok && err == nil {
+						err = ErrInvalidSignature
+					}
+				}
+				if err != nil {
+					errs <- err
+					return
+				}
+			}
+			errs <- nil
+		}()
+	}
+	for i := 0; i < 8; i++ {
+		if err := <-errs; err != nil {
+			t.Error("concurrent use across a reload failed: " + err.Error())
+		}
+	}
+}
+
+func TestBufferPooling(t *testing.T) {
+	km := NewKeyManager()
+	km.Create("pool", P_DECRYPT_AND_ENCRYPT, T_AES)
+	km.AddKey(0, S_PRIMARY)
+	js := mustJSONs(km, nil)
+	for _, pooling := range []bool{true, false} {
+		for _, encoding := range []Encoding{BASE64W, HEX, NO_ENCODING} {
+			crypter, _ := NewCrypter(keyManagerReader(js), WithBufferPooling(pooling), WithEncoding(encoding), WithCompression(GZIP))
+			if crypter.(BufferPoolController).BufferPooling() != pooling {
+				t.Errorf("buffer pooling not set to %v", pooling)
+			}
+			for i := 0; i < 3; i++ {
+				c, err := crypter.Encrypt([]byte(INPUT))
+				if err != nil {
+					t.Fatal("failed to encrypt: " + err.Error())
+				}
+				p, err := crypter.Decrypt(c)
+				if err != nil || string(p) != INPUT {
+					t.Errorf("round trip failed (pooling %v, encoding %d): %v", pooling, encoding, err)
+				}
+			}
+		}
+	}
+	// padded base64 from other implementations still decodes
+	crypter, _ := NewCrypter(keyManagerReader(js), WithEncoding(NO_ENCODING))
+	c, _ := crypter.Encrypt([]byte(INPUT))
+	crypter.SetEncoding(BASE64W)
+	if p, err := crypter.Decrypt(base64.URLEncoding.EncodeToString([]byte(c))); err != nil || string(p) != INPUT {
+		t.Errorf("failed to decrypt padded base64: %v", err)
+	}
+}
+
+func TestUnknownKeyFailsFast(t *testing.T) {
+	km := NewKeyManager()
+	km.Create("fast", P_DECRYPT_AND_ENCRYPT, T_AES)
+	km.AddKey(0, S_PRIMARY)
+	crypter, _ := NewCrypter(keyManagerReader(mustJSONs(km, nil)))
+	other := NewKeyManager()
+	other.Create("other", P_DECRYPT_AND_ENCRYPT, T_AES)
+	other.AddKey(0, S_PRIMARY)
+	otherCrypter, _ := NewCrypter(keyManagerReader(mustJSONs(other, nil)))
+	c, _ := otherCrypter.Encrypt([]byte(INPUT))
+	// the body is never decoded, so garbage after the header makes no difference
+	for _, s := range []string{c, c[:8] + "!!!!"} {
+		if _, err := crypter.Decrypt(s); !errors.Is(err, ErrKeyNotFound) {
+			t.Errorf("expected ErrKeyNotFound for %q, got %v", s, err)
+		}
+	}
+	c, _ = crypter.Encrypt([]byte(INPUT))
+	if _, err := crypter.Decrypt(c[:8] + "!!!!"); err != ErrBase64Decoding {
+		t.Errorf("expected ErrBase64Decoding, got %v", err)
+	}
+}
+
+func BenchmarkAESEncrypt(b *testing.B) {
+	km := NewKeyManager()
+	km.Create("bench", P_DECRYPT_AND_ENCRYPT, T_AES)
+	km.AddKey(0, S_PRIMARY)
+	crypter, _ := NewCrypter(keyManagerReader(mustJSONs(km, nil)))
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		crypter.Encrypt([]byte(INPUT))
+	}
+}
+
+func BenchmarkAESDecrypt(b *testing.B) {
+	km := NewKeyManager()
+	km.Create("bench", P_DECRYPT_AND_ENCRYPT, T_AES)
+	km.AddKey(0, S_PRIMARY)
+	crypter, _ := NewCrypter(keyManagerReader(mustJSONs(km, nil)))
+	c, _ := crypter.Encrypt([]byte(INPUT))
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		crypter.Decrypt(c)
+	}
+}
+
+func TestEnvelopeEncryptDecrypt(t *testing.T) {
+	km := NewKeyManager()
+	km.Create("kek", P_DECRYPT_AND_ENCRYPT, T_RSA_PRIV)
+	km.AddKey(1024, S_PRIMARY)
+	kek, _ := NewCrypter(keyManagerReader(mustJSONs(km, nil)))
+	for _, encoding := range []Encoding{BASE64W, NO_ENCODING} {
+		kek.SetEncoding(encoding)
+		blob, err := EnvelopeEncrypt(kek, []byte(INPUT))
+		if err != nil {
+			t.Fatal("failed to envelope encrypt: " + err.Error())
+		}
+		if p, err := EnvelopeDecrypt(kek, blob); err != nil || string(p) != INPUT {
+			t.Errorf("envelope decrypt(encrypt(p)) != p: %v", err)
+		}
+	}
+	kek.SetEncoding(NO_ENCODING)
+	blob, _ := EnvelopeEncrypt(kek, []byte(INPUT))
+	b := []byte(blob)
+	b[len(b)-1] ^= 1
+	if _, err := EnvelopeDecrypt(kek, string(b)); err != ErrInvalidSignature {
+		t.Errorf("decrypted a tampered envelope: %v", err)
+	}
+	b = []byte(blob)
+	b[1] = 0xff
+	if _, err := EnvelopeDecrypt(kek, string(b)); err != ErrShortCiphertext {
+		t.Errorf("expected ErrShortCiphertext for a bad wrapped key length, got %v", err)
+	}
+
+	other := NewKeyManager()
+	other.Create("other", P_DECRYPT_AND_ENCRYPT, T_AES)
+	other.AddKey(0, S_PRIMARY)
+	otherKek, _ := NewCrypter(keyManagerReader(mustJSONs(other, nil)), WithEncoding(NO_ENCODING))
+	if _, err := EnvelopeDecrypt(otherKek, blob); !errors.Is(err, ErrKeyNotFound) {
+		t.Errorf("decrypted an envelope with the wrong kek: %v", err)
+	}
+}
+
+// a KMSClient that "encrypts" by prefixing the key id and flipping bits
+type fakeKMS struct {
+	keyID string
+}
+
+func (f fakeKMS) Encrypt(ctx context.Context, keyID string, plaintext []byte, ec map[string]string) ([]byte, error) {
+	b := []byte(keyID + ec["keyset"] + ":")
+	for _, c := range plaintext {
+		b = append(b, c^0x5a)
+	}
+	return b, nil
+}
+
+func (f fakeKMS) Decrypt(ctx context.Context, ciphertext []byte, ec map[string]string) ([]byte, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	prefix := []byte(f.keyID + ec["keyset"] + ":")
+	if !bytes.HasPrefix(ciphertext, prefix) {
+		return nil, errors.New("fake kms: wrong key or encryption context")
+	}
+	var p []byte
+	for _, c := range ciphertext[len(prefix):] {
+		p = append(p, c^0x5a)
+	}
+	return p, nil
+}
+
+func TestKMSEncryptedReader(t *testing.T) {
+	kms := NewKMSCrypter(fakeKMS{"cmk-1"}, "cmk-1", map[string]string{"keyset": "payments"})
+	km := NewKeyManager()
+	km.Create("kms", P_DECRYPT_AND_ENCRYPT, T_AES)
+	km.AddKey(0, S_PRIMARY)
+	js := mustJSONs(km, kms)
+	r := NewEncryptedReader(keyManagerReader(js), kms)
+	testEncryptDecrypt(t, "kms encrypted", r)
+
+	// standard base64 with a trailing newline, as written by the aws cli
+	b, _ := decodeWeb64String(js[1])
+	js[1] = base64.StdEncoding.EncodeToString(b) + "\n"
+	testEncryptDecrypt(t, "kms encrypted, standard base64", NewEncryptedReader(keyManagerReader(js), kms))
+
+	wrong := NewKMSCrypter(fakeKMS{"cmk-1"}, "cmk-1", map[string]string{"keyset": "billing"})
+	if _, err := NewCrypter(NewEncryptedReader(keyManagerReader(js), wrong)); err == nil {
+		t.Error("key set decrypted with the wrong encryption context")
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := NewCrypterWithContext(ctx, r); err != context.Canceled {
+		t.Errorf("expected context.Canceled, got %v", err)
+	}
+}
+
+// a GCPKMSClient and AzureKeyVaultClient binding ciphertexts to the key name
+type fakeCloudKMS struct{}
+
+func (fakeCloudKMS) Encrypt(ctx context.Context, name string, plaintext []byte, aad []byte) ([]byte, error) {
+	return append([]byte(name+string(aad)+":"), plaintext...), nil
+}
+
+func (fakeCloudKMS) Decrypt(ctx context.Context, name string, ciphertext []byte, aad []byte) ([]byte, error) {
+	prefix := []byte(name + string(aad) + ":")
+	if !bytes.HasPrefix(ciphertext, prefix) {
+		return nil, errors.New("fake kms: wrong key")
+	}
+	return ciphertext[len(prefix):], nil
+}
+
+func (f fakeCloudKMS) WrapKey(ctx context.Context, keyName string, KeyVersion string, algorithm string, key []byte) ([]byte, error) {
+	return f.Encrypt(ctx, keyName+KeyVersion, key, []byte(algorithm))
+}
+
+func (f fakeCloudKMS) UnwrapKey(ctx context.Context, keyName string, KeyVersion string, algorithm string, wrapped []byte) ([]byte, error) {
+	return f.Decrypt(ctx, keyName+KeyVersion, wrapped, []byte(algorithm))
+}
+
+func TestExternalCrypters(t *testing.T) {
+	km := NewKeyManager()
+	km.Create("external", P_DECRYPT_AND_ENCRYPT, T_AES)
+	km.AddKey(0, S_PRIMARY)
+	for name, ext := range map[string]Crypter{
+		"gcp":   NewGCPKMSCrypter(fakeCloudKMS{}, "projects/p/locations/global/keyRings/r/cryptoKeys/k", nil),
+		"azure": NewAzureKeyVaultCrypter(fakeCloudKMS{}, "kek", "", "RSA-OAEP-256"),
+	} {
+		testEncryptDecrypt(t, name+" encrypted", NewEncryptedReader(keyManagerReader(mustJSONs(km, ext)), ext))
+		blob, err := EnvelopeEncrypt(ext, []byte(INPUT))
+		if err != nil {
+			t.Fatal(name + ": failed to envelope encrypt: " + err.Error())
+		}
+		if p, err := EnvelopeDecrypt(ext, blob); err != nil || string(p) != INPUT {
+			t.Errorf("%s: envelope decrypt(encrypt(p)) != p: %v", name, err)
+		}
+	}
+	other := NewAzureKeyVaultCrypter(fakeCloudKMS{}, "other", "", "RSA-OAEP-256")
+	c, _ := NewAzureKeyVaultCrypter(fakeCloudKMS{}, "kek", "", "RSA-OAEP-256").Encrypt([]byte(INPUT))
+	if _, err := other.Decrypt(c); err == nil {
+		t.Error("decrypted with the wrong key vault key")
+	}
+}
+
+func TestExternalSigner(t *testing.T) {
+	// the private keys stand in for keys on a token: only their crypto.Signer is used
+	ecPriv, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	rsaPriv, _ := rsa.GenerateKey(rand.Reader, 1024)
+	ecDER, _ := x509.MarshalPKIXPublicKey(&ecPriv.PublicKey)
+	rsaDER, _ := x509.MarshalPKIXPublicKey(&rsaPriv.PublicKey)
+	for _, tt := range []struct {
+		name   string
+		ktype  KeyType
+		signer crypto.Signer
+		pub    func([]byte) (KeyReader, error)
+		der    []byte
+	}{
+		{"ec", T_EC_PUB, ecPriv, ImportECDSAPublicKeyFromPEMBytesForVerify, ecDER},
+		{"rsa", T_RSA_PUB, rsaPriv, ImportRSAPublicKeyFromPEMBytesForVerify, rsaDER},
+	} {
+		pr, err := tt.pub(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: tt.der}))
+		if err != nil {
+			t.Fatal(tt.name + ": failed to import public key: " + err.Error())
+		}
+		km := NewKeyManager()
+		km.Create("hsm", P_VERIFY, tt.ktype)
+		if err := km.ImportKey(pr, S_PRIMARY); err != nil {
+			t.Fatal(tt.name + ": failed to add public key: " + err.Error())
+		}
+		r := keyManagerReader(mustJSONs(km, nil))
+		signer, err := NewExternalSigner(r, map[int]crypto.Signer{1: tt.signer})
+		if err != nil {
+			t.Fatal(tt.name + ": failed to create external signer: " + err.Error())
+		}
+		s, err := signer.Sign([]byte(INPUT))
+		if err != nil {
+			t.Fatal(tt.name + ": failed to sign: " + err.Error())
+		}
+		verifier, _ := NewVerifier(r)
+		if ok, err := verifier.Verify([]byte(INPUT), s); !ok || err != nil {
+			t.Errorf("%s: external signature didn't verify: %v", tt.name, err)
+		}
+		other, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if _, err := NewExternalSigner(r, map[int]crypto.Signer{1: other}); err != ErrSignerMismatch {
+			t.Errorf("%s: expected ErrSignerMismatch, got %v", tt.name, err)
+		}
+		if _, err := NewExternalSigner(r, nil); err != ErrNoPrimaryKey {
+			t.Errorf("%s: expected ErrNoPrimaryKey without a signer, got %v", tt.name, err)
+		}
+	}
+}
+
+func TestImportSignerDecrypter(t *testing.T) {
+	rsaPriv, _ := rsa.GenerateKey(rand.Reader, 1024)
+	_, edPriv, _ := ed25519.GenerateKey(rand.Reader)
+	for name, s := range map[string]crypto.Signer{"rsa": rsaPriv, "ed25519": edPriv} {
+		r, err := ImportSigner(s, P_SIGN_AND_VERIFY)
+		if err != nil {
+			t.Fatal(name + ": failed to import signer: " + err.Error())
+		}
+		signer, err := NewSigner(r)
+		if err != nil {
+			t.Fatal(name + ": failed to create signer: " + err.Error())
+		}
+		sig, _ := signer.Sign([]byte(INPUT))
+		if ok, err := signer.Verify([]byte(INPUT), sig); !ok || err != nil {
+			t.Errorf("%s: opaque signature didn't verify: %v", name, err)
+		}
+		km := NewKeyManager()
+		km.Create("opaque", P_SIGN_AND_VERIFY, T_RSA_PRIV)
+		if err := km.ImportKey(r, S_PRIMARY); err != ErrOpaqueKey {
+			t.Errorf("%s: imported an opaque key into a key set: %v", name, err)
+		}
+	}
+	// the signature matches the one from the raw key
+	pr, _ := ImportSigner(rsaPriv, P_SIGN_AND_VERIFY)
+	opaque, _ := NewSigner(pr)
+	raw, _ := NewSigner(newImportedRSAPrivateKeyReader(rsaPriv, P_SIGN_AND_VERIFY))
+	s1, _ := opaque.Sign([]byte(INPUT))
+	if ok, _ := raw.Verify([]byte(INPUT), s1); !ok {
+		t.Error("opaque rsa signature didn't verify with the raw key")
+	}
+	if _, err := ImportSigner(rsaPriv, P_DECRYPT_AND_ENCRYPT); err != ErrUnacceptablePurpose {
+		t.Errorf("expected ErrUnacceptablePurpose, got %v", err)
+	}
+
+	dr, err := ImportDecrypter(rsaPriv)
+	if err != nil {
+		t.Fatal("failed to import decrypter: " + err.Error())
+	}
+	testEncryptDecrypt(t, "opaque rsa", dr)
+}
+
+func TestSessionEncryptDecrypt(t *testing.T) {
+	f := NewFileReader(TESTDATA + "rsa")
+	kz, err := NewCrypter(f)
+	if err != nil {
+		t.Fatal("failed to create crypter with rsa: " + err.Error())
+	}
+	sess1, keys, err := NewSessionEncrypter(kz)
+	if err != nil {
+		t.Fatal("failed to create session encrypter: " + err.Error())
+	}
+	c, err := sess1.Encrypt([]byte(INPUT))
+	if err != nil {
+		t.Fatal("failed to session encrypt: " + err.Error())
+	}
+	sess2, err := NewSessionDecrypter(kz, keys)
+	if err != nil {
+		t.Fatal("failed to create session decrypter: " + err.Error())
+	}
+	p, err := sess2.Decrypt(c)
+	if err != nil {
+		t.Fatal("failed to session decrypt: " + err.Error())
+	}
+	if string(p) != INPUT {
+		t.Error("session decrypt(encrypt(p)) != p")
+	}
+}
+
+func TestEncrypterIsNotDecrypter(t *testing.T) {
+	km := NewKeyManager()
+	km.Create("public", P_DECRYPT_AND_ENCRYPT, T_RSA_PRIV)
+	km.AddKey(1024, S_PRIMARY)
+	encrypter, err := NewEncrypter(keyManagerReader(mustJSONs(km.PubKeys(), nil)), WithMetrics(new(recordingSink)))
+	if err != nil {
+		t.Fatal("failed to create rsa public encrypter: " + err.Error())
+	}
+	if _, ok := encrypter.(Decrypter); ok {
+		t.Error("public key encrypter is a Decrypter")
+	}
+	if _, ok := encrypter.(VersionedEncrypter); !ok {
+		t.Error("public key encrypter isn't a VersionedEncrypter")
+	}
+	if encrypter.(MetricsController).MetricsSink() == nil {
+		t.Error("option wasn't applied to the encrypter")
+	}
+	c, _ := encrypter.Encrypt([]byte(INPUT))
+	crypter, _ := NewCrypter(keyManagerReader(mustJSONs(km, nil)))
+	if p, err := crypter.Decrypt(c); err != nil || string(p) != INPUT {
+		t.Errorf("crypter failed to decrypt: %v", err)
+	}
+
+	km = NewKeyManager()
+	km.Create("stream", P_DECRYPT_AND_ENCRYPT, T_AES)
+	km.AddKey(0, S_PRIMARY)
+	streamer, err := NewEncryptStreamer(keyManagerReader(mustJSONs(km, nil)))
+	if err != nil {
+		t.Fatal("failed to create encrypt streamer: " + err.Error())
+	}
+	if _, ok := streamer.(CryptStreamer); ok {
+		t.Error("encrypt streamer is a CryptStreamer")
+	}
+}
+
+func TestGeneratedSessionEncryptDecrypt(t *testing.T) {
+	km := NewKeyManager()
+	km.Create("session", P_DECRYPT_AND_ENCRYPT, T_RSA_PRIV)
+	km.AddKey(1024, S_PRIMARY)
+	// the sender only holds the public key
+	kpub, err := NewEncrypter(keyManagerReader(mustJSONs(km.PubKeys(), nil)))
+	if err != nil {
+		t.Fatal("failed to create rsa public encrypter: " + err.Error())
+	}
+	sess1, keys, err := NewSessionEncrypter(kpub)
+	if err != nil {
+		t.Fatal("failed to create session encrypter: " + err.Error())
+	}
+	var ciphertexts []string
+	for i := 0; i < 3; i++ {
+		c, err := sess1.Encrypt([]byte(INPUT))
+		if err != nil {
+			t.Fatal("failed to session encrypt: " + err.Error())
+		}
+		ciphertexts = append(ciphertexts, c)
+	}
+	kz, _ := NewCrypter(keyManagerReader(mustJSONs(km, nil)))
+	sess2, err := NewSessionDecrypter(kz, keys)
+	if err != nil {
+		t.Fatal("failed to create session decrypter: " + err.Error())
+	}
+	for _, c := range ciphertexts {
+		if p, err := sess2.Decrypt(c); err != nil || string(p) != INPUT {
+			t.Error("session decrypt(encrypt(p)) != p")
+		}
+	}
+	if _, err := NewSessionDecrypter(kz, keys[:len(keys)-4]); err == nil {
+		t.Error("session decrypter accepted truncated session keys")
+	}
+}
+
+func TestGeneratedSignedSessionEncryptDecrypt(t *testing.T) {
+	crypt := NewKeyManager()
+	crypt.Create("crypt", P_DECRYPT_AND_ENCRYPT, T_RSA_PRIV)
+	// the session material json doesn't fit in a 1024-bit OAEP block
+	crypt.AddKey(2048, S_PRIMARY)
+	sign := NewKeyManager()
+	sign.Create("sign", P_SIGN_AND_VERIFY, T_EC_PRIV)
+	sign.AddKey(0, S_PRIMARY)
+	kpub, _ := NewEncrypter(keyManagerReader(mustJSONs(crypt.PubKeys(), nil)))
+	signer, _ := NewSigner(keyManagerReader(mustJSONs(sign, nil)))
+	sess1, keys, err := NewSignedSessionEncrypter(kpub, signer)
+	if err != nil {
+		t.Fatal("failed to create signed session encrypter: " + err.Error())
+	}
+	c, err := sess1.Encrypt([]byte(INPUT))
+	if err != nil {
+		t.Fatal("failed to signed session encrypt: " + err.Error())
+	}
+	kz, _ := NewCrypter(keyManagerReader(mustJSONs(crypt, nil)))
+	verifier, _ := NewVerifier(keyManagerReader(mustJSONs(sign.PubKeys(), nil)))
+	sess2, err := NewSignedSessionDecrypter(kz, verifier, keys)
+	if err != nil {
+		t.Fatal("failed to create signed session decrypter: " + err.Error())
+	}
+	if p, err := sess2.Decrypt(c); err != nil || string(p) != INPUT {
+		t.Error("signed session decrypt(encrypt(p)) != p")
+	}
+	// a different sender's key must be rejected
+	other := NewKeyManager()
+	other.Create("other", P_SIGN_AND_VERIFY, T_EC_PRIV)
+	other.AddKey(0, S_PRIMARY)
+	otherVerifier, _ := NewVerifier(keyManagerReader(mustJSONs(other, nil)))
+	sess3, _ := NewSignedSessionDecrypter(kz, otherVerifier, keys)
+	if _, err := sess3.Decrypt(c); err == nil {
+		t.Error("signed session decrypt accepted the wrong signer")
+	}
+	// the signature binds the session nonce, so replaying under another session fails
+	_, keys2, _ := NewSignedSessionEncrypter(kpub, signer)
+	sess4, _ := NewSignedSessionDecrypter(kz, verifier, keys2)
+	if _, err := sess4.Decrypt(c); err == nil {
+		t.Error("signed session decrypt accepted a ciphertext from another session")
+	}
+}
+
+func TestSessionEncryptDecryptStream(t *testing.T) {
+	f := NewFileReader(TESTDATA + "rsa")
+	kz, err := NewCrypter(f)
+	if err != nil {
+		t.Fatal("failed to create crypter with rsa: " + err.Error())
+	}
+	kz.SetCompression(ZLIB)
+	for size := 1024 * 1024; size < 1024*1024+5; size += 1 {
+		source := make([]byte, size)
+		io.ReadFull(rand.Reader, source)
+		for iE, enc := range []Encoding{NO_ENCODING, BASE64W} {
+			for iC, compr := range []Compression{NO_COMPRESSION, ZLIB, GZIP} {
+				buf := bytes.NewBuffer(nil)
+				encoder, err := NewSessionEncryptWriter(kz, buf, enc, compr)
+				if err != nil {
+					t.Fatal("failed to create session encrypter: " + err.Error())
+				}
+				dumper := bytes.NewBuffer(source)
+				if _, err := dumper.WriteTo(encoder); err != nil {
+					t.Fatal("failed to encrypt with session", err)
+				}
+				if err := encoder.Close(); err != nil {
+					t.Fatal("Failed to close encoder", err)
+				}
+				plainReader, err := NewSessionDecryptReader(kz, buf, enc, compr)
+				if err != nil {
+					t.Fatal("failed to create session decrypter: " + err.Error())
+				}
+				out := bytes.NewBuffer(nil)
+				if _, err := out.ReadFrom(plainReader); err != nil && err != io.EOF {
+					t.Fatalf("[Test %d/%d] Error reading session ciphered data: %s", iE, iC, err)
+				}
+				if err := plainReader.Close(); err != nil {
+					t.Fatal("Could not close reader", err)
+				}
+				if !bytes.Equal(out.Bytes(), source) {
+					t.Error("session decrypt(encrypt(p)) != p")
+				}
+			}
+		}
+	}
+}
+
+func TestEncryptDecryptCompressed(t *testing.T) {
+	f := NewFileReader(TESTDATA + "aes")
+	longinput := INPUT + INPUT + INPUT + INPUT + INPUT
+	longinput = longinput + INPUT + INPUT + INPUT + INPUT + INPUT
+	longinput = longinput + INPUT + INPUT + INPUT + INPUT + INPUT
+	longinput = longinput + INPUT + INPUT + INPUT + INPUT + INPUT
+	longinput = longinput + INPUT + INPUT + INPUT + INPUT + INPUT
+	longinput = longinput + INPUT + INPUT + INPUT + INPUT + INPUT
+	kz, err := NewCrypter(f)
+	if err != nil {
+		t.Fatal("failed to create crypter for aes: " + err.Error())
+	}
+	c, err := kz.Encrypt([]byte(longinput))
+	if err != nil {
+		t.Fatal("failed to encrypt: " + err.Error())
+	}
+	uncompressedLen := len(c)
+	p, err := kz.Decrypt(c)
+	if err != nil {
+		t.Fatal("failed to decrypt: " + err.Error())
+	}
+	if string(p) != longinput {
+		t.Error("aes decrypt(encrypt(p)) != p")
+	}
+	for _, compression := range []struct {
+		kc    Compression
+		ctype string
+	}{{GZIP, "gzip"}, {ZLIB, "zlib"}} {
+		kz.SetCompression(compression.kc)
+		c, err = kz.Encrypt([]byte(longinput))
+		if err != nil {
+			t.Fatalf("failed to encrypt with compression %s: %s", compression.ctype, err)
+		}
+		compressedLen := len(c)
+		p, err = kz.Decrypt(c)
+		if err != nil {
+			t.Fatalf("failed to decrypt with compression %s: %s", compression.ctype, err)
+		}
+		if string(p) != longinput {
+			t.Error(compression.ctype + " raw decrypt(encrypt(p)) != p")
+		}
+		if compressedLen >= uncompressedLen {
+			t.Error(compression.ctype + " failed to compress")
+		}
+	}
+}
+
+func TestSignVerifyBase64(t *testing.T) {
+	f := NewFileReader(TESTDATA + "dsa")
+	kz, err := NewSigner(f)
+	if err != nil {
+		t.Fatal("failed to create signer: " + err.Error())
+	}
+	s, err := kz.Sign([]byte(INPUT))
+	if err != nil {
+		t.Fatal("failed to sign: " + err.Error())
+	}
+	if s[0] != 'A' { // first byte will 0, so first byte of base64 will be 'A'
+		t.Error("bad version byte for base64 signature")
+	}
+	kz.SetEncoding(NO_ENCODING)
+	s, err = kz.Sign([]byte(INPUT))
+	if err != nil {
+		t.Fatal("failed to sign with no encoding: " + err.Error())
+	}
+	if s[0] != 0 {
+		t.Error("bad version byte for raw signature")
+	}
+	kv, err := NewVerifier(f)
+	if err != nil {
+		t.Fatal("failed to create verifier")
+	}
+	kv.SetEncoding(NO_ENCODING)
+	b, err := kv.Verify([]byte(INPUT), s)
+	if err != nil {
+		t.Fatal("failed to verify with no encoding: " + err.Error())
+	}
+	if !b {
+		t.Error("dsa raw encoding verify failed")
+	}
+}
+
+var pkcs5padtests = []struct {
+	s   []byte
+	pad int
+	r   []byte
+}{
+	{[]byte{0, 0, 0, 0, 0, 0, 0, 0}, 8, []byte{0, 0, 0, 0, 0, 0, 0, 0, 8, 8, 8, 8, 8, 8, 8, 8}},
+	{[]byte{0, 0, 0, 0, 0, 0, 0}, 8, []byte{0, 0, 0, 0, 0, 0, 0, 1}},
+	{[]byte{0, 0, 0, 0, 0, 0}, 8, []byte{0, 0, 0, 0, 0, 0, 2, 2}},
+	{[]byte{0, 0, 0, 0, 0}, 8, []byte{0, 0, 0, 0, 0, 3, 3, 3}},
+	{[]byte{0, 0, 0, 0}, 8, []byte{0, 0, 0, 0, 4, 4, 4, 4}},
+}
+
+func TestPKCS5Pad(t *testing.T) {
+	for _, pkcs := range pkcs5padtests {
+		unpad := make([]byte, len(pkcs.s))
+		copy(unpad, pkcs.s)
+		r := pkcs5pad(pkcs.s, pkcs.pad)
+		if bytes.Compare(pkcs.r, r) != 0 {
+			t.Error("pkcs5pad: got: ", r, "expected: ", pkcs.r)
+		}
+		u, err := pkcs5unpad(r, pkcs.pad)
+		if err != nil || bytes.Compare(unpad, u) != 0 {
+			t.Error("pkcs5unpad: got: ", u, err, "expected: ", unpad)
+		}
+	}
+
+	for _, bad := range [][]byte{
+		{},
+		{0, 0, 0, 0, 0, 0, 0},
+		{0, 0, 0, 0, 0, 0, 0, 0},
+		{0, 0, 0, 0, 0, 0, 0, 9},
+		{0, 0, 0, 0, 0, 2, 3, 3},
+		{0, 0, 0, 0, 0, 0, 1, 2},
+	} {
+		if _, err := pkcs5unpad(bad, 8); err != ErrBadCiphertextFormat {
+			t.Errorf("pkcs5unpad(%v): got %v, want ErrBadCiphertextFormat", bad, err)
+		}
+	}
+}
+
+func TestAESBadPadding(t *testing.T) {
+	km := NewKeyManager()
+	km.Create("", P_DECRYPT_AND_ENCRYPT, T_AES)
+	km.AddKey(0, S_PRIMARY)
+	crypter, _ := NewCrypter(keyManagerReader(mustJSONs(km, nil)))
+	crypter.SetEncoding(NO_ENCODING)
+	ak := crypter.(*keyCrypter).kz.getPrimaryKey().(*aesKey)
+
+	// a ciphertext with a valid HMAC but bad padding is malformed
+	iv := make([]byte, aes.BlockSize)
+	block, _ := ak.blockCipher()
+	body := bytes.Repeat([]byte{0}, aes.BlockSize)
+	cipher.NewCBCEncrypter(block, iv).CryptBlocks(body, body)
+	msg := append(append(makeHeader(ak), iv...), body...)
+	sig, _ := ak.hmac.Sign(msg)
+	if _, err := ak.Decrypt(append(msg, sig...)); err != ErrBadCiphertextFormat {
+		t.Errorf("bad padding: got %v, want ErrBadCiphertextFormat", err)
+	}
+
+	// a forged one fails its HMAC check first, whatever its padding
+	ct, _ := crypter.Encrypt([]byte(INPUT))
+	b := []byte(ct)
+	b[len(b)-hmacSigLength-1] ^= 1
+	if _, err := crypter.Decrypt(string(b)); !errors.Is(err, ErrInvalidSignature) {
+		t.Errorf("forged ciphertext: got %v, want ErrInvalidSignature", err)
+	}
+
+	streamer, _ := NewCryptStreamer(keyManagerReader(mustJSONs(km, nil)), WithEncoding(NO_ENCODING))
+	var buf bytes.Buffer
+	w, _ := streamer.EncryptWriter(&buf)
+	w.Write([]byte(INPUT))
+	w.Close()
+	sb := buf.Bytes()
+	sb[len(sb)-hmacSigLength-1] ^= 1
+	r, _, err := streamer.DecryptReader(bytes.NewReader(sb), 0)
+	if err == nil {
+		_, err = ioutil.ReadAll(r)
+	}
+	if !errors.Is(err, ErrInvalidSignature) {
+		t.Errorf("forged stream: got %v, want ErrInvalidSignature", err)
+	}
+}
+
+func TestDegenerateKeys(t *testing.T) {
+	for _, tt := range []struct {
+		purpose, ktype, key string
+	}{
+		{"ENCRYPT", "RSA_PUB", `{"modulus":"","publicExponent":"","size":1024}`},
+		{"SIGN_AND_VERIFY", "RSA_PRIV", `{"publicKey":{"modulus":"","publicExponent":"","size":1024},"size":1024}`},
+		{"SIGN_AND_VERIFY", "DSA_PRIV", `{"publicKey":{"p":"","q":"","g":"","y":"","size":1024},"x":"","size":1024}`},
+		{"DECRYPT_AND_ENCRYPT", "AES", `{"aesKeyString":"","size":128,"hmacKey":{"hmacKeyString":"","size":256},"mode":"CBC"}`},
+	} {
+		meta := `{"name":"","purpose":"` + tt.purpose + `","type":"` + tt.ktype + `","encrypted":false,"versions":[{"versionNumber":1,"status":"PRIMARY","exportable":false}]}`
+		r := keyManagerReader{meta, tt.key}
+		// all zero numbers load, but fail when used; empty aes keys don't load
+		if e, err := NewEncrypter(r); err == nil {
+			if _, err := e.Encrypt([]byte(INPUT)); err == nil {
+				t.Errorf("%s: encrypted with a degenerate key", tt.ktype)
+			}
+		}
+		if s, err := NewSigner(r); err == nil {
+			if _, err := s.Sign([]byte(INPUT)); err == nil {
+				t.Errorf("%s: signed with a degenerate key", tt.ktype)
+			}
+		}
+	}
+}
+
+func TestKeyLengthMismatch(t *testing.T) {
+	key16 := encodeWeb64String(make([]byte, 16))
+	key32 := encodeWeb64String(make([]byte, 32))
+	aes := func(aesKey string, size int, hmacKey string) string {
+		return `{"aesKeyString":"` + aesKey + `","size":` + strconv.Itoa(size) + `,"hmacKey":{"hmacKeyString":"` + hmacKey + `","size":256},"mode":"CBC"}`
+	}
+	if _, err := newAESKeyFromJSON([]byte(aes(key16, 128, key32))); err != nil {
+		t.Fatal("failed to load an aes key: " + err.Error())
+	}
+	for _, key := range []string{aes(key16, 256, key32), aes("", 128, key32), aes(key16, 128, ""), aes(key16, 128, key16)} {
+		if _, err := newAESKeyFromJSON([]byte(key)); err != ErrInvalidKeySize {
+			t.Errorf("aes key %s: got %v, want ErrInvalidKeySize", key, err)
+		}
+	}
+	for _, key := range []string{"", key16} {
+		if _, err := newHMACKeyFromJSON([]byte(`{"hmacKeyString":"` + key + `","size":256}`)); err != ErrInvalidKeySize {
+			t.Errorf("hmac key %q: got %v, want ErrInvalidKeySize", key, err)
+		}
+	}
+}
+
+func TestAESTamperedCiphertext(t *testing.T) {
+	km := NewKeyManager()
+	km.Create("", P_DECRYPT_AND_ENCRYPT, T_AES)
+	km.AddKey(0, S_PRIMARY)
+	crypter, _ := NewCrypter(keyManagerReader(mustJSONs(km, nil)))
+	crypter.SetEncoding(NO_ENCODING)
+	ak := crypter.(*keyCrypter).kz.getPrimaryKey().(*aesKey)
+	ct, _ := crypter.Encrypt([]byte(INPUT))
+	data := []byte(ct)
+
+	// every bit of header, iv, ciphertext and signature is covered by the HMAC
+	for i := range data {
+		for bit := uint(0); bit < 8; bit++ {
+			b := append([]byte(nil), data...)
+			b[i] ^= 1 << bit
+			if p, err := ak.Decrypt(b); err != ErrInvalidSignature {
+				t.Fatalf("flipped bit %d of byte %d: got %q, %v, want ErrInvalidSignature", bit, i, p, err)
+			}
+		}
+	}
+
+	// dropping or adding ciphertext blocks breaks the HMAC too
+	body := data[:len(data)-hmacSigLength]
+	sig := data[len(data)-hmacSigLength:]
+	for _, b := range [][]byte{
+		append(append([]byte(nil), body[:len(body)-aes.BlockSize]...), sig...),
+		append(append(append([]byte(nil), body...), body[len(body)-aes.BlockSize:]...), sig...),
+		append(append([]byte(nil), body[:kzHeaderLength+aes.BlockSize]...), sig...),
+	} {
+		if _, err := ak.Decrypt(b); err != ErrInvalidSignature {
+			t.Errorf("%d byte ciphertext: got %v, want ErrInvalidSignature", len(b), err)
+		}
+	}
+	for n := 0; n < kzHeaderLength+aes.BlockSize+hmacSigLength; n++ {
+		if _, err := ak.Decrypt(data[:n]); err != ErrShortCiphertext {
+			t.Errorf("%d byte ciphertext: got %v, want ErrShortCiphertext", n, err)
+		}
+	}
+
+	if p, err := ak.Decrypt(data); err != nil || string(p) != INPUT {
+		t.Errorf("untampered ciphertext: got %q, %v", p, err)
+	}
+}
+
+func TestLenPrefixPack(t *testing.T) {
+	b := lenPrefixPack([]byte{4, 5, 6, 2, 1}, []byte{1, 4, 2, 8, 5, 7}, []byte{1, 2, 3, 4, 5, 6, 7, 8, 9}, []byte{1})
+	arrays, err := lenPrefixUnpack(b)
+	if err != nil || len(arrays) != 4 || len(arrays[3]) != 1 || arrays[3][0] != 1 {
+		t.Error("unpack error", err)
+	}
+
+	for _, bad := range [][]byte{
+		nil,
+		{0, 0, 0},
+		{0xff, 0xff, 0xff, 0xff},
+		{0, 0, 0, 1, 0xff, 0xff, 0xff, 0xff, 1},
+		b[:len(b)-1],
+	} {
+		if _, err := lenPrefixUnpack(bad); err != ErrBadCiphertextFormat {
+			t.Errorf("lenPrefixUnpack(%v): got %v, want ErrBadCiphertextFormat", bad, err)
+		}
+	}
+}
+
+// FIXME: DecodeWeb64String / EncodeWeb64String
+
+func TestCookies(t *testing.T) {
+	km := NewKeyManager()
+	km.Create("cookies", P_DECRYPT_AND_ENCRYPT, T_AES)
+	km.AddKey(0, S_PRIMARY)
+	oldCrypter, _ := NewCrypter(keyManagerReader(mustJSONs(km, nil)))
+	oldSealed, err := SealCookie(oldCrypter, "session", []byte("user=1"), time.Hour)
+	if err != nil {
+		t.Fatal("failed to seal cookie: " + err.Error())
+	}
+
+	km.AddKey(0, S_PRIMARY)
+	crypter, _ := NewCrypter(keyManagerReader(mustJSONs(km, nil)))
+	sealed, err := SealCookie(crypter, "session", []byte("user=2"), 0)
+	if err != nil {
+		t.Fatal("failed to seal cookie: " + err.Error())
+	}
+	if strings.ContainsAny(sealed, "=+/;, \"") {
+		t.Errorf("sealed cookie needs quoting: %s", sealed)
+	}
+	for s, expected := range map[string]string{oldSealed: "user=1", sealed: "user=2"} {
+		if v, err := OpenCookie(crypter, "session", s); err != nil || string(v) != expected {
+			t.Errorf("cookie mismatch: %q %v, expected %q", v, err, expected)
+		}
+	}
+	if _, err := OpenCookie(crypter, "other", sealed); err == nil {
+		t.Error("cookie opened under another name")
+	}
+	if _, err := crypter.Decrypt(sealed); err == nil {
+		t.Error("cookie decrypted as a message")
+	}
+
+	// a maxAge that isn't positive means no expiry
+	forever, _ := SealCookie(crypter, "session", []byte("user=3"), -time.Hour)
+	if _, err := OpenCookie(crypter, "session", forever); err != nil {
+		t.Errorf("cookie with no maxAge failed: %v", err)
+	}
+	expired, _ := SealCookie(crypter, "session", []byte("user=3"), time.Nanosecond)
+	time.Sleep(time.Second)
+	if _, err := OpenCookie(crypter, "session", expired); err != ErrCookieExpired {
+		t.Errorf("expected ErrCookieExpired, got %v", err)
+	}
+
+	if _, err := SealCookie(crypter, "session", make([]byte, MaxCookieSize), 0); err != ErrCookieTooLarge {
+		t.Errorf("expected ErrCookieTooLarge, got %v", err)
+	}
+	if _, err := OpenCookie(crypter, "session", strings.Repeat("A", MaxCookieSize)); err != ErrCookieTooLarge {
+		t.Errorf("expected ErrCookieTooLarge opening a large cookie, got %v", err)
+	}
+
+	km = NewKeyManager()
+	km.Create("public", P_DECRYPT_AND_ENCRYPT, T_RSA_PRIV)
+	km.AddKey(0, S_PRIMARY)
+	rsaCrypter, _ := NewCrypter(keyManagerReader(mustJSONs(km, nil)))
+	if _, err := SealCookie(rsaCrypter, "session", []byte("x"), 0); err != ErrUnsupportedType {
+		t.Errorf("expected ErrUnsupportedType sealing with an RSA key set, got %v", err)
+	}
+}
+
+func TestChunkedFile(t *testing.T) {
+	km := NewKeyManager()
+	km.Create("backups", P_DECRYPT_AND_ENCRYPT, T_AES)
+	km.AddKey(0, S_PRIMARY)
+	crypter, _ := NewCrypter(keyManagerReader(mustJSONs(km, nil)))
+
+	dir := t.TempDir()
+
+	for _, size := range []int{0, 1, ChunkSize - 1, ChunkSize, 3*ChunkSize + 100} {
+		plaintext := make([]byte, size)
+		io.ReadFull(rand.Reader, plaintext)
+		src, enc, dec := filepath.Join(dir, "src"), filepath.Join(dir, "enc"), filepath.Join(dir, "dec")
+		ioutil.WriteFile(src, plaintext, 0600)
+		if err := EncryptFile(crypter, src, enc); err != nil {
+			t.Fatalf("failed to encrypt %d byte file: %s", size, err)
+		}
+		if err := DecryptFile(crypter, enc, dec); err != nil {
+			t.Fatalf("failed to decrypt %d byte file: %s", size, err)
+		}
+		if got, _ := ioutil.ReadFile(dec); !bytes.Equal(got, plaintext) {
+			t.Errorf("%d byte file mismatch", size)
+		}
+
+		cr, err := OpenChunkedFile(crypter, enc)
+		if err != nil || cr.Size() != int64(size) {
+			t.Fatalf("failed to open %d byte file: %v", size, err)
+		}
+		// reads across chunk boundaries, from the end backwards
+		for off := size - 1; off >= 0; off -= ChunkSize / 3 {
+			p := make([]byte, 100)
+			n, err := cr.ReadAt(p, int64(off))
+			if (err != nil && err != io.EOF) || !bytes.Equal(p[:n], plaintext[off:off+n]) || (n < 100 && off+n != size) {
+				t.Errorf("%d byte file: ReadAt(%d) mismatch: %d %v", size, off, n, err)
+			}
+		}
+		if _, err := cr.Seek(int64(size/2), io.SeekStart); err != nil {
+			t.Fatal(err)
+		}
+		if rest, err := ioutil.ReadAll(cr); err != nil || !bytes.Equal(rest, plaintext[size/2:]) {
+			t.Errorf("%d byte file: read after seek mismatch: %v", size, err)
+		}
+		cr.Close()
+	}
+
+	// truncated at a chunk boundary, and with chunks swapped
+	b, _ := ioutil.ReadFile(filepath.Join(dir, "enc"))
+	sealed := int64(chunkSealedLength(ChunkSize))
+	start := int64(len(b)) - 3*sealed - int64(chunkSealedLength(100))
+	truncated := b[:start+2*sealed]
+	if _, err := NewChunkedReader(crypter, bytes.NewReader(truncated), int64(len(truncated))); err == nil {
+		t.Error("truncated file opened")
+	}
+	swapped := append([]byte{}, b...)
+	copy(swapped[start:], b[start+sealed:start+2*sealed])
+	copy(swapped[start+sealed:], b[start:start+sealed])
+	cr, err := NewChunkedReader(crypter, bytes.NewReader(swapped), int64(len(swapped)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cr.ReadAt(make([]byte, 10), 0); err == nil {
+		t.Error("swapped chunk decrypted")
+	}
+}
+
+func TestChunkedFS(t *testing.T) {
+	km := NewKeyManager()
+	km.Create("assets", P_DECRYPT_AND_ENCRYPT, T_AES)
+	km.AddKey(0, S_PRIMARY)
+	crypter, _ := NewCrypter(keyManagerReader(mustJSONs(km, nil)))
+
+	plaintext := []byte(strings.Repeat("body { color: red }\n", 5000))
+	var buf bytes.Buffer
+	w, _ := NewChunkedWriter(crypter, &buf)
+	w.Write(plaintext)
+	w.Close()
+	fsys := NewChunkedFS(crypter, fstest.MapFS{
+		"static/site.css": &fstest.MapFile{Data: buf.Bytes()},
+		"static/bad.css":  &fstest.MapFile{Data: []byte("not encrypted")},
+	})
+
+	got, err := fs.ReadFile(fsys, "static/site.css")
+	if err != nil || !bytes.Equal(got, plaintext) {
+		t.Fatalf("file mismatch: %v", err)
+	}
+	info, err := fs.Stat(fsys, "static/site.css")
+	if err != nil || info.Size() != int64(len(plaintext)) || info.Name() != "site.css" {
+		t.Errorf("file info mismatch: %v %v", info, err)
+	}
+	entries, err := fs.ReadDir(fsys, "static")
+	if err != nil || len(entries) != 2 {
+		t.Errorf("directory mismatch: %v %v", entries, err)
+	}
+	if _, err := fsys.Open("static/bad.css"); !errors.Is(err, ErrMalformedChunked) {
+		t.Errorf("expected ErrMalformedChunked for a file that isn't encrypted, got %v", err)
+	}
+	if _, err := fsys.Open("static/missing.css"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("expected fs.ErrNotExist, got %v", err)
+	}
+
+	// served over HTTP, with ranges
+	req := httptest.NewRequest("GET", "/static/site.css", nil)
+	req.Header.Set("Range", "bytes=70000-70019")
+	rec := httptest.NewRecorder()
+	http.FileServer(http.FS(fsys)).ServeHTTP(rec, req)
+	if rec.Code != http.StatusPartialContent || !bytes.Equal(rec.Body.Bytes(), plaintext[70000:70020]) {
+		t.Errorf("range request mismatch: %d %q", rec.Code, rec.Body.Bytes())
+	}
+}
+
+func TestBackupKeyset(t *testing.T) {
+	km := NewKeyManager()
+	km.Create("backup", P_DECRYPT_AND_ENCRYPT, T_AES)
+	km.AddKey(0, S_PRIMARY)
+	km.AddKey(0, S_PRIMARY)
+	r := keyManagerReader(mustJSONs(km, nil))
+	crypter, _ := NewCrypter(r)
+	c, _ := crypter.Encrypt([]byte(INPUT))
+
+	var backup bytes.Buffer
+	if err := BackupKeyset(r, &backup, []byte("correct horse")); err != nil {
+		t.Fatal("failed to back up key set: " + err.Error())
+	}
+	if bytes.Contains(backup.Bytes(), []byte("aesKeyString")) {
+		t.Fatal("backup isn't encrypted")
+	}
+	restored, manifest, err := RestoreKeyset(bytes.NewReader(backup.Bytes()), []byte("correct horse"))
+	if err != nil {
+		t.Fatal("failed to restore key set: " + err.Error())
+	}
+	if manifest.Name != "backup" || len(manifest.Versions) != 2 || manifest.Versions[1].Status != S_PRIMARY || manifest.Versions[0].Created == 0 {
+		t.Errorf("manifest mismatch: %+v", manifest)
+	}
+	restoredCrypter, err := NewCrypter(restored)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p, err := restoredCrypter.Decrypt(c); err != nil || string(p) != INPUT {
+		t.Errorf("restored key set decrypt failed: %v", err)
+	}
+	if _, _, err := RestoreKeyset(bytes.NewReader(backup.Bytes()), []byte("wrong")); err == nil {
+		t.Error("backup restored with the wrong passphrase")
+	}
+
+	// a backup whose manifest doesn't match its key set, made with the same passphrase
+	names, contents, _ := archiveEntries(r)
+	var archive bytes.Buffer
+	tw := tar.NewWriter(&archive)
+	m, _ := json.Marshal(manifest)
+	contents[backupManifestName] = string(m)
+	for _, name := range append([]string{backupManifestName}, names[:2]...) {
+		tw.WriteHeader(&tar.Header{Name: name, Mode: 0600, Size: int64(len(contents[name])), Typeflag: tar.TypeReg})
+		io.WriteString(tw, contents[name])
+	}
+	tw.Close()
+	forged, _ := NewPBECrypter([]byte("correct horse")).Encrypt(archive.Bytes())
+	if _, _, err := RestoreKeyset(strings.NewReader(forged), []byte("correct horse")); err == nil {
+		t.Error("backup missing a version restored")
+	}
+}
+
+func TestSharedSecretReader(t *testing.T) {
+	// the FIPS-197 example, and every inverse
+	if gfMul(0x57, 0x83) != 0xc1 {
+		t.Errorf("GF(2^8) multiplication mismatch: %#x", gfMul(0x57, 0x83))
+	}
+	for a := 1; a < 256; a++ {
+		if gfMul(byte(a), gfInv(byte(a))) != 1 {
+			t.Fatalf("GF(2^8) inverse of %#x mismatch", a)
+		}
+	}
+
+	km := NewKeyManager()
+	km.Create("root", P_SIGN_AND_VERIFY, T_HMAC_SHA1)
+	km.AddKey(0, S_PRIMARY)
+	signer, _ := NewSigner(keyManagerReader(mustJSONs(km, nil)))
+	sig, _ := signer.Sign([]byte(INPUT))
+
+	password := []byte("two person control")
+	shares, err := SplitPassword(password, 3, 2)
+	if err != nil || len(shares) != 3 {
+		t.Fatalf("failed to split password: %v", err)
+	}
+	pbeKeys := keyManagerReader(mustJSONs(km, NewPBEEncrypter(password)))
+	for _, pair := range [][]string{{shares[0], shares[1]}, {shares[2], shares[0]}, shares} {
+		r, err := NewSharedSecretReader(pbeKeys, pair...)
+		if err != nil {
+			t.Fatal("failed to combine shares: " + err.Error())
+		}
+		if v, err := NewVerifier(r); err != nil {
+			t.Errorf("key set with combined password failed to load: %v", err)
+		} else if ok, _ := v.Verify([]byte(INPUT), sig); !ok {
+			t.Error("key set with combined password failed to verify")
+		}
+	}
+	if _, err := NewSharedSecretReader(pbeKeys, shares[1]); err != ErrInvalidShares {
+		t.Errorf("expected ErrInvalidShares for too few shares, got %v", err)
+	}
+	if _, err := NewSharedSecretReader(pbeKeys, shares[1], shares[1]); err != ErrInvalidShares {
+		t.Errorf("expected ErrInvalidShares for a repeated share, got %v", err)
+	}
+	other, _ := SplitPassword(password, 3, 2)
+	if _, err := NewSharedSecretReader(pbeKeys, shares[0], other[1]); err != ErrInvalidShares {
+		t.Errorf("expected ErrInvalidShares for shares of different splits, got %v", err)
+	}
+
+	// the crypter key set of an encrypted key set, split
+	kek := NewKeyManager()
+	kek.Create("kek", P_DECRYPT_AND_ENCRYPT, T_AES)
+	kek.AddKey(0, S_PRIMARY)
+	kekReader := keyManagerReader(mustJSONs(kek, nil))
+	kekCrypter, _ := NewCrypter(kekReader)
+	shares, err = SplitKeySet(kekReader, 5, 3)
+	if err != nil {
+		t.Fatal("failed to split key set: " + err.Error())
+	}
+	r, err := NewSharedSecretReader(keyManagerReader(mustJSONs(km, kekCrypter)), shares[4], shares[1], shares[2])
+	if err != nil {
+		t.Fatal("failed to combine key set shares: " + err.Error())
+	}
+	if v, err := NewVerifier(r); err != nil {
+		t.Errorf("key set with combined crypter failed to load: %v", err)
+	} else if ok, _ := v.Verify([]byte(INPUT), sig); !ok {
+		t.Error("key set with combined crypter failed to verify")
+	}
+	if _, err := NewSharedSecretReader(r, shares[0], shares[3]); err != ErrInvalidShares {
+		t.Errorf("expected ErrInvalidShares for fewer shares than the threshold, got %v", err)
+	}
+}
@@ -7,6 +7,21 @@ Sample usage is:
 	ciphertext := crypter.Encrypt(plaintext)
 Decryption, Signing and Verification use the same minimal API.
 Encrypted data and signatures are encoded with web-safe base64.
+
+MACs, signatures and padding are checked in constant time.  AES ciphertexts
+are only decrypted after their HMAC has been checked, so a forged ciphertext
+fails with ErrInvalidSignature whatever its padding, and a malformed one that
+passes the check fails with ErrBadCiphertextFormat: decrypting can't be used as
+a padding oracle.
+
+The Crypters, Encrypters, Signers and Verifiers made from key sets, and their
+streamers, are safe for concurrent use by multiple goroutines: the keys are
+not modified after they are read, and the key tables are only changed, under
+a lock, when a key set is reloaded or a key version is read on first use.
+Their Set methods are configuration: call them, or pass the matching Options,
+before sharing the object, except for the key lookup and reload settings,
+which may be changed at any time.  Wipe must only be called once all other
+calls have returned.  KeyManagers are not safe for concurrent use.
 */
 package dkeyczar
 
@@ -14,19 +29,29 @@ import (
 	"bytes"
 	"encoding/binary"
 	"encoding/json"
+	"hash"
 	"io"
 	"time"
 )
 
 // Our main base type.  We only expose this through one of the interfaces.
 type keyCzar struct {
-	keymeta keyMeta              // metadata for this key
-	keys    map[int]keydata      // maps versions to keys
-	idkeys  map[uint32][]keydata // maps keyids to keys
-	primary int                  // integer version of the primary key
+	keymeta    KeyMeta              // metadata for this key
+	keys       map[int]keydata      // maps versions to keys
+	idkeys     map[uint32][]keydata // maps keyids to keys
+	primary    int                  // integer version of the primary key
+	source     string               // where the key set was read from, for audit events
+	tryAll     bool                 // try every key when a key hash matches none
+	hashCompat KeyHashCompat        // other key hashes accepted
+	rand       io.Reader            // random source given to the keys, nil for crypto/rand
+	lazy       *lazyKeys            // the key versions not read yet, nil if all were read
+	preloadErr error                // the error of PreloadKeys, for the constructor to return
+	reloader
 }
 
 // An Encrypter can be used for encrypting
+// The Encrypters made by NewEncrypter, e.g. for RSA public key sets and
+// certificates, aren't Decrypters, so they can't be asserted to a Crypter.
 type Encrypter interface {
 	EncodingController
 	CompressionController
@@ -41,18 +66,72 @@ type EncryptStreamer interface {
 	EncryptWriter(io.Writer) (io.WriteCloser, error)
 }
 
+// A Decrypter can be used for decrypting
+type Decrypter interface {
+	// Decrypt returns the plaintext bytes of an encrypted string
+	Decrypt(ciphertext string) ([]uint8, error)
+}
+
 // A Crypter can used for encrypting or decrypting
+// Those made from key sets are safe for concurrent use (see the package documentation).
 type Crypter interface {
 	Encrypter
-	// Decrypt returns the plaintext bytes of an encrypted string
-	Decrypt(ciphertext string) ([]uint8, error)
+	Decrypter
+}
+
+// A VersionedEncrypter can encrypt with a chosen key version instead of the primary key,
+// e.g. to stage a rollout or to make ciphertexts for old versions when testing a rotation.
+// The Encrypters and Crypters made from key sets are VersionedEncrypters.
+type VersionedEncrypter interface {
+	// EncryptWithVersion is like Encrypt, but uses the given key version, which must not be inactive
+	EncryptWithVersion(version int, plaintext []uint8) (string, error)
+	// PrimaryVersion returns the version of the primary key, which Encrypt uses
+	PrimaryVersion() int
+}
+
+// KeyInfo identifies the key that handled a message, or describes a key of a Keyset
+type KeyInfo struct {
+	Version    int       // the key version in the key set, or -1 if a reload dropped it meanwhile
+	KeyHash    []byte    // the key hash, as found in message headers
+	Status     KeyStatus // the status of the version in the metadata
+	Size       uint      // the key size in bits, or 0 if unknown
+	Exportable bool      // the version is marked exportable
+}
+
+// An InfoDecrypter reports which key decrypted a ciphertext, e.g. to measure how much traffic still needs an old key during a rotation.
+// The Crypters made from key sets are InfoDecrypters.
+type InfoDecrypter interface {
+	// DecryptWithInfo is like Decrypt, and also returns the key that decrypted the ciphertext
+	DecryptWithInfo(ciphertext string) ([]uint8, KeyInfo, error)
+}
+
+// An InfoVerifier reports which key verified a signature.
+// The Signers and Verifiers made from key sets are InfoVerifiers.
+type InfoVerifier interface {
+	// VerifyWithInfo is like Verify, and also returns the key that verified the signature
+	VerifyWithInfo(message []byte, signature string) (bool, KeyInfo, error)
+}
+
+// A StreamSigner signs a stream as it is read, without holding all of it in memory.
+// The Signers made from key sets are StreamSigners.
+type StreamSigner interface {
+	// SignReader returns the signature of everything read from r, the same as Sign of the whole stream.
+	// The stream is hashed as it is read; Ed25519 keys sign the whole message and return ErrCannotStream.
+	SignReader(r io.Reader) (string, error)
+}
+
+// A StreamVerifier checks the signature of a stream as it is read.
+// The Signers and Verifiers made from key sets are StreamVerifiers.
+type StreamVerifier interface {
+	// VerifyReader checks a signature made by Sign or SignReader against everything read from r
+	VerifyReader(r io.Reader, signature string) (bool, error)
 }
 
 //An CryptStreamer can encrypt and decrypt through a stream (reader for decrypt, writer for encrypt)
 //Remember to close the streams to flush everything down the original one and check everything went ok
 type CryptStreamer interface {
 	EncryptStreamer
-	Decrypt(ciphertext string) ([]uint8, error)
+	Decrypter
 	DecryptReader(io.Reader, int) (io.ReadCloser, int, error)
 }
 
@@ -73,34 +152,58 @@ type SignedDecrypter interface {
 }
 
 // A Signer can be used for signing and verification
+// Those made from key sets are safe for concurrent use (see the package documentation).
 type Signer interface {
 	Verifier
 	// Sign returns a cryptographic signature for the message
 	Sign(message []byte) (string, error)
+	// AttachedSign returns a signed blob that carries the message along with its signature.
+	// The optional nonce is covered by the signature but not included in the output,
+	// so the verifier must supply the same nonce.  The format is compatible with Java and Python keyczar.
 	AttachedSign(message []byte, nonce []byte) (string, error)
 	// TimeoutSign returns a signature for the message that is valid until expiration
-	// expiration should be milliseconds since 1/1/1970 GMT
+	// expiration should be milliseconds since 1/1/1970 GMT (see ExpirationMillis)
+	// The expiration is bound into the signature, as in Java keyczar.
 	TimeoutSign(message []byte, expiration int64) (string, error)
 	// UnversionedSign signs the message with a plain, non-Keyczar-tagged signature
+	// The result is the raw signature of the key type (e.g. HMAC-SHA1, or RSA PKCS#1 v1.5 over SHA-1),
+	// so it can be checked by code that knows nothing about keyczar.
 	UnversionedSign(message []byte) (string, error)
 }
 
 // A Verifier can be used for verification
+// Those made from key sets are safe for concurrent use (see the package documentation).
 type Verifier interface {
 	EncodingController
 	// Verify checks the cryptographic signature for a message
 	Verify(message []byte, signature string) (bool, error)
+	// AttachedVerify checks a blob produced by AttachedSign with the same nonce and returns the embedded message.
 	AttachedVerify(signedMessage string, nonce []byte) ([]byte, error)
 	// TimeoutVerify checks the cryptographic signature for a message and ensure it hasn't expired.
 	TimeoutVerify(message []byte, signature string) (bool, error)
-	// UnversionedVerify checks the plained, non-Keyczar-tagged cryptographic signature for a message
+	// UnversionedVerify checks the plain, non-Keyczar-tagged cryptographic signature for a message
+	// As there is no key hash, every key in the key set is tried.
 	UnversionedVerify(message []byte, signature string) (bool, error)
 }
 
-type keyCrypter struct {
+// the encrypting half of a keyCrypter, which is all NewEncrypter gives out
+type keyEncrypter struct {
 	kz *keyCzar
 	encodingController
 	compressionController
+	bufferPoolController
+	metricsController
+	batchController
+	ivReuseController
+	paddingController
+}
+
+type keyCrypter struct {
+	keyEncrypter
+}
+
+type keyEncryptStreamer struct {
+	*keyEncrypter
 }
 
 type keyCryptStreamer struct {
@@ -125,20 +228,88 @@ type keySignedDecrypter struct {
 
 // Encrypt plaintext and return encoded encrypted text as a string
 // All the heavy lifting is done by the key
-func (kc *keyCrypter) Encrypt(plaintext []uint8) (string, error) {
-	key := kc.kz.getPrimaryKey()
+func (kc *keyEncrypter) Encrypt(plaintext []uint8) (string, error) {
+	start := kc.startTimer()
+	key, err := kc.kz.primaryKey()
+	if err != nil {
+		kc.observe(OP_ENCRYPT, start, kc.kz, nil, err)
+		return "", err
+	}
+	s, err := kc.encryptWithKey(key, plaintext, nil)
+	kc.observe(OP_ENCRYPT, start, kc.kz, key, err)
+	return s, err
+}
+
+// Encrypt plaintext with a given key version rather than the primary key
+func (kc *keyEncrypter) EncryptWithVersion(version int, plaintext []uint8) (string, error) {
+	start := kc.startTimer()
+	key, err := kc.kz.getKeyVersion(version)
+	if err != nil {
+		kc.observe(OP_ENCRYPT, start, kc.kz, nil, err)
+		return "", err
+	}
+	s, err := kc.encryptWithKey(key, plaintext, nil)
+	kc.observe(OP_ENCRYPT, start, kc.kz, key, err)
+	return s, err
+}
+
+// PrimaryVersion returns the version of the primary key
+func (kc *keyEncrypter) PrimaryVersion() int {
+	return kc.kz.primaryVersion()
+}
+
+func (kc *keyEncrypter) encryptWithKey(key keydata, plaintext []uint8, aad []byte) (string, error) {
 	encryptKey := key.(encryptKey)
-	compressedPlaintext := kc.compress(plaintext)
+	compressedPlaintext := kc.pad(kc.compress(plaintext))
+	if len(aad) > 0 {
+		ak, ok := key.(aadEncryptKey)
+		if !ok {
+			return "", ErrUnsupportedType
+		}
+		ciphertext, err := ak.encryptWithAAD(compressedPlaintext, aad)
+		if err != nil {
+			return "", err
+		}
+		if err := kc.checkIV(kc.kz, key, ciphertext); err != nil {
+			return "", err
+		}
+		return kc.encode(ciphertext), nil
+	}
+	// the binary ciphertext is only scratch space when it gets encoded
+	if ak, ok := encryptKey.(appendEncryptKey); ok && kc.encoding != NO_ENCODING {
+		bp := kc.buffers()
+		ciphertext, err := ak.appendEncrypt(bp.get(0), compressedPlaintext)
+		if err != nil {
+			return "", err
+		}
+		if err := kc.checkIV(kc.kz, key, ciphertext); err != nil {
+			bp.put(ciphertext)
+			return "", err
+		}
+		s := kc.encodePooled(ciphertext, bp)
+		bp.put(ciphertext)
+		return s, nil
+	}
 	ciphertext, err := encryptKey.Encrypt(compressedPlaintext)
 	if err != nil {
 		return "", err
 	}
+	if err := kc.checkIV(kc.kz, key, ciphertext); err != nil {
+		return "", err
+	}
 	s := kc.encode(ciphertext)
 	return s, nil
 }
 
 func (kc *keyCryptStreamer) EncryptWriter(sink io.Writer) (io.WriteCloser, error) {
-	key := kc.kz.getPrimaryKey()
+	return (&keyEncryptStreamer{&kc.keyEncrypter}).EncryptWriter(sink)
+}
+
+func (kc *keyEncryptStreamer) EncryptWriter(sink io.Writer) (io.WriteCloser, error) {
+	key, err := kc.kz.primaryKey()
+	if err != nil {
+		return nil, err
+	}
 	encryptKey, ok := key.(streamEncryptKey)
 	if !ok {
 		return nil, ErrCannotStream
@@ -153,7 +324,10 @@ func (kc *keyCryptStreamer) EncryptWriter(sink io.Writer) (io.WriteCloser, error
 }
 
 func (kc *keySignedEncypter) Encrypt(plaintext []uint8) (string, error) {
-	key := kc.kz.getPrimaryKey()
+	key, err := kc.kz.primaryKey()
+	if err != nil {
+		return "", err
+	}
 	encryptKey := key.(encryptKey)
 	compressedPlaintext := kc.compress(plaintext)
 	ciphertext, err := encryptKey.Encrypt(compressedPlaintext)
@@ -170,21 +344,73 @@ func (kc *keySignedEncypter) Encrypt(plaintext []uint8) (string, error) {
 // Decode and decrypt ciphertext and return plaintext as []byte
 // All the heavy lifting is done by the key
 func (kc *keyCrypter) Decrypt(ciphertext string) ([]uint8, error) {
-	b, kl, err := splitHeader(kc.encodingController, kc.kz, ciphertext, ErrShortCiphertext)
+	plaintext, _, err := kc.decrypt(ciphertext, nil)
+	return plaintext, err
+}
+
+// Decrypt ciphertext and report the key that did it
+func (kc *keyCrypter) DecryptWithInfo(ciphertext string) ([]uint8, KeyInfo, error) {
+	plaintext, k, err := kc.decrypt(ciphertext, nil)
 	if err != nil {
-		return nil, err
+		return nil, KeyInfo{}, err
+	}
+	return plaintext, kc.kz.keyInfo(k), nil
+}
+
+// decrypt, checking the associated data if there is any, and return the key that worked
+func (kc *keyCrypter) decrypt(ciphertext string, aad []byte) ([]uint8, keydata, error) {
+	start := kc.startTimer()
+	plaintext, k, err := kc.decryptKeys(ciphertext, aad)
+	kc.observe(OP_DECRYPT, start, kc.kz, k, err)
+	if err != nil {
+		kc.kz.auditFailure(AUDIT_DECRYPT_FAILURE, kc.encodingController, ciphertext, err)
+	}
+	return plaintext, k, err
+}
+
+func (kc *keyCrypter) decryptKeys(ciphertext string, aad []byte) ([]uint8, keydata, error) {
+	kl, err := lookupHeader(kc.encodingController, kc.kz, ciphertext, ErrShortCiphertext)
+	if err != nil {
+		return nil, nil, err
+	}
+	bp := kc.buffers()
+	b, err := kc.decodePooled(ciphertext, bp)
+	if err != nil {
+		return nil, nil, ErrBase64Decoding
+	}
+	if kc.encoding != NO_ENCODING {
+		// none of the keys keep references to the ciphertext
+		defer bp.put(b)
 	}
 	for _, k := range kl {
 		decryptKey, ok := k.(decryptEncryptKey)
 		if !ok {
-			return nil, ErrCannotStream
+			return nil, nil, ErrCannotStream
+		}
+		var compressedPlaintext []byte
+		if len(aad) > 0 {
+			ak, ok := k.(aadDecryptKey)
+			if !ok {
+				return nil, nil, ErrUnsupportedType
+			}
+			compressedPlaintext, err = ak.decryptWithAAD(b, aad)
+		} else {
+			compressedPlaintext, err = decryptKey.Decrypt(b)
 		}
-		compressedPlaintext, err := decryptKey.Decrypt(b)
 		if err == nil {
-			return kc.decompress(compressedPlaintext)
+			unpadded, err := kc.unpad(compressedPlaintext)
+			if err != nil {
+				return nil, k, err
+			}
+			if kc.compression == NO_COMPRESSION {
+				return unpadded, k, nil
+			}
+			plaintext, err := kc.decompress(unpadded)
+			bp.put(compressedPlaintext)
+			return plaintext, k, err
 		}
 	}
-	return nil, ErrInvalidSignature
+	return nil, nil, &DecryptError{err}
 }
 
 func (kc *keyCryptStreamer) DecryptReader(in io.Reader, kPos int) (io.ReadCloser, int, error) {
@@ -223,24 +449,41 @@ func (kc *keySignedDecrypter) Decrypt(signedCiphertext string) ([]uint8, error)
 	}
 	for _, k := range kl {
 		decryptKey := k.(decryptEncryptKey)
-		compressedPlaintext, err := decryptKey.Decrypt(b)
+		var compressedPlaintext []byte
+		compressedPlaintext, err = decryptKey.Decrypt(b)
 		if err == nil {
 			return kc.decompress(compressedPlaintext)
 		}
 	}
-	return nil, ErrInvalidSignature
+	return nil, &DecryptError{err}
 }
 
 type currentTime func() int64
 
+// the default time provider: milliseconds since the epoch
+func currentMillis() int64 {
+	return ExpirationMillis(time.Now())
+}
+
+// ExpirationMillis converts t to the milliseconds since 1/1/1970 GMT expected by TimeoutSign
+func ExpirationMillis(t time.Time) int64 {
+	return t.UnixNano() / int64(time.Millisecond)
+}
+
 type keySigner struct {
 	kz *keyCzar
 	currentTime
 	encodingController
+	metricsController
+	batchController
+	replayController
 }
 
 func (ks *keySigner) UnversionedSign(message []byte) (string, error) {
-	key := ks.kz.getPrimaryKey()
+	key, err := ks.kz.primaryKey()
+	if err != nil {
+		return "", err
+	}
 	signingKey := key.(signVerifyKey)
 	signature, err := signingKey.Sign(message)
 	if err != nil {
@@ -256,7 +499,7 @@ func (ks *keySigner) UnversionedVerify(message []byte, signature string) (bool,
 		return false, err
 	}
 	// without a key id, we have to check all the keys
-	for _, k := range ks.kz.keys {
+	for _, k := range ks.kz.allKeys() {
 		verifyKey := k.(verifyKey)
 		// errors ignored here
 		valid, _ := verifyKey.Verify(message, b)
@@ -270,9 +513,39 @@ func (ks *keySigner) UnversionedVerify(message []byte, signature string) (bool,
 // Verify the signature on 'msg'
 // All the heavy lifting is done by the key
 func (ks *keySigner) Verify(msg []byte, signature string) (bool, error) {
+	k, err := ks.verify(msg, signature)
+	return k != nil, err
+}
+
+// Verify the signature on 'msg' and report the key that did it
+func (ks *keySigner) VerifyWithInfo(msg []byte, signature string) (bool, KeyInfo, error) {
+	k, err := ks.verify(msg, signature)
+	if k == nil {
+		return false, KeyInfo{}, err
+	}
+	return true, ks.kz.keyInfo(k), err
+}
+
+// return the key that verifies the signature, or nil
+func (ks *keySigner) verify(msg []byte, signature string) (keydata, error) {
+	start := ks.startTimer()
+	k, err := ks.verifyKeys(msg, signature)
+	if k == nil && err == nil {
+		ks.observe(OP_VERIFY, start, ks.kz, nil, ErrInvalidSignature)
+		ks.kz.auditFailure(AUDIT_VERIFY_FAILURE, ks.encodingController, signature, ErrInvalidSignature)
+	} else {
+		ks.observe(OP_VERIFY, start, ks.kz, k, err)
+		if err != nil {
+			ks.kz.auditFailure(AUDIT_VERIFY_FAILURE, ks.encodingController, signature, err)
+		}
+	}
+	return k, err
+}
+
+func (ks *keySigner) verifyKeys(msg []byte, signature string) (keydata, error) {
 	b, kl, err := splitHeader(ks.encodingController, ks.kz, signature, ErrShortSignature)
 	if err != nil {
-		return false, err
+		return nil, err
 	}
 	signedbytes := make([]byte, len(msg)+1)
 	copy(signedbytes, msg)
@@ -282,16 +555,30 @@ func (ks *keySigner) Verify(msg []byte, signature string) (bool, error) {
 		verifyKey := k.(verifyKey)
 		valid, _ := verifyKey.Verify(signedbytes, sig)
 		if valid {
-			return true, nil
+			return k, nil
 		}
 	}
-	return false, nil
+	return nil, nil
 }
 
 // Return a signature for 'msg'
 // All the heavy lifting is done by the key
 func (ks *keySigner) Sign(msg []byte) (string, error) {
-	key := ks.kz.getPrimaryKey()
+	start := ks.startTimer()
+	key, err := ks.kz.primaryKey()
+	if err != nil {
+		ks.observe(OP_SIGN, start, ks.kz, nil, err)
+		return "", err
+	}
+	s, err := ks.sign(key, msg)
+	ks.observe(OP_SIGN, start, ks.kz, key, err)
+	return s, err
+}
+
+func (ks *keySigner) sign(key keydata, msg []byte) (string, error) {
+	if key == nil {
+		return "", ErrNoPrimaryKey
+	}
 	signingKey := key.(signVerifyKey)
 	signedbytes := make([]byte, len(msg)+1)
 	copy(signedbytes, msg)
@@ -306,6 +593,67 @@ func (ks *keySigner) Sign(msg []byte) (string, error) {
 	return s, nil
 }
 
+// Return a signature for everything read from 'r', hashing it as it goes
+func (ks *keySigner) SignReader(r io.Reader) (string, error) {
+	key, err := ks.kz.primaryKey()
+	if err != nil {
+		return "", err
+	}
+	signingKey, ok := key.(digestSignKey)
+	if !ok {
+		return "", ErrCannotStream
+	}
+	h := signingKey.newHash()
+	if h == nil {
+		return "", ErrCannotStream
+	}
+	if _, err := io.Copy(h, r); err != nil {
+		return "", err
+	}
+	h.Write([]byte{kzVersion})
+	signature, err := signingKey.SignDigest(h.Sum(nil))
+	if err != nil {
+		return "", err
+	}
+	signature = append(makeHeader(key), signature...)
+	return ks.encode(signature), nil
+}
+
+// Verify the signature on everything read from 'r', hashing it as it goes
+func (ks *keySigner) VerifyReader(r io.Reader, signature string) (bool, error) {
+	b, kl, err := splitHeader(ks.encodingController, ks.kz, signature, ErrShortSignature)
+	if err != nil {
+		return false, err
+	}
+	// more than one key can share a key hash, and the stream can only be read once
+	var keys []digestVerifyKey
+	var hashes []io.Writer
+	for _, k := range kl {
+		if dk, ok := k.(digestVerifyKey); ok {
+			if h := dk.newHash(); h != nil {
+				keys = append(keys, dk)
+				hashes = append(hashes, h)
+			}
+		}
+	}
+	if len(keys) == 0 {
+		return false, ErrCannotStream
+	}
+	if _, err := io.Copy(io.MultiWriter(hashes...), r); err != nil {
+		return false, err
+	}
+	sig := b[kzHeaderLength:]
+	for i, dk := range keys {
+		h := hashes[i].(hash.Hash)
+		h.Write([]byte{kzVersion})
+		valid, _ := dk.VerifyDigest(h.Sum(nil), sig)
+		if valid {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
 func buildAttachedSignedBytes(msg []byte, nonce []byte) []byte {
 	signedBytesLen := len(msg) + 1
 	if nonce != nil {
@@ -363,7 +711,10 @@ func (ks *keySigner) AttachedVerify(signedMsg string, nonce []byte) ([]byte, err
 // Return a signature for 'msg' and the nonce
 // All the heavy lifting is done by the key
 func (ks *keySigner) AttachedSign(msg []byte, nonce []byte) (string, error) {
-	key := ks.kz.getPrimaryKey()
+	key, err := ks.kz.primaryKey()
+	if err != nil {
+		return "", err
+	}
 	signingKey := key.(signVerifyKey)
 	signedbytes := buildAttachedSignedBytes(msg, nonce)
 	signature, err := signingKey.Sign(signedbytes)
@@ -400,7 +751,10 @@ func buildTimeoutSignedBytes(msg []byte, expiration int64) []byte {
 
 // construct and return a timeout signature
 func (ks *keySigner) TimeoutSign(msg []byte, expiration int64) (string, error) {
-	key := ks.kz.getPrimaryKey()
+	key, err := ks.kz.primaryKey()
+	if err != nil {
+		return "", err
+	}
 	signingKey := key.(signVerifyKey)
 	h := makeHeader(key)
 	signedbytes := buildTimeoutSignedBytes(msg, expiration)
@@ -445,11 +799,19 @@ func (ks *keySigner) TimeoutVerify(message []byte, signature string) (bool, erro
 }
 
 // NewCrypter returns an object capable of encrypting and decrypting using the key provded by the reader
-func NewCrypter(r KeyReader) (Crypter, error) {
-	return newCrypter(r)
+func NewCrypter(r KeyReader, opts ...Option) (Crypter, error) {
+	c, err := newCrypter(r)
+	if err != nil {
+		return nil, err
+	}
+	applyOptions(c, opts)
+	if err := c.kz.preloadError(); err != nil {
+		return nil, err
+	}
+	return c, nil
 }
 
-func NewCryptStreamer(r KeyReader) (CryptStreamer, error) {
+func NewCryptStreamer(r KeyReader, opts ...Option) (CryptStreamer, error) {
 	c, err := newCrypter(r)
 	if err != nil {
 		return nil, err
@@ -457,19 +819,26 @@ func NewCryptStreamer(r KeyReader) (CryptStreamer, error) {
 	if _, ok := c.kz.getPrimaryKey().(streamEncryptKey); !ok {
 		return nil, ErrCannotStream
 	}
+	applyOptions(c, opts)
+	if err := c.kz.preloadError(); err != nil {
+		return nil, err
+	}
 	return &keyCryptStreamer{c}, nil
 }
 
 func newCrypter(r KeyReader) (*keyCrypter, error) {
 	k := new(keyCrypter)
 	var err error
-	k.kz, err = newKeyCzar(r)
+	k.kz, err = newLazyKeyCzar(r)
 	if err != nil {
 		return nil, err
 	}
 	if !k.kz.isAcceptablePurpose(P_DECRYPT_AND_ENCRYPT) {
 		return nil, ErrUnacceptablePurpose
 	}
+	if k.kz.keymeta.Type.isDeterministic() {
+		return nil, ErrDeterministicKey
+	}
 	err = k.kz.loadPrimaryKey()
 	if err != nil {
 		return nil, err
@@ -477,7 +846,7 @@ func newCrypter(r KeyReader) (*keyCrypter, error) {
 	return k, nil
 }
 
-func NewSignedEncrypter(r KeyReader, signer Signer, nonce []byte) (SignedEncrypter, error) {
+func NewSignedEncrypter(r KeyReader, signer Signer, nonce []byte, opts ...Option) (SignedEncrypter, error) {
 	k := new(keySignedEncypter)
 	var err error
 	k.kz, err = newKeyCzar(r)
@@ -489,14 +858,18 @@ func NewSignedEncrypter(r KeyReader, signer Signer, nonce []byte) (SignedEncrypt
 	if !k.kz.isAcceptablePurpose(P_DECRYPT_AND_ENCRYPT) {
 		return nil, ErrUnacceptablePurpose
 	}
+	if k.kz.keymeta.Type.isDeterministic() {
+		return nil, ErrDeterministicKey
+	}
 	err = k.kz.loadPrimaryKey()
 	if err != nil {
 		return nil, err
 	}
-	return k, err
+	applyOptions(k, opts)
+	return k, nil
 }
 
-func NewSignedDecrypter(r KeyReader, verifier Verifier, nonce []byte) (SignedDecrypter, error) {
+func NewSignedDecrypter(r KeyReader, verifier Verifier, nonce []byte, opts ...Option) (SignedDecrypter, error) {
 	k := new(keySignedDecrypter)
 	var err error
 	k.kz, err = newKeyCzar(r)
@@ -508,19 +881,31 @@ func NewSignedDecrypter(r KeyReader, verifier Verifier, nonce []byte) (SignedDec
 	if !k.kz.isAcceptablePurpose(P_DECRYPT_AND_ENCRYPT) {
 		return nil, ErrUnacceptablePurpose
 	}
+	if k.kz.keymeta.Type.isDeterministic() {
+		return nil, ErrDeterministicKey
+	}
 	err = k.kz.loadPrimaryKey()
 	if err != nil {
 		return nil, err
 	}
-	return k, err
+	applyOptions(k, opts)
+	return k, nil
 }
 
 // NewEncrypter returns an object capable of encrypting using the key provded by the reader
-func NewEncrypter(r KeyReader) (Encrypter, error) {
-	return newEncrypter(r)
+func NewEncrypter(r KeyReader, opts ...Option) (Encrypter, error) {
+	e, err := newEncrypter(r)
+	if err != nil {
+		return nil, err
+	}
+	applyOptions(e, opts)
+	if err := e.kz.preloadError(); err != nil {
+		return nil, err
+	}
+	return e, nil
 }
 
-func NewEncryptStreamer(r KeyReader) (EncryptStreamer, error) {
+func NewEncryptStreamer(r KeyReader, opts ...Option) (EncryptStreamer, error) {
 	e, err := newEncrypter(r)
 	if err != nil {
 		return nil, err
@@ -528,19 +913,26 @@ func NewEncryptStreamer(r KeyReader) (EncryptStreamer, error) {
 	if _, ok := e.kz.getPrimaryKey().(streamDecryptKey); !ok {
 		return nil, ErrCannotStream
 	}
-	return &keyCryptStreamer{e}, nil
+	applyOptions(e, opts)
+	if err := e.kz.preloadError(); err != nil {
+		return nil, err
+	}
+	return &keyEncryptStreamer{e}, nil
 }
 
-func newEncrypter(r KeyReader) (*keyCrypter, error) {
-	k := new(keyCrypter)
+func newEncrypter(r KeyReader) (*keyEncrypter, error) {
+	k := new(keyEncrypter)
 	var err error
-	k.kz, err = newKeyCzar(r)
+	k.kz, err = newLazyKeyCzar(r)
 	if err != nil {
 		return nil, err
 	}
 	if !k.kz.isAcceptablePurpose(P_ENCRYPT) {
 		return nil, ErrUnacceptablePurpose
 	}
+	if k.kz.keymeta.Type.isDeterministic() {
+		return nil, ErrDeterministicKey
+	}
 	err = k.kz.loadPrimaryKey()
 	if err != nil {
 		return nil, err
@@ -549,42 +941,49 @@ func newEncrypter(r KeyReader) (*keyCrypter, error) {
 }
 
 // NewVerifier returns an object capable of verifying signatures using the key provded by the reader
-func NewVerifier(r KeyReader) (Verifier, error) {
+func NewVerifier(r KeyReader, opts ...Option) (Verifier, error) {
 	k := new(keySigner)
-	k.currentTime = func() int64 {
-		return time.Now().UnixNano() / int64(time.Millisecond)
-	}
+	k.currentTime = currentMillis
 	var err error
-	k.kz, err = newKeyCzar(r)
+	k.kz, err = newLazyKeyCzar(r)
 	if err != nil {
 		return nil, err
 	}
 	if !k.kz.isAcceptablePurpose(P_VERIFY) {
 		return nil, ErrUnacceptablePurpose
 	}
-	return k, err
+	applyOptions(k, opts)
+	if err := k.kz.preloadError(); err != nil {
+		return nil, err
+	}
+	return k, nil
 }
 
 // NewVerifierTimeProvider returns an object verifying signatures valid for a certain period
-func NewVerifierTimeProvider(r KeyReader, t currentTime) (Verifier, error) {
+func NewVerifierTimeProvider(r KeyReader, t currentTime, opts ...Option) (Verifier, error) {
 	k := new(keySigner)
 	k.currentTime = t
 	var err error
-	k.kz, err = newKeyCzar(r)
+	k.kz, err = newLazyKeyCzar(r)
 	if err != nil {
 		return nil, err
 	}
 	if !k.kz.isAcceptablePurpose(P_VERIFY) {
 		return nil, ErrUnacceptablePurpose
 	}
-	return k, err
+	applyOptions(k, opts)
+	if err := k.kz.preloadError(); err != nil {
+		return nil, err
+	}
+	return k, nil
 }
 
 // NewSigner returns an object capable of creating and verifying signatures using the key provded by the reader
-func NewSigner(r KeyReader) (Signer, error) {
+func NewSigner(r KeyReader, opts ...Option) (Signer, error) {
 	k := new(keySigner)
+	k.currentTime = currentMillis
 	var err error
-	k.kz, err = newKeyCzar(r)
+	k.kz, err = newLazyKeyCzar(r)
 	if err != nil {
 		return nil, err
 	}
@@ -595,7 +994,11 @@ func NewSigner(r KeyReader) (Signer, error) {
 	if err != nil {
 		return nil, err
 	}
-	return k, err
+	applyOptions(k, opts)
+	if err := k.kz.preloadError(); err != nil {
+		return nil, err
+	}
+	return k, nil
 }
 
 func (kz *keyCzar) loadPrimaryKey() error {
@@ -606,7 +1009,7 @@ func (kz *keyCzar) loadPrimaryKey() error {
 			if kz.primary == -1 {
 				kz.primary = v.VersionNumber
 			} else {
-				return ErrNoPrimaryKey // technically, ErrMultiplePrimaryKey
+				return ErrMultiplePrimaryKeys
 			}
 		}
 	}
@@ -617,14 +1020,86 @@ func (kz *keyCzar) loadPrimaryKey() error {
 	return nil
 }
 
+// return the primary key to encrypt or sign with, if it is within its lifetime
+func (kz *keyCzar) primaryKey() (keydata, error) {
+	kz.mu.RLock()
+	defer kz.mu.RUnlock()
+	if kz.primary == -1 {
+		return nil, ErrNoPrimaryKey
+	}
+	for i := range kz.keymeta.Versions {
+		if kv := &kz.keymeta.Versions[i]; kv.VersionNumber == kz.primary {
+			if err := kv.usableAt(currentMillis()); err != nil {
+				return nil, err
+			}
+		}
+	}
+	k, ok := kz.keys[kz.primary]
+	if !ok {
+		return nil, ErrNoPrimaryKey
+	}
+	return k, nil
+}
+
 func (kz *keyCzar) getPrimaryKey() keydata {
+	kz.mu.RLock()
+	defer kz.mu.RUnlock()
 	if kz.primary == -1 {
 		return nil
 	}
 	return kz.keys[kz.primary]
 }
 
-func (kz *keyCzar) isAcceptablePurpose(purpose keyPurpose) bool {
+// return the version and hash of a key of the key set
+func (kz *keyCzar) keyInfo(k keydata) KeyInfo {
+	kz.mu.RLock()
+	defer kz.mu.RUnlock()
+	info := KeyInfo{Version: -1, KeyHash: append([]byte(nil), k.KeyID()...), Size: keySize(k)}
+	for v, kk := range kz.keys {
+		if kk == k {
+			info.Version = v
+			break
+		}
+	}
+	for _, kv := range kz.keymeta.Versions {
+		if kv.VersionNumber == info.Version {
+			info.Status, info.Exportable = kv.Status, kv.Exportable
+		}
+	}
+	return info
+}
+
+func (kz *keyCzar) primaryVersion() int {
+	kz.mu.RLock()
+	defer kz.mu.RUnlock()
+	return kz.primary
+}
+
+// return the key of a version that can still be used for new output
+func (kz *keyCzar) getKeyVersion(version int) (keydata, error) {
+	if err := kz.loadVersion(version); err != nil {
+		return nil, err
+	}
+	kz.mu.RLock()
+	defer kz.mu.RUnlock()
+	for _, kv := range kz.keymeta.Versions {
+		if kv.VersionNumber != version {
+			continue
+		}
+		if kv.Status == S_INACTIVE {
+			return nil, ErrInactiveKey
+		}
+		if err := kv.usableAt(currentMillis()); err != nil {
+			return nil, err
+		}
+		if k, ok := kz.keys[version]; ok {
+			return k, nil
+		}
+	}
+	return nil, ErrNoSuchKeyVersion
+}
+
+func (kz *keyCzar) isAcceptablePurpose(purpose KeyPurpose) bool {
 	return kz.keymeta.Purpose.isAcceptablePurpose(purpose)
 }
 
@@ -633,40 +1108,110 @@ type lookupKeyIDer interface {
 }
 
 func (kz *keyCzar) getKeyForID(id []byte) ([]keydata, error) {
-	kl, ok := kz.idkeys[binary.BigEndian.Uint32(id)]
-	if !ok || len(kl) == 0 {
-		return kl, ErrKeyNotFound
+	kz.mu.RLock()
+	kl := kz.idkeys[binary.BigEndian.Uint32(id)]
+	policy, tryAll, compat := kz.policy, kz.tryAll, kz.hashCompat
+	kz.mu.RUnlock()
+	var loadErr error
+	if len(kl) == 0 {
+		// maybe it is a key version not read yet
+		loadErr = kz.loadAllVersions()
+		kz.mu.RLock()
+		kl = kz.idkeys[binary.BigEndian.Uint32(id)]
+		kz.mu.RUnlock()
+	}
+	if len(kl) == 0 && policy == RELOAD_ON_UNKNOWN_KEY {
+		// maybe the key was added since we loaded the key set
+		if err := kz.reload(); err != nil {
+			return nil, err
+		}
+		kz.mu.RLock()
+		kl = kz.idkeys[binary.BigEndian.Uint32(id)]
+		kz.mu.RUnlock()
+	}
+	if len(kl) == 0 && compat == KEYHASH_CPP {
+		kl = kz.getKeyForCppID(id)
+	}
+	if len(kl) == 0 && tryAll {
+		kl = kz.allKeys()
+	}
+	if len(kl) == 0 {
+		return kl, &KeyNotFoundError{KeyHash: append([]byte(nil), id...), Err: loadErr}
 	}
 	return kl, nil
 }
 
-func newKeysFromReader(r KeyReader, kz *keyCzar, keyFromJSON func([]byte) (keydata, error)) (map[int]keydata, map[uint32][]keydata, error) {
+// read the keys of kz from r.  If lazy is set, only the primary key is read, and the other versions are left to kz.lazy.
+func newKeysFromReader(r KeyReader, kz *keyCzar, keyFromJSON func([]byte) (keydata, error), lazy bool) (map[int]keydata, map[uint32][]keydata, error) {
 	keys := make(map[int]keydata)
 	idkeys := make(map[uint32][]keydata)
 	for _, kv := range kz.keymeta.Versions {
 		if kv.Status == S_PRIMARY {
 			kz.primary = kv.VersionNumber
+		} else if lazy {
+			if kz.lazy == nil {
+				kz.lazy = &lazyKeys{reader: r, keyFromJSON: keyFromJSON, name: kz.keymeta.Name, encrypted: kz.keymeta.Encrypted, versions: make(map[int]*lazyKey)}
+			}
+			kz.lazy.versions[kv.VersionNumber] = new(lazyKey)
+			continue
 		}
-		s, err := r.GetKey(kv.VersionNumber)
-		if err != nil {
-			return nil, nil, err
-		}
-		k, err := keyFromJSON([]byte(s))
+		k, err := readKeyVersion(r, kv.VersionNumber, keyFromJSON)
 		if err != nil {
 			return nil, nil, err
 		}
 		keys[kv.VersionNumber] = k
 		//initialize fast lookup for keys
-		hash := binary.BigEndian.Uint32(k.KeyID())
-		kl := idkeys[hash]
-		kl = append(kl, k)
-		idkeys[hash] = kl
+		addKeyIDs(idkeys, k)
 	}
 	return keys, idkeys, nil
 }
 
-// construct a keyczar object from a reader for a given purpose
+// return the function parsing keys of the given type, or nil if it's not supported
+func keyFromJSONFunc(t KeyType) func([]byte) (keydata, error) {
+	switch t {
+	case T_AES:
+		return func(s []byte) (keydata, error) { return newAESKeyFromJSON(s) }
+	case T_HMAC_SHA1:
+		return func(s []byte) (keydata, error) { return newHMACKeyFromJSON(s) }
+	case T_DSA_PRIV:
+		return func(s []byte) (keydata, error) { return newDSAKeyFromJSON(s) }
+	case T_DSA_PUB:
+		return func(s []byte) (keydata, error) { return newDSAPublicKeyFromJSON(s) }
+	case T_RSA_PRIV:
+		return func(s []byte) (keydata, error) { return newRSAKeyFromJSON(s) }
+	case T_RSA_PUB:
+		return func(s []byte) (keydata, error) { return newRSAPublicKeyFromJSON(s) }
+	case T_EC_PRIV:
+		return func(s []byte) (keydata, error) { return newECDSAKeyFromJSON(s) }
+	case T_EC_PUB:
+		return func(s []byte) (keydata, error) { return newECDSAPublicKeyFromJSON(s) }
+	case T_ED25519_PRIV:
+		return func(s []byte) (keydata, error) { return newEd25519KeyFromJSON(s) }
+	case T_ED25519_PUB:
+		return func(s []byte) (keydata, error) { return newEd25519PublicKeyFromJSON(s) }
+	case T_X25519_PRIV:
+		return func(s []byte) (keydata, error) { return newX25519KeyFromJSON(s) }
+	case T_X25519_PUB:
+		return func(s []byte) (keydata, error) { return newX25519PublicKeyFromJSON(s) }
+	case T_CHACHA20_POLY1305:
+		return func(s []byte) (keydata, error) { return newChaChaKeyFromJSON(s) }
+	case T_AES_SIV:
+		return func(s []byte) (keydata, error) { return newAESSIVKeyFromJSON(s) }
+	}
+	return nil
+}
+
+// construct a keyczar object from a reader for a given purpose, reading every key version
 func newKeyCzar(r KeyReader) (*keyCzar, error) {
+	return readKeyCzar(r, false)
+}
+
+// construct a keyczar object from a reader, reading only the primary key: the other versions are read on first use
+func newLazyKeyCzar(r KeyReader) (*keyCzar, error) {
+	return readKeyCzar(r, true)
+}
+
+func readKeyCzar(r KeyReader, lazy bool) (*keyCzar, error) {
 	kz := new(keyCzar)
 	kz.primary = -1
 	s, err := r.GetMetadata()
@@ -677,23 +1222,27 @@ func newKeyCzar(r KeyReader) (*keyCzar, error) {
 	if err != nil {
 		return nil, err
 	}
-	var f func(s []byte) (keydata, error)
-	switch kz.keymeta.Type {
-	case T_AES:
-		f = func(s []byte) (keydata, error) { return newAESKeyFromJSON(s) }
-	case T_HMAC_SHA1:
-		f = func(s []byte) (keydata, error) { return newHMACKeyFromJSON(s) }
-	case T_DSA_PRIV:
-		f = func(s []byte) (keydata, error) { return newDSAKeyFromJSON(s) }
-	case T_DSA_PUB:
-		f = func(s []byte) (keydata, error) { return newDSAPublicKeyFromJSON(s) }
-	case T_RSA_PRIV:
-		f = func(s []byte) (keydata, error) { return newRSAKeyFromJSON(s) }
-	case T_RSA_PUB:
-		f = func(s []byte) (keydata, error) { return newRSAPublicKeyFromJSON(s) }
-	default:
+	err = kz.keymeta.validate()
+	if err != nil {
+		return nil, err
+	}
+	f := keyFromJSONFunc(kz.keymeta.Type)
+	if f == nil {
 		return nil, ErrUnsupportedType
 	}
-	kz.keys, kz.idkeys, err = newKeysFromReader(r, kz, f)
+	decrypts := decryptsKeys(r)
+	if kz.keymeta.Encrypted && !decrypts {
+		return nil, &KeysetEncryptionError{Name: kz.keymeta.Name, Encrypted: true}
+	}
+	kz.source = readerSource(r)
+	kz.keys, kz.idkeys, err = newKeysFromReader(r, kz, f, lazy)
+	if err != nil && !kz.keymeta.Encrypted && decrypts {
+		// plaintext keys don't decrypt: say why
+		err = &KeysetEncryptionError{Name: kz.keymeta.Name, Err: err}
+	}
+	kz.load = func() (*keyCzar, error) { return readKeyCzar(r, lazy) }
+	if err == nil {
+		kz.auditLoad()
+	}
 	return kz, err
 }
@@ -1,12 +1,14 @@
 package main
 
 import (
+	"bytes"
 	"fmt"
 	"github.com/dgryski/dkeyczar"
+	"github.com/dgryski/dkeyczar/interop"
 	"github.com/jessevdk/go-flags"
+	"io"
 	"io/ioutil"
 	"os"
-	"strconv"
 	"time"
 )
 
@@ -22,18 +24,29 @@ func Save(location string, km dkeyczar.KeyManager, encrypter dkeyczar.Encrypter)
 	Update(location, km, encrypter)
 }
 
+// Update writes the key set of km to location, leaving it as it was if that fails
 func Update(location string, km dkeyczar.KeyManager, encrypter dkeyczar.Encrypter) {
 
-	s := km.ToJSONs(encrypter)
-
-	ioutil.WriteFile(location+"/meta", []byte(s[0]), 0600)
-
-	for i := 1; i < len(s); i++ {
-		fname := location + "/" + strconv.Itoa(i)
-		ioutil.WriteFile(fname, []byte(s[i]), 0600)
+	s, err := km.ToJSONs(encrypter)
+	if err == nil {
+		err = dkeyczar.NewFileWriter(location).WriteKeyset(s)
+	}
+	if err != nil {
+		fmt.Println("error writing key set:", err)
+		os.Exit(1)
 	}
 }
 
+// options shared by the encrypt, decrypt, sign and verify commands
+type streamOpts struct {
+	Location string `short:"l" long:"location" description:"The location of the key set."`
+	Crypter  string `short:"c" long:"crypter" description:"The location of the crypter key set to crypt the main key set."`
+	Password string `long:"password" description:"The password of a PBE encrypted key set."`
+	Binary   bool   `long:"binary" description:"Raw binary ciphertext or signature."`
+	Base64   bool   `long:"base64" description:"Web-safe base64 ciphertext or signature (default)."`
+	Hex      bool   `long:"hex" description:"Hex ciphertext or signature."`
+}
+
 func main() {
 
 	//value string `short:"" long:"" description:""`
@@ -41,13 +54,17 @@ func main() {
 		Location   string `short:"l" long:"location" description:"The location of the key set."`
 		Purpose    string `short:"o" long:"purpose"  description:"The purpose of the key set (sign|crypt)."`
 		Name       string `short:"n" long:"name" description:"The key set name."`
-		Asymmetric string `short:"a" long:"asymmetric" description:"Use asymmetric algorithm (dsa|rsa)."`
+		Asymmetric string `short:"a" long:"asymmetric" description:"Use asymmetric algorithm (dsa|rsa|ec|ed25519|x25519)."`
+		Cipher     string `long:"cipher" description:"Use symmetric cipher for crypt key sets (aes|chacha20poly1305|aes-siv)."`
 	}
 	var addKeyOpts struct {
 		Location string `short:"l" long:"location" description:"The location of the key set."`
 		Status   string `short:"s" long:"status" description:"The status (active|primary)."`
-		Size     int    `short:"b" long:"size" description:"The key size in bits."`
+		Size     int    `short:"b" long:"size" description:"The key size in bits (2048|3072|4096 for RSA)."`
+		MinSize  int    `long:"min-size" description:"Refuse RSA keys smaller than this many bits."`
+		Strict   bool   `long:"strict" description:"Refuse AES keys under 192 bits and RSA keys under 2048 bits; AES keys default to 256 bits."`
 		Crypter  string `short:"c" long:"crypter" description:"The location of the crypter key set to crypt the main key set."`
+		Padding  string `long:"padding" description:"The signature padding for RSA keys (pkcs1|pss)."`
 	}
 	var promoteOpts struct {
 		Location string `short:"l" long:"location" description:"The location of the key set."`
@@ -61,11 +78,34 @@ func main() {
 		Location string `short:"l" long:"location" description:"The location of the key set."`
 		Version  int    `short:"v" long:"version" default:"0" description:"The key version."`
 	}
+	var exportableOpts struct {
+		Location string `short:"l" long:"location" description:"The location of the key set."`
+		Version  int    `short:"v" long:"version" default:"0" description:"The key version."`
+		Crypter  string `short:"c" long:"crypter" description:"The location of the crypter key set to crypt the main key set."`
+		Yes      bool   `long:"yes" description:"Confirm that the private key may be exported."`
+		Clear    bool   `long:"clear" description:"Clear the mark instead, so the key can't be exported."`
+	}
+	var importKeyOpts struct {
+		Location   string `short:"l" long:"location" description:"The location of the key set."`
+		Status     string `short:"s" long:"status" description:"The status (active|primary)."`
+		PemFile    string `long:"pemfile" description:"The PEM file containing the private key to import."`
+		Passphrase string `long:"passphrase" description:"The passphrase of an encrypted PEM file."`
+		Crypter    string `short:"c" long:"crypter" description:"The location of the crypter key set to crypt the main key set."`
+		Padding    string `long:"padding" description:"The signature padding for RSA keys (pkcs1|pss)."`
+		MinSize    int    `long:"min-size" description:"Refuse RSA keys smaller than this many bits."`
+	}
 	var pubKeyOpts struct {
 		Location    string `short:"l" long:"location" description:"The location of the key set."`
 		Destination string `short:"d" long:"destination" description:"The destination location of the operation."`
 		Crypter     string `short:"c" long:"crypter" description:"The location of the crypter key set to crypt the main key set."`
 	}
+	var exportKeyOpts struct {
+		Location    string `short:"l" long:"location" description:"The location of the key set."`
+		Version     int    `short:"v" long:"version" default:"0" description:"The key version (defaults to the primary)."`
+		Destination string `short:"d" long:"destination" description:"The destination location of the operation."`
+		Crypter     string `short:"c" long:"crypter" description:"The location of the crypter key set to crypt the main key set."`
+		Private     bool   `long:"private" description:"Export the private key instead of the public key."`
+	}
 	var useKeyOpts struct {
 		Format       string `long:"format" description:"Output usage for key (crypt|sign|sign-timeout|sign-vanilla|sign-attached|crypt-session|crypt-signedsession)."`
 		Location     string `short:"l" long:"location" description:"The location of the key set."`
@@ -75,6 +115,26 @@ func main() {
 		Crypter      string `short:"c" long:"crypter" description:"The location of the crypter key set to crypt the main key set."`
 		Crypter2     string `short:"c" long:"crypter2" description:"The location of the crypter key set to crypt the 2nd key set."`
 	}
+	var encryptOpts, decryptOpts streamOpts
+	var signOpts struct {
+		streamOpts
+		Detached string `long:"detached" description:"Sign this file instead of stdin, writing the signature to the file with a .sig suffix."`
+	}
+	var verifyOpts struct {
+		streamOpts
+		Signature string `short:"s" long:"signature" description:"The signature to check."`
+		Detached  string `long:"detached" description:"Verify this file against its signature file with a .sig suffix, instead of stdin and --signature."`
+	}
+	var checkOpts struct {
+		Location string `short:"l" long:"location" description:"The location of the key set."`
+		Crypter  string `short:"c" long:"crypter" description:"The location of the crypter key set to crypt the main key set."`
+		Password string `long:"password" description:"The password of a PBE encrypted key set."`
+		Strict   bool   `long:"strict" description:"Fail on warnings too."`
+	}
+	var interopOpts struct {
+		Location string   `short:"l" long:"location" description:"The directory of the corpus."`
+		Case     []string `long:"case" description:"A case of the corpus, e.g. aes or rsa-sign (default all)."`
+	}
 
 	parser := flags.NewNamedParser("dkeyczart", flags.Default)
 	parser.AddCommand("create", "Create a new key set.", "Create a new key set.", &createOpts)
@@ -82,8 +142,17 @@ func main() {
 	parser.AddCommand("promote", "Promote a given key version from the key set.", "Promote a given key version from the key set.", &promoteOpts)
 	parser.AddCommand("demote", "Demote a given key version from the key set.", "Demote a given key version from the key set.", &demoteOpts)
 	parser.AddCommand("revoke", "Revoke a given key version from the key set.", "Revoke a given key version from the key set.", &revokeOpts)
+	parser.AddCommand("exportable", "Marks a given key version exportable.", "Marks a given key version exportable, so exportkey --private can export it.  Needs --yes.", &exportableOpts)
+	parser.AddCommand("importkey", "Import a PEM private key into an existing key set.", "Import an RSA, DSA, EC or Ed25519 PEM or OpenSSH private key as a new version of an existing key set.", &importKeyOpts)
 	parser.AddCommand("pubkey", "Extracts public keys to a new key set.", "Extracts public keys to a new key set.", &pubKeyOpts)
+	parser.AddCommand("exportkey", "Exports a key as PEM.", "Exports a key from an RSA, DSA, EC or Ed25519 key set as PEM.", &exportKeyOpts)
 	parser.AddCommand("usekey", "Uses keyset to encrypt or sign a message.", "Uses keyset to encrypt or sign a message.", &useKeyOpts)
+	parser.AddCommand("encrypt", "Encrypts stdin to stdout.", "Encrypts stdin to stdout with the primary key of the key set.", &encryptOpts)
+	parser.AddCommand("decrypt", "Decrypts stdin to stdout.", "Decrypts stdin to stdout with the key set.", &decryptOpts)
+	parser.AddCommand("sign", "Signs stdin.", "Signs stdin with the primary key of the key set and writes the signature to stdout, or signs a --detached file.", &signOpts)
+	parser.AddCommand("verify", "Verifies a signature of stdin.", "Verifies the --signature of stdin, or a --detached file, with the key set.  Exits with status 1 if the signature is invalid.", &verifyOpts)
+	parser.AddCommand("check", "Checks a key set for problems.", "Checks a key set for missing primary keys, unreadable or mismatched keys, weak key sizes and exportable keys.  Exits with status 1 on errors, or on warnings with --strict.", &checkOpts)
+	parser.AddCommand("interop", "Generates or checks an interop corpus (gen|check).", "interop gen writes key sets, ciphertexts and signatures in the layout of the keyczar interop test data; interop check decrypts and verifies such a corpus, e.g. one written by Java or Python keyczar.  Exits with status 1 if anything fails.", &interopOpts)
 
 	args, err := parser.Parse()
 	if err != nil {
@@ -113,7 +182,7 @@ func main() {
 			return
 		}
 
-		if createOpts.Asymmetric != "" && createOpts.Asymmetric != "dsa" && createOpts.Asymmetric != "rsa" {
+		if createOpts.Asymmetric != "" && createOpts.Asymmetric != "dsa" && createOpts.Asymmetric != "rsa" && createOpts.Asymmetric != "ec" && createOpts.Asymmetric != "ed25519" && createOpts.Asymmetric != "x25519" {
 			fmt.Println("unknown asymmetric key type:", createOpts.Asymmetric)
 			return
 		}
@@ -121,16 +190,26 @@ func main() {
 		keytype := dkeyczar.T_AES
 
 		switch {
-		case keypurpose == dkeyczar.P_DECRYPT_AND_ENCRYPT && createOpts.Asymmetric == "":
+		case keypurpose == dkeyczar.P_DECRYPT_AND_ENCRYPT && createOpts.Asymmetric == "" && (createOpts.Cipher == "" || createOpts.Cipher == "aes"):
 			keytype = dkeyczar.T_AES
+		case keypurpose == dkeyczar.P_DECRYPT_AND_ENCRYPT && createOpts.Asymmetric == "" && createOpts.Cipher == "chacha20poly1305":
+			keytype = dkeyczar.T_CHACHA20_POLY1305
+		case keypurpose == dkeyczar.P_DECRYPT_AND_ENCRYPT && createOpts.Asymmetric == "" && createOpts.Cipher == "aes-siv":
+			keytype = dkeyczar.T_AES_SIV
 		case keypurpose == dkeyczar.P_DECRYPT_AND_ENCRYPT && createOpts.Asymmetric == "rsa":
 			keytype = dkeyczar.T_RSA_PRIV
+		case keypurpose == dkeyczar.P_DECRYPT_AND_ENCRYPT && createOpts.Asymmetric == "x25519":
+			keytype = dkeyczar.T_X25519_PRIV
 		case keypurpose == dkeyczar.P_SIGN_AND_VERIFY && createOpts.Asymmetric == "":
 			keytype = dkeyczar.T_HMAC_SHA1
 		case keypurpose == dkeyczar.P_SIGN_AND_VERIFY && createOpts.Asymmetric == "rsa":
 			keytype = dkeyczar.T_RSA_PRIV
 		case keypurpose == dkeyczar.P_SIGN_AND_VERIFY && createOpts.Asymmetric == "dsa":
 			keytype = dkeyczar.T_DSA_PRIV
+		case keypurpose == dkeyczar.P_SIGN_AND_VERIFY && createOpts.Asymmetric == "ec":
+			keytype = dkeyczar.T_EC_PRIV
+		case keypurpose == dkeyczar.P_SIGN_AND_VERIFY && createOpts.Asymmetric == "ed25519":
+			keytype = dkeyczar.T_ED25519_PRIV
 		default:
 			fmt.Println("unknown or invalid purpose/asymmetric combination:", createOpts.Purpose, "/", createOpts.Asymmetric)
 			return
@@ -161,6 +240,21 @@ func main() {
 		}
 		km.Demote(demoteOpts.Version)
 		Update(demoteOpts.Location, km, nil)
+	case "revoke":
+		if !loadLocationReader(km, revokeOpts.Location, nil) {
+			return
+		}
+
+		if revokeOpts.Version == 0 {
+			fmt.Println("must provide a version with --version")
+			return
+		}
+		err := km.Revoke(revokeOpts.Version)
+		if err != nil {
+			fmt.Println("error revoking key:", err)
+			return
+		}
+		Update(revokeOpts.Location, km, nil)
 	case "addkey":
 		c := loadCrypter(addKeyOpts.Crypter)
 		if !loadLocationReader(km, addKeyOpts.Location, c) {
@@ -182,12 +276,98 @@ func main() {
 			return
 		}
 
+		switch addKeyOpts.Padding {
+		case "", "pkcs1":
+			km.SetSignatureScheme(dkeyczar.SIG_PKCS1)
+		case "pss":
+			km.SetSignatureScheme(dkeyczar.SIG_PSS)
+		default:
+			fmt.Println("unknown padding:", addKeyOpts.Padding)
+			return
+		}
+
+		km.(dkeyczar.RSAKeySizeController).SetMinRSAKeySize(uint(addKeyOpts.MinSize))
+		km.(dkeyczar.KeyPolicyController).SetStrictKeyPolicy(addKeyOpts.Strict)
+
 		err := km.AddKey(uint(addKeyOpts.Size), status)
 		if err != nil {
 			fmt.Println("error adding key:", err)
 			return
 		}
 		Update(addKeyOpts.Location, km, c)
+	case "exportable":
+		c := loadCrypter(exportableOpts.Crypter)
+		if !loadLocationReader(km, exportableOpts.Location, c) {
+			return
+		}
+		if exportableOpts.Version == 0 {
+			fmt.Println("must provide a version with --version")
+			return
+		}
+		ec := km.(dkeyczar.ExportableController)
+		var err error
+		switch {
+		case exportableOpts.Clear:
+			err = ec.ClearExportable(exportableOpts.Version)
+		case !exportableOpts.Yes:
+			fmt.Println("marking a key exportable lets its private key leave the key set; confirm with --yes")
+			return
+		default:
+			err = ec.MarkExportable(exportableOpts.Version, dkeyczar.ConfirmExportable)
+		}
+		if err != nil {
+			fmt.Println("error marking key:", err)
+			return
+		}
+		Update(exportableOpts.Location, km, c)
+	case "importkey":
+		c := loadCrypter(importKeyOpts.Crypter)
+		if !loadLocationReader(km, importKeyOpts.Location, c) {
+			return
+		}
+		if importKeyOpts.PemFile == "" {
+			fmt.Println("must provide a PEM file with --pemfile")
+			return
+		}
+		status := dkeyczar.S_ACTIVE
+		switch importKeyOpts.Status {
+		case "", "active":
+			status = dkeyczar.S_ACTIVE
+		case "primary":
+			status = dkeyczar.S_PRIMARY
+		default:
+			fmt.Println("unknown status:", importKeyOpts.Status)
+			return
+		}
+
+		switch importKeyOpts.Padding {
+		case "", "pkcs1":
+			km.SetSignatureScheme(dkeyczar.SIG_PKCS1)
+		case "pss":
+			km.SetSignatureScheme(dkeyczar.SIG_PSS)
+		default:
+			fmt.Println("unknown padding:", importKeyOpts.Padding)
+			return
+		}
+
+		km.(dkeyczar.RSAKeySizeController).SetMinRSAKeySize(uint(importKeyOpts.MinSize))
+
+		var passphrase []byte
+		if importKeyOpts.Passphrase != "" {
+			passphrase = []byte(importKeyOpts.Passphrase)
+		}
+		// any private key can be imported for signing; ImportKey keeps the key set's purpose
+		r, err := dkeyczar.ImportPrivateKeyFromPEM(importKeyOpts.PemFile, passphrase, dkeyczar.P_SIGN_AND_VERIFY)
+		if err != nil {
+			fmt.Println("error reading PEM file:", err)
+			return
+		}
+		err = km.ImportKey(r, status)
+		if err != nil {
+			fmt.Println("error importing key:", err)
+			return
+		}
+		Update(importKeyOpts.Location, km, c)
 	case "pubkey":
 		if !loadLocationReader(km, pubKeyOpts.Location, nil) {
 			return
@@ -195,6 +375,151 @@ func main() {
 		kpub := km.PubKeys()
 		Save(pubKeyOpts.Destination, kpub, nil) // doesn't make sense to encrypt a public key
 		return
+	case "exportkey":
+		c := loadCrypter(exportKeyOpts.Crypter)
+		r := loadReader(exportKeyOpts.Location, c)
+		if r == nil {
+			return
+		}
+		version := exportKeyOpts.Version
+		if version == 0 {
+			version = dkeyczar.PrimaryKeyVersion
+		}
+		var b []byte
+		var err error
+		if exportKeyOpts.Private {
+			b, err = dkeyczar.ExportPrivateKeyPEM(r, version)
+		} else {
+			b, err = dkeyczar.ExportPublicKeyPEM(r, version)
+		}
+		if err != nil {
+			fmt.Println("error exporting key:", err)
+			return
+		}
+		if exportKeyOpts.Destination == "" {
+			os.Stdout.Write(b)
+			return
+		}
+		ioutil.WriteFile(exportKeyOpts.Destination, b, 0600)
+		return
+	case "encrypt":
+		r := loadStreamReader(encryptOpts)
+		if r == nil {
+			return
+		}
+		encoding := streamEncoding(encryptOpts)
+		if err := encryptStream(r, encoding, os.Stdin, os.Stdout); err != nil {
+			fmt.Fprintln(os.Stderr, "error encrypting:", err)
+			os.Exit(1)
+		}
+		if encoding != dkeyczar.NO_ENCODING {
+			fmt.Println()
+		}
+	case "decrypt":
+		r := loadStreamReader(decryptOpts)
+		if r == nil {
+			return
+		}
+		if err := decryptStream(r, streamEncoding(decryptOpts), os.Stdin, os.Stdout); err != nil {
+			fmt.Fprintln(os.Stderr, "error decrypting:", err)
+			os.Exit(1)
+		}
+	case "sign":
+		r := loadStreamReader(signOpts.streamOpts)
+		if r == nil {
+			return
+		}
+		encoding := streamEncoding(signOpts.streamOpts)
+		signer, err := dkeyczar.NewSigner(r, dkeyczar.WithEncoding(encoding))
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "failed to load key:", err)
+			os.Exit(1)
+		}
+		if signOpts.Detached != "" {
+			if err := signDetached(signer, signOpts.Detached); err != nil {
+				fmt.Fprintln(os.Stderr, "error signing:", err)
+				os.Exit(1)
+			}
+			return
+		}
+		output, err := signStream(signer, os.Stdin)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "error signing:", err)
+			os.Exit(1)
+		}
+		io.WriteString(os.Stdout, output)
+		if encoding != dkeyczar.NO_ENCODING {
+			fmt.Println()
+		}
+	case "verify":
+		r := loadStreamReader(verifyOpts.streamOpts)
+		if r == nil {
+			return
+		}
+		if verifyOpts.Signature == "" && verifyOpts.Detached == "" {
+			fmt.Fprintln(os.Stderr, "must provide a signature with --signature")
+			os.Exit(1)
+		}
+		verifier, err := dkeyczar.NewVerifier(r, dkeyczar.WithEncoding(streamEncoding(verifyOpts.streamOpts)))
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "failed to load key:", err)
+			os.Exit(1)
+		}
+		var valid bool
+		if verifyOpts.Detached != "" {
+			valid, err = verifyDetached(verifier, verifyOpts.Detached)
+		} else {
+			valid, err = verifyStream(verifier, os.Stdin, verifyOpts.Signature)
+		}
+		if err != nil || !valid {
+			fmt.Println("invalid")
+			os.Exit(1)
+		}
+		fmt.Println("valid")
+	case "check":
+		r := loadStreamReader(streamOpts{Location: checkOpts.Location, Crypter: checkOpts.Crypter, Password: checkOpts.Password})
+		failed := false
+		for _, issue := range dkeyczar.ValidateKeyset(r) {
+			fmt.Println(issue)
+			if issue.Severity == dkeyczar.ISSUE_ERROR || checkOpts.Strict {
+				failed = true
+			}
+		}
+		if failed {
+			os.Exit(1)
+		}
+		fmt.Println("ok")
+	case "interop":
+		if interopOpts.Location == "" {
+			fmt.Println("missing required --location argument")
+			os.Exit(1)
+		}
+		if len(args) != 1 {
+			fmt.Println("must provide gen or check")
+			os.Exit(1)
+		}
+		switch args[0] {
+		case "gen":
+			if err := interop.Generate(interopOpts.Location, interopOpts.Case...); err != nil {
+				fmt.Println(err)
+				os.Exit(1)
+			}
+		case "check":
+			results, err := interop.Check(interopOpts.Location, interopOpts.Case...)
+			for _, r := range results {
+				fmt.Println(r)
+			}
+			if err != nil {
+				fmt.Println(err)
+				os.Exit(1)
+			}
+			if len(interop.Failed(results)) > 0 {
+				os.Exit(1)
+			}
+		default:
+			fmt.Println("must provide gen or check")
+			os.Exit(1)
+		}
 	case "usekey":
 		c := loadCrypter(useKeyOpts.Crypter)
 		r := loadReader(useKeyOpts.Location, c)
@@ -220,7 +545,7 @@ func main() {
 				fmt.Println("must provide date")
 			}
 			t, _ := time.Parse(time.RFC3339, args[1])
-			ticks := t.Unix() * 1000
+			ticks := dkeyczar.ExpirationMillis(t)
 			signer, _ := dkeyczar.NewSigner(r)
 			output, _ = signer.TimeoutSign(input, ticks)
 		case "sign-unversioned":
@@ -238,7 +563,7 @@ func main() {
 			if err != nil {
 				fmt.Println(err)
 			}
-			var se dkeyczar.Crypter
+			var se dkeyczar.EncryptStreamer
 			se, output, err = dkeyczar.NewSessionEncrypter(e)
 			if err != nil {
 				fmt.Println(err)
@@ -287,6 +612,176 @@ func main() {
 	}
 }
 
+// return the reader for the encrypt, decrypt, sign and verify commands
+// Errors go to stderr, as stdout carries the output.
+func loadStreamReader(opts streamOpts) dkeyczar.KeyReader {
+	if opts.Location == "" {
+		fmt.Fprintln(os.Stderr, "missing required --location argument")
+		os.Exit(1)
+	}
+	lr := dkeyczar.NewFileReader(opts.Location)
+	switch {
+	case opts.Crypter != "":
+		crypter, err := dkeyczar.NewCrypter(dkeyczar.NewFileReader(opts.Crypter))
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "failed to load crypter:", err)
+			os.Exit(1)
+		}
+		lr = dkeyczar.NewEncryptedReader(lr, crypter)
+	case opts.Password != "":
+		lr = dkeyczar.NewPBEReader(lr, []byte(opts.Password))
+	}
+	return lr
+}
+
+// sign the file at path, writing the signature file next to it
+func signDetached(signer dkeyczar.Signer, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	sig, err := os.OpenFile(path+".sig", os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	if err := dkeyczar.WriteDetachedSignature(signer, f, sig); err != nil {
+		sig.Close()
+		return err
+	}
+	return sig.Close()
+}
+
+// encrypt everything read from in to out with the key set in r,
+// streaming if the key type allows it, otherwise in one go
+func encryptStream(r dkeyczar.KeyReader, encoding dkeyczar.Encoding, in io.Reader, out io.Writer) error {
+	if es, err := dkeyczar.NewEncryptStreamer(r, dkeyczar.WithEncoding(encoding)); err == nil {
+		w, err := es.EncryptWriter(out)
+		if err != nil {
+			return err
+		}
+		if _, err := io.Copy(w, in); err != nil {
+			w.Close()
+			return err
+		}
+		// writes the last block and the hmac
+		return w.Close()
+	}
+	e, err := dkeyczar.NewEncrypter(r, dkeyczar.WithEncoding(encoding))
+	if err != nil {
+		return err
+	}
+	input, err := ioutil.ReadAll(in)
+	if err != nil {
+		return err
+	}
+	output, err := e.Encrypt(input)
+	if err != nil {
+		return err
+	}
+	_, err = io.WriteString(out, output)
+	return err
+}
+
+// decrypt everything read from in to out with the key set in r.  Nothing is
+// written to out unless the whole ciphertext is authenticated.
+func decryptStream(r dkeyczar.KeyReader, encoding dkeyczar.Encoding, in io.Reader, out io.Writer) error {
+	input, err := ioutil.ReadAll(in)
+	if err != nil {
+		return err
+	}
+	if encoding != dkeyczar.NO_ENCODING {
+		input = bytes.TrimSpace(input)
+	}
+	var plaintext []byte
+	if cs, cerr := dkeyczar.NewCryptStreamer(r, dkeyczar.WithEncoding(encoding)); cerr == nil {
+		pr, _, err := cs.DecryptReader(bytes.NewReader(input), 0)
+		if err != nil {
+			return err
+		}
+		var buf bytes.Buffer
+		_, err = io.Copy(&buf, pr)
+		// the hmac is checked on close
+		if cerr := pr.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			return err
+		}
+		plaintext = buf.Bytes()
+	} else {
+		c, err := dkeyczar.NewCrypter(r, dkeyczar.WithEncoding(encoding))
+		if err != nil {
+			return err
+		}
+		if plaintext, err = c.Decrypt(string(input)); err != nil {
+			return err
+		}
+	}
+	_, err = out.Write(plaintext)
+	return err
+}
+
+// sign everything read from in, hashing it as it comes unless the key needs the whole message
+func signStream(signer dkeyczar.Signer, in io.Reader) (string, error) {
+	// ErrCannotStream is returned before anything is read
+	var output string
+	err := dkeyczar.ErrCannotStream
+	if ss, ok := signer.(dkeyczar.StreamSigner); ok {
+		output, err = ss.SignReader(in)
+	}
+	if err == dkeyczar.ErrCannotStream {
+		input, err := ioutil.ReadAll(in)
+		if err != nil {
+			return "", err
+		}
+		return signer.Sign(input)
+	}
+	return output, err
+}
+
+// verify the signature of everything read from in, hashing it as it comes unless the key needs the whole message
+func verifyStream(verifier dkeyczar.Verifier, in io.Reader, signature string) (bool, error) {
+	valid := false
+	err := dkeyczar.ErrCannotStream
+	if sv, ok := verifier.(dkeyczar.StreamVerifier); ok {
+		valid, err = sv.VerifyReader(in, signature)
+	}
+	if err == dkeyczar.ErrCannotStream {
+		input, err := ioutil.ReadAll(in)
+		if err != nil {
+			return false, err
+		}
+		return verifier.Verify(input, signature)
+	}
+	return valid, err
+}
+
+// verify the file at path against the signature file next to it
+func verifyDetached(verifier dkeyczar.Verifier, path string) (bool, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+	sig, err := os.Open(path + ".sig")
+	if err != nil {
+		return false, err
+	}
+	defer sig.Close()
+	return dkeyczar.VerifyDetachedSignature(verifier, f, sig)
+}
+
+func streamEncoding(opts streamOpts) dkeyczar.Encoding {
+	switch {
+	case opts.Binary:
+		return dkeyczar.NO_ENCODING
+	case opts.Hex:
+		return dkeyczar.HEX
+	}
+	return dkeyczar.BASE64W
+}
+
 func loadReader(optLocation string, crypter dkeyczar.Crypter) dkeyczar.KeyReader {
 	if optLocation == "" {
 		fmt.Println("missing required --location argument")
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/dgryski/dkeyczar"
+)
+
+// a KeyReader for the output of KeyManager.ToJSONs
+type jsonsReader []string
+
+func (r jsonsReader) GetMetadata() (string, error) {
+	return r[0], nil
+}
+
+func (r jsonsReader) GetKey(version int) (string, error) {
+	if version <= 0 || version >= len(r) {
+		return "", dkeyczar.ErrNoSuchKeyVersion
+	}
+	return r[version], nil
+}
+
+// the key set of km as KeyManager.ToJSONs returns it, for keys that can't fail to encrypt
+func mustJSONs(km dkeyczar.KeyManager, encrypter dkeyczar.Encrypter) []string {
+	jsons, err := km.ToJSONs(encrypter)
+	if err != nil {
+		panic(err)
+	}
+	return jsons
+}
+
+func newKeySet(t *testing.T, purpose dkeyczar.KeyPurpose, keyType dkeyczar.KeyType) dkeyczar.KeyReader {
+	km := dkeyczar.NewKeyManager()
+	if err := km.Create("keyczart", purpose, keyType); err != nil {
+		t.Fatal(err)
+	}
+	if err := km.AddKey(0, dkeyczar.S_PRIMARY); err != nil {
+		t.Fatal(err)
+	}
+	return jsonsReader(mustJSONs(km, nil))
+}
+
+const message = "This is some test data"
+
+func TestEncryptDecryptStream(t *testing.T) {
+	for _, keyType := range []dkeyczar.KeyType{dkeyczar.T_AES, dkeyczar.T_CHACHA20_POLY1305} {
+		r := newKeySet(t, dkeyczar.P_DECRYPT_AND_ENCRYPT, keyType)
+		for _, encoding := range []dkeyczar.Encoding{dkeyczar.BASE64W, dkeyczar.NO_ENCODING} {
+			var ct bytes.Buffer
+			if err := encryptStream(r, encoding, strings.NewReader(message), &ct); err != nil {
+				t.Fatalf("%s: failed to encrypt: %v", keyType, err)
+			}
+			var pt bytes.Buffer
+			if err := decryptStream(r, encoding, bytes.NewReader(ct.Bytes()), &pt); err != nil || pt.String() != message {
+				t.Errorf("%s: roundtrip failed: %q %v", keyType, pt.String(), err)
+			}
+
+			// a tampered ciphertext fails, and nothing of it is written
+			b := append([]byte(nil), ct.Bytes()...)
+			b[len(b)/2] ^= 1
+			pt.Reset()
+			if err := decryptStream(r, encoding, bytes.NewReader(b), &pt); err == nil {
+				t.Errorf("%s: decrypted a tampered ciphertext", keyType)
+			}
+			if pt.Len() != 0 {
+				t.Errorf("%s: wrote %d bytes of a tampered ciphertext", keyType, pt.Len())
+			}
+		}
+	}
+
+	r := newKeySet(t, dkeyczar.P_DECRYPT_AND_ENCRYPT, dkeyczar.T_AES)
+	var pt bytes.Buffer
+	if err := decryptStream(r, dkeyczar.BASE64W, strings.NewReader("garbage"), &pt); err == nil || pt.Len() != 0 {
+		t.Errorf("decrypted garbage: %q %v", pt.String(), err)
+	}
+}
+
+func TestSignVerifyStream(t *testing.T) {
+	for _, keyType := range []dkeyczar.KeyType{dkeyczar.T_HMAC_SHA1, dkeyczar.T_ED25519_PRIV} {
+		signer, err := dkeyczar.NewSigner(newKeySet(t, dkeyczar.P_SIGN_AND_VERIFY, keyType))
+		if err != nil {
+			t.Fatal(err)
+		}
+		sig, err := signStream(signer, strings.NewReader(message))
+		if err != nil {
+			t.Fatalf("%s: failed to sign: %v", keyType, err)
+		}
+		if valid, err := verifyStream(signer, strings.NewReader(message), sig); !valid || err != nil {
+			t.Errorf("%s: failed to verify: %v", keyType, err)
+		}
+		if valid, _ := verifyStream(signer, strings.NewReader(message+"!"), sig); valid {
+			t.Errorf("%s: verified a tampered message", keyType)
+		}
+	}
+}
@@ -5,10 +5,13 @@ There are two main types in use: fooKey and fooKeyJSON
 The fooKeyJSON match the on-disk representation of stored keys.  The fooKey
 store just the key material.  There are routines for converting back and forth
 between these two types.
-There are types for AES+HMAC, HMAC, RSA and RSA Public, DSA and DSA Public.
+There are types for AES+HMAC, HMAC, RSA and RSA Public, DSA and DSA Public, EC and EC Public,
+Ed25519 and Ed25519 Public, X25519 and X25519 Public, ChaCha20-Poly1305.
 */
 import (
+	"crypto/rand"
 	"encoding/json"
+	"hash"
 	"io"
 )
 type keydata interface {
@@ -21,6 +24,27 @@ type encryptKey interface {
 	Encrypt(b []byte) ([]byte, error)
 }
 
+// a key that can encrypt into a caller supplied buffer
+type appendEncryptKey interface {
+	appendEncrypt(dst []byte, data []byte) ([]byte, error)
+}
+
+// a key whose ciphertexts carry a random IV or nonce, which must never repeat
+type ivKey interface {
+	// return the IV of a ciphertext made by the key
+	iv(ciphertext []byte) []byte
+}
+
+// a key that can authenticate caller supplied associated data along with the plaintext.
+// Empty associated data must give the same ciphertexts as Encrypt and Decrypt.
+type aadEncryptKey interface {
+	encryptWithAAD(data []byte, aad []byte) ([]byte, error)
+}
+
+type aadDecryptKey interface {
+	decryptWithAAD(data []byte, aad []byte) ([]byte, error)
+}
+
 type streamEncryptKey interface {
 	EncryptWriter(io.Writer) (io.WriteCloser, error)
 }
@@ -35,6 +59,19 @@ type streamDecryptKey interface {
 	DecryptReader(io.Reader) (io.ReadCloser, error)
 }
 
+type deterministicKey interface {
+	keydata
+	EncryptDeterministically(data []byte, associatedData []byte) ([]byte, error)
+	DecryptDeterministically(data []byte, associatedData []byte) ([]byte, error)
+}
+
+// a symmetric key whose secret can feed a key derivation
+type secretKey interface {
+	keydata
+	// return a copy of the secret key material
+	secret() []byte
+}
+
 type verifyKey interface {
 	keydata
 	Verify(message []byte, signature []byte) (bool, error)
@@ -45,16 +82,49 @@ type signVerifyKey interface {
 	Sign(message []byte) ([]byte, error)
 }
 
-func generateKey(ktype keyType, size uint) (keydata, error) {
+// a key whose signatures are made over a hash of the message, so the message can be hashed as it streams past
+type digestVerifyKey interface {
+	verifyKey
+	// return the hash the signatures are made over, or nil if the key can't stream after all
+	newHash() hash.Hash
+	VerifyDigest(digest []byte, signature []byte) (bool, error)
+}
+
+type digestSignKey interface {
+	digestVerifyKey
+	SignDigest(digest []byte) ([]byte, error)
+}
+
+// generate a new key of ktype from rng, nil for crypto/rand
+func generateKey(ktype KeyType, size uint, rng io.Reader) (keydata, error) {
+	if rng == nil {
+		rng = rand.Reader
+	}
 	switch ktype {
 	case T_AES:
-		return generateAESKey(size)
+		return generateAESKey(size, rng)
 	case T_HMAC_SHA1:
-		return generateHMACKey()
+		return generateHMACKey(rng)
 	case T_DSA_PRIV:
-		return generateDSAKey(size)
+		return generateDSAKey(size, rng)
 	case T_RSA_PRIV:
-		return generateRSAKey(size)
+		return generateRSAKey(size, rng)
+	case T_EC_PRIV:
+		return generateECDSAKey(size, rng)
+	case T_ED25519_PRIV:
+		if size != 0 && !T_ED25519_PRIV.isAcceptableSize(size) {
+			return nil, ErrInvalidKeySize
+		}
+		return generateEd25519Key(rng)
+	case T_X25519_PRIV:
+		if size != 0 && !T_X25519_PRIV.isAcceptableSize(size) {
+			return nil, ErrInvalidKeySize
+		}
+		return generateX25519Key(rng)
+	case T_CHACHA20_POLY1305:
+		return generateChaChaKey(size, rng)
+	case T_AES_SIV:
+		return generateAESSIVKey(size, rng)
 	}
 	panic("not reached")
 }
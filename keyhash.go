@@ -0,0 +1,230 @@
+package dkeyczar
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/binary"
+	"math/big"
+)
+
+// Old Java keyczar releases hashed the numbers of RSA and DSA keys the way
+// BigInteger.toByteArray returns them, with the leading zero byte that keeps a
+// number with its top bit set positive.  The other implementations strip it,
+// so those keys have a second, legacy key hash in the headers Java made.
+type legacyKeyIDer interface {
+	legacyKeyID() []byte
+}
+
+// hash the numbers of a key as old Java keyczar did
+func legacyNumbersHash(numbers ...*big.Int) []byte {
+	h := sha1.New()
+	for _, n := range numbers {
+		b := n.Bytes()
+		if len(b) > 0 && b[0]&0x80 != 0 {
+			b = append([]byte{0}, b...)
+		}
+		binary.Write(h, binary.BigEndian, uint32(len(b)))
+		h.Write(b)
+	}
+	return h.Sum(nil)[:4]
+}
+
+func (rk *rsaPublicKey) legacyKeyID() []byte {
+	return legacyNumbersHash(rk.key.N, big.NewInt(int64(rk.key.E)))
+}
+
+func (rk *rsaKey) legacyKeyID() []byte {
+	return rk.publicKey.legacyKeyID()
+}
+
+func (dk *dsaPublicKey) legacyKeyID() []byte {
+	return legacyNumbersHash(dk.key.P, dk.key.Q, dk.key.G, dk.key.Y)
+}
+
+func (dk *dsaKey) legacyKeyID() []byte {
+	return dk.publicKey.legacyKeyID()
+}
+
+func (k *cryptoSignerKey) legacyKeyID() []byte {
+	if lk, ok := k.verifyKey.(legacyKeyIDer); ok {
+		return lk.legacyKeyID()
+	}
+	return nil
+}
+
+// KeyHashCompat selects the key hashes accepted besides the standard ones
+type KeyHashCompat int
+
+const (
+	KEYHASH_DEFAULT KeyHashCompat = iota // the standard key hashes, and the legacy Java ones
+	KEYHASH_CPP                          // also the key hashes of C++ keyczar
+)
+
+// C++ keyczar writes the numbers of RSA and DSA keys into buffers as wide as
+// the modulus (or p for DSA) before hashing them, so numbers shorter than that,
+// like the public exponent, keep their leading zero bytes.
+type cppKeyIDer interface {
+	cppKeyID() []byte
+}
+
+// hash the numbers of a key, each zero-padded to width bytes
+func paddedNumbersHash(width int, numbers ...*big.Int) []byte {
+	h := sha1.New()
+	for _, n := range numbers {
+		b := n.Bytes()
+		if len(b) < width {
+			b = append(make([]byte, width-len(b)), b...)
+		}
+		binary.Write(h, binary.BigEndian, uint32(len(b)))
+		h.Write(b)
+	}
+	return h.Sum(nil)[:4]
+}
+
+func (rk *rsaPublicKey) cppKeyID() []byte {
+	return paddedNumbersHash((rk.key.N.BitLen()+7)/8, rk.key.N, big.NewInt(int64(rk.key.E)))
+}
+
+func (rk *rsaKey) cppKeyID() []byte {
+	return rk.publicKey.cppKeyID()
+}
+
+func (dk *dsaPublicKey) cppKeyID() []byte {
+	return paddedNumbersHash((dk.key.P.BitLen()+7)/8, dk.key.P, dk.key.Q, dk.key.G, dk.key.Y)
+}
+
+func (dk *dsaKey) cppKeyID() []byte {
+	return dk.publicKey.cppKeyID()
+}
+
+func (k *cryptoSignerKey) cppKeyID() []byte {
+	if ck, ok := k.verifyKey.(cppKeyIDer); ok {
+		return ck.cppKeyID()
+	}
+	return nil
+}
+
+// return the keys whose C++ key hash is id
+func (kz *keyCzar) getKeyForCppID(id []byte) []keydata {
+	var kl []keydata
+	for _, k := range kz.allKeys() {
+		if ck, ok := k.(cppKeyIDer); ok && bytes.Equal(ck.cppKeyID(), id) {
+			kl = append(kl, k)
+		}
+	}
+	return kl
+}
+
+// the key hashes a key is looked up by: its own, and its legacy one if that differs
+func keyIDs(k keydata) []uint32 {
+	ids := []uint32{binary.BigEndian.Uint32(k.KeyID())}
+	if lk, ok := k.(legacyKeyIDer); ok {
+		if b := lk.legacyKeyID(); b != nil {
+			if id := binary.BigEndian.Uint32(b); id != ids[0] {
+				ids = append(ids, id)
+			}
+		}
+	}
+	return ids
+}
+
+// index k under all its key hashes.  Keys whose hashes collide share an entry and are all tried.
+func addKeyIDs(idkeys map[uint32][]keydata, k keydata) {
+	for _, id := range keyIDs(k) {
+		idkeys[id] = append(idkeys[id], k)
+	}
+}
+
+// KeyLookupController is implemented by the Crypters, Signers and Verifiers made from key sets
+type KeyLookupController interface {
+	// Try every key in the key set when the key hash in a ciphertext or signature header matches none of them.
+	// This copes with hashes computed differently by other implementations, at the cost of trying each key.
+	SetTryAllKeys(tryAll bool)
+	TryAllKeys() bool
+	// Set which key hashes computed by other implementations are accepted
+	SetKeyHashCompat(compat KeyHashCompat)
+	KeyHashCompat() KeyHashCompat
+}
+
+func (kz *keyCzar) setTryAllKeys(tryAll bool) {
+	kz.mu.Lock()
+	kz.tryAll = tryAll
+	kz.mu.Unlock()
+}
+
+func (kz *keyCzar) tryAllKeys() bool {
+	kz.mu.RLock()
+	defer kz.mu.RUnlock()
+	return kz.tryAll
+}
+
+func (kz *keyCzar) setKeyHashCompat(compat KeyHashCompat) {
+	kz.mu.Lock()
+	kz.hashCompat = compat
+	kz.mu.Unlock()
+}
+
+func (kz *keyCzar) keyHashCompat() KeyHashCompat {
+	kz.mu.RLock()
+	defer kz.mu.RUnlock()
+	return kz.hashCompat
+}
+
+// SetTryAllKeys sets whether the crypter tries every key for a ciphertext whose key hash matches none
+func (kc *keyCrypter) SetTryAllKeys(tryAll bool) {
+	kc.kz.setTryAllKeys(tryAll)
+}
+
+// TryAllKeys returns whether the crypter tries every key for a ciphertext whose key hash matches none
+func (kc *keyCrypter) TryAllKeys() bool {
+	return kc.kz.tryAllKeys()
+}
+
+// SetTryAllKeys sets whether the signer or verifier tries every key for a signature whose key hash matches none
+func (ks *keySigner) SetTryAllKeys(tryAll bool) {
+	ks.kz.setTryAllKeys(tryAll)
+}
+
+// TryAllKeys returns whether the signer or verifier tries every key for a signature whose key hash matches none
+func (ks *keySigner) TryAllKeys() bool {
+	return ks.kz.tryAllKeys()
+}
+
+// SetKeyHashCompat sets the key hashes of other implementations the crypter accepts
+func (kc *keyCrypter) SetKeyHashCompat(compat KeyHashCompat) {
+	kc.kz.setKeyHashCompat(compat)
+}
+
+// KeyHashCompat returns the key hashes of other implementations the crypter accepts
+func (kc *keyCrypter) KeyHashCompat() KeyHashCompat {
+	return kc.kz.keyHashCompat()
+}
+
+// SetKeyHashCompat sets the key hashes of other implementations the signer or verifier accepts
+func (ks *keySigner) SetKeyHashCompat(compat KeyHashCompat) {
+	ks.kz.setKeyHashCompat(compat)
+}
+
+// KeyHashCompat returns the key hashes of other implementations the signer or verifier accepts
+func (ks *keySigner) KeyHashCompat() KeyHashCompat {
+	return ks.kz.keyHashCompat()
+}
+
+// WithKeyHashCompat makes a Crypter, Signer or Verifier accept the key hashes of another implementation,
+// e.g. KEYHASH_CPP for ciphertexts and signatures made by C++ keyczar
+func WithKeyHashCompat(compat KeyHashCompat) Option {
+	return func(x interface{}) {
+		if lc, ok := x.(KeyLookupController); ok {
+			lc.SetKeyHashCompat(compat)
+		}
+	}
+}
+
+// WithTryAllKeys makes a Crypter, Signer or Verifier try every key when a key hash matches none
+func WithTryAllKeys() Option {
+	return func(x interface{}) {
+		if lc, ok := x.(KeyLookupController); ok {
+			lc.SetTryAllKeys(true)
+		}
+	}
+}
@@ -1,66 +1,109 @@
 package dkeyczar
-type keyType int
+
+import (
+	"encoding/json"
+)
+
+// KeyType is the type of the keys in a key set, as named in its metadata
+type KeyType int
 const (
-	T_AES keyType = iota
+	T_AES KeyType = iota
 	T_HMAC_SHA1
 	T_DSA_PRIV
 	T_DSA_PUB
 	T_RSA_PRIV
 	T_RSA_PUB
+	T_EC_PRIV
+	T_EC_PUB
+	T_ED25519_PRIV
+	T_ED25519_PUB
+	T_X25519_PRIV
+	T_X25519_PUB
+	T_CHACHA20_POLY1305
+	T_AES_SIV
 )
 // This struct copies the Java layout, but suffers from YAGNI
 // The sizing and output fields aren't really used (yet...)
-var keyTypeInfo = map[keyType]struct {
+var keyTypeInfo = map[KeyType]struct {
 	str     string
 	qstr    []byte
 	sizes   []uint
 	output  uint
 	outputs []uint
 }{
-	T_AES:       {"AES", []byte("\"AES\""), []uint{128, 192, 256}, 128, nil},
-	T_HMAC_SHA1: {"HMAC_SHA1", []byte("\"HMAC_SHA1\""), []uint{256}, 160, nil},
-	T_DSA_PRIV:  {"DSA_PRIV", []byte("\"DSA_PRIV\""), []uint{1024}, 384, nil},
-	T_DSA_PUB:   {"DSA_PUB", []byte("\"DSA_PUB\""), []uint{1024}, 384, nil},
-	T_RSA_PRIV:  {"RSA_PRIV", []byte("\"RSA_PRIV\""), []uint{4096, 2048, 1024}, 0, []uint{512, 256, 128}},
-	T_RSA_PUB:   {"RSA_PUB", []byte("\"RSA_PUB\""), []uint{4096, 2048, 1024}, 0, []uint{512, 256, 128}},
+	T_AES:               {"AES", []byte("\"AES\""), []uint{128, 192, 256}, 128, nil},
+	T_HMAC_SHA1:         {"HMAC_SHA1", []byte("\"HMAC_SHA1\""), []uint{256}, 160, nil},
+	T_DSA_PRIV:          {"DSA_PRIV", []byte("\"DSA_PRIV\""), []uint{1024}, 384, nil},
+	T_DSA_PUB:           {"DSA_PUB", []byte("\"DSA_PUB\""), []uint{1024}, 384, nil},
+	T_RSA_PRIV:          {"RSA_PRIV", []byte("\"RSA_PRIV\""), []uint{4096, 3072, 2048, 1024}, 0, []uint{512, 384, 256, 128}},
+	T_RSA_PUB:           {"RSA_PUB", []byte("\"RSA_PUB\""), []uint{4096, 3072, 2048, 1024}, 0, []uint{512, 384, 256, 128}},
+	T_EC_PRIV:           {"EC_PRIV", []byte("\"EC_PRIV\""), []uint{256, 384, 521}, 0, []uint{576, 832, 1112}},
+	T_EC_PUB:            {"EC_PUB", []byte("\"EC_PUB\""), []uint{256, 384, 521}, 0, []uint{576, 832, 1112}},
+	T_ED25519_PRIV:      {"ED25519_PRIV", []byte("\"ED25519_PRIV\""), []uint{256}, 512, nil},
+	T_ED25519_PUB:       {"ED25519_PUB", []byte("\"ED25519_PUB\""), []uint{256}, 512, nil},
+	T_X25519_PRIV:       {"X25519_PRIV", []byte("\"X25519_PRIV\""), []uint{256}, 384, nil},
+	T_X25519_PUB:        {"X25519_PUB", []byte("\"X25519_PUB\""), []uint{256}, 384, nil},
+	T_CHACHA20_POLY1305: {"CHACHA20_POLY1305", []byte("\"CHACHA20_POLY1305\""), []uint{256}, 224, nil},
+	T_AES_SIV:           {"AES_SIV", []byte("\"AES_SIV\""), []uint{512, 384, 256}, 128, nil},
 }
 
-func (k keyType) String() string {
+func (k KeyType) String() string {
 	ktinfo, ok := keyTypeInfo[k]
 	if !ok {
-		panic("unknown keytype in String()!")
+		return "(unknown KeyType)"
 	}
 	return ktinfo.str
 }
 
-var keyTypeLookup = map[string]keyType{
-	"AES":       T_AES,
-	"HMAC_SHA1": T_HMAC_SHA1,
-	"DSA_PRIV":  T_DSA_PRIV,
-	"DSA_PUB":   T_DSA_PUB,
-	"RSA_PRIV":  T_RSA_PRIV,
-	"RSA_PUB":   T_RSA_PUB,
+var keyTypeLookup = map[string]KeyType{
+	"AES":               T_AES,
+	"HMAC_SHA1":         T_HMAC_SHA1,
+	"DSA_PRIV":          T_DSA_PRIV,
+	"DSA_PUB":           T_DSA_PUB,
+	"RSA_PRIV":          T_RSA_PRIV,
+	"RSA_PUB":           T_RSA_PUB,
+	"EC_PRIV":           T_EC_PRIV,
+	"EC_PUB":            T_EC_PUB,
+	"ED25519_PRIV":      T_ED25519_PRIV,
+	"ED25519_PUB":       T_ED25519_PUB,
+	"X25519_PRIV":       T_X25519_PRIV,
+	"X25519_PUB":        T_X25519_PUB,
+	"CHACHA20_POLY1305": T_CHACHA20_POLY1305,
+	"AES_SIV":           T_AES_SIV,
 }
 
-func (k *keyType) UnmarshalJSON(b []byte) error {
+// ParseKeyType returns the key type named s, as in the metadata ("AES", "RSA_PRIV", ...)
+func ParseKeyType(s string) (KeyType, error) {
+	kt, ok := keyTypeLookup[s]
+	if !ok {
+		return 0, ErrUnsupportedType
+	}
+	return kt, nil
+}
+
+func (k *KeyType) UnmarshalJSON(b []byte) error {
+	if len(b) < 2 {
+		return ErrUnsupportedType
+	}
 	kt, ok := keyTypeLookup[string(b[1:len(b)-1])]
-	if ok {
-		*k = kt
+	if !ok {
+		return ErrUnsupportedType
 	}
+	*k = kt
 	return nil
 }
 
-func (k keyType) MarshalJSON() ([]byte, error) {
+func (k KeyType) MarshalJSON() ([]byte, error) {
 	ktinfo, _ := keyTypeInfo[k]
 	return ktinfo.qstr, nil
 }
 
-func (k keyType) defaultSize() uint {
+func (k KeyType) defaultSize() uint {
 	ktinfo, _ := keyTypeInfo[k]
 	return ktinfo.sizes[0]
 }
 
-func (k keyType) outputSize(size uint) uint {
+func (k KeyType) outputSize(size uint) uint {
 	ktinfo, _ := keyTypeInfo[k]
 	if ktinfo.output != 0 {
 		return ktinfo.output
@@ -74,7 +117,7 @@ func (k keyType) outputSize(size uint) uint {
 	return 0
 }
 
-func (k keyType) isAcceptableSize(size uint) bool {
+func (k KeyType) isAcceptableSize(size uint) bool {
 	ktinfo, _ := keyTypeInfo[k]
 	for _, sz := range ktinfo.sizes {
 		if sz == size {
@@ -84,13 +127,14 @@ func (k keyType) isAcceptableSize(size uint) bool {
 	return false
 }
 
-type keyStatus int
+// KeyStatus is the status of a key version: primary, active or inactive
+type KeyStatus int
 const (
-	S_PRIMARY keyStatus = iota
+	S_PRIMARY KeyStatus = iota
 	S_ACTIVE
 	S_INACTIVE
 )
-func (k keyStatus) String() string {
+func (k KeyStatus) String() string {
 	switch k {
 	case S_PRIMARY:
 		return "PRIMARY"
@@ -102,21 +146,35 @@ func (k keyStatus) String() string {
 	return "(unknown KeyStatus)"
 }
 
-var keyStatusLookup = map[string]keyStatus{
+var keyStatusLookup = map[string]KeyStatus{
 	"PRIMARY":  S_PRIMARY,
 	"ACTIVE":   S_ACTIVE,
 	"INACTIVE": S_INACTIVE,
 }
 
-func (k *keyStatus) UnmarshalJSON(b []byte) error {
+// ParseKeyStatus returns the key status named s, as in the metadata ("PRIMARY", "ACTIVE" or "INACTIVE")
+func ParseKeyStatus(s string) (KeyStatus, error) {
+	ks, ok := keyStatusLookup[s]
+	if !ok {
+		return 0, ErrInvalidKeyStatus
+	}
+	return ks, nil
+}
+
+func (k *KeyStatus) UnmarshalJSON(b []byte) error {
+	if len(b) < 2 {
+		return ErrInvalidKeyStatus
+	}
+	// an unknown status must not silently become S_PRIMARY
 	ks, ok := keyStatusLookup[string(b[1:len(b)-1])]
-	if ok {
-		*k = ks
+	if !ok {
+		return ErrInvalidKeyStatus
 	}
+	*k = ks
 	return nil
 }
 
-func (k keyStatus) MarshalJSON() ([]byte, error) {
+func (k KeyStatus) MarshalJSON() ([]byte, error) {
 	switch k {
 	case S_PRIMARY:
 		return []byte("\"PRIMARY\""), nil
@@ -128,15 +186,16 @@ func (k keyStatus) MarshalJSON() ([]byte, error) {
 	return []byte("\"(unknown KeyStatus)\""), nil
 }
 
-type keyPurpose int
+// KeyPurpose is what the keys of a key set may be used for
+type KeyPurpose int
 const (
-	P_DECRYPT_AND_ENCRYPT keyPurpose = iota
+	P_DECRYPT_AND_ENCRYPT KeyPurpose = iota
 	P_ENCRYPT
 	P_SIGN_AND_VERIFY
 	P_VERIFY
 	P_TEST
 )
-func (k keyPurpose) String() string {
+func (k KeyPurpose) String() string {
 	switch k {
 	case P_DECRYPT_AND_ENCRYPT:
 		return "DECRYPT_AND_ENCRYPT"
@@ -149,10 +208,10 @@ func (k keyPurpose) String() string {
 	case P_TEST:
 		return "TEST"
 	}
-	return "(unknown keyPurpose)"
+	return "(unknown KeyPurpose)"
 }
 
-var keyPurposeLookup = map[string]keyPurpose{
+var keyPurposeLookup = map[string]KeyPurpose{
 	"DECRYPT_AND_ENCRYPT": P_DECRYPT_AND_ENCRYPT,
 	"ENCRYPT":             P_ENCRYPT,
 	"SIGN_AND_VERIFY":     P_SIGN_AND_VERIFY,
@@ -160,7 +219,16 @@ var keyPurposeLookup = map[string]keyPurpose{
 	"TEST":                P_TEST,
 }
 
-func (k keyPurpose) isAcceptablePurpose(want keyPurpose) bool {
+// ParseKeyPurpose returns the key purpose named s, as in the metadata ("DECRYPT_AND_ENCRYPT", "SIGN_AND_VERIFY", ...)
+func ParseKeyPurpose(s string) (KeyPurpose, error) {
+	kp, ok := keyPurposeLookup[s]
+	if !ok {
+		return 0, ErrUnacceptablePurpose
+	}
+	return kp, nil
+}
+
+func (k KeyPurpose) isAcceptablePurpose(want KeyPurpose) bool {
 	switch want {
 	case P_ENCRYPT:
 		return k == P_DECRYPT_AND_ENCRYPT || k == P_ENCRYPT
@@ -171,18 +239,22 @@ func (k keyPurpose) isAcceptablePurpose(want keyPurpose) bool {
 	case P_SIGN_AND_VERIFY:
 		return k == P_SIGN_AND_VERIFY
 	}
-	panic("unknown purpose: " + string(want))
+	panic("unknown purpose: " + want.String())
 }
 
-func (k *keyPurpose) UnmarshalJSON(b []byte) error {
+func (k *KeyPurpose) UnmarshalJSON(b []byte) error {
+	if len(b) < 2 {
+		return ErrUnacceptablePurpose
+	}
 	kp, ok := keyPurposeLookup[string(b[1:len(b)-1])]
-	if ok {
-		*k = kp
+	if !ok {
+		return ErrUnacceptablePurpose
 	}
+	*k = kp
 	return nil
 }
 
-func (k keyPurpose) MarshalJSON() ([]byte, error) {
+func (k KeyPurpose) MarshalJSON() ([]byte, error) {
 	switch k {
 	case P_DECRYPT_AND_ENCRYPT:
 		return []byte("\"DECRYPT_AND_ENCRYPT\""), nil
@@ -195,21 +267,116 @@ func (k keyPurpose) MarshalJSON() ([]byte, error) {
 	case P_TEST:
 		return []byte("\"TEST\""), nil
 	}
-	return []byte("\"(unknown keyPurpose)\""), nil
+	return []byte("\"(unknown KeyPurpose)\""), nil
 }
 
-type keyMeta struct {
+// KeyMeta is the metadata of a key set
+type KeyMeta struct {
 	Name      string       `json:"name"`
-	Type      keyType      `json:"type"`
-	Purpose   keyPurpose   `json:"purpose"`
+	Type      KeyType      `json:"type"`
+	Purpose   KeyPurpose   `json:"purpose"`
 	Encrypted bool         `json:"encrypted"`
-	Versions  []keyVersion `json:"versions"`
+	Versions  []KeyVersion `json:"versions"`
 }
 
-type keyVersion struct {
+// KeyVersion is the metadata of one key version of a key set
+type KeyVersion struct {
 	VersionNumber int       `json:"versionNumber"`
-	Status        keyStatus `json:"status"`
+	Status        KeyStatus `json:"status"`
 	Exportable    bool      `json:"exportable"`
+	// when the version was added, in milliseconds since 1/1/1970 GMT, or 0 if unknown.
+	// Only this implementation writes it; the others ignore it.
+	Created int64 `json:"created,omitempty"`
+	// when the version was given its current status, in milliseconds since 1/1/1970 GMT,
+	// or 0 if unknown.  Only this implementation writes it; the others ignore it.
+	StatusChanged int64 `json:"statusChanged,omitempty"`
+	// the version only encrypts or signs from NotBefore until NotAfter, in milliseconds
+	// since 1/1/1970 GMT, 0 for no limit.  It still decrypts and verifies outside them.
+	// Only this implementation enforces them; the others ignore them.
+	NotBefore int64 `json:"notBefore,omitempty"`
+	NotAfter  int64 `json:"notAfter,omitempty"`
+}
+
+// check the version may encrypt or sign at time now, in milliseconds since 1/1/1970 GMT
+func (kv *KeyVersion) usableAt(now int64) error {
+	if kv.NotBefore != 0 && now < kv.NotBefore {
+		return ErrKeyNotYetValid
+	}
+	if kv.NotAfter != 0 && now >= kv.NotAfter {
+		return ErrKeyExpired
+	}
+	return nil
+}
+
+// GetKeyMeta reads and checks the metadata of the key set in reader, without loading any keys
+func GetKeyMeta(reader KeyReader) (*KeyMeta, error) {
+	s, err := reader.GetMetadata()
+	if err != nil {
+		return nil, err
+	}
+	km := new(KeyMeta)
+	if err := json.Unmarshal([]byte(s), km); err != nil {
+		return nil, err
+	}
+	if err := km.validate(); err != nil {
+		return nil, err
+	}
+	return km, nil
+}
+
+// return true if keys of this type encrypt deterministically, and so need a DeterministicCrypter
+func (k KeyType) isDeterministic() bool {
+	return k == T_AES_SIV
+}
+
+// return true if keys of this type can be used for the purpose
+func (k KeyType) isValidPurpose(purpose KeyPurpose) bool {
+	if purpose == P_TEST {
+		return true
+	}
+	switch k {
+	case T_AES, T_CHACHA20_POLY1305, T_X25519_PRIV, T_AES_SIV:
+		return purpose == P_DECRYPT_AND_ENCRYPT
+	case T_X25519_PUB:
+		return purpose == P_ENCRYPT
+	case T_HMAC_SHA1, T_DSA_PRIV, T_EC_PRIV, T_ED25519_PRIV:
+		return purpose == P_SIGN_AND_VERIFY
+	case T_DSA_PUB, T_EC_PUB, T_ED25519_PUB:
+		return purpose == P_VERIFY
+	case T_RSA_PRIV:
+		return purpose == P_DECRYPT_AND_ENCRYPT || purpose == P_SIGN_AND_VERIFY
+	case T_RSA_PUB:
+		return purpose == P_ENCRYPT || purpose == P_VERIFY
+	}
+	return false
+}
+
+// check the metadata is consistent before we load any keys
+func (km *KeyMeta) validate() error {
+	if !km.Type.isValidPurpose(km.Purpose) {
+		return ErrUnacceptablePurpose
+	}
+	seen := make(map[int]bool)
+	primaries := 0
+	for _, v := range km.Versions {
+		if v.VersionNumber < 0 {
+			return ErrInvalidKeyVersion
+		}
+		if seen[v.VersionNumber] {
+			return ErrDuplicateKeyVersion
+		}
+		seen[v.VersionNumber] = true
+		if v.NotBefore != 0 && v.NotAfter != 0 && v.NotAfter <= v.NotBefore {
+			return ErrInvalidKeyLifetime
+		}
+		if v.Status == S_PRIMARY {
+			primaries++
+		}
+	}
+	if primaries > 1 {
+		return ErrMultiplePrimaryKeys
+	}
+	return nil
 }
 
 type cipherMode int
@@ -263,3 +430,51 @@ func (c cipherMode) MarshalJSON() ([]byte, error) {
 	return []byte("\"(unknown CipherMode)\""), nil
 }
 
+
+// An RSASignatureScheme is how the keys of an RSA key set sign.  They always encrypt with OAEP.
+type RSASignatureScheme int
+
+const (
+	SIG_PKCS1 RSASignatureScheme = iota // RSASSA-PKCS1-v1_5 signatures (SHA-1) [default]
+	SIG_PSS                             // RSASSA-PSS signatures (SHA-256)
+)
+
+func (s RSASignatureScheme) String() string {
+	switch s {
+	case SIG_PKCS1:
+		return "PKCS1"
+	case SIG_PSS:
+		return "PSS"
+	}
+	return "(unknown RSASignatureScheme)"
+}
+
+// in JSON the signature scheme is PKCS#1 v1.5 unless set;
+// the encryption padding isn't stored, as only OAEP is supported
+var rsaSignatureSchemeLookup = map[string]RSASignatureScheme{
+	"PKCS1": SIG_PKCS1,
+	"PSS":   SIG_PSS,
+}
+
+func (s *RSASignatureScheme) UnmarshalJSON(b []byte) error {
+	var str string
+	if err := json.Unmarshal(b, &str); err != nil {
+		return err
+	}
+	rs, ok := rsaSignatureSchemeLookup[str]
+	if !ok {
+		return ErrUnknownSigScheme
+	}
+	*s = rs
+	return nil
+}
+
+func (s RSASignatureScheme) MarshalJSON() ([]byte, error) {
+	switch s {
+	case SIG_PKCS1:
+		return []byte("\"PKCS1\""), nil
+	case SIG_PSS:
+		return []byte("\"PSS\""), nil
+	}
+	return nil, ErrUnknownSigScheme
+}
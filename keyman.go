@@ -1,27 +1,161 @@
 package dkeyczar
 import (
 	"encoding/json"
+	"io"
+	"time"
 )
 // KeyManager handles all aspects of dealing with keyczar key files
 type KeyManager interface {
-	Create(name string, purpose keyPurpose, ktype keyType) error
+	Create(name string, purpose KeyPurpose, ktype KeyType) error
 	Load(reader KeyReader) error
-	AddKey(size uint, status keyStatus) error
+	AddKey(size uint, status KeyStatus) error
+	// ImportKey adds the primary key of reader, e.g. one from ImportPrivateKeyFromPEM, as a new version
+	// The key types must match; the purpose of the key set is kept.
+	ImportKey(reader KeyReader, status KeyStatus) error
+	// SetSignatureScheme selects how RSA keys created with AddKey or ImportKey sign
+	SetSignatureScheme(scheme RSASignatureScheme)
 	Promote(version int)
 	Demote(version int)
-	// Revoke
+	// Revoke removes an inactive key version from the key set
+	Revoke(version int) error
 	PubKeys() KeyManager
-	// Write
-	ToJSONs(encrypter Encrypter) []string
+	// ToJSONs returns the metadata and then each version of the key set, empty for revoked versions,
+	// with the keys encrypted by encrypter unless it is nil.  It fails if a key can't be encrypted.
+	ToJSONs(encrypter Encrypter) ([]string, error)
 }
 
 type keyManager struct {
-	kz *keyCzar
+	kz         *keyCzar
+	sigScheme  RSASignatureScheme // signature scheme of newly generated rsa keys
+	rsaSize    uint               // modulus size of rsa keys generated with AddKey(0, ...), 0 for the default
+	minRSASize uint               // smallest rsa modulus AddKey and ImportKey accept, 0 for no minimum
+	strict     bool               // refuse keys below strictMinKeySizes
+	rand       io.Reader          // random source for new keys, nil for crypto/rand
+}
+
+// the smallest key sizes a KeyManager with the strict key policy adds
+var strictMinKeySizes = map[KeyType]uint{
+	T_AES:      192,
+	T_RSA_PRIV: 2048,
+	T_RSA_PUB:  2048,
+}
+
+// RSAKeySizeController is implemented by the KeyManager to pick the size of its RSA keys
+type RSAKeySizeController interface {
+	// Set the modulus size in bits of RSA keys added with AddKey(0, ...), 0 for the default (4096)
+	SetRSAKeySize(size uint)
+	// Make AddKey and ImportKey refuse RSA keys smaller than size bits with ErrWeakKey, 0 for no minimum
+	SetMinRSAKeySize(size uint)
+}
+
+// KeyPolicyController is implemented by the KeyManager to enforce a key size policy
+type KeyPolicyController interface {
+	// With the strict policy AddKey and ImportKey refuse AES keys under 192 bits
+	// and RSA keys under 2048 bits with ErrWeakKey, and AES keys default to 256 bits.
+	SetStrictKeyPolicy(strict bool)
+	StrictKeyPolicy() bool
+}
+
+// KeyLifetimeController is implemented by the KeyManager to limit when key versions encrypt or sign
+type KeyLifetimeController interface {
+	// Set when a key version may encrypt or sign, a zero time for no limit.  Outside that
+	// it can still decrypt and verify.  Fails with ErrNoSuchKeyVersion or ErrInvalidKeyLifetime.
+	SetKeyLifetime(version int, notBefore, notAfter time.Time) error
+}
+
+// ConfirmExportable must be passed to MarkExportable, to show the caller means to let the private key leave the key set
+const ConfirmExportable = "allow private key export"
+
+// ExportableController is implemented by the KeyManager to control which key versions
+// ExportPrivateKeyPEM and ExportPrivateJWK will export
+type ExportableController interface {
+	// Mark a key version exportable; confirm must be ConfirmExportable.
+	// Fails with ErrNoSuchKeyVersion or ErrExportNotConfirmed.
+	MarkExportable(version int, confirm string) error
+	// Clear the exportable mark of a key version.  Fails with ErrNoSuchKeyVersion.
+	ClearExportable(version int) error
 }
 
 // NewKeyManager returns a new KeyManager
-func NewKeyManager() KeyManager {
-	return new(keyManager)
+func NewKeyManager(opts ...Option) KeyManager {
+	m := new(keyManager)
+	applyOptions(m, opts)
+	return m
+}
+
+func (m *keyManager) SetRSAKeySize(size uint) {
+	m.rsaSize = size
+}
+
+func (m *keyManager) SetMinRSAKeySize(size uint) {
+	m.minRSASize = size
+}
+
+func (m *keyManager) SetStrictKeyPolicy(strict bool) {
+	m.strict = strict
+}
+
+func (m *keyManager) StrictKeyPolicy() bool {
+	return m.strict
+}
+
+// WithStrictKeyPolicy makes a KeyManager refuse to add keys below the strict minimum sizes
+func WithStrictKeyPolicy() Option {
+	return func(x interface{}) {
+		if pc, ok := x.(KeyPolicyController); ok {
+			pc.SetStrictKeyPolicy(true)
+		}
+	}
+}
+
+// WithRSAKeySize sets the modulus size in bits (2048, 3072 or 4096) of the RSA keys a KeyManager generates
+func WithRSAKeySize(size uint) Option {
+	return func(x interface{}) {
+		if rc, ok := x.(RSAKeySizeController); ok {
+			rc.SetRSAKeySize(size)
+		}
+	}
+}
+
+// WithMinRSAKeySize makes a KeyManager refuse to add RSA keys smaller than size bits
+func WithMinRSAKeySize(size uint) Option {
+	return func(x interface{}) {
+		if rc, ok := x.(RSAKeySizeController); ok {
+			rc.SetMinRSAKeySize(size)
+		}
+	}
+}
+
+// the size of the keys of type ktype AddKey(0, ...) generates, or 0 to leave it to the key type
+func (m *keyManager) defaultSize(ktype KeyType) uint {
+	switch ktype {
+	case T_RSA_PRIV:
+		if m.rsaSize != 0 {
+			return m.rsaSize
+		}
+		return T_RSA_PRIV.defaultSize()
+	case T_AES:
+		if m.strict {
+			return 256
+		}
+		return T_AES.defaultSize()
+	}
+	return 0
+}
+
+// check a key of type ktype and size bits against the minimum key sizes
+func (m *keyManager) checkKeySize(ktype KeyType, size uint) error {
+	var min uint
+	if ktype == T_RSA_PRIV || ktype == T_RSA_PUB {
+		min = m.minRSASize
+	}
+	if m.strict && strictMinKeySizes[ktype] > min {
+		min = strictMinKeySizes[ktype]
+	}
+	if size < min {
+		return ErrWeakKey
+	}
+	return nil
 }
 
 func (m *keyManager) Load(reader KeyReader) error {
@@ -30,9 +164,9 @@ func (m *keyManager) Load(reader KeyReader) error {
 	return err
 }
 
-func (m *keyManager) Create(name string, purpose keyPurpose, ktype keyType) error {
+func (m *keyManager) Create(name string, purpose KeyPurpose, ktype KeyType) error {
 	m.kz = &keyCzar{
-		keymeta: keyMeta{name, ktype, purpose, false, nil},
+		keymeta: KeyMeta{name, ktype, purpose, false, nil},
 		keys:    make(map[int]keydata),
 		idkeys:  make(map[uint32][]keydata),
 		primary: -1}
@@ -42,25 +176,39 @@ func (m *keyManager) Create(name string, purpose keyPurpose, ktype keyType) erro
 	return nil
 }
 
-func (m *keyManager) ToJSONs(encrypter Encrypter) []string {
+func (m *keyManager) ToJSONs(encrypter Encrypter) ([]string, error) {
 	s := make([]string, 1)
 	if m.kz == nil {
 		s[0] = ""
-		return s
+		return s, nil
 	}
-	if encrypter != nil {
-		m.kz.keymeta.Encrypted = true
+	// the keys are written as the encrypter leaves them, even if they were read encrypted
+	m.kz.keymeta.Encrypted = encrypter != nil
+	b, err := json.Marshal(m.kz.keymeta)
+	if err != nil {
+		return nil, err
 	}
-	b, _ := json.Marshal(m.kz.keymeta)
 	s[0] = string(b)
 	if m.kz.keys != nil {
-		for i := 1; ; i++ {
+		maxVersion := 0
+		for _, v := range m.kz.keymeta.Versions {
+			if maxVersion < v.VersionNumber {
+				maxVersion = v.VersionNumber
+			}
+		}
+		for i := 1; i <= maxVersion; i++ {
 			k, ok := m.kz.keys[i]
 			if !ok {
-				break
+				// revoked versions leave a gap
+				s = append(s, "")
+				continue
 			}
 			if encrypter != nil {
-				ks, _ := encrypter.Encrypt(k.ToKeyJSON())
+				// an empty string would say the version was revoked
+				ks, err := encrypter.Encrypt(k.ToKeyJSON())
+				if err != nil {
+					return nil, err
+				}
 				s = append(s, ks)
 			} else {
 				b = k.ToKeyJSON()
@@ -68,14 +216,64 @@ func (m *keyManager) ToJSONs(encrypter Encrypter) []string {
 			}
 		}
 	}
-	return s
+	return s, nil
+}
+
+func (m *keyManager) AddKey(size uint, status KeyStatus) error {
+	if size == 0 {
+		size = m.defaultSize(m.kz.keymeta.Type)
+	}
+	// don't spend time generating a key we'd refuse
+	if err := m.checkKeySize(m.kz.keymeta.Type, size); err != nil {
+		return err
+	}
+	k, err := generateKey(m.kz.keymeta.Type, size, m.rand)
+	if err != nil {
+		return err
+	}
+	if rk, ok := k.(*rsaKey); ok {
+		rk.publicKey.scheme = m.sigScheme
+	}
+	m.addKey(k, status)
+	return nil
+}
+
+func (m *keyManager) ImportKey(reader KeyReader, status KeyStatus) error {
+	// there is no key material to store
+	if _, ok := reader.(opaqueKeyReader); ok {
+		return ErrOpaqueKey
+	}
+	kz, err := newKeyCzar(reader)
+	if err != nil {
+		return err
+	}
+	// the key material doesn't depend on the purpose, so only the type has to match
+	if kz.keymeta.Type != m.kz.keymeta.Type {
+		return ErrUnsupportedType
+	}
+	err = kz.loadPrimaryKey()
+	if err != nil {
+		return err
+	}
+	k := kz.getPrimaryKey()
+	if err := m.checkKeySize(kz.keymeta.Type, keySize(k)); err != nil {
+		return err
+	}
+	if rk, ok := k.(*rsaKey); ok {
+		rk.publicKey.scheme = m.sigScheme
+	}
+	m.addKey(k, status)
+	return nil
 }
 
-func (m *keyManager) AddKey(size uint, status keyStatus) error {
+// add k to the key set as a new version
+func (m *keyManager) addKey(k keydata, status KeyStatus) {
 	exportable := false
+	now := currentMillis()
 	// if we're adding a primary key, and we already have a primary key, then move the existing key to 'active'
 	if status == S_PRIMARY && m.kz.primary != -1 {
-		m.kz.keymeta.Versions[m.kz.primary-1].Status = S_ACTIVE
+		old := m.version(m.kz.primary)
+		old.Status, old.StatusChanged = S_ACTIVE, now
 	}
 	// find the version of the key we're going to add
 	maxVersion := 0
@@ -86,56 +284,139 @@ func (m *keyManager) AddKey(size uint, status keyStatus) error {
 	}
 	maxVersion++
 	// create our version entry and add it to the list of versions
-	kv := keyVersion{maxVersion, status, exportable}
+	kv := KeyVersion{VersionNumber: maxVersion, Status: status, Exportable: exportable, Created: now, StatusChanged: now}
 	if m.kz.keymeta.Versions == nil {
-		m.kz.keymeta.Versions = []keyVersion{kv}
+		m.kz.keymeta.Versions = []KeyVersion{kv}
 	} else {
 		m.kz.keymeta.Versions = append(m.kz.keymeta.Versions, kv)
 	}
-	k, err := generateKey(m.kz.keymeta.Type, size)
-	if err != nil {
-		return err
-	}
 	m.kz.keys[maxVersion] = k
+	if status == S_PRIMARY {
+		m.kz.primary = maxVersion
+	}
+}
+
+func (m *keyManager) SetKeyLifetime(version int, notBefore, notAfter time.Time) error {
+	kv := m.version(version)
+	if kv == nil {
+		return ErrNoSuchKeyVersion
+	}
+	var nb, na int64
+	if !notBefore.IsZero() {
+		nb = ExpirationMillis(notBefore)
+	}
+	if !notAfter.IsZero() {
+		na = ExpirationMillis(notAfter)
+	}
+	if nb != 0 && na != 0 && na <= nb {
+		return ErrInvalidKeyLifetime
+	}
+	kv.NotBefore, kv.NotAfter = nb, na
 	return nil
 }
 
+func (m *keyManager) MarkExportable(version int, confirm string) error {
+	kv := m.version(version)
+	if kv == nil {
+		return ErrNoSuchKeyVersion
+	}
+	if confirm != ConfirmExportable {
+		return ErrExportNotConfirmed
+	}
+	kv.Exportable = true
+	return nil
+}
+
+func (m *keyManager) ClearExportable(version int) error {
+	kv := m.version(version)
+	if kv == nil {
+		return ErrNoSuchKeyVersion
+	}
+	kv.Exportable = false
+	return nil
+}
+
+// return the metadata for a key version, or nil if there is no such version
+func (m *keyManager) version(version int) *KeyVersion {
+	for i := range m.kz.keymeta.Versions {
+		if m.kz.keymeta.Versions[i].VersionNumber == version {
+			return &m.kz.keymeta.Versions[i]
+		}
+	}
+	return nil
+}
+
+func (m *keyManager) SetSignatureScheme(scheme RSASignatureScheme) {
+	m.sigScheme = scheme
+}
+
 func (m *keyManager) Promote(version int) {
-	// check if version exists
-	// check if version is active
-	switch m.kz.keymeta.Versions[version-1].Status {
+	kv := m.version(version)
+	if kv == nil {
+		return
+	}
+	now := currentMillis()
+	switch kv.Status {
 	case S_ACTIVE:
-		m.kz.keymeta.Versions[version-1].Status = S_PRIMARY
 		if m.kz.primary != -1 {
 			// demote current primary key
-			m.kz.keymeta.Versions[m.kz.primary-1].Status = S_ACTIVE
+			old := m.version(m.kz.primary)
+			old.Status = S_ACTIVE
+			old.StatusChanged = now
 		}
+		kv.Status = S_PRIMARY
+		kv.StatusChanged = now
 		m.kz.primary = version
 	case S_PRIMARY:
 		// can't promote primary key
 	case S_INACTIVE:
-		m.kz.keymeta.Versions[version-1].Status = S_ACTIVE
+		kv.Status = S_ACTIVE
+		kv.StatusChanged = now
 	}
 }
 
 func (m *keyManager) Demote(version int) {
-	// check if version exists
-	switch m.kz.keymeta.Versions[version-1].Status {
+	kv := m.version(version)
+	if kv == nil {
+		return
+	}
+	switch kv.Status {
 	case S_ACTIVE:
-		m.kz.keymeta.Versions[version-1].Status = S_INACTIVE
+		kv.Status = S_INACTIVE
 	case S_PRIMARY:
-		m.kz.keymeta.Versions[version-1].Status = S_ACTIVE
+		kv.Status = S_ACTIVE
 		m.kz.primary = -1
 	case S_INACTIVE:
 		// can't demote invalid key, only revoke
 		return
 	}
+	kv.StatusChanged = currentMillis()
+}
+
+func (m *keyManager) Revoke(version int) error {
+	kv := m.version(version)
+	if kv == nil {
+		return ErrNoSuchKeyVersion
+	}
+	// as in keyczart, keys must be demoted to inactive first
+	if kv.Status != S_INACTIVE {
+		return ErrKeyNotInactive
+	}
+	versions := m.kz.keymeta.Versions[:0]
+	for _, v := range m.kz.keymeta.Versions {
+		if v.VersionNumber != version {
+			versions = append(versions, v)
+		}
+	}
+	m.kz.keymeta.Versions = versions
+	delete(m.kz.keys, version)
+	return nil
 }
 
 func (m *keyManager) PubKeys() KeyManager {
 	km := new(keyManager)
-	var kt keyType
-	var kp keyPurpose
+	var kt KeyType
+	var kp KeyPurpose
 	switch {
 	case m.kz.keymeta.Type == T_DSA_PRIV && m.kz.keymeta.Purpose == P_SIGN_AND_VERIFY:
 		kt, kp = T_DSA_PUB, P_VERIFY
@@ -143,11 +424,17 @@ func (m *keyManager) PubKeys() KeyManager {
 		kt, kp = T_RSA_PUB, P_VERIFY
 	case m.kz.keymeta.Type == T_RSA_PRIV && m.kz.keymeta.Purpose == P_DECRYPT_AND_ENCRYPT:
 		kt, kp = T_RSA_PUB, P_ENCRYPT
+	case m.kz.keymeta.Type == T_EC_PRIV && m.kz.keymeta.Purpose == P_SIGN_AND_VERIFY:
+		kt, kp = T_EC_PUB, P_VERIFY
+	case m.kz.keymeta.Type == T_ED25519_PRIV && m.kz.keymeta.Purpose == P_SIGN_AND_VERIFY:
+		kt, kp = T_ED25519_PUB, P_VERIFY
+	case m.kz.keymeta.Type == T_X25519_PRIV && m.kz.keymeta.Purpose == P_DECRYPT_AND_ENCRYPT:
+		kt, kp = T_X25519_PUB, P_ENCRYPT
 	default:
 		return nil // unknown types
 	}
-	km.kz = &keyCzar{keyMeta{m.kz.keymeta.Name, kt, kp, false, nil}, nil, nil, -1}
-	km.kz.keymeta.Versions = make([]keyVersion, len(m.kz.keymeta.Versions))
+	km.kz = &keyCzar{keymeta: KeyMeta{m.kz.keymeta.Name, kt, kp, false, nil}, primary: -1}
+	km.kz.keymeta.Versions = make([]KeyVersion, len(m.kz.keymeta.Versions))
 	for i, v := range m.kz.keymeta.Versions {
 		km.kz.keymeta.Versions[i] = v
 	}
@@ -159,6 +446,12 @@ func (m *keyManager) PubKeys() KeyManager {
 			km.kz.keys[version] = &k.publicKey
 		case *rsaKey:
 			km.kz.keys[version] = &k.publicKey
+		case *ecdsaKey:
+			km.kz.keys[version] = &k.publicKey
+		case *ed25519Key:
+			km.kz.keys[version] = &k.publicKey
+		case *x25519Key:
+			km.kz.keys[version] = &k.publicKey
 		}
 	}
 	return km
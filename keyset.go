@@ -0,0 +1,74 @@
+package dkeyczar
+
+import (
+	"errors"
+	"sort"
+)
+
+// Keyset describes a key set without exposing its key material, e.g. for an inventory of the keys in use
+type Keyset struct {
+	Name      string
+	Type      KeyType
+	Purpose   KeyPurpose
+	Encrypted bool      // the keys are stored encrypted
+	Primary   int       // the version of the primary key, or -1 if there is none
+	Keys      []KeyInfo // one for each version, in version order
+}
+
+// LoadKeysetInfo reads the key set in reader and describes it.
+// The keys of an encrypted key set are only hashed and sized if reader
+// decrypts them, as one from NewEncryptedReader does; otherwise their
+// KeyHash is nil and their Size 0.  The keys read are wiped before returning.
+func LoadKeysetInfo(reader KeyReader) (*Keyset, error) {
+	meta, err := GetKeyMeta(reader)
+	if err != nil {
+		return nil, err
+	}
+	f := keyFromJSONFunc(meta.Type)
+	if f == nil {
+		return nil, ErrUnsupportedType
+	}
+	ks := &Keyset{
+		Name:      meta.Name,
+		Type:      meta.Type,
+		Purpose:   meta.Purpose,
+		Encrypted: meta.Encrypted,
+		Primary:   -1,
+	}
+	for _, kv := range meta.Versions {
+		info := KeyInfo{Version: kv.VersionNumber, Status: kv.Status, Exportable: kv.Exportable}
+		if kv.Status == S_PRIMARY {
+			ks.Primary = kv.VersionNumber
+		}
+		k, err := readKeyVersion(reader, kv.VersionNumber, f)
+		// the keys of an encrypted key set may still be ciphertext, but they must be there
+		var notFound *KeyNotFoundError
+		if err != nil && (!meta.Encrypted || errors.As(err, &notFound)) {
+			return nil, err
+		}
+		if err == nil {
+			info.KeyHash = append([]byte(nil), k.KeyID()...)
+			info.Size = keySize(k)
+			wipeKeydata(k)
+		}
+		ks.Keys = append(ks.Keys, info)
+	}
+	sort.Slice(ks.Keys, func(i, j int) bool { return ks.Keys[i].Version < ks.Keys[j].Version })
+	return ks, nil
+}
+
+// read and parse one key version
+func readKeyVersion(r KeyReader, version int, keyFromJSON func([]byte) (keydata, error)) (keydata, error) {
+	if or, ok := r.(opaqueKeyReader); ok {
+		k, err := or.opaqueKey(version)
+		if err != nil {
+			return nil, &KeyNotFoundError{Version: version, Err: err}
+		}
+		return k, nil
+	}
+	s, err := r.GetKey(version)
+	if err != nil {
+		return nil, &KeyNotFoundError{Version: version, Err: err}
+	}
+	return keyFromJSON([]byte(s))
+}
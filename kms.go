@@ -0,0 +1,175 @@
+package dkeyczar
+
+import (
+	"context"
+	"strings"
+)
+
+// An ExternalCrypter encrypts and decrypts small blobs with a key held outside
+// the process, such as a cloud KMS or HSM master key.  NewExternalCrypter turns
+// it into a Crypter, for NewEncryptedReader, KeyManager.ToJSONs or as the key
+// encryption key of EnvelopeEncrypt.
+type ExternalCrypter interface {
+	// Encrypt encrypts plaintext with the external key
+	Encrypt(ctx context.Context, plaintext []byte) ([]byte, error)
+	// Decrypt decrypts a ciphertext returned by Encrypt
+	Decrypt(ctx context.Context, ciphertext []byte) ([]byte, error)
+}
+
+type externalCrypter struct {
+	ext ExternalCrypter
+	encodingController
+	compressionController
+}
+
+// NewExternalCrypter returns a Crypter encrypting with ext.  Services limit the size
+// of what they encrypt, so large key sets are better wrapped with EnvelopeEncrypt.
+// With the default BASE64W encoding, Decrypt also accepts standard base64 and
+// surrounding whitespace, as written by most command line tools.
+func NewExternalCrypter(ext ExternalCrypter) Crypter {
+	return &externalCrypter{ext: ext}
+}
+
+func (c *externalCrypter) Encrypt(plaintext []byte) (string, error) {
+	return c.encryptContext(context.Background(), plaintext)
+}
+
+func (c *externalCrypter) encryptContext(ctx context.Context, plaintext []byte) (string, error) {
+	b, err := c.ext.Encrypt(ctx, c.compress(plaintext))
+	if err != nil {
+		return "", err
+	}
+	return c.encode(b), nil
+}
+
+func (c *externalCrypter) Decrypt(ciphertext string) ([]byte, error) {
+	return c.decryptContext(context.Background(), ciphertext)
+}
+
+// the external call honours ctx, so readers using this crypter can give up in time
+func (c *externalCrypter) decryptContext(ctx context.Context, ciphertext string) ([]byte, error) {
+	if c.encoding != NO_ENCODING {
+		ciphertext = strings.TrimSpace(ciphertext)
+	}
+	if c.encoding == BASE64W {
+		ciphertext = strings.NewReplacer("+", "-", "/", "_", "=", "").Replace(ciphertext)
+	}
+	b, err := c.decode(ciphertext)
+	if err != nil {
+		return nil, ErrBase64Decoding
+	}
+	p, err := c.ext.Decrypt(ctx, b)
+	if err != nil {
+		return nil, err
+	}
+	return c.decompress(p)
+}
+
+// The adapters below take the few calls they need as interfaces, which keeps
+// this package free of any cloud SDK.  Wrapping an SDK client takes a few lines.
+
+// KMSClient is the part of AWS KMS needed to encrypt and decrypt key sets.
+// With the AWS SDK for Go v2 an adapter looks like:
+//
+//	type awsKMS struct{ c *kms.Client }
+//
+//	func (a awsKMS) Encrypt(ctx context.Context, keyID string, plaintext []byte, ec map[string]string) ([]byte, error) {
+//		out, err := a.c.Encrypt(ctx, &kms.EncryptInput{KeyId: &keyID, Plaintext: plaintext, EncryptionContext: ec})
+//		if err != nil {
+//			return nil, err
+//		}
+//		return out.CiphertextBlob, nil
+//	}
+//
+//	func (a awsKMS) Decrypt(ctx context.Context, ciphertext []byte, ec map[string]string) ([]byte, error) {
+//		out, err := a.c.Decrypt(ctx, &kms.DecryptInput{CiphertextBlob: ciphertext, EncryptionContext: ec})
+//		if err != nil {
+//			return nil, err
+//		}
+//		return out.Plaintext, nil
+//	}
+type KMSClient interface {
+	// Encrypt encrypts plaintext under the master key keyID
+	Encrypt(ctx context.Context, keyID string, plaintext []byte, encryptionContext map[string]string) ([]byte, error)
+	// Decrypt decrypts a ciphertext returned by Encrypt.  The ciphertext identifies the master key.
+	Decrypt(ctx context.Context, ciphertext []byte, encryptionContext map[string]string) ([]byte, error)
+}
+
+type awsKMS struct {
+	client            KMSClient
+	keyID             string
+	encryptionContext map[string]string
+}
+
+func (a *awsKMS) Encrypt(ctx context.Context, plaintext []byte) ([]byte, error) {
+	return a.client.Encrypt(ctx, a.keyID, plaintext, a.encryptionContext)
+}
+
+func (a *awsKMS) Decrypt(ctx context.Context, ciphertext []byte) ([]byte, error) {
+	return a.client.Decrypt(ctx, ciphertext, a.encryptionContext)
+}
+
+// NewKMSCrypter returns a Crypter that encrypts and decrypts with the AWS KMS master key keyID.
+// encryptionContext may be nil.  Key files written by
+// `aws kms encrypt --output text --query CiphertextBlob` can be read as they are.
+func NewKMSCrypter(client KMSClient, keyID string, encryptionContext map[string]string) Crypter {
+	return NewExternalCrypter(&awsKMS{client, keyID, encryptionContext})
+}
+
+// GCPKMSClient is the part of Google Cloud KMS needed to encrypt and decrypt key sets.
+// The calls map onto EncryptRequest and DecryptRequest of the cloud.google.com/go/kms client,
+// with name being the full resource name of the CryptoKey.
+type GCPKMSClient interface {
+	Encrypt(ctx context.Context, name string, plaintext []byte, additionalAuthenticatedData []byte) ([]byte, error)
+	Decrypt(ctx context.Context, name string, ciphertext []byte, additionalAuthenticatedData []byte) ([]byte, error)
+}
+
+type gcpKMS struct {
+	client GCPKMSClient
+	name   string
+	aad    []byte
+}
+
+func (g *gcpKMS) Encrypt(ctx context.Context, plaintext []byte) ([]byte, error) {
+	return g.client.Encrypt(ctx, g.name, plaintext, g.aad)
+}
+
+func (g *gcpKMS) Decrypt(ctx context.Context, ciphertext []byte) ([]byte, error) {
+	return g.client.Decrypt(ctx, g.name, ciphertext, g.aad)
+}
+
+// NewGCPKMSCrypter returns a Crypter that encrypts and decrypts with the Cloud KMS CryptoKey name,
+// e.g. "projects/p/locations/global/keyRings/r/cryptoKeys/k".  additionalAuthenticatedData may be nil.
+func NewGCPKMSCrypter(client GCPKMSClient, name string, additionalAuthenticatedData []byte) Crypter {
+	return NewExternalCrypter(&gcpKMS{client, name, additionalAuthenticatedData})
+}
+
+// AzureKeyVaultClient is the part of Azure Key Vault needed to encrypt and decrypt key sets.
+// The calls map onto WrapKey and UnwrapKey of the azkeys client, with algorithm
+// being a key vault algorithm name such as "RSA-OAEP-256".
+type AzureKeyVaultClient interface {
+	WrapKey(ctx context.Context, keyName string, KeyVersion string, algorithm string, key []byte) ([]byte, error)
+	UnwrapKey(ctx context.Context, keyName string, KeyVersion string, algorithm string, wrapped []byte) ([]byte, error)
+}
+
+type azureKeyVault struct {
+	client     AzureKeyVaultClient
+	keyName    string
+	KeyVersion string
+	algorithm  string
+}
+
+func (a *azureKeyVault) Encrypt(ctx context.Context, plaintext []byte) ([]byte, error) {
+	return a.client.WrapKey(ctx, a.keyName, a.KeyVersion, a.algorithm, plaintext)
+}
+
+func (a *azureKeyVault) Decrypt(ctx context.Context, ciphertext []byte) ([]byte, error) {
+	return a.client.UnwrapKey(ctx, a.keyName, a.KeyVersion, a.algorithm, ciphertext)
+}
+
+// NewAzureKeyVaultCrypter returns a Crypter that wraps and unwraps with the key vault key keyName.
+// An empty KeyVersion means the current version.  RSA wrapping only takes a couple of hundred bytes,
+// which fits symmetric key sets; use it as the key encryption key of EnvelopeEncrypt for anything larger.
+func NewAzureKeyVaultCrypter(client AzureKeyVaultClient, keyName string, KeyVersion string, algorithm string) Crypter {
+	return NewExternalCrypter(&azureKeyVault{client, keyName, KeyVersion, algorithm})
+}
@@ -0,0 +1,143 @@
+package dkeyczar
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// Lazy loading: the Crypters, Encrypters, Signers and Verifiers made from key
+// sets read the metadata and the primary key when they are made, and each
+// other key version the first time it is needed, so a key set with a long
+// history behind a slow reader is quick to load.  A ciphertext or signature
+// names its key by hash, which isn't known until the key is read, so the
+// first one whose hash matches no key read yet reads all the others; once they
+// are all read, an unknown hash reads nothing.  A version that fails to read is
+// read again when it is next needed, but no more than once every
+// minReloadInterval, so a stream of bogus key hashes can't hammer the KeyReader.
+
+// KeyLoadController is implemented by the Crypters, Encrypters, Signers and Verifiers made from key sets
+type KeyLoadController interface {
+	// PreloadKeys reads every key version not read yet, instead of on first use,
+	// failing with the error of the first one that can't be read
+	PreloadKeys() error
+}
+
+// WithPreloadedKeys makes a Crypter, Encrypter, Signer or Verifier read every key version when it is made,
+// failing if one can't be read, instead of reading those other than the primary key on first use
+func WithPreloadedKeys() Option {
+	return func(x interface{}) {
+		if lc, ok := x.(KeyLoadController); ok {
+			lc.PreloadKeys()
+		}
+	}
+}
+
+// the key versions of a key set not read yet
+type lazyKeys struct {
+	reader      KeyReader
+	keyFromJSON func([]byte) (keydata, error)
+	name        string // the name of the key set and whether the metadata says
+	encrypted   bool   // it is encrypted, for the error reading a version
+	versions    map[int]*lazyKey
+}
+
+// a key version read on first use; a read that fails is tried again once minReloadInterval has passed
+type lazyKey struct {
+	mu     sync.Mutex // held while reading, so concurrent uses read the version once
+	k      keydata    // nil until read
+	err    error      // the error of the last read, until it is tried again
+	failed time.Time  // when the last read failed
+}
+
+// read version of kz if it hasn't been read yet
+func (kz *keyCzar) loadVersion(version int) error {
+	kz.mu.RLock()
+	lazy := kz.lazy
+	var lk *lazyKey
+	if lazy != nil {
+		lk = lazy.versions[version]
+	}
+	kz.mu.RUnlock()
+	if lk == nil {
+		return nil
+	}
+	lk.mu.Lock()
+	if lk.k == nil {
+		if lk.err != nil && time.Since(lk.failed) < minReloadInterval {
+			err := lk.err
+			lk.mu.Unlock()
+			return err
+		}
+		k, err := readKeyVersion(lazy.reader, version, lazy.keyFromJSON)
+		if err != nil {
+			if !lazy.encrypted && decryptsKeys(lazy.reader) {
+				err = &KeysetEncryptionError{Name: lazy.name, Err: err}
+			}
+			lk.err, lk.failed = err, time.Now()
+			lk.mu.Unlock()
+			return err
+		}
+		lk.k, lk.err = k, nil
+	}
+	lk.mu.Unlock()
+	kz.mu.Lock()
+	// unless another call got there first, or the key set was reloaded or wiped meanwhile
+	if kz.lazy == lazy && lazy.versions[version] == lk {
+		delete(lazy.versions, version)
+		if rs, ok := lk.k.(randSetter); ok && kz.rand != nil {
+			rs.setRand(kz.rand)
+		}
+		kz.keys[version] = lk.k
+		addKeyIDs(kz.idkeys, lk.k)
+		kz.auditLoadVersion(version, lk.k)
+	}
+	kz.mu.Unlock()
+	return nil
+}
+
+// read every version of kz not read yet, returning the error of the first that can't be read
+func (kz *keyCzar) loadAllVersions() error {
+	kz.mu.RLock()
+	var versions []int
+	if kz.lazy != nil {
+		for v := range kz.lazy.versions {
+			versions = append(versions, v)
+		}
+	}
+	kz.mu.RUnlock()
+	sort.Ints(versions)
+	var first error
+	for _, v := range versions {
+		if err := kz.loadVersion(v); err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+// read every version of kz not read yet, remembering the error for the constructor to return
+func (kz *keyCzar) preload() error {
+	err := kz.loadAllVersions()
+	kz.mu.Lock()
+	kz.preloadErr = err
+	kz.mu.Unlock()
+	return err
+}
+
+// the error of the last preload, if any
+func (kz *keyCzar) preloadError() error {
+	kz.mu.RLock()
+	defer kz.mu.RUnlock()
+	return kz.preloadErr
+}
+
+// PreloadKeys reads the key versions not read yet
+func (kc *keyEncrypter) PreloadKeys() error {
+	return kc.kz.preload()
+}
+
+// PreloadKeys reads the key versions not read yet
+func (ks *keySigner) PreloadKeys() error {
+	return ks.kz.preload()
+}
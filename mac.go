@@ -0,0 +1,58 @@
+package dkeyczar
+
+import (
+	"crypto/rand"
+	"io"
+)
+
+// An HMACSigner is a Signer for HMAC key sets, for message authentication
+// between parties sharing the key set, such as request signing or webhooks.
+// MAC and VerifyMAC are SignReader and VerifyReader under the names MAC users expect.
+type HMACSigner interface {
+	Signer
+	// MAC returns the signature of everything read from r, the same as Sign of the whole stream
+	MAC(r io.Reader) (string, error)
+	// VerifyMAC checks a signature made by MAC or Sign against everything read from r
+	VerifyMAC(r io.Reader, signature string) (bool, error)
+}
+
+type keyHMACSigner struct {
+	*keySigner
+}
+
+// GenerateHMACKeySet returns a KeyReader for a new signing key set holding one fresh HMAC key as its primary version 1.
+// Save it with KeyManager.Load and ToJSONs, or use it directly for keys that only live in memory.
+func GenerateHMACKeySet(name string) KeyReader {
+	hk, err := generateHMACKey(rand.Reader)
+	if err != nil {
+		// there is no error to return it in, and crypto/rand failing leaves nothing safe to do
+		panic("keyczar: crypto/rand failed: " + err.Error())
+	}
+	defer wipeKeydata(hk)
+	r := new(importedKeySetReader)
+	kv := KeyVersion{VersionNumber: 1, Status: S_PRIMARY}
+	r.km = KeyMeta{name, T_HMAC_SHA1, P_SIGN_AND_VERIFY, false, []KeyVersion{kv}}
+	r.keys = map[int]string{1: string(hk.ToKeyJSON())}
+	return r
+}
+
+// NewHMACSigner returns an HMACSigner using the HMAC keys provided by the reader
+func NewHMACSigner(r KeyReader, opts ...Option) (HMACSigner, error) {
+	s, err := NewSigner(r, opts...)
+	if err != nil {
+		return nil, err
+	}
+	ks := s.(*keySigner)
+	if ks.kz.keymeta.Type != T_HMAC_SHA1 {
+		return nil, ErrUnsupportedType
+	}
+	return &keyHMACSigner{ks}, nil
+}
+
+func (ks *keyHMACSigner) MAC(r io.Reader) (string, error) {
+	return ks.SignReader(r)
+}
+
+func (ks *keyHMACSigner) VerifyMAC(r io.Reader, signature string) (bool, error) {
+	return ks.VerifyReader(r, signature)
+}
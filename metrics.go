@@ -0,0 +1,91 @@
+package dkeyczar
+
+import (
+	"time"
+)
+
+// Operation is the kind of work reported to a MetricsSink
+type Operation int
+
+const (
+	OP_ENCRYPT Operation = iota
+	OP_DECRYPT
+	OP_SIGN
+	OP_VERIFY
+)
+
+func (op Operation) String() string {
+	switch op {
+	case OP_ENCRYPT:
+		return "encrypt"
+	case OP_DECRYPT:
+		return "decrypt"
+	case OP_SIGN:
+		return "sign"
+	case OP_VERIFY:
+		return "verify"
+	}
+	return "unknown"
+}
+
+// A MetricsSink receives a report for every Encrypt, Decrypt, Sign and Verify
+// of a Crypter or Signer it is set on, e.g. to feed Prometheus counters and
+// histograms.  Observe is called from the goroutine doing the work, so it
+// should be quick, and safe for concurrent use.
+type MetricsSink interface {
+	// Observe reports one operation: the key version used, or -1 if no key
+	// was found; how long it took; and the error, or nil on success.
+	// A signature that doesn't verify is reported as ErrInvalidSignature.
+	Observe(op Operation, version int, elapsed time.Duration, err error)
+}
+
+type MetricsController interface {
+	// Set the sink receiving the metrics, nil for none
+	SetMetricsSink(sink MetricsSink)
+	// Return the sink receiving the metrics
+	MetricsSink() MetricsSink
+}
+
+type metricsController struct {
+	sink MetricsSink
+}
+
+// MetricsSink returns the sink receiving the metrics of the keyczar object, or nil
+func (mc metricsController) MetricsSink() MetricsSink {
+	return mc.sink
+}
+
+// SetMetricsSink sets the sink receiving the metrics of the keyczar object; nil turns them off.
+// Set it before sharing the object between goroutines.
+func (mc *metricsController) SetMetricsSink(sink MetricsSink) {
+	mc.sink = sink
+}
+
+// return the start time of an operation, or the zero time if nobody is listening
+func (mc metricsController) startTimer() time.Time {
+	if mc.sink == nil {
+		return time.Time{}
+	}
+	return time.Now()
+}
+
+// report an operation started at start, done with key k of kz (nil if none)
+func (mc metricsController) observe(op Operation, start time.Time, kz *keyCzar, k keydata, err error) {
+	if mc.sink == nil {
+		return
+	}
+	version := -1
+	if k != nil {
+		version = kz.keyInfo(k).Version
+	}
+	mc.sink.Observe(op, version, time.Since(start), err)
+}
+
+// WithMetrics sets the sink receiving the metrics of a Crypter, Encrypter, Signer or Verifier
+func WithMetrics(sink MetricsSink) Option {
+	return func(x interface{}) {
+		if mc, ok := x.(MetricsController); ok {
+			mc.SetMetricsSink(sink)
+		}
+	}
+}
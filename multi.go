@@ -0,0 +1,78 @@
+package dkeyczar
+
+import (
+	"strings"
+)
+
+// Multiple key sets can be combined into one Verifier or Crypter, for example
+// while migrating data from an old key set to a new one.  The key hash in the
+// header of a signature or ciphertext selects the key, whichever set it is in.
+
+// merge the key sets into one keyCzar.  The metadata (and so the primary key)
+// come from the first key set; the keys of the others are renumbered after it.
+func newMultiKeyCzar(readers []KeyReader, purpose KeyPurpose) (*keyCzar, error) {
+	if len(readers) == 0 {
+		return nil, ErrNoKeySets
+	}
+	var kz *keyCzar
+	var sources []string
+	next := 0
+	for _, r := range readers {
+		k, err := newKeyCzar(r)
+		if err != nil {
+			return nil, err
+		}
+		if !k.isAcceptablePurpose(purpose) {
+			return nil, ErrUnacceptablePurpose
+		}
+		sources = append(sources, k.source)
+		if kz == nil {
+			kz = k
+			for v := range kz.keys {
+				if v >= next {
+					next = v + 1
+				}
+			}
+			continue
+		}
+		for _, key := range k.keys {
+			kz.keys[next] = key
+			next++
+			addKeyIDs(kz.idkeys, key)
+		}
+	}
+	kz.source = strings.Join(sources, ",")
+	kz.load = func() (*keyCzar, error) { return newMultiKeyCzar(readers, purpose) }
+	return kz, nil
+}
+
+// NewMultiVerifier returns a Verifier that checks signatures made by any of the key sets provided by the readers
+func NewMultiVerifier(readers ...KeyReader) (Verifier, error) {
+	k := new(keySigner)
+	k.currentTime = currentMillis
+	var err error
+	k.kz, err = newMultiKeyCzar(readers, P_VERIFY)
+	if err != nil {
+		return nil, err
+	}
+	return k, nil
+}
+
+// NewMultiCrypter returns a Crypter that decrypts ciphertexts from any of the key sets provided by the readers
+// Encryption always uses the primary key of the first key set.
+func NewMultiCrypter(readers ...KeyReader) (Crypter, error) {
+	k := new(keyCrypter)
+	var err error
+	k.kz, err = newMultiKeyCzar(readers, P_DECRYPT_AND_ENCRYPT)
+	if err != nil {
+		return nil, err
+	}
+	if k.kz.keymeta.Type.isDeterministic() {
+		return nil, ErrDeterministicKey
+	}
+	err = k.kz.loadPrimaryKey()
+	if err != nil {
+		return nil, err
+	}
+	return k, nil
+}
@@ -0,0 +1,107 @@
+package dkeyczar
+
+// Length hiding: a Crypter or Encrypter with a padding scheme pads every
+// (compressed) plaintext before encrypting it, so the ciphertext length only
+// reveals which bucket the plaintext fell in.  The padding is a 0x80 byte
+// followed by zeros (ISO/IEC 7816-4), so it can always be stripped.  As with
+// compression, the ciphertext doesn't record it, so the decrypting side must
+// use the same setting.  Streams are not padded.
+
+// A PaddingScheme returns the length to pad n bytes to.  Lengths less than n are taken as n.
+type PaddingScheme func(n int) int
+
+// PadToPowerOfTwo pads to the next power of two, at least 16 bytes
+func PadToPowerOfTwo(n int) int {
+	size := 16
+	for size < n {
+		size *= 2
+	}
+	return size
+}
+
+// PadToMultiple returns a PaddingScheme padding to a multiple of blockSize bytes
+func PadToMultiple(blockSize int) PaddingScheme {
+	return func(n int) int {
+		if blockSize <= 0 {
+			return n
+		}
+		return (n + blockSize - 1) / blockSize * blockSize
+	}
+}
+
+// PadToBuckets returns a PaddingScheme padding to the smallest of the ascending sizes that fits,
+// and beyond the largest to a multiple of it
+func PadToBuckets(sizes ...int) PaddingScheme {
+	return func(n int) int {
+		for _, size := range sizes {
+			if n <= size {
+				return size
+			}
+		}
+		if len(sizes) == 0 {
+			return n
+		}
+		return PadToMultiple(sizes[len(sizes)-1])(n)
+	}
+}
+
+type PaddingController interface {
+	// Set the padding scheme, nil for none
+	SetPadding(scheme PaddingScheme)
+	// Return the padding scheme
+	Padding() PaddingScheme
+}
+
+type paddingController struct {
+	scheme PaddingScheme
+}
+
+// Padding returns the padding scheme of the keyczar object, or nil
+func (pc paddingController) Padding() PaddingScheme {
+	return pc.scheme
+}
+
+// SetPadding sets the padding scheme of the keyczar object; nil turns padding off
+func (pc *paddingController) SetPadding(scheme PaddingScheme) {
+	pc.scheme = scheme
+}
+
+// return 'data' padded based on the padding scheme, or 'data' itself if there is none
+func (pc paddingController) pad(data []byte) []byte {
+	if pc.scheme == nil {
+		return data
+	}
+	n := pc.scheme(len(data) + 1)
+	if n < len(data)+1 {
+		n = len(data) + 1
+	}
+	padded := make([]byte, n)
+	copy(padded, data)
+	padded[len(data)] = 0x80
+	return padded
+}
+
+// return 'data' with the padding stripped based on the padding scheme
+func (pc paddingController) unpad(data []byte) ([]byte, error) {
+	if pc.scheme == nil {
+		return data, nil
+	}
+	i := len(data) - 1
+	for i >= 0 && data[i] == 0 {
+		i--
+	}
+	if i < 0 || data[i] != 0x80 {
+		return nil, ErrBadCiphertextFormat
+	}
+	return data[:i], nil
+}
+
+// WithPadding sets the padding scheme of a Crypter or Encrypter, e.g. PadToPowerOfTwo.
+// The ciphertext doesn't record the padding, so the decrypting side must use the same setting.
+func WithPadding(scheme PaddingScheme) Option {
+	return func(x interface{}) {
+		if pc, ok := x.(PaddingController); ok {
+			pc.SetPadding(scheme)
+		}
+	}
+}
@@ -0,0 +1,360 @@
+package dkeyczar
+
+import (
+	"crypto/ed25519"
+	"crypto/hmac"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/blake2b"
+	"golang.org/x/crypto/chacha20"
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+// PASETO tokens (https://paseto.io) from keyczar key sets.  Local tokens are
+// encrypted with the 256-bit key of a CHACHA20_POLY1305 key set, public tokens
+// signed with an Ed25519 key set.  The footer is the JSON object
+//   {"kid":"<web-safe base64 keyczar key hash>"}
+// so the right key version is found after a rotation.  v4 tokens are made
+// without an implicit assertion.
+
+// The PASETO versions supported
+const (
+	PASETO_V2 = "v2"
+	PASETO_V4 = "v4"
+)
+
+type pasetoFooter struct {
+	Kid string `json:"kid"`
+}
+
+// pre-authentication encoding: the number of pieces, then each piece
+// preceded by its length, all as little-endian 64-bit integers
+func pasetoPAE(pieces ...[]byte) []byte {
+	buf := make([]byte, 8)
+	binary.LittleEndian.PutUint64(buf, uint64(len(pieces)))
+	for _, p := range pieces {
+		var l [8]byte
+		binary.LittleEndian.PutUint64(l[:], uint64(len(p)))
+		buf = append(buf, l[:]...)
+		buf = append(buf, p...)
+	}
+	return buf
+}
+
+func pasetoFooterForKey(k keydata) []byte {
+	f, _ := json.Marshal(pasetoFooter{encodeWeb64String(k.KeyID())})
+	return f
+}
+
+func pasetoToken(header string, payload, footer []byte) string {
+	token := header + encodeWeb64String(payload)
+	if len(footer) > 0 {
+		token += "." + encodeWeb64String(footer)
+	}
+	return token
+}
+
+// split a token into its header ("v4.local." etc.), payload and footer
+func pasetoParse(token string) (header string, payload, footer []byte, err error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 && len(parts) != 4 {
+		return "", nil, nil, ErrMalformedPASETO
+	}
+	header = parts[0] + "." + parts[1] + "."
+	if payload, err = pasetoDecode(parts[2]); err != nil {
+		return "", nil, nil, err
+	}
+	if len(parts) == 4 {
+		if footer, err = pasetoDecode(parts[3]); err != nil {
+			return "", nil, nil, err
+		}
+	}
+	return header, payload, footer, nil
+}
+
+// PASETO requires the unpadded base64 to be canonical
+func pasetoDecode(s string) ([]byte, error) {
+	b, err := decodeWeb64String(s)
+	if err != nil || encodeWeb64String(b) != s {
+		return nil, ErrBase64Decoding
+	}
+	return b, nil
+}
+
+// return the keys that may have made a token, using the kid of the footer if there is one.
+// Footers that aren't ours are allowed; they are authenticated along with the payload.
+func pasetoKeys(kz *keyCzar, footer []byte) ([]keydata, error) {
+	var f pasetoFooter
+	if len(footer) == 0 || json.Unmarshal(footer, &f) != nil || f.Kid == "" {
+		return kz.allKeys(), nil
+	}
+	id, err := decodeWeb64String(f.Kid)
+	if err != nil || len(id) != 4 {
+		return nil, ErrKeyNotFound
+	}
+	return kz.getKeyForID(id)
+}
+
+func pasetoClaims(m []byte, now time.Time) (map[string]interface{}, error) {
+	claims := make(map[string]interface{})
+	if err := json.Unmarshal(m, &claims); err != nil {
+		return nil, ErrMalformedPASETO
+	}
+	for _, name := range []string{"exp", "nbf"} {
+		v, ok := claims[name]
+		if !ok {
+			continue
+		}
+		s, _ := v.(string)
+		t, err := time.Parse(time.RFC3339, s)
+		if err != nil {
+			return nil, ErrMalformedPASETO
+		}
+		if name == "exp" && !now.Before(t) {
+			return nil, ErrPASETOExpired
+		}
+		if name == "nbf" && now.Before(t) {
+			return nil, ErrPASETONotYetValid
+		}
+	}
+	return claims, nil
+}
+
+func pasetoLocalKey(k keydata) []byte {
+	if ck, ok := k.(*chachaKey); ok && len(ck.key) == chacha20poly1305.KeySize {
+		return ck.key
+	}
+	return nil
+}
+
+// the v4 encryption key, counter nonce and authentication key for the random nonce n
+func pasetoV4Keys(key, n []byte) (ek, n2, ak []byte) {
+	h, _ := blake2b.New(56, key)
+	h.Write([]byte("paseto-encryption-key"))
+	h.Write(n)
+	tmp := h.Sum(nil)
+	h, _ = blake2b.New(32, key)
+	h.Write([]byte("paseto-auth-key-for-aead"))
+	h.Write(n)
+	return tmp[:32], tmp[32:], h.Sum(nil)
+}
+
+func pasetoV4Tag(ak []byte, header string, n, c, footer []byte) []byte {
+	h, _ := blake2b.New(32, ak)
+	h.Write(pasetoPAE([]byte(header), n, c, footer, nil))
+	return h.Sum(nil)
+}
+
+func pasetoEncrypt(header string, key []byte, rng io.Reader, m, footer []byte) ([]byte, error) {
+	switch header {
+	case "v2.local.":
+		// the nonce is derived from the message with a random key, so a bad random source doesn't repeat it
+		b := make([]byte, chacha20poly1305.NonceSizeX)
+		if _, err := io.ReadFull(rng, b); err != nil {
+			return nil, err
+		}
+		h, _ := blake2b.New(chacha20poly1305.NonceSizeX, b)
+		h.Write(m)
+		n := h.Sum(nil)
+		aead, err := chacha20poly1305.NewX(key)
+		if err != nil {
+			return nil, err
+		}
+		return aead.Seal(n, n, m, pasetoPAE([]byte(header), n, footer)), nil
+	case "v4.local.":
+		n := make([]byte, 32)
+		if _, err := io.ReadFull(rng, n); err != nil {
+			return nil, err
+		}
+		ek, n2, ak := pasetoV4Keys(key, n)
+		defer wipeBytes(ek)
+		c := make([]byte, len(m))
+		s, err := chacha20.NewUnauthenticatedCipher(ek, n2)
+		if err != nil {
+			return nil, err
+		}
+		s.XORKeyStream(c, m)
+		payload := append(append(n, c...), pasetoV4Tag(ak, header, n, c, footer)...)
+		wipeBytes(ak)
+		return payload, nil
+	}
+	return nil, ErrUnsupportedType
+}
+
+func pasetoDecrypt(header string, key, payload, footer []byte) ([]byte, error) {
+	switch header {
+	case "v2.local.":
+		if len(payload) < chacha20poly1305.NonceSizeX+chacha20poly1305.Overhead {
+			return nil, ErrInvalidSignature
+		}
+		aead, err := chacha20poly1305.NewX(key)
+		if err != nil {
+			return nil, err
+		}
+		n := payload[:chacha20poly1305.NonceSizeX]
+		m, err := aead.Open(nil, n, payload[len(n):], pasetoPAE([]byte(header), n, footer))
+		if err != nil {
+			return nil, ErrInvalidSignature
+		}
+		return m, nil
+	case "v4.local.":
+		if len(payload) < 64 {
+			return nil, ErrInvalidSignature
+		}
+		n, c, t := payload[:32], payload[32:len(payload)-32], payload[len(payload)-32:]
+		ek, n2, ak := pasetoV4Keys(key, n)
+		defer wipeBytes(ek)
+		valid := hmac.Equal(pasetoV4Tag(ak, header, n, c, footer), t)
+		wipeBytes(ak)
+		if !valid {
+			return nil, ErrInvalidSignature
+		}
+		m := make([]byte, len(c))
+		s, err := chacha20.NewUnauthenticatedCipher(ek, n2)
+		if err != nil {
+			return nil, err
+		}
+		s.XORKeyStream(m, c)
+		return m, nil
+	}
+	return nil, ErrUnsupportedType
+}
+
+// the message signed for a public token
+func pasetoSigningInput(header string, m, footer []byte) []byte {
+	if header == "v2.public." {
+		return pasetoPAE([]byte(header), m, footer)
+	}
+	return pasetoPAE([]byte(header), m, footer, nil)
+}
+
+// EncryptPASETO returns the claims as a local PASETO token of the given version, PASETO_V2 or PASETO_V4,
+// encrypted with the encrypter's primary key.
+// The encrypter must have been created by NewEncrypter or NewCrypter from a CHACHA20_POLY1305 key set.
+func EncryptPASETO(encrypter Encrypter, version string, claims map[string]interface{}) (string, error) {
+	kz := jweKeyCzar(encrypter)
+	if kz == nil || (version != PASETO_V2 && version != PASETO_V4) {
+		return "", ErrUnsupportedType
+	}
+	key, err := kz.primaryKey()
+	if err != nil {
+		return "", err
+	}
+	k := pasetoLocalKey(key)
+	if k == nil {
+		return "", ErrUnsupportedType
+	}
+	m, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	header := version + ".local."
+	footer := pasetoFooterForKey(key)
+	payload, err := pasetoEncrypt(header, k, kz.random(), m, footer)
+	if err != nil {
+		return "", err
+	}
+	return pasetoToken(header, payload, footer), nil
+}
+
+// DecryptPASETO returns the claims of a v2 or v4 local PASETO token.
+// The key is selected with the "kid" of the footer if present.  Tokens whose "exp" has passed
+// or whose "nbf" is in the future are rejected.
+func DecryptPASETO(crypter Crypter, token string) (map[string]interface{}, error) {
+	kc, ok := crypter.(*keyCrypter)
+	if !ok {
+		return nil, ErrUnsupportedType
+	}
+	header, payload, footer, err := pasetoParse(token)
+	if err != nil {
+		return nil, err
+	}
+	if header != "v2.local." && header != "v4.local." {
+		return nil, ErrUnsupportedType
+	}
+	kl, err := pasetoKeys(kc.kz, footer)
+	if err != nil {
+		return nil, err
+	}
+	for _, k := range kl {
+		key := pasetoLocalKey(k)
+		if key == nil {
+			continue
+		}
+		if m, err := pasetoDecrypt(header, key, payload, footer); err == nil {
+			return pasetoClaims(m, time.Now())
+		}
+	}
+	return nil, ErrInvalidSignature
+}
+
+// SignPASETO returns the claims as a public PASETO token of the given version, PASETO_V2 or PASETO_V4,
+// signed with the signer's primary key.
+// The signer must have been created by NewSigner from an Ed25519 key set.
+func SignPASETO(signer Signer, version string, claims map[string]interface{}) (string, error) {
+	ks, ok := signer.(*keySigner)
+	if !ok || (version != PASETO_V2 && version != PASETO_V4) {
+		return "", ErrUnsupportedType
+	}
+	key, err := ks.kz.primaryKey()
+	if err != nil {
+		return "", err
+	}
+	ek, ok := key.(*ed25519Key)
+	if !ok {
+		return "", ErrUnsupportedType
+	}
+	m, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	header := version + ".public."
+	footer := pasetoFooterForKey(key)
+	sig := ed25519.Sign(ek.key, pasetoSigningInput(header, m, footer))
+	return pasetoToken(header, append(m, sig...), footer), nil
+}
+
+// VerifyPASETO checks the signature of a v2 or v4 public PASETO token against the verifier's key set and returns its claims.
+// The key is selected with the "kid" of the footer if present.  Tokens whose "exp" has passed
+// or whose "nbf" is in the future are rejected.
+func VerifyPASETO(verifier Verifier, token string) (map[string]interface{}, error) {
+	ks, ok := verifier.(*keySigner)
+	if !ok {
+		return nil, ErrUnsupportedType
+	}
+	header, payload, footer, err := pasetoParse(token)
+	if err != nil {
+		return nil, err
+	}
+	if header != "v2.public." && header != "v4.public." {
+		return nil, ErrUnsupportedType
+	}
+	if len(payload) < ed25519.SignatureSize {
+		return nil, ErrInvalidSignature
+	}
+	m, sig := payload[:len(payload)-ed25519.SignatureSize], payload[len(payload)-ed25519.SignatureSize:]
+	kl, err := pasetoKeys(ks.kz, footer)
+	if err != nil {
+		return nil, err
+	}
+	input := pasetoSigningInput(header, m, footer)
+	for _, k := range kl {
+		var pub ed25519.PublicKey
+		switch k := k.(type) {
+		case *ed25519Key:
+			pub = k.publicKey.key
+		case *ed25519PublicKey:
+			pub = k.key
+		default:
+			continue
+		}
+		if ed25519.Verify(pub, input, sig) {
+			return pasetoClaims(m, time.UnixMilli(ks.currentTime()))
+		}
+	}
+	return nil, ErrInvalidSignature
+}
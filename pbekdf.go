@@ -0,0 +1,218 @@
+package dkeyczar
+
+import (
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/json"
+	"hash"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/pbkdf2"
+	"golang.org/x/crypto/scrypt"
+)
+
+// PBEKDF selects how a password is turned into the key protecting a PBE encrypted key.
+// Every setting can be read back by NewPBECrypter and NewPBEReader, since the PBE JSON records the parameters used.
+type PBEKDF int
+
+const (
+	PBE_PBKDF2_SHA1   PBEKDF = iota // PBKDF2-HMAC-SHA1 (4096 iterations) with AES-128 [default, readable by the other keyczar implementations]
+	PBE_PBKDF2_SHA256               // PBKDF2-HMAC-SHA256 (600000 iterations) with AES-256
+	PBE_SCRYPT                      // scrypt (N=32768, r=8, p=1) with AES-256
+	PBE_ARGON2ID                    // Argon2id (3 passes, 64MB, 4 threads) with AES-256
+)
+
+// limits on the parameters we accept when decrypting, so a hostile key file can't make us spin or allocate forever
+const (
+	maxScryptN       = 1 << 20
+	maxScryptR       = 32
+	maxScryptP       = 16
+	maxArgon2Time    = 64
+	maxArgon2Memory  = 1 << 21 // KB
+	maxArgon2Threads = 64
+)
+
+// DEFAULT_PBE_MIN_ITERATIONS is the lowest PBKDF2 iteration count accepted when decrypting, unless changed with WithPBEMinIterations.
+// It is the count the keyczar implementations write, so their key files still load.
+const DEFAULT_PBE_MIN_ITERATIONS = 4096
+
+// the settings below which GetPBEParams reports a key as weak
+const (
+	weakPBKDF2Iterations = 600000
+	weakScryptN          = 32768
+	weakArgon2Memory     = 19 * 1024 // KB
+)
+
+// NewPBECrypterWithKDF returns a Crypter for encrypting and decrypting password-based keys, encrypting with the given key derivation function.
+// Keys encrypted with anything but PBE_PBKDF2_SHA1 can't be read by the Java or Python keyczar.
+// Options other than WithPBEMinIterations are ignored.
+func NewPBECrypterWithKDF(password []byte, kdf PBEKDF, opts ...Option) Crypter {
+	return newPBECrypter(password, kdf, opts)
+}
+
+func newPBECrypter(password []byte, kdf PBEKDF, opts []Option) *pbeCrypter {
+	c := &pbeCrypter{password: append([]byte(nil), password...), kdf: kdf}
+	c.minIterations = DEFAULT_PBE_MIN_ITERATIONS
+	// the other controllers of a pbeCrypter are unset, so the options only get to see our own settings
+	applyOptions(&c.pbeController, opts)
+	return c
+}
+
+type PBEController interface {
+	// Set the lowest PBKDF2 iteration count accepted when decrypting, 0 to accept any
+	SetMinIterations(n int)
+	// Return the lowest PBKDF2 iteration count accepted when decrypting
+	MinIterations() int
+}
+
+type pbeController struct {
+	minIterations int
+}
+
+// MinIterations returns the lowest PBKDF2 iteration count the crypter decrypts with
+func (pc pbeController) MinIterations() int {
+	return pc.minIterations
+}
+
+// SetMinIterations sets the lowest PBKDF2 iteration count the crypter decrypts with.
+// Keys protected with fewer iterations fail with ErrWeakPBE; 0 turns the check off.
+func (pc *pbeController) SetMinIterations(n int) {
+	pc.minIterations = n
+}
+
+// WithPBEMinIterations sets the lowest PBKDF2 iteration count accepted by a PBE crypter or reader
+func WithPBEMinIterations(n int) Option {
+	return func(x interface{}) {
+		if pc, ok := x.(PBEController); ok {
+			pc.SetMinIterations(n)
+		}
+	}
+}
+
+// PBEParams describes how a password-based key is protected
+type PBEParams struct {
+	Cipher      string // AES128 or AES256
+	KDF         string // PBKDF2, SCRYPT or ARGON2ID
+	HMAC        string // the PBKDF2 prf, HMAC_SHA1 or HMAC_SHA256
+	Iterations  int    // PBKDF2 iterations, scrypt N or Argon2id passes
+	Memory      int    // scrypt r or Argon2id memory in KB
+	Parallelism int    // scrypt p or Argon2id threads
+}
+
+// GetPBEParams returns the protection parameters of a password-based key, as returned by the KeyReader wrapped with NewPBEReader.
+// The key isn't decrypted, so no password is needed.
+func GetPBEParams(key string) (PBEParams, error) {
+	var pbejson pbeKeyJSON
+	if err := json.Unmarshal([]byte(key), &pbejson); err != nil {
+		return PBEParams{}, ErrBadCiphertextFormat
+	}
+	p := PBEParams{
+		Cipher:      pbejson.Cipher,
+		KDF:         pbejson.KDF,
+		HMAC:        pbejson.HMAC,
+		Iterations:  pbejson.IterationCount,
+		Memory:      pbejson.Memory,
+		Parallelism: pbejson.Parallelism,
+	}
+	if p.KDF == "" {
+		p.KDF = "PBKDF2"
+	}
+	return p, nil
+}
+
+// Weak reports whether the parameters are below current recommendations, so a password guess is cheap.
+// Keys written by NewPBECrypter, and by the other keyczar implementations, are weak.
+func (p PBEParams) Weak() bool {
+	switch p.KDF {
+	case "SCRYPT":
+		return p.Iterations < weakScryptN
+	case "ARGON2ID":
+		return p.Memory < weakArgon2Memory
+	}
+	return p.Iterations < weakPBKDF2Iterations
+}
+
+// fill in the cipher and kdf parameters for a new pbe key
+func (kdf PBEKDF) setParams(pbejson *pbeKeyJSON) {
+	switch kdf {
+	case PBE_PBKDF2_SHA256:
+		pbejson.Cipher = "AES256"
+		pbejson.HMAC = "HMAC_SHA256"
+		pbejson.IterationCount = 600000
+	case PBE_SCRYPT:
+		pbejson.Cipher = "AES256"
+		pbejson.KDF = "SCRYPT"
+		pbejson.IterationCount = 32768
+		pbejson.Memory = 8
+		pbejson.Parallelism = 1
+	case PBE_ARGON2ID:
+		pbejson.Cipher = "AES256"
+		pbejson.KDF = "ARGON2ID"
+		pbejson.IterationCount = 3
+		pbejson.Memory = 64 * 1024
+		pbejson.Parallelism = 4
+	default:
+		pbejson.Cipher = "AES128"
+		pbejson.HMAC = "HMAC_SHA1"
+		pbejson.IterationCount = 4096
+	}
+}
+
+// check the cipher and kdf parameters of a pbe key and return the function deriving its key from the password and salt.
+// PBKDF2 keys with fewer than minIterations iterations are refused.
+func (pbejson *pbeKeyJSON) keyDerivation(minIterations int) (func(password, salt []byte) ([]byte, error), error) {
+	var keyLen int
+	switch pbejson.Cipher {
+	case "AES128":
+		keyLen = 128 / 8
+	case "AES256":
+		keyLen = 256 / 8
+	default:
+		return nil, ErrUnsupportedType
+	}
+
+	iter := pbejson.IterationCount
+	mem := pbejson.Memory
+	par := pbejson.Parallelism
+
+	switch pbejson.KDF {
+	case "", "PBKDF2":
+		var h func() hash.Hash
+		switch pbejson.HMAC {
+		case "HMAC_SHA1":
+			h = sha1.New
+		case "HMAC_SHA256":
+			h = sha256.New
+		default:
+			return nil, ErrUnsupportedType
+		}
+		if iter <= 0 {
+			return nil, ErrBadCiphertextFormat
+		}
+		if iter < minIterations {
+			return nil, ErrWeakPBE
+		}
+		return func(password, salt []byte) ([]byte, error) {
+			return pbkdf2.Key(password, salt, iter, keyLen, h), nil
+		}, nil
+
+	case "SCRYPT":
+		// N must be a power of two
+		if iter <= 1 || iter > maxScryptN || iter&(iter-1) != 0 || mem <= 0 || mem > maxScryptR || par <= 0 || par > maxScryptP {
+			return nil, ErrBadCiphertextFormat
+		}
+		return func(password, salt []byte) ([]byte, error) {
+			return scrypt.Key(password, salt, iter, mem, par, keyLen)
+		}, nil
+
+	case "ARGON2ID":
+		if iter <= 0 || iter > maxArgon2Time || par <= 0 || par > maxArgon2Threads || mem < 8*par || mem > maxArgon2Memory {
+			return nil, ErrBadCiphertextFormat
+		}
+		return func(password, salt []byte) ([]byte, error) {
+			return argon2.IDKey(password, salt, uint32(iter), uint32(mem), uint8(par), uint32(keyLen)), nil
+		}, nil
+	}
+
+	return nil, ErrUnsupportedType
+}
@@ -0,0 +1,54 @@
+package dkeyczar
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+
+	"golang.org/x/crypto/pkcs12"
+)
+
+// ImportFromPKCS12 returns a KeyReader for a key in the PKCS#12 (.p12 or .pfx) file specified in the location,
+// as ImportFromPKCS12Bytes does.
+func ImportFromPKCS12(location string, password []byte, purpose KeyPurpose) (KeyReader, error) {
+	buf, err := slurp(location)
+	if err != nil {
+		return nil, err
+	}
+	return ImportFromPKCS12Bytes([]byte(buf), password, purpose)
+}
+
+// ImportFromPKCS12Bytes returns a KeyReader for a key in the PKCS#12 (.p12 or .pfx) data, decrypted with password.
+// P_SIGN_AND_VERIFY and P_DECRYPT_AND_ENCRYPT import the private key, as ImportPrivateKeyFromPEMBytes does;
+// P_VERIFY and P_ENCRYPT import the public key of the first certificate, without checking its chain
+// (see ImportCertificateChainBytesForVerify to check it).  Only RSA and EC keys, and the legacy
+// 3DES and RC2 encryption, are supported; a wrong password fails with ErrPKCS12Decryption.
+func ImportFromPKCS12Bytes(pfxData []byte, password []byte, purpose KeyPurpose) (KeyReader, error) {
+	blocks, err := pkcs12.ToPEM(pfxData, string(password))
+	if err == pkcs12.ErrIncorrectPassword {
+		return nil, ErrPKCS12Decryption
+	}
+	if err != nil {
+		return nil, err
+	}
+	var pemBytes []byte
+	for _, block := range blocks {
+		// ToPEM labels keys "PRIVATE KEY", but they are PKCS#1 RSA or SEC 1 EC keys, not PKCS#8
+		if block.Type == "PRIVATE KEY" {
+			if _, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+				block.Type = "RSA PRIVATE KEY"
+			} else {
+				block.Type = "EC PRIVATE KEY"
+			}
+		}
+		pemBytes = append(pemBytes, pem.EncodeToMemory(block)...)
+	}
+	switch purpose {
+	case P_SIGN_AND_VERIFY, P_DECRYPT_AND_ENCRYPT:
+		return ImportPrivateKeyFromPEMBytes(pemBytes, nil, purpose)
+	case P_VERIFY:
+		return ImportCertificateChainBytesForVerify(pemBytes, nil)
+	case P_ENCRYPT:
+		return ImportRSAPublicKeyFromCertificateBytesForCrypt(pemBytes)
+	}
+	return nil, ErrUnacceptablePurpose
+}
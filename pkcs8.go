@@ -0,0 +1,184 @@
+package dkeyczar
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/des"
+	"crypto/ed25519"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/pem"
+	"hash"
+
+	"golang.org/x/crypto/pbkdf2"
+	"golang.org/x/crypto/ssh"
+)
+
+// Support for passphrase protected private keys: the traditional OpenSSL
+// "Proc-Type: 4,ENCRYPTED" PEM blocks and PKCS#8 "ENCRYPTED PRIVATE KEY"
+// blocks using PBES2 with PBKDF2 (RFC 8018).
+
+var (
+	oidPBES2          = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 5, 13}
+	oidPBKDF2         = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 5, 12}
+	oidHMACWithSHA1   = asn1.ObjectIdentifier{1, 2, 840, 113549, 2, 7}
+	oidHMACWithSHA256 = asn1.ObjectIdentifier{1, 2, 840, 113549, 2, 9}
+	oidHMACWithSHA512 = asn1.ObjectIdentifier{1, 2, 840, 113549, 2, 11}
+	oidAES128CBC      = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 2}
+	oidAES192CBC      = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 22}
+	oidAES256CBC      = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 42}
+	oidDESEDE3CBC     = asn1.ObjectIdentifier{1, 2, 840, 113549, 3, 7}
+)
+
+type encryptedPrivateKeyInfo struct {
+	Algo          pkix.AlgorithmIdentifier
+	EncryptedData []byte
+}
+
+type pbes2Params struct {
+	KeyDerivationFunc pkix.AlgorithmIdentifier
+	EncryptionScheme  pkix.AlgorithmIdentifier
+}
+
+type pbkdf2Params struct {
+	Salt           []byte
+	IterationCount int
+	KeyLength      int                      `asn1:"optional"`
+	PRF            pkix.AlgorithmIdentifier `asn1:"optional"`
+}
+
+// return the cipher constructor and key length for a PBES2 encryption scheme
+func pbes2Cipher(oid asn1.ObjectIdentifier) (func([]byte) (cipher.Block, error), int) {
+	switch {
+	case oid.Equal(oidAES128CBC):
+		return aes.NewCipher, 16
+	case oid.Equal(oidAES192CBC):
+		return aes.NewCipher, 24
+	case oid.Equal(oidAES256CBC):
+		return aes.NewCipher, 32
+	case oid.Equal(oidDESEDE3CBC):
+		return des.NewTripleDESCipher, 24
+	}
+	return nil, 0
+}
+
+func pbkdf2Hash(prf pkix.AlgorithmIdentifier) func() hash.Hash {
+	switch {
+	case len(prf.Algorithm) == 0 || prf.Algorithm.Equal(oidHMACWithSHA1):
+		return sha1.New
+	case prf.Algorithm.Equal(oidHMACWithSHA256):
+		return sha256.New
+	case prf.Algorithm.Equal(oidHMACWithSHA512):
+		return sha512.New
+	}
+	return nil
+}
+
+// decrypt a PKCS#8 EncryptedPrivateKeyInfo and return the inner PrivateKeyInfo
+func decryptPKCS8PrivateKey(der []byte, passphrase []byte) ([]byte, error) {
+	var info encryptedPrivateKeyInfo
+	if _, err := asn1.Unmarshal(der, &info); err != nil {
+		return nil, err
+	}
+	if !info.Algo.Algorithm.Equal(oidPBES2) {
+		return nil, ErrUnsupportedType
+	}
+	var params pbes2Params
+	if _, err := asn1.Unmarshal(info.Algo.Parameters.FullBytes, &params); err != nil {
+		return nil, err
+	}
+	if !params.KeyDerivationFunc.Algorithm.Equal(oidPBKDF2) {
+		return nil, ErrUnsupportedType
+	}
+	var kdf pbkdf2Params
+	if _, err := asn1.Unmarshal(params.KeyDerivationFunc.Parameters.FullBytes, &kdf); err != nil {
+		return nil, err
+	}
+	h := pbkdf2Hash(kdf.PRF)
+	newCipher, keyLen := pbes2Cipher(params.EncryptionScheme.Algorithm)
+	if h == nil || newCipher == nil {
+		return nil, ErrUnsupportedType
+	}
+	var iv []byte
+	if _, err := asn1.Unmarshal(params.EncryptionScheme.Parameters.FullBytes, &iv); err != nil {
+		return nil, err
+	}
+	block, err := newCipher(pbkdf2.Key(passphrase, kdf.Salt, kdf.IterationCount, keyLen, h))
+	if err != nil {
+		return nil, err
+	}
+	bs := block.BlockSize()
+	if len(iv) != bs || len(info.EncryptedData) == 0 || len(info.EncryptedData)%bs != 0 {
+		return nil, ErrPEMDecryption
+	}
+	plaintext := make([]byte, len(info.EncryptedData))
+	cipher.NewCBCDecrypter(block, iv).CryptBlocks(plaintext, info.EncryptedData)
+	// strip and check the PKCS#7 padding; a bad passphrase almost always fails here
+	pad := int(plaintext[len(plaintext)-1])
+	if pad == 0 || pad > bs {
+		return nil, ErrPEMDecryption
+	}
+	for _, b := range plaintext[len(plaintext)-pad:] {
+		if int(b) != pad {
+			return nil, ErrPEMDecryption
+		}
+	}
+	return plaintext[:len(plaintext)-pad], nil
+}
+
+// parse a possibly encrypted PEM private key block, returning an
+// *rsa.PrivateKey, *dsa.PrivateKey, *ecdsa.PrivateKey or ed25519.PrivateKey
+// parse an OpenSSH ("OPENSSH PRIVATE KEY") key, as written by ssh-keygen, decrypting it with passphrase if it's encrypted
+func parseOpenSSHPrivateKey(block *pem.Block, passphrase []byte) (interface{}, error) {
+	data := pem.EncodeToMemory(block)
+	priv, err := ssh.ParseRawPrivateKey(data)
+	if _, ok := err.(*ssh.PassphraseMissingError); ok && len(passphrase) != 0 {
+		priv, err = ssh.ParseRawPrivateKeyWithPassphrase(data, passphrase)
+	}
+	if _, ok := err.(*ssh.PassphraseMissingError); ok || err == x509.IncorrectPasswordError {
+		return nil, ErrPEMDecryption
+	}
+	if err != nil {
+		return nil, err
+	}
+	// the ssh package returns a pointer for ed25519 keys, unlike crypto/x509
+	if k, ok := priv.(*ed25519.PrivateKey); ok {
+		return *k, nil
+	}
+	return priv, nil
+}
+
+func parseEncryptedPEMPrivateKey(block *pem.Block, passphrase []byte) (interface{}, error) {
+	der := block.Bytes
+	switch {
+	case block.Type == "OPENSSH PRIVATE KEY":
+		return parseOpenSSHPrivateKey(block, passphrase)
+	case block.Type == "ENCRYPTED PRIVATE KEY":
+		var err error
+		if der, err = decryptPKCS8PrivateKey(block.Bytes, passphrase); err != nil {
+			return nil, err
+		}
+		return parsePKCS8PrivateKey(der)
+	case x509.IsEncryptedPEMBlock(block):
+		var err error
+		if der, err = x509.DecryptPEMBlock(block, passphrase); err != nil {
+			if err == x509.IncorrectPasswordError {
+				return nil, ErrPEMDecryption
+			}
+			return nil, err
+		}
+	}
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		return x509.ParsePKCS1PrivateKey(der)
+	case "EC PRIVATE KEY":
+		return x509.ParseECPrivateKey(der)
+	case "DSA PRIVATE KEY":
+		return parseDSAOpenSSLPrivateKey(der)
+	}
+	return parsePKCS8PrivateKey(der)
+}
@@ -0,0 +1,87 @@
+package dkeyczar
+
+import (
+	"crypto/rand"
+	"io"
+)
+
+// RandController is implemented by the Crypters, Encrypters, Signers and Verifiers
+// made from key sets, and by KeyManagers
+type RandController interface {
+	// Set the source of randomness for IVs, nonces, signatures and new keys, nil for crypto/rand.
+	// Set it before use, e.g. with WithRand: changing it isn't safe while other calls are running.
+	// Go's RSA, DSA and ECDSA code may mix in randomness of its own, so only
+	// IVs, nonces and symmetric keys are fully determined by it.
+	SetRand(rng io.Reader)
+}
+
+// embedded in the keys that need randomness after they are made
+type randSource struct {
+	rand io.Reader
+}
+
+func (r *randSource) random() io.Reader {
+	if r.rand != nil {
+		return r.rand
+	}
+	return rand.Reader
+}
+
+func (r *randSource) setRand(rng io.Reader) {
+	r.rand = rng
+}
+
+type randSetter interface {
+	setRand(rng io.Reader)
+}
+
+// give each of keys the random source rng
+func setKeysRand(keys map[int]keydata, rng io.Reader) {
+	for _, k := range keys {
+		if rs, ok := k.(randSetter); ok {
+			rs.setRand(rng)
+		}
+	}
+}
+
+func (kz *keyCzar) setRand(rng io.Reader) {
+	kz.mu.Lock()
+	kz.rand = rng
+	setKeysRand(kz.keys, rng)
+	kz.mu.Unlock()
+}
+
+// the random source for values made outside the keys, like nonces
+func (kz *keyCzar) random() io.Reader {
+	kz.mu.RLock()
+	defer kz.mu.RUnlock()
+	if kz.rand != nil {
+		return kz.rand
+	}
+	return rand.Reader
+}
+
+// SetRand sets the random source of the encrypter or crypter
+func (kc *keyEncrypter) SetRand(rng io.Reader) {
+	kc.kz.setRand(rng)
+}
+
+// SetRand sets the random source of the signer or verifier
+func (ks *keySigner) SetRand(rng io.Reader) {
+	ks.kz.setRand(rng)
+}
+
+// SetRand sets the random source new keys are generated from
+func (m *keyManager) SetRand(rng io.Reader) {
+	m.rand = rng
+}
+
+// WithRand makes a Crypter, Encrypter, Signer, Verifier or KeyManager use rng instead of crypto/rand,
+// e.g. a hardware RNG, or a fixed stream to produce test vectors
+func WithRand(rng io.Reader) Option {
+	return func(x interface{}) {
+		if rc, ok := x.(RandController); ok {
+			rc.SetRand(rng)
+		}
+	}
+}
@@ -0,0 +1,106 @@
+package dkeyczar
+
+import (
+	"crypto"
+	"crypto/rsa"
+)
+
+// The functions in this file work on the bare primitives, for systems that
+// don't understand keyczar framing: their output has no version byte, no key
+// hash and no trailing version byte on the signed data, so it can't be checked
+// with a Verifier, and a key set can't tell which of its keys made it.
+
+// load a key set for raw use and return its primary key
+func rawPrimaryKey(reader KeyReader, purpose KeyPurpose) (keydata, error) {
+	kz, err := newKeyCzar(reader)
+	if err != nil {
+		return nil, err
+	}
+	if !kz.isAcceptablePurpose(purpose) {
+		return nil, ErrUnacceptablePurpose
+	}
+	if err := kz.loadPrimaryKey(); err != nil {
+		return nil, err
+	}
+	return kz.primaryKey()
+}
+
+// hash message with h, which must be linked into the binary
+func rawDigest(h crypto.Hash, message []byte) ([]byte, error) {
+	if !h.Available() {
+		return nil, ErrUnsupportedType
+	}
+	d := h.New()
+	d.Write(message)
+	return d.Sum(nil), nil
+}
+
+// SignRawPKCS1 returns the unframed RSASSA-PKCS1-v1_5 signature of message,
+// hashed with h, made by the primary key of the RSA key set in reader.
+// The padding setting of the key set is ignored.
+func SignRawPKCS1(reader KeyReader, h crypto.Hash, message []byte) ([]byte, error) {
+	k, err := rawPrimaryKey(reader, P_SIGN_AND_VERIFY)
+	if err != nil {
+		return nil, err
+	}
+	digest, err := rawDigest(h, message)
+	if err != nil {
+		return nil, err
+	}
+	switch k := k.(type) {
+	case *rsaKey:
+		return rsa.SignPKCS1v15(k.random(), &k.key, h, digest)
+	case *cryptoSignerKey:
+		if _, ok := k.verifyKey.(*rsaPublicKey); ok {
+			return k.signer.Sign(k.random(), digest, h)
+		}
+	}
+	return nil, ErrUnsupportedType
+}
+
+// VerifyRawPKCS1 checks an unframed RSASSA-PKCS1-v1_5 signature of message,
+// hashed with h, against every key of the RSA key set in reader, private or public.
+func VerifyRawPKCS1(reader KeyReader, h crypto.Hash, message []byte, signature []byte) (bool, error) {
+	kz, err := newKeyCzar(reader)
+	if err != nil {
+		return false, err
+	}
+	if !kz.isAcceptablePurpose(P_VERIFY) {
+		return false, ErrUnacceptablePurpose
+	}
+	digest, err := rawDigest(h, message)
+	if err != nil {
+		return false, err
+	}
+	for _, k := range kz.allKeys() {
+		if ck, ok := k.(*cryptoSignerKey); ok {
+			k = ck.verifyKey
+		}
+		var pub *rsa.PublicKey
+		switch k := k.(type) {
+		case *rsaKey:
+			pub = &k.publicKey.key
+		case *rsaPublicKey:
+			pub = &k.key
+		default:
+			return false, ErrUnsupportedType
+		}
+		if rsa.VerifyPKCS1v15(pub, h, digest, signature) == nil {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// HMACRaw returns the unframed HMAC-SHA1 of message under the primary key of the HMAC key set in reader
+func HMACRaw(reader KeyReader, message []byte) ([]byte, error) {
+	k, err := rawPrimaryKey(reader, P_SIGN_AND_VERIFY)
+	if err != nil {
+		return nil, err
+	}
+	hk, ok := k.(*hmacKey)
+	if !ok {
+		return nil, ErrUnsupportedType
+	}
+	return hk.Sign(message)
+}
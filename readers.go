@@ -4,17 +4,21 @@ import (
 	"crypto/aes"
 	"crypto/cipher"
 	"crypto/dsa"
+	"crypto/ecdsa"
+	"crypto/ed25519"
 	"crypto/rand"
 	"crypto/rsa"
-	"crypto/sha1"
 	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
 	"encoding/json"
 	"encoding/pem"
 	"io"
 	"io/ioutil"
+	"math/big"
 	"os"
 	"strconv"
-	"golang.org/x/crypto/pbkdf2"
+	"golang.org/x/crypto/ssh"
 )
 // KeyReader provides an interface for returning information about a particular key.
 type KeyReader interface {
@@ -69,6 +73,27 @@ func NewEncryptedReader(reader KeyReader, crypter Crypter) KeyReader {
 	return r
 }
 
+// DecryptingKeyReader is implemented by the KeyReaders returning the keys of an encrypted key set
+// decrypted, as the ones from NewEncryptedReader and NewPBEReader do, and by readers wrapping them.
+// A key set whose metadata says it is encrypted only loads through one, and a plaintext one only
+// through a KeyReader that isn't one, or whose DecryptsKeys is false.
+type DecryptingKeyReader interface {
+	KeyReader
+	// DecryptsKeys reports whether GetKey decrypts the keys it reads
+	DecryptsKeys() bool
+}
+
+// report whether r decrypts the keys it reads
+func decryptsKeys(r KeyReader) bool {
+	dr, ok := r.(DecryptingKeyReader)
+	return ok && dr.DecryptsKeys()
+}
+
+// DecryptsKeys is true: the keys are decrypted with the crypter
+func (r *encryptedReader) DecryptsKeys() bool {
+	return true
+}
+
 // return the meta information from the wrapper reader.  Meta information is not encrypted.
 func (r *encryptedReader) GetMetadata() (string, error) {
 	return r.reader.GetMetadata()
@@ -88,62 +113,79 @@ func (r *encryptedReader) GetKey(version int) (string, error) {
 }
 
 // NewPBEReader returns a KeyReader which decrypts keys encrypted with password-based encryption
-func NewPBEReader(reader KeyReader, password []byte) KeyReader {
-	pbe := NewPBECrypter(password)
+// Options other than WithPBEMinIterations are ignored.
+func NewPBEReader(reader KeyReader, password []byte, opts ...Option) KeyReader {
+	pbe := NewPBECrypter(password, opts...)
 	return NewEncryptedReader(reader, pbe)
 }
 
 type pbeKeyJSON struct {
 	Cipher         string `json:"cipher"`
-	HMAC           string `json:"hmac"`
-	IterationCount int    `json:"iterationCount"`
+	HMAC           string `json:"hmac"`           // the PBKDF2 prf
+	IterationCount int    `json:"iterationCount"` // PBKDF2 iterations, scrypt N or Argon2id passes
 	Iv             string `json:"iv"`
 	Key            string `json:"key"`
 	Salt           string `json:"salt"`
+	KDF            string `json:"kdf,omitempty"`         // PBKDF2 if empty, SCRYPT or ARGON2ID
+	Memory         int    `json:"memory,omitempty"`      // scrypt r or Argon2id memory in KB
+	Parallelism    int    `json:"parallelism,omitempty"` // scrypt p or Argon2id threads
 }
 
 // NewPBECrypter returns a Crypter for encrypting and decrypting password-based keys
-func NewPBECrypter(password []byte) Crypter {
-	return &pbeCrypter{password: password}
+// It encrypts with PBKDF2-HMAC-SHA1 and AES-128 for compatibility; see NewPBECrypterWithKDF for stronger settings.
+// The password is copied, so Wipe doesn't clobber the caller's slice.
+// Options other than WithPBEMinIterations are ignored.
+func NewPBECrypter(password []byte, opts ...Option) Crypter {
+	return newPBECrypter(password, PBE_PBKDF2_SHA1, opts)
 }
 
 func NewPBEEncrypter(password []byte) Encrypter {
-	return &pbeCrypter{password: password}
+	return &pbeCrypter{password: append([]byte(nil), password...)}
 }
 
 // for writing pbe-json keys
 type pbeCrypter struct {
 	CompressionController
 	EncodingController
+	pbeController
 	password []byte // the password to use for the PBE
+	kdf      PBEKDF // the key derivation used when encrypting
 }
 
 func (c *pbeCrypter) Decrypt(message string) ([]byte, error) {
 	var pbejson pbeKeyJSON
 	err := json.Unmarshal([]byte(message), &pbejson)
 	if err != nil {
-		return nil, err
+		return nil, ErrBadCiphertextFormat
 	}
 	return c.decrypt(pbejson)
 }
 
 func (c *pbeCrypter) decrypt(pbejson pbeKeyJSON) ([]byte, error) {
-	if pbejson.Cipher != "AES128" || pbejson.HMAC != "HMAC_SHA1" {
-		return nil, ErrUnsupportedType
+	derive, err := pbejson.keyDerivation(c.minIterations)
+	if err != nil {
+		return nil, err
 	}
 	salt, err := decodeWeb64String(pbejson.Salt)
 	if err != nil {
-		return nil, err
+		return nil, ErrBase64Decoding
 	}
 	iv, err := decodeWeb64String(pbejson.Iv)
 	if err != nil {
-		return nil, err
+		return nil, ErrBase64Decoding
 	}
 	ciphertext, err := decodeWeb64String(pbejson.Key)
+	if err != nil {
+		return nil, ErrBase64Decoding
+	}
+	// CryptBlocks panics on a bad iv or a partial block
+	if len(iv) != aes.BlockSize || len(ciphertext) == 0 || len(ciphertext)%aes.BlockSize != 0 {
+		return nil, ErrBadCiphertextFormat
+	}
+	keybytes, err := derive(c.password, salt)
 	if err != nil {
 		return nil, err
 	}
-	keybytes := pbkdf2.Key(c.password, salt, pbejson.IterationCount, 128/8, sha1.New)
 	aesCipher, err := aes.NewCipher(keybytes)
 	if err != nil {
 		return nil, err
@@ -158,7 +200,7 @@ func (c *pbeCrypter) DecryptReader(source io.Reader, kp int) (io.ReadCloser, int
 	var pbejson pbeKeyJSON
 	err := json.NewDecoder(source).Decode(&pbejson)
 	if err != nil {
-		return nil, 0, err
+		return nil, 0, ErrBadCiphertextFormat
 	}
 	data, err := c.decrypt(pbejson)
 	if err != nil {
@@ -169,17 +211,29 @@ func (c *pbeCrypter) DecryptReader(source io.Reader, kp int) (io.ReadCloser, int
 
 func (c *pbeCrypter) createAESCipher() (pbeKeyJSON, cipher.BlockMode, error) {
 	var pbejson pbeKeyJSON
-	pbejson.Cipher = "AES128"
-	pbejson.HMAC = "HMAC_SHA1"
-	pbejson.IterationCount = 4096
+	c.kdf.setParams(&pbejson)
+	derive, err := pbejson.keyDerivation(0)
+	if err != nil {
+		return pbejson, nil, err
+	}
 	salt := make([]byte, 16)
-	io.ReadFull(rand.Reader, salt)
+	if _, err := io.ReadFull(rand.Reader, salt); err != nil {
+		return pbejson, nil, err
+	}
 	pbejson.Salt = encodeWeb64String(salt)
 	iv := make([]byte, 16)
-	io.ReadFull(rand.Reader, iv)
+	if _, err := io.ReadFull(rand.Reader, iv); err != nil {
+		return pbejson, nil, err
+	}
 	pbejson.Iv = encodeWeb64String(iv)
-	keybytes := pbkdf2.Key(c.password, salt, pbejson.IterationCount, 128/8, sha1.New)
+	keybytes, err := derive(c.password, salt)
+	if err != nil {
+		return pbejson, nil, err
+	}
 	aesCipher, err := aes.NewCipher(keybytes)
+	if err != nil {
+		return pbejson, nil, err
+	}
 	return pbejson, cipher.NewCBCEncrypter(aesCipher, iv), err
 }
 
@@ -213,18 +267,38 @@ func (c *pbeCrypter) EncryptWriter(sink io.Writer) (io.WriteCloser, error) {
 	return &pbeCryptoWriter{pbe: pbejson, aesCipher: aesCipher, data: bytes.NewBuffer(nil), sink: sink}, nil
 }
 
+// the PEM block types that hold private keys
+var privateKeyPEMTypes = []string{"PRIVATE KEY", "ENCRYPTED PRIVATE KEY", "RSA PRIVATE KEY", "DSA PRIVATE KEY", "EC PRIVATE KEY", "OPENSSH PRIVATE KEY"}
+
+// return the first PEM block in buf of one of the given types, skipping any others,
+// so files holding a key and its certificates, or EC parameters, can be imported
+func decodePEMBlock(buf []byte, types ...string) (*pem.Block, error) {
+	for {
+		var block *pem.Block
+		block, buf = pem.Decode(buf)
+		if block == nil {
+			return nil, ErrNoPEMFound
+		}
+		for _, t := range types {
+			if block.Type == t {
+				return block, nil
+			}
+		}
+	}
+}
+
 // a fake reader for an RSA private key
 type importedRSAPrivateKeyReader struct {
-	km      keyMeta    // our fake meta info
+	km      KeyMeta    // our fake meta info
 	rsajson rsaKeyJSON // the rsa key we're importing
 }
 
 // construct a fake keyreader for the provided rsa private key and purpose
-func newImportedRSAPrivateKeyReader(key *rsa.PrivateKey, purpose keyPurpose) KeyReader {
+func newImportedRSAPrivateKeyReader(key *rsa.PrivateKey, purpose KeyPurpose) KeyReader {
 	r := new(importedRSAPrivateKeyReader)
-	kv := keyVersion{0, S_PRIMARY, false}
-	r.km = keyMeta{"Imported RSA Private Key", T_RSA_PRIV, purpose, false, []keyVersion{kv}}
-	r.rsajson = *newRSAJSONFromKey(key)
+	kv := KeyVersion{VersionNumber: 0, Status: S_PRIMARY}
+	r.km = KeyMeta{"Imported RSA Private Key", T_RSA_PRIV, purpose, false, []KeyVersion{kv}}
+	r.rsajson = *newRSAJSONFromKey(key, SIG_PKCS1)
 	return r
 }
 
@@ -241,24 +315,41 @@ func (r *importedRSAPrivateKeyReader) GetKey(version int) (string, error) {
 	return string(b), err
 }
 
-// load and return an rsa private key from a PEM file specified in 'location'
-func getRSAKeyFromPEM(location string) (*rsa.PrivateKey, error) {
-	buf, err := slurp(location)
+// load and return an rsa private key from the PEM data in 'buf'
+// PKCS#1 ("RSA PRIVATE KEY"), PKCS#8 ("PRIVATE KEY") and OpenSSH ("OPENSSH PRIVATE KEY") blocks are accepted
+func getRSAKeyFromPEM(buf []byte) (*rsa.PrivateKey, error) {
+	block, err := decodePEMBlock(buf, privateKeyPEMTypes...)
 	if err != nil {
 		return nil, err
 	}
-	block, _ := pem.Decode([]byte(buf))
-	priv, err := x509.ParsePKCS1PrivateKey(block.Bytes)
+	if block.Type == "RSA PRIVATE KEY" {
+		return x509.ParsePKCS1PrivateKey(block.Bytes)
+	}
+	priv, err := parseEncryptedPEMPrivateKey(block, nil)
 	if err != nil {
 		return nil, err
 	}
-	return priv, nil
+	rsapriv, ok := priv.(*rsa.PrivateKey)
+	if !ok {
+		return nil, ErrUnsupportedType
+	}
+	return rsapriv, nil
 }
 
 // ImportRSAKeyFromPEMForSigning returns a KeyReader for the RSA Private Key contained in the PEM file specified in the location.
 // The resulting key can be used for signing and verification only
 func ImportRSAKeyFromPEMForSigning(location string) (KeyReader, error) {
-	priv, err := getRSAKeyFromPEM(location)
+	buf, err := slurp(location)
+	if err != nil {
+		return nil, err
+	}
+	return ImportRSAKeyFromPEMBytesForSigning([]byte(buf))
+}
+
+// ImportRSAKeyFromPEMBytesForSigning returns a KeyReader for the RSA Private Key contained in the PEM data.
+// The resulting key can be used for signing and verification only
+func ImportRSAKeyFromPEMBytesForSigning(pemBytes []byte) (KeyReader, error) {
+	priv, err := getRSAKeyFromPEM(pemBytes)
 	if err != nil {
 		return nil, err
 	}
@@ -269,7 +360,17 @@ func ImportRSAKeyFromPEMForSigning(location string) (KeyReader, error) {
 // ImportRSAKeyFromPEMForCrypt returns a KeyReader for the RSA Private Key contained in the PEM file specified in the location.
 // The resulting key can be used for encryption and decryption only
 func ImportRSAKeyFromPEMForCrypt(location string) (KeyReader, error) {
-	priv, err := getRSAKeyFromPEM(location)
+	buf, err := slurp(location)
+	if err != nil {
+		return nil, err
+	}
+	return ImportRSAKeyFromPEMBytesForCrypt([]byte(buf))
+}
+
+// ImportRSAKeyFromPEMBytesForCrypt returns a KeyReader for the RSA Private Key contained in the PEM data.
+// The resulting key can be used for encryption and decryption only
+func ImportRSAKeyFromPEMBytesForCrypt(pemBytes []byte) (KeyReader, error) {
+	priv, err := getRSAKeyFromPEM(pemBytes)
 	if err != nil {
 		return nil, err
 	}
@@ -277,18 +378,52 @@ func ImportRSAKeyFromPEMForCrypt(location string) (KeyReader, error) {
 	return r, nil
 }
 
+// ImportRSAKeyFromEncryptedPEM returns a KeyReader for the passphrase protected RSA Private Key contained in the PEM file specified in the location.
+// Both traditional encrypted PEM ("Proc-Type: 4,ENCRYPTED") and encrypted PKCS#8 ("ENCRYPTED PRIVATE KEY") blocks are accepted.
+// The purpose must be P_SIGN_AND_VERIFY or P_DECRYPT_AND_ENCRYPT.
+func ImportRSAKeyFromEncryptedPEM(location string, passphrase []byte, purpose KeyPurpose) (KeyReader, error) {
+	buf, err := slurp(location)
+	if err != nil {
+		return nil, err
+	}
+	return ImportRSAKeyFromEncryptedPEMBytes([]byte(buf), passphrase, purpose)
+}
+
+// ImportRSAKeyFromEncryptedPEMBytes returns a KeyReader for the passphrase protected RSA Private Key contained in the PEM data.
+// Both traditional encrypted PEM ("Proc-Type: 4,ENCRYPTED") and encrypted PKCS#8 ("ENCRYPTED PRIVATE KEY") blocks are accepted.
+// The purpose must be P_SIGN_AND_VERIFY or P_DECRYPT_AND_ENCRYPT.
+func ImportRSAKeyFromEncryptedPEMBytes(pemBytes []byte, passphrase []byte, purpose KeyPurpose) (KeyReader, error) {
+	if purpose != P_SIGN_AND_VERIFY && purpose != P_DECRYPT_AND_ENCRYPT {
+		return nil, ErrUnacceptablePurpose
+	}
+	block, err := decodePEMBlock(pemBytes, privateKeyPEMTypes...)
+	if err != nil {
+		return nil, err
+	}
+	priv, err := parseEncryptedPEMPrivateKey(block, passphrase)
+	if err != nil {
+		return nil, err
+	}
+	rsapriv, ok := priv.(*rsa.PrivateKey)
+	if !ok {
+		return nil, ErrUnsupportedType
+	}
+	r := newImportedRSAPrivateKeyReader(rsapriv, purpose)
+	return r, nil
+}
+
 // a fake reader for an RSA public key
 type importedRSAPublicKeyReader struct {
-	km      keyMeta          // our fake meta info
+	km      KeyMeta          // our fake meta info
 	rsajson rsaPublicKeyJSON // the rsa key we're importing
 }
 
 // construct a fake keyreader for the provided rsa public key and purpose
-func newImportedRSAPublicKeyReader(key *rsa.PublicKey, purpose keyPurpose) KeyReader {
+func newImportedRSAPublicKeyReader(key *rsa.PublicKey, purpose KeyPurpose) KeyReader {
 	r := new(importedRSAPublicKeyReader)
-	kv := keyVersion{0, S_PRIMARY, false}
-	r.km = keyMeta{"Imported RSA Public Key", T_RSA_PUB, purpose, false, []keyVersion{kv}}
-	r.rsajson = *newRSAPublicJSONFromKey(key)
+	kv := KeyVersion{VersionNumber: 0, Status: S_PRIMARY}
+	r.km = KeyMeta{"Imported RSA Public Key", T_RSA_PUB, purpose, false, []KeyVersion{kv}}
+	r.rsajson = *newRSAPublicJSONFromKey(key, SIG_PKCS1)
 	return r
 }
 
@@ -305,13 +440,12 @@ func (r *importedRSAPublicKeyReader) GetKey(version int) (string, error) {
 	return string(b), err
 }
 
-// load and return an rsa public key from a PEM file specified in 'location'
-func getRSAPublicKeyFromPEM(location string) (*rsa.PublicKey, error) {
-	buf, err := slurp(location)
+// load and return an rsa public key from the PEM data in 'buf'
+func getRSAPublicKeyFromPEM(buf []byte) (*rsa.PublicKey, error) {
+	block, err := decodePEMBlock(buf, "PUBLIC KEY")
 	if err != nil {
 		return nil, err
 	}
-	block, _ := pem.Decode([]byte(buf))
 	pub, err := x509.ParsePKIXPublicKey(block.Bytes)
 	if err != nil {
 		return nil, err
@@ -327,7 +461,17 @@ func getRSAPublicKeyFromPEM(location string) (*rsa.PublicKey, error) {
 // ImportRSAPublicKeyFromPEMForEncryption returns a KeyReader for the RSA Public Key contained in the PEM file specified in the location.
 // The resulting key can be used for encryption only.
 func ImportRSAPublicKeyFromPEMForEncryption(location string) (KeyReader, error) {
-	rsapub, err := getRSAPublicKeyFromPEM(location)
+	buf, err := slurp(location)
+	if err != nil {
+		return nil, err
+	}
+	return ImportRSAPublicKeyFromPEMBytesForEncryption([]byte(buf))
+}
+
+// ImportRSAPublicKeyFromPEMBytesForEncryption returns a KeyReader for the RSA Public Key contained in the PEM data.
+// The resulting key can be used for encryption only.
+func ImportRSAPublicKeyFromPEMBytesForEncryption(pemBytes []byte) (KeyReader, error) {
+	rsapub, err := getRSAPublicKeyFromPEM(pemBytes)
 	if err != nil {
 		return nil, err
 	}
@@ -338,7 +482,17 @@ func ImportRSAPublicKeyFromPEMForEncryption(location string) (KeyReader, error)
 // ImportRSAPublicKeyFromPEMForVerify returns a KeyReader for the RSA Public Key contained in the PEM file specified in the location.
 // The resulting key can be used for verification only.
 func ImportRSAPublicKeyFromPEMForVerify(location string) (KeyReader, error) {
-	rsapub, err := getRSAPublicKeyFromPEM(location)
+	buf, err := slurp(location)
+	if err != nil {
+		return nil, err
+	}
+	return ImportRSAPublicKeyFromPEMBytesForVerify([]byte(buf))
+}
+
+// ImportRSAPublicKeyFromPEMBytesForVerify returns a KeyReader for the RSA Public Key contained in the PEM data.
+// The resulting key can be used for verification only.
+func ImportRSAPublicKeyFromPEMBytesForVerify(pemBytes []byte) (KeyReader, error) {
+	rsapub, err := getRSAPublicKeyFromPEM(pemBytes)
 	if err != nil {
 		return nil, err
 	}
@@ -346,12 +500,11 @@ func ImportRSAPublicKeyFromPEMForVerify(location string) (KeyReader, error) {
 	return r, nil
 }
 
-func getRSAPublicKeyFromCertificate(location string) (*rsa.PublicKey, error) {
-	buf, err := slurp(location)
+func getRSAPublicKeyFromCertificate(buf []byte) (*rsa.PublicKey, error) {
+	block, err := decodePEMBlock(buf, "CERTIFICATE")
 	if err != nil {
 		return nil, err
 	}
-	block, _ := pem.Decode([]byte(buf))
 	cert, err := x509.ParseCertificate(block.Bytes)
 	if err != nil {
 		return nil, err
@@ -367,7 +520,17 @@ func getRSAPublicKeyFromCertificate(location string) (*rsa.PublicKey, error) {
 // ImportRSAPublicKeyFromCertificateForVerify returns a KeyReader for the RSA Public Key contained in the certificate file specified in the location.
 // The resulting key can be used for verification only.
 func ImportRSAPublicKeyFromCertificateForVerify(location string) (KeyReader, error) {
-	rsapub, err := getRSAPublicKeyFromCertificate(location)
+	buf, err := slurp(location)
+	if err != nil {
+		return nil, err
+	}
+	return ImportRSAPublicKeyFromCertificateBytesForVerify([]byte(buf))
+}
+
+// ImportRSAPublicKeyFromCertificateBytesForVerify returns a KeyReader for the RSA Public Key contained in the PEM encoded certificate data.
+// The resulting key can be used for verification only.
+func ImportRSAPublicKeyFromCertificateBytesForVerify(pemBytes []byte) (KeyReader, error) {
+	rsapub, err := getRSAPublicKeyFromCertificate(pemBytes)
 	if err != nil {
 		return nil, err
 	}
@@ -378,7 +541,17 @@ func ImportRSAPublicKeyFromCertificateForVerify(location string) (KeyReader, err
 // ImportRSAPublicKeyFromCertificateForCrypt returns a KeyReader for the RSA Public Key contained in the certificate file specified in the location.
 // The resulting key can be used for encryption only.
 func ImportRSAPublicKeyFromCertificateForCrypt(location string) (KeyReader, error) {
-	rsapub, err := getRSAPublicKeyFromCertificate(location)
+	buf, err := slurp(location)
+	if err != nil {
+		return nil, err
+	}
+	return ImportRSAPublicKeyFromCertificateBytesForCrypt([]byte(buf))
+}
+
+// ImportRSAPublicKeyFromCertificateBytesForCrypt returns a KeyReader for the RSA Public Key contained in the PEM encoded certificate data.
+// The resulting key can be used for encryption only.
+func ImportRSAPublicKeyFromCertificateBytesForCrypt(pemBytes []byte) (KeyReader, error) {
+	rsapub, err := getRSAPublicKeyFromCertificate(pemBytes)
 	if err != nil {
 		return nil, err
 	}
@@ -386,17 +559,77 @@ func ImportRSAPublicKeyFromCertificateForCrypt(location string) (KeyReader, erro
 	return r, nil
 }
 
+// return a verifying KeyReader of the matching type for a parsed public key
+func newImportedPublicKeyReaderForVerify(pub interface{}) (KeyReader, error) {
+	switch k := pub.(type) {
+	case *rsa.PublicKey:
+		return newImportedRSAPublicKeyReader(k, P_VERIFY), nil
+	case *dsa.PublicKey:
+		return newImportedDSAPublicKeyReader(k), nil
+	case *ecdsa.PublicKey:
+		return newImportedECDSAPublicKeyReader(k), nil
+	case ed25519.PublicKey:
+		return newImportedEd25519PublicKeyReader(k), nil
+	}
+	return nil, ErrUnsupportedType
+}
+
+// ImportCertificateChainForVerify returns a KeyReader for the public key of the certificate in the PEM file specified in the location,
+// as ImportCertificateChainBytesForVerify does.
+func ImportCertificateChainForVerify(location string, roots *x509.CertPool) (KeyReader, error) {
+	buf, err := slurp(location)
+	if err != nil {
+		return nil, err
+	}
+	return ImportCertificateChainBytesForVerify([]byte(buf), roots)
+}
+
+// ImportCertificateChainBytesForVerify returns a KeyReader for the public key of the first certificate in the PEM data.
+// The certificates after it are taken as its chain, and other blocks, such as the private key, are skipped.
+// If roots isn't nil, the certificate must chain to one of them through those certificates, or the import fails
+// with the verification error; if roots is nil, the key is trusted as is.
+// RSA, DSA, EC and Ed25519 keys are supported; the key set type follows the key.
+// The resulting key can be used for verification only.
+func ImportCertificateChainBytesForVerify(pemBytes []byte, roots *x509.CertPool) (KeyReader, error) {
+	var certs []*x509.Certificate
+	for block, rest := pem.Decode(pemBytes); block != nil; block, rest = pem.Decode(rest) {
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		certs = append(certs, cert)
+	}
+	if len(certs) == 0 {
+		return nil, ErrNoPEMFound
+	}
+	if roots != nil {
+		intermediates := x509.NewCertPool()
+		for _, cert := range certs[1:] {
+			intermediates.AddCert(cert)
+		}
+		// keyczar keys sign anything, so don't insist on a particular extended key usage
+		opts := x509.VerifyOptions{Roots: roots, Intermediates: intermediates, KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageAny}}
+		if _, err := certs[0].Verify(opts); err != nil {
+			return nil, err
+		}
+	}
+	return newImportedPublicKeyReaderForVerify(certs[0].PublicKey)
+}
+
 // fake reader for an AES key
 type importedAESKeyReader struct {
-	km      keyMeta    // our fake meta info
+	km      KeyMeta    // our fake meta info
 	aesjson aesKeyJSON // the aes key we're importing
 }
 
 // construct a fake keyreader for the provided aes key
 func newImportedAESKeyReader(key *aesKey) KeyReader {
 	r := new(importedAESKeyReader)
-	kv := keyVersion{0, S_PRIMARY, false}
-	r.km = keyMeta{"Imported AES Key", T_AES, P_DECRYPT_AND_ENCRYPT, false, []keyVersion{kv}}
+	kv := KeyVersion{VersionNumber: 0, Status: S_PRIMARY}
+	r.km = KeyMeta{"Imported AES Key", T_AES, P_DECRYPT_AND_ENCRYPT, false, []KeyVersion{kv}}
 	r.aesjson = *newAESJSONFromKey(key)
 	return r
 }
@@ -416,15 +649,15 @@ func (r *importedAESKeyReader) GetKey(version int) (string, error) {
 
 // a fake reader for a DSA private key
 type importedDSAPrivateKeyReader struct {
-	km      keyMeta    // our fake meta info
+	km      KeyMeta    // our fake meta info
 	dsajson dsaKeyJSON // the dsa key we're importing
 }
 
 // construct a fake keyreader for the provided dsa private key
 func newImportedDSAPrivateKeyReader(key *dsa.PrivateKey) KeyReader {
 	r := new(importedDSAPrivateKeyReader)
-	kv := keyVersion{0, S_PRIMARY, false}
-	r.km = keyMeta{"Imported DSA Private Key", T_DSA_PRIV, P_SIGN_AND_VERIFY, false, []keyVersion{kv}}
+	kv := KeyVersion{VersionNumber: 0, Status: S_PRIMARY}
+	r.km = KeyMeta{"Imported DSA Private Key", T_DSA_PRIV, P_SIGN_AND_VERIFY, false, []KeyVersion{kv}}
 	r.dsajson = *newDSAJSONFromKey(key)
 	return r
 }
@@ -442,3 +675,554 @@ func (r *importedDSAPrivateKeyReader) GetKey(version int) (string, error) {
 	return string(b), err
 }
 
+// the OpenSSL "DSA PRIVATE KEY" encoding
+type dsaOpenSSLPrivateKey struct {
+	Version       int
+	P, Q, G, Y, X *big.Int
+}
+
+// the PKCS#8 encoding, with the domain parameters in the algorithm identifier
+type dsaPKCS8PrivateKey struct {
+	Version    int
+	Algo       pkix.AlgorithmIdentifier
+	PrivateKey []byte
+}
+
+type dsaAlgorithmParameters struct {
+	P, Q, G *big.Int
+}
+
+var oidPublicKeyDSA = asn1.ObjectIdentifier{1, 2, 840, 10040, 4, 1}
+
+// load and return a dsa private key from the PEM data in 'buf'
+// both OpenSSL ("DSA PRIVATE KEY") and PKCS#8 ("PRIVATE KEY") blocks are accepted
+func getDSAKeyFromPEM(buf []byte) (*dsa.PrivateKey, error) {
+	block, err := decodePEMBlock(buf, privateKeyPEMTypes...)
+	if err != nil {
+		return nil, err
+	}
+	if block.Type == "DSA PRIVATE KEY" {
+		return parseDSAOpenSSLPrivateKey(block.Bytes)
+	}
+	return parseDSAPKCS8PrivateKey(block.Bytes)
+}
+
+// parse the traditional OpenSSL ("DSA PRIVATE KEY") encoding
+func parseDSAOpenSSLPrivateKey(der []byte) (*dsa.PrivateKey, error) {
+	var k dsaOpenSSLPrivateKey
+	if _, err := asn1.Unmarshal(der, &k); err != nil {
+		return nil, err
+	}
+	priv := new(dsa.PrivateKey)
+	priv.P, priv.Q, priv.G, priv.Y, priv.X = k.P, k.Q, k.G, k.Y, k.X
+	return priv, nil
+}
+
+// crypto/x509 doesn't handle DSA private keys, so we parse PKCS#8 ourselves
+func parseDSAPKCS8PrivateKey(der []byte) (*dsa.PrivateKey, error) {
+	var k dsaPKCS8PrivateKey
+	if _, err := asn1.Unmarshal(der, &k); err != nil {
+		return nil, err
+	}
+	if !k.Algo.Algorithm.Equal(oidPublicKeyDSA) {
+		return nil, ErrUnsupportedType
+	}
+	var params dsaAlgorithmParameters
+	if _, err := asn1.Unmarshal(k.Algo.Parameters.FullBytes, &params); err != nil {
+		return nil, err
+	}
+	x := new(big.Int)
+	if _, err := asn1.Unmarshal(k.PrivateKey, &x); err != nil {
+		return nil, err
+	}
+	priv := new(dsa.PrivateKey)
+	priv.P, priv.Q, priv.G, priv.X = params.P, params.Q, params.G, x
+	priv.Y = new(big.Int).Exp(priv.G, priv.X, priv.P)
+	return priv, nil
+}
+
+// parse a PKCS#8 private key, returning an *rsa.PrivateKey, *dsa.PrivateKey,
+// *ecdsa.PrivateKey or ed25519.PrivateKey
+func parsePKCS8PrivateKey(der []byte) (interface{}, error) {
+	priv, err := x509.ParsePKCS8PrivateKey(der)
+	if err == nil {
+		return priv, nil
+	}
+	if dsapriv, derr := parseDSAPKCS8PrivateKey(der); derr == nil {
+		return dsapriv, nil
+	}
+	return nil, err
+}
+
+// return a signing KeyReader of the matching type for a parsed private key
+func newImportedPrivateKeyReaderForSigning(priv interface{}) (KeyReader, error) {
+	switch k := priv.(type) {
+	case *rsa.PrivateKey:
+		return newImportedRSAPrivateKeyReader(k, P_SIGN_AND_VERIFY), nil
+	case *dsa.PrivateKey:
+		if !T_DSA_PRIV.isAcceptableSize(uint(k.P.BitLen())) {
+			return nil, ErrInvalidKeySize
+		}
+		return newImportedDSAPrivateKeyReader(k), nil
+	case *ecdsa.PrivateKey:
+		if !T_EC_PRIV.isAcceptableSize(uint(k.Curve.Params().BitSize)) {
+			return nil, ErrInvalidKeySize
+		}
+		return newImportedECDSAPrivateKeyReader(k), nil
+	case ed25519.PrivateKey:
+		return newImportedEd25519PrivateKeyReader(k), nil
+	}
+	return nil, ErrUnsupportedType
+}
+
+// ImportPKCS8KeyFromPEMForSigning returns a KeyReader for the PKCS#8 ("PRIVATE KEY") encoded key contained in the PEM file specified in the location.
+// RSA, DSA, EC and Ed25519 keys are supported; the key set type follows the key.
+// The resulting key can be used for signing and verification only
+func ImportPKCS8KeyFromPEMForSigning(location string) (KeyReader, error) {
+	buf, err := slurp(location)
+	if err != nil {
+		return nil, err
+	}
+	return ImportPKCS8KeyFromPEMBytesForSigning([]byte(buf))
+}
+
+// ImportPKCS8KeyFromPEMBytesForSigning returns a KeyReader for the PKCS#8 ("PRIVATE KEY") encoded key contained in the PEM data.
+// RSA, DSA, EC and Ed25519 keys are supported; the key set type follows the key.
+// The resulting key can be used for signing and verification only
+func ImportPKCS8KeyFromPEMBytesForSigning(pemBytes []byte) (KeyReader, error) {
+	block, err := decodePEMBlock(pemBytes, "PRIVATE KEY")
+	if err != nil {
+		return nil, err
+	}
+	priv, err := parsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	return newImportedPrivateKeyReaderForSigning(priv)
+}
+
+// ImportPrivateKeyFromPEM returns a KeyReader for the RSA, DSA, EC or Ed25519 private key contained in the PEM file specified in the location.
+// Besides the OpenSSL formats, OpenSSH private key files, as written by ssh-keygen, are accepted.
+// The key may be protected by passphrase (pass nil for an unencrypted key); the key set type follows the key.
+// Any key can be imported with P_SIGN_AND_VERIFY, but only RSA keys with P_DECRYPT_AND_ENCRYPT.
+func ImportPrivateKeyFromPEM(location string, passphrase []byte, purpose KeyPurpose) (KeyReader, error) {
+	buf, err := slurp(location)
+	if err != nil {
+		return nil, err
+	}
+	return ImportPrivateKeyFromPEMBytes([]byte(buf), passphrase, purpose)
+}
+
+// ImportPrivateKeyFromPEMBytes returns a KeyReader for the RSA, DSA, EC or Ed25519 private key contained in the PEM data.
+// Besides the OpenSSL formats, OpenSSH private keys, as written by ssh-keygen, are accepted.
+// The key may be protected by passphrase (pass nil for an unencrypted key); the key set type follows the key.
+// Any key can be imported with P_SIGN_AND_VERIFY, but only RSA keys with P_DECRYPT_AND_ENCRYPT.
+func ImportPrivateKeyFromPEMBytes(pemBytes []byte, passphrase []byte, purpose KeyPurpose) (KeyReader, error) {
+	block, err := decodePEMBlock(pemBytes, privateKeyPEMTypes...)
+	if err != nil {
+		return nil, err
+	}
+	priv, err := parseEncryptedPEMPrivateKey(block, passphrase)
+	if err != nil {
+		return nil, err
+	}
+	switch purpose {
+	case P_SIGN_AND_VERIFY:
+		return newImportedPrivateKeyReaderForSigning(priv)
+	case P_DECRYPT_AND_ENCRYPT:
+		rsapriv, ok := priv.(*rsa.PrivateKey)
+		if !ok {
+			return nil, ErrUnsupportedType
+		}
+		return newImportedRSAPrivateKeyReader(rsapriv, purpose), nil
+	}
+	return nil, ErrUnacceptablePurpose
+}
+
+// ImportDSAKeyFromPEMForSigning returns a KeyReader for the DSA Private Key contained in the PEM file specified in the location.
+// The resulting key can be used for signing and verification only
+func ImportDSAKeyFromPEMForSigning(location string) (KeyReader, error) {
+	buf, err := slurp(location)
+	if err != nil {
+		return nil, err
+	}
+	return ImportDSAKeyFromPEMBytesForSigning([]byte(buf))
+}
+
+// ImportDSAKeyFromPEMBytesForSigning returns a KeyReader for the DSA Private Key contained in the PEM data.
+// The resulting key can be used for signing and verification only
+func ImportDSAKeyFromPEMBytesForSigning(pemBytes []byte) (KeyReader, error) {
+	priv, err := getDSAKeyFromPEM(pemBytes)
+	if err != nil {
+		return nil, err
+	}
+	if !T_DSA_PRIV.isAcceptableSize(uint(priv.P.BitLen())) {
+		return nil, ErrInvalidKeySize
+	}
+	r := newImportedDSAPrivateKeyReader(priv)
+	return r, nil
+}
+
+// a fake reader for a DSA public key
+type importedDSAPublicKeyReader struct {
+	km      KeyMeta          // our fake meta info
+	dsajson dsaPublicKeyJSON // the dsa key we're importing
+}
+
+// construct a fake keyreader for the provided dsa public key
+func newImportedDSAPublicKeyReader(key *dsa.PublicKey) KeyReader {
+	r := new(importedDSAPublicKeyReader)
+	kv := KeyVersion{VersionNumber: 0, Status: S_PRIMARY}
+	r.km = KeyMeta{"Imported DSA Public Key", T_DSA_PUB, P_VERIFY, false, []KeyVersion{kv}}
+	r.dsajson = *newDSAPublicJSONFromKey(key)
+	return r
+}
+
+func (r *importedDSAPublicKeyReader) GetMetadata() (string, error) {
+	b, err := json.Marshal(r.km)
+	return string(b), err
+}
+
+func (r *importedDSAPublicKeyReader) GetKey(version int) (string, error) {
+	if version != 0 {
+		return "", ErrNoSuchKeyVersion
+	}
+	b, err := json.Marshal(r.dsajson)
+	return string(b), err
+}
+
+// load and return a dsa public key from the PEM data in 'buf'
+func getDSAPublicKeyFromPEM(buf []byte) (*dsa.PublicKey, error) {
+	block, err := decodePEMBlock(buf, "PUBLIC KEY")
+	if err != nil {
+		return nil, err
+	}
+	pub, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	dsapub, ok := pub.(*dsa.PublicKey)
+	if !ok {
+		return nil, ErrUnsupportedType
+	}
+	return dsapub, nil
+}
+
+// ImportDSAPublicKeyFromPEMForVerify returns a KeyReader for the DSA Public Key contained in the PEM file specified in the location.
+// The resulting key can be used for verification only.
+func ImportDSAPublicKeyFromPEMForVerify(location string) (KeyReader, error) {
+	buf, err := slurp(location)
+	if err != nil {
+		return nil, err
+	}
+	return ImportDSAPublicKeyFromPEMBytesForVerify([]byte(buf))
+}
+
+// ImportDSAPublicKeyFromPEMBytesForVerify returns a KeyReader for the DSA Public Key contained in the PEM data.
+// The resulting key can be used for verification only.
+func ImportDSAPublicKeyFromPEMBytesForVerify(pemBytes []byte) (KeyReader, error) {
+	dsapub, err := getDSAPublicKeyFromPEM(pemBytes)
+	if err != nil {
+		return nil, err
+	}
+	if !T_DSA_PUB.isAcceptableSize(uint(dsapub.P.BitLen())) {
+		return nil, ErrInvalidKeySize
+	}
+	r := newImportedDSAPublicKeyReader(dsapub)
+	return r, nil
+}
+
+// a fake reader for an EC private key
+type importedECDSAPrivateKeyReader struct {
+	km     KeyMeta      // our fake meta info
+	ecjson ecdsaKeyJSON // the ec key we're importing
+}
+
+// construct a fake keyreader for the provided ec private key
+func newImportedECDSAPrivateKeyReader(key *ecdsa.PrivateKey) KeyReader {
+	r := new(importedECDSAPrivateKeyReader)
+	kv := KeyVersion{VersionNumber: 0, Status: S_PRIMARY}
+	r.km = KeyMeta{"Imported EC Private Key", T_EC_PRIV, P_SIGN_AND_VERIFY, false, []KeyVersion{kv}}
+	r.ecjson = *newECDSAJSONFromKey(key)
+	return r
+}
+
+func (r *importedECDSAPrivateKeyReader) GetMetadata() (string, error) {
+	b, err := json.Marshal(r.km)
+	return string(b), err
+}
+
+func (r *importedECDSAPrivateKeyReader) GetKey(version int) (string, error) {
+	if version != 0 {
+		return "", ErrNoSuchKeyVersion
+	}
+	b, err := json.Marshal(r.ecjson)
+	return string(b), err
+}
+
+// load and return an ec private key from the PEM data in 'buf'
+// SEC1 ("EC PRIVATE KEY"), PKCS#8 ("PRIVATE KEY") and OpenSSH ("OPENSSH PRIVATE KEY") blocks are accepted
+func getECDSAKeyFromPEM(buf []byte) (*ecdsa.PrivateKey, error) {
+	block, err := decodePEMBlock(buf, privateKeyPEMTypes...)
+	if err != nil {
+		return nil, err
+	}
+	if block.Type == "EC PRIVATE KEY" {
+		return x509.ParseECPrivateKey(block.Bytes)
+	}
+	priv, err := parseEncryptedPEMPrivateKey(block, nil)
+	if err != nil {
+		return nil, err
+	}
+	ecpriv, ok := priv.(*ecdsa.PrivateKey)
+	if !ok {
+		return nil, ErrUnsupportedType
+	}
+	return ecpriv, nil
+}
+
+// ImportECDSAKeyFromPEMForSigning returns a KeyReader for the EC Private Key contained in the PEM file specified in the location.
+// The resulting key can be used for signing and verification only
+func ImportECDSAKeyFromPEMForSigning(location string) (KeyReader, error) {
+	buf, err := slurp(location)
+	if err != nil {
+		return nil, err
+	}
+	return ImportECDSAKeyFromPEMBytesForSigning([]byte(buf))
+}
+
+// ImportECDSAKeyFromPEMBytesForSigning returns a KeyReader for the EC Private Key contained in the PEM data.
+// The resulting key can be used for signing and verification only
+func ImportECDSAKeyFromPEMBytesForSigning(pemBytes []byte) (KeyReader, error) {
+	priv, err := getECDSAKeyFromPEM(pemBytes)
+	if err != nil {
+		return nil, err
+	}
+	if !T_EC_PRIV.isAcceptableSize(uint(priv.Curve.Params().BitSize)) {
+		return nil, ErrInvalidKeySize
+	}
+	r := newImportedECDSAPrivateKeyReader(priv)
+	return r, nil
+}
+
+// a fake reader for an EC public key
+type importedECDSAPublicKeyReader struct {
+	km     KeyMeta            // our fake meta info
+	ecjson ecdsaPublicKeyJSON // the ec key we're importing
+}
+
+// construct a fake keyreader for the provided ec public key
+func newImportedECDSAPublicKeyReader(key *ecdsa.PublicKey) KeyReader {
+	r := new(importedECDSAPublicKeyReader)
+	kv := KeyVersion{VersionNumber: 0, Status: S_PRIMARY}
+	r.km = KeyMeta{"Imported EC Public Key", T_EC_PUB, P_VERIFY, false, []KeyVersion{kv}}
+	r.ecjson = *newECDSAPublicJSONFromKey(key)
+	return r
+}
+
+func (r *importedECDSAPublicKeyReader) GetMetadata() (string, error) {
+	b, err := json.Marshal(r.km)
+	return string(b), err
+}
+
+func (r *importedECDSAPublicKeyReader) GetKey(version int) (string, error) {
+	if version != 0 {
+		return "", ErrNoSuchKeyVersion
+	}
+	b, err := json.Marshal(r.ecjson)
+	return string(b), err
+}
+
+// load and return an ec public key from the PEM data in 'buf'
+func getECDSAPublicKeyFromPEM(buf []byte) (*ecdsa.PublicKey, error) {
+	block, err := decodePEMBlock(buf, "PUBLIC KEY")
+	if err != nil {
+		return nil, err
+	}
+	pub, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	ecpub, ok := pub.(*ecdsa.PublicKey)
+	if !ok {
+		return nil, ErrUnsupportedType
+	}
+	return ecpub, nil
+}
+
+// ImportECDSAPublicKeyFromPEMForVerify returns a KeyReader for the EC Public Key contained in the PEM file specified in the location.
+// The resulting key can be used for verification only.
+func ImportECDSAPublicKeyFromPEMForVerify(location string) (KeyReader, error) {
+	buf, err := slurp(location)
+	if err != nil {
+		return nil, err
+	}
+	return ImportECDSAPublicKeyFromPEMBytesForVerify([]byte(buf))
+}
+
+// ImportECDSAPublicKeyFromPEMBytesForVerify returns a KeyReader for the EC Public Key contained in the PEM data.
+// The resulting key can be used for verification only.
+func ImportECDSAPublicKeyFromPEMBytesForVerify(pemBytes []byte) (KeyReader, error) {
+	ecpub, err := getECDSAPublicKeyFromPEM(pemBytes)
+	if err != nil {
+		return nil, err
+	}
+	if !T_EC_PUB.isAcceptableSize(uint(ecpub.Curve.Params().BitSize)) {
+		return nil, ErrInvalidKeySize
+	}
+	r := newImportedECDSAPublicKeyReader(ecpub)
+	return r, nil
+}
+
+// a fake reader for an Ed25519 private key
+type importedEd25519PrivateKeyReader struct {
+	km     KeyMeta        // our fake meta info
+	edjson ed25519KeyJSON // the ed25519 key we're importing
+}
+
+// construct a fake keyreader for the provided ed25519 private key
+func newImportedEd25519PrivateKeyReader(key ed25519.PrivateKey) KeyReader {
+	r := new(importedEd25519PrivateKeyReader)
+	kv := KeyVersion{VersionNumber: 0, Status: S_PRIMARY}
+	r.km = KeyMeta{"Imported Ed25519 Private Key", T_ED25519_PRIV, P_SIGN_AND_VERIFY, false, []KeyVersion{kv}}
+	r.edjson = *newEd25519JSONFromKey(key)
+	return r
+}
+
+func (r *importedEd25519PrivateKeyReader) GetMetadata() (string, error) {
+	b, err := json.Marshal(r.km)
+	return string(b), err
+}
+
+func (r *importedEd25519PrivateKeyReader) GetKey(version int) (string, error) {
+	if version != 0 {
+		return "", ErrNoSuchKeyVersion
+	}
+	b, err := json.Marshal(r.edjson)
+	return string(b), err
+}
+
+// load and return an ed25519 private key from the PEM data in 'buf'
+// both PKCS#8 ("PRIVATE KEY") and OpenSSH ("OPENSSH PRIVATE KEY") blocks are accepted
+func getEd25519KeyFromPEM(buf []byte) (ed25519.PrivateKey, error) {
+	block, err := decodePEMBlock(buf, privateKeyPEMTypes...)
+	if err != nil {
+		return nil, err
+	}
+	priv, err := parseEncryptedPEMPrivateKey(block, nil)
+	if err != nil {
+		return nil, err
+	}
+	edpriv, ok := priv.(ed25519.PrivateKey)
+	if !ok {
+		return nil, ErrUnsupportedType
+	}
+	return edpriv, nil
+}
+
+// ImportEd25519KeyFromPEMForSigning returns a KeyReader for the Ed25519 Private Key contained in the PEM file specified in the location.
+// The resulting key can be used for signing and verification only
+func ImportEd25519KeyFromPEMForSigning(location string) (KeyReader, error) {
+	buf, err := slurp(location)
+	if err != nil {
+		return nil, err
+	}
+	return ImportEd25519KeyFromPEMBytesForSigning([]byte(buf))
+}
+
+// ImportEd25519KeyFromPEMBytesForSigning returns a KeyReader for the Ed25519 Private Key contained in the PEM data.
+// The resulting key can be used for signing and verification only
+func ImportEd25519KeyFromPEMBytesForSigning(pemBytes []byte) (KeyReader, error) {
+	priv, err := getEd25519KeyFromPEM(pemBytes)
+	if err != nil {
+		return nil, err
+	}
+	r := newImportedEd25519PrivateKeyReader(priv)
+	return r, nil
+}
+
+// a fake reader for an Ed25519 public key
+type importedEd25519PublicKeyReader struct {
+	km     KeyMeta              // our fake meta info
+	edjson ed25519PublicKeyJSON // the ed25519 key we're importing
+}
+
+// construct a fake keyreader for the provided ed25519 public key
+func newImportedEd25519PublicKeyReader(key ed25519.PublicKey) KeyReader {
+	r := new(importedEd25519PublicKeyReader)
+	kv := KeyVersion{VersionNumber: 0, Status: S_PRIMARY}
+	r.km = KeyMeta{"Imported Ed25519 Public Key", T_ED25519_PUB, P_VERIFY, false, []KeyVersion{kv}}
+	r.edjson = *newEd25519PublicJSONFromKey(key)
+	return r
+}
+
+func (r *importedEd25519PublicKeyReader) GetMetadata() (string, error) {
+	b, err := json.Marshal(r.km)
+	return string(b), err
+}
+
+func (r *importedEd25519PublicKeyReader) GetKey(version int) (string, error) {
+	if version != 0 {
+		return "", ErrNoSuchKeyVersion
+	}
+	b, err := json.Marshal(r.edjson)
+	return string(b), err
+}
+
+// load and return an ed25519 public key from the PEM data in 'buf'
+func getEd25519PublicKeyFromPEM(buf []byte) (ed25519.PublicKey, error) {
+	block, err := decodePEMBlock(buf, "PUBLIC KEY")
+	if err != nil {
+		return nil, err
+	}
+	pub, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	edpub, ok := pub.(ed25519.PublicKey)
+	if !ok {
+		return nil, ErrUnsupportedType
+	}
+	return edpub, nil
+}
+
+// ImportEd25519PublicKeyFromPEMForVerify returns a KeyReader for the Ed25519 Public Key contained in the PEM file specified in the location.
+// The resulting key can be used for verification only.
+func ImportEd25519PublicKeyFromPEMForVerify(location string) (KeyReader, error) {
+	buf, err := slurp(location)
+	if err != nil {
+		return nil, err
+	}
+	return ImportEd25519PublicKeyFromPEMBytesForVerify([]byte(buf))
+}
+
+// ImportEd25519PublicKeyFromPEMBytesForVerify returns a KeyReader for the Ed25519 Public Key contained in the PEM data.
+// The resulting key can be used for verification only.
+func ImportEd25519PublicKeyFromPEMBytesForVerify(pemBytes []byte) (KeyReader, error) {
+	edpub, err := getEd25519PublicKeyFromPEM(pemBytes)
+	if err != nil {
+		return nil, err
+	}
+	r := newImportedEd25519PublicKeyReader(edpub)
+	return r, nil
+}
+
+// ImportSSHPublicKeyForVerify returns a KeyReader for the public key in a line of an OpenSSH authorized_keys
+// file, e.g. "ssh-ed25519 AAAA... user@host"; options before the key type and the comment are ignored.
+// ssh-rsa, ssh-ed25519 and ecdsa-sha2-nistp* keys are supported; the key set type follows the key.
+// The resulting key can be used for verification only.
+func ImportSSHPublicKeyForVerify(line string) (KeyReader, error) {
+	sshpub, _, _, _, err := ssh.ParseAuthorizedKey([]byte(line))
+	if err != nil {
+		return nil, err
+	}
+	cpk, ok := sshpub.(ssh.CryptoPublicKey)
+	if !ok {
+		return nil, ErrUnsupportedType
+	}
+	switch pub := cpk.CryptoPublicKey().(type) {
+	case *rsa.PublicKey, *ecdsa.PublicKey, ed25519.PublicKey:
+		return newImportedPublicKeyReaderForVerify(pub)
+	}
+	return nil, ErrUnsupportedType
+}
@@ -0,0 +1,70 @@
+package dkeyczar
+
+import (
+	"bufio"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// Reencrypt decrypts ciphertext with whichever key of the key set made it, and
+// encrypts it again with the primary key, e.g. to move data off a key version
+// before it is revoked.
+func Reencrypt(crypter Crypter, ciphertext string) (string, error) {
+	plaintext, err := crypter.Decrypt(ciphertext)
+	if err != nil {
+		return "", err
+	}
+	defer wipeBytes(plaintext)
+	return crypter.Encrypt(plaintext)
+}
+
+// ReencryptError is returned by ReencryptLines for a line that didn't re-encrypt
+type ReencryptError struct {
+	Line int   // the line number, from 1
+	Err  error // why it failed
+}
+
+func (e *ReencryptError) Error() string {
+	return "keyczar: line " + strconv.Itoa(e.Line) + ": " + e.Err.Error()
+}
+
+func (e *ReencryptError) Unwrap() error { return e.Err }
+
+// ReencryptLines reads ciphertexts from src, one per line, and writes each one
+// re-encrypted by Reencrypt to dst, keeping empty lines and line endings.  The crypter's encoding
+// must not produce newlines: the default web-safe base64 or hex.
+// It returns how many ciphertexts were re-encrypted, and stops at the first
+// that fails with a *ReencryptError.
+func ReencryptLines(crypter Crypter, dst io.Writer, src io.Reader) (int, error) {
+	r := bufio.NewReader(src)
+	w := bufio.NewWriter(dst)
+	n := 0
+	for line := 1; ; line++ {
+		s, err := r.ReadString('\n')
+		if err != nil && err != io.EOF {
+			return n, err
+		}
+		if s == "" && err == io.EOF {
+			break
+		}
+		ciphertext := strings.TrimRight(s, "\r\n")
+		eol := s[len(ciphertext):]
+		if ciphertext != "" {
+			c, rerr := Reencrypt(crypter, ciphertext)
+			if rerr != nil {
+				w.Flush()
+				return n, &ReencryptError{Line: line, Err: rerr}
+			}
+			ciphertext = c
+			n++
+		}
+		if _, werr := w.WriteString(ciphertext + eol); werr != nil {
+			return n, werr
+		}
+		if err == io.EOF {
+			break
+		}
+	}
+	return n, w.Flush()
+}
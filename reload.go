@@ -0,0 +1,112 @@
+package dkeyczar
+
+import (
+	"sync"
+	"time"
+)
+
+type ReloadPolicy int
+
+const (
+	NO_RELOAD             ReloadPolicy = iota // Never re-read the key set [default]
+	RELOAD_ON_UNKNOWN_KEY                     // Re-read the key set when a key hash isn't found
+)
+
+// minimum time between two reloads, so a stream of bogus key hashes can't hammer the KeyReader
+const minReloadInterval = time.Second
+
+// ReloadController is implemented by the Crypters, Encrypters, DeterministicCrypters,
+// Signers and Verifiers made from key sets, which can re-read them
+type ReloadController interface {
+	// Set the policy for re-reading the key set
+	SetReloadPolicy(policy ReloadPolicy)
+	// Return the current reload policy
+	ReloadPolicy() ReloadPolicy
+}
+
+// the reload state of a keyCzar.  mu guards the key set, which a reload replaces.
+// Everything else in a keyCzar is fixed once it is made, or guarded by mu too.
+type reloader struct {
+	mu         sync.RWMutex
+	reloading  sync.Mutex // held while reading the new key set
+	load       func() (*keyCzar, error)
+	policy     ReloadPolicy
+	lastReload time.Time
+}
+
+// re-read the key set and swap it in, unless we have done so recently
+func (kz *keyCzar) reload() error {
+	kz.reloading.Lock()
+	defer kz.reloading.Unlock()
+	if kz.load == nil || time.Since(kz.lastReload) < minReloadInterval {
+		return nil
+	}
+	kz.lastReload = time.Now()
+	nkz, err := kz.load()
+	if err != nil {
+		return err
+	}
+	// the new key set must still be usable the way the old one was
+	if nkz.keymeta.Purpose != kz.keymeta.Purpose {
+		return ErrUnacceptablePurpose
+	}
+	if nkz.keymeta.Type != kz.keymeta.Type {
+		return ErrUnsupportedType
+	}
+	kz.mu.Lock()
+	setKeysRand(nkz.keys, kz.rand)
+	// the type and purpose are left alone: they are read without the lock
+	kz.keymeta.Name = nkz.keymeta.Name
+	kz.keymeta.Encrypted = nkz.keymeta.Encrypted
+	kz.keymeta.Versions = nkz.keymeta.Versions
+	kz.keys = nkz.keys
+	kz.idkeys = nkz.idkeys
+	kz.lazy = nkz.lazy
+	kz.primary = nkz.primary
+	kz.mu.Unlock()
+	return nil
+}
+
+// return all the keys in the key set, in no particular order, leaving out those that can't be read
+func (kz *keyCzar) allKeys() []keydata {
+	kz.loadAllVersions()
+	kz.mu.RLock()
+	defer kz.mu.RUnlock()
+	kl := make([]keydata, 0, len(kz.keys))
+	for _, k := range kz.keys {
+		kl = append(kl, k)
+	}
+	return kl
+}
+
+func (kz *keyCzar) setReloadPolicy(policy ReloadPolicy) {
+	kz.mu.Lock()
+	kz.policy = policy
+	kz.mu.Unlock()
+}
+
+func (kz *keyCzar) reloadPolicy() ReloadPolicy {
+	kz.mu.RLock()
+	defer kz.mu.RUnlock()
+	return kz.policy
+}
+
+// SetReloadPolicy sets when the encrypter or crypter re-reads its key set
+func (kc *keyEncrypter) SetReloadPolicy(policy ReloadPolicy) {
+	kc.kz.setReloadPolicy(policy)
+}
+
+// ReloadPolicy returns the current reload policy of the encrypter or crypter
+func (kc *keyEncrypter) ReloadPolicy() ReloadPolicy {
+	return kc.kz.reloadPolicy()
+}
+
+// SetReloadPolicy sets when the signer or verifier re-reads its key set
+func (ks *keySigner) SetReloadPolicy(policy ReloadPolicy) {
+	ks.kz.setReloadPolicy(policy)
+}
+
+// ReloadPolicy returns the current reload policy of the signer or verifier
+func (ks *keySigner) ReloadPolicy() ReloadPolicy {
+	return ks.kz.reloadPolicy()
+}
@@ -0,0 +1,225 @@
+package remote
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"github.com/dgryski/dkeyczar"
+)
+
+// A Client is a Crypter and a Signer carrying out its operations on a Server.
+// It is safe for concurrent use once configured, like the ones made from key sets.
+type Client struct {
+	url         string
+	client      *http.Client
+	encoding    dkeyczar.Encoding
+	compression dkeyczar.Compression
+}
+
+var (
+	_ dkeyczar.Crypter = (*Client)(nil)
+	_ dkeyczar.Signer  = (*Client)(nil)
+)
+
+// NewClient returns a Client for the server at url, e.g. "https://keys.example.com".
+// Requests are made with client, nil for http.DefaultClient; give it an httpsig.Transport
+// to sign them.
+func NewClient(url string, client *http.Client) *Client {
+	if client == nil {
+		client = http.DefaultClient
+	}
+	return &Client{url: strings.TrimSuffix(url, "/"), client: client}
+}
+
+func (c *Client) call(op string, req *request) (*response, error) {
+	body, err := json.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.client.Post(c.url+"/v1/"+op, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	var r response
+	if err := json.NewDecoder(io.LimitReader(resp.Body, maxRequestSize)).Decode(&r); err != nil {
+		return nil, &Error{StatusCode: resp.StatusCode, Message: resp.Status}
+	}
+	switch {
+	case resp.StatusCode == http.StatusNotFound && r.Error == ErrNoKeySet.Error():
+		return nil, ErrNoKeySet
+	case resp.StatusCode != http.StatusOK:
+		return nil, &Error{StatusCode: resp.StatusCode, Message: r.Error}
+	}
+	return &r, nil
+}
+
+// SetEncoding sets the encoding of the ciphertexts and signatures
+func (c *Client) SetEncoding(encoding dkeyczar.Encoding) { c.encoding = encoding }
+
+// Encoding returns the encoding of the ciphertexts and signatures
+func (c *Client) Encoding() dkeyczar.Encoding { return c.encoding }
+
+// SetCompression sets the compression of the plaintexts, which is done client-side
+func (c *Client) SetCompression(compression dkeyczar.Compression) { c.compression = compression }
+
+// Compression returns the compression of the plaintexts
+func (c *Client) Compression() dkeyczar.Compression { return c.compression }
+
+func (c *Client) encode(b []byte) string {
+	switch c.encoding {
+	case dkeyczar.NO_ENCODING:
+		return string(b)
+	case dkeyczar.HEX:
+		return hex.EncodeToString(b)
+	}
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func (c *Client) decode(s string) ([]byte, error) {
+	var b []byte
+	var err error
+	switch c.encoding {
+	case dkeyczar.NO_ENCODING:
+		return []byte(s), nil
+	case dkeyczar.HEX:
+		b, err = hex.DecodeString(s)
+	default:
+		b, err = base64.RawURLEncoding.DecodeString(strings.TrimRight(s, "="))
+	}
+	if err != nil {
+		return nil, dkeyczar.ErrBase64Decoding
+	}
+	return b, nil
+}
+
+func (c *Client) compress(b []byte) []byte {
+	var buf bytes.Buffer
+	var w io.WriteCloser
+	switch c.compression {
+	case dkeyczar.GZIP:
+		w = gzip.NewWriter(&buf)
+	case dkeyczar.ZLIB:
+		w = zlib.NewWriter(&buf)
+	default:
+		return b
+	}
+	w.Write(b)
+	w.Close()
+	return buf.Bytes()
+}
+
+func (c *Client) decompress(b []byte) ([]byte, error) {
+	var r io.Reader
+	var err error
+	switch c.compression {
+	case dkeyczar.GZIP:
+		r, err = gzip.NewReader(bytes.NewReader(b))
+	case dkeyczar.ZLIB:
+		r, err = zlib.NewReader(bytes.NewReader(b))
+	default:
+		return b, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.ReadAll(r)
+}
+
+// Encrypt encrypts plaintext with the primary key of the server's key set
+func (c *Client) Encrypt(plaintext []byte) (string, error) {
+	r, err := c.call("encrypt", &request{Plaintext: c.compress(plaintext)})
+	if err != nil {
+		return "", err
+	}
+	return c.encode(r.Ciphertext), nil
+}
+
+// Decrypt decrypts ciphertext with the server's key set
+func (c *Client) Decrypt(ciphertext string) ([]byte, error) {
+	b, err := c.decode(ciphertext)
+	if err != nil {
+		return nil, err
+	}
+	r, err := c.call("decrypt", &request{Ciphertext: b})
+	if err != nil {
+		return nil, err
+	}
+	return c.decompress(r.Plaintext)
+}
+
+func (c *Client) sign(op string, req *request) (string, error) {
+	r, err := c.call(op, req)
+	if err != nil {
+		return "", err
+	}
+	return c.encode(r.Signature), nil
+}
+
+func (c *Client) verify(op string, message []byte, signature string) (bool, error) {
+	sig, err := c.decode(signature)
+	if err != nil {
+		return false, err
+	}
+	r, err := c.call(op, &request{Message: message, Signature: sig})
+	if err != nil {
+		return false, err
+	}
+	return r.Valid, nil
+}
+
+// Sign signs message with the primary key of the server's key set
+func (c *Client) Sign(message []byte) (string, error) {
+	return c.sign("sign", &request{Message: message})
+}
+
+// AttachedSign returns message signed with nonce by the server's key set, with the message attached
+func (c *Client) AttachedSign(message []byte, nonce []byte) (string, error) {
+	return c.sign("attached-sign", &request{Message: message, Nonce: nonce})
+}
+
+// TimeoutSign signs message with the server's key set, valid until expiration
+func (c *Client) TimeoutSign(message []byte, expiration int64) (string, error) {
+	return c.sign("timeout-sign", &request{Message: message, Expiration: expiration})
+}
+
+// UnversionedSign signs message with a plain signature by the server's key set
+func (c *Client) UnversionedSign(message []byte) (string, error) {
+	return c.sign("unversioned-sign", &request{Message: message})
+}
+
+// Verify checks the signature of message with the server's key set
+func (c *Client) Verify(message []byte, signature string) (bool, error) {
+	return c.verify("verify", message, signature)
+}
+
+// AttachedVerify checks a message signed by AttachedSign with nonce, and returns the message
+func (c *Client) AttachedVerify(signedMessage string, nonce []byte) ([]byte, error) {
+	sig, err := c.decode(signedMessage)
+	if err != nil {
+		return nil, err
+	}
+	r, err := c.call("attached-verify", &request{Signature: sig, Nonce: nonce})
+	if err != nil {
+		return nil, err
+	}
+	return r.Message, nil
+}
+
+// TimeoutVerify checks a signature made by TimeoutSign, and that it hasn't expired
+func (c *Client) TimeoutVerify(message []byte, signature string) (bool, error) {
+	return c.verify("timeout-verify", message, signature)
+}
+
+// UnversionedVerify checks a signature made by UnversionedSign
+func (c *Client) UnversionedVerify(message []byte, signature string) (bool, error) {
+	return c.verify("unversioned-verify", message, signature)
+}
@@ -0,0 +1,164 @@
+/*
+Package remote serves a key set over HTTP, so the private keys stay on a
+hardened host while the applications using them keep the dkeyczar interfaces.
+A Server answers the operations of a Crypter and a Signer held server-side,
+and a Client is a Crypter and a Signer carrying out each call on the server.
+
+Every operation is a POST of a JSON request to /v1/<operation>, e.g.
+
+	POST /v1/encrypt {"plaintext": "<base64>"}
+	200 OK {"ciphertext": "<base64>"}
+
+with byte strings in standard base64.  The server works on raw ciphertexts
+and signatures, and on uncompressed plaintexts: the client applies its own
+encoding and compression, so it behaves as a local Crypter or Signer would.
+A failed operation answers {"error": "<message>"}, with 404 Not Found for an
+operation the server has no key set for.
+
+The server doesn't authenticate its clients itself: put it behind TLS and
+wrap it in an httpsig.Handler, with the client using an httpsig.Transport.
+*/
+package remote
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"github.com/dgryski/dkeyczar"
+)
+
+// the largest request body the server reads
+const maxRequestSize = 32 << 20
+
+// ErrNoKeySet is returned by a Client for an operation the server has no key set for
+var ErrNoKeySet = errors.New("remote: the server has no key set for the operation")
+
+// An Error is an error returned by the server.  errors.Is matches it against the dkeyczar
+// errors by their messages, e.g. errors.Is(err, dkeyczar.ErrInvalidSignature) for a forged ciphertext.
+type Error struct {
+	StatusCode int
+	Message    string
+}
+
+func (e *Error) Error() string {
+	return "remote: " + e.Message
+}
+
+func (e *Error) Is(target error) bool {
+	return target != nil && target.Error() != "" && strings.Contains(e.Message, target.Error())
+}
+
+// the body of every request
+type request struct {
+	Plaintext  []byte `json:"plaintext,omitempty"`
+	Ciphertext []byte `json:"ciphertext,omitempty"`
+	Message    []byte `json:"message,omitempty"`
+	Signature  []byte `json:"signature,omitempty"`
+	Nonce      []byte `json:"nonce,omitempty"`
+	Expiration int64  `json:"expiration,omitempty"`
+}
+
+// the body of every response
+type response struct {
+	Plaintext  []byte `json:"plaintext,omitempty"`
+	Ciphertext []byte `json:"ciphertext,omitempty"`
+	Message    []byte `json:"message,omitempty"`
+	Signature  []byte `json:"signature,omitempty"`
+	Valid      bool   `json:"valid,omitempty"`
+	Error      string `json:"error,omitempty"`
+}
+
+// A Server serves the operations of Crypter and Signer over HTTP.  Either may be nil.
+type Server struct {
+	crypter dkeyczar.Crypter
+	signer  dkeyczar.Signer
+}
+
+// NewServer returns a Server for crypter and signer, either of which may be nil.
+// It sets their encoding and compression to NO_ENCODING and NO_COMPRESSION, so they must not be shared.
+func NewServer(crypter dkeyczar.Crypter, signer dkeyczar.Signer) *Server {
+	if crypter != nil {
+		crypter.SetEncoding(dkeyczar.NO_ENCODING)
+		crypter.SetCompression(dkeyczar.NO_COMPRESSION)
+	}
+	if signer != nil {
+		signer.SetEncoding(dkeyczar.NO_ENCODING)
+	}
+	return &Server{crypter: crypter, signer: signer}
+}
+
+// carry out the operation op, returning nil if there is no such operation, or no key set for it
+func (s *Server) do(op string, req *request) (*response, error) {
+	c, sg := s.crypter, s.signer
+	resp := new(response)
+	var err error
+	switch {
+	case op == "encrypt" && c != nil:
+		var ct string
+		ct, err = c.Encrypt(req.Plaintext)
+		resp.Ciphertext = []byte(ct)
+	case op == "decrypt" && c != nil:
+		resp.Plaintext, err = c.Decrypt(string(req.Ciphertext))
+	case op == "sign" && sg != nil:
+		var sig string
+		sig, err = sg.Sign(req.Message)
+		resp.Signature = []byte(sig)
+	case op == "verify" && sg != nil:
+		resp.Valid, err = sg.Verify(req.Message, string(req.Signature))
+	case op == "attached-sign" && sg != nil:
+		var sig string
+		sig, err = sg.AttachedSign(req.Message, req.Nonce)
+		resp.Signature = []byte(sig)
+	case op == "attached-verify" && sg != nil:
+		resp.Message, err = sg.AttachedVerify(string(req.Signature), req.Nonce)
+	case op == "timeout-sign" && sg != nil:
+		var sig string
+		sig, err = sg.TimeoutSign(req.Message, req.Expiration)
+		resp.Signature = []byte(sig)
+	case op == "timeout-verify" && sg != nil:
+		resp.Valid, err = sg.TimeoutVerify(req.Message, string(req.Signature))
+	case op == "unversioned-sign" && sg != nil:
+		var sig string
+		sig, err = sg.UnversionedSign(req.Message)
+		resp.Signature = []byte(sig)
+	case op == "unversioned-verify" && sg != nil:
+		resp.Valid, err = sg.UnversionedVerify(req.Message, string(req.Signature))
+	default:
+		return nil, nil
+	}
+	return resp, err
+}
+
+// ServeHTTP carries out the operation of a request
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if r.Method != "POST" || !strings.HasPrefix(r.URL.Path, "/v1/") {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(&response{Error: "no such operation"})
+		return
+	}
+	var req request
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxRequestSize))
+	if err == nil {
+		err = json.Unmarshal(body, &req)
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(&response{Error: "malformed request"})
+		return
+	}
+	resp, err := s.do(strings.TrimPrefix(r.URL.Path, "/v1/"), &req)
+	switch {
+	case resp == nil:
+		w.WriteHeader(http.StatusNotFound)
+		resp = &response{Error: ErrNoKeySet.Error()}
+	case err != nil:
+		// the client tells a failed operation from a broken server by the status
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		resp = &response{Error: err.Error()}
+	}
+	json.NewEncoder(w).Encode(resp)
+}
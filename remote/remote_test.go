@@ -0,0 +1,131 @@
+package remote
+
+import (
+	"bytes"
+	"errors"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/dgryski/dkeyczar"
+)
+
+// a key set held by a KeyManager
+type jsonsReader []string
+
+func (r jsonsReader) GetMetadata() (string, error) {
+	return r[0], nil
+}
+
+func (r jsonsReader) GetKey(version int) (string, error) {
+	return r[version], nil
+}
+
+// the key set of km as KeyManager.ToJSONs returns it, for keys that can't fail to encrypt
+func mustJSONs(km dkeyczar.KeyManager, encrypter dkeyczar.Encrypter) []string {
+	jsons, err := km.ToJSONs(encrypter)
+	if err != nil {
+		panic(err)
+	}
+	return jsons
+}
+
+func newKeySet(purpose dkeyczar.KeyPurpose, keyType dkeyczar.KeyType) dkeyczar.KeyReader {
+	km := dkeyczar.NewKeyManager()
+	km.Create("remote", purpose, keyType)
+	km.AddKey(0, dkeyczar.S_PRIMARY)
+	return jsonsReader(mustJSONs(km, nil))
+}
+
+func TestRemoteCrypter(t *testing.T) {
+	keys := newKeySet(dkeyczar.P_DECRYPT_AND_ENCRYPT, dkeyczar.T_AES)
+	serverCrypter, _ := dkeyczar.NewCrypter(keys)
+	server := httptest.NewServer(NewServer(serverCrypter, nil))
+	defer server.Close()
+	client := NewClient(server.URL, nil)
+
+	// the client's ciphertexts are those of a local Crypter with the same settings
+	local, _ := dkeyczar.NewCrypter(keys)
+	plaintext := bytes.Repeat([]byte("remote "), 100)
+	for _, settings := range []struct {
+		encoding    dkeyczar.Encoding
+		compression dkeyczar.Compression
+	}{{dkeyczar.BASE64W, dkeyczar.NO_COMPRESSION}, {dkeyczar.HEX, dkeyczar.GZIP}, {dkeyczar.NO_ENCODING, dkeyczar.ZLIB}} {
+		client.SetEncoding(settings.encoding)
+		client.SetCompression(settings.compression)
+		local.SetEncoding(settings.encoding)
+		local.SetCompression(settings.compression)
+		c, err := client.Encrypt(plaintext)
+		if err != nil {
+			t.Fatal("remote encrypt failed: " + err.Error())
+		}
+		if p, err := local.Decrypt(c); err != nil || !bytes.Equal(p, plaintext) {
+			t.Errorf("remote ciphertext didn't decrypt locally with %v: %v", settings, err)
+		}
+		c, _ = local.Encrypt(plaintext)
+		if p, err := client.Decrypt(c); err != nil || !bytes.Equal(p, plaintext) {
+			t.Errorf("local ciphertext didn't decrypt remotely with %v: %v", settings, err)
+		}
+	}
+
+	client.SetEncoding(dkeyczar.BASE64W)
+	client.SetCompression(dkeyczar.NO_COMPRESSION)
+	c, _ := client.Encrypt(plaintext)
+	forged := []byte(c)
+	// another base64 character, so the ciphertext still decodes
+	if forged[len(forged)-2] == 'A' {
+		forged[len(forged)-2] = 'B'
+	} else {
+		forged[len(forged)-2] = 'A'
+	}
+	if _, err := client.Decrypt(string(forged)); !errors.Is(err, dkeyczar.ErrInvalidSignature) {
+		t.Errorf("expected ErrInvalidSignature for a forged ciphertext, got %v", err)
+	}
+	if _, err := client.Sign(plaintext); err != ErrNoKeySet {
+		t.Errorf("expected ErrNoKeySet signing without a signing key set, got %v", err)
+	}
+}
+
+func TestRemoteSigner(t *testing.T) {
+	keys := newKeySet(dkeyczar.P_SIGN_AND_VERIFY, dkeyczar.T_HMAC_SHA1)
+	serverSigner, _ := dkeyczar.NewSigner(keys)
+	server := httptest.NewServer(NewServer(nil, serverSigner))
+	defer server.Close()
+	client := NewClient(server.URL, nil)
+	local, _ := dkeyczar.NewSigner(keys)
+	msg := []byte("message")
+
+	sig, err := client.Sign(msg)
+	if err != nil {
+		t.Fatal("remote sign failed: " + err.Error())
+	}
+	if ok, err := local.Verify(msg, sig); !ok || err != nil {
+		t.Errorf("remote signature didn't verify locally: %v", err)
+	}
+	sig, _ = local.Sign(msg)
+	if ok, err := client.Verify(msg, sig); !ok || err != nil {
+		t.Errorf("local signature didn't verify remotely: %v", err)
+	}
+	if ok, _ := client.Verify([]byte("other"), sig); ok {
+		t.Error("signature of another message verified")
+	}
+
+	attached, err := client.AttachedSign(msg, []byte("nonce"))
+	if err != nil {
+		t.Fatal("remote attached sign failed: " + err.Error())
+	}
+	if m, err := client.AttachedVerify(attached, []byte("nonce")); err != nil || !bytes.Equal(m, msg) {
+		t.Errorf("attached signature mismatch: %q %v", m, err)
+	}
+	timeout, _ := client.TimeoutSign(msg, dkeyczar.ExpirationMillis(time.Now().Add(time.Hour)))
+	if ok, err := local.TimeoutVerify(msg, timeout); !ok || err != nil {
+		t.Errorf("remote timeout signature didn't verify locally: %v", err)
+	}
+	unversioned, _ := client.UnversionedSign(msg)
+	if ok, err := client.UnversionedVerify(msg, unversioned); !ok || err != nil {
+		t.Errorf("remote unversioned signature didn't verify: %v", err)
+	}
+	if _, err := client.Encrypt(msg); err != ErrNoKeySet {
+		t.Errorf("expected ErrNoKeySet encrypting without a crypt key set, got %v", err)
+	}
+}
@@ -0,0 +1,223 @@
+package dkeyczar
+
+import (
+	"encoding/binary"
+	"io"
+	"sync"
+	"time"
+)
+
+// Replay-protected signatures bind a timestamp and a random nonce into the
+// signature, so a verifier can reject signatures that are too old, or that it
+// has seen before.  The format is specific to dkeyczar:
+//	header | timestamp (8 bytes, millis since 1/1/1970 GMT) | nonce (16 bytes) | signature
+// where the signature is over timestamp | nonce | message | version byte.
+
+// ReplayNonceSize is the size of the nonce of a replay-protected signature
+const ReplayNonceSize = 16
+
+// DefaultReplayWindow is how far the timestamp of a replay-protected signature
+// may be from the verifier's clock, unless set with WithReplayWindow
+const DefaultReplayWindow = 5 * time.Minute
+
+// A NonceStore remembers the nonces of the replay-protected signatures a verifier has accepted.
+// It may be shared by many verifiers, e.g. backed by a database shared by several servers.
+type NonceStore interface {
+	// Add records nonce until expiration, in milliseconds since 1/1/1970 GMT, and returns
+	// whether it was new.  The check and the add must be atomic, and safe for concurrent use.
+	Add(nonce []byte, expiration int64) (bool, error)
+}
+
+type memoryNonceStore struct {
+	mu     sync.Mutex
+	nonces map[string]int64 // nonce -> expiration
+	adds   int
+}
+
+// NewMemoryNonceStore returns a NonceStore that keeps the nonces in memory,
+// dropping them once they expire.  It only protects a single process.
+func NewMemoryNonceStore() NonceStore {
+	return &memoryNonceStore{nonces: make(map[string]int64)}
+}
+
+func (s *memoryNonceStore) Add(nonce []byte, expiration int64) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := currentMillis()
+	if exp, ok := s.nonces[string(nonce)]; ok && exp > now {
+		return false, nil
+	}
+	// sweep the expired nonces now and then, so the map stays the size of the window
+	s.adds++
+	if s.adds >= len(s.nonces) {
+		s.adds = 0
+		for n, exp := range s.nonces {
+			if exp <= now {
+				delete(s.nonces, n)
+			}
+		}
+	}
+	s.nonces[string(nonce)] = expiration
+	return true, nil
+}
+
+// A ReplaySigner makes replay-protected signatures.  The Signers made from key sets are ReplaySigners.
+type ReplaySigner interface {
+	// ReplaySign returns a signature for the message bound to the current time and a random nonce
+	ReplaySign(message []byte) (string, error)
+	// ReplaySignWith returns a signature for the message bound to timestamp, in milliseconds since
+	// 1/1/1970 GMT, and nonce, which must be ReplayNonceSize bytes, e.g. a request ID the caller
+	// already has.  The caller must make sure a nonce isn't used twice within the replay window.
+	ReplaySignWith(message []byte, nonce []byte, timestamp int64) (string, error)
+}
+
+type ReplayController interface {
+	// Set the store of nonces already seen
+	SetNonceStore(store NonceStore)
+	// Return the store of nonces already seen
+	NonceStore() NonceStore
+	// Set how far a signature's timestamp may be from the current time, either way
+	SetReplayWindow(window time.Duration)
+	// Return how far a signature's timestamp may be from the current time
+	ReplayWindow() time.Duration
+}
+
+// A ReplayVerifier checks replay-protected signatures.  The Signers and
+// Verifiers made from key sets are ReplayVerifiers.
+type ReplayVerifier interface {
+	ReplayController
+	// ReplayVerify checks a signature made by ReplaySign.  A signature that
+	// verifies but is outside the replay window fails with ErrStaleSignature, and
+	// one whose nonce was seen before fails with ErrReplayedSignature.
+	// It fails with ErrNoNonceStore unless a NonceStore was set.
+	ReplayVerify(message []byte, signature string) (bool, error)
+}
+
+type replayController struct {
+	store  NonceStore
+	window time.Duration
+}
+
+// NonceStore returns the store of nonces the verifier has seen
+func (rc replayController) NonceStore() NonceStore {
+	return rc.store
+}
+
+// SetNonceStore sets the store of nonces the verifier has seen
+func (rc *replayController) SetNonceStore(store NonceStore) {
+	rc.store = store
+}
+
+// ReplayWindow returns how far a signature's timestamp may be from the current time
+func (rc replayController) ReplayWindow() time.Duration {
+	if rc.window == 0 {
+		return DefaultReplayWindow
+	}
+	return rc.window
+}
+
+// SetReplayWindow sets how far a signature's timestamp may be from the current time, 0 for DefaultReplayWindow
+func (rc *replayController) SetReplayWindow(window time.Duration) {
+	rc.window = window
+}
+
+func buildReplaySignedBytes(msg []byte, timestamp int64, nonce []byte) []byte {
+	signedbytes := make([]byte, timestampSize+ReplayNonceSize+len(msg)+1)
+	binary.BigEndian.PutUint64(signedbytes, uint64(timestamp))
+	copy(signedbytes[timestampSize:], nonce)
+	copy(signedbytes[timestampSize+ReplayNonceSize:], msg)
+	signedbytes[len(signedbytes)-1] = kzVersion
+	return signedbytes
+}
+
+// construct and return a replay-protected signature with a random nonce and the current time
+func (ks *keySigner) ReplaySign(msg []byte) (string, error) {
+	nonce := make([]byte, ReplayNonceSize)
+	if _, err := io.ReadFull(ks.kz.random(), nonce); err != nil {
+		return "", err
+	}
+	return ks.ReplaySignWith(msg, nonce, ks.currentTime())
+}
+
+// construct and return a replay-protected signature with the caller's nonce and timestamp
+func (ks *keySigner) ReplaySignWith(msg []byte, nonce []byte, timestamp int64) (string, error) {
+	if len(nonce) != ReplayNonceSize {
+		return "", ErrBadNonceSize
+	}
+	key, err := ks.kz.primaryKey()
+	if err != nil {
+		return "", err
+	}
+	signingKey := key.(signVerifyKey)
+	signature, err := signingKey.Sign(buildReplaySignedBytes(msg, timestamp, nonce))
+	if err != nil {
+		return "", err
+	}
+	signedMsg := make([]byte, kzHeaderLength+timestampSize+ReplayNonceSize+len(signature))
+	offs := copy(signedMsg, makeHeader(key))
+	binary.BigEndian.PutUint64(signedMsg[offs:], uint64(timestamp))
+	offs += timestampSize
+	offs += copy(signedMsg[offs:], nonce)
+	copy(signedMsg[offs:], signature)
+	return ks.encode(signedMsg), nil
+}
+
+// validate a replay-protected signature: it must be cryptographically valid,
+// inside the replay window, and its nonce must be new
+func (ks *keySigner) ReplayVerify(message []byte, signature string) (bool, error) {
+	if ks.store == nil {
+		return false, ErrNoNonceStore
+	}
+	sig, kl, err := splitHeader(ks.encodingController, ks.kz, signature, ErrShortSignature)
+	if err != nil {
+		return false, err
+	}
+	offs := kzHeaderLength
+	if len(sig[offs:]) < timestampSize+ReplayNonceSize {
+		return false, ErrShortSignature
+	}
+	timestamp := int64(binary.BigEndian.Uint64(sig[offs:]))
+	offs += timestampSize
+	nonce := sig[offs : offs+ReplayNonceSize]
+	offs += ReplayNonceSize
+	signedbytes := buildReplaySignedBytes(message, timestamp, nonce)
+	for _, k := range kl {
+		verifyKey := k.(verifyKey)
+		if valid, _ := verifyKey.Verify(signedbytes, sig[offs:]); !valid {
+			continue
+		}
+		window := ks.ReplayWindow().Milliseconds()
+		now := ks.currentTime()
+		if timestamp < now-window || timestamp > now+window {
+			return false, ErrStaleSignature
+		}
+		// once the window has passed the timestamp check rejects it, so the store can forget it
+		fresh, err := ks.store.Add(nonce, timestamp+window)
+		if err != nil {
+			return false, err
+		}
+		if !fresh {
+			return false, ErrReplayedSignature
+		}
+		return true, nil
+	}
+	return false, nil
+}
+
+// WithNonceStore makes a Signer or Verifier check the nonces of replay-protected signatures against store
+func WithNonceStore(store NonceStore) Option {
+	return func(x interface{}) {
+		if rc, ok := x.(ReplayController); ok {
+			rc.SetNonceStore(store)
+		}
+	}
+}
+
+// WithReplayWindow sets how far the timestamp of a replay-protected signature may be from a Signer or Verifier's clock
+func WithReplayWindow(window time.Duration) Option {
+	return func(x interface{}) {
+		if rc, ok := x.(ReplayController); ok {
+			rc.SetReplayWindow(window)
+		}
+	}
+}
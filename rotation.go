@@ -0,0 +1,214 @@
+package dkeyczar
+
+import (
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// KeyChange is a key version found in both key sets compared by DiffKeysets, with differences
+type KeyChange struct {
+	From KeyInfo // the version in the first key set
+	To   KeyInfo // the version in the second key set
+}
+
+// KeysetDiff is the difference between two key sets, as returned by DiffKeysets
+type KeysetDiff struct {
+	Added   []KeyInfo   // versions only in the second key set
+	Removed []KeyInfo   // versions only in the first key set
+	Changed []KeyChange // versions whose status, exportability or key changed
+}
+
+// Empty returns whether the key sets had the same versions, statuses and keys
+func (d *KeysetDiff) Empty() bool {
+	return len(d.Added) == 0 && len(d.Removed) == 0 && len(d.Changed) == 0
+}
+
+// DiffKeysets compares the versions of the key sets in a and b, e.g. a
+// deployed key set and the one about to replace it.  The keys are compared
+// by their key hashes, as described by LoadKeysetInfo, so the keys of an
+// encrypted key set are only compared if its reader decrypts them.
+// Each list is in version order.
+func DiffKeysets(a, b KeyReader) (*KeysetDiff, error) {
+	ka, err := LoadKeysetInfo(a)
+	if err != nil {
+		return nil, err
+	}
+	kb, err := LoadKeysetInfo(b)
+	if err != nil {
+		return nil, err
+	}
+	d := new(KeysetDiff)
+	from := make(map[int]KeyInfo)
+	for _, info := range ka.Keys {
+		from[info.Version] = info
+	}
+	for _, to := range kb.Keys {
+		f, ok := from[to.Version]
+		if !ok {
+			d.Added = append(d.Added, to)
+			continue
+		}
+		delete(from, to.Version)
+		if f.Status != to.Status || f.Exportable != to.Exportable || string(f.KeyHash) != string(to.KeyHash) {
+			d.Changed = append(d.Changed, KeyChange{f, to})
+		}
+	}
+	for _, info := range ka.Keys {
+		if _, ok := from[info.Version]; ok {
+			d.Removed = append(d.Removed, info)
+		}
+	}
+	return d, nil
+}
+
+// RotationPolicy says how long the keys of a key set are used for, for PlanRotation
+type RotationPolicy struct {
+	// rotate the primary key once it is this old, 0 to only add a primary key when there is none
+	MaxAge time.Duration
+	// add the next key as active this long before it is promoted, so every reader of the key set
+	// can decrypt or verify with it before it is used; and keep the old primary active this long
+	// after it is replaced, before demoting it to inactive.  0 promotes new keys straight away.
+	Overlap time.Duration
+	// the size of new keys, 0 for the default
+	KeySize uint
+	// revoke inactive keys once they have been inactive this long, 0 to leave them for the caller to revoke
+	RevokeAfter time.Duration
+}
+
+type RotationAction int
+
+const (
+	ROTATE_ADD_KEY RotationAction = iota // add a new key version with Status
+	ROTATE_PROMOTE                       // promote Version from active to primary
+	ROTATE_DEMOTE                        // demote Version from active to inactive
+	ROTATE_REVOKE                        // revoke Version, which is inactive
+)
+
+func (a RotationAction) String() string {
+	switch a {
+	case ROTATE_ADD_KEY:
+		return "addkey"
+	case ROTATE_PROMOTE:
+		return "promote"
+	case ROTATE_DEMOTE:
+		return "demote"
+	case ROTATE_REVOKE:
+		return "revoke"
+	}
+	return "(unknown RotationAction)"
+}
+
+// RotationOp is one step of a RotationPlan
+type RotationOp struct {
+	Action  RotationAction
+	Version int       // the version promoted, demoted or revoked
+	Status  KeyStatus // the status of the added key
+	Size    uint      // the size of the added key, 0 for the default
+}
+
+// String names the operation like the keyczart command that does it, e.g. "promote --version=3"
+func (op RotationOp) String() string {
+	if op.Action == ROTATE_ADD_KEY {
+		return op.Action.String() + " --status=" + strings.ToLower(op.Status.String())
+	}
+	return op.Action.String() + " --version=" + strconv.Itoa(op.Version)
+}
+
+// RotationPlan is the list of operations that bring a key set in line with a RotationPolicy
+type RotationPlan []RotationOp
+
+// Apply performs the operations of the plan on km, which must hold the key set the plan was made for
+func (p RotationPlan) Apply(km KeyManager) error {
+	for _, op := range p {
+		switch op.Action {
+		case ROTATE_ADD_KEY:
+			if err := km.AddKey(op.Size, op.Status); err != nil {
+				return err
+			}
+		case ROTATE_PROMOTE:
+			km.Promote(op.Version)
+		case ROTATE_DEMOTE:
+			km.Demote(op.Version)
+		case ROTATE_REVOKE:
+			if err := km.Revoke(op.Version); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// PlanRotation returns the operations due at time now to rotate the key set in reader under policy:
+// adding the next key as active once the primary key is within policy.Overlap of policy.MaxAge,
+// promoting it once the primary key is policy.MaxAge old and the new key policy.Overlap old,
+// demoting the active keys older than the primary once they have been replaced for policy.Overlap,
+// and revoking inactive keys once they have been inactive for policy.RevokeAfter.
+// The age of a key is taken from its creation time, and how long it has had its status from the
+// time of its last status change, which key versions only have if this implementation added or
+// changed them.  A primary key of unknown age is taken to be due for rotation, but keys are never
+// demoted or revoked unless it is known how long they have had their status.
+func PlanRotation(reader KeyReader, policy RotationPolicy, now time.Time) (RotationPlan, error) {
+	meta, err := GetKeyMeta(reader)
+	if err != nil {
+		return nil, err
+	}
+	return planRotation(meta, policy, now), nil
+}
+
+func planRotation(meta *KeyMeta, policy RotationPolicy, now time.Time) RotationPlan {
+	versions := append([]KeyVersion(nil), meta.Versions...)
+	sort.Slice(versions, func(i, j int) bool { return versions[i].VersionNumber < versions[j].VersionNumber })
+	since := func(millis int64) time.Duration {
+		return now.Sub(time.Unix(0, millis*int64(time.Millisecond)))
+	}
+	age := func(kv KeyVersion) time.Duration {
+		if kv.Created == 0 {
+			return math.MaxInt64
+		}
+		return since(kv.Created)
+	}
+
+	var primary, staged *KeyVersion
+	for i := range versions {
+		if versions[i].Status == S_PRIMARY {
+			primary = &versions[i]
+		}
+	}
+	for i := range versions {
+		// the newest active key after the primary is the next one to use
+		if versions[i].Status == S_ACTIVE && (primary == nil || versions[i].VersionNumber > primary.VersionNumber) {
+			staged = &versions[i]
+		}
+	}
+
+	var plan RotationPlan
+	switch {
+	case primary == nil && staged != nil:
+		plan = append(plan, RotationOp{Action: ROTATE_PROMOTE, Version: staged.VersionNumber})
+	case primary == nil:
+		plan = append(plan, RotationOp{Action: ROTATE_ADD_KEY, Status: S_PRIMARY, Size: policy.KeySize})
+	case policy.MaxAge == 0:
+		// the primary key is never rotated
+	case staged == nil && age(*primary) >= policy.MaxAge && policy.Overlap == 0:
+		plan = append(plan, RotationOp{Action: ROTATE_ADD_KEY, Status: S_PRIMARY, Size: policy.KeySize})
+	case staged == nil && age(*primary) >= policy.MaxAge-policy.Overlap:
+		plan = append(plan, RotationOp{Action: ROTATE_ADD_KEY, Status: S_ACTIVE, Size: policy.KeySize})
+	case staged != nil && age(*primary) >= policy.MaxAge && age(*staged) >= policy.Overlap:
+		plan = append(plan, RotationOp{Action: ROTATE_PROMOTE, Version: staged.VersionNumber})
+	}
+	for _, kv := range versions {
+		switch {
+		case kv.StatusChanged == 0:
+			// how long it has had its status is unknown
+		case kv.Status == S_ACTIVE && primary != nil && kv.VersionNumber < primary.VersionNumber &&
+			policy.MaxAge != 0 && since(kv.StatusChanged) >= policy.Overlap:
+			plan = append(plan, RotationOp{Action: ROTATE_DEMOTE, Version: kv.VersionNumber})
+		case kv.Status == S_INACTIVE && policy.RevokeAfter != 0 && since(kv.StatusChanged) >= policy.RevokeAfter:
+			plan = append(plan, RotationOp{Action: ROTATE_REVOKE, Version: kv.VersionNumber})
+		}
+	}
+	return plan
+}
@@ -0,0 +1,109 @@
+package dkeyczar
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+	"time"
+)
+
+// A Rotator rotates a key set on a schedule: every Interval it plans the
+// rotation due under Policy, as PlanRotation does, applies it to the key set
+// held by its KeyManager, and writes the result with its KeyWriter.
+// Set the hooks before calling Run.
+type Rotator struct {
+	Policy   RotationPolicy
+	Interval time.Duration // how often to check the key set, 0 for an hour
+
+	// Approve, if set, is called with each plan before it is applied.  If it
+	// returns false the plan is skipped, and planned again at the next check.
+	Approve func(plan RotationPlan) bool
+	// Notify, if set, is called after each plan is applied and written, or a failed write is
+	// retried with an empty plan, with the error if that failed
+	Notify func(plan RotationPlan, err error)
+
+	mu        sync.Mutex
+	km        KeyManager
+	w         KeyWriter
+	encrypter Encrypter
+	unwritten bool             // km holds changes the KeyWriter failed to store
+	now       func() time.Time // for tests
+}
+
+// NewRotator returns a Rotator for the key set held by km, which it writes to w.
+// If encrypter isn't nil, the keys are written encrypted with it, as by KeyManager.ToJSONs.
+// km must not be used by anything else while the Rotator runs.
+func NewRotator(km KeyManager, w KeyWriter, encrypter Encrypter, policy RotationPolicy) *Rotator {
+	return &Rotator{Policy: policy, km: km, w: w, encrypter: encrypter, now: time.Now}
+}
+
+// return the metadata of the key set held by km
+func keyManagerMeta(km KeyManager) (*KeyMeta, error) {
+	if m, ok := km.(*keyManager); ok && m.kz != nil {
+		return &m.kz.keymeta, nil
+	}
+	jsons, err := km.ToJSONs(nil)
+	if err != nil {
+		return nil, err
+	}
+	meta := new(KeyMeta)
+	if err := json.Unmarshal([]byte(jsons[0]), meta); err != nil {
+		return nil, err
+	}
+	return meta, nil
+}
+
+// Rotate checks the key set once, and applies and writes the plan that is due, if any.
+// It returns the plan, which is empty if nothing was due, or nil if it wasn't approved.
+func (r *Rotator) Rotate() (RotationPlan, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	meta, err := keyManagerMeta(r.km)
+	if err != nil {
+		return nil, err
+	}
+	plan := planRotation(meta, r.Policy, r.now())
+	if len(plan) == 0 && !r.unwritten {
+		return plan, nil
+	}
+	if len(plan) != 0 {
+		if r.Approve != nil && !r.Approve(plan) {
+			return nil, nil
+		}
+		// even a plan that fails part way through may change the key set
+		r.unwritten = true
+		err = plan.Apply(r.km)
+	}
+	var jsons []string
+	if err == nil {
+		jsons, err = r.km.ToJSONs(r.encrypter)
+	}
+	if err == nil {
+		if err = r.w.WriteKeyset(jsons); err == nil {
+			r.unwritten = false
+		}
+	}
+	if r.Notify != nil {
+		r.Notify(plan, err)
+	}
+	return plan, err
+}
+
+// Run calls Rotate straight away and then every Interval, until ctx is done.
+// Errors are passed to Notify, and the next check tries again.
+func (r *Rotator) Run(ctx context.Context) error {
+	interval := r.Interval
+	if interval == 0 {
+		interval = time.Hour
+	}
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		r.Rotate()
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-t.C:
+		}
+	}
+}
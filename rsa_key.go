@@ -1,22 +1,28 @@
 package dkeyczar
 import (
 	"crypto"
-	"crypto/rand"
 	"crypto/rsa"
 	"crypto/sha1"
+	"crypto/sha256"
 	"encoding/binary"
 	"encoding/json"
+	"hash"
+	"io"
 	"math/big"
 )
 type rsaPublicKeyJSON struct {
 	Modulus        string `json:"modulus"`
 	PublicExponent string `json:"publicExponent"`
 	Size           uint   `json:"size"`
+	// not "padding", which other implementations use for the encryption padding
+	SignatureScheme RSASignatureScheme `json:"signatureScheme,omitempty"`
 }
 
 type rsaPublicKey struct {
-	key rsa.PublicKey
-	id  []byte
+	key    rsa.PublicKey
+	scheme RSASignatureScheme
+	id     []byte
+	randSource
 }
 
 type rsaKeyJSON struct {
@@ -33,9 +39,10 @@ type rsaKeyJSON struct {
 type rsaKey struct {
 	key       rsa.PrivateKey
 	publicKey rsaPublicKey
+	randSource
 }
 
-func generateRSAKey(size uint) (*rsaKey, error) {
+func generateRSAKey(size uint, rng io.Reader) (*rsaKey, error) {
 	rsakey := new(rsaKey)
 	if size == 0 {
 		size = T_RSA_PRIV.defaultSize()
@@ -43,7 +50,7 @@ func generateRSAKey(size uint) (*rsaKey, error) {
 	if !T_RSA_PRIV.isAcceptableSize(size) {
 		return nil, ErrInvalidKeySize
 	}
-	priv, err := rsa.GenerateKey(rand.Reader, int(size))
+	priv, err := rsa.GenerateKey(rng, int(size))
 	if err != nil {
 		return nil, err
 	}
@@ -93,20 +100,22 @@ func newRSAPublicKeyFromJSON(s []byte) (*rsaPublicKey, error) {
 		return nil, ErrBase64Decoding
 	}
 	rsakey.key.E = int(big.NewInt(0).SetBytes(b).Int64())
+	rsakey.scheme = rsajson.SignatureScheme
 	return rsakey, nil
 }
 
-func newRSAPublicJSONFromKey(key *rsa.PublicKey) *rsaPublicKeyJSON {
+func newRSAPublicJSONFromKey(key *rsa.PublicKey, scheme RSASignatureScheme) *rsaPublicKeyJSON {
 	rsajson := new(rsaPublicKeyJSON)
 	rsajson.Modulus = encodeWeb64String(bigIntBytes(key.N))
 	e := big.NewInt(int64(key.E))
 	rsajson.PublicExponent = encodeWeb64String(bigIntBytes(e))
 	rsajson.Size = uint(len(key.N.Bytes())) * 8
+	rsajson.SignatureScheme = scheme
 	return rsajson
 }
 
 func (rk *rsaPublicKey) ToKeyJSON() []byte {
-	j := newRSAPublicJSONFromKey(&rk.key)
+	j := newRSAPublicJSONFromKey(&rk.key, rk.scheme)
 	s, _ := json.Marshal(j)
 	return s
 }
@@ -165,16 +174,17 @@ func newRSAKeyFromJSON(s []byte) (*rsaKey, error) {
 	}
 	rsakey.key.PublicKey.E = int(big.NewInt(0).SetBytes(b).Int64())
 	rsakey.publicKey.key.E = rsakey.key.PublicKey.E
+	rsakey.publicKey.scheme = rsajson.PublicKey.SignatureScheme
 	return rsakey, nil
 }
 
 func (rk *rsaKey) ToKeyJSON() []byte {
-	j := newRSAJSONFromKey(&rk.key)
+	j := newRSAJSONFromKey(&rk.key, rk.publicKey.scheme)
 	s, _ := json.Marshal(j)
 	return s
 }
 
-func newRSAJSONFromKey(key *rsa.PrivateKey) *rsaKeyJSON {
+func newRSAJSONFromKey(key *rsa.PrivateKey, scheme RSASignatureScheme) *rsaKeyJSON {
 	rsajson := new(rsaKeyJSON)
 	rsajson.PublicKey.Modulus = encodeWeb64String(bigIntBytes(key.PublicKey.N))
 	e := big.NewInt(int64(key.PublicKey.E))
@@ -187,13 +197,37 @@ func newRSAJSONFromKey(key *rsa.PrivateKey) *rsaKeyJSON {
 	rsajson.CrtCoefficient = encodeWeb64String(bigIntBytes(key.Precomputed.Qinv))
 	rsajson.Size = uint(len(key.N.Bytes())) * 8
 	rsajson.PublicKey.Size = uint(len(key.N.Bytes())) * 8
+	rsajson.PublicKey.SignatureScheme = scheme
 	return rsajson
 }
 
+// PSS signatures use SHA-256 with a salt the length of the hash, matching the
+// PS256 parameters expected by JWT and TLS verifiers.
+var pssOptions = &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash, Hash: crypto.SHA256}
+
+// the hash the signatures are made over
+func (rk *rsaPublicKey) newHash() hash.Hash {
+	if rk.scheme == SIG_PSS {
+		return sha256.New()
+	}
+	return sha1.New()
+}
+
+func (rk *rsaKey) newHash() hash.Hash {
+	return rk.publicKey.newHash()
+}
+
 func (rk *rsaKey) Sign(msg []byte) ([]byte, error) {
-	h := sha1.New()
+	h := rk.newHash()
 	h.Write(msg)
-	s, err := rsa.SignPKCS1v15(rand.Reader, &rk.key, crypto.SHA1, h.Sum(nil))
+	return rk.SignDigest(h.Sum(nil))
+}
+
+func (rk *rsaKey) SignDigest(digest []byte) ([]byte, error) {
+	if rk.publicKey.scheme == SIG_PSS {
+		return rsa.SignPSS(rk.random(), &rk.key, crypto.SHA256, digest, pssOptions)
+	}
+	s, err := rsa.SignPKCS1v15(rk.random(), &rk.key, crypto.SHA1, digest)
 	return s, err
 }
 
@@ -201,17 +235,33 @@ func (rk *rsaKey) Verify(msg []byte, signature []byte) (bool, error) {
 	return rk.publicKey.Verify(msg, signature)
 }
 
+func (rk *rsaKey) VerifyDigest(digest []byte, signature []byte) (bool, error) {
+	return rk.publicKey.VerifyDigest(digest, signature)
+}
+
 func (rk *rsaPublicKey) Verify(msg []byte, signature []byte) (bool, error) {
-	h := sha1.New()
+	h := rk.newHash()
 	h.Write(msg)
-	return rsa.VerifyPKCS1v15(&rk.key, crypto.SHA1, h.Sum(nil), signature) == nil, nil
+	return rk.VerifyDigest(h.Sum(nil), signature)
+}
+
+func (rk *rsaPublicKey) VerifyDigest(digest []byte, signature []byte) (bool, error) {
+	if rk.scheme == SIG_PSS {
+		return rsa.VerifyPSS(&rk.key, crypto.SHA256, digest, signature, pssOptions) == nil, nil
+	}
+	return rsa.VerifyPKCS1v15(&rk.key, crypto.SHA1, digest, signature) == nil, nil
 }
 
 func (rk *rsaPublicKey) Encrypt(msg []byte) ([]byte, error) {
+	return rk.encryptWithAAD(msg, nil)
+}
+
+// associated data is bound in as the OAEP label
+func (rk *rsaPublicKey) encryptWithAAD(msg []byte, aad []byte) ([]byte, error) {
 	// FIXME: If msg is too long for keysize, EncryptOAEP returns an error
 	// Do we want to return a Keyczar error here, either by checking
 	// ourselves for this case or by wrapping the returned error?
-	s, err := rsa.EncryptOAEP(sha1.New(), rand.Reader, &rk.key, msg, nil)
+	s, err := rsa.EncryptOAEP(sha1.New(), rk.random(), &rk.key, msg, aad)
 	if err != nil {
 		return nil, err
 	}
@@ -219,12 +269,26 @@ func (rk *rsaPublicKey) Encrypt(msg []byte) ([]byte, error) {
 	return h, nil
 }
 
+// the public half encrypts, so it needs the random source too
+func (rk *rsaKey) setRand(rng io.Reader) {
+	rk.randSource.setRand(rng)
+	rk.publicKey.setRand(rng)
+}
+
 func (rk *rsaKey) Encrypt(msg []byte) ([]byte, error) {
 	return rk.publicKey.Encrypt(msg)
 }
 
+func (rk *rsaKey) encryptWithAAD(msg []byte, aad []byte) ([]byte, error) {
+	return rk.publicKey.encryptWithAAD(msg, aad)
+}
+
 func (rk *rsaKey) Decrypt(msg []byte) ([]byte, error) {
-	s, err := rsa.DecryptOAEP(sha1.New(), rand.Reader, &rk.key, msg[kzHeaderLength:], nil)
+	return rk.decryptWithAAD(msg, nil)
+}
+
+func (rk *rsaKey) decryptWithAAD(msg []byte, aad []byte) ([]byte, error) {
+	s, err := rsa.DecryptOAEP(sha1.New(), rk.random(), &rk.key, msg[kzHeaderLength:], aad)
 	if err != nil {
 		return nil, err
 	}
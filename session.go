@@ -7,9 +7,16 @@ import (
 	"io"
 )
 
-// NewSessionEncrypter returns an Encrypter that has been initailized with a random session key.  This key material is encrypted with crypter and returned.
+// NewSessionEncrypter returns an Encrypter that has been initialized with a random session key.  This key material is encrypted with crypter and returned.
+// Only the (small) session key blob is encrypted with the possibly expensive encrypter, e.g. an RSA public key;
+// the data itself is encrypted with AES+HMAC.
 func NewSessionEncrypter(encrypter Encrypter) (EncryptStreamer, string, error) {
-	aeskey, _ := generateAESKey(0) // shouldn't fail
+	aeskey, err := generateAESKey(0, rand.Reader)
+	if err != nil {
+		return nil, "", err
+	}
+	// the session crypter parses its own copy of the key
+	defer wipeKeydata(aeskey)
 	r := newImportedAESKeyReader(aeskey)
 	keys, err := encrypter.Encrypt(aeskey.packedKeys())
 	if err != nil {
@@ -19,6 +26,8 @@ func NewSessionEncrypter(encrypter Encrypter) (EncryptStreamer, string, error) {
 	return sessionCrypter, keys, err
 }
 
+// NewSessionEncryptWriter returns a writer that encrypts everything written to it with a fresh session key.
+// The encrypted session key blob is written to sink first, prefixed with its length, followed by the encrypted stream.
 func NewSessionEncryptWriter(encrypter Encrypter, sink io.Writer, encoding Encoding, compression Compression) (io.WriteCloser, error) {
 	oldEnc := encrypter.Encoding()
 	defer encrypter.SetEncoding(oldEnc)
@@ -63,6 +72,8 @@ func NewSessionDecrypter(crypter Crypter, sessionKeys string) (CryptStreamer, er
 	return NewCryptStreamer(r)
 }
 
+// NewSessionDecryptReader reads the session key blob written by NewSessionEncryptWriter from source, decrypts it with crypter
+// and returns a reader for the decrypted stream.
 func NewSessionDecryptReader(crypter Crypter, source io.Reader, encoding Encoding, compression Compression) (io.ReadCloser, error) {
 	oldEnc := crypter.Encoding()
 	defer crypter.SetEncoding(oldEnc)
@@ -90,14 +101,22 @@ func NewSessionDecryptReader(crypter Crypter, source io.Reader, encoding Encodin
 	return reader, err
 }
 
-// NewSignedSessionEncrypter returns an Encrypter that has been initailized with a random session key.  This key material is encrypted with crypter and returned.
+// NewSignedSessionEncrypter returns an Encrypter that has been initialized with a random session key.  This key material is encrypted with crypter and returned.
+// Every ciphertext is attached-signed by signer with the session nonce, so the receiver can authenticate the sender.
 func NewSignedSessionEncrypter(encrypter Encrypter, signer Signer) (SignedEncrypter, string, error) {
-	aeskey, _ := generateAESKey(0) // shouldn't fail
+	aeskey, err := generateAESKey(0, rand.Reader)
+	if err != nil {
+		return nil, "", err
+	}
+	// the session crypter parses its own copy of the key
+	defer wipeKeydata(aeskey)
 	r := newImportedAESKeyReader(aeskey)
 	nonce := make([]byte, 16)
-	io.ReadFull(rand.Reader, nonce)
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, "", err
+	}
 	sm := new(sessionMaterial)
-	sm.key = *aeskey
+	sm.key = aesKey{key: aeskey.key, hmac: aeskey.hmac}
 	sm.nonce = nonce
 	keys, err := encrypter.Encrypt(sm.ToSessionMaterialJSON())
 	if err != nil {
@@ -0,0 +1,191 @@
+package dkeyczar
+
+import (
+	"crypto/rand"
+	"io"
+)
+
+// Split knowledge: the secret protecting a key set, either the password of a
+// PBE encrypted key set or the whole crypter key set of an encrypted one, split
+// into n shares with Shamir's secret sharing over GF(2^8), any threshold of
+// which rebuild it.  Fewer shares tell nothing about the secret, so no one
+// holder can load the key set alone.  A share looks like:
+// |version|kind|threshold|split id|x|y|
+// where the split id is random, the same for all the shares of a split, so
+// shares of different splits aren't combined, and y has one byte per byte of
+// the secret.  Shares are encoded in web-safe base64.
+
+const shareVersion = uint8(1)
+
+// what a share is a share of
+const (
+	shareKindPassword = uint8(0)
+	shareKindKeySet   = uint8(1)
+)
+
+const shareSplitIDLength = 4
+
+// the share bytes before y
+const shareHeaderLength = 3 + shareSplitIDLength + 1
+
+// multiply in GF(2^8) with the AES polynomial, without tables so the time doesn't depend on the operands
+func gfMul(a, b byte) byte {
+	var p byte
+	for i := 0; i < 8; i++ {
+		p ^= -(b & 1) & a
+		a = a<<1 ^ -(a>>7)&0x1b
+		b >>= 1
+	}
+	return p
+}
+
+// the inverse of a, a^254, for a != 0
+func gfInv(a byte) byte {
+	r := byte(1)
+	for i := 0; i < 7; i++ {
+		a = gfMul(a, a)
+		r = gfMul(r, a)
+	}
+	return r
+}
+
+func splitSecret(secret []byte, kind uint8, n, threshold int) ([]string, error) {
+	if threshold < 2 || n < threshold || n > 255 || len(secret) == 0 {
+		return nil, ErrInvalidShares
+	}
+	id := make([]byte, shareSplitIDLength)
+	if _, err := io.ReadFull(rand.Reader, id); err != nil {
+		return nil, err
+	}
+	shares := make([][]byte, n)
+	for i := range shares {
+		s := make([]byte, shareHeaderLength, shareHeaderLength+len(secret))
+		s[0], s[1], s[2] = shareVersion, kind, byte(threshold)
+		copy(s[3:], id)
+		s[shareHeaderLength-1] = byte(i + 1)
+		shares[i] = s
+	}
+	// a random polynomial of degree threshold-1 for each byte, with the byte as its constant term
+	coeffs := make([]byte, threshold)
+	defer wipeBytes(coeffs)
+	for _, b := range secret {
+		coeffs[0] = b
+		if _, err := io.ReadFull(rand.Reader, coeffs[1:]); err != nil {
+			return nil, err
+		}
+		for i := range shares {
+			x := byte(i + 1)
+			var y byte
+			for j := threshold - 1; j >= 0; j-- {
+				y = gfMul(y, x) ^ coeffs[j]
+			}
+			shares[i] = append(shares[i], y)
+		}
+	}
+	encoded := make([]string, n)
+	for i, s := range shares {
+		encoded[i] = encodeWeb64String(s)
+		wipeBytes(s)
+	}
+	return encoded, nil
+}
+
+// SplitPassword splits the password of a PBE encrypted key set into n shares, any threshold of which
+// NewSharedSecretReader combines to read the key set.  threshold must be at least 2, and n at most 255.
+func SplitPassword(password []byte, n, threshold int) ([]string, error) {
+	return splitSecret(password, shareKindPassword, n, threshold)
+}
+
+// SplitKeySet splits the crypter key set in reader, which encrypts another key set, into n shares,
+// any threshold of which NewSharedSecretReader combines to read that key set.
+// threshold must be at least 2, and n at most 255.
+func SplitKeySet(reader KeyReader, n, threshold int) ([]string, error) {
+	b, err := ExportJSON(reader)
+	if err != nil {
+		return nil, err
+	}
+	defer wipeBytes(b)
+	return splitSecret(b, shareKindKeySet, n, threshold)
+}
+
+// combine shares into the secret they are shares of, and its kind
+func combineShares(encoded []string) ([]byte, uint8, error) {
+	if len(encoded) == 0 {
+		return nil, 0, ErrInvalidShares
+	}
+	shares := make([][]byte, len(encoded))
+	for i, e := range encoded {
+		s, err := decodeWeb64String(e)
+		if err != nil {
+			return nil, 0, ErrInvalidShares
+		}
+		defer wipeBytes(s)
+		if len(s) <= shareHeaderLength || s[0] != shareVersion || s[shareHeaderLength-1] == 0 {
+			return nil, 0, ErrInvalidShares
+		}
+		if i > 0 && (string(s[:shareHeaderLength-1]) != string(shares[0][:shareHeaderLength-1]) || len(s) != len(shares[0])) {
+			// shares of another split
+			return nil, 0, ErrInvalidShares
+		}
+		for _, t := range shares[:i] {
+			if t[shareHeaderLength-1] == s[shareHeaderLength-1] {
+				return nil, 0, ErrInvalidShares
+			}
+		}
+		shares[i] = s
+	}
+	threshold := int(shares[0][2])
+	if threshold < 2 || len(shares) < threshold {
+		return nil, 0, ErrInvalidShares
+	}
+	shares = shares[:threshold]
+	// Lagrange interpolation at 0: the secret is the sum of y_i * prod(x_j / (x_j - x_i)), j != i
+	weights := make([]byte, threshold)
+	for i, s := range shares {
+		xi := s[shareHeaderLength-1]
+		w := byte(1)
+		for j, t := range shares {
+			if j != i {
+				xj := t[shareHeaderLength-1]
+				w = gfMul(w, gfMul(xj, gfInv(xj^xi)))
+			}
+		}
+		weights[i] = w
+	}
+	secret := make([]byte, len(shares[0])-shareHeaderLength)
+	for k := range secret {
+		var b byte
+		for i, s := range shares {
+			b ^= gfMul(s[shareHeaderLength+k], weights[i])
+		}
+		secret[k] = b
+	}
+	return secret, shares[0][1], nil
+}
+
+// NewSharedSecretReader returns a KeyReader for the encrypted key set in reader, decrypted with the
+// secret rebuilt from shares made by SplitPassword or SplitKeySet.  At least the threshold of shares
+// must be given, all from the same split; otherwise ErrInvalidShares is returned.  A share that was
+// modified gives a wrong secret, which fails when the keys are read.
+func NewSharedSecretReader(reader KeyReader, shares ...string) (KeyReader, error) {
+	secret, kind, err := combineShares(shares)
+	if err != nil {
+		return nil, err
+	}
+	defer wipeBytes(secret)
+	switch kind {
+	case shareKindPassword:
+		return NewPBEReader(reader, secret), nil
+	case shareKindKeySet:
+		kek, err := NewJSONReader(secret)
+		if err != nil {
+			return nil, ErrInvalidShares
+		}
+		crypter, err := NewCrypter(kek)
+		if err != nil {
+			return nil, err
+		}
+		return NewEncryptedReader(reader, crypter), nil
+	}
+	return nil, ErrInvalidShares
+}
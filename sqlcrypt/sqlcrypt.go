@@ -0,0 +1,145 @@
+/*
+Package sqlcrypt encrypts database columns transparently.  EncryptedString and
+EncryptedBytes implement driver.Valuer and sql.Scanner: they are encrypted with
+a dkeyczar Crypter when written, and decrypted when read.
+
+	sqlcrypt.SetCrypter(crypter)
+	db.Exec("INSERT INTO users (id, ssn) VALUES (?, ?)", id, sqlcrypt.EncryptedString{String: ssn})
+	var ssn sqlcrypt.EncryptedString
+	db.QueryRow("SELECT ssn FROM users WHERE id = ?", id).Scan(&ssn)
+
+The column holds the ciphertext as a string, in the Crypter's encoding, so it
+must be a text or binary column wide enough for it.
+
+After a key rotation, a value read with an older key version is marked Stale.
+Writing it back encrypts it with the primary key, so the columns move off the
+old versions lazily, as their rows are updated.
+*/
+package sqlcrypt
+
+import (
+	"database/sql/driver"
+	"errors"
+	"sync"
+
+	"github.com/dgryski/dkeyczar"
+)
+
+// ErrNoCrypter is returned when a value has no Crypter and none was set with SetCrypter
+var ErrNoCrypter = errors.New("sqlcrypt: no Crypter set")
+
+// ErrUnsupportedColumn is returned by Scan for a column that is neither text nor binary
+var ErrUnsupportedColumn = errors.New("sqlcrypt: encrypted column must be text or binary")
+
+var (
+	mu             sync.RWMutex
+	defaultCrypter dkeyczar.Crypter
+)
+
+// SetCrypter sets the Crypter used by the values whose Crypter is nil
+func SetCrypter(crypter dkeyczar.Crypter) {
+	mu.Lock()
+	defaultCrypter = crypter
+	mu.Unlock()
+}
+
+func crypterFor(c dkeyczar.Crypter) (dkeyczar.Crypter, error) {
+	if c != nil {
+		return c, nil
+	}
+	mu.RLock()
+	defer mu.RUnlock()
+	if defaultCrypter == nil {
+		return nil, ErrNoCrypter
+	}
+	return defaultCrypter, nil
+}
+
+func encrypt(c dkeyczar.Crypter, null bool, plaintext []byte) (driver.Value, error) {
+	if null {
+		return nil, nil
+	}
+	crypter, err := crypterFor(c)
+	if err != nil {
+		return nil, err
+	}
+	return crypter.Encrypt(plaintext)
+}
+
+// decrypt a column value, reporting whether it is NULL, and whether it was encrypted with a key version other than the primary
+func decrypt(c dkeyczar.Crypter, src interface{}) (plaintext []byte, null bool, stale bool, err error) {
+	var ciphertext string
+	switch src := src.(type) {
+	case nil:
+		return nil, true, false, nil
+	case string:
+		ciphertext = src
+	case []byte:
+		ciphertext = string(src)
+	default:
+		return nil, false, false, ErrUnsupportedColumn
+	}
+	crypter, err := crypterFor(c)
+	if err != nil {
+		return nil, false, false, err
+	}
+	id, ok1 := crypter.(dkeyczar.InfoDecrypter)
+	ve, ok2 := crypter.(dkeyczar.VersionedEncrypter)
+	if !ok1 || !ok2 {
+		plaintext, err = crypter.Decrypt(ciphertext)
+		return plaintext, false, false, err
+	}
+	plaintext, info, err := id.DecryptWithInfo(ciphertext)
+	if err != nil {
+		return nil, false, false, err
+	}
+	return plaintext, false, info.Version != ve.PrimaryVersion(), nil
+}
+
+// An EncryptedString is a string column stored encrypted
+type EncryptedString struct {
+	String  string
+	Null    bool             // the column is SQL NULL
+	Stale   bool             // set by Scan when the column was encrypted with a key version other than the primary
+	Crypter dkeyczar.Crypter // the Crypter to use, nil for the one set with SetCrypter
+}
+
+// Value encrypts the string with the primary key, or returns NULL if Null is set
+func (s EncryptedString) Value() (driver.Value, error) {
+	return encrypt(s.Crypter, s.Null, []byte(s.String))
+}
+
+// Scan decrypts a column made by Value
+func (s *EncryptedString) Scan(src interface{}) error {
+	plaintext, null, stale, err := decrypt(s.Crypter, src)
+	if err != nil {
+		return err
+	}
+	s.String, s.Null, s.Stale = string(plaintext), null, stale
+	return nil
+}
+
+// An EncryptedBytes is a byte slice column stored encrypted
+type EncryptedBytes struct {
+	Bytes   []byte           // nil for SQL NULL
+	Stale   bool             // set by Scan when the column was encrypted with a key version other than the primary
+	Crypter dkeyczar.Crypter // the Crypter to use, nil for the one set with SetCrypter
+}
+
+// Value encrypts the bytes with the primary key, or returns NULL if Bytes is nil
+func (b EncryptedBytes) Value() (driver.Value, error) {
+	return encrypt(b.Crypter, b.Bytes == nil, b.Bytes)
+}
+
+// Scan decrypts a column made by Value
+func (b *EncryptedBytes) Scan(src interface{}) error {
+	plaintext, null, stale, err := decrypt(b.Crypter, src)
+	if err != nil {
+		return err
+	}
+	if !null && plaintext == nil {
+		plaintext = []byte{}
+	}
+	b.Bytes, b.Stale = plaintext, stale
+	return nil
+}
@@ -0,0 +1,103 @@
+package sqlcrypt
+
+import (
+	"bytes"
+	"database/sql"
+	"database/sql/driver"
+	"testing"
+
+	"github.com/dgryski/dkeyczar"
+)
+
+var (
+	_ driver.Valuer = EncryptedString{}
+	_ sql.Scanner   = (*EncryptedString)(nil)
+	_ driver.Valuer = EncryptedBytes{}
+	_ sql.Scanner   = (*EncryptedBytes)(nil)
+)
+
+// a key set held by a KeyManager
+type jsonsReader []string
+
+func (r jsonsReader) GetMetadata() (string, error) {
+	return r[0], nil
+}
+
+func (r jsonsReader) GetKey(version int) (string, error) {
+	return r[version], nil
+}
+
+// the key set of km as KeyManager.ToJSONs returns it, for keys that can't fail to encrypt
+func mustJSONs(km dkeyczar.KeyManager, encrypter dkeyczar.Encrypter) []string {
+	jsons, err := km.ToJSONs(encrypter)
+	if err != nil {
+		panic(err)
+	}
+	return jsons
+}
+
+func TestEncryptedColumns(t *testing.T) {
+	km := dkeyczar.NewKeyManager()
+	km.Create("sqlcrypt", dkeyczar.P_DECRYPT_AND_ENCRYPT, dkeyczar.T_AES)
+	km.AddKey(0, dkeyczar.S_PRIMARY)
+	oldCrypter, _ := dkeyczar.NewCrypter(jsonsReader(mustJSONs(km, nil)))
+
+	s := EncryptedString{String: "123-45-6789", Crypter: oldCrypter}
+	v, err := s.Value()
+	if err != nil {
+		t.Fatal("failed to encrypt string column: " + err.Error())
+	}
+	if v == "123-45-6789" {
+		t.Fatal("string column wasn't encrypted")
+	}
+	var got EncryptedString
+	if err := got.Scan(v); err != ErrNoCrypter {
+		t.Errorf("expected ErrNoCrypter without a Crypter, got %v", err)
+	}
+
+	km.AddKey(0, dkeyczar.S_PRIMARY)
+	crypter, _ := dkeyczar.NewCrypter(jsonsReader(mustJSONs(km, nil)))
+	SetCrypter(crypter)
+	defer SetCrypter(nil)
+	// drivers may hand text columns over as []byte
+	if err := got.Scan([]byte(v.(string))); err != nil {
+		t.Fatal("failed to decrypt string column: " + err.Error())
+	}
+	if got.String != s.String || got.Null || !got.Stale {
+		t.Errorf("string column from the old key mismatch: %+v", got)
+	}
+	// writing it back moves it to the primary key
+	v, _ = got.Value()
+	if err := got.Scan(v); err != nil || got.Stale {
+		t.Errorf("rewritten string column still stale: %+v %v", got, err)
+	}
+
+	if err := got.Scan(nil); err != nil || !got.Null {
+		t.Errorf("NULL string column mismatch: %+v %v", got, err)
+	}
+	if v, _ := got.Value(); v != nil {
+		t.Errorf("expected NULL for a Null string, got %v", v)
+	}
+	if err := got.Scan(int64(1)); err != ErrUnsupportedColumn {
+		t.Errorf("expected ErrUnsupportedColumn for an integer column, got %v", err)
+	}
+
+	b := EncryptedBytes{Bytes: []byte{0, 1, 2, 255}}
+	v, err = b.Value()
+	if err != nil {
+		t.Fatal("failed to encrypt bytes column: " + err.Error())
+	}
+	var gotBytes EncryptedBytes
+	if err := gotBytes.Scan(v); err != nil || !bytes.Equal(gotBytes.Bytes, b.Bytes) || gotBytes.Stale {
+		t.Errorf("bytes column mismatch: %+v %v", gotBytes, err)
+	}
+	if v, _ := (EncryptedBytes{}).Value(); v != nil {
+		t.Errorf("expected NULL for nil bytes, got %v", v)
+	}
+	if _, err := crypter.Decrypt("bogus"); err == nil {
+		t.Fatal("bogus ciphertext decrypted")
+	}
+	if err := gotBytes.Scan("bogus"); err == nil {
+		t.Error("bogus bytes column decrypted")
+	}
+}
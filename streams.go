@@ -125,8 +125,15 @@ func (cr *cryptoReader) Read(data []byte) (int, error) {
 			return 0, err
 		}
 		if cr.eof {
-			pad := cr.outBuf.Bytes()[cr.outBuf.Len()-1]
-			cr.outBuf.Truncate(cr.outBuf.Len() - int(pad))
+			if cr.outBuf.Len() < cr.bm.BlockSize() {
+				return 0, ErrShortCiphertext
+			}
+			last := cr.outBuf.Bytes()[cr.outBuf.Len()-cr.bm.BlockSize():]
+			unpadded, err := pkcs5unpad(last, cr.bm.BlockSize())
+			if err != nil {
+				return 0, err
+			}
+			cr.outBuf.Truncate(cr.outBuf.Len() - len(last) + len(unpadded))
 		}
 		missing = len(data) - cr.outBuf.Len()
 	}
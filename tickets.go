@@ -0,0 +1,90 @@
+package dkeyczar
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"io"
+	"sort"
+
+	"golang.org/x/crypto/hkdf"
+)
+
+// TLS session ticket keys derived from a symmetric key set, so ticket keys
+// rotate with the key set instead of by a separate mechanism.  Each version
+// gives one ticket key, derived with HKDF-SHA256 as by DeriveKeyVersion.  The
+// primary version's key issues tickets; the others only accept tickets issued
+// before the last rotation, until their versions are revoked.
+
+const sessionTicketInfo = "dkeyczar TLS session ticket key"
+
+// the Go crypto/tls ticket key size
+const sessionTicketKeySize = 32
+
+// SessionTicketKeys returns TLS session ticket keys derived from the symmetric key set in reader,
+// in the order tls.Config.SetSessionTicketKeys wants them: the primary version's first,
+// then the other versions' from the newest.
+func SessionTicketKeys(reader KeyReader) ([][sessionTicketKeySize]byte, error) {
+	raw, err := RawSessionTicketKeys(reader, sessionTicketKeySize)
+	if err != nil {
+		return nil, err
+	}
+	keys := make([][sessionTicketKeySize]byte, len(raw))
+	for i, k := range raw {
+		copy(keys[i][:], k)
+		wipeBytes(k)
+	}
+	return keys, nil
+}
+
+// RawSessionTicketKeys is like SessionTicketKeys, but derives keys of size bytes,
+// e.g. for the 48 or 80 byte ticket key files of nginx and HAProxy
+func RawSessionTicketKeys(reader KeyReader, size int) ([][]byte, error) {
+	if size <= 0 || size > maxDerivedKeyLength {
+		return nil, ErrInvalidLength
+	}
+	kz, err := newKeyCzar(reader)
+	if err != nil {
+		return nil, err
+	}
+	defer kz.wipe()
+	if err := kz.loadPrimaryKey(); err != nil {
+		return nil, err
+	}
+	versions := make([]int, 0, len(kz.keys))
+	for v := range kz.keys {
+		versions = append(versions, v)
+	}
+	sort.Slice(versions, func(i, j int) bool {
+		if (versions[i] == kz.primary) != (versions[j] == kz.primary) {
+			return versions[i] == kz.primary
+		}
+		return versions[i] > versions[j]
+	})
+	keys := make([][]byte, 0, len(versions))
+	for _, v := range versions {
+		sk, ok := kz.keys[v].(secretKey)
+		if !ok {
+			return nil, ErrNotDerivable
+		}
+		secret := sk.secret()
+		key := make([]byte, size)
+		_, err := io.ReadFull(hkdf.New(sha256.New, secret, nil, []byte(sessionTicketInfo)), key)
+		wipeBytes(secret)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+// SetSessionTicketKeys sets the session ticket keys of config from the symmetric key set in reader,
+// see SessionTicketKeys.  Call it again whenever the key set changes, e.g. from the Notify hook of a Rotator.
+func SetSessionTicketKeys(config *tls.Config, reader KeyReader) error {
+	keys, err := SessionTicketKeys(reader)
+	if err != nil {
+		return err
+	}
+	config.SetSessionTicketKeys(keys)
+	return nil
+}
@@ -0,0 +1,391 @@
+package dkeyczar
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/binary"
+	"encoding/json"
+	"math/big"
+	"sort"
+)
+
+// Conversion to and from Tink keysets, in the JSON format of Tink's
+// JsonKeysetReader and JsonKeysetWriter.  Each key is a serialized protobuf,
+// which is encoded and parsed here by hand to avoid the dependency.
+//
+// A converted key keeps its key material, and is given keyczar's key hash as
+// its Tink key ID with the LEGACY output prefix, which is keyczar's message
+// header.  The algorithms are each library's own: HMAC-SHA1 and RSA-PSS keys
+// make and check the same signatures in both, but Tink doesn't allow SHA-1
+// for ECDSA and RSA PKCS#1 signatures, so those keys are given SHA-256
+// (SHA-384 and SHA-512 for the larger curves) and their signatures differ;
+// AES keys become AES-CTR-HMAC keys, whose ciphertexts differ from keyczar's
+// AES-CBC ones.
+
+const tinkTypeURLPrefix = "type.googleapis.com/google.crypto.tink."
+
+// Tink type URLs, without tinkTypeURLPrefix
+const (
+	tinkAESCTRHMAC      = "AesCtrHmacAeadKey"
+	tinkAESGCM          = "AesGcmKey"
+	tinkHMAC            = "HmacKey"
+	tinkRSAPKCS1Private = "RsaSsaPkcs1PrivateKey"
+	tinkRSAPKCS1Public  = "RsaSsaPkcs1PublicKey"
+	tinkRSAPSSPrivate   = "RsaSsaPssPrivateKey"
+	tinkRSAPSSPublic    = "RsaSsaPssPublicKey"
+	tinkECDSAPrivate    = "EcdsaPrivateKey"
+	tinkECDSAPublic     = "EcdsaPublicKey"
+)
+
+// Tink HashType values
+const (
+	tinkSHA1   = 1
+	tinkSHA384 = 2
+	tinkSHA256 = 3
+	tinkSHA512 = 4
+)
+
+// Tink EllipticCurveType values, by curve size
+var tinkCurves = map[uint64]elliptic.Curve{
+	2: elliptic.P256(),
+	3: elliptic.P384(),
+	4: elliptic.P521(),
+}
+
+type tinkKeyDataJSON struct {
+	TypeURL         string `json:"typeUrl"`
+	Value           []byte `json:"value"`
+	KeyMaterialType string `json:"keyMaterialType"`
+}
+
+type tinkKeyJSON struct {
+	KeyData          tinkKeyDataJSON `json:"keyData"`
+	Status           string          `json:"status"`
+	KeyID            uint32          `json:"keyId"`
+	OutputPrefixType string          `json:"outputPrefixType"`
+}
+
+type tinkKeysetJSON struct {
+	PrimaryKeyID uint32        `json:"primaryKeyId"`
+	Key          []tinkKeyJSON `json:"key"`
+}
+
+// a protobuf message being built; fields with zero values are left out, as proto3 does
+type protoMessage []byte
+
+func (m protoMessage) varint(field int, v uint64) protoMessage {
+	if v == 0 {
+		return m
+	}
+	m = binary.AppendUvarint(m, uint64(field)<<3)
+	return binary.AppendUvarint(m, v)
+}
+
+func (m protoMessage) bytes(field int, b []byte) protoMessage {
+	if len(b) == 0 {
+		return m
+	}
+	m = binary.AppendUvarint(m, uint64(field)<<3|2)
+	m = binary.AppendUvarint(m, uint64(len(b)))
+	return append(m, b...)
+}
+
+// the fields of a parsed protobuf message; for repeated fields the last value wins
+type protoFields struct {
+	varints map[int]uint64
+	bytes   map[int][]byte
+}
+
+func parseProto(b []byte) (*protoFields, error) {
+	f := &protoFields{make(map[int]uint64), make(map[int][]byte)}
+	for len(b) > 0 {
+		tag, n := binary.Uvarint(b)
+		if n <= 0 {
+			return nil, ErrMalformedJSONKeySet
+		}
+		b = b[n:]
+		field := int(tag >> 3)
+		switch tag & 7 {
+		case 0:
+			v, n := binary.Uvarint(b)
+			if n <= 0 {
+				return nil, ErrMalformedJSONKeySet
+			}
+			f.varints[field], b = v, b[n:]
+		case 1:
+			if len(b) < 8 {
+				return nil, ErrMalformedJSONKeySet
+			}
+			b = b[8:]
+		case 2:
+			l, n := binary.Uvarint(b)
+			if n <= 0 || uint64(len(b)-n) < l {
+				return nil, ErrMalformedJSONKeySet
+			}
+			f.bytes[field], b = b[n:n+int(l)], b[n+int(l):]
+		case 5:
+			if len(b) < 4 {
+				return nil, ErrMalformedJSONKeySet
+			}
+			b = b[4:]
+		default:
+			return nil, ErrMalformedJSONKeySet
+		}
+	}
+	return f, nil
+}
+
+// return the field as a nested message
+func (f *protoFields) message(field int) (*protoFields, error) {
+	return parseProto(f.bytes[field])
+}
+
+func (f *protoFields) bigInt(field int) *big.Int {
+	return new(big.Int).SetBytes(f.bytes[field])
+}
+
+// encode a non-negative integer big-endian with a leading zero byte if its top bit is set,
+// as Tink's Java implementation does
+func tinkBigInt(i *big.Int) []byte {
+	b := i.Bytes()
+	if len(b) > 0 && b[0]&0x80 != 0 {
+		return append([]byte{0}, b...)
+	}
+	return b
+}
+
+// build the Tink type URL, key proto and key material type of a key
+func newTinkKeyData(k keydata) (string, protoMessage, string, error) {
+	switch k := k.(type) {
+	case *aesKey:
+		if len(k.key) != 16 && len(k.key) != 32 {
+			return "", nil, "", ErrInvalidKeySize
+		}
+		ctr := protoMessage(nil).bytes(2, protoMessage(nil).varint(1, 16)).bytes(3, k.key)
+		return tinkAESCTRHMAC, protoMessage(nil).bytes(2, ctr).bytes(3, newTinkHMACKey(k.hmac)), "SYMMETRIC", nil
+	case *hmacKey:
+		return tinkHMAC, newTinkHMACKey(k), "SYMMETRIC", nil
+	case *rsaKey:
+		url, pub := newTinkRSAPublicKey(&k.publicKey)
+		k.key.Precompute()
+		m := protoMessage(nil).bytes(2, pub).bytes(3, tinkBigInt(k.key.D)).
+			bytes(4, tinkBigInt(k.key.Primes[0])).bytes(5, tinkBigInt(k.key.Primes[1])).
+			bytes(6, tinkBigInt(k.key.Precomputed.Dp)).bytes(7, tinkBigInt(k.key.Precomputed.Dq)).
+			bytes(8, tinkBigInt(k.key.Precomputed.Qinv))
+		if url == tinkRSAPKCS1Public {
+			return tinkRSAPKCS1Private, m, "ASYMMETRIC_PRIVATE", nil
+		}
+		return tinkRSAPSSPrivate, m, "ASYMMETRIC_PRIVATE", nil
+	case *rsaPublicKey:
+		url, m := newTinkRSAPublicKey(k)
+		return url, m, "ASYMMETRIC_PUBLIC", nil
+	case *ecdsaKey:
+		pub, err := newTinkECDSAPublicKey(&k.publicKey.key)
+		if err != nil {
+			return "", nil, "", err
+		}
+		return tinkECDSAPrivate, protoMessage(nil).bytes(2, pub).bytes(3, tinkBigInt(k.key.D)), "ASYMMETRIC_PRIVATE", nil
+	case *ecdsaPublicKey:
+		m, err := newTinkECDSAPublicKey(&k.key)
+		return tinkECDSAPublic, m, "ASYMMETRIC_PUBLIC", err
+	}
+	return "", nil, "", ErrUnsupportedType
+}
+
+func newTinkHMACKey(k *hmacKey) protoMessage {
+	params := protoMessage(nil).varint(1, tinkSHA1).varint(2, hmacSigLength)
+	return protoMessage(nil).bytes(2, params).bytes(3, k.key)
+}
+
+func newTinkRSAPublicKey(k *rsaPublicKey) (string, protoMessage) {
+	url, params := tinkRSAPKCS1Public, protoMessage(nil).varint(1, tinkSHA256)
+	if k.scheme == SIG_PSS {
+		url = tinkRSAPSSPublic
+		params = protoMessage(nil).varint(1, tinkSHA256).varint(2, tinkSHA256).varint(3, 32)
+	}
+	return url, protoMessage(nil).bytes(2, params).bytes(3, tinkBigInt(k.key.N)).bytes(4, tinkBigInt(big.NewInt(int64(k.key.E))))
+}
+
+func newTinkECDSAPublicKey(k *ecdsa.PublicKey) (protoMessage, error) {
+	var curve uint64
+	for c, ec := range tinkCurves {
+		if ec == k.Curve {
+			curve = c
+		}
+	}
+	if curve == 0 {
+		return nil, ErrUnsupportedType
+	}
+	hash := map[uint64]uint64{2: tinkSHA256, 3: tinkSHA384, 4: tinkSHA512}[curve]
+	// DER signatures, as keyczar makes
+	params := protoMessage(nil).varint(1, hash).varint(2, curve).varint(3, 2)
+	return protoMessage(nil).bytes(2, params).bytes(3, tinkBigInt(k.X)).bytes(4, tinkBigInt(k.Y)), nil
+}
+
+// ExportTinkKeyset returns the key set in r as a cleartext Tink keyset in Tink's JSON format, for migrating to Tink.
+// AES, HMAC, RSA signing and EC key sets are supported, as AES-CTR-HMAC, HMAC, RSA-SSA-PKCS1 or RSA-SSA-PSS,
+// and ECDSA keys.  Primary and active keys are enabled and inactive ones disabled.
+// The result is unencrypted, so handle it with care.
+func ExportTinkKeyset(r KeyReader) ([]byte, error) {
+	kz, err := newKeyCzar(r)
+	if err != nil {
+		return nil, err
+	}
+	if kz.keymeta.Type == T_RSA_PRIV && kz.keymeta.Purpose != P_SIGN_AND_VERIFY ||
+		kz.keymeta.Type == T_RSA_PUB && kz.keymeta.Purpose != P_VERIFY {
+		// Tink has no RSA encryption
+		return nil, ErrUnsupportedType
+	}
+	versions := append([]KeyVersion(nil), kz.keymeta.Versions...)
+	sort.Slice(versions, func(i, j int) bool { return versions[i].VersionNumber < versions[j].VersionNumber })
+	ks := tinkKeysetJSON{Key: []tinkKeyJSON{}}
+	for _, kv := range versions {
+		k := kz.keys[kv.VersionNumber]
+		url, m, material, err := newTinkKeyData(k)
+		if err != nil {
+			return nil, err
+		}
+		tk := tinkKeyJSON{
+			KeyData:          tinkKeyDataJSON{tinkTypeURLPrefix + url, m, material},
+			Status:           "ENABLED",
+			KeyID:            binary.BigEndian.Uint32(k.KeyID()),
+			OutputPrefixType: "LEGACY",
+		}
+		if kv.Status == S_INACTIVE {
+			tk.Status = "DISABLED"
+		}
+		if kv.Status == S_PRIMARY {
+			ks.PrimaryKeyID = tk.KeyID
+		}
+		ks.Key = append(ks.Key, tk)
+	}
+	return json.Marshal(ks)
+}
+
+// convert a Tink key into its keyczar key type, purpose and key json
+func newKeyJSONFromTink(kd *tinkKeyDataJSON) (KeyType, KeyPurpose, []byte, error) {
+	if len(kd.TypeURL) <= len(tinkTypeURLPrefix) || kd.TypeURL[:len(tinkTypeURLPrefix)] != tinkTypeURLPrefix {
+		return 0, 0, nil, ErrUnsupportedType
+	}
+	f, err := parseProto(kd.Value)
+	if err != nil {
+		return 0, 0, nil, err
+	}
+	switch url := kd.TypeURL[len(tinkTypeURLPrefix):]; url {
+	case tinkAESCTRHMAC:
+		ctr, err := f.message(2)
+		if err != nil {
+			return 0, 0, nil, err
+		}
+		hm, err := f.message(3)
+		if err != nil {
+			return 0, 0, nil, err
+		}
+		b, err := json.Marshal(newAESJSONFromKey(&aesKey{key: ctr.bytes[3], hmac: &hmacKey{key: hm.bytes[3]}}))
+		return T_AES, P_DECRYPT_AND_ENCRYPT, b, err
+	case tinkHMAC:
+		b, err := json.Marshal(newHMACJSONFromKey(&hmacKey{key: f.bytes[3]}))
+		return T_HMAC_SHA1, P_SIGN_AND_VERIFY, b, err
+	case tinkRSAPKCS1Private, tinkRSAPSSPrivate, tinkRSAPKCS1Public, tinkRSAPSSPublic:
+		scheme := SIG_PKCS1
+		if url == tinkRSAPSSPrivate || url == tinkRSAPSSPublic {
+			scheme = SIG_PSS
+		}
+		pf := f
+		if url == tinkRSAPKCS1Private || url == tinkRSAPSSPrivate {
+			if pf, err = f.message(2); err != nil {
+				return 0, 0, nil, err
+			}
+		}
+		pub := rsa.PublicKey{N: pf.bigInt(3), E: int(pf.bigInt(4).Int64())}
+		if pf == f {
+			b, err := json.Marshal(newRSAPublicJSONFromKey(&pub, scheme))
+			return T_RSA_PUB, P_VERIFY, b, err
+		}
+		priv := &rsa.PrivateKey{PublicKey: pub, D: f.bigInt(3), Primes: []*big.Int{f.bigInt(4), f.bigInt(5)}}
+		if err := priv.Validate(); err != nil {
+			return 0, 0, nil, err
+		}
+		priv.Precompute()
+		b, err := json.Marshal(newRSAJSONFromKey(priv, scheme))
+		return T_RSA_PRIV, P_SIGN_AND_VERIFY, b, err
+	case tinkECDSAPrivate, tinkECDSAPublic:
+		pf := f
+		if url == tinkECDSAPrivate {
+			if pf, err = f.message(2); err != nil {
+				return 0, 0, nil, err
+			}
+		}
+		params, err := pf.message(2)
+		if err != nil {
+			return 0, 0, nil, err
+		}
+		curve, ok := tinkCurves[params.varints[2]]
+		if !ok {
+			return 0, 0, nil, ErrUnsupportedType
+		}
+		pub := ecdsa.PublicKey{Curve: curve, X: pf.bigInt(3), Y: pf.bigInt(4)}
+		if !curve.IsOnCurve(pub.X, pub.Y) {
+			return 0, 0, nil, ErrUnsupportedType
+		}
+		if pf == f {
+			b, err := json.Marshal(newECDSAPublicJSONFromKey(&pub))
+			return T_EC_PUB, P_VERIFY, b, err
+		}
+		b, err := json.Marshal(newECDSAJSONFromKey(&ecdsa.PrivateKey{PublicKey: pub, D: f.bigInt(3)}))
+		return T_EC_PRIV, P_SIGN_AND_VERIFY, b, err
+	case tinkAESGCM:
+		// keyczar has no AES-GCM key type
+	}
+	return 0, 0, nil, ErrUnsupportedType
+}
+
+// ImportTinkKeyset returns a KeyReader for a cleartext Tink keyset in Tink's JSON format, as written by ExportTinkKeyset.
+// AES-CTR-HMAC, HMAC, RSA-SSA-PKCS1, RSA-SSA-PSS and ECDSA keys are supported, all of the same kind;
+// AES-GCM keys have no keyczar counterpart and fail with ErrUnsupportedType.
+// The keys become versions 1, 2, ... in keyset order: enabled keys are active, or primary for the
+// primary key, disabled keys inactive, and destroyed keys are left out.
+// The keys are used with keyczar's algorithms, as described for ExportTinkKeyset.
+func ImportTinkKeyset(data []byte) (KeyReader, error) {
+	ks := new(tinkKeysetJSON)
+	if err := json.Unmarshal(data, ks); err != nil {
+		return nil, err
+	}
+	r := new(importedKeySetReader)
+	r.km.Name = "Imported Tink Keyset"
+	r.keys = make(map[int]string)
+	for i := range ks.Key {
+		tk := &ks.Key[i]
+		var status KeyStatus
+		switch tk.Status {
+		case "ENABLED":
+			status = S_ACTIVE
+			if tk.KeyID == ks.PrimaryKeyID {
+				status = S_PRIMARY
+			}
+		case "DISABLED":
+			status = S_INACTIVE
+		case "DESTROYED":
+			continue
+		default:
+			return nil, ErrInvalidKeyStatus
+		}
+		kt, kp, b, err := newKeyJSONFromTink(&tk.KeyData)
+		if err != nil {
+			return nil, err
+		}
+		if len(r.km.Versions) == 0 {
+			r.km.Type, r.km.Purpose = kt, kp
+		} else if kt != r.km.Type || kp != r.km.Purpose {
+			return nil, ErrUnsupportedType
+		}
+		version := len(r.km.Versions) + 1
+		r.km.Versions = append(r.km.Versions, KeyVersion{VersionNumber: version, Status: status})
+		r.keys[version] = string(b)
+	}
+	if len(r.km.Versions) == 0 {
+		return nil, ErrKeyNotFound
+	}
+	return r, nil
+}
@@ -2,6 +2,7 @@ package dkeyczar
 
 import (
 	"bytes"
+	"crypto/subtle"
 	"encoding/base64"
 	"encoding/binary"
 	"io"
@@ -10,7 +11,7 @@ import (
 
 func bigIntBytes(value *big.Int) []byte {
 	absbytes := value.Bytes()
-	if absbytes[0]&0x80 != 0x00 {
+	if len(absbytes) > 0 && absbytes[0]&0x80 != 0x00 {
 		zero := []byte{0x00}
 		return append(zero, absbytes...)
 	}
@@ -36,7 +37,7 @@ func decodeWeb64String(key string) ([]byte, error) {
 func encodeWeb64String(b []byte) string {
 	s := base64.URLEncoding.EncodeToString(b)
 	var i = len(s) - 1
-	for s[i] == '=' {
+	for i >= 0 && s[i] == '=' {
 		i--
 	}
 	return s[0 : i+1]
@@ -63,18 +64,32 @@ func lenPrefixPack(arrays ...[]byte) []byte {
 }
 
 // Unpack a list of arrays packed with lenPrefixPack
-func lenPrefixUnpack(packed []byte) [][]byte {
-	var numArrays uint32
-	buf := bytes.NewBuffer(packed)
-	binary.Read(buf, binary.BigEndian, &numArrays)
+// The counts and lengths are checked against the data left before anything is
+// allocated, so a corrupt or hostile length can't make us allocate more than it.
+func lenPrefixUnpack(packed []byte) ([][]byte, error) {
+	if len(packed) < 4 {
+		return nil, ErrBadCiphertextFormat
+	}
+	numArrays := binary.BigEndian.Uint32(packed)
+	packed = packed[4:]
+	if uint64(numArrays) > uint64(len(packed)/4) {
+		return nil, ErrBadCiphertextFormat
+	}
 	arrays := make([][]byte, numArrays)
-	for i := uint32(0); i < numArrays; i++ {
-		var size uint32
-		binary.Read(buf, binary.BigEndian, &size)
+	for i := range arrays {
+		if len(packed) < 4 {
+			return nil, ErrBadCiphertextFormat
+		}
+		size := binary.BigEndian.Uint32(packed)
+		packed = packed[4:]
+		if uint64(size) > uint64(len(packed)) {
+			return nil, ErrBadCiphertextFormat
+		}
 		arrays[i] = make([]byte, size)
-		buf.Read(arrays[i])
+		copy(arrays[i], packed)
+		packed = packed[size:]
 	}
-	return arrays
+	return arrays, nil
 }
 
 // only needed by AES?
@@ -87,10 +102,24 @@ func pkcs5pad(data []byte, blocksize int) []byte {
 	return append(data, b...)
 }
 
-func pkcs5unpad(data []byte) []byte {
+// pkcs5unpad strips the padding added by pkcs5pad.  The padding is checked in
+// constant time, so that how it's wrong doesn't leak through timing.
+func pkcs5unpad(data []byte, blocksize int) ([]byte, error) {
+	if len(data) == 0 || len(data)%blocksize != 0 {
+		return nil, ErrBadCiphertextFormat
+	}
 	pad := int(data[len(data)-1])
-	// FIXME: check that the padding bytes are all what we expect
-	return data[:len(data)-pad]
+	good := subtle.ConstantTimeLessOrEq(1, pad) & subtle.ConstantTimeLessOrEq(pad, blocksize)
+	for i := 1; i <= blocksize; i++ {
+		// only the last pad bytes have to equal pad
+		inPad := subtle.ConstantTimeLessOrEq(i, pad)
+		same := subtle.ConstantTimeByteEq(data[len(data)-i], uint8(pad))
+		good &= subtle.ConstantTimeSelect(inPad, same, 1)
+	}
+	if good != 1 {
+		return nil, ErrBadCiphertextFormat
+	}
+	return data[:len(data)-pad], nil
 }
 
 //Close wrappers
@@ -0,0 +1,160 @@
+package dkeyczar
+
+import (
+	"math/big"
+)
+
+// A Wiper holds key material that it can zero once it is no longer needed.
+// Go gives no control over copies made by the garbage collector or the
+// standard library, so this limits how long secrets stay around rather than
+// guaranteeing they are gone.
+// The Crypters, Encrypters, Signers and Verifiers made from key sets, the
+// PBE crypters and the imported key readers are Wipers.
+type Wiper interface {
+	// Wipe zeroes the key material.  The object can't be used afterwards.
+	Wipe()
+}
+
+func wipeBytes(b []byte) {
+	for i := range b {
+		b[i] = 0
+	}
+}
+
+func wipeBigInt(x *big.Int) {
+	if x == nil {
+		return
+	}
+	w := x.Bits()
+	for i := range w {
+		w[i] = 0
+	}
+	x.SetInt64(0)
+}
+
+// zero the secret parts of a key; public keys have nothing to wipe
+func wipeKeydata(k keydata) {
+	switch k := k.(type) {
+	case *aesKey:
+		wipeBytes(k.key)
+		// the expanded key can't be zeroed, so drop it and make sure it isn't rebuilt
+		k.once.Do(func() {})
+		k.block, k.blockErr = nil, ErrInvalidKeySize
+		if k.hmac != nil {
+			wipeHMACKey(k.hmac)
+		}
+	case *hmacKey:
+		wipeHMACKey(k)
+	case *chachaKey:
+		wipeBytes(k.key)
+		k.once.Do(func() {})
+		k.aead, k.aeadErr = nil, ErrInvalidKeySize
+	case *aesSIVKey:
+		wipeBytes(k.key)
+		k.once.Do(func() {})
+		k.mac, k.ctr, k.blockErr = nil, nil, ErrInvalidKeySize
+	case *rsaKey:
+		wipeBigInt(k.key.D)
+		for _, p := range k.key.Primes {
+			wipeBigInt(p)
+		}
+		wipeBigInt(k.key.Precomputed.Dp)
+		wipeBigInt(k.key.Precomputed.Dq)
+		wipeBigInt(k.key.Precomputed.Qinv)
+		for _, crt := range k.key.Precomputed.CRTValues {
+			wipeBigInt(crt.Exp)
+			wipeBigInt(crt.Coeff)
+			wipeBigInt(crt.R)
+		}
+	case *dsaKey:
+		wipeBigInt(k.key.X)
+	case *ecdsaKey:
+		wipeBigInt(k.key.D)
+	case *ed25519Key:
+		wipeBytes(k.key)
+	case *x25519Key:
+		wipeBytes(k.key)
+	}
+}
+
+func wipeHMACKey(k *hmacKey) {
+	wipeBytes(k.key)
+	// drop the cached hmac states, which hold the key
+	for k.pool.Get() != nil {
+	}
+}
+
+// zero every key and forget the key set, so later operations fail instead of using zero keys
+func (kz *keyCzar) wipe() {
+	kz.reloading.Lock()
+	defer kz.reloading.Unlock()
+	kz.mu.Lock()
+	defer kz.mu.Unlock()
+	for _, k := range kz.keys {
+		wipeKeydata(k)
+	}
+	kz.keys = make(map[int]keydata)
+	kz.idkeys = make(map[uint32][]keydata)
+	kz.lazy = nil
+	kz.primary = -1
+	// and don't bring the keys back
+	kz.load = nil
+}
+
+// Wipe zeroes the keys of the encrypter or crypter
+func (kc *keyEncrypter) Wipe() {
+	kc.kz.wipe()
+}
+
+// Wipe zeroes the keys of the signer or verifier
+func (ks *keySigner) Wipe() {
+	ks.kz.wipe()
+}
+
+// Wipe zeroes the encryption keys.  The signer is left alone, as it may be shared.
+func (kc *keySignedEncypter) Wipe() {
+	kc.kz.wipe()
+}
+
+// Wipe zeroes the decryption keys.  The verifier is left alone, as it may be shared.
+func (kc *keySignedDecrypter) Wipe() {
+	kc.kz.wipe()
+}
+
+// Wipe zeroes the password
+func (c *pbeCrypter) Wipe() {
+	wipeBytes(c.password)
+}
+
+// The imported readers only hold the key as encoded strings, which Go can't
+// zero in place, so Wipe just drops them to let the garbage collector have them.
+
+// Wipe drops the imported key
+func (r *importedRSAPrivateKeyReader) Wipe() {
+	r.rsajson = rsaKeyJSON{}
+}
+
+// Wipe drops the imported key
+func (r *importedAESKeyReader) Wipe() {
+	r.aesjson = aesKeyJSON{}
+}
+
+// Wipe drops the imported key
+func (r *importedDSAPrivateKeyReader) Wipe() {
+	r.dsajson = dsaKeyJSON{}
+}
+
+// Wipe drops the imported key
+func (r *importedECDSAPrivateKeyReader) Wipe() {
+	r.ecjson = ecdsaKeyJSON{}
+}
+
+// Wipe drops the imported key
+func (r *importedEd25519PrivateKeyReader) Wipe() {
+	r.edjson = ed25519KeyJSON{}
+}
+
+// Wipe drops the imported keys
+func (r *importedKeySetReader) Wipe() {
+	r.keys = make(map[int]string)
+}
@@ -0,0 +1,63 @@
+package dkeyczar
+
+// Key wrapping: secrets from other systems, like database encryption keys or
+// TLS session ticket keys, encrypted under a key set acting as the KEK.  A
+// wrapped key is an ordinary ciphertext of the key set, but made with the
+// associated data below, so a wrapped key never decrypts as a message and a
+// message never unwraps as a key.  Compression and padding are not applied.
+
+const wrapAAD = "dkeyczar wrapped key"
+
+// A KeyWrapper wraps secrets under its primary key.  The Encrypters and Crypters made from
+// AES, ChaCha20-Poly1305, X25519 and RSA key sets are KeyWrappers.
+type KeyWrapper interface {
+	// WrapKey returns the secret encrypted as a wrapped key
+	WrapKey(secret []byte) (string, error)
+}
+
+// A KeyUnwrapper wraps and unwraps secrets.  The Crypters made from
+// AES, ChaCha20-Poly1305, X25519 and RSA key sets are KeyUnwrappers.
+type KeyUnwrapper interface {
+	KeyWrapper
+	// UnwrapKey returns the secret of a wrapped key made by WrapKey
+	UnwrapKey(wrapped string) ([]byte, error)
+}
+
+// WrapKey encrypts secret with the primary key as a wrapped key
+func (kc *keyEncrypter) WrapKey(secret []byte) (string, error) {
+	key, err := kc.kz.primaryKey()
+	if err != nil {
+		return "", err
+	}
+	wk, ok := key.(aadEncryptKey)
+	if !ok {
+		return "", ErrUnsupportedType
+	}
+	ciphertext, err := wk.encryptWithAAD(secret, []byte(wrapAAD))
+	if err != nil {
+		return "", err
+	}
+	if err := kc.checkIV(kc.kz, key, ciphertext); err != nil {
+		return "", err
+	}
+	return kc.encode(ciphertext), nil
+}
+
+// UnwrapKey decrypts a wrapped key made by WrapKey and returns the secret
+func (kc *keyCrypter) UnwrapKey(wrapped string) ([]byte, error) {
+	b, kl, err := splitHeader(kc.encodingController, kc.kz, wrapped, ErrShortCiphertext)
+	if err != nil {
+		return nil, err
+	}
+	for _, k := range kl {
+		wk, ok := k.(aadDecryptKey)
+		if !ok {
+			return nil, ErrUnsupportedType
+		}
+		var secret []byte
+		if secret, err = wk.decryptWithAAD(b, []byte(wrapAAD)); err == nil {
+			return secret, nil
+		}
+	}
+	return nil, &DecryptError{err}
+}
@@ -0,0 +1,100 @@
+package dkeyczar
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
+// KeyWriter stores a key set, the counterpart of a KeyReader
+type KeyWriter interface {
+	// WriteKeyset stores the metadata and keys of a key set as returned by
+	// KeyManager.ToJSONs: the metadata first, then each version, empty for revoked versions
+	WriteKeyset(jsons []string) error
+}
+
+type fileWriter struct {
+	location string
+}
+
+// NewFileWriter returns a KeyWriter that writes key sets to the directory location,
+// in the layout NewFileReader reads, creating it if needed.  Each file is replaced
+// atomically, and the metadata only after the keys it lists, so a reader of the
+// directory sees either the old key set or the new one.
+func NewFileWriter(location string) KeyWriter {
+	return &fileWriter{location}
+}
+
+// write data to a temporary file next to name and rename it into place
+func writeFileAtomic(name string, data []byte) error {
+	f, err := ioutil.TempFile(filepath.Dir(name), "."+filepath.Base(name))
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Chmod(f.Name(), 0600)
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), name)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+	}
+	return err
+}
+
+func (w *fileWriter) WriteKeyset(jsons []string) error {
+	if len(jsons) == 0 {
+		return ErrMalformedJSONKeySet
+	}
+	// only versions the metadata doesn't list are revoked; a listed version without a key is a mistake
+	var meta KeyMeta
+	if err := json.Unmarshal([]byte(jsons[0]), &meta); err != nil {
+		return ErrMalformedJSONKeySet
+	}
+	listed := make(map[int]bool)
+	for _, kv := range meta.Versions {
+		if kv.VersionNumber < 1 || kv.VersionNumber >= len(jsons) || jsons[kv.VersionNumber] == "" {
+			return ErrMalformedJSONKeySet
+		}
+		listed[kv.VersionNumber] = true
+	}
+	if err := os.MkdirAll(w.location, 0700); err != nil {
+		return err
+	}
+	for v := 1; v < len(jsons); v++ {
+		if !listed[v] {
+			continue
+		}
+		if err := writeFileAtomic(filepath.Join(w.location, strconv.Itoa(v)), []byte(jsons[v])); err != nil {
+			return err
+		}
+	}
+	if err := writeFileAtomic(filepath.Join(w.location, "meta"), []byte(jsons[0])); err != nil {
+		return err
+	}
+	// the new metadata no longer lists the revoked versions, including any past the last one left
+	files, err := ioutil.ReadDir(w.location)
+	if err != nil {
+		return err
+	}
+	for _, fi := range files {
+		v, err := strconv.Atoi(fi.Name())
+		if err != nil || v < 1 || listed[v] {
+			continue
+		}
+		if err := os.Remove(filepath.Join(w.location, fi.Name())); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,239 @@
+package dkeyczar
+
+import (
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/json"
+	"io"
+
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/hkdf"
+)
+
+// X25519 keys provide ECIES-style hybrid encryption: every message carries a
+// fresh ephemeral public key, and the shared secret is run through HKDF-SHA256
+// to key ChaCha20-Poly1305.  The data array looks like:
+// |header|ephemeral public key|ciphertext+tag|
+// The header is authenticated as additional data.
+const x25519Info = "dkeyczar X25519 ChaCha20-Poly1305"
+
+type x25519PublicKeyJSON struct {
+	PublicBytes string `json:"publicBytes"`
+	Size        uint   `json:"size"`
+}
+
+type x25519PublicKey struct {
+	key []byte
+	id  []byte
+	randSource
+}
+
+type x25519KeyJSON struct {
+	PublicKey  x25519PublicKeyJSON `json:"publicKey"`
+	PrivateKey string              `json:"privateKey"`
+	Size       uint                `json:"size"`
+}
+
+type x25519Key struct {
+	key       []byte
+	publicKey x25519PublicKey
+}
+
+func generateX25519Key(rng io.Reader) (*x25519Key, error) {
+	xk := new(x25519Key)
+	xk.key = make([]byte, curve25519.ScalarSize)
+	if _, err := io.ReadFull(rng, xk.key); err != nil {
+		return nil, err
+	}
+	pub, err := curve25519.X25519(xk.key, curve25519.Basepoint)
+	if err != nil {
+		return nil, err
+	}
+	xk.publicKey.key = pub
+	return xk, nil
+}
+
+func newX25519PublicKeyFromJSON(s []byte) (*x25519PublicKey, error) {
+	xk := new(x25519PublicKey)
+	xjson := new(x25519PublicKeyJSON)
+	var err error
+	err = json.Unmarshal(s, &xjson)
+	if err != nil {
+		return nil, err
+	}
+	if !T_X25519_PUB.isAcceptableSize(xjson.Size) {
+		return nil, ErrInvalidKeySize
+	}
+	xk.key, err = decodeWeb64String(xjson.PublicBytes)
+	if err != nil {
+		return nil, ErrBase64Decoding
+	}
+	if len(xk.key) != curve25519.PointSize {
+		return nil, ErrInvalidKeySize
+	}
+	return xk, nil
+}
+
+func newX25519PublicJSONFromKey(key []byte) *x25519PublicKeyJSON {
+	xjson := new(x25519PublicKeyJSON)
+	xjson.PublicBytes = encodeWeb64String(key)
+	xjson.Size = uint(len(key)) * 8
+	return xjson
+}
+
+func (xk *x25519PublicKey) ToKeyJSON() []byte {
+	j := newX25519PublicJSONFromKey(xk.key)
+	s, _ := json.Marshal(j)
+	return s
+}
+
+func newX25519KeyFromJSON(s []byte) (*x25519Key, error) {
+	xk := new(x25519Key)
+	xjson := new(x25519KeyJSON)
+	var err error
+	err = json.Unmarshal(s, &xjson)
+	if err != nil {
+		return nil, err
+	}
+	if !T_X25519_PRIV.isAcceptableSize(xjson.Size) || !T_X25519_PUB.isAcceptableSize(xjson.PublicKey.Size) {
+		return nil, ErrInvalidKeySize
+	}
+	xk.key, err = decodeWeb64String(xjson.PrivateKey)
+	if err != nil {
+		return nil, ErrBase64Decoding
+	}
+	if len(xk.key) != curve25519.ScalarSize {
+		return nil, ErrInvalidKeySize
+	}
+	xk.publicKey.key, err = curve25519.X25519(xk.key, curve25519.Basepoint)
+	if err != nil {
+		return nil, err
+	}
+	return xk, nil
+}
+
+func newX25519JSONFromKey(xk *x25519Key) *x25519KeyJSON {
+	xjson := new(x25519KeyJSON)
+	xjson.PrivateKey = encodeWeb64String(xk.key)
+	xjson.PublicKey = *newX25519PublicJSONFromKey(xk.publicKey.key)
+	xjson.Size = uint(len(xk.key)) * 8
+	return xjson
+}
+
+func (xk *x25519Key) ToKeyJSON() []byte {
+	j := newX25519JSONFromKey(xk)
+	s, _ := json.Marshal(j)
+	return s
+}
+
+func (xk *x25519PublicKey) KeyID() []byte {
+	if len(xk.id) != 0 {
+		return xk.id
+	}
+	h := sha1.New()
+	h.Write(xk.key)
+	xk.id = h.Sum(nil)[:4]
+	return xk.id
+}
+
+func (xk *x25519Key) KeyID() []byte {
+	return xk.publicKey.KeyID()
+}
+
+// derive the per-message AEAD key from the shared secret and both public keys
+func x25519AEADKey(shared, ephemeral, recipient []byte) ([]byte, error) {
+	salt := make([]byte, 0, len(ephemeral)+len(recipient))
+	salt = append(salt, ephemeral...)
+	salt = append(salt, recipient...)
+	key := make([]byte, chacha20poly1305.KeySize)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, shared, salt, []byte(x25519Info)), key); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+func (xk *x25519PublicKey) Encrypt(msg []byte) ([]byte, error) {
+	return xk.encryptWithAAD(msg, nil)
+}
+
+func (xk *x25519PublicKey) encryptWithAAD(msg []byte, aad []byte) ([]byte, error) {
+	ephemeral := make([]byte, curve25519.ScalarSize)
+	if _, err := io.ReadFull(xk.random(), ephemeral); err != nil {
+		return nil, err
+	}
+	ephemeralPublic, err := curve25519.X25519(ephemeral, curve25519.Basepoint)
+	if err != nil {
+		return nil, err
+	}
+	shared, err := curve25519.X25519(ephemeral, xk.key)
+	if err != nil {
+		return nil, err
+	}
+	key, err := x25519AEADKey(shared, ephemeralPublic, xk.key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := chacha20poly1305.New(key)
+	if err != nil {
+		return nil, err
+	}
+	// the key is never reused, so a zero nonce is safe
+	nonce := make([]byte, aead.NonceSize())
+	h := makeHeader(xk)
+	out := make([]byte, 0, kzHeaderLength+len(ephemeralPublic)+len(msg)+aead.Overhead())
+	out = append(out, h...)
+	out = append(out, ephemeralPublic...)
+	return aead.Seal(out, nonce, msg, chachaAD(h, aad)), nil
+}
+
+// the ephemeral public key stands in for the IV, as the AEAD nonce is always zero
+func (xk *x25519PublicKey) iv(ciphertext []byte) []byte {
+	return ciphertext[kzHeaderLength : kzHeaderLength+curve25519.PointSize]
+}
+
+func (xk *x25519Key) iv(ciphertext []byte) []byte {
+	return xk.publicKey.iv(ciphertext)
+}
+
+func (xk *x25519Key) setRand(rng io.Reader) {
+	xk.publicKey.setRand(rng)
+}
+
+func (xk *x25519Key) Encrypt(msg []byte) ([]byte, error) {
+	return xk.publicKey.Encrypt(msg)
+}
+
+func (xk *x25519Key) encryptWithAAD(msg []byte, aad []byte) ([]byte, error) {
+	return xk.publicKey.encryptWithAAD(msg, aad)
+}
+
+func (xk *x25519Key) Decrypt(data []byte) ([]byte, error) {
+	return xk.decryptWithAAD(data, nil)
+}
+
+func (xk *x25519Key) decryptWithAAD(data []byte, aad []byte) ([]byte, error) {
+	if len(data) < kzHeaderLength+curve25519.PointSize+chacha20poly1305.Overhead {
+		return nil, ErrShortCiphertext
+	}
+	h := data[:kzHeaderLength]
+	ephemeralPublic := data[kzHeaderLength : kzHeaderLength+curve25519.PointSize]
+	shared, err := curve25519.X25519(xk.key, ephemeralPublic)
+	if err != nil {
+		return nil, err
+	}
+	key, err := x25519AEADKey(shared, ephemeralPublic, xk.publicKey.key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := chacha20poly1305.New(key)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	plaintext, err := aead.Open(nil, nonce, data[kzHeaderLength+curve25519.PointSize:], chachaAD(h, aad))
+	if err != nil {
+		return nil, ErrInvalidSignature
+	}
+	return plaintext, nil
+}